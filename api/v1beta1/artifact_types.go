@@ -39,10 +39,32 @@ type Artifact struct {
 	// +optional
 	Revision string `json:"revision"`
 
-	// Checksum is the SHA1 checksum of the artifact.
+	// Checksum is the SHA256 checksum of the artifact, or the SHA1 checksum
+	// of an artifact created by a previous version of the controller.
 	// +optional
 	Checksum string `json:"checksum"`
 
+	// Digest is the checksum of the artifact prefixed with its algorithm,
+	// in the form of '<algorithm>:<checksum>', e.g. 'sha256:<checksum>'. The
+	// algorithm is 'sha256', 'sha384' or 'sha512', as configured for the
+	// controller. It is empty for an artifact created by a previous version
+	// of the controller.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// Signature is the base64 encoded signature of the SHA256 checksum of
+	// the artifact, made with the signing key of the controller. It is also
+	// served next to the artifact, at its URL with the '.sig' extension. It
+	// is empty when the controller has no signing key.
+	// +optional
+	Signature string `json:"signature,omitempty"`
+
+	// Size is the size in bytes of the file of the artifact, recorded with
+	// its checksum. It is empty for an artifact created by a previous version
+	// of the controller, until the artifact is verified.
+	// +optional
+	Size *int64 `json:"size,omitempty"`
+
 	// LastUpdateTime is the timestamp corresponding to the last update of this
 	// artifact.
 	// +required
@@ -19,6 +19,7 @@ package v1beta1
 import (
 	"github.com/fluxcd/pkg/apis/meta"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,7 +31,7 @@ const (
 // BucketSpec defines the desired state of an S3 compatible bucket
 type BucketSpec struct {
 	// The S3 compatible storage provider name, default ('generic').
-	// +kubebuilder:validation:Enum=generic;aws
+	// +kubebuilder:validation:Enum=generic;aws;gcp;azure
 	// +kubebuilder:default:=generic
 	// +optional
 	Provider string `json:"provider,omitempty"`
@@ -39,11 +40,18 @@ type BucketSpec struct {
 	// +required
 	BucketName string `json:"bucketName"`
 
+	// The prefix used for server-side filtering of the bucket objects, only
+	// objects with a key starting with the prefix are included in the artifact.
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
 	// The bucket endpoint address.
 	// +required
 	Endpoint string `json:"endpoint"`
 
-	// Insecure allows connecting to a non-TLS S3 HTTP endpoint.
+	// Insecure allows connecting to a non-TLS S3 HTTP endpoint, or skips the
+	// verification of the certificate of an endpoint with an 'https://'
+	// scheme.
 	// +optional
 	Insecure bool `json:"insecure,omitempty"`
 
@@ -56,12 +64,27 @@ type BucketSpec struct {
 	// +optional
 	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
 
+	// ProxySecretRef is the name of the secret containing the proxy through
+	// which the objects of the Bucket are fetched, instead of the proxy of
+	// the environment of the controller. The secret must contain the URL of
+	// the proxy in the address field, and may contain username, password and
+	// no_proxy fields.
+	// +optional
+	ProxySecretRef *meta.LocalObjectReference `json:"proxySecretRef,omitempty"`
+
+	// STS configures the Security Token Service used to obtain temporary
+	// credentials for the Bucket, supported only for the 'generic' and 'aws'
+	// providers.
+	// +optional
+	STS *BucketSTSSpec `json:"sts,omitempty"`
+
 	// The interval at which to check for bucket updates.
-	// +required
+	// Defaults to the default interval of the controller, if it has one.
+	// +optional
 	Interval metav1.Duration `json:"interval"`
 
-	// The timeout for download operations, defaults to 20s.
-	// +kubebuilder:default="20s"
+	// The timeout for download operations, defaults to the default timeout of
+	// the controller, 20s if it has none.
 	// +optional
 	Timeout *metav1.Duration `json:"timeout,omitempty"`
 
@@ -71,14 +94,74 @@ type BucketSpec struct {
 	// +optional
 	Ignore *string `json:"ignore,omitempty"`
 
+	// MaxObjects is the maximum number of objects included in the artifact,
+	// overriding the default of the controller. Zero means unlimited.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxObjects *int64 `json:"maxObjects,omitempty"`
+
+	// MaxSize is the maximum total size of the objects included in the
+	// artifact, overriding the default of the controller. Zero means
+	// unlimited.
+	// +optional
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+
+	// MaxArtifactSize is the maximum size of the artifact, overriding the
+	// default of the controller. A size larger than the maximum of the
+	// controller is capped at the maximum of the controller. Zero uses the
+	// default.
+	// +optional
+	MaxArtifactSize *resource.Quantity `json:"maxArtifactSize,omitempty"`
+
+	// RetryInterval is the maximum interval between the retries of the
+	// reconciliation after a failure, capping the exponential backoff of the
+	// controller. Defaults to the maximum retry delay of the controller.
+	// +optional
+	RetryInterval *metav1.Duration `json:"retryInterval,omitempty"`
+
+	// IncludeMetadataManifest adds a manifest with the content type, ETag
+	// and size of every object to the root of the artifact.
+	// +optional
+	IncludeMetadataManifest bool `json:"includeMetadataManifest,omitempty"`
+
+	// IncludeFolderMarkers includes the zero-byte objects with a key ending
+	// in a slash, which are created as folder placeholders by e.g. the AWS
+	// console, as empty directories in the artifact. They are skipped by
+	// default.
+	// +optional
+	IncludeFolderMarkers bool `json:"includeFolderMarkers,omitempty"`
+
 	// This flag tells the controller to suspend the reconciliation of this source.
 	// +optional
 	Suspend bool `json:"suspend,omitempty"`
 }
 
+// BucketSTSSpec specifies the Security Token Service used to exchange a web
+// identity token, or the credentials of the Bucket secret, for temporary
+// credentials.
+type BucketSTSSpec struct {
+	// Endpoint is the HTTP/S endpoint of the Security Token Service.
+	// +kubebuilder:validation:Pattern="^(http|https)://.*$"
+	// +required
+	Endpoint string `json:"endpoint"`
+
+	// RoleARN is the Amazon Resource Name of the role to assume.
+	// +optional
+	RoleARN string `json:"roleARN,omitempty"`
+
+	// WebIdentityTokenSecretRef is a reference to a Secret with a 'token'
+	// field containing the web identity (JWT) used for
+	// AssumeRoleWithWebIdentity. When not specified, the credentials of the
+	// Bucket secret are used for AssumeRole.
+	// +optional
+	WebIdentityTokenSecretRef *meta.LocalObjectReference `json:"webIdentityTokenSecretRef,omitempty"`
+}
+
 const (
 	GenericBucketProvider string = "generic"
 	AmazonBucketProvider  string = "aws"
+	GoogleBucketProvider  string = "gcp"
+	AzureBucketProvider   string = "azure"
 )
 
 // BucketStatus defines the observed state of a bucket
@@ -99,6 +182,37 @@ type BucketStatus struct {
 	// +optional
 	Artifact *Artifact `json:"artifact,omitempty"`
 
+	// Region is the effective region of the bucket, as configured in the
+	// spec or detected from the storage service.
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// NextRetryTime is the time at which the reconciliation is retried after
+	// the last failure, if it is retried.
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+
+	// EffectiveInterval is the interval of the last reconciliation, the
+	// interval of the spec or the default interval of the controller.
+	// +optional
+	EffectiveInterval *metav1.Duration `json:"effectiveInterval,omitempty"`
+
+	// EffectiveTimeout is the timeout of the last reconciliation, the
+	// timeout of the spec or the default timeout of the controller.
+	// +optional
+	EffectiveTimeout *metav1.Duration `json:"effectiveTimeout,omitempty"`
+
+	// LastReconcileTrace is the trace of the last completed reconciliation,
+	// unless disabled for the controller.
+	// +optional
+	LastReconcileTrace *ReconcileTrace `json:"lastReconcileTrace,omitempty"`
+
+	// LastHandledForceRefetchAt holds the value of the most recent force
+	// refetch request handled by a successful reconciliation, so a newer
+	// request can be detected.
+	// +optional
+	LastHandledForceRefetchAt string `json:"lastHandledForceRefetchAt,omitempty"`
+
 	meta.ReconcileRequestStatus `json:",inline"`
 }
 
@@ -110,16 +224,37 @@ const (
 	// BucketOperationFailedReason represents the fact that the bucket listing or
 	// download operations failed.
 	BucketOperationFailedReason string = "BucketOperationFailed"
+
+	// BucketNotFoundReason represents the fact that the bucket does not exist.
+	BucketNotFoundReason string = "BucketNotFound"
+
+	// BucketConnectionFailedReason represents the fact that the bucket
+	// endpoint could not be reached.
+	BucketConnectionFailedReason string = "BucketConnectionFailed"
+
+	// BucketLimitExceededReason represents the fact that the objects in the
+	// bucket exceed the maximum number of objects or total size.
+	BucketLimitExceededReason string = "BucketLimitExceeded"
 )
 
 // BucketProgressing resets the conditions of the Bucket to metav1.Condition of
-// type meta.ReadyCondition with status 'Unknown' and meta.ProgressingReason
-// reason and message. It returns the modified Bucket.
+// type meta.ReconcilingCondition with status 'True' and NewGenerationReason for
+// a new generation, or else meta.ProgressingReason, and of type
+// meta.ReadyCondition with status 'Unknown'. It returns the modified Bucket.
 func BucketProgressing(bucket Bucket) Bucket {
+	newGeneration := bucket.Status.ObservedGeneration != bucket.Generation
 	bucket.Status.ObservedGeneration = bucket.Generation
 	bucket.Status.URL = ""
-	bucket.Status.Conditions = []metav1.Condition{}
-	meta.SetResourceCondition(&bucket, meta.ReadyCondition, metav1.ConditionUnknown, meta.ProgressingReason, "reconciliation in progress")
+	markProgressing(&bucket, newGeneration)
+	return bucket
+}
+
+// BucketReconciling sets the metav1.Condition of type meta.ReconcilingCondition
+// of the Bucket to 'True' with meta.ProgressingReason at the start of a
+// reconciliation, and keeps the other conditions of the last reconciliation.
+// It returns the modified Bucket.
+func BucketReconciling(bucket Bucket) Bucket {
+	markReconciling(&bucket)
 	return bucket
 }
 
@@ -129,14 +264,22 @@ func BucketProgressing(bucket Bucket) Bucket {
 func BucketReady(bucket Bucket, artifact Artifact, url, reason, message string) Bucket {
 	bucket.Status.Artifact = &artifact
 	bucket.Status.URL = url
-	meta.SetResourceCondition(&bucket, meta.ReadyCondition, metav1.ConditionTrue, reason, message)
+	markReady(&bucket, reason, message)
 	return bucket
 }
 
 // BucketNotReady sets the meta.ReadyCondition on the Bucket to 'False', with
 // the given reason and message. It returns the modified Bucket.
 func BucketNotReady(bucket Bucket, reason, message string) Bucket {
-	meta.SetResourceCondition(&bucket, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	markNotReady(&bucket, reason, message)
+	return bucket
+}
+
+// BucketStalled sets the meta.ReadyCondition on the Bucket to 'False', and
+// the meta.StalledCondition to 'True', with the given reason and message. It
+// returns the modified Bucket.
+func BucketStalled(bucket Bucket, reason, message string) Bucket {
+	markStalled(&bucket, reason, message)
 	return bucket
 }
 
@@ -174,6 +317,8 @@ func (in *Bucket) GetInterval() metav1.Duration {
 // +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.spec.url`
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
+// +kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.artifact.size`,priority=1
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
 
 // Bucket is the Schema for the buckets API
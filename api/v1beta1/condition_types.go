@@ -16,9 +16,43 @@ limitations under the License.
 
 package v1beta1
 
+import (
+	"github.com/fluxcd/pkg/apis/meta"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
 const SourceFinalizer = "finalizers.fluxcd.io"
 
 const (
+	// FetchFailedCondition is the name of the negative polarity condition
+	// that is 'True' when the last reconciliation of a source failed to fetch
+	// its upstream, e.g. to clone a Git repository or to download a Helm
+	// repository index. The meta.ReadyCondition is then 'False' with the same
+	// reason and message.
+	FetchFailedCondition string = "FetchFailed"
+
+	// ArtifactInStorageCondition is the name of the condition that is 'True'
+	// with the ArtifactStoredReason when the artifact of a source is present
+	// in the storage and matches its digest, as verified at the start of the
+	// last reconciliation, or written by it. It is 'False' with the
+	// ArtifactMissingReason or the ArtifactCorruptReason otherwise, until a
+	// new artifact is produced.
+	ArtifactInStorageCondition string = "ArtifactInStorage"
+
+	// SourceVerifiedCondition is the name of the condition that is 'True'
+	// with the VerificationSucceededReason when the signature of the upstream
+	// of a source was verified by the last reconciliation, and 'False' with
+	// the VerificationFailedReason when the verification failed. It is only
+	// set for the sources with verification enabled.
+	SourceVerifiedCondition string = "SourceVerified"
+)
+
+const (
+	// NewGenerationReason represents the fact that the reconciliation of a
+	// new generation of a source is in progress.
+	NewGenerationReason string = "NewGeneration"
+
 	// URLInvalidReason represents the fact that a given source has an invalid URL.
 	URLInvalidReason string = "URLInvalid"
 
@@ -32,4 +66,144 @@ const (
 	// VerificationFailedReason represents the fact that the cryptographic
 	// provenance verification for the source failed.
 	VerificationFailedReason string = "VerificationFailed"
+
+	// VerificationSucceededReason represents the fact that the cryptographic
+	// provenance verification for the source succeeded.
+	VerificationSucceededReason string = "VerificationSucceeded"
+
+	// ArtifactTooLargeReason represents the fact that the artifact of a source
+	// exceeds the maximum artifact size.
+	ArtifactTooLargeReason string = "ArtifactTooLarge"
+
+	// StorageFullReason represents the fact that the storage is above its
+	// high watermark, and no previous artifacts are left to prune, or that
+	// its file system has no space left for the artifact.
+	StorageFullReason string = "StorageFull"
+
+	// StorageReadOnlyReason represents the fact that the artifact could not
+	// be written as the file system of the storage is read-only.
+	StorageReadOnlyReason string = "StorageReadOnly"
+
+	// ArtifactStoredReason represents the fact that the artifact of a source
+	// is present in the storage and matches its digest.
+	ArtifactStoredReason string = "ArtifactStored"
+
+	// ArtifactMissingReason represents the fact that a source has no
+	// artifact, or that its artifact is missing from the storage.
+	ArtifactMissingReason string = "ArtifactMissing"
+
+	// SpecInvalidReason represents the fact that the spec of a source
+	// violates a validation rule of the controller, e.g. a timeout that
+	// exceeds the interval, and is not reconciled until it is corrected.
+	SpecInvalidReason string = "SpecInvalid"
+
+	// ArtifactCorruptReason represents the fact that the artifact of a
+	// source in the storage does not match its digest.
+	ArtifactCorruptReason string = "ArtifactCorrupt"
+
+	// EgressDeniedReason represents the fact that a connection to the
+	// upstream of a source was denied by the egress policy of the controller.
+	EgressDeniedReason string = "EgressDenied"
+
+	// ArtifactImportedReason represents the fact that the artifact of a
+	// source was imported from an artifact bundle, e.g. in an air-gapped
+	// cluster, instead of being produced from its upstream.
+	ArtifactImportedReason string = "ArtifactImported"
 )
+
+// fetchFailedReasons are the reasons of the failures to fetch the upstream
+// of a source, which are recorded in the FetchFailedCondition.
+var fetchFailedReasons = map[string]bool{
+	URLInvalidReason:             true,
+	AuthenticationFailedReason:   true,
+	GitOperationFailedReason:     true,
+	IndexationFailedReason:       true,
+	ChartPullFailedReason:        true,
+	BucketOperationFailedReason:  true,
+	BucketNotFoundReason:         true,
+	BucketConnectionFailedReason: true,
+	EgressDeniedReason:           true,
+}
+
+// conditionsObject is a source with status conditions, which observe the
+// generation of the source.
+type conditionsObject interface {
+	GetGeneration() int64
+	GetStatusConditions() *[]metav1.Condition
+}
+
+// setCondition sets the condition of the given type on the given object,
+// with the generation of the object as the observed generation.
+func setCondition(obj conditionsObject, condition string, status metav1.ConditionStatus, reason, message string) {
+	apimeta.SetStatusCondition(obj.GetStatusConditions(), metav1.Condition{
+		Type:               condition,
+		Status:             status,
+		ObservedGeneration: obj.GetGeneration(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// markProgressing resets the conditions of the given object, and sets the
+// meta.ReconcilingCondition to 'True' and the meta.ReadyCondition to
+// 'Unknown'. The reason is NewGenerationReason for a generation that has
+// not been observed, and meta.ProgressingReason otherwise.
+func markProgressing(obj conditionsObject, newGeneration bool) {
+	reason := meta.ProgressingReason
+	if newGeneration {
+		reason = NewGenerationReason
+	}
+	*obj.GetStatusConditions() = []metav1.Condition{}
+	setCondition(obj, meta.ReadyCondition, metav1.ConditionUnknown, meta.ProgressingReason, "reconciliation in progress")
+	setCondition(obj, meta.ReconcilingCondition, metav1.ConditionTrue, reason, "reconciliation in progress")
+}
+
+// markReconciling sets the meta.ReconcilingCondition of the given object to
+// 'True' while a reconciliation is under way, until it is removed by
+// markReady, markNotReady or markStalled.
+func markReconciling(obj conditionsObject) {
+	setCondition(obj, meta.ReconcilingCondition, metav1.ConditionTrue, meta.ProgressingReason, "reconciliation in progress")
+}
+
+// markReady sets the meta.ReadyCondition of the given object to 'True', and
+// removes the conditions of a reconciliation in progress or failed.
+func markReady(obj conditionsObject, reason, message string) {
+	setCondition(obj, meta.ReadyCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.ReconcilingCondition)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.StalledCondition)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), FetchFailedCondition)
+}
+
+// markNotReady sets the meta.ReadyCondition of the given object to 'False'
+// after a failure that is retried, and removes the meta.ReconcilingCondition
+// until the retry starts. The FetchFailedCondition is 'True' with the same
+// reason and message if the failure is a failure to fetch the upstream, and
+// removed otherwise.
+func markNotReady(obj conditionsObject, reason, message string) {
+	setCondition(obj, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.ReconcilingCondition)
+	setFetchFailed(obj, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.StalledCondition)
+}
+
+// markStalled sets the meta.ReadyCondition of the given object to 'False'
+// and the meta.StalledCondition to 'True' after a failure that is not
+// retried until the spec of the object changes, and removes the
+// meta.ReconcilingCondition.
+func markStalled(obj conditionsObject, reason, message string) {
+	setCondition(obj, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	setCondition(obj, meta.StalledCondition, metav1.ConditionTrue, reason, message)
+	setFetchFailed(obj, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.ReconcilingCondition)
+}
+
+// setFetchFailed sets the FetchFailedCondition of the given object to 'True'
+// if the given reason is a failure to fetch the upstream, and removes it
+// otherwise.
+func setFetchFailed(obj conditionsObject, reason, message string) {
+	if fetchFailedReasons[reason] {
+		setCondition(obj, FetchFailedCondition, metav1.ConditionTrue, reason, message)
+		return
+	}
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), FetchFailedCondition)
+}
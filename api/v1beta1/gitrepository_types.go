@@ -17,8 +17,12 @@ limitations under the License.
 package v1beta1
 
 import (
+	"net/url"
+	"strings"
+
 	"github.com/fluxcd/pkg/apis/meta"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,6 +34,16 @@ const (
 	GoGitImplementation = "go-git"
 	// LibGit2Implementation represents the git2go Git implementation kind.
 	LibGit2Implementation = "libgit2"
+	// AutoImplementation selects the LibGit2Implementation for the URLs of
+	// Azure DevOps, and the GoGitImplementation otherwise.
+	AutoImplementation = "auto"
+
+	// GitVerificationModeHead verifies the signature of the commit HEAD
+	// points to.
+	GitVerificationModeHead = "head"
+	// GitVerificationModeTag verifies the signature of the annotated tag
+	// of a tag or semver reference.
+	GitVerificationModeTag = "tag"
 )
 
 // GitRepositorySpec defines the desired state of a Git repository.
@@ -47,12 +61,40 @@ type GitRepositorySpec struct {
 	// +optional
 	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
 
+	// ServerName is the name by which the server of an HTTPS repository is
+	// addressed instead of the host of the URL, e.g. when the URL is the
+	// address of an ingress reachable by IP only. It is sent as the TLS
+	// server name (SNI) and as the Host header, and the certificate of the
+	// server is verified against it. It is only supported by the go-git Git
+	// implementation.
+	// +kubebuilder:validation:Pattern="^[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?(\\.[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?)*$"
+	// +optional
+	ServerName string `json:"serverName,omitempty"`
+
+	// ProxySecretRef is the name of the secret containing the proxy through
+	// which the repository is cloned, instead of the proxy of the environment
+	// of the controller. The secret must contain the URL of the proxy in the
+	// address field, and may contain username, password and no_proxy fields.
+	// It is only supported for HTTP(S) repositories by the go-git Git
+	// implementation.
+	// +optional
+	ProxySecretRef *meta.LocalObjectReference `json:"proxySecretRef,omitempty"`
+
+	// CARef is the reference to the key of a config map containing PEM
+	// encoded CA certificates, against which the certificate of the server
+	// of an HTTPS repository is verified in addition to the system roots and
+	// to the caFile of the secret, if any. It is only supported for HTTP(S)
+	// repositories by the go-git Git implementation.
+	// +optional
+	CARef *ConfigMapKeyReference `json:"caRef,omitempty"`
+
 	// The interval at which to check for repository updates.
-	// +required
+	// Defaults to the default interval of the controller, if it has one.
+	// +optional
 	Interval metav1.Duration `json:"interval"`
 
-	// The timeout for remote Git operations like cloning, defaults to 20s.
-	// +kubebuilder:default="20s"
+	// The timeout for remote Git operations like cloning, defaults to the
+	// default timeout of the controller, 20s if it has none.
 	// +optional
 	Timeout *metav1.Duration `json:"timeout,omitempty"`
 
@@ -61,7 +103,8 @@ type GitRepositorySpec struct {
 	// +optional
 	Reference *GitRepositoryRef `json:"ref,omitempty"`
 
-	// Verify OpenPGP signature for the Git commit HEAD points to.
+	// Verify OpenPGP signature for the Git commit HEAD points to, or for the
+	// annotated tag of a tag or semver reference.
 	// +optional
 	Verification *GitRepositoryVerification `json:"verify,omitempty"`
 
@@ -71,13 +114,29 @@ type GitRepositorySpec struct {
 	// +optional
 	Ignore *string `json:"ignore,omitempty"`
 
+	// MaxArtifactSize is the maximum size of the artifact, overriding the
+	// default of the controller. A size larger than the maximum of the
+	// controller is capped at the maximum of the controller. Zero uses the
+	// default.
+	// +optional
+	MaxArtifactSize *resource.Quantity `json:"maxArtifactSize,omitempty"`
+
+	// RetryInterval is the maximum interval between the retries of the
+	// reconciliation after a failure, capping the exponential backoff of the
+	// controller. Defaults to the maximum retry delay of the controller.
+	// +optional
+	RetryInterval *metav1.Duration `json:"retryInterval,omitempty"`
+
 	// This flag tells the controller to suspend the reconciliation of this source.
 	// +optional
 	Suspend bool `json:"suspend,omitempty"`
 
 	// Determines which git client library to use.
-	// Defaults to go-git, valid values are ('go-git', 'libgit2').
-	// +kubebuilder:validation:Enum=go-git;libgit2
+	// Defaults to go-git, valid values are ('go-git', 'libgit2', 'auto').
+	// 'auto' selects libgit2 for the Azure DevOps URLs, as Azure DevOps
+	// requires capabilities of the Git protocol go-git does not support, and
+	// go-git otherwise.
+	// +kubebuilder:validation:Enum=go-git;libgit2;auto
 	// +kubebuilder:default:=go-git
 	// +optional
 	GitImplementation string `json:"gitImplementation,omitempty"`
@@ -88,6 +147,49 @@ type GitRepositorySpec struct {
 	// +optional
 	RecurseSubmodules bool `json:"recurseSubmodules,omitempty"`
 
+	// SubmoduleSecretRefs are the secrets containing the Git credentials of
+	// the submodules of a host, in the format of the SecretRef, for the
+	// submodules of which the host differs from the host of the repository.
+	// The submodules of the other hosts are cloned with the SecretRef.
+	// This option is available only when using the 'go-git' GitImplementation.
+	// +optional
+	SubmoduleSecretRefs []GitRepositorySubmoduleSecretRef `json:"submoduleSecretRefs,omitempty"`
+
+	// SubmoduleDepth is the maximum depth of the recursion of the submodules,
+	// 1 for the submodules of the repository only. The submodules below the
+	// maximum depth are not initialized. Defaults to 10 when omitted.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	SubmoduleDepth int `json:"submoduleDepth,omitempty"`
+
+	// SparseCheckout are the paths of the directories or files, relative to
+	// the root of the repository, to check out instead of the whole
+	// repository, e.g. 'apps/podinfo'. Only these paths are written to the
+	// worktree and included in the artifact, and the hash of the revision is
+	// the hash of their content instead of the hash of the commit, so it only
+	// changes when the content of the paths changes.
+	// This option is available only when using the 'go-git' GitImplementation,
+	// and can not be combined with RecurseSubmodules.
+	// +optional
+	SparseCheckout []string `json:"sparseCheckout,omitempty"`
+
+	// Depth is the number of commits of the history to fetch, for a shallow
+	// clone. Defaults to 1 for the branch, tag and semver references, and to
+	// the full history for the commit references, when omitted. For a commit
+	// reference with a depth, the history is deepened until the commit is
+	// reachable.
+	// This option is available only when using the 'go-git' GitImplementation.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Depth int `json:"depth,omitempty"`
+
+	// AllBranches fetches all the branches of the repository, instead of the
+	// referenced branch only, e.g. when the commit of a commit reference is
+	// not reachable from the referenced branch.
+	// This option is available only when using the 'go-git' GitImplementation.
+	// +optional
+	AllBranches bool `json:"allBranches,omitempty"`
+
 	// Extra git repositories to map into the repository
 	Include []GitRepositoryInclude `json:"include,omitempty"`
 }
@@ -117,6 +219,19 @@ type GitRepositoryInclude struct {
 	ToPath string `json:"toPath"`
 }
 
+// GitRepositorySubmoduleSecretRef maps the host of the URLs of submodules to
+// the secret containing their Git credentials.
+type GitRepositorySubmoduleSecretRef struct {
+	// Host of the URLs of the submodules, e.g. 'gitlab.com'.
+	// +required
+	Host string `json:"host"`
+
+	// The secret name containing the Git credentials of the submodules of
+	// the host.
+	// +required
+	SecretRef meta.LocalObjectReference `json:"secretRef"`
+}
+
 // GitRepositoryRef defines the Git ref used for pull and checkout operations.
 type GitRepositoryRef struct {
 	// The Git branch to checkout, defaults to master.
@@ -139,8 +254,11 @@ type GitRepositoryRef struct {
 
 // GitRepositoryVerification defines the OpenPGP signature verification process.
 type GitRepositoryVerification struct {
-	// Mode describes what git object should be verified, currently ('head').
-	// +kubebuilder:validation:Enum=head
+	// Mode describes what git object should be verified, ('head') for the
+	// commit HEAD points to, or ('tag') for the annotated tag of a tag or
+	// semver reference, which is only supported by the go-git
+	// GitImplementation.
+	// +kubebuilder:validation:Enum=head;tag
 	Mode string `json:"mode"`
 
 	// The secret name containing the public keys of all trusted Git authors.
@@ -170,9 +288,64 @@ type GitRepositoryStatus struct {
 	// +optional
 	IncludedArtifacts []*Artifact `json:"includedArtifacts,omitempty"`
 
+	// LastSucceededTransport describes the Git implementation and transport
+	// used for the last successful repository sync.
+	// +optional
+	LastSucceededTransport *GitRepositoryTransport `json:"lastSucceededTransport,omitempty"`
+
+	// LastFailedTransport describes the Git implementation and transport used
+	// for the last failed repository sync.
+	// +optional
+	LastFailedTransport *GitRepositoryTransport `json:"lastFailedTransport,omitempty"`
+
+	// NextRetryTime is the time at which the reconciliation is retried after
+	// the last failure, if it is retried.
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+
+	// EffectiveInterval is the interval of the last reconciliation, the
+	// interval of the spec or the default interval of the controller.
+	// +optional
+	EffectiveInterval *metav1.Duration `json:"effectiveInterval,omitempty"`
+
+	// EffectiveTimeout is the timeout of the last reconciliation, the
+	// timeout of the spec or the default timeout of the controller.
+	// +optional
+	EffectiveTimeout *metav1.Duration `json:"effectiveTimeout,omitempty"`
+
+	// LastReconcileTrace is the trace of the last completed reconciliation,
+	// unless disabled for the controller.
+	// +optional
+	LastReconcileTrace *ReconcileTrace `json:"lastReconcileTrace,omitempty"`
+
+	// LastHandledForceRefetchAt holds the value of the most recent force
+	// refetch request handled by a successful reconciliation, so a newer
+	// request can be detected.
+	// +optional
+	LastHandledForceRefetchAt string `json:"lastHandledForceRefetchAt,omitempty"`
+
 	meta.ReconcileRequestStatus `json:",inline"`
 }
 
+// GitRepositoryTransport describes the Git implementation and transport used
+// to communicate with the remote during a repository sync.
+type GitRepositoryTransport struct {
+	// Implementation is the Git client library used, ('go-git', 'libgit2').
+	// +optional
+	Implementation string `json:"implementation,omitempty"`
+
+	// Scheme is the transport scheme of the repository URL, ('http', 'https',
+	// 'ssh').
+	// +optional
+	Scheme string `json:"scheme,omitempty"`
+
+	// ImplementationProtocolVersion is the Git wire protocol version
+	// implemented by the Git implementation, ('v0'). It is not negotiated
+	// with the remote, as the implementations only speak this version.
+	// +optional
+	ImplementationProtocolVersion string `json:"implementationProtocolVersion,omitempty"`
+}
+
 const (
 	// GitOperationSucceedReason represents the fact that the git clone, pull
 	// and checkout operations succeeded.
@@ -184,14 +357,24 @@ const (
 )
 
 // GitRepositoryProgressing resets the conditions of the GitRepository to
-// metav1.Condition of type meta.ReadyCondition with status 'Unknown' and
-// meta.ProgressingReason reason and message. It returns the modified
+// metav1.Condition of type meta.ReconcilingCondition with status 'True' and
+// NewGenerationReason for a new generation, or else meta.ProgressingReason, and
+// of type meta.ReadyCondition with status 'Unknown'. It returns the modified
 // GitRepository.
 func GitRepositoryProgressing(repository GitRepository) GitRepository {
+	newGeneration := repository.Status.ObservedGeneration != repository.Generation
 	repository.Status.ObservedGeneration = repository.Generation
 	repository.Status.URL = ""
-	repository.Status.Conditions = []metav1.Condition{}
-	meta.SetResourceCondition(&repository, meta.ReadyCondition, metav1.ConditionUnknown, meta.ProgressingReason, "reconciliation in progress")
+	markProgressing(&repository, newGeneration)
+	return repository
+}
+
+// GitRepositoryReconciling sets the metav1.Condition of type meta.ReconcilingCondition
+// of the GitRepository to 'True' with meta.ProgressingReason at the start of a
+// reconciliation, and keeps the other conditions of the last reconciliation.
+// It returns the modified GitRepository.
+func GitRepositoryReconciling(repository GitRepository) GitRepository {
+	markReconciling(&repository)
 	return repository
 }
 
@@ -202,7 +385,7 @@ func GitRepositoryReady(repository GitRepository, artifact Artifact, includedArt
 	repository.Status.Artifact = &artifact
 	repository.Status.IncludedArtifacts = includedArtifacts
 	repository.Status.URL = url
-	meta.SetResourceCondition(&repository, meta.ReadyCondition, metav1.ConditionTrue, reason, message)
+	markReady(&repository, reason, message)
 	return repository
 }
 
@@ -210,7 +393,33 @@ func GitRepositoryReady(repository GitRepository, artifact Artifact, includedArt
 // to 'False', with the given reason and message. It returns the modified
 // GitRepository.
 func GitRepositoryNotReady(repository GitRepository, reason, message string) GitRepository {
-	meta.SetResourceCondition(&repository, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	markNotReady(&repository, reason, message)
+	return repository
+}
+
+// GitRepositoryStalled sets the meta.ReadyCondition on the given GitRepository
+// to 'False', and the meta.StalledCondition to 'True', with the given reason
+// and message. It returns the modified GitRepository.
+func GitRepositoryStalled(repository GitRepository, reason, message string) GitRepository {
+	markStalled(&repository, reason, message)
+	return repository
+}
+
+// GitRepositoryVerified sets the SourceVerifiedCondition on the given
+// GitRepository to 'True' with the given message. It returns the modified
+// GitRepository.
+func GitRepositoryVerified(repository GitRepository, message string) GitRepository {
+	setCondition(&repository, SourceVerifiedCondition, metav1.ConditionTrue, VerificationSucceededReason, message)
+	return repository
+}
+
+// GitRepositoryNotVerified sets the SourceVerifiedCondition and the
+// meta.ReadyCondition on the given GitRepository to 'False', with the
+// VerificationFailedReason and the given message. It returns the modified
+// GitRepository.
+func GitRepositoryNotVerified(repository GitRepository, message string) GitRepository {
+	setCondition(&repository, SourceVerifiedCondition, metav1.ConditionFalse, VerificationFailedReason, message)
+	markNotReady(&repository, VerificationFailedReason, message)
 	return repository
 }
 
@@ -241,6 +450,30 @@ func (in *GitRepository) GetInterval() metav1.Duration {
 	return in.Spec.Interval
 }
 
+// GetGitImplementation returns the Git implementation of the GitRepository,
+// with the AutoImplementation resolved for its URL.
+func (in *GitRepository) GetGitImplementation() string {
+	if in.Spec.GitImplementation != AutoImplementation {
+		return in.Spec.GitImplementation
+	}
+	if isAzureDevOpsURL(in.Spec.URL) {
+		return LibGit2Implementation
+	}
+	return GoGitImplementation
+}
+
+// isAzureDevOpsURL returns if the given URL is the HTTPS or SSH URL of an
+// Azure DevOps repository, of the 'dev.azure.com' or legacy
+// 'visualstudio.com' hosts.
+func isAzureDevOpsURL(repositoryURL string) bool {
+	u, err := url.Parse(repositoryURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == "dev.azure.com" || host == "ssh.dev.azure.com" || strings.HasSuffix(host, ".visualstudio.com")
+}
+
 // +genclient
 // +genclient:Namespaced
 // +kubebuilder:object:root=true
@@ -249,6 +482,8 @@ func (in *GitRepository) GetInterval() metav1.Duration {
 // +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.spec.url`
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
+// +kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.artifact.size`,priority=1
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
 
 // GitRepository is the Schema for the gitrepositories API
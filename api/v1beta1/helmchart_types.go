@@ -19,12 +19,39 @@ package v1beta1
 import (
 	"github.com/fluxcd/pkg/apis/meta"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // HelmChartKind is the string representation of a HelmChart.
 const HelmChartKind = "HelmChart"
 
+const (
+	// VersionUpdatePolicyAuto fetches the latest chart version matching the
+	// version constraint at every reconciliation.
+	VersionUpdatePolicyAuto string = "Auto"
+
+	// VersionUpdatePolicyManual pins the chart version resolved from the
+	// version constraint, until the spec changes or a version bump is
+	// requested.
+	VersionUpdatePolicyManual string = "Manual"
+
+	// VersionBumpAnnotation is the annotation of a HelmChart which requests
+	// the chart version pinned under the Manual version update policy to be
+	// resolved again, when its value, e.g. a timestamp, is newer than the
+	// LastHandledVersionBumpAt of the status.
+	VersionBumpAnnotation string = "source.toolkit.fluxcd.io/bumpVersion"
+
+	// ReconcileStrategyChartVersion packages a new chart from a GitRepository
+	// or Bucket source when the version of its Chart.yaml changes.
+	ReconcileStrategyChartVersion string = "ChartVersion"
+
+	// ReconcileStrategyRevision packages a new chart from a GitRepository or
+	// Bucket source when the revision of the source changes, with the
+	// revision as build metadata of the chart version.
+	ReconcileStrategyRevision string = "Revision"
+)
+
 // HelmChartSpec defines the desired state of a Helm chart.
 type HelmChartSpec struct {
 	// The name or path the Helm chart is available at in the SourceRef.
@@ -37,12 +64,32 @@ type HelmChartSpec struct {
 	// +optional
 	Version string `json:"version,omitempty"`
 
+	// VersionUpdatePolicy determines when the chart version is resolved from
+	// the version constraint, for charts from HelmRepository sources. 'Auto'
+	// fetches the latest matching version at every reconciliation. 'Manual'
+	// resolves the version when the chart is created, its spec changes, or
+	// a version bump is requested with the bump annotation, and keeps it
+	// pinned otherwise. Defaults to 'Auto'.
+	// +kubebuilder:validation:Enum=Auto;Manual
+	// +optional
+	VersionUpdatePolicy string `json:"versionUpdatePolicy,omitempty"`
+
+	// ReconcileStrategy determines when a new chart is packaged from a
+	// GitRepository or Bucket source. 'ChartVersion' packages a new chart
+	// when the version of its Chart.yaml changes. 'Revision' packages a new
+	// chart when the revision of the source changes, with the revision as
+	// build metadata of the chart version. Defaults to 'ChartVersion'.
+	// +kubebuilder:validation:Enum=ChartVersion;Revision
+	// +optional
+	ReconcileStrategy string `json:"reconcileStrategy,omitempty"`
+
 	// The reference to the Source the chart is available at.
 	// +required
 	SourceRef LocalHelmChartSourceReference `json:"sourceRef"`
 
 	// The interval at which to check the Source for updates.
-	// +required
+	// Defaults to the default interval of the controller, if it has one.
+	// +optional
 	Interval metav1.Duration `json:"interval"`
 
 	// Alternative list of values files to use as the chart values (values.yaml
@@ -60,6 +107,34 @@ type HelmChartSpec struct {
 	// +deprecated
 	ValuesFile string `json:"valuesFile,omitempty"`
 
+	// Normalize repackages the charts pulled from a HelmRepository with
+	// canonical entries before they are stored, so that the checksum of the
+	// artifact only depends on the content of the chart, and not on how the
+	// chart was packaged. Ignored for charts from GitRepository and Bucket
+	// sources, which are packaged by the controller.
+	// +optional
+	Normalize bool `json:"normalize,omitempty"`
+
+	// MaxArtifactSize is the maximum size of the artifact, overriding the
+	// default of the controller. A size larger than the maximum of the
+	// controller is capped at the maximum of the controller. Zero uses the
+	// default.
+	// +optional
+	MaxArtifactSize *resource.Quantity `json:"maxArtifactSize,omitempty"`
+
+	// RetryInterval is the maximum interval between the retries of the
+	// reconciliation after a failure, capping the exponential backoff of the
+	// controller. Defaults to the maximum retry delay of the controller.
+	// +optional
+	RetryInterval *metav1.Duration `json:"retryInterval,omitempty"`
+
+	// Verify the cosign signature of the chart before it is pulled, for
+	// charts from HelmRepository sources of the 'oci' type, or the
+	// provenance file of the chart before it is packaged, for charts from
+	// HelmRepository sources of the default type.
+	// +optional
+	Verification *OCIRepositoryVerification `json:"verify,omitempty"`
+
 	// This flag tells the controller to suspend the reconciliation of this source.
 	// +optional
 	Suspend bool `json:"suspend,omitempty"`
@@ -101,6 +176,52 @@ type HelmChartStatus struct {
 	// +optional
 	Artifact *Artifact `json:"artifact,omitempty"`
 
+	// NextRetryTime is the time at which the reconciliation is retried after
+	// the last failure, if it is retried.
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+
+	// EffectiveInterval is the interval of the last reconciliation, the
+	// interval of the spec or the default interval of the controller.
+	// +optional
+	EffectiveInterval *metav1.Duration `json:"effectiveInterval,omitempty"`
+
+	// LastReconcileTrace is the trace of the last completed reconciliation,
+	// unless disabled for the controller.
+	// +optional
+	LastReconcileTrace *ReconcileTrace `json:"lastReconcileTrace,omitempty"`
+
+	// LastHandledForceRefetchAt holds the value of the most recent force
+	// refetch request handled by a successful reconciliation, so a newer
+	// request can be detected.
+	// +optional
+	LastHandledForceRefetchAt string `json:"lastHandledForceRefetchAt,omitempty"`
+
+	// PinnedVersion is the chart version resolved from the version
+	// constraint under the Manual version update policy.
+	// +optional
+	PinnedVersion string `json:"pinnedVersion,omitempty"`
+
+	// PinnedGeneration is the generation of the spec for which the
+	// PinnedVersion was resolved.
+	// +optional
+	PinnedGeneration int64 `json:"pinnedGeneration,omitempty"`
+
+	// AvailableVersion is the latest chart version matching the version
+	// constraint, when it is newer than the PinnedVersion.
+	// +optional
+	AvailableVersion string `json:"availableVersion,omitempty"`
+
+	// LastHandledVersionBumpAt holds the value of the most recent version
+	// bump request handled, so a newer request can be detected.
+	// +optional
+	LastHandledVersionBumpAt string `json:"lastHandledVersionBumpAt,omitempty"`
+
+	// VerifiedIdentity is the identity of the signature verified by the
+	// last successful verification, if verification is enabled.
+	// +optional
+	VerifiedIdentity *OCIRepositoryVerifiedIdentity `json:"verifiedIdentity,omitempty"`
+
 	meta.ReconcileRequestStatus `json:",inline"`
 }
 
@@ -122,14 +243,25 @@ const (
 	ChartPackageSucceededReason string = "ChartPackageSucceeded"
 )
 
-// HelmChartProgressing resets the conditions of the HelmChart to meta.Condition
-// of type meta.ReadyCondition with status 'Unknown' and meta.ProgressingReason
-// reason and message. It returns the modified HelmChart.
+// HelmChartProgressing resets the conditions of the HelmChart to
+// metav1.Condition of type meta.ReconcilingCondition with status 'True' and
+// NewGenerationReason for a new generation, or else meta.ProgressingReason, and
+// of type meta.ReadyCondition with status 'Unknown'. It returns the modified
+// HelmChart.
 func HelmChartProgressing(chart HelmChart) HelmChart {
+	newGeneration := chart.Status.ObservedGeneration != chart.Generation
 	chart.Status.ObservedGeneration = chart.Generation
 	chart.Status.URL = ""
-	chart.Status.Conditions = []metav1.Condition{}
-	meta.SetResourceCondition(&chart, meta.ReadyCondition, metav1.ConditionUnknown, meta.ProgressingReason, "reconciliation in progress")
+	markProgressing(&chart, newGeneration)
+	return chart
+}
+
+// HelmChartReconciling sets the metav1.Condition of type meta.ReconcilingCondition
+// of the HelmChart to 'True' with meta.ProgressingReason at the start of a
+// reconciliation, and keeps the other conditions of the last reconciliation.
+// It returns the modified HelmChart.
+func HelmChartReconciling(chart HelmChart) HelmChart {
+	markReconciling(&chart)
 	return chart
 }
 
@@ -139,7 +271,7 @@ func HelmChartProgressing(chart HelmChart) HelmChart {
 func HelmChartReady(chart HelmChart, artifact Artifact, url, reason, message string) HelmChart {
 	chart.Status.Artifact = &artifact
 	chart.Status.URL = url
-	meta.SetResourceCondition(&chart, meta.ReadyCondition, metav1.ConditionTrue, reason, message)
+	markReady(&chart, reason, message)
 	return chart
 }
 
@@ -147,7 +279,34 @@ func HelmChartReady(chart HelmChart, artifact Artifact, url, reason, message str
 // 'False', with the given reason and message. It returns the modified
 // HelmChart.
 func HelmChartNotReady(chart HelmChart, reason, message string) HelmChart {
-	meta.SetResourceCondition(&chart, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	markNotReady(&chart, reason, message)
+	return chart
+}
+
+// HelmChartStalled sets the meta.ReadyCondition on the given HelmChart to
+// 'False', and the meta.StalledCondition to 'True', with the given reason and
+// message. It returns the modified HelmChart.
+func HelmChartStalled(chart HelmChart, reason, message string) HelmChart {
+	markStalled(&chart, reason, message)
+	return chart
+}
+
+// HelmChartVerified sets the given identity of the verified signature on
+// the HelmChart, and sets the SourceVerifiedCondition to 'True' with the
+// given message. It returns the modified HelmChart.
+func HelmChartVerified(chart HelmChart, identity OCIRepositoryVerifiedIdentity, message string) HelmChart {
+	chart.Status.VerifiedIdentity = &identity
+	setCondition(&chart, SourceVerifiedCondition, metav1.ConditionTrue, VerificationSucceededReason, message)
+	return chart
+}
+
+// HelmChartNotVerified sets the SourceVerifiedCondition and the
+// meta.ReadyCondition on the given HelmChart to 'False', with the
+// VerificationFailedReason and the given message. It returns the modified
+// HelmChart.
+func HelmChartNotVerified(chart HelmChart, message string) HelmChart {
+	setCondition(&chart, SourceVerifiedCondition, metav1.ConditionFalse, VerificationFailedReason, message)
+	markNotReady(&chart, VerificationFailedReason, message)
 	return chart
 }
 
@@ -200,6 +359,8 @@ func (in *HelmChart) GetValuesFiles() []string {
 // +kubebuilder:printcolumn:name="Source Name",type=string,JSONPath=`.spec.sourceRef.name`
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
+// +kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.artifact.size`,priority=1
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
 
 // HelmChart is the Schema for the helmcharts API
@@ -19,6 +19,7 @@ package v1beta1
 import (
 	"github.com/fluxcd/pkg/apis/meta"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -28,20 +29,40 @@ const (
 	// HelmRepositoryURLIndexKey is the key to use for indexing HelmRepository
 	// resources by their HelmRepositorySpec.URL.
 	HelmRepositoryURLIndexKey = ".metadata.helmRepositoryURL"
+
+	// HelmRepositoryTypeDefault is the type of a HelmRepository with an
+	// index served over HTTP/S.
+	HelmRepositoryTypeDefault = "default"
+	// HelmRepositoryTypeOCI is the type of a HelmRepository of which the
+	// charts are stored in an OCI registry.
+	HelmRepositoryTypeOCI = "oci"
 )
 
 // HelmRepositorySpec defines the reference to a Helm repository.
 type HelmRepositorySpec struct {
 	// The Helm repository URL, a valid URL contains at least a protocol and host.
+	// For the 'oci' type it is an 'oci://' URL of the registry and the path of
+	// the charts, e.g. 'oci://ghcr.io/stefanprodan/charts'.
 	// +required
 	URL string `json:"url"`
 
+	// Type of the HelmRepository. The 'default' type has an index served
+	// over HTTP/S. The 'oci' type stores the charts in an OCI registry, of
+	// which the versions are resolved against the tags of the charts, as it
+	// has no index, and it has no artifact.
+	// Defaults to 'default'.
+	// +kubebuilder:validation:Enum=default;oci
+	// +optional
+	Type string `json:"type,omitempty"`
+
 	// The name of the secret containing authentication credentials for the Helm
 	// repository.
 	// For HTTP/S basic auth the secret must contain username and
 	// password fields.
 	// For TLS the secret must contain a certFile and keyFile, and/or
 	// caCert fields.
+	// For the 'oci' type the secret may instead be of type
+	// 'kubernetes.io/dockerconfigjson'.
 	// +optional
 	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
 
@@ -54,15 +75,55 @@ type HelmRepositorySpec struct {
 	// +optional
 	PassCredentials bool `json:"passCredentials,omitempty"`
 
+	// ServerName is the name by which the server of the repository is
+	// addressed instead of the host of the URL, e.g. when the URL is the
+	// address of an ingress reachable by IP only. It is sent as the TLS
+	// server name (SNI) and as the Host header of the requests to the host
+	// of the URL, and the certificate of the server is verified against it.
+	// +kubebuilder:validation:Pattern="^[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?(\\.[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?)*$"
+	// +optional
+	ServerName string `json:"serverName,omitempty"`
+
+	// ProxySecretRef is the name of the secret containing the proxy through
+	// which the index and the charts of the repository are fetched, instead
+	// of the proxy of the environment of the controller. The secret must
+	// contain the URL of the proxy in the address field, and may contain
+	// username, password and no_proxy fields. It is not supported for the
+	// 'oci' type.
+	// +optional
+	ProxySecretRef *meta.LocalObjectReference `json:"proxySecretRef,omitempty"`
+
+	// CARef is the reference to the key of a config map containing PEM
+	// encoded CA certificates, against which the certificate of the server
+	// of the repository is verified in addition to the system roots and to
+	// the caFile of the secret, if any. It is not supported for the 'oci'
+	// type.
+	// +optional
+	CARef *ConfigMapKeyReference `json:"caRef,omitempty"`
+
 	// The interval at which to check the upstream for updates.
-	// +required
+	// Defaults to the default interval of the controller, if it has one.
+	// +optional
 	Interval metav1.Duration `json:"interval"`
 
-	// The timeout of index downloading, defaults to 60s.
-	// +kubebuilder:default:="60s"
+	// The timeout of index downloading, defaults to the default timeout of the
+	// controller, 60s if it has none.
 	// +optional
 	Timeout *metav1.Duration `json:"timeout,omitempty"`
 
+	// MaxArtifactSize is the maximum size of the artifact, overriding the
+	// default of the controller. A size larger than the maximum of the
+	// controller is capped at the maximum of the controller. Zero uses the
+	// default.
+	// +optional
+	MaxArtifactSize *resource.Quantity `json:"maxArtifactSize,omitempty"`
+
+	// RetryInterval is the maximum interval between the retries of the
+	// reconciliation after a failure, capping the exponential backoff of the
+	// controller. Defaults to the maximum retry delay of the controller.
+	// +optional
+	RetryInterval *metav1.Duration `json:"retryInterval,omitempty"`
+
 	// This flag tells the controller to suspend the reconciliation of this source.
 	// +optional
 	Suspend bool `json:"suspend,omitempty"`
@@ -86,6 +147,32 @@ type HelmRepositoryStatus struct {
 	// +optional
 	Artifact *Artifact `json:"artifact,omitempty"`
 
+	// NextRetryTime is the time at which the reconciliation is retried after
+	// the last failure, if it is retried.
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+
+	// EffectiveInterval is the interval of the last reconciliation, the
+	// interval of the spec or the default interval of the controller.
+	// +optional
+	EffectiveInterval *metav1.Duration `json:"effectiveInterval,omitempty"`
+
+	// EffectiveTimeout is the timeout of the last reconciliation, the
+	// timeout of the spec or the default timeout of the controller.
+	// +optional
+	EffectiveTimeout *metav1.Duration `json:"effectiveTimeout,omitempty"`
+
+	// LastReconcileTrace is the trace of the last completed reconciliation,
+	// unless disabled for the controller.
+	// +optional
+	LastReconcileTrace *ReconcileTrace `json:"lastReconcileTrace,omitempty"`
+
+	// LastHandledForceRefetchAt holds the value of the most recent force
+	// refetch request handled by a successful reconciliation, so a newer
+	// request can be detected.
+	// +optional
+	LastHandledForceRefetchAt string `json:"lastHandledForceRefetchAt,omitempty"`
+
 	meta.ReconcileRequestStatus `json:",inline"`
 }
 
@@ -97,17 +184,32 @@ const (
 	// IndexationSucceededReason represents the fact that the indexation of the
 	// given Helm repository succeeded.
 	IndexationSucceededReason string = "IndexationSucceed"
+
+	// RegistryConfiguredReason represents the fact that the OCI registry of
+	// the given Helm repository of the 'oci' type is configured, as it has no
+	// index to fetch.
+	RegistryConfiguredReason string = "RegistryConfigured"
 )
 
 // HelmRepositoryProgressing resets the conditions of the HelmRepository to
-// metav1.Condition of type meta.ReadyCondition with status 'Unknown' and
-// meta.ProgressingReason reason and message. It returns the modified
+// metav1.Condition of type meta.ReconcilingCondition with status 'True' and
+// NewGenerationReason for a new generation, or else meta.ProgressingReason, and
+// of type meta.ReadyCondition with status 'Unknown'. It returns the modified
 // HelmRepository.
 func HelmRepositoryProgressing(repository HelmRepository) HelmRepository {
+	newGeneration := repository.Status.ObservedGeneration != repository.Generation
 	repository.Status.ObservedGeneration = repository.Generation
 	repository.Status.URL = ""
-	repository.Status.Conditions = []metav1.Condition{}
-	meta.SetResourceCondition(&repository, meta.ReadyCondition, metav1.ConditionUnknown, meta.ProgressingReason, "reconciliation in progress")
+	markProgressing(&repository, newGeneration)
+	return repository
+}
+
+// HelmRepositoryReconciling sets the metav1.Condition of type meta.ReconcilingCondition
+// of the HelmRepository to 'True' with meta.ProgressingReason at the start of a
+// reconciliation, and keeps the other conditions of the last reconciliation.
+// It returns the modified HelmRepository.
+func HelmRepositoryReconciling(repository HelmRepository) HelmRepository {
+	markReconciling(&repository)
 	return repository
 }
 
@@ -117,7 +219,19 @@ func HelmRepositoryProgressing(repository HelmRepository) HelmRepository {
 func HelmRepositoryReady(repository HelmRepository, artifact Artifact, url, reason, message string) HelmRepository {
 	repository.Status.Artifact = &artifact
 	repository.Status.URL = url
-	meta.SetResourceCondition(&repository, meta.ReadyCondition, metav1.ConditionTrue, reason, message)
+	markReady(&repository, reason, message)
+	return repository
+}
+
+// HelmRepositoryOCIReady removes the Artifact, URL and ArtifactInStorageCondition
+// of the HelmRepository, as a HelmRepository of the 'oci' type has none, and
+// sets the meta.ReadyCondition to 'True', with the given reason and message. It
+// returns the modified HelmRepository.
+func HelmRepositoryOCIReady(repository HelmRepository, reason, message string) HelmRepository {
+	repository.Status.Artifact = nil
+	repository.Status.URL = ""
+	apimeta.RemoveStatusCondition(&repository.Status.Conditions, ArtifactInStorageCondition)
+	markReady(&repository, reason, message)
 	return repository
 }
 
@@ -125,7 +239,15 @@ func HelmRepositoryReady(repository HelmRepository, artifact Artifact, url, reas
 // HelmRepository to 'False', with the given reason and message. It returns the
 // modified HelmRepository.
 func HelmRepositoryNotReady(repository HelmRepository, reason, message string) HelmRepository {
-	meta.SetResourceCondition(&repository, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	markNotReady(&repository, reason, message)
+	return repository
+}
+
+// HelmRepositoryStalled sets the meta.ReadyCondition on the given
+// HelmRepository to 'False', and the meta.StalledCondition to 'True', with the
+// given reason and message. It returns the modified HelmRepository.
+func HelmRepositoryStalled(repository HelmRepository, reason, message string) HelmRepository {
+	markStalled(&repository, reason, message)
 	return repository
 }
 
@@ -164,6 +286,8 @@ func (in *HelmRepository) GetInterval() metav1.Duration {
 // +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.spec.url`
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
+// +kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.artifact.size`,priority=1
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
 
 // HelmRepository is the Schema for the helmrepositories API
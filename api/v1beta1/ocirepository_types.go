@@ -0,0 +1,384 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"github.com/fluxcd/pkg/apis/meta"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// OCIRepositoryKind is the string representation of an OCIRepository.
+	OCIRepositoryKind = "OCIRepository"
+)
+
+// OCIRepositorySpec defines the reference to an artifact in an OCI registry.
+type OCIRepositorySpec struct {
+	// The URL of the repository of the artifact in the OCI registry, in the
+	// form 'oci://<host>/<repository>', without a tag or digest.
+	// +kubebuilder:validation:Pattern="^oci://.*$"
+	// +required
+	URL string `json:"url"`
+
+	// The reference of the artifact to pull, defaults to the 'latest' tag.
+	// +optional
+	Reference *OCIRepositoryRef `json:"ref,omitempty"`
+
+	// The name of the secret containing the credentials of the registry, of
+	// type 'kubernetes.io/dockerconfigjson', or with the username and password
+	// fields. The secret may contain a caFile or ca.crt field with the CA
+	// certificate of the registry, and the certFile and keyFile, or tls.crt
+	// and tls.key, fields with a client certificate.
+	// +optional
+	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// Insecure allows connecting to a registry over plain HTTP.
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+
+	// Verify the cosign signature of the artifact before it is unpacked.
+	// +optional
+	Verification *OCIRepositoryVerification `json:"verify,omitempty"`
+
+	// The interval at which to check the registry for updates.
+	// Defaults to the default interval of the controller, if it has one.
+	// +optional
+	Interval metav1.Duration `json:"interval"`
+
+	// The timeout of the registry operations, defaults to the default timeout
+	// of the controller, 60s if it has none.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// Ignore overrides the set of excluded patterns in the .sourceignore format
+	// (which is the same as .gitignore). If not provided, a default will be used,
+	// consult the documentation for your version to find out what those are.
+	// +optional
+	Ignore *string `json:"ignore,omitempty"`
+
+	// MaxArtifactSize is the maximum size of the artifact, overriding the
+	// default of the controller. A size larger than the maximum of the
+	// controller is capped at the maximum of the controller. Zero uses the
+	// default.
+	// +optional
+	MaxArtifactSize *resource.Quantity `json:"maxArtifactSize,omitempty"`
+
+	// RetryInterval is the maximum interval between the retries of the
+	// reconciliation after a failure, capping the exponential backoff of the
+	// controller. Defaults to the maximum retry delay of the controller.
+	// +optional
+	RetryInterval *metav1.Duration `json:"retryInterval,omitempty"`
+
+	// This flag tells the controller to suspend the reconciliation of this source.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// OCIRepositoryRef defines the artifact reference to pull from the registry.
+type OCIRepositoryRef struct {
+	// The digest of the manifest to pull, takes precedence over all other
+	// fields.
+	// +kubebuilder:validation:Pattern="^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$"
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// The semver range of the tags to pull the highest version of, takes
+	// precedence over the tag.
+	// +optional
+	SemVer string `json:"semver,omitempty"`
+
+	// The tag to pull.
+	// +optional
+	Tag string `json:"tag,omitempty"`
+}
+
+const (
+	// CosignVerificationProvider verifies the cosign signatures of the
+	// manifests in OCI registries.
+	CosignVerificationProvider string = "cosign"
+
+	// ProvenanceVerificationProvider verifies the Helm provenance files of
+	// the charts from HelmRepository sources of the default type.
+	ProvenanceVerificationProvider string = "provenance"
+)
+
+// OCIRepositoryVerification defines the verification of the cosign
+// signatures of the artifacts.
+type OCIRepositoryVerification struct {
+	// Provider of the signatures, ('cosign'), or ('provenance') for the
+	// provenance files of the charts of a HelmChart from a HelmRepository of
+	// the default type.
+	// +kubebuilder:validation:Enum=cosign;provenance
+	// +kubebuilder:default=cosign
+	// +optional
+	Provider string `json:"provider,omitempty"`
+
+	// The name of the secret containing the trusted cosign public keys, in
+	// the fields with the '.pub' extension. The signatures are verified
+	// keyless if omitted. For the 'provenance' provider, the secret contains
+	// the trusted PGP public keyrings in all its fields, and is required.
+	// +optional
+	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// MatchOIDCIdentity are the OIDC identities trusted for the keyless
+	// verification, the certificate of a signature must match one of them.
+	// Required for the keyless verification.
+	// +optional
+	MatchOIDCIdentity []OIDCIdentityMatch `json:"matchOIDCIdentity,omitempty"`
+
+	// RekorURL is the URL of the Rekor transparency log of the keyless
+	// signatures, e.g. of a mirror. Defaults to 'https://rekor.sigstore.dev'.
+	// +optional
+	RekorURL string `json:"rekorURL,omitempty"`
+}
+
+// OIDCIdentityMatch defines an OIDC identity of the certificates of the
+// keyless signatures.
+type OIDCIdentityMatch struct {
+	// Issuer is the regular expression the whole OIDC issuer of the
+	// certificate must match, e.g. '^https://token\.actions\.githubusercontent\.com$'.
+	// +required
+	Issuer string `json:"issuer"`
+
+	// Subject is the regular expression the whole identity of the
+	// certificate must match, its email address or URI.
+	// +required
+	Subject string `json:"subject"`
+}
+
+// OCIRepositoryVerifiedIdentity describes the identity of the verified
+// signature of an artifact.
+type OCIRepositoryVerifiedIdentity struct {
+	// Digest is the digest of the verified manifest, or chart package.
+	// +required
+	Digest string `json:"digest"`
+
+	// Key is the field of the secret with the public key the signature was
+	// verified with.
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// Issuer is the OIDC issuer of the certificate of a keyless signature.
+	// +optional
+	Issuer string `json:"issuer,omitempty"`
+
+	// Subject is the identity of the certificate of a keyless signature,
+	// or the signer of a provenance file.
+	// +optional
+	Subject string `json:"subject,omitempty"`
+}
+
+// OCIRepositoryStatus defines the observed state of the OCIRepository.
+type OCIRepositoryStatus struct {
+	// ObservedGeneration is the last observed generation.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions holds the conditions for the OCIRepository.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// URL is the download link for the artifact output of the last pull.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Artifact represents the output of the last successful pull.
+	// +optional
+	Artifact *Artifact `json:"artifact,omitempty"`
+
+	// RegistryHost is the host of the registry which served the manifest of
+	// the last resolved reference: the host of the mirror of the registry of
+	// the URL, if the controller has one and it did not miss the reference.
+	// +optional
+	RegistryHost string `json:"registryHost,omitempty"`
+
+	// NextRetryTime is the time at which the reconciliation is retried after
+	// the last failure, if it is retried.
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+
+	// EffectiveInterval is the interval of the last reconciliation, the
+	// interval of the spec or the default interval of the controller.
+	// +optional
+	EffectiveInterval *metav1.Duration `json:"effectiveInterval,omitempty"`
+
+	// EffectiveTimeout is the timeout of the last reconciliation, the
+	// timeout of the spec or the default timeout of the controller.
+	// +optional
+	EffectiveTimeout *metav1.Duration `json:"effectiveTimeout,omitempty"`
+
+	// VerifiedIdentity is the identity of the signature verified by the
+	// last successful verification, if verification is enabled.
+	// +optional
+	VerifiedIdentity *OCIRepositoryVerifiedIdentity `json:"verifiedIdentity,omitempty"`
+
+	// LastReconcileTrace is the trace of the last completed reconciliation,
+	// unless disabled for the controller.
+	// +optional
+	LastReconcileTrace *ReconcileTrace `json:"lastReconcileTrace,omitempty"`
+
+	// LastHandledForceRefetchAt holds the value of the most recent force
+	// refetch request handled by a successful reconciliation, so a newer
+	// request can be detected.
+	// +optional
+	LastHandledForceRefetchAt string `json:"lastHandledForceRefetchAt,omitempty"`
+
+	meta.ReconcileRequestStatus `json:",inline"`
+}
+
+const (
+	// OCIOperationSucceedReason represents the fact that the OCI pull
+	// operation succeeded.
+	OCIOperationSucceedReason string = "OCIOperationSucceed"
+
+	// OCIOperationFailedReason represents the fact that the OCI pull
+	// operation failed.
+	OCIOperationFailedReason string = "OCIOperationFailed"
+
+	// OCILayerUnsupportedReason represents the fact that the artifact has a
+	// layer of which the media type is not supported.
+	OCILayerUnsupportedReason string = "OCILayerUnsupported"
+)
+
+// OCIRepositoryProgressing resets the conditions of the OCIRepository to
+// metav1.Condition of type meta.ReconcilingCondition with status 'True' and
+// NewGenerationReason for a new generation, or else meta.ProgressingReason, and
+// of type meta.ReadyCondition with status 'Unknown'. It returns the modified
+// OCIRepository.
+func OCIRepositoryProgressing(repository OCIRepository) OCIRepository {
+	newGeneration := repository.Status.ObservedGeneration != repository.Generation
+	repository.Status.ObservedGeneration = repository.Generation
+	repository.Status.URL = ""
+	markProgressing(&repository, newGeneration)
+	return repository
+}
+
+// OCIRepositoryReconciling sets the metav1.Condition of type meta.ReconcilingCondition
+// of the OCIRepository to 'True' with meta.ProgressingReason at the start of a
+// reconciliation, and keeps the other conditions of the last reconciliation.
+// It returns the modified OCIRepository.
+func OCIRepositoryReconciling(repository OCIRepository) OCIRepository {
+	markReconciling(&repository)
+	return repository
+}
+
+// OCIRepositoryReady sets the given Artifact and URL on the OCIRepository and
+// sets the meta.ReadyCondition to 'True', with the given reason and message. It
+// returns the modified OCIRepository.
+func OCIRepositoryReady(repository OCIRepository, artifact Artifact, url, reason, message string) OCIRepository {
+	repository.Status.Artifact = &artifact
+	repository.Status.URL = url
+	markReady(&repository, reason, message)
+	return repository
+}
+
+// OCIRepositoryNotReady sets the meta.ReadyCondition on the given
+// OCIRepository to 'False', with the given reason and message. It returns the
+// modified OCIRepository.
+func OCIRepositoryNotReady(repository OCIRepository, reason, message string) OCIRepository {
+	markNotReady(&repository, reason, message)
+	return repository
+}
+
+// OCIRepositoryStalled sets the meta.ReadyCondition on the given
+// OCIRepository to 'False', and the meta.StalledCondition to 'True', with the
+// given reason and message. It returns the modified OCIRepository.
+func OCIRepositoryStalled(repository OCIRepository, reason, message string) OCIRepository {
+	markStalled(&repository, reason, message)
+	return repository
+}
+
+// OCIRepositoryVerified sets the given identity of the verified signature
+// on the OCIRepository, and sets the SourceVerifiedCondition to 'True' with
+// the given message. It returns the modified OCIRepository.
+func OCIRepositoryVerified(repository OCIRepository, identity OCIRepositoryVerifiedIdentity, message string) OCIRepository {
+	repository.Status.VerifiedIdentity = &identity
+	setCondition(&repository, SourceVerifiedCondition, metav1.ConditionTrue, VerificationSucceededReason, message)
+	return repository
+}
+
+// OCIRepositoryNotVerified sets the SourceVerifiedCondition and the
+// meta.ReadyCondition on the given OCIRepository to 'False', with the
+// VerificationFailedReason and the given message. It returns the modified
+// OCIRepository.
+func OCIRepositoryNotVerified(repository OCIRepository, message string) OCIRepository {
+	setCondition(&repository, SourceVerifiedCondition, metav1.ConditionFalse, VerificationFailedReason, message)
+	markNotReady(&repository, VerificationFailedReason, message)
+	return repository
+}
+
+// OCIRepositoryReadyMessage returns the message of the metav1.Condition of type
+// meta.ReadyCondition with status 'True' if present, or an empty string.
+func OCIRepositoryReadyMessage(repository OCIRepository) string {
+	if c := apimeta.FindStatusCondition(repository.Status.Conditions, meta.ReadyCondition); c != nil {
+		if c.Status == metav1.ConditionTrue {
+			return c.Message
+		}
+	}
+	return ""
+}
+
+// GetArtifact returns the latest artifact from the source if present in the
+// status sub-resource.
+func (in *OCIRepository) GetArtifact() *Artifact {
+	return in.Status.Artifact
+}
+
+// GetStatusConditions returns a pointer to the Status.Conditions slice
+func (in *OCIRepository) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
+// GetInterval returns the interval at which the source is updated.
+func (in *OCIRepository) GetInterval() metav1.Duration {
+	return in.Spec.Interval
+}
+
+// +genclient
+// +genclient:Namespaced
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=ocirepo
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.spec.url`
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
+// +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
+// +kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.artifact.size`,priority=1
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
+
+// OCIRepository is the Schema for the ocirepositories API
+type OCIRepository struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   OCIRepositorySpec   `json:"spec,omitempty"`
+	Status OCIRepositoryStatus `json:"status,omitempty"`
+}
+
+// OCIRepositoryList contains a list of OCIRepository
+// +kubebuilder:object:root=true
+type OCIRepositoryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []OCIRepository `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&OCIRepository{}, &OCIRepositoryList{})
+}
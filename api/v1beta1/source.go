@@ -24,8 +24,53 @@ const (
 	// SourceIndexKey is the key used for indexing resources
 	// resources based on their Source.
 	SourceIndexKey string = ".metadata.source"
+
+	// SecretIndexKey is the key used for indexing sources based on the
+	// names of the Secrets they reference.
+	SecretIndexKey string = ".metadata.secret"
+
+	// ConfigMapIndexKey is the key used for indexing sources based on the
+	// names of the ConfigMaps they reference.
+	ConfigMapIndexKey string = ".metadata.configMap"
+
+	// ReconcilesPerMinuteAnnotation is the annotation of a Namespace which
+	// overrides the maximum number of reconciliations per minute of the
+	// sources of a kind in the namespace, zero means unlimited.
+	ReconcilesPerMinuteAnnotation string = "source.toolkit.fluxcd.io/reconciles-per-minute"
+
+	// ForceRefetchAnnotation is the annotation of a source which requests a
+	// reconciliation which fetches the upstream and rebuilds the artifact
+	// from scratch, bypassing the caches of the controller, when its value,
+	// e.g. a timestamp, is newer than the LastHandledForceRefetchAt of the
+	// status.
+	ForceRefetchAnnotation string = "source.toolkit.fluxcd.io/forceRefetch"
+
+	// DefaultConfigMapKey is the default key of a ConfigMapKeyReference,
+	// which is the key of the CA bundle of the ConfigMaps published by
+	// cert-manager trust and by the kube-root-ca.crt ConfigMap.
+	DefaultConfigMapKey string = "ca.crt"
 )
 
+// ConfigMapKeyReference is the reference to a key of a ConfigMap in the
+// namespace of the referrer.
+type ConfigMapKeyReference struct {
+	// Name of the config map.
+	// +required
+	Name string `json:"name"`
+
+	// Key of the config map, defaults to 'ca.crt'.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// GetKey returns the key of the reference, or the default 'ca.crt' key.
+func (in ConfigMapKeyReference) GetKey() string {
+	if in.Key == "" {
+		return DefaultConfigMapKey
+	}
+	return in.Key
+}
+
 // Source interface must be supported by all API types.
 // +k8s:deepcopy-gen=false
 type Source interface {
@@ -0,0 +1,65 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReconcileTrace is a compact trace of the last completed reconciliation of
+// a source, recorded for debugging.
+type ReconcileTrace struct {
+	// StartTime is the time at which the reconciliation started.
+	// +required
+	StartTime metav1.Time `json:"startTime"`
+
+	// Duration is the duration of the reconciliation, until its result was
+	// recorded in the status.
+	// +required
+	Duration metav1.Duration `json:"duration"`
+
+	// Result is the result of the reconciliation, 'success', 'error' or
+	// 'stalled'.
+	// +required
+	Result string `json:"result"`
+
+	// Phases are the phases of the reconciliation, in the order in which
+	// they ran, e.g. 'auth', 'fetch', 'verify', 'archive', 'store' and 'gc'.
+	// +optional
+	Phases []ReconcileTracePhase `json:"phases,omitempty"`
+
+	// Truncated is true if the details or the first phases of the trace were
+	// dropped, to cap the size of the trace.
+	// +optional
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ReconcileTracePhase is a phase of a ReconcileTrace.
+type ReconcileTracePhase struct {
+	// Name is the name of the phase.
+	// +required
+	Name string `json:"name"`
+
+	// Duration is the duration of the phase.
+	// +required
+	Duration metav1.Duration `json:"duration"`
+
+	// Detail is a short description of the outcome of the phase, e.g. the
+	// fetched revision, or the error of the phase that failed.
+	// +optional
+	Detail string `json:"detail,omitempty"`
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/runtime/client"
+
+	"github.com/fluxcd/source-controller/controllers"
+)
+
+// commands are the subcommands of the controller, by name, which return the
+// exit code of the process.
+var commands = map[string]func(args []string) int{
+	"export-artifacts": exportArtifacts,
+	"import-artifacts": importArtifacts,
+}
+
+// exportArtifacts writes the artifacts of all sources in the storage, and the
+// manifest of their revisions and checksums, to a gzipped tarball, e.g. to
+// seed the storage of an air-gapped cluster with import-artifacts.
+func exportArtifacts(args []string) int {
+	var (
+		storagePath   string
+		output        string
+		clientOptions client.Options
+	)
+	fs := flag.NewFlagSet("export-artifacts", flag.ContinueOnError)
+	fs.StringVar(&storagePath, "storage-path", envOrDefault("STORAGE_PATH", ""),
+		"The local storage path.")
+	fs.StringVarP(&output, "output", "o", "-",
+		"The path of the artifact bundle, '-' for the standard output.")
+	clientOptions.BindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if storagePath == "" {
+		fmt.Fprintln(os.Stderr, "the --storage-path flag, or the STORAGE_PATH environment variable, is required")
+		return 2
+	}
+
+	storage, err := controllers.NewStorage(storagePath, "localhost", 5*time.Minute)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to initialise storage: %v\n", err)
+		return 1
+	}
+	c, err := ctrlclient.New(client.GetConfigOrDie(clientOptions), ctrlclient.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create client: %v\n", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to create artifact bundle: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	bundle, err := storage.ExportArtifacts(context.Background(), c, w)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to export artifacts: %v\n", err)
+		if output != "-" {
+			os.Remove(output)
+		}
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d artifacts of %d sources\n", len(bundle.Files), len(bundle.Sources))
+	return 0
+}
+
+// importArtifacts imports the artifacts of an artifact bundle written by
+// export-artifacts into the storage, and patches the status of their sources
+// with the artifacts. The bundle is refused as a whole if any of its files or
+// sources does not match.
+func importArtifacts(args []string) int {
+	var (
+		storagePath        string
+		storageAddr        string
+		storageAdvAddr     string
+		input              string
+		artifactSigningKey string
+		clientOptions      client.Options
+	)
+	fs := flag.NewFlagSet("import-artifacts", flag.ContinueOnError)
+	fs.StringVar(&storagePath, "storage-path", envOrDefault("STORAGE_PATH", ""),
+		"The local storage path.")
+	fs.StringVar(&storageAddr, "storage-addr", envOrDefault("STORAGE_ADDR", ":9090"),
+		"The address the static file server of the controller binds to.")
+	fs.StringVar(&storageAdvAddr, "storage-adv-addr", envOrDefault("STORAGE_ADV_ADDR", ""),
+		"The advertised address of the static file server of the controller.")
+	fs.StringVar(&artifactSigningKey, "artifact-signing-key", envOrDefault("ARTIFACT_SIGNING_KEY", ""),
+		"The path of the PEM encoded ECDSA or RSA private key with which the imported artifacts are signed.")
+	fs.StringVarP(&input, "input", "i", "-",
+		"The path of the artifact bundle, '-' for the standard input.")
+	clientOptions.BindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if storagePath == "" {
+		fmt.Fprintln(os.Stderr, "the --storage-path flag, or the STORAGE_PATH environment variable, is required")
+		return 2
+	}
+
+	if storageAdvAddr == "" {
+		storageAdvAddr = determineAdvStorageAddr(storageAddr, setupLog)
+	} else {
+		storageAdvAddr = withLocalPort(storageAdvAddr, storageAddr)
+	}
+	storage, err := controllers.NewStorage(storagePath, storageAdvAddr, 5*time.Minute)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to initialise storage: %v\n", err)
+		return 1
+	}
+	if artifactSigningKey != "" {
+		key, err := controllers.LoadSigningKey(artifactSigningKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid artifact signing key: %v\n", err)
+			return 1
+		}
+		storage.SigningKey = key
+	}
+	c, err := ctrlclient.New(client.GetConfigOrDie(clientOptions), ctrlclient.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create client: %v\n", err)
+		return 1
+	}
+
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open artifact bundle: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	bundle, err := storage.ImportArtifacts(context.Background(), c, r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to import artifacts: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "imported %d artifacts of %d sources\n", len(bundle.Files), len(bundle.Sources))
+	return 0
+}
@@ -0,0 +1,510 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+const (
+	// ArtifactBundleVersion is the version of the manifest of the artifact bundles.
+	ArtifactBundleVersion = 1
+
+	// artifactBundleManifest is the name of the manifest, the first entry of the archive of an artifact bundle.
+	artifactBundleManifest = "manifest.json"
+
+	// artifactBundleDir is the directory of the files of the artifacts in the archive of an artifact bundle.
+	artifactBundleDir = "artifacts/"
+)
+
+// ArtifactBundle is the manifest of an archive of the artifacts of the sources, with which the storage of a
+// controller in an air-gapped cluster is seeded.
+type ArtifactBundle struct {
+	// Version is the ArtifactBundleVersion of the manifest.
+	Version int `json:"version"`
+
+	// Sources are the sources of which the artifacts are bundled, sorted by kind, namespace and name.
+	Sources []BundledSource `json:"sources"`
+
+	// Files are the hex encoded SHA256 checksums of the files of the artifacts, by the path of the artifacts.
+	Files map[string]string `json:"files"`
+}
+
+// BundledSource is a source of an ArtifactBundle, with the artifacts in its status.
+type BundledSource struct {
+	// Kind is the kind of the source, e.g. GitRepository.
+	Kind string `json:"kind"`
+
+	// Namespace is the namespace of the source.
+	Namespace string `json:"namespace"`
+
+	// Name is the name of the source.
+	Name string `json:"name"`
+
+	// Artifact is the artifact of the source.
+	Artifact sourcev1.Artifact `json:"artifact"`
+
+	// IncludedArtifacts are the included artifacts of a GitRepository.
+	IncludedArtifacts []*sourcev1.Artifact `json:"includedArtifacts,omitempty"`
+
+	// LinkName is the name of the link to the artifact, of which the URL is the URL in the status of the source,
+	// e.g. 'index.yaml' for a HelmRepository.
+	LinkName string `json:"linkName,omitempty"`
+}
+
+// ExportArtifacts writes the artifacts of all sources with an artifact in the Storage, and the ArtifactBundle of
+// their revisions and checksums, to a gzipped tarball. The artifacts are verified against their digest before they
+// are written, and the export fails if any artifact is missing or corrupt, e.g. if it is only stored in the Backend.
+func (s *Storage) ExportArtifacts(ctx context.Context, reader client.Reader, w io.Writer) (*ArtifactBundle, error) {
+	sources, err := listSources(ctx, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &ArtifactBundle{Version: ArtifactBundleVersion, Files: map[string]string{}}
+	var artifacts []sourcev1.Artifact
+	for _, source := range sources {
+		artifact := source.GetArtifact()
+		if artifact == nil {
+			continue
+		}
+		bundled := BundledSource{
+			Kind:      bundledSourceKind(source),
+			Namespace: source.GetNamespace(),
+			Name:      source.GetName(),
+			Artifact:  *artifact,
+		}
+		if repository, ok := source.(*sourcev1.GitRepository); ok {
+			bundled.IncludedArtifacts = repository.Status.IncludedArtifacts
+		}
+		if statusURL := sourceStatusURL(source); statusURL != "" {
+			bundled.LinkName = path.Base(statusURL)
+		}
+
+		for _, a := range append([]*sourcev1.Artifact{artifact}, bundled.IncludedArtifacts...) {
+			if _, ok := bundle.Files[a.Path]; ok {
+				continue
+			}
+			if err := s.verifyFile(*a); err != nil {
+				return nil, fmt.Errorf("unable to export the artifact of %s '%s/%s': %w",
+					bundled.Kind, bundled.Namespace, bundled.Name, err)
+			}
+			checksum, err := s.fileChecksum(*a)
+			if err != nil {
+				return nil, fmt.Errorf("unable to export the artifact of %s '%s/%s': %w",
+					bundled.Kind, bundled.Namespace, bundled.Name, err)
+			}
+			bundle.Files[a.Path] = checksum
+			artifacts = append(artifacts, *a)
+		}
+		bundle.Sources = append(bundle.Sources, bundled)
+	}
+	sort.Slice(bundle.Sources, func(i, j int) bool {
+		a, b := bundle.Sources[i], bundle.Sources[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Path < artifacts[j].Path })
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	manifest, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: artifactBundleManifest, Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return nil, err
+	}
+	for _, artifact := range artifacts {
+		if err := s.writeBundleFile(tw, artifact); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// writeBundleFile writes the file of the given v1beta1.Artifact to the given tar.Writer, under the artifactBundleDir.
+func (s *Storage) writeBundleFile(tw *tar.Writer, artifact sourcev1.Artifact) error {
+	f, err := os.Open(s.LocalPath(artifact))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    artifactBundleDir + artifact.Path,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// fileChecksum returns the hex encoded SHA256 checksum of the file of the given v1beta1.Artifact.
+func (s *Storage) fileChecksum(artifact sourcev1.Artifact) (string, error) {
+	f, err := os.Open(s.LocalPath(artifact))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return s.Checksum(f), nil
+}
+
+// ImportArtifacts imports the artifacts of the gzipped tarball of an ArtifactBundle into the Storage, and patches
+// the status of their sources with the artifacts, marked ready with the ArtifactImportedReason. The bundle is
+// refused as a whole, before the Storage or any source is modified, if any file is missing, unexpected or does not
+// match its checksum, if any artifact does not match its digest, or if any source does not exist. The imported
+// artifacts are signed with the SigningKey of the Storage, and uploaded to its Backend.
+func (s *Storage) ImportArtifacts(ctx context.Context, c client.Client, r io.Reader) (*ArtifactBundle, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact bundle: %w", err)
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact bundle: %w", err)
+	}
+	if header.Name != artifactBundleManifest {
+		return nil, fmt.Errorf("invalid artifact bundle: first entry '%s' is not the manifest '%s'", header.Name, artifactBundleManifest)
+	}
+	var bundle ArtifactBundle
+	if err := json.NewDecoder(tr).Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("invalid artifact bundle manifest: %w", err)
+	}
+	if err := bundle.validate(); err != nil {
+		return nil, fmt.Errorf("invalid artifact bundle manifest: %w", err)
+	}
+
+	// The files are staged in the BasePath, to be renamed in place once all of them are verified
+	staging, err := os.MkdirTemp(s.BasePath, ".import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	if err := s.stageBundleFiles(tr, &bundle, staging); err != nil {
+		return nil, err
+	}
+
+	sources := make([]artifactSource, 0, len(bundle.Sources))
+	for _, bundled := range bundle.Sources {
+		for _, a := range append([]*sourcev1.Artifact{&bundled.Artifact}, bundled.IncludedArtifacts...) {
+			f, err := os.Open(filepath.Join(staging, filepath.FromSlash(a.Path)))
+			if err != nil {
+				return nil, err
+			}
+			err = verifyBundledArtifact(f, *a)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("artifact of %s '%s/%s' refused: %w", bundled.Kind, bundled.Namespace, bundled.Name, err)
+			}
+		}
+		source := newBundledSource(bundled.Kind)
+		if err := c.Get(ctx, types.NamespacedName{Namespace: bundled.Namespace, Name: bundled.Name}, source); err != nil {
+			return nil, fmt.Errorf("unable to get %s '%s/%s': %w", bundled.Kind, bundled.Namespace, bundled.Name, err)
+		}
+		sources = append(sources, source)
+	}
+
+	paths := make([]string, 0, len(bundle.Files))
+	for p := range bundle.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		artifact := sourcev1.Artifact{Path: p}
+		if err := s.MkdirAll(artifact); err != nil {
+			return nil, err
+		}
+		localPath := s.LocalPath(artifact)
+		if err := os.Rename(filepath.Join(staging, filepath.FromSlash(p)), localPath); err != nil {
+			return nil, err
+		}
+		if err := syncDir(filepath.Dir(localPath)); err != nil {
+			return nil, err
+		}
+		if err := s.upload(p, localPath, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, bundled := range bundle.Sources {
+		if err := s.importSource(ctx, c, sources[i], bundled); err != nil {
+			return nil, fmt.Errorf("unable to import the artifact of %s '%s/%s': %w", bundled.Kind, bundled.Namespace, bundled.Name, err)
+		}
+	}
+	return &bundle, nil
+}
+
+// stageBundleFiles writes the files of the given tar.Reader to the given staging directory, and verifies that they
+// are exactly the files of the given ArtifactBundle, with their checksum.
+func (s *Storage) stageBundleFiles(tr *tar.Reader, bundle *ArtifactBundle, staging string) error {
+	staged := map[string]bool{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid artifact bundle: %w", err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		p := strings.TrimPrefix(header.Name, artifactBundleDir)
+		checksum, ok := bundle.Files[p]
+		if header.Typeflag != tar.TypeReg || !strings.HasPrefix(header.Name, artifactBundleDir) || !ok {
+			return fmt.Errorf("artifact bundle refused: unexpected entry '%s'", header.Name)
+		}
+		if staged[p] {
+			return fmt.Errorf("artifact bundle refused: duplicate entry '%s'", header.Name)
+		}
+		staged[p] = true
+
+		localPath := filepath.Join(staging, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0777); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(localPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(f, h), tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if got := fmt.Sprintf("%x", h.Sum(nil)); got != checksum {
+			return fmt.Errorf("artifact bundle refused: checksum '%s' of '%s' does not match '%s'", got, p, checksum)
+		}
+	}
+	for p := range bundle.Files {
+		if !staged[p] {
+			return fmt.Errorf("artifact bundle refused: missing file '%s'", p)
+		}
+	}
+	return nil
+}
+
+// importSource patches the status of the given source with the artifacts of the given BundledSource, with the URLs
+// of the Storage, and marks it ready with the ArtifactImportedReason.
+func (s *Storage) importSource(ctx context.Context, c client.Client, source artifactSource, bundled BundledSource) error {
+	artifact := bundled.Artifact.DeepCopy()
+	s.SetArtifactURL(artifact)
+	if err := s.signFile(artifact); err != nil {
+		return err
+	}
+	var statusURL string
+	if bundled.LinkName != "" {
+		u, err := s.Symlink(*artifact, bundled.LinkName)
+		if err != nil {
+			return err
+		}
+		statusURL = u
+	}
+	message := fmt.Sprintf("imported artifact for revision '%s'", artifact.Revision)
+
+	patch := client.MergeFrom(source.DeepCopyObject().(client.Object))
+	switch src := source.(type) {
+	case *sourcev1.Bucket:
+		*src = sourcev1.BucketReady(*src, *artifact, statusURL, sourcev1.ArtifactImportedReason, message)
+	case *sourcev1.GitRepository:
+		included := make([]*sourcev1.Artifact, 0, len(bundled.IncludedArtifacts))
+		for _, a := range bundled.IncludedArtifacts {
+			a = a.DeepCopy()
+			s.SetArtifactURL(a)
+			included = append(included, a)
+		}
+		*src = sourcev1.GitRepositoryReady(*src, *artifact, included, statusURL, sourcev1.ArtifactImportedReason, message)
+	case *sourcev1.HelmChart:
+		*src = sourcev1.HelmChartReady(*src, *artifact, statusURL, sourcev1.ArtifactImportedReason, message)
+	case *sourcev1.HelmRepository:
+		*src = sourcev1.HelmRepositoryReady(*src, *artifact, statusURL, sourcev1.ArtifactImportedReason, message)
+	case *sourcev1.OCIRepository:
+		*src = sourcev1.OCIRepositoryReady(*src, *artifact, statusURL, sourcev1.ArtifactImportedReason, message)
+	}
+	return c.Status().Patch(ctx, source, patch)
+}
+
+// signFile signs the file of the given v1beta1.Artifact with the SigningKey, or removes its signature without one.
+func (s *Storage) signFile(artifact *sourcev1.Artifact) error {
+	f, err := os.Open(s.LocalPath(*artifact))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := s.newArtifactHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return s.sign(artifact, h)
+}
+
+// validate returns an error if the ArtifactBundle has an unsupported version, a source of an unknown kind, an
+// artifact outside of the directory of its source, or a file that is not the artifact of one of its sources.
+func (b *ArtifactBundle) validate() error {
+	if b.Version != ArtifactBundleVersion {
+		return fmt.Errorf("unsupported version %d, must be %d", b.Version, ArtifactBundleVersion)
+	}
+	artifacts := map[string]bool{}
+	for _, bundled := range b.Sources {
+		if newBundledSource(bundled.Kind) == nil {
+			return fmt.Errorf("unsupported kind '%s' of source '%s/%s'", bundled.Kind, bundled.Namespace, bundled.Name)
+		}
+		dir := sourcev1.ArtifactDir(bundled.Kind, bundled.Namespace, bundled.Name) + "/"
+		if !strings.HasPrefix(bundled.Artifact.Path, dir) {
+			return fmt.Errorf("artifact '%s' of %s '%s/%s' is not in '%s'", bundled.Artifact.Path, bundled.Kind,
+				bundled.Namespace, bundled.Name, dir)
+		}
+		if bundled.LinkName != "" && (bundled.LinkName != path.Base(bundled.LinkName) || bundled.LinkName == "." ||
+			bundled.LinkName == ".." || bundled.LinkName == path.Base(bundled.Artifact.Path)) {
+			return fmt.Errorf("invalid link name '%s' of %s '%s/%s'", bundled.LinkName, bundled.Kind, bundled.Namespace, bundled.Name)
+		}
+		for _, a := range append([]*sourcev1.Artifact{&bundled.Artifact}, bundled.IncludedArtifacts...) {
+			if a == nil || !validArtifactPath(a.Path) {
+				return fmt.Errorf("invalid artifact path of %s '%s/%s'", bundled.Kind, bundled.Namespace, bundled.Name)
+			}
+			if _, ok := b.Files[a.Path]; !ok {
+				return fmt.Errorf("artifact '%s' of %s '%s/%s' is not in the files", a.Path, bundled.Kind,
+					bundled.Namespace, bundled.Name)
+			}
+			artifacts[a.Path] = true
+		}
+	}
+	for p := range b.Files {
+		if !artifacts[p] {
+			return fmt.Errorf("file '%s' is not the artifact of a source", p)
+		}
+	}
+	return nil
+}
+
+// validArtifactPath returns true if the given path is a clean relative path of an artifact, in the directory of a
+// kind, namespace and name.
+func validArtifactPath(p string) bool {
+	return p != "" && path.Clean(p) == p && !path.IsAbs(p) && !strings.HasPrefix(p, "../") &&
+		strings.Count(p, "/") >= 3 && !strings.Contains(p, "\\")
+}
+
+// verifyBundledArtifact verifies the data of the given io.Reader against the digest or checksum of the given
+// v1beta1.Artifact, if it has any.
+func verifyBundledArtifact(r io.Reader, artifact sourcev1.Artifact) error {
+	digest := artifact.Digest
+	if digest == "" {
+		digest = artifact.Checksum
+	}
+	if digest == "" {
+		return nil
+	}
+	if err := VerifyDigest(r, digest); err != nil {
+		return fmt.Errorf("artifact '%s': %w", artifact.Path, err)
+	}
+	return nil
+}
+
+// bundledSourceKind returns the kind of the given source.
+func bundledSourceKind(source artifactSource) string {
+	switch source.(type) {
+	case *sourcev1.Bucket:
+		return sourcev1.BucketKind
+	case *sourcev1.GitRepository:
+		return sourcev1.GitRepositoryKind
+	case *sourcev1.HelmChart:
+		return sourcev1.HelmChartKind
+	case *sourcev1.HelmRepository:
+		return sourcev1.HelmRepositoryKind
+	case *sourcev1.OCIRepository:
+		return sourcev1.OCIRepositoryKind
+	}
+	return source.GetObjectKind().GroupVersionKind().Kind
+}
+
+// newBundledSource returns a new source of the given kind, nil for an unknown kind.
+func newBundledSource(kind string) artifactSource {
+	switch kind {
+	case sourcev1.BucketKind:
+		return &sourcev1.Bucket{}
+	case sourcev1.GitRepositoryKind:
+		return &sourcev1.GitRepository{}
+	case sourcev1.HelmChartKind:
+		return &sourcev1.HelmChart{}
+	case sourcev1.HelmRepositoryKind:
+		return &sourcev1.HelmRepository{}
+	case sourcev1.OCIRepositoryKind:
+		return &sourcev1.OCIRepository{}
+	}
+	return nil
+}
+
+// sourceStatusURL returns the URL in the status of the given source, the URL of the link to its artifact.
+func sourceStatusURL(source artifactSource) string {
+	switch src := source.(type) {
+	case *sourcev1.Bucket:
+		return src.Status.URL
+	case *sourcev1.GitRepository:
+		return src.Status.URL
+	case *sourcev1.HelmChart:
+		return src.Status.URL
+	case *sourcev1.HelmRepository:
+		return src.Status.URL
+	case *sourcev1.OCIRepository:
+		return src.Status.URL
+	}
+	return ""
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// artifactBundleFixture returns a storage populated with the artifacts of a
+// GitRepository with an included GitRepository, a HelmRepository and a
+// HelmChart, and a client with these sources.
+func artifactBundleFixture(t *testing.T) (*Storage, client.Client, []client.Object) {
+	t.Helper()
+	storage, err := NewStorage(t.TempDir(), "source-controller.flux-system", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	store := func(kind string, obj metav1.Object, revision, fileName, content, linkName string) (*sourcev1.Artifact, string) {
+		artifact := storage.NewArtifactFor(kind, obj, revision, fileName)
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AtomicWriteFile(&artifact, strings.NewReader(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var url string
+		if linkName != "" {
+			if url, err = storage.Symlink(artifact, linkName); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &artifact, url
+	}
+
+	included := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "included", Namespace: "default"}}
+	included.Status.Artifact, included.Status.URL = store(sourcev1.GitRepositoryKind, included, "main/1234", "1234.tar.gz", "included", "latest.tar.gz")
+	repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	repository.Status.Artifact, repository.Status.URL = store(sourcev1.GitRepositoryKind, repository, "main/5678", "5678.tar.gz", "repository", "latest.tar.gz")
+	repository.Status.IncludedArtifacts = []*sourcev1.Artifact{included.Status.Artifact}
+	helmRepository := &sourcev1.HelmRepository{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "apps"}}
+	helmRepository.Status.Artifact, helmRepository.Status.URL = store(sourcev1.HelmRepositoryKind, helmRepository, "abcd", "index-abcd.yaml", "entries: {}", "index.yaml")
+	chart := &sourcev1.HelmChart{ObjectMeta: metav1.ObjectMeta{Name: "apps-podinfo", Namespace: "apps"}}
+	chart.Status.Artifact, chart.Status.URL = store(sourcev1.HelmChartKind, chart, "6.0.0", "podinfo-6.0.0.tgz", "chart", "podinfo-latest.tgz")
+	// a source without an artifact is not exported
+	bucket := &sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"}}
+
+	objects := []client.Object{included, repository, helmRepository, chart, bucket}
+	return storage, fake.NewClientBuilder().WithScheme(artifactBundleScheme(t)).WithObjects(objects...).Build(), objects
+}
+
+func artifactBundleScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+// airGappedCluster returns an empty storage and a client with the given
+// sources, without their status.
+func airGappedCluster(t *testing.T, objects []client.Object) (*Storage, client.Client) {
+	t.Helper()
+	storage, err := NewStorage(t.TempDir(), "artifacts.flux-system:8080", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	var specs []client.Object
+	for _, obj := range objects {
+		spec := obj.DeepCopyObject().(client.Object)
+		switch s := spec.(type) {
+		case *sourcev1.GitRepository:
+			s.Status = sourcev1.GitRepositoryStatus{}
+		case *sourcev1.HelmRepository:
+			s.Status = sourcev1.HelmRepositoryStatus{}
+		case *sourcev1.HelmChart:
+			s.Status = sourcev1.HelmChartStatus{}
+		}
+		spec.SetResourceVersion("")
+		specs = append(specs, spec)
+	}
+	return storage, fake.NewClientBuilder().WithScheme(artifactBundleScheme(t)).WithObjects(specs...).Build()
+}
+
+func TestStorage_ExportImportArtifacts(t *testing.T) {
+	storage, c, objects := artifactBundleFixture(t)
+	var buf bytes.Buffer
+	bundle, err := storage.ExportArtifacts(context.TODO(), c, &buf)
+	if err != nil {
+		t.Fatalf("ExportArtifacts() error = %v", err)
+	}
+	if len(bundle.Sources) != 4 || len(bundle.Files) != 4 {
+		t.Fatalf("ExportArtifacts() = %d sources and %d files, want 4 of each", len(bundle.Sources), len(bundle.Files))
+	}
+
+	imported, ic := airGappedCluster(t, objects)
+	if _, err := imported.ImportArtifacts(context.TODO(), ic, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ImportArtifacts() error = %v", err)
+	}
+
+	var repository sourcev1.GitRepository
+	if err := ic.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "repository"}, &repository); err != nil {
+		t.Fatal(err)
+	}
+	want := objects[1].(*sourcev1.GitRepository).Status.Artifact
+	got := repository.GetArtifact()
+	if got == nil || got.Revision != want.Revision || got.Checksum != want.Checksum || got.Digest != want.Digest || got.Path != want.Path {
+		t.Fatalf("imported artifact = %+v, want %+v", got, want)
+	}
+	if wantURL := "http://artifacts.flux-system:8080/" + want.Path; got.URL != wantURL {
+		t.Errorf("imported artifact URL = %q, want %q", got.URL, wantURL)
+	}
+	if wantURL := "http://artifacts.flux-system:8080/gitrepository/default/repository/latest.tar.gz"; repository.Status.URL != wantURL {
+		t.Errorf("imported URL = %q, want %q", repository.Status.URL, wantURL)
+	}
+	if len(repository.Status.IncludedArtifacts) != 1 || !strings.HasPrefix(repository.Status.IncludedArtifacts[0].URL, "http://artifacts.flux-system:8080/") {
+		t.Errorf("imported included artifacts = %+v, want the included artifact at the new hostname", repository.Status.IncludedArtifacts)
+	}
+	ready := apimeta.FindStatusCondition(repository.Status.Conditions, meta.ReadyCondition)
+	if ready == nil || ready.Status != metav1.ConditionTrue || ready.Reason != sourcev1.ArtifactImportedReason {
+		t.Errorf("Ready condition = %+v, want True with the %s reason", ready, sourcev1.ArtifactImportedReason)
+	}
+
+	for _, obj := range objects {
+		source := obj.(sourcev1.Source)
+		if source.GetArtifact() == nil {
+			continue
+		}
+		if err := imported.VerifyArtifact(*source.GetArtifact()); err != nil {
+			t.Errorf("VerifyArtifact() of the imported artifact error = %v", err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(imported.BasePath, "helmrepository/apps/podinfo/index.yaml")); err != nil ||
+		filepath.Base(target) != "index-abcd.yaml" {
+		t.Errorf("index.yaml links to %q (%v), want the imported index", target, err)
+	}
+
+	// The bundle exported from the air-gapped cluster has the same sources and files
+	var again bytes.Buffer
+	reexported, err := imported.ExportArtifacts(context.TODO(), ic, &again)
+	if err != nil {
+		t.Fatalf("ExportArtifacts() of the imported artifacts error = %v", err)
+	}
+	for p, checksum := range bundle.Files {
+		if reexported.Files[p] != checksum {
+			t.Errorf("re-exported file %q checksum = %q, want %q", p, reexported.Files[p], checksum)
+		}
+	}
+}
+
+func TestStorage_ImportArtifacts_refused(t *testing.T) {
+	storage, c, objects := artifactBundleFixture(t)
+	var buf bytes.Buffer
+	if _, err := storage.ExportArtifacts(context.TODO(), c, &buf); err != nil {
+		t.Fatalf("ExportArtifacts() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		rewrite func(name string, data []byte) (string, []byte)
+		objects []client.Object
+		wantErr string
+	}{
+		{
+			name: "tampered file",
+			rewrite: func(name string, data []byte) (string, []byte) {
+				if strings.HasSuffix(name, "index-abcd.yaml") {
+					return name, []byte("entries: {tampered: true}")
+				}
+				return name, data
+			},
+			objects: objects,
+			wantErr: "does not match",
+		},
+		{
+			name: "missing file",
+			rewrite: func(name string, data []byte) (string, []byte) {
+				if strings.HasSuffix(name, "podinfo-6.0.0.tgz") {
+					return "", nil
+				}
+				return name, data
+			},
+			objects: objects,
+			wantErr: "missing file 'helmchart/apps/apps-podinfo/podinfo-6.0.0.tgz'",
+		},
+		{
+			name: "unexpected file",
+			rewrite: func(name string, data []byte) (string, []byte) {
+				if strings.HasSuffix(name, "podinfo-6.0.0.tgz") {
+					return artifactBundleDir + "helmchart/apps/other/podinfo-6.0.0.tgz", data
+				}
+				return name, data
+			},
+			objects: objects,
+			wantErr: "unexpected entry",
+		},
+		{
+			name: "manifest outside of the directory of a source",
+			rewrite: func(name string, data []byte) (string, []byte) {
+				if name == artifactBundleManifest {
+					return name, bytes.ReplaceAll(data, []byte(`"path": "helmchart/apps/apps-podinfo/`), []byte(`"path": "helmchart/apps/../../`))
+				}
+				return name, data
+			},
+			objects: objects,
+			wantErr: "invalid artifact bundle manifest",
+		},
+		{
+			name:    "missing source",
+			rewrite: func(name string, data []byte) (string, []byte) { return name, data },
+			objects: objects[1:],
+			wantErr: "unable to get GitRepository 'default/included'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imported, ic := airGappedCluster(t, tt.objects)
+			_, err := imported.ImportArtifacts(context.TODO(), ic, rewriteArtifactBundle(t, buf.Bytes(), tt.rewrite))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ImportArtifacts() error = %v, want %q", err, tt.wantErr)
+			}
+
+			// Neither the storage nor the sources are modified
+			entries, err := os.ReadDir(imported.BasePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("storage has %d entries after a refused import, want none", len(entries))
+			}
+			var repository sourcev1.GitRepository
+			if err := ic.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "repository"}, &repository); err != nil {
+				t.Fatal(err)
+			}
+			if repository.GetArtifact() != nil {
+				t.Errorf("source has the artifact %+v after a refused import", repository.GetArtifact())
+			}
+		})
+	}
+}
+
+// rewriteArtifactBundle returns the given artifact bundle with its entries
+// rewritten by the given function, which drops an entry with an empty name.
+func rewriteArtifactBundle(t *testing.T, bundle []byte, rewrite func(name string, data []byte) (string, []byte)) io.Reader {
+	t.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, data := rewrite(header.Name, data)
+		if name == "" {
+			continue
+		}
+		header.Name, header.Size = name, int64(len(data))
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
@@ -18,17 +18,20 @@ package controllers
 
 import (
 	"context"
-	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 	"github.com/go-logr/logr"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
-	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -37,10 +40,14 @@ import (
 	kuberecorder "k8s.io/client-go/tools/record"
 	"k8s.io/client-go/tools/reference"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/fluxcd/pkg/runtime/events"
@@ -48,6 +55,13 @@ import (
 	"github.com/fluxcd/pkg/runtime/predicates"
 
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/egress"
+	"github.com/fluxcd/source-controller/internal/fips"
+	"github.com/fluxcd/source-controller/internal/redact"
+	"github.com/fluxcd/source-controller/internal/transport"
+	"github.com/fluxcd/source-controller/pkg/azure"
+	"github.com/fluxcd/source-controller/pkg/gcp"
+	"github.com/fluxcd/source-controller/pkg/minio"
 	"github.com/fluxcd/source-controller/pkg/sourceignore"
 )
 
@@ -56,6 +70,41 @@ import (
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=buckets/finalizers,verbs=get;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
 
+// BucketProvider is an interface for the object storage clients used to
+// fetch the contents of a Bucket.
+type BucketProvider interface {
+	// BucketExists returns if the bucket with the given name exists.
+	BucketExists(ctx context.Context, bucketName string) (bool, error)
+	// FGetObject downloads the object with the given name from the bucket to
+	// the given local path, and returns its content type.
+	FGetObject(ctx context.Context, bucketName, objectName, localPath string) (string, error)
+	// VisitObjects lists all objects in the bucket with a key starting with
+	// the given prefix, and calls visit with the key, ETag, size and last
+	// modification time of every object.
+	VisitObjects(ctx context.Context, bucketName, prefix string, visit func(key, etag string, size int64, lastModified time.Time) error) error
+	// ObjectIsNotFound returns if the error is caused by a missing object.
+	ObjectIsNotFound(err error) bool
+	// IsAuthError returns if the error is caused by missing, invalid or
+	// insufficient credentials.
+	IsAuthError(err error) bool
+	// CredentialSource returns the name of the source of the credentials
+	// used by the provider.
+	CredentialSource() string
+	// Retries returns the number of retries of operations after a transient
+	// error.
+	Retries() int64
+	// Region returns the effective region of the bucket, or an empty string
+	// if it is unknown or the provider has no regions.
+	Region() string
+}
+
+// regionWarner is implemented by the BucketProviders which report when the
+// bucket is located in another region than the region configured in the
+// spec, which is used nonetheless.
+type regionWarner interface {
+	RegionWarning() string
+}
+
 // BucketReconciler reconciles a Bucket object
 type BucketReconciler struct {
 	client.Client
@@ -63,11 +112,36 @@ type BucketReconciler struct {
 	Storage               *Storage
 	EventRecorder         kuberecorder.EventRecorder
 	ExternalEventRecorder *events.Recorder
+	EventLimiter          *EventLimiter
+	FetchMetrics          *FetchMetrics
 	MetricsRecorder       *metrics.Recorder
+	downloadConcurrency   int
+	fullResyncInterval    time.Duration
+	maxObjects            int64
+	maxSize               int64
+	retryLimiter          *RetryLimiter
+	intervalJitter        *IntervalJitter
+	validator             *SourceValidator
+	defaults              *SourceDefaults
+	reconcileTracer       *ReconcileTracer
 }
 
 type BucketReconcilerOptions struct {
 	MaxConcurrentReconciles int
+	DownloadConcurrency     int
+	FullResyncInterval      time.Duration
+	MaxObjects              int64
+	MaxSize                 int64
+	MinRetryDelay           time.Duration
+	MaxRetryDelay           time.Duration
+	Drainer                 *Drainer
+	IntervalJitter          *IntervalJitter
+	ReconcileTracker        *ReconcileTracker
+	Validator               *SourceValidator
+	Defaults                *SourceDefaults
+	ReconcileTracer         *ReconcileTracer
+	ReconcileSpans          *ReconcileSpans
+	NamespaceLimiter        *NamespaceLimiter
 }
 
 func (r *BucketReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -75,15 +149,48 @@ func (r *BucketReconciler) SetupWithManager(mgr ctrl.Manager) error {
 }
 
 func (r *BucketReconciler) SetupWithManagerAndOptions(mgr ctrl.Manager, opts BucketReconcilerOptions) error {
+	r.retryLimiter = NewRetryLimiter(opts.MinRetryDelay, opts.MaxRetryDelay)
+	r.intervalJitter = opts.IntervalJitter
+	r.validator = opts.Validator
+	r.defaults = opts.Defaults
+	r.reconcileTracer = opts.ReconcileTracer
+	r.downloadConcurrency = opts.DownloadConcurrency
+	r.fullResyncInterval = opts.FullResyncInterval
+	r.maxObjects = opts.MaxObjects
+	r.maxSize = opts.MaxSize
+
+	if err := mgr.GetCache().IndexField(context.TODO(), &sourcev1.Bucket{}, sourcev1.SecretIndexKey,
+		indexBySecretRefs); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+
+	recordMaxConcurrentReconciles(sourcev1.BucketKind, opts.MaxConcurrentReconciles)
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&sourcev1.Bucket{}).
-		WithEventFilter(predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{})).
-		WithOptions(controller.Options{MaxConcurrentReconciles: opts.MaxConcurrentReconciles}).
-		Complete(r)
+		For(&sourcev1.Bucket{}, builder.WithPredicates(
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}, ForceRefetchRequestedPredicate{}),
+		)).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSecretChange),
+		).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: opts.MaxConcurrentReconciles,
+			RateLimiter:             r.retryLimiter.rateLimiter(),
+		}).
+		Complete(opts.Drainer.Reconciler(opts.NamespaceLimiter.Reconciler(sourcev1.BucketKind,
+			opts.ReconcileSpans.Reconciler(sourcev1.BucketKind,
+				opts.ReconcileTracker.Reconciler(sourcev1.BucketKind, r)))))
 }
 
-func (r *BucketReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+// requestsForSecretChange returns the reconcile requests for the Bucket objects that reference the given Secret.
+func (r *BucketReconciler) requestsForSecretChange(o client.Object) []reconcile.Request {
+	return requestsForSecretChange(r, &sourcev1.BucketList{}, o)
+}
+
+func (r *BucketReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, retErr error) {
 	start := time.Now()
+	// redact the credentials from the error logged by the controller
+	defer func() { retErr = redact.Error(retErr) }()
 	log := ctrl.LoggerFrom(ctx)
 
 	var bucket sourcev1.Bucket
@@ -94,6 +201,11 @@ func (r *BucketReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	// Record suspended status metric
 	defer r.recordSuspension(ctx, bucket)
 
+	// Record the artifact URLs advertised in the status, to map the errors
+	// of the artifact server back to the object, and the size of the artifact
+	advertiseArtifact(sourcev1.BucketKind, &bucket)
+	recordArtifactSize(sourcev1.BucketKind, &bucket)
+
 	// Add our finalizer if it does not exist
 	if !controllerutil.ContainsFinalizer(&bucket, sourcev1.SourceFinalizer) {
 		controllerutil.AddFinalizer(&bucket, sourcev1.SourceFinalizer)
@@ -105,6 +217,9 @@ func (r *BucketReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	// Examine if the object is under deletion
 	if !bucket.ObjectMeta.DeletionTimestamp.IsZero() {
+		forgetReconciledSource(sourcev1.BucketKind, req.NamespacedName)
+		r.FetchMetrics.forget(sourcev1.BucketKind, &bucket)
+		setReconcilePhase(ctx, reconcilePhaseDeleting)
 		return r.reconcileDelete(ctx, bucket)
 	}
 
@@ -114,6 +229,32 @@ func (r *BucketReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		return ctrl.Result{}, nil
 	}
 
+	// apply the default interval and timeout of the controller, if the spec
+	// omits them
+	r.defaults.apply(&bucket)
+
+	// stagger the first reconciliations of the sources that are up to date
+	// after the start of the controller
+	upToDate := sourceUpToDate(&bucket, bucket.Status.ObservedGeneration,
+		bucket.Status.GetLastHandledReconcileRequest(), bucket.Status.Conditions)
+	if delay := r.intervalJitter.startupDelay(sourcev1.BucketKind, req.NamespacedName, upToDate, bucket.GetInterval().Duration); delay > 0 {
+		log.Info(fmt.Sprintf("Delaying the first reconciliation by %s", delay.String()))
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	recordReconcileStart(sourcev1.BucketKind, start, bucket.GetInterval().Duration)
+	ctx = r.reconcileTracer.start(ctx, start)
+
+	// cap the backoff of failed reconciliations at the retry interval
+	r.retryLimiter.setMaxDelay(req, bucket.Spec.RetryInterval)
+
+	// record the duration and result of the reconciliation
+	reconciled := &bucket
+	defer func() {
+		recordReconcile(sourcev1.BucketKind, reconciled, start, retErr)
+		advertiseArtifact(sourcev1.BucketKind, reconciled)
+		recordArtifactSize(sourcev1.BucketKind, reconciled)
+	}()
+
 	// record reconciliation duration
 	if r.MetricsRecorder != nil {
 		objRef, err := reference.GetReference(r.Scheme, &bucket)
@@ -123,15 +264,35 @@ func (r *BucketReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		defer r.MetricsRecorder.RecordDuration(*objRef, start)
 	}
 
-	// set initial status
-	if resetBucket, ok := r.resetStatus(bucket); ok {
-		bucket = resetBucket
-		if err := r.updateStatus(ctx, req, bucket.Status); err != nil {
+	// stall the bucket if its spec is invalid, e.g. it was created before
+	// the validation webhook was enabled, until it is corrected
+	if err := r.validator.validate(&bucket); err != nil {
+		stalledBucket := sourcev1.BucketStalled(*bucket.DeepCopy(), sourcev1.SpecInvalidReason, err.Error())
+		stalledBucket.Status.ObservedGeneration = stalledBucket.Generation
+		stalledBucket.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, stalledBucket.Status.Conditions, nil)
+		reconciled = &stalledBucket
+		if err := r.updateStatus(ctx, req, stalledBucket.Status); err != nil {
 			log.Error(err, "unable to update status")
 			return ctrl.Result{Requeue: true}, err
 		}
-		r.recordReadiness(ctx, bucket)
+		r.event(ctx, stalledBucket, events.EventSeverityError, err.Error(), nil)
+		r.recordReadiness(ctx, stalledBucket)
+		return ctrl.Result{}, nil
+	}
+
+	// warn about insecure connections once for every generation
+	if bucket.Spec.Insecure && bucket.Generation != bucket.Status.ObservedGeneration {
+		r.event(ctx, bucket, events.EventSeverityError,
+			fmt.Sprintf("insecure connection to endpoint '%s': TLS is not used or the certificate is not verified", bucket.Spec.Endpoint), nil)
+	}
+
+	// set initial status
+	bucket, _ = r.resetStatus(bucket)
+	if err := r.updateStatus(ctx, req, bucket.Status); err != nil {
+		log.Error(err, "unable to update status")
+		return ctrl.Result{Requeue: true}, err
 	}
+	r.recordReadiness(ctx, bucket)
 
 	// record the value of the reconciliation request, if any
 	// TODO(hidde): would be better to defer this in combination with
@@ -141,48 +302,116 @@ func (r *BucketReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	}
 
 	// purge old artifacts from storage
+	tracePhase(ctx, tracePhaseGC)
 	if err := r.gc(bucket); err != nil {
 		log.Error(err, "unable to purge old artifacts")
 	}
 
+	// bypass the caches if the bucket was annotated with a force refetch
+	// request newer than the handled one
+	refetch, force := forceRefetchRequest(&bucket, bucket.Status.LastHandledForceRefetchAt)
+
 	// reconcile bucket by downloading its content
-	reconciledBucket, reconcileErr := r.reconcile(ctx, *bucket.DeepCopy())
+	setReconcilePhase(ctx, reconcilePhaseFetching)
+	fetchCtx, rateLimits := transport.WithRateLimits(ctx)
+	reconciledBucket, reconcileErr := r.reconcile(withForceRefetch(fetchCtx, force), *bucket.DeepCopy())
+	reconciled = &reconciledBucket
+	if force && reconcileErr == nil {
+		reconciledBucket.Status.LastHandledForceRefetchAt = refetch
+	}
+
+	// delay the retry until the reset of the rate limit of the upstream, if
+	// the reconciliation was rejected by it
+	reconcileErr = recordUpstreamRateLimit(ctx, r.retryLimiter, req, sourcev1.BucketKind, &bucket,
+		upstreamURL(&bucket), rateLimits, reconcileErr)
+
+	// stall the bucket on a connection denied by the egress policy, as
+	// retrying does not resolve it
+	if egress.IsDenied(reconcileErr) {
+		reconciledBucket = sourcev1.BucketStalled(reconciledBucket, sourcev1.EgressDeniedReason, reconcileErr.Error())
+	}
+
+	// record the artifact written by the reconciliation as in the storage
+	r.Storage.recordArtifactInStorage(&reconciledBucket.Status.Conditions, reconciledBucket.Generation,
+		bucket.GetArtifact(), reconciledBucket.GetArtifact())
+
+	// record the failures to fetch the upstream
+	r.FetchMetrics.record(sourcev1.BucketKind, &reconciledBucket, reconciledBucket.Status.Conditions, reconcileErr)
+
+	// record the time of the next retry of a failed reconciliation
+	reconciledBucket.Status.NextRetryTime = r.retryLimiter.nextRetryTime(req, reconcileErr, reconciledBucket.Status.Conditions)
+
+	// record the trace of the reconciliation, and the revision of its span
+	reconciledBucket.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, reconciledBucket.Status.Conditions, reconcileErr)
+	spanRevision(ctx, reconciledBucket.GetArtifact())
 
 	// update status with the reconciliation result
+	setReconcilePhase(ctx, reconcilePhaseUpdatingStatus)
 	if err := r.updateStatus(ctx, req, reconciledBucket.Status); err != nil {
 		log.Error(err, "unable to update status")
 		return ctrl.Result{Requeue: true}, err
 	}
 
+	// if the bucket exceeds the limits, record the failure and requeue at the
+	// interval, as retrying does not resolve it
+	if reconcileErr != nil && apimeta.IsStatusConditionTrue(reconciledBucket.Status.Conditions, meta.StalledCondition) {
+		r.event(ctx, reconciledBucket, events.EventSeverityError, reconcileErr.Error(), nil)
+		r.recordReadiness(ctx, reconciledBucket)
+		if reconcileRequestPending(ctx, r, &reconciledBucket, reconciledBucket.Status.GetLastHandledReconcileRequest()) {
+			return ctrl.Result{Requeue: true}, reconcileErr
+		}
+		return ctrl.Result{RequeueAfter: r.intervalJitter.interval(bucket.GetInterval().Duration)}, nil
+	}
+
 	// if reconciliation failed, record the failure and requeue immediately
 	if reconcileErr != nil {
-		r.event(ctx, reconciledBucket, events.EventSeverityError, reconcileErr.Error())
+		r.event(ctx, reconciledBucket, events.EventSeverityError, reconcileErr.Error(), nil)
 		r.recordReadiness(ctx, reconciledBucket)
+		if next := reconciledBucket.Status.NextRetryTime; next != nil {
+			log.Info(fmt.Sprintf("Reconciliation failed, retrying at %s", next.Format(time.RFC3339)))
+		}
 		return ctrl.Result{Requeue: true}, reconcileErr
 	}
 
-	// emit revision change event
+	// emit revision change event and purge the previous artifacts
 	if bucket.Status.Artifact == nil || reconciledBucket.Status.Artifact.Revision != bucket.Status.Artifact.Revision {
-		r.event(ctx, reconciledBucket, events.EventSeverityInfo, sourcev1.BucketReadyMessage(reconciledBucket))
+		metadata := r.Storage.artifactMetadata(reconciledBucket.GetArtifact(), upstreamURL(&reconciledBucket))
+		r.event(ctx, reconciledBucket, events.EventSeverityInfo, sourcev1.BucketReadyMessage(reconciledBucket), metadata)
+		if err := r.gc(reconciledBucket); err != nil {
+			log.Error(err, "unable to purge old artifacts")
+		}
 	}
 	r.recordReadiness(ctx, reconciledBucket)
 
+	// shift the next run by a jitter, for the sources to drift apart
+	interval := r.intervalJitter.interval(bucket.GetInterval().Duration)
 	log.Info(fmt.Sprintf("Reconciliation finished in %s, next run in %s",
 		time.Now().Sub(start).String(),
-		bucket.GetInterval().Duration.String(),
+		interval.String(),
 	))
 
-	return ctrl.Result{RequeueAfter: bucket.GetInterval().Duration}, nil
+	// reconcile again right away if the object was annotated with a
+	// reconcile request during the reconciliation, as it is not handled
+	if reconcileRequestPending(ctx, r, &reconciledBucket, reconciledBucket.Status.GetLastHandledReconcileRequest()) {
+		log.Info("Reconcile request received during the reconciliation, reconciling again")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: interval}, nil
 }
 
 func (r *BucketReconciler) reconcile(ctx context.Context, bucket sourcev1.Bucket) (sourcev1.Bucket, error) {
-	s3Client, err := r.auth(ctx, bucket)
+	log := ctrl.LoggerFrom(ctx)
+
+	tracePhase(ctx, tracePhaseAuth)
+	provider, err := r.provider(ctx, bucket)
 	if err != nil {
 		err = fmt.Errorf("auth error: %w", err)
 		return sourcev1.BucketNotReady(bucket, sourcev1.AuthenticationFailedReason, err.Error()), err
 	}
 
 	// create tmp dir
+	tracePhase(ctx, tracePhaseFetch)
 	tempDir, err := os.MkdirTemp("", bucket.Name)
 	if err != nil {
 		err = fmt.Errorf("tmp dir error: %w", err)
@@ -192,23 +421,27 @@ func (r *BucketReconciler) reconcile(ctx context.Context, bucket sourcev1.Bucket
 
 	ctxTimeout, cancel := context.WithTimeout(ctx, bucket.Spec.Timeout.Duration)
 	defer cancel()
+	defer recordRetries(bucket, provider)
+	defer r.warnRegionMismatch(ctx, bucket, provider)
 
-	exists, err := s3Client.BucketExists(ctxTimeout, bucket.Spec.BucketName)
+	exists, err := provider.BucketExists(ctxTimeout, bucket.Spec.BucketName)
 	if err != nil {
-		return sourcev1.BucketNotReady(bucket, sourcev1.BucketOperationFailedReason, err.Error()), err
+		return sourcev1.BucketNotReady(bucket, bucketFailureReason(provider, err), err.Error()), err
 	}
 	if !exists {
 		err = fmt.Errorf("bucket '%s' not found", bucket.Spec.BucketName)
-		return sourcev1.BucketNotReady(bucket, sourcev1.BucketOperationFailedReason, err.Error()), err
+		return sourcev1.BucketNotReady(bucket, sourcev1.BucketNotFoundReason, err.Error()), err
 	}
+	bucket.Status.Region = provider.Region()
 
 	// Look for file with ignore rules first
 	// NB: S3 has flat filepath keys making it impossible to look
 	// for files in "subdirectories" without building up a tree first.
 	path := filepath.Join(tempDir, sourceignore.IgnoreFile)
-	if err := s3Client.FGetObject(ctxTimeout, bucket.Spec.BucketName, sourceignore.IgnoreFile, path, minio.GetObjectOptions{}); err != nil {
-		if resp, ok := err.(minio.ErrorResponse); ok && resp.Code != "NoSuchKey" {
-			return sourcev1.BucketNotReady(bucket, sourcev1.BucketOperationFailedReason, err.Error()), err
+	if _, err := provider.FGetObject(ctxTimeout, bucket.Spec.BucketName, sourceignore.IgnoreFile, path); err != nil {
+		if !provider.ObjectIsNotFound(err) {
+			err = fmt.Errorf("downloading object from bucket '%s' failed: '%s': %w", bucket.Spec.BucketName, sourceignore.IgnoreFile, err)
+			return sourcev1.BucketNotReady(bucket, bucketFailureReason(provider, err), err.Error()), err
 		}
 	}
 	ps, err := sourceignore.ReadIgnoreFile(path, nil)
@@ -222,28 +455,37 @@ func (r *BucketReconciler) reconcile(ctx context.Context, bucket sourcev1.Bucket
 	matcher := sourceignore.NewMatcher(ps)
 
 	// download bucket content
-	for object := range s3Client.ListObjects(ctxTimeout, bucket.Spec.BucketName, minio.ListObjectsOptions{
-		Recursive: true,
-		UseV1:     s3utils.IsGoogleEndpoint(*s3Client.EndpointURL()),
-	}) {
-		if object.Err != nil {
-			err = fmt.Errorf("listing objects from bucket '%s' failed: %w", bucket.Spec.BucketName, object.Err)
-			return sourcev1.BucketNotReady(bucket, sourcev1.BucketOperationFailedReason, err.Error()), err
-		}
-
-		if strings.HasSuffix(object.Key, "/") || object.Key == sourceignore.IgnoreFile {
-			continue
-		}
-
-		if matcher.Match(strings.Split(object.Key, "/"), false) {
-			continue
+	usage := newBucketUsage(r.limits(bucket))
+	objects, err := listObjects(ctxTimeout, provider, bucket, matcher, usage)
+	if err != nil {
+		err = fmt.Errorf("listing objects from bucket '%s' failed: %w", bucket.Spec.BucketName, err)
+		return bucketNotReady(bucket, provider, err), err
+	}
+	download := objectRefs(objects)
+	var lastFullSync time.Time
+	// reuse the unchanged objects from the current artifact, unless forced
+	// to refetch all objects
+	if prevIndex := r.loadIndex(bucket); prevIndex != nil && !forceRefetch(ctx) {
+		if remaining, err := r.restoreObjects(bucket, prevIndex, objects, tempDir); err != nil {
+			log.Info(fmt.Sprintf("Unable to reuse objects from current artifact, downloading all objects: %s", err.Error()))
+		} else {
+			download = remaining
+			lastFullSync = prevIndex.LastFullSync
 		}
+	}
+	if err := downloadObjects(ctxTimeout, provider, bucket.Spec.BucketName, download, tempDir, r.downloadConcurrency, usage); err != nil {
+		err = fmt.Errorf("downloading object from bucket '%s' failed: %w", bucket.Spec.BucketName, err)
+		return bucketNotReady(bucket, provider, err), err
+	}
+	index := newBucketIndex(bucket, objects)
+	if !lastFullSync.IsZero() {
+		index.LastFullSync = lastFullSync
+	}
 
-		localPath := filepath.Join(tempDir, object.Key)
-		err := s3Client.FGetObject(ctxTimeout, bucket.Spec.BucketName, object.Key, localPath, minio.GetObjectOptions{})
-		if err != nil {
-			err = fmt.Errorf("downloading object from bucket '%s' failed: %w", bucket.Spec.BucketName, err)
-			return sourcev1.BucketNotReady(bucket, sourcev1.BucketOperationFailedReason, err.Error()), err
+	if bucket.Spec.IncludeMetadataManifest {
+		if err := writeMetadataManifest(tempDir, objects); err != nil {
+			err = fmt.Errorf("writing metadata manifest failed: %w", err)
+			return sourcev1.BucketNotReady(bucket, sourcev1.StorageOperationFailedReason, err.Error()), err
 		}
 	}
 
@@ -251,17 +493,29 @@ func (r *BucketReconciler) reconcile(ctx context.Context, bucket sourcev1.Bucket
 	if err != nil {
 		return sourcev1.BucketNotReady(bucket, sourcev1.StorageOperationFailedReason, err.Error()), err
 	}
+	tracePhaseDetail(ctx, "revision %s, %d objects", revision, len(objects))
 
-	// return early on unchanged revision
-	artifact := r.Storage.NewArtifactFor(bucket.Kind, bucket.GetObjectMeta(), revision, fmt.Sprintf("%s.tar.gz", revision))
-	if apimeta.IsStatusConditionTrue(bucket.Status.Conditions, meta.ReadyCondition) && bucket.GetArtifact().HasRevision(artifact.Revision) {
-		if artifact.URL != bucket.GetArtifact().URL {
+	// return early on unchanged revision, unless forced to refetch
+	artifact := r.Storage.NewArtifactFor(bucket.Kind, bucket.GetObjectMeta(), revision, revision+r.Storage.ArchiveExtension())
+	if !forceRefetch(ctx) && apimeta.IsStatusConditionTrue(bucket.Status.Conditions, meta.ReadyCondition) && r.hasRevision(bucket.GetArtifact(), artifact.Revision, tempDir) {
+		if !r.Storage.currentURL(bucket.GetArtifact().URL) {
 			r.Storage.SetArtifactURL(bucket.GetArtifact())
 			bucket.Status.URL = r.Storage.SetHostname(bucket.Status.URL)
 		}
+		// the ETags may have changed without changing the content
+		if err := r.saveIndex(*bucket.GetArtifact(), index); err != nil {
+			log.Error(err, "unable to write bucket index")
+		}
 		return bucket, nil
 	}
 
+	// ensure there is space for the artifact
+	if err := r.storagePruner().ensureSpace(ctx); err != nil {
+		return sourcev1.BucketNotReady(bucket, sourcev1.StorageFullReason, err.Error()), err
+	}
+
+	setReconcilePhase(ctx, reconcilePhaseStoring)
+	tracePhase(ctx, tracePhaseArchive)
 	// create artifact dir
 	err = r.Storage.MkdirAll(artifact)
 	if err != nil {
@@ -278,32 +532,46 @@ func (r *BucketReconciler) reconcile(ctx context.Context, bucket sourcev1.Bucket
 	defer unlock()
 
 	// archive artifact and check integrity
-	if err := r.Storage.Archive(&artifact, tempDir, nil); err != nil {
+	storage := r.Storage.WithArtifactMaxSize(bucket.Spec.MaxArtifactSize)
+	if err := storage.ArchiveWithModTimes(&artifact, tempDir, nil, objectModTimes(objects)); err != nil {
 		err = fmt.Errorf("storage archive error: %w", err)
-		return sourcev1.BucketNotReady(bucket, sourcev1.StorageOperationFailedReason, err.Error()), err
+		if isArtifactSizeError(err) {
+			return sourcev1.BucketStalled(bucket, sourcev1.ArtifactTooLargeReason, err.Error()), err
+		}
+		return sourcev1.BucketNotReady(bucket, storageFailureReason(err), err.Error()), err
+	}
+
+	// record the ETags of the archived objects for the next sync
+	if err := r.saveIndex(artifact, index); err != nil {
+		log.Error(err, "unable to write bucket index")
 	}
 
 	// update latest symlink
-	url, err := r.Storage.Symlink(artifact, "latest.tar.gz")
+	tracePhase(ctx, tracePhaseStore)
+	url, err := r.Storage.Symlink(artifact, "latest"+r.Storage.ArchiveExtension())
 	if err != nil {
 		err = fmt.Errorf("storage symlink error: %w", err)
 		return sourcev1.BucketNotReady(bucket, sourcev1.StorageOperationFailedReason, err.Error()), err
 	}
 
 	message := fmt.Sprintf("Fetched revision: %s", artifact.Revision)
+	if source := provider.CredentialSource(); source != "" {
+		message = fmt.Sprintf("%s, using %s credentials", message, source)
+	}
 	return sourcev1.BucketReady(bucket, artifact, url, sourcev1.BucketOperationSucceedReason, message), nil
 }
 
 func (r *BucketReconciler) reconcileDelete(ctx context.Context, bucket sourcev1.Bucket) (ctrl.Result, error) {
 	if err := r.gc(bucket); err != nil {
 		r.event(ctx, bucket, events.EventSeverityError,
-			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()))
+			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()), nil)
 		// Return the error so we retry the failed garbage collection
 		return ctrl.Result{}, err
 	}
 
 	// Record deleted status
 	r.recordReadiness(ctx, bucket)
+	deleteRetries(bucket)
 
 	// Remove our finalizer from the list and update it
 	controllerutil.RemoveFinalizer(&bucket, sourcev1.SourceFinalizer)
@@ -315,51 +583,221 @@ func (r *BucketReconciler) reconcileDelete(ctx context.Context, bucket sourcev1.
 	return ctrl.Result{}, nil
 }
 
-func (r *BucketReconciler) auth(ctx context.Context, bucket sourcev1.Bucket) (*minio.Client, error) {
-	opt := minio.Options{
-		Region: bucket.Spec.Region,
-		Secure: !bucket.Spec.Insecure,
+// provider returns the BucketProvider for the provider configured in the
+// spec of the given v1beta1.Bucket, authenticated with the credentials from
+// the referenced Secrets, if any.
+func (r *BucketReconciler) provider(ctx context.Context, bucket sourcev1.Bucket) (BucketProvider, error) {
+	var secret *corev1.Secret
+	if bucket.Spec.SecretRef != nil {
+		var err error
+		if secret, err = r.getSecret(ctx, bucket, bucket.Spec.SecretRef.Name); err != nil {
+			return nil, fmt.Errorf("credentials secret error: %w", err)
+		}
 	}
 
-	if bucket.Spec.SecretRef != nil {
-		secretName := types.NamespacedName{
-			Namespace: bucket.GetNamespace(),
-			Name:      bucket.Spec.SecretRef.Name,
+	proxy, warnings, err := proxyFromSecretRef(ctx, r.Client, bucket.GetNamespace(), bucket.Spec.ProxySecretRef)
+	for _, w := range warnings {
+		r.event(ctx, bucket, events.EventSeverityError, w, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch bucket.Spec.Provider {
+	case sourcev1.GoogleBucketProvider:
+		if bucket.Spec.STS != nil {
+			return nil, fmt.Errorf("STS configuration is not supported for provider '%s'", bucket.Spec.Provider)
+		}
+		return gcp.NewClient(ctx, bucket, secret, proxy)
+	case sourcev1.AzureBucketProvider:
+		if bucket.Spec.STS != nil {
+			return nil, fmt.Errorf("STS configuration is not supported for provider '%s'", bucket.Spec.Provider)
+		}
+		return azure.NewClient(bucket, secret, proxy)
+	default:
+		var tokenSecret *corev1.Secret
+		if bucket.Spec.STS != nil && bucket.Spec.STS.WebIdentityTokenSecretRef != nil {
+			var err error
+			if tokenSecret, err = r.getSecret(ctx, bucket, bucket.Spec.STS.WebIdentityTokenSecretRef.Name); err != nil {
+				return nil, fmt.Errorf("web identity token secret error: %w", err)
+			}
 		}
+		return minio.NewClient(bucket, secret, tokenSecret, proxy)
+	}
+}
 
-		var secret corev1.Secret
-		if err := r.Get(ctx, secretName, &secret); err != nil {
-			return nil, fmt.Errorf("credentials secret error: %w", err)
+// warnRegionMismatch emits a warning event when the given BucketProvider
+// reported that the bucket is located in another region than the region
+// configured in the spec of the given v1beta1.Bucket.
+func (r *BucketReconciler) warnRegionMismatch(ctx context.Context, bucket sourcev1.Bucket, provider BucketProvider) {
+	if w, ok := provider.(regionWarner); ok {
+		if msg := w.RegionWarning(); msg != "" {
+			r.event(ctx, bucket, events.EventSeverityError, msg, nil)
 		}
+	}
+}
 
-		accesskey := ""
-		secretkey := ""
-		if k, ok := secret.Data["accesskey"]; ok {
-			accesskey = string(k)
+// getSecret returns the Secret with the given name in the namespace of the
+// given v1beta1.Bucket.
+func (r *BucketReconciler) getSecret(ctx context.Context, bucket sourcev1.Bucket, name string) (*corev1.Secret, error) {
+	secretName := types.NamespacedName{
+		Namespace: bucket.GetNamespace(),
+		Name:      name,
+	}
+	var secret corev1.Secret
+	if err := r.Get(ctx, secretName, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// listObjects returns the objects in the bucket of the given v1beta1.Bucket
+// which are included in the artifact. Objects are included when their key
+// starts with the prefix from the spec, and is not matched by the ignore
+// patterns. Folder markers are only included when enabled in the spec, and
+// listing fails for a key that can not be materialised in the artifact. The
+// included objects are added to the given usage, and listing stops as soon
+// as they exceed its limits.
+func listObjects(ctx context.Context, provider BucketProvider, bucket sourcev1.Bucket, matcher gitignore.Matcher, usage *bucketUsage) ([]bucketObject, error) {
+	var objects []bucketObject
+	paths := map[string]bucketObject{}
+	err := provider.VisitObjects(ctx, bucket.Spec.BucketName, bucket.Spec.Prefix, func(key, etag string, size int64, lastModified time.Time) error {
+		// Not all S3 compatible implementations honour the prefix
+		if !strings.HasPrefix(key, bucket.Spec.Prefix) {
+			return nil
 		}
-		if k, ok := secret.Data["secretkey"]; ok {
-			secretkey = string(k)
+		if key == sourceignore.IgnoreFile {
+			return nil
+		}
+		if err := validateKey(key); err != nil {
+			return err
 		}
-		if accesskey == "" || secretkey == "" {
-			return nil, fmt.Errorf("invalid '%s' secret data: required fields 'accesskey' and 'secretkey'", secret.Name)
+		object := bucketObject{Key: key, ETag: etag, Size: size, LastModified: lastModified}
+		marker := isFolderMarker(object)
+		if marker && !bucket.Spec.IncludeFolderMarkers {
+			return nil
+		}
+		if matcher.Match(strings.Split(strings.TrimSuffix(key, "/"), "/"), marker) {
+			return nil
 		}
-		opt.Creds = credentials.NewStaticV4(accesskey, secretkey, "")
-	} else if bucket.Spec.Provider == sourcev1.AmazonBucketProvider {
-		opt.Creds = credentials.NewIAM("")
+		if err := checkObjectPath(paths, object); err != nil {
+			return err
+		}
+		if err := usage.add(1, size); err != nil {
+			return err
+		}
+		objects = append(objects, object)
+		return nil
+	})
+	return objects, err
+}
+
+// downloadObjects downloads the given objects from the bucket to their path
+// in the given directory, with at most concurrency downloads in parallel, and
+// sets their content type. Folder markers are created as empty directories. The difference between the downloaded and the listed size of
+// every object is added to the given usage. The first failed download, or a
+// download exceeding the limits of the usage, cancels the remaining
+// downloads, and its error is returned.
+func downloadObjects(ctx context.Context, provider BucketProvider, bucketName string, objects []*bucketObject, dir string, concurrency int, usage *bucketUsage) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	queue := make(chan *bucketObject)
+	group.Go(func() error {
+		defer close(queue)
+		for _, object := range objects {
+			select {
+			case queue <- object:
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			}
+		}
+		return nil
+	})
+	for i := 0; i < concurrency; i++ {
+		group.Go(func() error {
+			for object := range queue {
+				localPath := filepath.Join(dir, filepath.FromSlash(objectPath(*object)))
+				if isFolderMarker(*object) {
+					if err := os.MkdirAll(localPath, 0700); err != nil {
+						return fmt.Errorf("'%s': %w", object.Key, err)
+					}
+					continue
+				}
+				contentType, err := provider.FGetObject(groupCtx, bucketName, object.Key, localPath)
+				if err != nil {
+					return fmt.Errorf("'%s': %w", object.Key, err)
+				}
+				fi, err := os.Stat(localPath)
+				if err != nil {
+					return fmt.Errorf("'%s': %w", object.Key, err)
+				}
+				if err := usage.add(0, fi.Size()-object.Size); err != nil {
+					return err
+				}
+				object.ContentType = contentType
+			}
+			return nil
+		})
 	}
+	return group.Wait()
+}
 
-	if opt.Creds == nil {
-		return nil, fmt.Errorf("no bucket credentials found")
+// bucketNotReady returns the given v1beta1.Bucket marked as not ready for
+// the given error returned by the BucketProvider, or as stalled if the error
+// is a bucketLimitError.
+func bucketNotReady(bucket sourcev1.Bucket, provider BucketProvider, err error) sourcev1.Bucket {
+	var limitErr *bucketLimitError
+	if errors.As(err, &limitErr) {
+		return sourcev1.BucketStalled(bucket, sourcev1.BucketLimitExceededReason, err.Error())
 	}
+	return sourcev1.BucketNotReady(bucket, bucketFailureReason(provider, err), err.Error())
+}
 
-	return minio.New(bucket.Spec.Endpoint, &opt)
+// bucketFailureReason returns the condition reason for the given error
+// returned by the BucketProvider.
+func bucketFailureReason(provider BucketProvider, err error) string {
+	if provider.IsAuthError(err) {
+		return sourcev1.AuthenticationFailedReason
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return sourcev1.BucketConnectionFailedReason
+	}
+	return sourcev1.BucketOperationFailedReason
 }
 
-// checksum calculates the SHA1 checksum of the given root directory.
-// It traverses the given root directory and calculates the checksum for any found file, and returns the SHA1 sum of the
-// list with relative file paths and their checksums.
+// checksum calculates the revision of the given root directory, the hex
+// encoded SHA-256 digest of the sorted list of the slash separated relative
+// paths of all regular files and the SHA-256 of their content. The revision
+// only depends on the content of the objects, and not on their ETags, which
+// change when an object is uploaded again, e.g. in a different number of
+// multipart upload parts.
 func (r *BucketReconciler) checksum(root string) (string, error) {
-	sum := sha1.New()
+	sums, err := fileSums(root)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	for _, s := range sums {
+		sum.Write([]byte(fmt.Sprintf("%x  %s\n", s.sum, s.path)))
+	}
+	return fmt.Sprintf("%x", sum.Sum(nil)), nil
+}
+
+// legacyChecksum calculates the revision of the given root directory in the
+// format of previous versions, the SHA1 sum of the list of relative file
+// paths in lexical walk order and their SHA1 checksums. It is only used to
+// compare against the revision of existing artifacts, and returns an error in
+// FIPS mode.
+func (r *BucketReconciler) legacyChecksum(root string) (string, error) {
+	const use = "revision of the artifacts of previous versions"
+	sum, err := fips.Legacy(fips.SHA1, use)
+	if err != nil {
+		return "", err
+	}
 	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -375,7 +813,12 @@ func (r *BucketReconciler) checksum(root string) (string, error) {
 		if err != nil {
 			return err
 		}
-		sum.Write([]byte(fmt.Sprintf("%x  %s\n", sha1.Sum(data), relPath)))
+		fileSum, err := fips.Legacy(fips.SHA1, use)
+		if err != nil {
+			return err
+		}
+		fileSum.Write(data)
+		sum.Write([]byte(fmt.Sprintf("%x  %s\n", fileSum.Sum(nil), relPath)))
 		return nil
 	}); err != nil {
 		return "", err
@@ -383,55 +826,153 @@ func (r *BucketReconciler) checksum(root string) (string, error) {
 	return fmt.Sprintf("%x", sum.Sum(nil)), nil
 }
 
+// hasRevision returns if the given artifact has the revision of the given
+// root directory, in the current or in the legacy format.
+func (r *BucketReconciler) hasRevision(artifact *sourcev1.Artifact, revision, root string) bool {
+	if artifact.HasRevision(revision) {
+		return true
+	}
+	if artifact == nil || len(artifact.Revision) != legacyChecksumLength {
+		return false
+	}
+	legacy, err := r.legacyChecksum(root)
+	return err == nil && artifact.HasRevision(legacy)
+}
+
+// fileSum is the digest of the content of a file.
+type fileSum struct {
+	path string
+	sum  []byte
+}
+
+// fileSums returns the SHA-256 digests of the content of all regular files
+// in the given root directory, sorted by their slash separated relative path.
+// The files are streamed through the hash, instead of being read into memory.
+// Empty directories, which are created for folder markers, are included with
+// a path ending in a slash and without a digest.
+func fileSums(root string) ([]fileSum, error) {
+	var sums []fileSum
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != root {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				sums = append(sums, fileSum{path: filepath.ToSlash(relPath) + "/"})
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sums = append(sums, fileSum{path: filepath.ToSlash(relPath), sum: h.Sum(nil)})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i].path < sums[j].path })
+	return sums, nil
+}
+
 // resetStatus returns a modified v1beta1.Bucket and a boolean indicating
-// if the status field has been reset.
+// if the status field has been reset. The meta.ReconcilingCondition of a
+// status that is not reset is set, as a reconciliation is under way.
 func (r *BucketReconciler) resetStatus(bucket sourcev1.Bucket) (sourcev1.Bucket, bool) {
-	// We do not have an artifact, or it does no longer exist
-	if bucket.GetArtifact() == nil || !r.Storage.ArtifactExist(*bucket.GetArtifact()) {
+	// verify that the artifact is in the storage and intact
+	inStorage := r.Storage.artifactInStorage(bucket.GetArtifact(), bucket.Generation)
+	changed := false
+	switch {
+	case inStorage.Status != metav1.ConditionTrue:
+		// We do not have an artifact, or it is missing or corrupt
 		bucket = sourcev1.BucketProgressing(bucket)
 		bucket.Status.Artifact = nil
-		return bucket, true
-	}
-	if bucket.Generation != bucket.Status.ObservedGeneration {
-		return sourcev1.BucketProgressing(bucket), true
+		changed = true
+	case bucket.Generation != bucket.Status.ObservedGeneration:
+		bucket = sourcev1.BucketProgressing(bucket)
+		changed = true
+	default:
+		bucket = sourcev1.BucketReconciling(bucket)
 	}
-	return bucket, false
+	return bucket, setArtifactInStorage(&bucket.Status.Conditions, inStorage) || changed
 }
 
 // gc performs a garbage collection for the given v1beta1.Bucket.
-// It removes all but the current artifact except for when the
-// deletion timestamp is set, which will result in the removal of
-// all artifacts for the resource.
+// It removes the previous artifacts which exceed the retention of the
+// storage, except for when the deletion timestamp is set, which will
+// result in the removal of all artifacts for the resource.
 func (r *BucketReconciler) gc(bucket sourcev1.Bucket) error {
 	if !bucket.DeletionTimestamp.IsZero() {
-		return r.Storage.RemoveAll(r.Storage.NewArtifactFor(bucket.Kind, bucket.GetObjectMeta(), "", "*"))
+		return r.Storage.RemoveDeleted(bucket.Kind, bucket.GetObjectMeta())
 	}
 	if bucket.GetArtifact() != nil {
-		return r.Storage.RemoveAllButCurrent(*bucket.GetArtifact())
+		_, err := r.Storage.GarbageCollect(*bucket.GetArtifact())
+		return err
 	}
 	return nil
 }
 
 // event emits a Kubernetes event and forwards the event to notification controller if configured
-func (r *BucketReconciler) event(ctx context.Context, bucket sourcev1.Bucket, severity, msg string) {
+func (r *BucketReconciler) event(ctx context.Context, bucket sourcev1.Bucket, severity, msg string, metadata map[string]string) {
 	log := logr.FromContext(ctx)
+	msg = redact.String(msg)
+
+	// Duplicates are recorded as Kubernetes events nonetheless, which bump
+	// the count of the existing event
+	suppressed := r.EventLimiter.suppress(sourcev1.BucketKind, &bucket, severity, msg)
+	if suppressed == eventRateLimitedCause {
+		return
+	}
+
 	if r.EventRecorder != nil {
-		r.EventRecorder.Eventf(&bucket, "Normal", severity, msg)
+		if len(metadata) > 0 {
+			r.EventRecorder.AnnotatedEventf(&bucket, metadata, "Normal", severity, msg)
+		} else {
+			r.EventRecorder.Eventf(&bucket, "Normal", severity, msg)
+		}
 	}
-	if r.ExternalEventRecorder != nil {
+	if r.ExternalEventRecorder != nil && suppressed == "" {
 		objRef, err := reference.GetReference(r.Scheme, &bucket)
 		if err != nil {
 			log.Error(err, "unable to send event")
 			return
 		}
 
-		if err := r.ExternalEventRecorder.Eventf(*objRef, nil, severity, severity, msg); err != nil {
+		if err := r.ExternalEventRecorder.Eventf(*objRef, metadata, severity, severity, msg); err != nil {
 			log.Error(err, "unable to send event")
 			return
 		}
 	}
 }
 
+// storagePruner returns the pruner of the storage, which emits events with the
+// recorders of the reconciler.
+func (r *BucketReconciler) storagePruner() *storagePruner {
+	return &storagePruner{
+		Reader:                r.Client,
+		Scheme:                r.Scheme,
+		Storage:               r.Storage,
+		EventRecorder:         r.EventRecorder,
+		ExternalEventRecorder: r.ExternalEventRecorder,
+	}
+}
+
 func (r *BucketReconciler) recordReadiness(ctx context.Context, bucket sourcev1.Bucket) {
 	log := logr.FromContext(ctx)
 	if r.MetricsRecorder == nil {
@@ -453,6 +994,14 @@ func (r *BucketReconciler) recordReadiness(ctx context.Context, bucket sourcev1.
 }
 
 func (r *BucketReconciler) recordSuspension(ctx context.Context, bucket sourcev1.Bucket) {
+	name := types.NamespacedName{Namespace: bucket.Namespace, Name: bucket.Name}
+	if !bucket.DeletionTimestamp.IsZero() {
+		forgetSuspendStatus(r.MetricsRecorder, sourcev1.BucketKind, name)
+		return
+	}
+	if recordSuspend(sourcev1.BucketKind, name, bucket.Spec.Suspend) {
+		r.event(ctx, bucket, events.EventSeverityInfo, suspendMessage(bucket.Spec.Suspend), nil)
+	}
 	if r.MetricsRecorder == nil {
 		return
 	}
@@ -464,14 +1013,12 @@ func (r *BucketReconciler) recordSuspension(ctx context.Context, bucket sourcev1
 		return
 	}
 
-	if !bucket.DeletionTimestamp.IsZero() {
-		r.MetricsRecorder.RecordSuspend(*objRef, false)
-	} else {
-		r.MetricsRecorder.RecordSuspend(*objRef, bucket.Spec.Suspend)
-	}
+	r.MetricsRecorder.RecordSuspend(*objRef, bucket.Spec.Suspend)
 }
 
 func (r *BucketReconciler) updateStatus(ctx context.Context, req ctrl.Request, newStatus sourcev1.BucketStatus) error {
+	redact.Conditions(newStatus.Conditions)
+
 	var bucket sourcev1.Bucket
 	if err := r.Get(ctx, req.NamespacedName, &bucket); err != nil {
 		return err
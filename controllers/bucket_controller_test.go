@@ -17,12 +17,32 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/fips"
+	"github.com/fluxcd/source-controller/pkg/sourceignore"
 )
 
-func TestBucketReconciler_checksum(t *testing.T) {
+func TestBucketReconciler_legacyChecksum(t *testing.T) {
+	if fips.Enabled() {
+		t.Skip("the revisions of previous versions are not computed in FIPS mode")
+	}
+
 	tests := []struct {
 		name       string
 		beforeFunc func(root string)
@@ -58,11 +78,54 @@ func TestBucketReconciler_checksum(t *testing.T) {
 			if tt.beforeFunc != nil {
 				tt.beforeFunc(root)
 			}
-			got, err := (&BucketReconciler{}).checksum(root)
+			got, err := (&BucketReconciler{}).legacyChecksum(root)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("checksum() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("legacyChecksum() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if got != tt.want {
+				t.Errorf("legacyChecksum() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketReconciler_checksum(t *testing.T) {
+	tests := []struct {
+		name       string
+		beforeFunc func(root string)
+		want       string
+	}{
+		{
+			name: "empty root",
+			want: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			name: "with file",
+			beforeFunc: func(root string) {
+				mockFile(root, "a/b/c.txt", "a dummy string")
+			},
+			want: "65a8ff8c0feac7c8710ece851923f173e45cb89dc264378ed291074e5759aa61",
+		},
+		{
+			name: "with files sorted by key",
+			beforeFunc: func(root string) {
+				mockFile(root, "a/b.txt", "a dummy string")
+				mockFile(root, "a.txt", "another dummy string")
+			},
+			want: "84a644a9209adb1a01e15b6787890cf17eb660e32ea72e57b384ec213975c654",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.beforeFunc != nil {
+				tt.beforeFunc(root)
+			}
+			got, err := (&BucketReconciler{}).checksum(root)
+			if err != nil {
+				t.Fatalf("checksum() error = %v", err)
+			}
 			if got != tt.want {
 				t.Errorf("checksum() got = %v, want %v", got, tt.want)
 			}
@@ -70,6 +133,76 @@ func TestBucketReconciler_checksum(t *testing.T) {
 	}
 }
 
+func TestBucketReconciler_checksum_multipartUpload(t *testing.T) {
+	// An object uploaded again with a different number of multipart upload
+	// parts has a different ETag, which causes it to be downloaded again,
+	// but results in the same revision.
+	objects := []bucketObject{{Key: "apps/deploy.yaml", ETag: "9b2cf535f27731c974343645a3985328-1"}}
+	reuploaded := []bucketObject{{Key: "apps/deploy.yaml", ETag: "3858f62230ac3c915f300c664312c63f-3"}}
+
+	r := &BucketReconciler{}
+	var revisions []string
+	for _, objects := range [][]bucketObject{objects, reuploaded} {
+		dir := t.TempDir()
+		if err := downloadObjects(context.TODO(), downloadBucketProvider{}, "bucket", objectRefs(objects), dir, 1, newBucketUsage(bucketLimits{})); err != nil {
+			t.Fatal(err)
+		}
+		revision, err := r.checksum(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions = append(revisions, revision)
+	}
+	if revisions[0] != revisions[1] {
+		t.Errorf("revision after multipart upload = %s, want %s", revisions[1], revisions[0])
+	}
+}
+
+func TestBucketReconciler_hasRevision(t *testing.T) {
+	root := t.TempDir()
+	mockFile(root, "a/b/c.txt", "a dummy string")
+	r := &BucketReconciler{}
+	revision, err := r.checksum(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		artifact *sourcev1.Artifact
+		want     bool
+	}{
+		{
+			name:     "no artifact",
+			artifact: nil,
+			want:     false,
+		},
+		{
+			name:     "current format",
+			artifact: &sourcev1.Artifact{Revision: revision},
+			want:     true,
+		},
+		{
+			name:     "legacy format",
+			artifact: &sourcev1.Artifact{Revision: "309a5e6e96b4a7eea0d1cfaabf1be8ec1c063fa0"},
+			// the legacy revision is not computed in FIPS mode
+			want: !fips.Enabled(),
+		},
+		{
+			name:     "different legacy revision",
+			artifact: &sourcev1.Artifact{Revision: "e28c62b5cc488849950c4355dddc5523712616d4"},
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.hasRevision(tt.artifact, revision, root); got != tt.want {
+				t.Errorf("hasRevision() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func mockFile(root, path, content string) error {
 	filePath := filepath.Join(root, path)
 	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
@@ -80,3 +213,378 @@ func mockFile(root, path, content string) error {
 	}
 	return nil
 }
+
+type fakeBucketProvider struct {
+	BucketProvider
+	authErr error
+}
+
+func (p fakeBucketProvider) IsAuthError(err error) bool {
+	return errors.Is(err, p.authErr)
+}
+
+type regionWarningProvider struct {
+	BucketProvider
+	warning string
+}
+
+func (p regionWarningProvider) RegionWarning() string {
+	return p.warning
+}
+
+func TestBucketReconciler_warnRegionMismatch(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &BucketReconciler{EventRecorder: recorder}
+	bucket := sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"}}
+
+	r.warnRegionMismatch(context.TODO(), bucket, regionWarningProvider{})
+	r.warnRegionMismatch(context.TODO(), bucket, fakeBucketProvider{})
+	r.warnRegionMismatch(context.TODO(), bucket, regionWarningProvider{
+		warning: "bucket is located in region 'eu-west-1' instead of the configured region 'us-east-1'",
+	})
+	close(recorder.Events)
+	var got []string
+	for e := range recorder.Events {
+		got = append(got, e)
+	}
+	if len(got) != 1 || !strings.Contains(got[0], "instead of the configured region 'us-east-1'") {
+		t.Errorf("events = %v, want a warning of the region mismatch", got)
+	}
+}
+
+func TestBucketFailureReason(t *testing.T) {
+	authErr := errors.New("access denied")
+	provider := fakeBucketProvider{authErr: authErr}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "auth error",
+			err:  fmt.Errorf("listing objects failed: %w", authErr),
+			want: sourcev1.AuthenticationFailedReason,
+		},
+		{
+			name: "network error",
+			err:  &url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			want: sourcev1.BucketConnectionFailedReason,
+		},
+		{
+			name: "other error",
+			err:  errors.New("internal error"),
+			want: sourcev1.BucketOperationFailedReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bucketFailureReason(provider, tt.err); got != tt.want {
+				t.Errorf("bucketFailureReason() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type listBucketProvider struct {
+	BucketProvider
+	keys []string
+}
+
+func (p listBucketProvider) VisitObjects(_ context.Context, _, prefix string, visit func(string, string, int64, time.Time) error) error {
+	for _, key := range p.keys {
+		if strings.HasPrefix(key, prefix) {
+			// Keys ending in a slash are folder markers
+			size := int64(len(key))
+			if strings.HasSuffix(key, "/") {
+				size = 0
+			}
+			if err := visit(key, fmt.Sprintf("etag-%s", key), size, time.Time{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestListObjects(t *testing.T) {
+	keys := []string{
+		".sourceignore",
+		"clusters/prod/",
+		"clusters/prod/app.yaml",
+		"clusters/prod/README.md",
+		"clusters/prod/infra/db.yaml",
+		"clusters/production/app.yaml",
+		"clusters/staging/app.yaml",
+		"old/clusters/prod/app.yaml",
+		"old/clusters/dev/",
+	}
+	tests := []struct {
+		name          string
+		prefix        string
+		ignore        string
+		folderMarkers bool
+		want          []string
+	}{
+		{
+			name: "no prefix",
+			want: []string{
+				"clusters/prod/app.yaml",
+				"clusters/prod/README.md",
+				"clusters/prod/infra/db.yaml",
+				"clusters/production/app.yaml",
+				"clusters/staging/app.yaml",
+				"old/clusters/prod/app.yaml",
+			},
+		},
+		{
+			name:   "prefix with trailing slash",
+			prefix: "clusters/prod/",
+			want: []string{
+				"clusters/prod/app.yaml",
+				"clusters/prod/README.md",
+				"clusters/prod/infra/db.yaml",
+			},
+		},
+		{
+			name:   "prefix without trailing slash",
+			prefix: "clusters/prod",
+			want: []string{
+				"clusters/prod/app.yaml",
+				"clusters/prod/README.md",
+				"clusters/prod/infra/db.yaml",
+				"clusters/production/app.yaml",
+			},
+		},
+		{
+			name:   "prefix with ignore",
+			prefix: "clusters/prod/",
+			ignore: "*.md\n/clusters/prod/infra/",
+			want:   []string{"clusters/prod/app.yaml"},
+		},
+		{
+			name:   "ignore relative to bucket root",
+			prefix: "clusters/",
+			ignore: "/prod/",
+			want: []string{
+				"clusters/prod/app.yaml",
+				"clusters/prod/README.md",
+				"clusters/prod/infra/db.yaml",
+				"clusters/production/app.yaml",
+				"clusters/staging/app.yaml",
+			},
+		},
+		{
+			name:          "folder markers",
+			prefix:        "clusters/prod/",
+			folderMarkers: true,
+			want: []string{
+				"clusters/prod/",
+				"clusters/prod/app.yaml",
+				"clusters/prod/README.md",
+				"clusters/prod/infra/db.yaml",
+			},
+		},
+		{
+			name:          "ignored folder markers",
+			prefix:        "old/",
+			ignore:        "/old/clusters/dev/",
+			folderMarkers: true,
+			want:          []string{"old/clusters/prod/app.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{BucketName: "bucket", Prefix: tt.prefix, IncludeFolderMarkers: tt.folderMarkers}}
+			matcher := sourceignore.NewMatcher(sourceignore.ReadPatterns(strings.NewReader(tt.ignore), nil))
+			objects, err := listObjects(context.TODO(), listBucketProvider{keys: keys}, bucket, matcher, newBucketUsage(bucketLimits{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, object := range objects {
+				if object.ETag != "etag-"+object.Key {
+					t.Errorf("listObjects() got ETag %q for %q", object.ETag, object.Key)
+				}
+				got = append(got, object.Key)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listObjects() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListObjects_invalidKeys(t *testing.T) {
+	tests := []struct {
+		key     string
+		wantErr string
+	}{
+		{key: "../escape.yaml", wantErr: "object key '../escape.yaml' is not allowed: path traversal"},
+		{key: "dir/../../escape.yaml", wantErr: "object key 'dir/../../escape.yaml' is not allowed: path traversal"},
+		{key: "dir/../", wantErr: "object key 'dir/../' is not allowed: path traversal"},
+		{key: "/", wantErr: "object key '/' is not allowed: empty path"},
+		{key: "/app.yaml", wantErr: "object keys 'app.yaml' and '/app.yaml' are not allowed: both are stored as 'app.yaml'"},
+		{key: "./app.yaml", wantErr: "object keys 'app.yaml' and './app.yaml' are not allowed: both are stored as 'app.yaml'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{BucketName: "bucket"}}
+			matcher := sourceignore.NewMatcher(nil)
+			_, err := listObjects(context.TODO(), listBucketProvider{keys: []string{"app.yaml", tt.key}}, bucket, matcher, newBucketUsage(bucketLimits{}))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("listObjects() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListObjects_limits(t *testing.T) {
+	keys := []string{"a.yaml", "b.yaml", "c.yaml"}
+	tests := []struct {
+		name    string
+		limits  bucketLimits
+		wantErr string
+	}{
+		{
+			name:   "within limits",
+			limits: bucketLimits{maxObjects: 3, maxSize: 18},
+		},
+		{
+			name:    "too many objects",
+			limits:  bucketLimits{maxObjects: 2},
+			wantErr: "found at least 3 objects with a total size of 18 bytes, exceeding the limit of 2 objects",
+		},
+		{
+			name:    "too large",
+			limits:  bucketLimits{maxSize: 10},
+			wantErr: "found at least 2 objects with a total size of 12 bytes, exceeding the limit of 10 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{BucketName: "bucket"}}
+			matcher := sourceignore.NewMatcher(nil)
+			_, err := listObjects(context.TODO(), listBucketProvider{keys: keys}, bucket, matcher, newBucketUsage(tt.limits))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("listObjects() unexpected error: %v", err)
+				}
+				return
+			}
+			var limitErr *bucketLimitError
+			if !errors.As(err, &limitErr) || err.Error() != tt.wantErr {
+				t.Errorf("listObjects() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// downloadCounter counts the downloads of a downloadBucketProvider.
+type downloadCounter struct {
+	mu       sync.Mutex
+	started  int
+	inFlight int
+	peak     int
+}
+
+// start counts a started download, and returns the function to call when it
+// has finished.
+func (c *downloadCounter) start() func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started++
+	c.inFlight++
+	if c.inFlight > c.peak {
+		c.peak = c.inFlight
+	}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.inFlight--
+	}
+}
+
+// downloadBucketProvider downloads the objects from the embedded
+// BucketProvider, or writes their key as their content if nil, after the
+// given delay. The download of the object with the failKey fails, and the
+// downloads are counted by the counter if not nil.
+type downloadBucketProvider struct {
+	BucketProvider
+	delay   time.Duration
+	failKey string
+	counter *downloadCounter
+}
+
+func (p downloadBucketProvider) FGetObject(ctx context.Context, bucketName, key, localPath string) (string, error) {
+	if p.counter != nil {
+		defer p.counter.start()()
+	}
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if key == p.failKey {
+		return "", errors.New("internal error")
+	}
+	if p.BucketProvider != nil {
+		return p.BucketProvider.FGetObject(ctx, bucketName, key, localPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0700); err != nil {
+		return "", err
+	}
+	return "text/plain", os.WriteFile(localPath, []byte(key), 0600)
+}
+
+func TestDownloadObjects(t *testing.T) {
+	var objects []bucketObject
+	for i := 0; i < 40; i++ {
+		objects = append(objects, bucketObject{Key: fmt.Sprintf("dir-%d/object-%d.yaml", i%4, i)})
+	}
+
+	download := func(provider BucketProvider, concurrency int) (string, error) {
+		dir := t.TempDir()
+		if err := downloadObjects(context.TODO(), provider, "bucket", objectRefs(objects), dir, concurrency, newBucketUsage(bucketLimits{})); err != nil {
+			return "", err
+		}
+		return (&BucketReconciler{}).checksum(dir)
+	}
+
+	sequential := &downloadCounter{}
+	sequentialSum, err := download(downloadBucketProvider{delay: time.Millisecond, counter: sequential}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequential.peak != 1 {
+		t.Errorf("peak of sequential downloads = %d, want 1", sequential.peak)
+	}
+	concurrent := &downloadCounter{}
+	concurrentSum, err := download(downloadBucketProvider{delay: 10 * time.Millisecond, counter: concurrent}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequentialSum != concurrentSum {
+		t.Errorf("checksum of concurrent download %s does not match sequential download %s", concurrentSum, sequentialSum)
+	}
+	if concurrent.peak < 2 || concurrent.peak > 10 {
+		t.Errorf("peak of concurrent downloads = %d, want between 2 and 10", concurrent.peak)
+	}
+
+	failKey := objects[5].Key
+	failing := &downloadCounter{}
+	_, err = download(downloadBucketProvider{delay: 10 * time.Millisecond, failKey: failKey, counter: failing}, 2)
+	if err == nil || !strings.Contains(err.Error(), failKey) {
+		t.Errorf("expected error for '%s', got %v", failKey, err)
+	}
+	if failing.started == len(objects) {
+		t.Errorf("remaining downloads not cancelled after failure, %d downloads started", failing.started)
+	}
+
+	// The objects grew after they were listed
+	usage := newBucketUsage(bucketLimits{maxSize: 100})
+	err = downloadObjects(context.TODO(), downloadBucketProvider{}, "bucket", objectRefs(objects), t.TempDir(), 2, usage)
+	var limitErr *bucketLimitError
+	if !errors.As(err, &limitErr) {
+		t.Errorf("expected bucketLimitError, got %v", err)
+	}
+}
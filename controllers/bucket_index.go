@@ -0,0 +1,180 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// bucketIndexSuffix is the suffix of the path of the bucket index, which is
+// stored as a sidecar file next to the artifact.
+const bucketIndexSuffix = ".index.json"
+
+// bucketObject is an object listed from a bucket.
+type bucketObject struct {
+	Key          string
+	ETag         string
+	Size         int64
+	LastModified time.Time
+	// ContentType is set when the object is downloaded or restored.
+	ContentType string
+}
+
+// objectRefs returns references to the given objects.
+func objectRefs(objects []bucketObject) []*bucketObject {
+	refs := make([]*bucketObject, len(objects))
+	for i := range objects {
+		refs[i] = &objects[i]
+	}
+	return refs
+}
+
+// bucketIndex records the ETags of the objects in a Bucket artifact, to allow
+// the next sync to download only the objects that are new or have changed.
+type bucketIndex struct {
+	// Source identifies the bucket the objects were listed from.
+	Source string `json:"source"`
+
+	// LastFullSync is the time of the last sync that downloaded all objects.
+	LastFullSync time.Time `json:"lastFullSync"`
+
+	// Objects maps the keys of the objects in the artifact to their ETags.
+	Objects map[string]string `json:"objects"`
+
+	// ContentTypes maps the keys of the objects in the artifact to their
+	// content types. It is nil for indexes written by previous versions.
+	ContentTypes map[string]string `json:"contentTypes"`
+}
+
+// newBucketIndex returns a bucketIndex for the given objects listed from the
+// bucket of the given v1beta1.Bucket.
+func newBucketIndex(bucket sourcev1.Bucket, objects []bucketObject) *bucketIndex {
+	index := &bucketIndex{
+		Source:       bucketIndexSource(bucket),
+		LastFullSync: time.Now().UTC(),
+		Objects:      make(map[string]string, len(objects)),
+		ContentTypes: make(map[string]string, len(objects)),
+	}
+	for _, object := range objects {
+		index.Objects[object.Key] = object.ETag
+		index.ContentTypes[object.Key] = object.ContentType
+	}
+	return index
+}
+
+// bucketIndexSource returns the identifier of the bucket the objects of the
+// given v1beta1.Bucket are listed from.
+func bucketIndexSource(bucket sourcev1.Bucket) string {
+	return fmt.Sprintf("%s/%s/%s", bucket.Spec.Provider, bucket.Spec.Endpoint, bucket.Spec.BucketName)
+}
+
+// bucketIndexArtifact returns the v1beta1.Artifact of the bucket index of the
+// given artifact.
+func bucketIndexArtifact(artifact sourcev1.Artifact) sourcev1.Artifact {
+	return sourcev1.Artifact{
+		Path:     artifact.Path + bucketIndexSuffix,
+		Revision: artifact.Revision,
+	}
+}
+
+// loadIndex returns the bucket index of the current artifact of the given
+// v1beta1.Bucket, or nil if there is none, it belongs to a different bucket,
+// the last full sync is more than the full resync interval ago, or it lacks
+// the content types required for the metadata manifest.
+func (r *BucketReconciler) loadIndex(bucket sourcev1.Bucket) *bucketIndex {
+	if r.fullResyncInterval <= 0 || bucket.GetArtifact() == nil || !r.Storage.ArtifactExist(*bucket.GetArtifact()) {
+		return nil
+	}
+	b, err := os.ReadFile(r.Storage.LocalPath(bucketIndexArtifact(*bucket.GetArtifact())))
+	if err != nil {
+		return nil
+	}
+	var index bucketIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil
+	}
+	if index.Source != bucketIndexSource(bucket) || time.Since(index.LastFullSync) > r.fullResyncInterval {
+		return nil
+	}
+	if bucket.Spec.IncludeMetadataManifest && index.ContentTypes == nil {
+		return nil
+	}
+	return &index
+}
+
+// saveIndex atomically writes the bucket index for the given artifact.
+func (r *BucketReconciler) saveIndex(artifact sourcev1.Artifact, index *bucketIndex) error {
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	indexArtifact := bucketIndexArtifact(artifact)
+	return r.Storage.AtomicWriteFile(&indexArtifact, bytes.NewReader(b), 0644)
+}
+
+// restoreObjects restores the objects with an unchanged ETag from the
+// current artifact of the given v1beta1.Bucket to the given directory, sets
+// their content type from the index, and returns references to the objects
+// that still have to be downloaded. Objects that are no longer listed are not
+// restored.
+func (r *BucketReconciler) restoreObjects(bucket sourcev1.Bucket, index *bucketIndex, objects []bucketObject, dir string) ([]*bucketObject, error) {
+	cacheDir, err := os.MkdirTemp("", bucket.Name+"-cache")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(cacheDir)
+
+	f, err := os.Open(r.Storage.LocalPath(*bucket.GetArtifact()))
+	if err != nil {
+		return nil, err
+	}
+	err = untarArtifact(*bucket.GetArtifact(), f, cacheDir)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining []*bucketObject
+	for i := range objects {
+		object := &objects[i]
+		if etag, ok := index.Objects[object.Key]; !ok || etag == "" || etag != object.ETag {
+			remaining = append(remaining, object)
+			continue
+		}
+		cachePath := filepath.Join(cacheDir, filepath.FromSlash(objectPath(*object)))
+		if fi, err := os.Lstat(cachePath); err != nil || !fi.Mode().IsRegular() {
+			remaining = append(remaining, object)
+			continue
+		}
+		localPath := filepath.Join(dir, filepath.FromSlash(objectPath(*object)))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(cachePath, localPath); err != nil {
+			return nil, err
+		}
+		object.ContentType = index.ContentTypes[object.Key]
+	}
+	return remaining, nil
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestBucketReconciler_restoreObjects(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	r := &BucketReconciler{Storage: storage, fullResyncInterval: time.Hour}
+
+	bucket := sourcev1.Bucket{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.BucketKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"},
+		Spec: sourcev1.BucketSpec{
+			Provider:   sourcev1.GenericBucketProvider,
+			Endpoint:   "minio.example.com",
+			BucketName: "podinfo",
+		},
+	}
+
+	writeFiles := func(t *testing.T, files map[string]string) string {
+		t.Helper()
+		dir := t.TempDir()
+		for name, content := range files {
+			p := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	// Create the current artifact and its index
+	prevObjects := []bucketObject{
+		{Key: "unchanged.yaml", ETag: "1", ContentType: "application/yaml"},
+		{Key: "dir/changed.yaml", ETag: "2"},
+		{Key: "deleted.yaml", ETag: "3"},
+		{Key: "no-etag.yaml", ETag: ""},
+	}
+	prevDir := writeFiles(t, map[string]string{
+		"unchanged.yaml":   "unchanged",
+		"dir/changed.yaml": "old",
+		"deleted.yaml":     "deleted",
+		"no-etag.yaml":     "old",
+	})
+	artifact := storage.NewArtifactFor(bucket.Kind, bucket.GetObjectMeta(), "rev", "rev.tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Archive(&artifact, prevDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.saveIndex(artifact, newBucketIndex(bucket, prevObjects)); err != nil {
+		t.Fatal(err)
+	}
+	bucket.Status.Artifact = &artifact
+
+	index := r.loadIndex(bucket)
+	if index == nil {
+		t.Fatal("loadIndex() returned nil")
+	}
+
+	// Sync the bucket with changed, deleted and added objects
+	objects := []bucketObject{
+		{Key: "unchanged.yaml", ETag: "1"},
+		{Key: "dir/changed.yaml", ETag: "4"},
+		{Key: "no-etag.yaml", ETag: ""},
+		{Key: "added.yaml", ETag: "5"},
+	}
+	bucketFiles := map[string]string{
+		"unchanged.yaml":   "unchanged",
+		"dir/changed.yaml": "new",
+		"no-etag.yaml":     "new",
+		"added.yaml":       "added",
+	}
+	tempDir := t.TempDir()
+	remaining, err := r.restoreObjects(bucket, index, objects, tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, object := range remaining {
+		keys = append(keys, object.Key)
+	}
+	want := []string{"dir/changed.yaml", "no-etag.yaml", "added.yaml"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("restoreObjects() got = %v, want %v", keys, want)
+	}
+	if got := objects[0].ContentType; got != "application/yaml" {
+		t.Errorf("restoreObjects() content type of restored object = %q, want %q", got, "application/yaml")
+	}
+	for _, key := range keys {
+		p := filepath.Join(tempDir, key)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(bucketFiles[key]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The incremental sync results in the same revision as a full sync
+	got, err := r.checksum(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := r.checksum(writeFiles(t, bucketFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != full {
+		t.Errorf("checksum of incremental sync %q does not match full sync %q", got, full)
+	}
+}
+
+func TestBucketReconciler_loadIndex(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	bucket := sourcev1.Bucket{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.BucketKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"},
+		Spec: sourcev1.BucketSpec{
+			Provider:   sourcev1.GenericBucketProvider,
+			Endpoint:   "minio.example.com",
+			BucketName: "podinfo",
+		},
+	}
+	artifact := storage.NewArtifactFor(bucket.Kind, bucket.GetObjectMeta(), "rev", "rev.tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(storage.LocalPath(artifact), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bucket.Status.Artifact = &artifact
+
+	tests := []struct {
+		name               string
+		fullResyncInterval time.Duration
+		bucketName         string
+		lastFullSync       time.Time
+		want               bool
+	}{
+		{
+			name:               "recent index",
+			fullResyncInterval: time.Hour,
+			bucketName:         "podinfo",
+			lastFullSync:       time.Now(),
+			want:               true,
+		},
+		{
+			name:               "incremental sync disabled",
+			fullResyncInterval: 0,
+			bucketName:         "podinfo",
+			lastFullSync:       time.Now(),
+		},
+		{
+			name:               "full resync due",
+			fullResyncInterval: time.Hour,
+			bucketName:         "podinfo",
+			lastFullSync:       time.Now().Add(-2 * time.Hour),
+		},
+		{
+			name:               "different bucket",
+			fullResyncInterval: time.Hour,
+			bucketName:         "other",
+			lastFullSync:       time.Now(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &BucketReconciler{Storage: storage, fullResyncInterval: tt.fullResyncInterval}
+			indexBucket := *bucket.DeepCopy()
+			indexBucket.Spec.BucketName = tt.bucketName
+			index := newBucketIndex(indexBucket, nil)
+			index.LastFullSync = tt.lastFullSync
+			if err := r.saveIndex(artifact, index); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.loadIndex(bucket) != nil; got != tt.want {
+				t.Errorf("loadIndex() returned index = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
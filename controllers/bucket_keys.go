@@ -0,0 +1,87 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateKey returns an error naming the given object key if it can not be
+// materialised within the artifact, because it contains a '..' path segment
+// attempting path traversal, or it has no path segment other than empty
+// ones, e.g. a key made of slashes only.
+func validateKey(key string) error {
+	if strings.Trim(key, "/") == "" {
+		return fmt.Errorf("object key '%s' is not allowed: empty path", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return fmt.Errorf("object key '%s' is not allowed: path traversal", key)
+		}
+	}
+	return nil
+}
+
+// isFolderMarker returns if the given object is a zero-byte folder
+// placeholder, with a key ending in a slash.
+func isFolderMarker(object bucketObject) bool {
+	return object.Size == 0 && strings.HasSuffix(object.Key, "/")
+}
+
+// objectPath returns the slash separated path of the given object relative
+// to the root of the artifact. The path of a folder marker ends in a slash.
+// Empty and '.' path segments, e.g. of a leading or a double slash, are
+// removed, and the unsafe path segments are escaped. Keys without any of
+// these map to an identical path. As the removed segments make keys share a
+// path, e.g. 'a/b' and 'a//b', the paths of the listed objects are checked
+// for collisions by checkObjectPath.
+func objectPath(object bucketObject) string {
+	var segments []string
+	for _, segment := range strings.Split(object.Key, "/") {
+		if segment == "" || segment == "." {
+			continue
+		}
+		segments = append(segments, escapeSegment(segment))
+	}
+	path := strings.Join(segments, "/")
+	if isFolderMarker(object) {
+		path += "/"
+	}
+	return path
+}
+
+// escapeSegment percent-encodes the NUL characters of the given path
+// segment, which can not be used in a file name, and the percent characters,
+// so that an escaped NUL does not collide with a literal '%00'.
+func escapeSegment(segment string) string {
+	segment = strings.ReplaceAll(segment, "%", "%25")
+	return strings.ReplaceAll(segment, "\x00", "%00")
+}
+
+// checkObjectPath records the path of the given object in the given paths by
+// key, and returns an error naming both keys if the path is already the path
+// of another object, as they would be written to the same file. Folder
+// markers sharing a path create the same directory, and do not collide.
+func checkObjectPath(paths map[string]bucketObject, object bucketObject) error {
+	path := objectPath(object)
+	if other, ok := paths[path]; ok && !(isFolderMarker(other) && isFolderMarker(object)) {
+		return fmt.Errorf("object keys '%s' and '%s' are not allowed: both are stored as '%s'", other.Key, object.Key, path)
+	}
+	paths[path] = object
+	return nil
+}
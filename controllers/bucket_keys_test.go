@@ -0,0 +1,224 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// deepKey is a key with a prefix of 64 levels.
+var deepKey = strings.Repeat("level/", 64) + "app.yaml"
+
+func TestObjectPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		object bucketObject
+		want   string
+	}{
+		{name: "plain key", object: bucketObject{Key: "clusters/prod/app.yaml", Size: 1}, want: "clusters/prod/app.yaml"},
+		{name: "unicode key", object: bucketObject{Key: "déploiement/アプリ/값.yaml", Size: 1}, want: "déploiement/アプリ/값.yaml"},
+		{name: "spaces", object: bucketObject{Key: "my dir/my app.yaml", Size: 1}, want: "my dir/my app.yaml"},
+		{name: "deep prefix", object: bucketObject{Key: deepKey, Size: 1}, want: deepKey},
+		{name: "reserved characters", object: bucketObject{Key: `backup/08:30/a<b>c"d|e?f\g*%.yaml`, Size: 1}, want: `backup/08:30/a<b>c"d|e?f\g*%25.yaml`},
+		{name: "control characters", object: bucketObject{Key: "new\nline\x7f", Size: 1}, want: "new\nline\x7f"},
+		{name: "NUL character", object: bucketObject{Key: "dir/a\x00b", Size: 1}, want: "dir/a%00b"},
+		{name: "escaped NUL", object: bucketObject{Key: "dir/a%00b", Size: 1}, want: "dir/a%2500b"},
+		{name: "dot segment", object: bucketObject{Key: "dir/./app.yaml", Size: 1}, want: "dir/app.yaml"},
+		{name: "empty segments", object: bucketObject{Key: "/dir//app.yaml", Size: 1}, want: "dir/app.yaml"},
+		{name: "folder marker", object: bucketObject{Key: "clusters/prod/"}, want: "clusters/prod/"},
+		{name: "folder marker with empty segments", object: bucketObject{Key: "clusters//prod//"}, want: "clusters/prod/"},
+		{name: "trailing slash with content", object: bucketObject{Key: "clusters/prod/", Size: 1}, want: "clusters/prod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := objectPath(tt.object); got != tt.want {
+				t.Errorf("objectPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckObjectPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects []bucketObject
+		wantErr string
+	}{
+		{name: "escaped NUL and literal escape", objects: []bucketObject{{Key: "a\x00b", Size: 1}, {Key: "a%00b", Size: 1}}},
+		{name: "folder markers", objects: []bucketObject{{Key: "dir/"}, {Key: "dir//"}}},
+		{name: "empty segments", objects: []bucketObject{{Key: "a/b", Size: 1}, {Key: "a//b", Size: 1}},
+			wantErr: "object keys 'a/b' and 'a//b' are not allowed: both are stored as 'a/b'"},
+		{name: "trailing slash with content", objects: []bucketObject{{Key: "dir/app", Size: 1}, {Key: "dir/app/", Size: 1}},
+			wantErr: "object keys 'dir/app' and 'dir/app/' are not allowed: both are stored as 'dir/app'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := map[string]bucketObject{}
+			var err error
+			for _, object := range tt.objects {
+				if err = checkObjectPath(paths, object); err != nil {
+					break
+				}
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkObjectPath() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("checkObjectPath() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		wantErr string
+	}{
+		{key: "app.yaml"},
+		{key: "clusters/prod/"},
+		{key: deepKey},
+		{key: "..app/app..yaml"},
+		{key: "dir/./app.yaml"},
+		{key: "/dir//app.yaml"},
+		{key: "..", wantErr: "object key '..' is not allowed: path traversal"},
+		{key: "dir/../app.yaml", wantErr: "object key 'dir/../app.yaml' is not allowed: path traversal"},
+		{key: "/", wantErr: "object key '/' is not allowed: empty path"},
+		{key: "//", wantErr: "object key '//' is not allowed: empty path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			err := validateKey(tt.key)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateKey() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validateKey() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBucketReconciler_archiveKeys(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	r := &BucketReconciler{Storage: storage}
+
+	objects := []bucketObject{
+		{Key: "clusters/prod/app.yaml", Size: 22},
+		{Key: "déploiement/アプリ/값.yaml", Size: 31},
+		{Key: deepKey, Size: int64(len(deepKey))},
+		{Key: "backup/08:30/*.yaml", Size: 19},
+		{Key: "clusters/staging/"},
+	}
+	tempDir := t.TempDir()
+	if err := downloadObjects(context.TODO(), downloadBucketProvider{}, "bucket", objectRefs(objects), tempDir, 2, newBucketUsage(bucketLimits{})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The revision changes with the folder marker
+	revision, err := r.checksum(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tempDir, "clusters", "staging")); err != nil {
+		t.Fatal(err)
+	}
+	if withoutMarker, err := r.checksum(tempDir); err != nil || withoutMarker == revision {
+		t.Errorf("checksum() without folder marker = %q, %v, want a different revision than %q", withoutMarker, err, revision)
+	}
+	if err := os.Mkdir(filepath.Join(tempDir, "clusters", "staging"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := sourcev1.Artifact{
+		Path: filepath.Join(randStringRunes(10), randStringRunes(10), revision+".tar.gz"),
+	}
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.ArchiveWithModTimes(&artifact, tempDir, nil, objectModTimes(objects)); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(storage.LocalPath(artifact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	got := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[h.Name] = string(b)
+	}
+	want := map[string]string{
+		"clusters/prod/app.yaml": "clusters/prod/app.yaml",
+		"déploiement/アプリ/값.yaml": "déploiement/アプリ/값.yaml",
+		deepKey:                  deepKey,
+		"backup/08:30/*.yaml":    "backup/08:30/*.yaml",
+		"clusters/staging/":      "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		var names []string
+		for name := range got {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t.Errorf("archive entries = %v, want %v", names, want)
+	}
+}
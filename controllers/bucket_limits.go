@@ -0,0 +1,95 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// bucketLimits are the maximum number of objects and total size in bytes of
+// the objects included in a Bucket artifact. A limit of zero means
+// unlimited.
+type bucketLimits struct {
+	maxObjects int64
+	maxSize    int64
+}
+
+// limits returns the bucketLimits for the given v1beta1.Bucket, the limits in
+// the spec take precedence over the defaults of the reconciler.
+func (r *BucketReconciler) limits(bucket sourcev1.Bucket) bucketLimits {
+	limits := bucketLimits{
+		maxObjects: r.maxObjects,
+		maxSize:    r.maxSize,
+	}
+	if bucket.Spec.MaxObjects != nil {
+		limits.maxObjects = *bucket.Spec.MaxObjects
+	}
+	if bucket.Spec.MaxSize != nil {
+		limits.maxSize = bucket.Spec.MaxSize.Value()
+	}
+	return limits
+}
+
+// bucketUsage counts the objects and bytes of a Bucket sync against the
+// bucketLimits. It is safe for concurrent use.
+type bucketUsage struct {
+	objects int64
+	size    int64
+	limits  bucketLimits
+}
+
+func newBucketUsage(limits bucketLimits) *bucketUsage {
+	return &bucketUsage{limits: limits}
+}
+
+// add adds the given number of objects and bytes to the usage, and returns a
+// bucketLimitError if this exceeds one of the limits. The number of bytes may
+// be negative, e.g. to correct the size of a listed object after it has been
+// downloaded.
+func (u *bucketUsage) add(objects, size int64) error {
+	o := atomic.AddInt64(&u.objects, objects)
+	s := atomic.AddInt64(&u.size, size)
+	if u.limits.maxObjects > 0 && o > u.limits.maxObjects {
+		return &bucketLimitError{objects: o, size: s, limits: u.limits, limit: "objects"}
+	}
+	if u.limits.maxSize > 0 && s > u.limits.maxSize {
+		return &bucketLimitError{objects: o, size: s, limits: u.limits, limit: "size"}
+	}
+	return nil
+}
+
+// bucketLimitError is returned when the objects of a Bucket exceed the
+// bucketLimits. Retrying the sync does not resolve the error, it requires the
+// limits to be raised or the objects to be filtered.
+type bucketLimitError struct {
+	objects int64
+	size    int64
+	limits  bucketLimits
+	limit   string
+}
+
+func (e *bucketLimitError) Error() string {
+	if e.limit == "objects" {
+		return fmt.Sprintf("found at least %d objects with a total size of %d bytes, exceeding the limit of %d objects",
+			e.objects, e.size, e.limits.maxObjects)
+	}
+	return fmt.Sprintf("found at least %d objects with a total size of %d bytes, exceeding the limit of %d bytes",
+		e.objects, e.size, e.limits.maxSize)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestBucketReconciler_limits(t *testing.T) {
+	zero := int64(0)
+	ten := int64(10)
+	size := resource.MustParse("1Ki")
+
+	tests := []struct {
+		name string
+		spec sourcev1.BucketSpec
+		want bucketLimits
+	}{
+		{
+			name: "controller defaults",
+			want: bucketLimits{maxObjects: 100, maxSize: 1 << 20},
+		},
+		{
+			name: "spec overrides",
+			spec: sourcev1.BucketSpec{MaxObjects: &ten, MaxSize: &size},
+			want: bucketLimits{maxObjects: 10, maxSize: 1024},
+		},
+		{
+			name: "spec disables limit",
+			spec: sourcev1.BucketSpec{MaxObjects: &zero},
+			want: bucketLimits{maxObjects: 0, maxSize: 1 << 20},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &BucketReconciler{maxObjects: 100, maxSize: 1 << 20}
+			if got := r.limits(sourcev1.Bucket{Spec: tt.spec}); got != tt.want {
+				t.Errorf("limits() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketNotReady_limitExceeded(t *testing.T) {
+	usage := newBucketUsage(bucketLimits{maxObjects: 1})
+	if err := usage.add(1, 10); err != nil {
+		t.Fatalf("add() unexpected error: %v", err)
+	}
+	err := usage.add(1, 10)
+	if err == nil {
+		t.Fatal("add() expected error")
+	}
+
+	bucket := bucketNotReady(sourcev1.Bucket{}, nil, err)
+	if !apimeta.IsStatusConditionTrue(bucket.Status.Conditions, meta.StalledCondition) {
+		t.Errorf("expected Stalled condition, got %+v", bucket.Status.Conditions)
+	}
+	ready := apimeta.FindStatusCondition(bucket.Status.Conditions, meta.ReadyCondition)
+	if ready == nil || ready.Status != metav1.ConditionFalse || ready.Reason != sourcev1.BucketLimitExceededReason {
+		t.Errorf("expected Ready condition with reason %s, got %+v", sourcev1.BucketLimitExceededReason, ready)
+	}
+}
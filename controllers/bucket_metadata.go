@@ -0,0 +1,84 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bucketMetadataManifest is the path of the metadata manifest in the root of
+// a Bucket artifact.
+const bucketMetadataManifest = ".bucket-metadata.json"
+
+// bucketMetadata is the metadata manifest of a Bucket artifact.
+type bucketMetadata struct {
+	// Objects maps the keys of the objects in the artifact to their
+	// metadata.
+	Objects map[string]bucketObjectMetadata `json:"objects"`
+}
+
+// bucketObjectMetadata is the metadata of an object in a Bucket artifact.
+type bucketObjectMetadata struct {
+	ContentType string `json:"contentType,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// writeMetadataManifest writes the metadata manifest of the given objects to
+// the root of the given directory. The keys of the objects are sorted in the
+// manifest, so that it only changes when the metadata changes.
+func writeMetadataManifest(dir string, objects []bucketObject) error {
+	metadata := bucketMetadata{Objects: make(map[string]bucketObjectMetadata, len(objects))}
+	for _, object := range objects {
+		metadata.Objects[object.Key] = bucketObjectMetadata{
+			ContentType: object.ContentType,
+			ETag:        object.ETag,
+			Size:        object.Size,
+		}
+	}
+	b, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, bucketMetadataManifest), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("object '%s' conflicts with the metadata manifest", bucketMetadataManifest)
+		}
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// objectModTimes returns the last modification times of the given objects,
+// keyed by their path in the artifact.
+func objectModTimes(objects []bucketObject) map[string]time.Time {
+	modTimes := make(map[string]time.Time, len(objects))
+	for _, object := range objects {
+		modTimes[objectPath(object)] = object.LastModified
+	}
+	return modTimes
+}
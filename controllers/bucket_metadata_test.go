@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestWriteMetadataManifest(t *testing.T) {
+	objects := []bucketObject{
+		{Key: "b.yaml", ETag: "2", Size: 20, ContentType: "application/yaml"},
+		{Key: "a/index.html", ETag: "1", Size: 10, ContentType: "text/html"},
+		{Key: "c.bin", Size: 30},
+	}
+	dir := t.TempDir()
+	if err := writeMetadataManifest(dir, objects); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, bucketMetadataManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "objects": {
+    "a/index.html": {
+      "contentType": "text/html",
+      "etag": "1",
+      "size": 10
+    },
+    "b.yaml": {
+      "contentType": "application/yaml",
+      "etag": "2",
+      "size": 20
+    },
+    "c.bin": {
+      "size": 30
+    }
+  }
+}`
+	if string(b) != want {
+		t.Errorf("writeMetadataManifest() wrote:\n%s\nwant:\n%s", b, want)
+	}
+
+	err = writeMetadataManifest(dir, objects)
+	if err == nil || !strings.Contains(err.Error(), "conflicts with the metadata manifest") {
+		t.Errorf("writeMetadataManifest() error = %v, want conflict error", err)
+	}
+}
+
+func TestBucketReconciler_syncUnchangedContent(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	r := &BucketReconciler{Storage: storage}
+
+	lastModified := time.Date(2021, 10, 12, 8, 30, 0, 0, time.UTC)
+	sync := func(t *testing.T) (string, string) {
+		t.Helper()
+		// The listing order of the service is not relevant
+		objects := []bucketObject{
+			{Key: "site/index.html", ETag: "1", LastModified: lastModified},
+			{Key: "deploy.yaml", ETag: "2", LastModified: lastModified.Add(time.Hour)},
+		}
+		tempDir := t.TempDir()
+		if err := downloadObjects(context.TODO(), downloadBucketProvider{}, "bucket", objectRefs(objects), tempDir, 2, newBucketUsage(bucketLimits{})); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeMetadataManifest(tempDir, objects); err != nil {
+			t.Fatal(err)
+		}
+		revision, err := r.checksum(tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		artifact := sourcev1.Artifact{
+			Path: filepath.Join(randStringRunes(10), randStringRunes(10), revision+".tar.gz"),
+		}
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.ArchiveWithModTimes(&artifact, tempDir, nil, objectModTimes(objects)); err != nil {
+			t.Fatal(err)
+		}
+		return revision, artifact.Checksum
+	}
+
+	revision, checksum := sync(t)
+	// The files of the second sync are written at a different time
+	time.Sleep(10 * time.Millisecond)
+	if gotRevision, gotChecksum := sync(t); gotRevision != revision || gotChecksum != checksum {
+		t.Errorf("second sync of unchanged content got revision %s and checksum %s, want %s and %s",
+			gotRevision, gotChecksum, revision, checksum)
+	}
+}
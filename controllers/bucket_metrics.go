@@ -0,0 +1,51 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// bucketRetriesCounter counts the retries of bucket operations after
+// transient errors, e.g. throttling by the storage service.
+var bucketRetriesCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gotk_bucket_retries_total",
+		Help: "The number of retries of Bucket storage operations after transient errors.",
+	},
+	[]string{"name", "namespace"},
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(bucketRetriesCounter)
+}
+
+// recordRetries adds the retries of the given BucketProvider to the retry
+// counter of the given v1beta1.Bucket.
+func recordRetries(bucket sourcev1.Bucket, provider BucketProvider) {
+	if retries := provider.Retries(); retries > 0 {
+		bucketRetriesCounter.WithLabelValues(bucket.Name, bucket.Namespace).Add(float64(retries))
+	}
+}
+
+// deleteRetries removes the retry counter of the given v1beta1.Bucket.
+func deleteRetries(bucket sourcev1.Bucket) {
+	bucketRetriesCounter.DeleteLabelValues(bucket.Name, bucket.Namespace)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	miniogo "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	corev1 "k8s.io/api/core/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/pkg/minio"
+	"github.com/fluxcd/source-controller/pkg/sourceignore"
+)
+
+// TestDownloadObjects_minio downloads the objects of a bucket from the MinIO
+// server at the MINIO_TEST_ENDPOINT, started as a container by the
+// test-minio target of the Makefile, with the MINIO_TEST_ACCESS_KEY and
+// MINIO_TEST_SECRET_KEY credentials.
+func TestDownloadObjects_minio(t *testing.T) {
+	endpoint := os.Getenv("MINIO_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_TEST_ENDPOINT is not set")
+	}
+	accessKey, secretKey := os.Getenv("MINIO_TEST_ACCESS_KEY"), os.Getenv("MINIO_TEST_SECRET_KEY")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	admin, err := miniogo.New(endpoint, &miniogo.Options{Creds: credentials.NewStaticV4(accessKey, secretKey, "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketName := fmt.Sprintf("download-%d", time.Now().UnixNano())
+	if err := admin.MakeBucket(ctx, bucketName, miniogo.MakeBucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for object := range admin.ListObjects(context.Background(), bucketName, miniogo.ListObjectsOptions{Recursive: true}) {
+			admin.RemoveObject(context.Background(), bucketName, object.Key, miniogo.RemoveObjectOptions{})
+		}
+		admin.RemoveBucket(context.Background(), bucketName)
+	})
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("dir-%d/object-%d.yaml", i%4, i)
+		if _, err := admin.PutObject(ctx, bucketName, key, strings.NewReader(key), int64(len(key)),
+			miniogo.PutObjectOptions{ContentType: "application/yaml"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{BucketName: bucketName, Endpoint: endpoint, Insecure: true}}
+	secret := &corev1.Secret{Data: map[string][]byte{"accesskey": []byte(accessKey), "secretkey": []byte(secretKey)}}
+	client, err := minio.NewClient(bucket, secret, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := listObjects(ctx, client, bucket, sourceignore.NewMatcher(nil), newBucketUsage(bucketLimits{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(provider BucketProvider, concurrency int) (string, error) {
+		dir := t.TempDir()
+		if err := downloadObjects(ctx, provider, bucketName, objectRefs(objects), dir, concurrency, newBucketUsage(bucketLimits{})); err != nil {
+			return "", err
+		}
+		for _, object := range objects {
+			b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(object.Key)))
+			if err != nil {
+				return "", err
+			}
+			if string(b) != object.Key || object.ContentType != "application/yaml" {
+				return "", fmt.Errorf("'%s' downloaded with content %q and type %q", object.Key, b, object.ContentType)
+			}
+		}
+		return (&BucketReconciler{}).checksum(dir)
+	}
+
+	sequential := &downloadCounter{}
+	sequentialSum, err := download(downloadBucketProvider{BucketProvider: client, counter: sequential}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequential.peak != 1 {
+		t.Errorf("peak of sequential downloads = %d, want 1", sequential.peak)
+	}
+
+	// Slow objects do not change the result of the concurrent downloads
+	concurrent := &downloadCounter{}
+	concurrentSum, err := download(downloadBucketProvider{BucketProvider: client, delay: 10 * time.Millisecond, counter: concurrent}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequentialSum != concurrentSum {
+		t.Errorf("checksum of concurrent download %s does not match sequential download %s", concurrentSum, sequentialSum)
+	}
+	if concurrent.peak < 2 || concurrent.peak > 10 {
+		t.Errorf("peak of concurrent downloads = %d, want between 2 and 10", concurrent.peak)
+	}
+
+	// An object removed after the listing fails the download, and cancels
+	// the remaining downloads
+	removed := objects[5].Key
+	if err := admin.RemoveObject(ctx, bucketName, removed, miniogo.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	failing := &downloadCounter{}
+	_, err = download(downloadBucketProvider{BucketProvider: client, delay: 10 * time.Millisecond, counter: failing}, 2)
+	if err == nil || !strings.Contains(err.Error(), removed) || !client.ObjectIsNotFound(err) {
+		t.Errorf("expected not found error for '%s', got %v", removed, err)
+	}
+	if failing.started == len(objects) {
+		t.Errorf("remaining downloads not cancelled after failure, %d downloads started", failing.started)
+	}
+}
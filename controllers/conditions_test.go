@@ -0,0 +1,201 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// sourceConditions sets the conditions of a source with the helpers of its
+// kind.
+type sourceConditions struct {
+	object      metav1.Object
+	conditions  func() []metav1.Condition
+	progressing func()
+	reconciling func()
+	ready       func(reason, message string)
+	notReady    func(reason, message string)
+	stalled     func(reason, message string)
+}
+
+func gitRepositoryConditions() sourceConditions {
+	obj := &sourcev1.GitRepository{}
+	return sourceConditions{
+		object:      obj,
+		conditions:  func() []metav1.Condition { return obj.Status.Conditions },
+		progressing: func() { *obj = sourcev1.GitRepositoryProgressing(*obj) },
+		reconciling: func() { *obj = sourcev1.GitRepositoryReconciling(*obj) },
+		ready: func(reason, message string) {
+			*obj = sourcev1.GitRepositoryReady(*obj, sourcev1.Artifact{}, nil, "", reason, message)
+		},
+		notReady: func(reason, message string) { *obj = sourcev1.GitRepositoryNotReady(*obj, reason, message) },
+		stalled:  func(reason, message string) { *obj = sourcev1.GitRepositoryStalled(*obj, reason, message) },
+	}
+}
+
+func helmRepositoryConditions() sourceConditions {
+	obj := &sourcev1.HelmRepository{}
+	return sourceConditions{
+		object:      obj,
+		conditions:  func() []metav1.Condition { return obj.Status.Conditions },
+		progressing: func() { *obj = sourcev1.HelmRepositoryProgressing(*obj) },
+		reconciling: func() { *obj = sourcev1.HelmRepositoryReconciling(*obj) },
+		ready: func(reason, message string) {
+			*obj = sourcev1.HelmRepositoryReady(*obj, sourcev1.Artifact{}, "", reason, message)
+		},
+		notReady: func(reason, message string) { *obj = sourcev1.HelmRepositoryNotReady(*obj, reason, message) },
+		stalled:  func(reason, message string) { *obj = sourcev1.HelmRepositoryStalled(*obj, reason, message) },
+	}
+}
+
+func helmChartConditions() sourceConditions {
+	obj := &sourcev1.HelmChart{}
+	return sourceConditions{
+		object:      obj,
+		conditions:  func() []metav1.Condition { return obj.Status.Conditions },
+		progressing: func() { *obj = sourcev1.HelmChartProgressing(*obj) },
+		reconciling: func() { *obj = sourcev1.HelmChartReconciling(*obj) },
+		ready: func(reason, message string) {
+			*obj = sourcev1.HelmChartReady(*obj, sourcev1.Artifact{}, "", reason, message)
+		},
+		notReady: func(reason, message string) { *obj = sourcev1.HelmChartNotReady(*obj, reason, message) },
+		stalled:  func(reason, message string) { *obj = sourcev1.HelmChartStalled(*obj, reason, message) },
+	}
+}
+
+func bucketConditions() sourceConditions {
+	obj := &sourcev1.Bucket{}
+	return sourceConditions{
+		object:      obj,
+		conditions:  func() []metav1.Condition { return obj.Status.Conditions },
+		progressing: func() { *obj = sourcev1.BucketProgressing(*obj) },
+		reconciling: func() { *obj = sourcev1.BucketReconciling(*obj) },
+		ready: func(reason, message string) {
+			*obj = sourcev1.BucketReady(*obj, sourcev1.Artifact{}, "", reason, message)
+		},
+		notReady: func(reason, message string) { *obj = sourcev1.BucketNotReady(*obj, reason, message) },
+		stalled:  func(reason, message string) { *obj = sourcev1.BucketStalled(*obj, reason, message) },
+	}
+}
+
+// wantCondition is the expected status and reason of a condition, an empty
+// status means that the condition is absent.
+type wantCondition struct {
+	status metav1.ConditionStatus
+	reason string
+}
+
+func TestSourceConditions(t *testing.T) {
+	kinds := []struct {
+		kind          string
+		new           func() sourceConditions
+		fetchReason   string
+		successReason string
+	}{
+		{sourcev1.GitRepositoryKind, gitRepositoryConditions, sourcev1.GitOperationFailedReason, sourcev1.GitOperationSucceedReason},
+		{sourcev1.HelmRepositoryKind, helmRepositoryConditions, sourcev1.IndexationFailedReason, sourcev1.IndexationSucceededReason},
+		{sourcev1.HelmChartKind, helmChartConditions, sourcev1.ChartPullFailedReason, sourcev1.ChartPullSucceededReason},
+		{sourcev1.BucketKind, bucketConditions, sourcev1.BucketOperationFailedReason, sourcev1.BucketOperationSucceedReason},
+	}
+	for _, k := range kinds {
+		t.Run(k.kind, func(t *testing.T) {
+			source := k.new()
+			expect := func(t *testing.T, step string, want map[string]wantCondition) {
+				t.Helper()
+				for _, condition := range []string{meta.ReadyCondition, meta.ReconcilingCondition, meta.StalledCondition, sourcev1.FetchFailedCondition} {
+					got := apimeta.FindStatusCondition(source.conditions(), condition)
+					w := want[condition]
+					switch {
+					case w.status == "" && got != nil:
+						t.Errorf("%s: condition %s = %s/%s, want none", step, condition, got.Status, got.Reason)
+					case w.status == "":
+					case got == nil:
+						t.Errorf("%s: condition %s is missing, want %s/%s", step, condition, w.status, w.reason)
+					case got.Status != w.status || got.Reason != w.reason:
+						t.Errorf("%s: condition %s = %s/%s, want %s/%s", step, condition, got.Status, got.Reason, w.status, w.reason)
+					case got.ObservedGeneration != source.object.GetGeneration():
+						t.Errorf("%s: condition %s observed generation %d, want %d", step, condition, got.ObservedGeneration, source.object.GetGeneration())
+					}
+				}
+			}
+
+			source.object.SetGeneration(1)
+			source.progressing()
+			expect(t, "new generation", map[string]wantCondition{
+				meta.ReadyCondition:       {metav1.ConditionUnknown, meta.ProgressingReason},
+				meta.ReconcilingCondition: {metav1.ConditionTrue, sourcev1.NewGenerationReason},
+			})
+
+			source.notReady(k.fetchReason, "fetch failed")
+			expect(t, "transient fetch failure", map[string]wantCondition{
+				meta.ReadyCondition:           {metav1.ConditionFalse, k.fetchReason},
+				sourcev1.FetchFailedCondition: {metav1.ConditionTrue, k.fetchReason},
+			})
+
+			source.reconciling()
+			expect(t, "retry", map[string]wantCondition{
+				meta.ReadyCondition:           {metav1.ConditionFalse, k.fetchReason},
+				meta.ReconcilingCondition:     {metav1.ConditionTrue, meta.ProgressingReason},
+				sourcev1.FetchFailedCondition: {metav1.ConditionTrue, k.fetchReason},
+			})
+
+			source.notReady(sourcev1.StorageOperationFailedReason, "storage failed")
+			expect(t, "transient storage failure", map[string]wantCondition{
+				meta.ReadyCondition: {metav1.ConditionFalse, sourcev1.StorageOperationFailedReason},
+			})
+
+			source.ready(k.successReason, "fetched")
+			expect(t, "success", map[string]wantCondition{
+				meta.ReadyCondition: {metav1.ConditionTrue, k.successReason},
+			})
+
+			// The ready source of an observed generation is reconciled again
+			source.reconciling()
+			expect(t, "reconciliation", map[string]wantCondition{
+				meta.ReadyCondition:       {metav1.ConditionTrue, k.successReason},
+				meta.ReconcilingCondition: {metav1.ConditionTrue, meta.ProgressingReason},
+			})
+
+			source.ready(k.successReason, "fetched")
+			expect(t, "success of the reconciliation", map[string]wantCondition{
+				meta.ReadyCondition: {metav1.ConditionTrue, k.successReason},
+			})
+
+			source.object.SetGeneration(2)
+			source.progressing()
+			source.stalled(sourcev1.ArtifactTooLargeReason, "artifact too large")
+			expect(t, "terminal failure", map[string]wantCondition{
+				meta.ReadyCondition:   {metav1.ConditionFalse, sourcev1.ArtifactTooLargeReason},
+				meta.StalledCondition: {metav1.ConditionTrue, sourcev1.ArtifactTooLargeReason},
+			})
+
+			// A missing artifact of an observed generation is produced again
+			source.progressing()
+			expect(t, "observed generation", map[string]wantCondition{
+				meta.ReadyCondition:       {metav1.ConditionUnknown, meta.ProgressingReason},
+				meta.ReconcilingCondition: {metav1.ConditionTrue, meta.ProgressingReason},
+			})
+		})
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// indexByConfigMapRefs returns the names of the ConfigMaps referenced by the given source, for the
+// sourcev1.ConfigMapIndexKey index. The ConfigMaps are in the namespace of the source.
+func indexByConfigMapRefs(o client.Object) []string {
+	var ref *sourcev1.ConfigMapKeyReference
+	switch s := o.(type) {
+	case *sourcev1.GitRepository:
+		ref = s.Spec.CARef
+	case *sourcev1.HelmRepository:
+		ref = s.Spec.CARef
+	default:
+		panic(fmt.Sprintf("Expected a GitRepository or HelmRepository, got %T", o))
+	}
+	if ref == nil || ref.Name == "" {
+		return nil
+	}
+	return []string{ref.Name}
+}
+
+// requestsForConfigMapChange returns the reconcile requests for the sources of the given list type that reference
+// the given ConfigMap, listed with the sourcev1.ConfigMapIndexKey index. Only the sources in the namespace of the
+// ConfigMap can reference it.
+func requestsForConfigMapChange(r client.Reader, list client.ObjectList, o client.Object) []reconcile.Request {
+	cm, ok := o.(*corev1.ConfigMap)
+	if !ok {
+		panic(fmt.Sprintf("Expected a ConfigMap, got %T", o))
+	}
+	return requestsForIndexedName(r, list, sourcev1.ConfigMapIndexKey, cm)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestIndexByConfigMapRefs(t *testing.T) {
+	tests := []struct {
+		name   string
+		source client.Object
+		want   []string
+	}{
+		{
+			name:   "GitRepository without config maps",
+			source: &sourcev1.GitRepository{},
+		},
+		{
+			name: "GitRepository with CA config map",
+			source: &sourcev1.GitRepository{Spec: sourcev1.GitRepositorySpec{
+				CARef: &sourcev1.ConfigMapKeyReference{Name: "internal-ca"},
+			}},
+			want: []string{"internal-ca"},
+		},
+		{
+			name: "HelmRepository with CA config map",
+			source: &sourcev1.HelmRepository{Spec: sourcev1.HelmRepositorySpec{
+				CARef: &sourcev1.ConfigMapKeyReference{Name: "internal-ca", Key: "bundle.pem"},
+			}},
+			want: []string{"internal-ca"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := indexByConfigMapRefs(tt.source); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("indexByConfigMapRefs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// DrainAbortTimeout is the duration for which the aborted reconciliations are
+// waited for once the Timeout of a Drainer expired.
+const DrainAbortTimeout = 2 * time.Second
+
+// Drainer drains the in-flight reconciliations of the controllers when the
+// manager stops, e.g. on SIGTERM. Once the manager stops, the reconciliations
+// that are still queued are skipped, while the in-flight reconciliations run
+// to completion, with a context that is not canceled by the manager, so that
+// their artifacts and status are written. The in-flight reconciliations are
+// aborted once the Timeout expired, by canceling their context, which rolls
+// back the artifact writes and removes their temporary files.
+type Drainer struct {
+	// Timeout is the maximum duration for which the in-flight
+	// reconciliations are waited for before they are aborted.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	stopping bool
+	inFlight sync.WaitGroup
+	abort    chan struct{}
+}
+
+// NewDrainer returns a Drainer with the given timeout.
+func NewDrainer(timeout time.Duration) *Drainer {
+	return &Drainer{Timeout: timeout, abort: make(chan struct{})}
+}
+
+// ShutdownTimeout returns the maximum duration of the drain, the timeout of
+// the graceful shutdown of the manager.
+func (d *Drainer) ShutdownTimeout() time.Duration {
+	return d.Timeout + DrainAbortTimeout
+}
+
+// Reconciler returns the given reconciler, of which the reconciliations are
+// drained. A nil Drainer returns the reconciler as is.
+func (d *Drainer) Reconciler(r reconcile.Reconciler) reconcile.Reconciler {
+	if d == nil {
+		return r
+	}
+	return reconcile.Func(func(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+		d.mu.Lock()
+		if d.stopping || ctx.Err() != nil {
+			d.mu.Unlock()
+			return ctrl.Result{}, nil
+		}
+		d.inFlight.Add(1)
+		d.mu.Unlock()
+		defer d.inFlight.Done()
+		return r.Reconcile(drainContext{Context: ctx, abort: d.abort}, req)
+	})
+}
+
+// Start drains the reconciliations once the given context is done, it
+// implements manager.Runnable.
+func (d *Drainer) Start(ctx context.Context) error {
+	<-ctx.Done()
+	d.drain(ctrl.LoggerFrom(ctx).WithName("drainer"))
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the
+// reconciliations of the leader are drained.
+func (d *Drainer) NeedLeaderElection() bool {
+	return true
+}
+
+// drain stops the reconciliations, and waits for the in-flight
+// reconciliations for the Timeout before it aborts them, and waits for them
+// for the DrainAbortTimeout.
+func (d *Drainer) drain(log logr.Logger) {
+	d.mu.Lock()
+	d.stopping = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(d.Timeout):
+	}
+	log.Info("aborting the in-flight reconciliations", "timeout", d.Timeout.String())
+	close(d.abort)
+	select {
+	case <-done:
+	case <-time.After(DrainAbortTimeout):
+		log.Info("in-flight reconciliations did not abort in time")
+	}
+}
+
+// drainContext is the context of an in-flight reconciliation, it carries the
+// values of the context of the controller but is only done once the
+// reconciliation is aborted.
+type drainContext struct {
+	context.Context
+	abort <-chan struct{}
+}
+
+func (c drainContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c drainContext) Done() <-chan struct{} {
+	return c.abort
+}
+
+func (c drainContext) Err() error {
+	select {
+	case <-c.abort:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// contextReader is a reader of an artifact that returns a first chunk, and
+// then blocks until its context is done, as a download that is aborted.
+type contextReader struct {
+	ctx  context.Context
+	read chan struct{}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.read:
+	default:
+		close(r.read)
+		return copy(p, "partial"), nil
+	}
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func TestDrainer_drain(t *testing.T) {
+	// The context of the manager, canceled by its signal handler
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	d := NewDrainer(time.Minute)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var reconciled int
+	r := d.Reconciler(reconcile.Func(func(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+		reconciled++
+		close(started)
+		<-release
+		return ctrl.Result{}, ctx.Err()
+	}))
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.Reconcile(ctx, ctrl.Request{})
+		errs <- err
+	}()
+	<-started
+
+	drained := make(chan struct{})
+	go func() {
+		d.Start(ctrl.LoggerInto(ctx, logr.Discard()))
+		close(drained)
+	}()
+	stop()
+
+	// The reconciliations that are still queued are skipped
+	if _, err := r.Reconcile(ctx, ctrl.Request{}); err != nil || reconciled != 1 {
+		t.Errorf("queued reconciliation is not skipped: %v", err)
+	}
+
+	// The in-flight reconciliation runs to completion with a context that
+	// is not canceled
+	select {
+	case <-drained:
+		t.Fatal("drain returned before the in-flight reconciliation completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-errs; err != nil {
+		t.Errorf("in-flight reconciliation error = %v, want its context not to be canceled", err)
+	}
+	<-drained
+}
+
+func TestDrainer_abort(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	artifact := storage.NewArtifactFor(sourcev1.BucketKind, &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"},
+		"rev", "rev.tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	d := NewDrainer(10 * time.Millisecond)
+
+	// A slow reconciliation that writes an artifact until it is aborted
+	read := make(chan struct{})
+	r := d.Reconciler(reconcile.Func(func(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+		return ctrl.Result{}, storage.AtomicWriteFile(&artifact, &contextReader{ctx: ctx, read: read}, 0644)
+	}))
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "podinfo"}})
+		errs <- err
+	}()
+	<-read
+	stop()
+
+	d.Start(ctrl.LoggerInto(ctx, logr.Discard()))
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("aborted reconciliation error = %v, want %v", err, context.Canceled)
+	}
+
+	// No partial artifact nor temporary file remains
+	entries, err := os.ReadDir(filepath.Dir(storage.LocalPath(artifact)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("partial file %q remains in the storage", entry.Name())
+	}
+}
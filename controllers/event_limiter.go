@@ -0,0 +1,183 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/fluxcd/pkg/runtime/events"
+)
+
+const (
+	// eventDuplicateCause is the cause of the suppression of an event that
+	// is identical to the last event of the object within the window.
+	eventDuplicateCause = "duplicate"
+	// eventRateLimitedCause is the cause of the suppression of a repeated
+	// error event above the maximum number of error events per hour.
+	eventRateLimitedCause = "rate_limited"
+)
+
+// suppressedEventsCounter counts the events of the sources that are not
+// emitted by the EventLimiter.
+var suppressedEventsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gotk_suppressed_events_total",
+		Help: "The number of events of the sources that are suppressed, by kind and cause.",
+	},
+	[]string{"kind", "cause"},
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(suppressedEventsCounter)
+}
+
+// EventLimiter suppresses the repeated events of the sources, e.g. the same
+// error event of a source with a bad credential at every interval. The first
+// event of an object with a reason, and any event of which the message
+// changed, are always emitted. A repeated event is suppressed within the
+// Window since the last emission of the same event, and a repeated error
+// event is suppressed once the object emitted MaxWarningsPerHour error events
+// in the last hour. A nil EventLimiter emits all events.
+type EventLimiter struct {
+	// Window is the duration since the emission of an event within which
+	// the same event of the object is suppressed. Zero disables the
+	// deduplication.
+	Window time.Duration
+
+	// MaxWarningsPerHour is the maximum number of error events of an object
+	// per hour, above which repeated error events are suppressed. Zero means
+	// unlimited.
+	MaxWarningsPerHour int
+
+	mu        sync.Mutex
+	objects   map[eventObject]*eventHistory
+	lastSweep time.Time
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// eventObject identifies the object of an event.
+type eventObject struct {
+	kind, namespace, name string
+}
+
+// eventHistory is the history of the emitted events of an object.
+type eventHistory struct {
+	// last is the last emitted event by reason.
+	last map[string]emittedEvent
+	// warnings are the emission times of the error events in the last hour.
+	warnings []time.Time
+}
+
+// emittedEvent is the hash of the message of an emitted event and the time
+// of its emission.
+type emittedEvent struct {
+	hash    [sha256.Size]byte
+	emitted time.Time
+}
+
+// NewEventLimiter returns an EventLimiter with the given deduplication window
+// and maximum number of error events per object per hour.
+func NewEventLimiter(window time.Duration, maxWarningsPerHour int) *EventLimiter {
+	return &EventLimiter{
+		Window:             window,
+		MaxWarningsPerHour: maxWarningsPerHour,
+		objects:            map[eventObject]*eventHistory{},
+	}
+}
+
+// suppress returns the cause of the suppression of the event of the given
+// object of the given kind with the given severity, which is the reason of
+// the event, and message, or an empty string if the event is emitted. The
+// suppressed events are recorded by cause in the suppressed events metric.
+func (l *EventLimiter) suppress(kind string, obj metav1.Object, severity, msg string) string {
+	if l == nil {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.objects == nil {
+		l.objects = map[eventObject]*eventHistory{}
+	}
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	l.sweep(now)
+	key := eventObject{kind: kind, namespace: obj.GetNamespace(), name: obj.GetName()}
+	history, ok := l.objects[key]
+	if !ok {
+		history = &eventHistory{last: map[string]emittedEvent{}}
+		l.objects[key] = history
+	}
+	hour := now.Add(-time.Hour)
+	for len(history.warnings) > 0 && !history.warnings[0].After(hour) {
+		history.warnings = history.warnings[1:]
+	}
+
+	hash := sha256.Sum256([]byte(msg))
+	if last, ok := history.last[severity]; ok && last.hash == hash {
+		if l.Window > 0 && now.Sub(last.emitted) < l.Window {
+			suppressedEventsCounter.WithLabelValues(kind, eventDuplicateCause).Inc()
+			return eventDuplicateCause
+		}
+		if severity == events.EventSeverityError && l.MaxWarningsPerHour > 0 && len(history.warnings) >= l.MaxWarningsPerHour {
+			suppressedEventsCounter.WithLabelValues(kind, eventRateLimitedCause).Inc()
+			return eventRateLimitedCause
+		}
+	}
+
+	history.last[severity] = emittedEvent{hash: hash, emitted: now}
+	if severity == events.EventSeverityError {
+		history.warnings = append(history.warnings, now)
+	}
+	return ""
+}
+
+// sweep removes the history of the objects that emitted no event for longer
+// than the Window and an hour, at most once per hour. The next event of such
+// an object is emitted as a first event.
+func (l *EventLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Hour {
+		return
+	}
+	l.lastSweep = now
+	retention := time.Hour
+	if l.Window > retention {
+		retention = l.Window
+	}
+	for key, history := range l.objects {
+		expired := true
+		for _, last := range history.last {
+			if now.Sub(last.emitted) < retention {
+				expired = false
+				break
+			}
+		}
+		if expired {
+			delete(l.objects, key)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fluxcd/pkg/runtime/events"
+)
+
+func TestEventLimiter(t *testing.T) {
+	// A kind of its own, the reconcilers of the suite record the others
+	const kind = "EventLimiterTest"
+	now := time.Now()
+	l := NewEventLimiter(10*time.Minute, 3)
+	l.now = func() time.Time { return now }
+	podinfo := &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}
+	other := &metav1.ObjectMeta{Name: "other", Namespace: "default"}
+
+	steps := []struct {
+		name     string
+		after    time.Duration
+		obj      metav1.Object
+		severity string
+		msg      string
+		want     string
+	}{
+		{name: "first event", obj: podinfo, severity: events.EventSeverityError, msg: "auth failed"},
+		{name: "duplicate within the window", after: time.Minute, obj: podinfo, severity: events.EventSeverityError, msg: "auth failed", want: eventDuplicateCause},
+		{name: "same event of another object", obj: other, severity: events.EventSeverityError, msg: "auth failed"},
+		{name: "same message with another severity", obj: podinfo, severity: events.EventSeverityInfo, msg: "auth failed"},
+		{name: "changed message", after: time.Minute, obj: podinfo, severity: events.EventSeverityError, msg: "auth failed again"},
+		{name: "repeat after the window", after: 10 * time.Minute, obj: podinfo, severity: events.EventSeverityError, msg: "auth failed again"},
+		{name: "repeat above the rate limit", after: 10 * time.Minute, obj: podinfo, severity: events.EventSeverityError, msg: "auth failed again", want: eventRateLimitedCause},
+		{name: "changed message above the rate limit", obj: podinfo, severity: events.EventSeverityError, msg: "auth failed once more"},
+		{name: "repeated info event after the window", after: 10 * time.Minute, obj: podinfo, severity: events.EventSeverityInfo, msg: "auth failed"},
+		{name: "repeat once the hour passed", after: 50 * time.Minute, obj: podinfo, severity: events.EventSeverityError, msg: "auth failed once more"},
+	}
+	for _, s := range steps {
+		now = now.Add(s.after)
+		if got := l.suppress(kind, s.obj, s.severity, s.msg); got != s.want {
+			t.Errorf("%s: suppress() = %q, want %q", s.name, got, s.want)
+		}
+	}
+
+	for cause, want := range map[string]float64{eventDuplicateCause: 1, eventRateLimitedCause: 1} {
+		if got := testutil.ToFloat64(suppressedEventsCounter.WithLabelValues(kind, cause)); got != want {
+			t.Errorf("suppressed events with cause %s = %v, want %v", cause, got, want)
+		}
+	}
+
+	// A nil limiter emits all events
+	var disabled *EventLimiter
+	if got := disabled.suppress(kind, podinfo, events.EventSeverityError, "auth failed"); got != "" {
+		t.Errorf("suppress() of a nil limiter = %q, want the event emitted", got)
+	}
+}
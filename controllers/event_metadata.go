@@ -0,0 +1,105 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/redact"
+)
+
+// The keys of the metadata of the event of a new artifact, which is forwarded
+// to the events receiver with the event, e.g. for the templates of alerts.
+// The keys are stable, a key without a value is omitted.
+const (
+	// RevisionMetadataKey is the key of the revision of the artifact.
+	RevisionMetadataKey = "revision"
+	// ChecksumMetadataKey is the key of the checksum of the artifact.
+	ChecksumMetadataKey = "checksum"
+	// DigestMetadataKey is the key of the digest of the artifact, the
+	// checksum prefixed with its algorithm.
+	DigestMetadataKey = "digest"
+	// SizeMetadataKey is the key of the size of the artifact in bytes.
+	SizeMetadataKey = "size"
+	// URLMetadataKey is the key of the URL of the upstream of the source,
+	// without credentials.
+	URLMetadataKey = "url"
+)
+
+// artifactMetadata returns the metadata of the event of the given new
+// artifact of a source with the given upstream URL, which may be empty.
+func (s *Storage) artifactMetadata(artifact *sourcev1.Artifact, sourceURL string) map[string]string {
+	if artifact == nil {
+		return nil
+	}
+	metadata := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	set(RevisionMetadataKey, artifact.Revision)
+	set(ChecksumMetadataKey, artifact.Checksum)
+	set(DigestMetadataKey, artifact.Digest)
+	if fi, err := os.Stat(s.LocalPath(*artifact)); err == nil {
+		set(SizeMetadataKey, strconv.FormatInt(fi.Size(), 10))
+	}
+	set(URLMetadataKey, redact.String(sourceURL))
+	return metadata
+}
+
+// upstreamURL returns the URL of the upstream of the given source, the URL of
+// a Git, Helm or OCI repository, or the URL of a bucket at its endpoint. It
+// returns an empty string for other sources, e.g. a HelmChart.
+func upstreamURL(source sourcev1.Source) string {
+	switch s := source.(type) {
+	case *sourcev1.GitRepository:
+		return s.Spec.URL
+	case *sourcev1.HelmRepository:
+		return s.Spec.URL
+	case *sourcev1.OCIRepository:
+		return s.Spec.URL
+	case *sourcev1.Bucket:
+		endpoint := strings.TrimSuffix(s.Spec.Endpoint, "/")
+		if !strings.Contains(endpoint, "://") {
+			scheme := "https"
+			if s.Spec.Insecure {
+				scheme = "http"
+			}
+			endpoint = fmt.Sprintf("%s://%s", scheme, endpoint)
+		}
+		return fmt.Sprintf("%s/%s", endpoint, s.Spec.BucketName)
+	default:
+		return ""
+	}
+}
+
+// mergeMetadata returns the union of the given event metadata, the later
+// values take precedence.
+func mergeMetadata(metadata ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, m := range metadata {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+const (
+	// FetchMetricsPerObject is the granularity of the fetch metrics labelled
+	// by the name and namespace of every source.
+	FetchMetricsPerObject = "object"
+	// FetchMetricsPerKind is the granularity of the fetch metrics labelled by
+	// kind only, with an empty name and namespace, for very large fleets.
+	FetchMetricsPerKind = "kind"
+)
+
+const (
+	// fetchFailureAuth is the class of a failure to authenticate against the
+	// upstream, e.g. with missing or rejected credentials.
+	fetchFailureAuth = "auth"
+	// fetchFailureNetwork is the class of a failure to connect to the
+	// upstream, e.g. an unknown host, a refused connection or a timeout.
+	fetchFailureNetwork = "network"
+	// fetchFailureNotFound is the class of a failure to find the requested
+	// upstream, e.g. a bucket, branch, chart or index that does not exist.
+	fetchFailureNotFound = "not-found"
+	// fetchFailureTLS is the class of a failure to establish a TLS
+	// connection, e.g. with an unknown certificate authority.
+	fetchFailureTLS = "tls"
+	// fetchFailureOther is the class of the other failures to fetch the
+	// upstream.
+	fetchFailureOther = "other"
+)
+
+var (
+	// fetchFailuresCounter counts the failures to fetch the upstream of the
+	// sources by class.
+	fetchFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_source_fetch_failures_total",
+			Help: "The number of failures to fetch the upstream of a source, by reason: 'auth', 'network', 'not-found', 'tls' or 'other'.",
+		},
+		[]string{"kind", "name", "namespace", "reason"},
+	)
+	// fetchConsecutiveFailuresGauge is the number of consecutive failures to
+	// fetch the upstream of a source, reset on success.
+	fetchConsecutiveFailuresGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_source_fetch_consecutive_failures",
+			Help: "The number of consecutive failures to fetch the upstream of a source, or the highest of the sources of a kind, reset on success.",
+		},
+		[]string{"kind", "name", "namespace"},
+	)
+	// fetchLastFailureGauge is the time of the last failure to fetch the
+	// upstream of a source, labelled by its reason.
+	fetchLastFailureGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_source_fetch_last_failure_timestamp_seconds",
+			Help: "The Unix time of the last failure to fetch the upstream of a source, or of any source of a kind, by reason.",
+		},
+		[]string{"kind", "name", "namespace", "reason"},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(fetchFailuresCounter, fetchConsecutiveFailuresGauge, fetchLastFailureGauge)
+}
+
+// FetchMetrics records the failures to fetch the upstream of the sources, as
+// reported by their FetchFailed condition, classified by reason, for alerts
+// on sources that cannot reach their upstream. The metrics are labelled by
+// the name and namespace of every source, or only by kind, depending on the
+// Granularity. A nil FetchMetrics records nothing.
+type FetchMetrics struct {
+	// Granularity is FetchMetricsPerObject or FetchMetricsPerKind.
+	Granularity string
+
+	mu sync.Mutex
+	// failures is the number of consecutive failures of every source.
+	failures map[fetchSource]int
+	// reasons are the reasons of the failures of every series.
+	reasons map[fetchSource]map[string]bool
+	// lastReasons is the reason of the last failure of every series.
+	lastReasons map[fetchSource]string
+}
+
+// fetchSource identifies a source, or the series of the metrics of a source.
+type fetchSource struct {
+	kind, namespace, name string
+}
+
+// NewFetchMetrics returns a FetchMetrics with the given granularity.
+func NewFetchMetrics(granularity string) *FetchMetrics {
+	return &FetchMetrics{
+		Granularity: granularity,
+		failures:    map[fetchSource]int{},
+		reasons:     map[fetchSource]map[string]bool{},
+		lastReasons: map[fetchSource]string{},
+	}
+}
+
+// series returns the labels of the metrics of the given source.
+func (m *FetchMetrics) series(source fetchSource) fetchSource {
+	if m.Granularity == FetchMetricsPerKind {
+		return fetchSource{kind: source.kind}
+	}
+	return source
+}
+
+// record records the result of the reconciliation of the given source of
+// the given kind, from its conditions after the reconciliation and the
+// reconciliation error, if any. A failure is recorded if the FetchFailed
+// condition is 'True', and the consecutive failures are reset if the source
+// is ready.
+func (m *FetchMetrics) record(kind string, obj metav1.Object, conditions []metav1.Condition, err error) {
+	if m == nil {
+		return
+	}
+	source := fetchSource{kind: kind, namespace: obj.GetNamespace(), name: obj.GetName()}
+	series := m.series(source)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fc := apimeta.FindStatusCondition(conditions, sourcev1.FetchFailedCondition); fc != nil && fc.Status == metav1.ConditionTrue {
+		reason := classifyFetchFailure(fc.Reason, fc.Message, err)
+		fetchFailuresCounter.WithLabelValues(series.kind, series.name, series.namespace, reason).Inc()
+		if m.reasons[series] == nil {
+			m.reasons[series] = map[string]bool{}
+		}
+		m.reasons[series][reason] = true
+		if last, ok := m.lastReasons[series]; ok && last != reason {
+			fetchLastFailureGauge.DeleteLabelValues(series.kind, series.name, series.namespace, last)
+		}
+		m.lastReasons[series] = reason
+		fetchLastFailureGauge.WithLabelValues(series.kind, series.name, series.namespace, reason).SetToCurrentTime()
+		m.failures[source]++
+	} else if apimeta.IsStatusConditionTrue(conditions, meta.ReadyCondition) {
+		m.failures[source] = 0
+	} else {
+		return
+	}
+	m.updateConsecutiveFailures(series)
+}
+
+// forget removes the given source of the given kind from the metrics, when
+// it is deleted.
+func (m *FetchMetrics) forget(kind string, obj metav1.Object) {
+	if m == nil {
+		return
+	}
+	source := fetchSource{kind: kind, namespace: obj.GetNamespace(), name: obj.GetName()}
+	series := m.series(source)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, source)
+	if series != source {
+		// the series of the kind is shared with the other sources
+		m.updateConsecutiveFailures(series)
+		return
+	}
+	fetchConsecutiveFailuresGauge.DeleteLabelValues(series.kind, series.name, series.namespace)
+	if last, ok := m.lastReasons[series]; ok {
+		fetchLastFailureGauge.DeleteLabelValues(series.kind, series.name, series.namespace, last)
+		delete(m.lastReasons, series)
+	}
+	for reason := range m.reasons[series] {
+		fetchFailuresCounter.DeleteLabelValues(series.kind, series.name, series.namespace, reason)
+	}
+	delete(m.reasons, series)
+}
+
+// updateConsecutiveFailures sets the consecutive failures gauge of the given
+// series, the highest consecutive failures of its sources.
+func (m *FetchMetrics) updateConsecutiveFailures(series fetchSource) {
+	var max int
+	if m.Granularity == FetchMetricsPerKind {
+		for source, n := range m.failures {
+			if source.kind == series.kind && n > max {
+				max = n
+			}
+		}
+	} else {
+		max = m.failures[series]
+	}
+	fetchConsecutiveFailuresGauge.WithLabelValues(series.kind, series.name, series.namespace).Set(float64(max))
+}
+
+// classifyFetchFailure returns the class of a failure to fetch the upstream
+// of a source, from the reason and message of its FetchFailed condition and
+// the reconciliation error. The classes are the same for all kinds, while
+// the reasons of the conditions are specific to the kinds, and the errors of
+// the Git implementations are only available as messages.
+func classifyFetchFailure(reason, message string, err error) string {
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		certificateErr      x509.CertificateInvalidError
+		hostnameErr         x509.HostnameError
+		netErr              net.Error
+	)
+	msg := strings.ToLower(message)
+	switch {
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &certificateErr), errors.As(err, &hostnameErr),
+		containsAny(msg, "x509:", "tls:", "certificate"):
+		return fetchFailureTLS
+	case reason == sourcev1.AuthenticationFailedReason,
+		containsAny(msg, "unauthorized", "forbidden", "authentication", "access denied", "accessdenied", "permission denied"):
+		return fetchFailureAuth
+	case reason == sourcev1.BucketNotFoundReason, errors.Is(err, os.ErrNotExist),
+		containsAny(msg, "not found", "nosuchbucket", "no such bucket", "does not exist"):
+		return fetchFailureNotFound
+	case reason == sourcev1.BucketConnectionFailedReason, errors.As(err, &netErr),
+		containsAny(msg, "no such host", "connection refused", "connection reset", "timeout", "timed out", "network is unreachable", "eof"):
+		return fetchFailureNetwork
+	default:
+		return fetchFailureOther
+	}
+}
+
+// containsAny returns if s contains any of the given substrings.
+func containsAny(s string, substrs ...string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestClassifyFetchFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		reason  string
+		message string
+		err     error
+		want    string
+	}{
+		{"unknown authority", sourcev1.IndexationFailedReason, "", fmt.Errorf("fetch: %w", x509.UnknownAuthorityError{}), fetchFailureTLS},
+		{"libgit2 certificate", sourcev1.GitOperationFailedReason, "unable to clone: the SSL certificate is invalid", nil, fetchFailureTLS},
+		{"credentials", sourcev1.AuthenticationFailedReason, "secret 'default/creds' not found", nil, fetchFailureAuth},
+		{"unauthorized", sourcev1.IndexationFailedReason, "failed to fetch index.yaml : 401 Unauthorized", nil, fetchFailureAuth},
+		{"bucket", sourcev1.BucketNotFoundReason, "bucket 'podinfo' not found", nil, fetchFailureNotFound},
+		{"branch", sourcev1.GitOperationFailedReason, "unable to clone: reference not found", nil, fetchFailureNotFound},
+		{"connection", sourcev1.BucketConnectionFailedReason, "", nil, fetchFailureNetwork},
+		{"dial", sourcev1.IndexationFailedReason, "", &net.OpError{Op: "dial", Err: errors.New("refused")}, fetchFailureNetwork},
+		{"host", sourcev1.GitOperationFailedReason, "unable to clone: dial tcp: lookup github.invalid: no such host", nil, fetchFailureNetwork},
+		{"other", sourcev1.ChartPullFailedReason, "chart 'podinfo' version '6.x' has no matching version", nil, fetchFailureOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyFetchFailure(tt.reason, tt.message, tt.err); got != tt.want {
+				t.Errorf("classifyFetchFailure() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchMetrics_PerObject(t *testing.T) {
+	const kind = "FetchMetricsObjectTest"
+	m := NewFetchMetrics(FetchMetricsPerObject)
+	obj := &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}
+	authFailed := []metav1.Condition{
+		{Type: meta.ReadyCondition, Status: metav1.ConditionFalse, Reason: sourcev1.AuthenticationFailedReason},
+		{Type: sourcev1.FetchFailedCondition, Status: metav1.ConditionTrue, Reason: sourcev1.AuthenticationFailedReason},
+	}
+	notFound := []metav1.Condition{
+		{Type: meta.ReadyCondition, Status: metav1.ConditionFalse, Reason: sourcev1.BucketNotFoundReason},
+		{Type: sourcev1.FetchFailedCondition, Status: metav1.ConditionTrue, Reason: sourcev1.BucketNotFoundReason},
+	}
+	storageFailed := []metav1.Condition{
+		{Type: meta.ReadyCondition, Status: metav1.ConditionFalse, Reason: sourcev1.StorageOperationFailedReason},
+	}
+	ready := []metav1.Condition{{Type: meta.ReadyCondition, Status: metav1.ConditionTrue}}
+
+	m.record(kind, obj, authFailed, errors.New("auth"))
+	m.record(kind, obj, authFailed, errors.New("auth"))
+	// A failure that is not a failure to fetch is not recorded
+	m.record(kind, obj, storageFailed, errors.New("storage"))
+	m.record(kind, obj, notFound, errors.New("not found"))
+
+	if got := testutil.ToFloat64(fetchFailuresCounter.WithLabelValues(kind, "podinfo", "default", fetchFailureAuth)); got != 2 {
+		t.Errorf("auth failures = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(fetchConsecutiveFailuresGauge.WithLabelValues(kind, "podinfo", "default")); got != 3 {
+		t.Errorf("consecutive failures = %v, want 3", got)
+	}
+	// Only the reason of the last failure is kept
+	if fetchLastFailureGauge.DeleteLabelValues(kind, "podinfo", "default", fetchFailureAuth) {
+		t.Error("last failure of a previous reason is kept")
+	}
+	if got := testutil.ToFloat64(fetchLastFailureGauge.WithLabelValues(kind, "podinfo", "default", fetchFailureNotFound)); got == 0 {
+		t.Error("last failure time is not set")
+	}
+
+	m.record(kind, obj, ready, nil)
+	if got := testutil.ToFloat64(fetchConsecutiveFailuresGauge.WithLabelValues(kind, "podinfo", "default")); got != 0 {
+		t.Errorf("consecutive failures after a success = %v, want 0", got)
+	}
+
+	// The series of a deleted source are removed
+	m.forget(kind, obj)
+	if fetchFailuresCounter.DeleteLabelValues(kind, "podinfo", "default", fetchFailureAuth) {
+		t.Error("failures of a deleted source are kept")
+	}
+	if fetchConsecutiveFailuresGauge.DeleteLabelValues(kind, "podinfo", "default") {
+		t.Error("consecutive failures of a deleted source are kept")
+	}
+	if fetchLastFailureGauge.DeleteLabelValues(kind, "podinfo", "default", fetchFailureNotFound) {
+		t.Error("last failure of a deleted source is kept")
+	}
+
+	var disabled *FetchMetrics
+	disabled.record(kind, obj, authFailed, nil)
+	disabled.forget(kind, obj)
+}
+
+func TestFetchMetrics_PerKind(t *testing.T) {
+	const kind = "FetchMetricsKindTest"
+	m := NewFetchMetrics(FetchMetricsPerKind)
+	a := &metav1.ObjectMeta{Name: "a", Namespace: "default"}
+	b := &metav1.ObjectMeta{Name: "b", Namespace: "default"}
+	failed := []metav1.Condition{
+		{Type: sourcev1.FetchFailedCondition, Status: metav1.ConditionTrue, Reason: sourcev1.BucketConnectionFailedReason},
+	}
+	ready := []metav1.Condition{{Type: meta.ReadyCondition, Status: metav1.ConditionTrue}}
+
+	m.record(kind, a, failed, nil)
+	m.record(kind, a, failed, nil)
+	m.record(kind, b, failed, nil)
+
+	if got := testutil.ToFloat64(fetchFailuresCounter.WithLabelValues(kind, "", "", fetchFailureNetwork)); got != 3 {
+		t.Errorf("network failures of the kind = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(fetchConsecutiveFailuresGauge.WithLabelValues(kind, "", "")); got != 2 {
+		t.Errorf("consecutive failures of the kind = %v, want the highest of its sources 2", got)
+	}
+	if fetchFailuresCounter.DeleteLabelValues(kind, "a", "default", fetchFailureNetwork) {
+		t.Error("failures are labelled by source")
+	}
+
+	m.record(kind, a, ready, nil)
+	if got := testutil.ToFloat64(fetchConsecutiveFailuresGauge.WithLabelValues(kind, "", "")); got != 1 {
+		t.Errorf("consecutive failures of the kind = %v, want 1", got)
+	}
+	m.forget(kind, b)
+	if got := testutil.ToFloat64(fetchConsecutiveFailuresGauge.WithLabelValues(kind, "", "")); got != 0 {
+		t.Errorf("consecutive failures of the kind after deletion = %v, want 0", got)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// forceRefetchKey is the context key of a reconciliation which bypasses the
+// caches of the controller.
+type forceRefetchKey struct{}
+
+// forceRefetchRequest returns the value of the force refetch annotation of
+// the given object, and if it is newer than the given handled value.
+func forceRefetchRequest(obj client.Object, handled string) (string, bool) {
+	return annotationRequest(obj, sourcev1.ForceRefetchAnnotation, handled)
+}
+
+// annotationRequest returns the value of the given request annotation of the
+// given object, and if it is newer than the given handled value: a value
+// different from the handled value, unless both are RFC 3339 timestamps and
+// the value is not after the handled one, e.g. an annotation reset to an
+// older timestamp.
+func annotationRequest(obj client.Object, annotation, handled string) (string, bool) {
+	v, ok := obj.GetAnnotations()[annotation]
+	if !ok || v == "" || v == handled {
+		return v, false
+	}
+	requested, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return v, true
+	}
+	last, err := time.Parse(time.RFC3339Nano, handled)
+	if err != nil {
+		return v, true
+	}
+	return v, requested.After(last)
+}
+
+// withForceRefetch returns a context of which the reconciliation bypasses the
+// caches of the controller if force is true: the short-circuits on an
+// unchanged revision, index or digest, the objects of a Bucket reused from its
+// current artifact, and the indexes of the dependency repositories of a
+// HelmChart loaded from the storage.
+func withForceRefetch(ctx context.Context, force bool) context.Context {
+	if !force {
+		return ctx
+	}
+	return context.WithValue(ctx, forceRefetchKey{}, true)
+}
+
+// forceRefetch returns if the reconciliation of the given context bypasses
+// the caches of the controller.
+func forceRefetch(ctx context.Context) bool {
+	force, _ := ctx.Value(forceRefetchKey{}).(bool)
+	return force
+}
+
+// ForceRefetchRequestedPredicate passes the updates of a source of which the
+// force refetch annotation changed, as the ReconcileRequestedPredicate does
+// for the reconcile request annotation.
+type ForceRefetchRequestedPredicate struct {
+	predicate.Funcs
+}
+
+func (ForceRefetchRequestedPredicate) Update(e event.UpdateEvent) bool {
+	return annotationChanged(e, sourcev1.ForceRefetchAnnotation)
+}
+
+// annotationChanged returns if the given request annotation is set on the
+// new object of the given update, with another value than on the old object.
+func annotationChanged(e event.UpdateEvent, annotation string) bool {
+	if e.ObjectOld == nil || e.ObjectNew == nil {
+		return false
+	}
+	v, ok := e.ObjectNew.GetAnnotations()[annotation]
+	return ok && v != e.ObjectOld.GetAnnotations()[annotation]
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/pkg/oci"
+)
+
+func TestForceRefetchRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		handled     string
+		want        bool
+	}{
+		{name: "no annotation", handled: "", want: false},
+		{name: "empty annotation", annotations: map[string]string{sourcev1.ForceRefetchAnnotation: ""}, want: false},
+		{name: "first request", annotations: map[string]string{sourcev1.ForceRefetchAnnotation: "2021-10-01T10:00:00Z"}, want: true},
+		{name: "handled request", annotations: map[string]string{sourcev1.ForceRefetchAnnotation: "2021-10-01T10:00:00Z"},
+			handled: "2021-10-01T10:00:00Z", want: false},
+		{name: "newer request", annotations: map[string]string{sourcev1.ForceRefetchAnnotation: "2021-10-01T11:00:00Z"},
+			handled: "2021-10-01T10:00:00Z", want: true},
+		{name: "older request", annotations: map[string]string{sourcev1.ForceRefetchAnnotation: "2021-10-01T09:00:00Z"},
+			handled: "2021-10-01T10:00:00Z", want: false},
+		{name: "other value", annotations: map[string]string{sourcev1.ForceRefetchAnnotation: "now"},
+			handled: "before", want: true},
+		{name: "reconcile request only", annotations: map[string]string{meta.ReconcileRequestAnnotation: "2021-10-01T10:00:00Z"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			v, got := forceRefetchRequest(obj, tt.handled)
+			if got != tt.want {
+				t.Errorf("forceRefetchRequest() = %v, want %v", got, tt.want)
+			}
+			if v != tt.annotations[sourcev1.ForceRefetchAnnotation] {
+				t.Errorf("forceRefetchRequest() value = %q, want the annotation", v)
+			}
+		})
+	}
+}
+
+func TestForceRefetch(t *testing.T) {
+	if forceRefetch(context.TODO()) {
+		t.Error("forceRefetch() of a context without request = true")
+	}
+	if forceRefetch(withForceRefetch(context.TODO(), false)) {
+		t.Error("forceRefetch() of a context not forced = true")
+	}
+	if !forceRefetch(withForceRefetch(context.TODO(), true)) {
+		t.Error("forceRefetch() of a forced context = false")
+	}
+}
+
+func TestForceRefetchRequestedPredicate(t *testing.T) {
+	annotated := func(annotations map[string]string) client.Object {
+		return &sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+	}
+	tests := []struct {
+		name     string
+		old, new client.Object
+		want     bool
+	}{
+		{name: "added", old: annotated(nil), new: annotated(map[string]string{sourcev1.ForceRefetchAnnotation: "a"}), want: true},
+		{name: "changed", old: annotated(map[string]string{sourcev1.ForceRefetchAnnotation: "a"}),
+			new: annotated(map[string]string{sourcev1.ForceRefetchAnnotation: "b"}), want: true},
+		{name: "unchanged", old: annotated(map[string]string{sourcev1.ForceRefetchAnnotation: "a"}),
+			new: annotated(map[string]string{sourcev1.ForceRefetchAnnotation: "a", "other": "b"}), want: false},
+		{name: "removed", old: annotated(map[string]string{sourcev1.ForceRefetchAnnotation: "a"}), new: annotated(nil), want: false},
+		{name: "missing object", new: annotated(map[string]string{sourcev1.ForceRefetchAnnotation: "a"}), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (ForceRefetchRequestedPredicate{}).Update(event.UpdateEvent{ObjectOld: tt.old, ObjectNew: tt.new}); got != tt.want {
+				t.Errorf("Update() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOCIRepositoryReconciler_forceRefetch(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	// count the pulls of the layers, which are skipped on an unchanged
+	// digest
+	registry := newOCITestRegistry(t)
+	var pulls int32
+	handler := registry.Config.Handler
+	registry.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/blobs/") {
+			atomic.AddInt32(&pulls, 1)
+		}
+		handler.ServeHTTP(w, req)
+	})
+	registry.push(t, "v1.0.0", map[string][]byte{
+		oci.FluxContentMediaType + "0": gzipTarball(t, map[string]string{"deploy.yaml": "v1"}),
+	}, oci.FluxContentMediaType)
+
+	repository := &sourcev1.OCIRepository{
+		TypeMeta: metav1.TypeMeta{Kind: sourcev1.OCIRepositoryKind},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "ocirepository",
+			Namespace:  "default",
+			Finalizers: []string{sourcev1.SourceFinalizer},
+		},
+		Spec: sourcev1.OCIRepositorySpec{
+			URL:       "oci://" + strings.TrimPrefix(registry.URL, "http://") + "/app",
+			Reference: &sourcev1.OCIRepositoryRef{Tag: "v1.0.0"},
+			Insecure:  true,
+			Interval:  metav1.Duration{Duration: time.Minute},
+			Timeout:   &metav1.Duration{Duration: 5 * time.Second},
+		},
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(repository).Build()
+	r := &OCIRepositoryReconciler{Client: c, Scheme: scheme, Storage: storage}
+	key := types.NamespacedName{Name: repository.Name, Namespace: repository.Namespace}
+
+	// reconcile returns the layer pulls of a reconciliation, and the status
+	// of the repository after it
+	reconcile := func(annotations map[string]string) (int32, sourcev1.OCIRepositoryStatus) {
+		t.Helper()
+		var obj sourcev1.OCIRepository
+		if err := c.Get(context.TODO(), key, &obj); err != nil {
+			t.Fatal(err)
+		}
+		if annotations != nil {
+			obj.SetAnnotations(annotations)
+			if err := c.Update(context.TODO(), &obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before := atomic.LoadInt32(&pulls)
+		ctx := logr.NewContext(context.TODO(), logr.Discard())
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+		if err := c.Get(context.TODO(), key, &obj); err != nil {
+			t.Fatal(err)
+		}
+		return atomic.LoadInt32(&pulls) - before, obj.Status
+	}
+
+	if n, _ := reconcile(nil); n == 0 {
+		t.Fatal("first reconciliation pulled no layers")
+	}
+	if n, _ := reconcile(nil); n != 0 {
+		t.Errorf("reconciliation of an unchanged digest pulled %d layers, want none", n)
+	}
+
+	// a force refetch request bypasses the short-circuit once, and is
+	// recorded as handled
+	n, status := reconcile(map[string]string{sourcev1.ForceRefetchAnnotation: "2021-10-01T10:00:00Z"})
+	if n == 0 {
+		t.Error("forced reconciliation pulled no layers")
+	}
+	if status.LastHandledForceRefetchAt != "2021-10-01T10:00:00Z" {
+		t.Errorf("LastHandledForceRefetchAt = %q, want the annotation", status.LastHandledForceRefetchAt)
+	}
+	if n, _ := reconcile(nil); n != 0 {
+		t.Errorf("reconciliation after a handled force refetch pulled %d layers, want none", n)
+	}
+
+	// an older request is not handled again
+	if n, _ := reconcile(map[string]string{sourcev1.ForceRefetchAnnotation: "2021-10-01T09:00:00Z"}); n != 0 {
+		t.Errorf("reconciliation of an older force refetch request pulled %d layers, want none", n)
+	}
+
+	// a force refetch request composes with a reconcile request, which are
+	// both handled by the same reconciliation
+	n, status = reconcile(map[string]string{
+		sourcev1.ForceRefetchAnnotation: "2021-10-01T11:00:00Z",
+		meta.ReconcileRequestAnnotation: "2021-10-01T11:00:00Z",
+	})
+	if n == 0 {
+		t.Error("forced reconciliation with a reconcile request pulled no layers")
+	}
+	if status.LastHandledForceRefetchAt != "2021-10-01T11:00:00Z" || status.GetLastHandledReconcileRequest() != "2021-10-01T11:00:00Z" {
+		t.Errorf("handled requests = %q, %q, want both annotations", status.LastHandledForceRefetchAt, status.GetLastHandledReconcileRequest())
+	}
+
+	// a reconcile request alone does not bypass the short-circuit
+	if n, _ := reconcile(map[string]string{
+		sourcev1.ForceRefetchAnnotation: "2021-10-01T11:00:00Z",
+		meta.ReconcileRequestAnnotation: "2021-10-01T12:00:00Z",
+	}); n != 0 {
+		t.Errorf("reconciliation of a reconcile request pulled %d layers, want none", n)
+	}
+}
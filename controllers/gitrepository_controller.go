@@ -38,7 +38,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/fluxcd/pkg/runtime/events"
@@ -46,6 +49,10 @@ import (
 	"github.com/fluxcd/pkg/runtime/predicates"
 
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/egress"
+	"github.com/fluxcd/source-controller/internal/redact"
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
 	"github.com/fluxcd/source-controller/pkg/git"
 	"github.com/fluxcd/source-controller/pkg/git/strategy"
 	"github.com/fluxcd/source-controller/pkg/sourceignore"
@@ -55,6 +62,7 @@ import (
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=gitrepositories/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=gitrepositories/finalizers,verbs=get;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
 
 // GitRepositoryReconciler reconciles a GitRepository object
 type GitRepositoryReconciler struct {
@@ -64,12 +72,29 @@ type GitRepositoryReconciler struct {
 	Storage               *Storage
 	EventRecorder         kuberecorder.EventRecorder
 	ExternalEventRecorder *events.Recorder
+	EventLimiter          *EventLimiter
+	FetchMetrics          *FetchMetrics
 	MetricsRecorder       *metrics.Recorder
+	retryLimiter          *RetryLimiter
+	intervalJitter        *IntervalJitter
+	validator             *SourceValidator
+	defaults              *SourceDefaults
+	reconcileTracer       *ReconcileTracer
 }
 
 type GitRepositoryReconcilerOptions struct {
 	MaxConcurrentReconciles   int
 	DependencyRequeueInterval time.Duration
+	MinRetryDelay             time.Duration
+	MaxRetryDelay             time.Duration
+	Drainer                   *Drainer
+	IntervalJitter            *IntervalJitter
+	ReconcileTracker          *ReconcileTracker
+	Validator                 *SourceValidator
+	Defaults                  *SourceDefaults
+	ReconcileTracer           *ReconcileTracer
+	ReconcileSpans            *ReconcileSpans
+	NamespaceLimiter          *NamespaceLimiter
 }
 
 func (r *GitRepositoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -77,18 +102,58 @@ func (r *GitRepositoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
 }
 
 func (r *GitRepositoryReconciler) SetupWithManagerAndOptions(mgr ctrl.Manager, opts GitRepositoryReconcilerOptions) error {
+	r.retryLimiter = NewRetryLimiter(opts.MinRetryDelay, opts.MaxRetryDelay)
+	r.intervalJitter = opts.IntervalJitter
+	r.validator = opts.Validator
+	r.defaults = opts.Defaults
+	r.reconcileTracer = opts.ReconcileTracer
 	r.requeueDependency = opts.DependencyRequeueInterval
 
+	if err := mgr.GetCache().IndexField(context.TODO(), &sourcev1.GitRepository{}, sourcev1.SecretIndexKey,
+		indexBySecretRefs); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+	if err := mgr.GetCache().IndexField(context.TODO(), &sourcev1.GitRepository{}, sourcev1.ConfigMapIndexKey,
+		indexByConfigMapRefs); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+
+	recordMaxConcurrentReconciles(sourcev1.GitRepositoryKind, opts.MaxConcurrentReconciles)
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&sourcev1.GitRepository{}, builder.WithPredicates(
-			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}),
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}, ForceRefetchRequestedPredicate{}),
 		)).
-		WithOptions(controller.Options{MaxConcurrentReconciles: opts.MaxConcurrentReconciles}).
-		Complete(r)
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSecretChange),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForConfigMapChange),
+		).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: opts.MaxConcurrentReconciles,
+			RateLimiter:             r.retryLimiter.rateLimiter(),
+		}).
+		Complete(opts.Drainer.Reconciler(opts.NamespaceLimiter.Reconciler(sourcev1.GitRepositoryKind,
+			opts.ReconcileSpans.Reconciler(sourcev1.GitRepositoryKind,
+				opts.ReconcileTracker.Reconciler(sourcev1.GitRepositoryKind, r)))))
+}
+
+// requestsForSecretChange returns the reconcile requests for the GitRepository objects that reference the given Secret.
+func (r *GitRepositoryReconciler) requestsForSecretChange(o client.Object) []reconcile.Request {
+	return requestsForSecretChange(r, &sourcev1.GitRepositoryList{}, o)
+}
+
+// requestsForConfigMapChange returns the reconcile requests for the GitRepository objects that reference the given ConfigMap.
+func (r *GitRepositoryReconciler) requestsForConfigMapChange(o client.Object) []reconcile.Request {
+	return requestsForConfigMapChange(r, &sourcev1.GitRepositoryList{}, o)
 }
 
-func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, retErr error) {
 	start := time.Now()
+	// redact the credentials from the error logged by the controller
+	defer func() { retErr = redact.Error(retErr) }()
 	log := logr.FromContext(ctx)
 
 	var repository sourcev1.GitRepository
@@ -99,6 +164,11 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	// Record suspended status metric
 	defer r.recordSuspension(ctx, repository)
 
+	// Record the artifact URLs advertised in the status, to map the errors
+	// of the artifact server back to the object, and the size of the artifact
+	advertiseArtifact(sourcev1.GitRepositoryKind, &repository)
+	recordArtifactSize(sourcev1.GitRepositoryKind, &repository)
+
 	// Add our finalizer if it does not exist
 	if !controllerutil.ContainsFinalizer(&repository, sourcev1.SourceFinalizer) {
 		controllerutil.AddFinalizer(&repository, sourcev1.SourceFinalizer)
@@ -110,6 +180,9 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 	// Examine if the object is under deletion
 	if !repository.ObjectMeta.DeletionTimestamp.IsZero() {
+		forgetReconciledSource(sourcev1.GitRepositoryKind, req.NamespacedName)
+		r.FetchMetrics.forget(sourcev1.GitRepositoryKind, &repository)
+		setReconcilePhase(ctx, reconcilePhaseDeleting)
 		return r.reconcileDelete(ctx, repository)
 	}
 
@@ -119,6 +192,32 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{}, nil
 	}
 
+	// apply the default interval and timeout of the controller, if the spec
+	// omits them
+	r.defaults.apply(&repository)
+
+	// stagger the first reconciliations of the sources that are up to date
+	// after the start of the controller
+	upToDate := sourceUpToDate(&repository, repository.Status.ObservedGeneration,
+		repository.Status.GetLastHandledReconcileRequest(), repository.Status.Conditions)
+	if delay := r.intervalJitter.startupDelay(sourcev1.GitRepositoryKind, req.NamespacedName, upToDate, repository.GetInterval().Duration); delay > 0 {
+		log.Info(fmt.Sprintf("Delaying the first reconciliation by %s", delay.String()))
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	recordReconcileStart(sourcev1.GitRepositoryKind, start, repository.GetInterval().Duration)
+	ctx = r.reconcileTracer.start(ctx, start)
+
+	// cap the backoff of failed reconciliations at the retry interval
+	r.retryLimiter.setMaxDelay(req, repository.Spec.RetryInterval)
+
+	// record the duration and result of the reconciliation
+	reconciled := &repository
+	defer func() {
+		recordReconcile(sourcev1.GitRepositoryKind, reconciled, start, retErr)
+		advertiseArtifact(sourcev1.GitRepositoryKind, reconciled)
+		recordArtifactSize(sourcev1.GitRepositoryKind, reconciled)
+	}()
+
 	// check dependencies
 	if len(repository.Spec.Include) > 0 {
 		if err := r.checkDependencies(repository); err != nil {
@@ -131,7 +230,7 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			// instead we requeue on a fix interval.
 			msg := fmt.Sprintf("Dependencies do not meet ready condition, retrying in %s", r.requeueDependency.String())
 			log.Info(msg)
-			r.event(ctx, repository, events.EventSeverityInfo, msg)
+			r.event(ctx, repository, events.EventSeverityInfo, msg, nil)
 			r.recordReadiness(ctx, repository)
 			return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
 		}
@@ -147,16 +246,30 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		defer r.MetricsRecorder.RecordDuration(*objRef, start)
 	}
 
-	// set initial status
-	if resetRepository, ok := r.resetStatus(repository); ok {
-		repository = resetRepository
-		if err := r.updateStatus(ctx, req, repository.Status); err != nil {
+	// stall the repository if its spec is invalid, e.g. it was created before
+	// the validation webhook was enabled, until it is corrected
+	if err := r.validator.validate(&repository); err != nil {
+		stalledRepository := sourcev1.GitRepositoryStalled(*repository.DeepCopy(), sourcev1.SpecInvalidReason, err.Error())
+		stalledRepository.Status.ObservedGeneration = stalledRepository.Generation
+		stalledRepository.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, stalledRepository.Status.Conditions, nil)
+		reconciled = &stalledRepository
+		if err := r.updateStatus(ctx, req, stalledRepository.Status); err != nil {
 			log.Error(err, "unable to update status")
 			return ctrl.Result{Requeue: true}, err
 		}
-		r.recordReadiness(ctx, repository)
+		r.event(ctx, stalledRepository, events.EventSeverityError, err.Error(), nil)
+		r.recordReadiness(ctx, stalledRepository)
+		return ctrl.Result{}, nil
 	}
 
+	// set initial status
+	repository, _ = r.resetStatus(repository)
+	if err := r.updateStatus(ctx, req, repository.Status); err != nil {
+		log.Error(err, "unable to update status")
+		return ctrl.Result{Requeue: true}, err
+	}
+	r.recordReadiness(ctx, repository)
+
 	// record the value of the reconciliation request, if any
 	// TODO(hidde): would be better to defer this in combination with
 	//   always patching the status sub-resource after a reconciliation.
@@ -165,38 +278,115 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	}
 
 	// purge old artifacts from storage
+	tracePhase(ctx, tracePhaseGC)
 	if err := r.gc(repository); err != nil {
 		log.Error(err, "unable to purge old artifacts")
 	}
 
+	// bypass the caches if the repository was annotated with a force
+	// refetch request newer than the handled one
+	refetch, force := forceRefetchRequest(&repository, repository.Status.LastHandledForceRefetchAt)
+
 	// reconcile repository by pulling the latest Git commit
-	reconciledRepository, reconcileErr := r.reconcile(ctx, *repository.DeepCopy())
+	setReconcilePhase(ctx, reconcilePhaseFetching)
+	fetchCtx, rateLimits := transport.WithRateLimits(ctx)
+	reconciledRepository, reconcileErr := r.reconcile(withForceRefetch(fetchCtx, force), *repository.DeepCopy())
+	reconciled = &reconciledRepository
+	if force && reconcileErr == nil {
+		reconciledRepository.Status.LastHandledForceRefetchAt = refetch
+	}
+
+	// delay the retry until the reset of the rate limit of the upstream, if
+	// the reconciliation was rejected by it
+	reconcileErr = recordUpstreamRateLimit(ctx, r.retryLimiter, req, sourcev1.GitRepositoryKind, &repository,
+		upstreamURL(&repository), rateLimits, reconcileErr)
+
+	// stall the repository on a connection denied by the egress policy, as
+	// retrying does not resolve it
+	if egress.IsDenied(reconcileErr) {
+		reconciledRepository = sourcev1.GitRepositoryStalled(reconciledRepository, sourcev1.EgressDeniedReason, reconcileErr.Error())
+	}
+
+	// record the Git transport used for the reconciliation attempt
+	transport, err := strategy.TransportForURL(repository.Spec.URL, git.CheckoutOptions{
+		GitImplementation: repository.GetGitImplementation(),
+	})
+	if err != nil {
+		log.Error(redact.Error(err), "unable to determine Git transport")
+	} else if reconcileErr != nil {
+		reconciledRepository.Status.LastFailedTransport = transport
+	} else {
+		reconciledRepository.Status.LastSucceededTransport = transport
+	}
+
+	// record the artifact written by the reconciliation as in the storage
+	r.Storage.recordArtifactInStorage(&reconciledRepository.Status.Conditions, reconciledRepository.Generation,
+		repository.GetArtifact(), reconciledRepository.GetArtifact())
+
+	// record the failures to fetch the upstream
+	r.FetchMetrics.record(sourcev1.GitRepositoryKind, &reconciledRepository, reconciledRepository.Status.Conditions, reconcileErr)
+
+	// record the time of the next retry of a failed reconciliation
+	reconciledRepository.Status.NextRetryTime = r.retryLimiter.nextRetryTime(req, reconcileErr, reconciledRepository.Status.Conditions)
+
+	// record the trace of the reconciliation, and the revision of its span
+	reconciledRepository.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, reconciledRepository.Status.Conditions, reconcileErr)
+	spanRevision(ctx, reconciledRepository.GetArtifact())
 
 	// update status with the reconciliation result
+	setReconcilePhase(ctx, reconcilePhaseUpdatingStatus)
 	if err := r.updateStatus(ctx, req, reconciledRepository.Status); err != nil {
 		log.Error(err, "unable to update status")
 		return ctrl.Result{Requeue: true}, err
 	}
 
+	// if the artifact exceeds the maximum size, record the failure and
+	// requeue at the interval, as retrying does not resolve it
+	if reconcileErr != nil && apimeta.IsStatusConditionTrue(reconciledRepository.Status.Conditions, meta.StalledCondition) {
+		r.event(ctx, reconciledRepository, events.EventSeverityError, reconcileErr.Error(), transportMetadata(transport))
+		r.recordReadiness(ctx, reconciledRepository)
+		if reconcileRequestPending(ctx, r, &reconciledRepository, reconciledRepository.Status.GetLastHandledReconcileRequest()) {
+			return ctrl.Result{Requeue: true}, reconcileErr
+		}
+		return ctrl.Result{RequeueAfter: r.intervalJitter.interval(repository.GetInterval().Duration)}, nil
+	}
+
 	// if reconciliation failed, record the failure and requeue immediately
 	if reconcileErr != nil {
-		r.event(ctx, reconciledRepository, events.EventSeverityError, reconcileErr.Error())
+		r.event(ctx, reconciledRepository, events.EventSeverityError, reconcileErr.Error(), transportMetadata(transport))
 		r.recordReadiness(ctx, reconciledRepository)
+		if next := reconciledRepository.Status.NextRetryTime; next != nil {
+			log.Info(fmt.Sprintf("Reconciliation failed, retrying at %s", next.Format(time.RFC3339)))
+		}
 		return ctrl.Result{Requeue: true}, reconcileErr
 	}
 
-	// emit revision change event
+	// emit revision change event and purge the previous artifacts
 	if repository.Status.Artifact == nil || reconciledRepository.Status.Artifact.Revision != repository.Status.Artifact.Revision {
-		r.event(ctx, reconciledRepository, events.EventSeverityInfo, sourcev1.GitRepositoryReadyMessage(reconciledRepository))
+		metadata := mergeMetadata(transportMetadata(transport),
+			r.Storage.artifactMetadata(reconciledRepository.GetArtifact(), upstreamURL(&reconciledRepository)))
+		r.event(ctx, reconciledRepository, events.EventSeverityInfo, sourcev1.GitRepositoryReadyMessage(reconciledRepository), metadata)
+		if err := r.gc(reconciledRepository); err != nil {
+			log.Error(err, "unable to purge old artifacts")
+		}
 	}
 	r.recordReadiness(ctx, reconciledRepository)
 
+	// shift the next run by a jitter, for the sources to drift apart
+	interval := r.intervalJitter.interval(repository.GetInterval().Duration)
 	log.Info(fmt.Sprintf("Reconciliation finished in %s, next run in %s",
 		time.Now().Sub(start).String(),
-		repository.GetInterval().Duration.String(),
+		interval.String(),
 	))
 
-	return ctrl.Result{RequeueAfter: repository.GetInterval().Duration}, nil
+	// reconcile again right away if the object was annotated with a
+	// reconcile request during the reconciliation, as it is not handled
+	if reconcileRequestPending(ctx, r, &reconciledRepository, reconciledRepository.Status.GetLastHandledReconcileRequest()) {
+		log.Info("Reconcile request received during the reconciliation, reconciling again")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: interval}, nil
 }
 
 func (r *GitRepositoryReconciler) checkDependencies(repository sourcev1.GitRepository) error {
@@ -230,12 +420,13 @@ func (r *GitRepositoryReconciler) reconcile(ctx context.Context, repository sour
 	defer os.RemoveAll(tmpGit)
 
 	// determine auth method
+	tracePhase(ctx, tracePhaseAuth)
 	auth := &git.Auth{}
 	if repository.Spec.SecretRef != nil {
 		authStrategy, err := strategy.AuthSecretStrategyForURL(
 			repository.Spec.URL,
 			git.CheckoutOptions{
-				GitImplementation: repository.Spec.GitImplementation,
+				GitImplementation: repository.GetGitImplementation(),
 				RecurseSubmodules: repository.Spec.RecurseSubmodules,
 			})
 		if err != nil {
@@ -253,6 +444,10 @@ func (r *GitRepositoryReconciler) reconcile(ctx context.Context, repository sour
 			err = fmt.Errorf("auth secret error: %w", err)
 			return sourcev1.GitRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
 		}
+		secret, warnings := secretdata.Correct(secret)
+		for _, w := range warnings {
+			r.event(ctx, repository, events.EventSeverityError, w, nil)
+		}
 
 		auth, err = authStrategy.Method(secret)
 		if err != nil {
@@ -260,12 +455,52 @@ func (r *GitRepositoryReconciler) reconcile(ctx context.Context, repository sour
 			return sourcev1.GitRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
 		}
 	}
+	auth.ServerName = repository.Spec.ServerName
+	proxy, warnings, err := proxyFromSecretRef(ctx, r.Client, repository.GetNamespace(), repository.Spec.ProxySecretRef)
+	for _, w := range warnings {
+		r.event(ctx, repository, events.EventSeverityError, w, nil)
+	}
+	if err != nil {
+		return sourcev1.GitRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+	}
+	auth.Proxy = proxy
+	caBundle, err := caBundleFromRef(ctx, r.Client, repository.GetNamespace(), repository.Spec.CARef)
+	if err != nil {
+		return sourcev1.GitRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+	}
+	auth.CABundle = appendCABundle(auth.CABundle, caBundle)
 
+	// the credentials of the submodules of other hosts, if any
+	for _, ref := range repository.Spec.SubmoduleSecretRefs {
+		name := types.NamespacedName{
+			Namespace: repository.GetNamespace(),
+			Name:      ref.SecretRef.Name,
+		}
+		var secret corev1.Secret
+		if err := r.Client.Get(ctx, name, &secret); err != nil {
+			err = fmt.Errorf("submodule auth secret error for host '%s': %w", ref.Host, err)
+			return sourcev1.GitRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+		}
+		secret, warnings := secretdata.Correct(secret)
+		for _, w := range warnings {
+			r.event(ctx, repository, events.EventSeverityError, w, nil)
+		}
+		if auth.SubmoduleSecrets == nil {
+			auth.SubmoduleSecrets = make(map[string]corev1.Secret, len(repository.Spec.SubmoduleSecretRefs))
+		}
+		auth.SubmoduleSecrets[ref.Host] = secret
+	}
+
+	tracePhase(ctx, tracePhaseFetch)
 	checkoutStrategy, err := strategy.CheckoutStrategyForRef(
 		repository.Spec.Reference,
 		git.CheckoutOptions{
-			GitImplementation: repository.Spec.GitImplementation,
+			GitImplementation: repository.GetGitImplementation(),
 			RecurseSubmodules: repository.Spec.RecurseSubmodules,
+			SubmoduleDepth:    repository.Spec.SubmoduleDepth,
+			SparseCheckout:    repository.Spec.SparseCheckout,
+			Depth:             repository.Spec.Depth,
+			AllBranches:       repository.Spec.AllBranches,
 		},
 	)
 	if err != nil {
@@ -275,12 +510,47 @@ func (r *GitRepositoryReconciler) reconcile(ctx context.Context, repository sour
 	gitCtx, cancel := context.WithTimeout(ctx, repository.Spec.Timeout.Duration)
 	defer cancel()
 
+	// check the URL against the egress policy before the checkout, the
+	// connections of libgit2 and of SSH are not dialed by the controller: for
+	// them it is a one-time check, which DNS rebinding and the redirects of
+	// libgit2 bypass
+	if err := egress.CurrentPolicy().CheckURL(gitCtx, repository.Spec.URL); err != nil {
+		return sourcev1.GitRepositoryNotReady(repository, sourcev1.EgressDeniedReason, err.Error()), err
+	}
+
 	commit, revision, err := checkoutStrategy.Checkout(gitCtx, tmpGit, repository.Spec.URL, auth)
 	if err != nil {
 		return sourcev1.GitRepositoryNotReady(repository, sourcev1.GitOperationFailedReason, err.Error()), err
 	}
+	tracePhaseDetail(ctx, "revision %s", revision)
+
+	// verify the PGP signature before the early return on an unchanged
+	// revision, for a revoked key to take effect
+	if repository.Spec.Verification != nil {
+		tracePhase(ctx, tracePhaseVerify)
+		publicKeySecret := types.NamespacedName{
+			Namespace: repository.Namespace,
+			Name:      repository.Spec.Verification.SecretRef.Name,
+		}
+		var secret corev1.Secret
+		if err := r.Client.Get(ctx, publicKeySecret, &secret); err != nil {
+			err = fmt.Errorf("PGP public keys secret error: %w", err)
+			return sourcev1.GitRepositoryNotVerified(repository, err.Error()), err
+		}
+
+		message := fmt.Sprintf("Verified signature of commit '%s'", commit.Hash())
+		verify := commit.Verify
+		if repository.Spec.Verification.Mode == sourcev1.GitVerificationModeTag {
+			message = fmt.Sprintf("Verified signature of the tag of revision '%s'", revision)
+			verify = commit.VerifyTag
+		}
+		if err := verify(secret); err != nil {
+			return sourcev1.GitRepositoryNotVerified(repository, err.Error()), err
+		}
+		repository = sourcev1.GitRepositoryVerified(repository, message)
+	}
 
-	artifact := r.Storage.NewArtifactFor(repository.Kind, repository.GetObjectMeta(), revision, fmt.Sprintf("%s.tar.gz", commit.Hash()))
+	artifact := r.Storage.NewArtifactFor(repository.Kind, repository.GetObjectMeta(), revision, commit.Hash()+r.Storage.ArchiveExtension())
 
 	// copy all included repository into the artifact
 	includedArtifacts := []*sourcev1.Artifact{}
@@ -294,33 +564,26 @@ func (r *GitRepositoryReconciler) reconcile(ctx context.Context, repository sour
 		includedArtifacts = append(includedArtifacts, gr.GetArtifact())
 	}
 
-	// return early on unchanged revision and unchanged included repositories
-	if apimeta.IsStatusConditionTrue(repository.Status.Conditions, meta.ReadyCondition) && repository.GetArtifact().HasRevision(artifact.Revision) && !hasArtifactUpdated(repository.Status.IncludedArtifacts, includedArtifacts) {
-		if artifact.URL != repository.GetArtifact().URL {
+	// return early on unchanged revision and unchanged included repositories,
+	// unless forced to refetch
+	if !forceRefetch(ctx) && apimeta.IsStatusConditionTrue(repository.Status.Conditions, meta.ReadyCondition) && repository.GetArtifact().HasRevision(artifact.Revision) && !hasArtifactUpdated(repository.Status.IncludedArtifacts, includedArtifacts) {
+		if !r.Storage.currentURL(repository.GetArtifact().URL) {
 			r.Storage.SetArtifactURL(repository.GetArtifact())
 			repository.Status.URL = r.Storage.SetHostname(repository.Status.URL)
+			for _, included := range repository.Status.IncludedArtifacts {
+				r.Storage.SetArtifactURL(included)
+			}
 		}
 		return repository, nil
 	}
 
-	// verify PGP signature
-	if repository.Spec.Verification != nil {
-		publicKeySecret := types.NamespacedName{
-			Namespace: repository.Namespace,
-			Name:      repository.Spec.Verification.SecretRef.Name,
-		}
-		var secret corev1.Secret
-		if err := r.Client.Get(ctx, publicKeySecret, &secret); err != nil {
-			err = fmt.Errorf("PGP public keys secret error: %w", err)
-			return sourcev1.GitRepositoryNotReady(repository, sourcev1.VerificationFailedReason, err.Error()), err
-		}
-
-		err := commit.Verify(secret)
-		if err != nil {
-			return sourcev1.GitRepositoryNotReady(repository, sourcev1.VerificationFailedReason, err.Error()), err
-		}
+	// ensure there is space for the artifact
+	if err := r.storagePruner().ensureSpace(ctx); err != nil {
+		return sourcev1.GitRepositoryNotReady(repository, sourcev1.StorageFullReason, err.Error()), err
 	}
 
+	setReconcilePhase(ctx, reconcilePhaseStoring)
+	tracePhase(ctx, tracePhaseArchive)
 	// create artifact dir
 	err = r.Storage.MkdirAll(artifact)
 	if err != nil {
@@ -357,13 +620,18 @@ func (r *GitRepositoryReconciler) reconcile(ctx context.Context, repository sour
 	if repository.Spec.Ignore != nil {
 		ps = append(ps, sourceignore.ReadPatterns(strings.NewReader(*repository.Spec.Ignore), ignoreDomain)...)
 	}
-	if err := r.Storage.Archive(&artifact, tmpGit, SourceIgnoreFilter(ps, ignoreDomain)); err != nil {
+	storage := r.Storage.WithArtifactMaxSize(repository.Spec.MaxArtifactSize)
+	if err := storage.Archive(&artifact, tmpGit, SourceIgnoreFilter(ps, ignoreDomain)); err != nil {
 		err = fmt.Errorf("storage archive error: %w", err)
-		return sourcev1.GitRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
+		if isArtifactSizeError(err) {
+			return sourcev1.GitRepositoryStalled(repository, sourcev1.ArtifactTooLargeReason, err.Error()), err
+		}
+		return sourcev1.GitRepositoryNotReady(repository, storageFailureReason(err), err.Error()), err
 	}
 
 	// update latest symlink
-	url, err := r.Storage.Symlink(artifact, "latest.tar.gz")
+	tracePhase(ctx, tracePhaseStore)
+	url, err := r.Storage.Symlink(artifact, "latest"+r.Storage.ArchiveExtension())
 	if err != nil {
 		err = fmt.Errorf("storage symlink error: %w", err)
 		return sourcev1.GitRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
@@ -376,7 +644,7 @@ func (r *GitRepositoryReconciler) reconcile(ctx context.Context, repository sour
 func (r *GitRepositoryReconciler) reconcileDelete(ctx context.Context, repository sourcev1.GitRepository) (ctrl.Result, error) {
 	if err := r.gc(repository); err != nil {
 		r.event(ctx, repository, events.EventSeverityError,
-			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()))
+			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()), nil)
 		// Return the error so we retry the failed garbage collection
 		return ctrl.Result{}, err
 	}
@@ -395,55 +663,101 @@ func (r *GitRepositoryReconciler) reconcileDelete(ctx context.Context, repositor
 }
 
 // resetStatus returns a modified v1beta1.GitRepository and a boolean indicating
-// if the status field has been reset.
+// if the status field has been reset. The meta.ReconcilingCondition of a
+// status that is not reset is set, as a reconciliation is under way.
 func (r *GitRepositoryReconciler) resetStatus(repository sourcev1.GitRepository) (sourcev1.GitRepository, bool) {
-	// We do not have an artifact, or it does no longer exist
-	if repository.GetArtifact() == nil || !r.Storage.ArtifactExist(*repository.GetArtifact()) {
+	// verify that the artifact is in the storage and intact
+	inStorage := r.Storage.artifactInStorage(repository.GetArtifact(), repository.Generation)
+	changed := false
+	switch {
+	case inStorage.Status != metav1.ConditionTrue:
+		// We do not have an artifact, or it is missing or corrupt
 		repository = sourcev1.GitRepositoryProgressing(repository)
 		repository.Status.Artifact = nil
-		return repository, true
-	}
-	if repository.Generation != repository.Status.ObservedGeneration {
-		return sourcev1.GitRepositoryProgressing(repository), true
+		changed = true
+	case repository.Generation != repository.Status.ObservedGeneration:
+		repository = sourcev1.GitRepositoryProgressing(repository)
+		changed = true
+	default:
+		repository = sourcev1.GitRepositoryReconciling(repository)
 	}
-	return repository, false
+	return repository, setArtifactInStorage(&repository.Status.Conditions, inStorage) || changed
 }
 
 // gc performs a garbage collection for the given v1beta1.GitRepository.
-// It removes all but the current artifact except for when the
-// deletion timestamp is set, which will result in the removal of
-// all artifacts for the resource.
+// It removes the previous artifacts which exceed the retention of the
+// storage, except for when the deletion timestamp is set, which will
+// result in the removal of all artifacts for the resource.
 func (r *GitRepositoryReconciler) gc(repository sourcev1.GitRepository) error {
 	if !repository.DeletionTimestamp.IsZero() {
-		return r.Storage.RemoveAll(r.Storage.NewArtifactFor(repository.Kind, repository.GetObjectMeta(), "", "*"))
+		return r.Storage.RemoveDeleted(repository.Kind, repository.GetObjectMeta())
 	}
 	if repository.GetArtifact() != nil {
-		return r.Storage.RemoveAllButCurrent(*repository.GetArtifact())
+		_, err := r.Storage.GarbageCollect(*repository.GetArtifact())
+		return err
 	}
 	return nil
 }
 
-// event emits a Kubernetes event and forwards the event to notification controller if configured
-func (r *GitRepositoryReconciler) event(ctx context.Context, repository sourcev1.GitRepository, severity, msg string) {
+// storagePruner returns the pruner of the storage, which emits events with the
+// recorders of the reconciler.
+func (r *GitRepositoryReconciler) storagePruner() *storagePruner {
+	return &storagePruner{
+		Reader:                r.Client,
+		Scheme:                r.Scheme,
+		Storage:               r.Storage,
+		EventRecorder:         r.EventRecorder,
+		ExternalEventRecorder: r.ExternalEventRecorder,
+	}
+}
+
+// event emits a Kubernetes event and forwards the event to notification controller if configured.
+// The given metadata is attached to the events as annotations, and can be nil.
+func (r *GitRepositoryReconciler) event(ctx context.Context, repository sourcev1.GitRepository, severity, msg string, metadata map[string]string) {
 	log := logr.FromContext(ctx)
+	msg = redact.String(msg)
+
+	// Duplicates are recorded as Kubernetes events nonetheless, which bump
+	// the count of the existing event
+	suppressed := r.EventLimiter.suppress(sourcev1.GitRepositoryKind, &repository, severity, msg)
+	if suppressed == eventRateLimitedCause {
+		return
+	}
 
 	if r.EventRecorder != nil {
-		r.EventRecorder.Eventf(&repository, "Normal", severity, msg)
+		if len(metadata) > 0 {
+			r.EventRecorder.AnnotatedEventf(&repository, metadata, "Normal", severity, msg)
+		} else {
+			r.EventRecorder.Eventf(&repository, "Normal", severity, msg)
+		}
 	}
-	if r.ExternalEventRecorder != nil {
+	if r.ExternalEventRecorder != nil && suppressed == "" {
 		objRef, err := reference.GetReference(r.Scheme, &repository)
 		if err != nil {
 			log.Error(err, "unable to send event")
 			return
 		}
 
-		if err := r.ExternalEventRecorder.Eventf(*objRef, nil, severity, severity, msg); err != nil {
+		if err := r.ExternalEventRecorder.Eventf(*objRef, metadata, severity, severity, msg); err != nil {
 			log.Error(err, "unable to send event")
 			return
 		}
 	}
 }
 
+// transportMetadata returns the given v1beta1.GitRepositoryTransport as event
+// metadata, or nil if the transport is nil.
+func transportMetadata(transport *sourcev1.GitRepositoryTransport) map[string]string {
+	if transport == nil {
+		return nil
+	}
+	return map[string]string{
+		"implementation":                transport.Implementation,
+		"scheme":                        transport.Scheme,
+		"implementationProtocolVersion": transport.ImplementationProtocolVersion,
+	}
+}
+
 func (r *GitRepositoryReconciler) recordReadiness(ctx context.Context, repository sourcev1.GitRepository) {
 	log := logr.FromContext(ctx)
 	if r.MetricsRecorder == nil {
@@ -465,6 +779,14 @@ func (r *GitRepositoryReconciler) recordReadiness(ctx context.Context, repositor
 }
 
 func (r *GitRepositoryReconciler) recordSuspension(ctx context.Context, gitrepository sourcev1.GitRepository) {
+	name := types.NamespacedName{Namespace: gitrepository.Namespace, Name: gitrepository.Name}
+	if !gitrepository.DeletionTimestamp.IsZero() {
+		forgetSuspendStatus(r.MetricsRecorder, sourcev1.GitRepositoryKind, name)
+		return
+	}
+	if recordSuspend(sourcev1.GitRepositoryKind, name, gitrepository.Spec.Suspend) {
+		r.event(ctx, gitrepository, events.EventSeverityInfo, suspendMessage(gitrepository.Spec.Suspend), nil)
+	}
 	if r.MetricsRecorder == nil {
 		return
 	}
@@ -476,14 +798,12 @@ func (r *GitRepositoryReconciler) recordSuspension(ctx context.Context, gitrepos
 		return
 	}
 
-	if !gitrepository.DeletionTimestamp.IsZero() {
-		r.MetricsRecorder.RecordSuspend(*objRef, false)
-	} else {
-		r.MetricsRecorder.RecordSuspend(*objRef, gitrepository.Spec.Suspend)
-	}
+	r.MetricsRecorder.RecordSuspend(*objRef, gitrepository.Spec.Suspend)
 }
 
 func (r *GitRepositoryReconciler) updateStatus(ctx context.Context, req ctrl.Request, newStatus sourcev1.GitRepositoryStatus) error {
+	redact.Conditions(newStatus.Conditions)
+
 	var repository sourcev1.GitRepository
 	if err := r.Get(ctx, req.NamespacedName, &repository); err != nil {
 		return err
@@ -45,6 +45,7 @@ import (
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
@@ -546,6 +547,103 @@ var _ = Describe("GitRepositoryReconciler", func() {
 			})
 		})
 
+		Context("referenced secret", func() {
+			It("reconciles when the secret changes", func() {
+				Expect(gitServer.Auth("git", "password").StartHTTP()).To(Succeed())
+				defer gitServer.StopHTTP()
+
+				repoPath := fmt.Sprintf("repository-%s.git", randStringRunes(5))
+				u, err := url.Parse(gitServer.HTTPAddressWithCredentials())
+				Expect(err).NotTo(HaveOccurred())
+				u.Path = path.Join(u.Path, repoPath)
+
+				fs := memfs.New()
+				gitrepo, err := git.Init(memory.NewStorage(), fs)
+				Expect(err).NotTo(HaveOccurred())
+
+				wt, err := gitrepo.Worktree()
+				Expect(err).NotTo(HaveOccurred())
+
+				ff, _ := fs.Create("fixture")
+				_ = ff.Close()
+				_, err = wt.Add(fs.Join("fixture"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = wt.Commit("Sample", &git.CommitOptions{Author: &object.Signature{
+					Name:  "John Doe",
+					Email: "john@example.com",
+					When:  time.Now(),
+				}})
+				Expect(err).NotTo(HaveOccurred())
+
+				remote, err := gitrepo.CreateRemote(&config.RemoteConfig{
+					Name: "origin",
+					URLs: []string{u.String()},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				err = remote.Push(&git.PushOptions{
+					RefSpecs: []config.RefSpec{"refs/heads/*:refs/heads/*"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				auth := &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "basic-auth",
+						Namespace: namespace.Name,
+					},
+					Data: map[string][]byte{
+						"username": []byte("git"),
+						"password": []byte("password"),
+					},
+				}
+				Expect(k8sClient.Create(context.Background(), auth)).To(Succeed())
+
+				key := types.NamespacedName{
+					Name:      fmt.Sprintf("git-secret-test-%s", randStringRunes(5)),
+					Namespace: namespace.Name,
+				}
+				// An interval longer than the test, the reconciliations are
+				// triggered by the changes of the secret
+				created := &sourcev1.GitRepository{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      key.Name,
+						Namespace: key.Namespace,
+					},
+					Spec: sourcev1.GitRepositorySpec{
+						URL:       gitServer.HTTPAddress() + "/" + repoPath,
+						Interval:  metav1.Duration{Duration: time.Hour},
+						Reference: &sourcev1.GitRepositoryRef{Branch: "master"},
+						SecretRef: &meta.LocalObjectReference{Name: auth.Name},
+					},
+				}
+				Expect(k8sClient.Create(context.Background(), created)).To(Succeed())
+				defer k8sClient.Delete(context.Background(), created)
+
+				readyStatus := func() metav1.ConditionStatus {
+					got := &sourcev1.GitRepository{}
+					if err := k8sClient.Get(context.Background(), key, got); err != nil {
+						return metav1.ConditionUnknown
+					}
+					if c := apimeta.FindStatusCondition(got.Status.Conditions, meta.ReadyCondition); c != nil {
+						return c.Status
+					}
+					return metav1.ConditionUnknown
+				}
+				Eventually(readyStatus, timeout, interval).Should(Equal(metav1.ConditionTrue))
+
+				By("Rotating the password of the secret")
+				auth.Data["password"] = []byte("rotated")
+				Expect(k8sClient.Update(context.Background(), auth)).To(Succeed())
+				Eventually(readyStatus, timeout, interval).Should(Equal(metav1.ConditionFalse))
+
+				By("Restoring the password of the secret")
+				auth.Data["password"] = []byte("password")
+				Expect(k8sClient.Update(context.Background(), auth)).To(Succeed())
+				Eventually(readyStatus, timeout, interval).Should(Equal(metav1.ConditionTrue))
+			})
+		})
+
 		type includeTestCase struct {
 			fromPath    string
 			toPath      string
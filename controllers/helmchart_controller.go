@@ -17,7 +17,10 @@ limitations under the License.
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -29,10 +32,10 @@ import (
 
 	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/go-logr/logr"
-	helmchart "helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
 	corev1 "k8s.io/api/core/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -56,10 +59,14 @@ import (
 	"github.com/fluxcd/pkg/runtime/metrics"
 	"github.com/fluxcd/pkg/runtime/predicates"
 	"github.com/fluxcd/pkg/runtime/transform"
-	"github.com/fluxcd/pkg/untar"
 
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/egress"
 	"github.com/fluxcd/source-controller/internal/helm"
+	"github.com/fluxcd/source-controller/internal/redact"
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
+	"github.com/fluxcd/source-controller/pkg/oci"
 )
 
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=helmcharts,verbs=get;list;watch;create;update;patch;delete
@@ -75,7 +82,27 @@ type HelmChartReconciler struct {
 	Getters               getter.Providers
 	EventRecorder         kuberecorder.EventRecorder
 	ExternalEventRecorder *events.Recorder
+	EventLimiter          *EventLimiter
+	FetchMetrics          *FetchMetrics
 	MetricsRecorder       *metrics.Recorder
+	IndexCache            *IndexCache
+	// KeylessRoots are the trusted roots of the certificates of the keyless
+	// signatures of the charts, keyless verification fails if nil.
+	KeylessRoots *x509.CertPool
+	// RekorKeys are the public keys of the Rekor transparency logs of the
+	// keyless signatures, in addition to the pinned key of the public log.
+	RekorKeys *oci.RekorKeys
+	// Mirrors are the mirrors of the registries through which the charts of
+	// the OCI HelmRepositories are pulled, if any.
+	Mirrors *oci.Mirrors
+	// MirrorFallback enables pulling a chart from the registry of its
+	// HelmRepository when the mirror of the registry misses it.
+	MirrorFallback  bool
+	retryLimiter    *RetryLimiter
+	intervalJitter  *IntervalJitter
+	validator       *SourceValidator
+	defaults        *SourceDefaults
+	reconcileTracer *ReconcileTracer
 }
 
 func (r *HelmChartReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -83,6 +110,11 @@ func (r *HelmChartReconciler) SetupWithManager(mgr ctrl.Manager) error {
 }
 
 func (r *HelmChartReconciler) SetupWithManagerAndOptions(mgr ctrl.Manager, opts HelmChartReconcilerOptions) error {
+	r.retryLimiter = NewRetryLimiter(opts.MinRetryDelay, opts.MaxRetryDelay)
+	r.intervalJitter = opts.IntervalJitter
+	r.validator = opts.Validator
+	r.defaults = opts.Defaults
+	r.reconcileTracer = opts.ReconcileTracer
 	if err := mgr.GetCache().IndexField(context.TODO(), &sourcev1.HelmRepository{}, sourcev1.HelmRepositoryURLIndexKey,
 		r.indexHelmRepositoryByURL); err != nil {
 		return fmt.Errorf("failed setting index fields: %w", err)
@@ -92,9 +124,11 @@ func (r *HelmChartReconciler) SetupWithManagerAndOptions(mgr ctrl.Manager, opts
 		return fmt.Errorf("failed setting index fields: %w", err)
 	}
 
+	recordMaxConcurrentReconciles(sourcev1.HelmChartKind, opts.MaxConcurrentReconciles)
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&sourcev1.HelmChart{}, builder.WithPredicates(
-			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}),
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}, ForceRefetchRequestedPredicate{},
+				VersionBumpRequestedPredicate{}),
 		)).
 		Watches(
 			&source.Kind{Type: &sourcev1.HelmRepository{}},
@@ -111,12 +145,23 @@ func (r *HelmChartReconciler) SetupWithManagerAndOptions(mgr ctrl.Manager, opts
 			handler.EnqueueRequestsFromMapFunc(r.requestsForBucketChange),
 			builder.WithPredicates(SourceRevisionChangePredicate{}),
 		).
-		WithOptions(controller.Options{MaxConcurrentReconciles: opts.MaxConcurrentReconciles}).
-		Complete(r)
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSecretChange),
+		).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: opts.MaxConcurrentReconciles,
+			RateLimiter:             r.retryLimiter.rateLimiter(),
+		}).
+		Complete(opts.Drainer.Reconciler(opts.NamespaceLimiter.Reconciler(sourcev1.HelmChartKind,
+			opts.ReconcileSpans.Reconciler(sourcev1.HelmChartKind,
+				opts.ReconcileTracker.Reconciler(sourcev1.HelmChartKind, r)))))
 }
 
-func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, retErr error) {
 	start := time.Now()
+	// redact the credentials from the error logged by the controller
+	defer func() { retErr = redact.Error(retErr) }()
 	log := logr.FromContext(ctx)
 
 	var chart sourcev1.HelmChart
@@ -127,6 +172,11 @@ func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	// Record suspended status metric
 	defer r.recordSuspension(ctx, chart)
 
+	// Record the artifact URLs advertised in the status, to map the errors
+	// of the artifact server back to the object, and the size of the artifact
+	advertiseArtifact(sourcev1.HelmChartKind, &chart)
+	recordArtifactSize(sourcev1.HelmChartKind, &chart)
+
 	// Add our finalizer if it does not exist
 	if !controllerutil.ContainsFinalizer(&chart, sourcev1.SourceFinalizer) {
 		controllerutil.AddFinalizer(&chart, sourcev1.SourceFinalizer)
@@ -138,6 +188,9 @@ func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 
 	// Examine if the object is under deletion
 	if !chart.ObjectMeta.DeletionTimestamp.IsZero() {
+		forgetReconciledSource(sourcev1.HelmChartKind, req.NamespacedName)
+		r.FetchMetrics.forget(sourcev1.HelmChartKind, &chart)
+		setReconcilePhase(ctx, reconcilePhaseDeleting)
 		return r.reconcileDelete(ctx, chart)
 	}
 
@@ -147,6 +200,32 @@ func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, nil
 	}
 
+	// apply the default interval and timeout of the controller, if the spec
+	// omits them
+	r.defaults.apply(&chart)
+
+	// Stagger the first reconciliations of the sources that are up to date
+	// after the start of the controller
+	upToDate := sourceUpToDate(&chart, chart.Status.ObservedGeneration,
+		chart.Status.GetLastHandledReconcileRequest(), chart.Status.Conditions)
+	if delay := r.intervalJitter.startupDelay(sourcev1.HelmChartKind, req.NamespacedName, upToDate, chart.GetInterval().Duration); delay > 0 {
+		log.Info(fmt.Sprintf("Delaying the first reconciliation by %s", delay.String()))
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	recordReconcileStart(sourcev1.HelmChartKind, start, chart.GetInterval().Duration)
+	ctx = r.reconcileTracer.start(ctx, start)
+
+	// cap the backoff of failed reconciliations at the retry interval
+	r.retryLimiter.setMaxDelay(req, chart.Spec.RetryInterval)
+
+	// Record the duration and result of the reconciliation
+	reconciled := &chart
+	defer func() {
+		recordReconcile(sourcev1.HelmChartKind, reconciled, start, retErr)
+		advertiseArtifact(sourcev1.HelmChartKind, reconciled)
+		recordArtifactSize(sourcev1.HelmChartKind, reconciled)
+	}()
+
 	// Record reconciliation duration
 	if r.MetricsRecorder != nil {
 		objRef, err := reference.GetReference(r.Scheme, &chart)
@@ -156,16 +235,29 @@ func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		defer r.MetricsRecorder.RecordDuration(*objRef, start)
 	}
 
-	// Conditionally set progressing condition in status
-	resetChart, changed := r.resetStatus(chart)
-	if changed {
-		chart = resetChart
-		if err := r.updateStatus(ctx, req, chart.Status); err != nil {
+	// Stall the chart if its spec is invalid, e.g. it was created before
+	// the validation webhook was enabled, until it is corrected
+	if err := r.validator.validate(&chart); err != nil {
+		stalledChart := sourcev1.HelmChartStalled(*chart.DeepCopy(), sourcev1.SpecInvalidReason, err.Error())
+		stalledChart.Status.ObservedGeneration = stalledChart.Generation
+		stalledChart.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, stalledChart.Status.Conditions, nil)
+		reconciled = &stalledChart
+		if err := r.updateStatus(ctx, req, stalledChart.Status); err != nil {
 			log.Error(err, "unable to update status")
 			return ctrl.Result{Requeue: true}, err
 		}
-		r.recordReadiness(ctx, chart)
+		r.event(ctx, stalledChart, events.EventSeverityError, err.Error(), nil)
+		r.recordReadiness(ctx, stalledChart)
+		return ctrl.Result{}, nil
+	}
+
+	// Conditionally set progressing condition in status
+	chart, changed := r.resetStatus(chart)
+	if err := r.updateStatus(ctx, req, chart.Status); err != nil {
+		log.Error(err, "unable to update status")
+		return ctrl.Result{Requeue: true}, err
 	}
+	r.recordReadiness(ctx, chart)
 
 	// Record the value of the reconciliation request, if any
 	// TODO(hidde): would be better to defer this in combination with
@@ -175,6 +267,7 @@ func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	}
 
 	// Purge all but current artifact from storage
+	tracePhase(ctx, tracePhaseGC)
 	if err := r.gc(chart); err != nil {
 		log.Error(err, "unable to purge old artifacts")
 	}
@@ -183,17 +276,22 @@ func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	source, err := r.getSource(ctx, chart)
 	if err != nil {
 		chart = sourcev1.HelmChartNotReady(*chart.DeepCopy(), sourcev1.ChartPullFailedReason, err.Error())
+		chart.Status.NextRetryTime = r.retryLimiter.nextRetryTime(req, err, chart.Status.Conditions)
+		chart.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, chart.Status.Conditions, err)
 		if err := r.updateStatus(ctx, req, chart.Status); err != nil {
 			log.Error(err, "unable to update status")
 		}
 		return ctrl.Result{Requeue: true}, err
 	}
 
-	// Assert source is ready
-	if source.GetArtifact() == nil {
+	// Assert source is ready, a HelmRepository of the 'oci' type has no
+	// artifact
+	if source.GetArtifact() == nil && !isOCIHelmRepository(source) {
 		err = fmt.Errorf("no artifact found for source `%s` kind '%s'",
 			chart.Spec.SourceRef.Name, chart.Spec.SourceRef.Kind)
 		chart = sourcev1.HelmChartNotReady(*chart.DeepCopy(), sourcev1.ChartPullFailedReason, err.Error())
+		chart.Status.NextRetryTime = r.retryLimiter.nextRetryTime(req, err, chart.Status.Conditions)
+		chart.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, chart.Status.Conditions, err)
 		if err := r.updateStatus(ctx, req, chart.Status); err != nil {
 			log.Error(err, "unable to update status")
 		}
@@ -201,64 +299,149 @@ func (r *HelmChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{Requeue: true}, err
 	}
 
+	// Bypass the caches if the chart was annotated with a force refetch
+	// request newer than the handled one
+	refetch, force := forceRefetchRequest(&chart, chart.Status.LastHandledForceRefetchAt)
+
 	// Perform the reconciliation for the chart source type
+	setReconcilePhase(ctx, reconcilePhaseFetching)
 	var reconciledChart sourcev1.HelmChart
 	var reconcileErr error
+	var repositoryURL string
+	reconciled = &reconciledChart
+	if chart.Spec.Verification == nil {
+		chart.Status.VerifiedIdentity = nil
+	}
+	fetchCtx, rateLimits := transport.WithRateLimits(ctx)
+	fetchCtx = withForceRefetch(fetchCtx, force)
 	switch typedSource := source.(type) {
 	case *sourcev1.HelmRepository:
 		// TODO: move this to a validation webhook once the discussion around
 		//  certificates has settled: https://github.com/fluxcd/image-reflector-controller/issues/69
 		if err := validHelmChartName(chart.Spec.Chart); err != nil {
 			reconciledChart = sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error())
+			reconciledChart.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, reconciledChart.Status.Conditions, err)
 			log.Error(err, "validation failed")
 			if err := r.updateStatus(ctx, req, reconciledChart.Status); err != nil {
 				log.Info(fmt.Sprintf("%v", reconciledChart.Status))
 				log.Error(err, "unable to update status")
 				return ctrl.Result{Requeue: true}, err
 			}
-			r.event(ctx, reconciledChart, events.EventSeverityError, err.Error())
+			r.event(ctx, reconciledChart, events.EventSeverityError, err.Error(), nil)
 			r.recordReadiness(ctx, reconciledChart)
 			// Do not requeue as there is no chance on recovery.
 			return ctrl.Result{Requeue: false}, nil
 		}
-		reconciledChart, reconcileErr = r.reconcileFromHelmRepository(ctx, *typedSource, *chart.DeepCopy(), changed)
+		repositoryURL = typedSource.Spec.URL
+		reconciledChart, reconcileErr = r.reconcileFromHelmRepository(fetchCtx, *typedSource, *chart.DeepCopy(), changed || force)
 	case *sourcev1.GitRepository, *sourcev1.Bucket:
-		reconciledChart, reconcileErr = r.reconcileFromTarballArtifact(ctx, *typedSource.GetArtifact(),
-			*chart.DeepCopy(), changed)
+		if err := chartVerificationSupported(chart.Spec.Verification, typedSource); err != nil {
+			reconcileErr = err
+			reconciledChart = sourcev1.HelmChartNotVerified(*chart.DeepCopy(), reconcileErr.Error())
+			break
+		}
+		reconciledChart, reconcileErr = r.reconcileFromTarballArtifact(fetchCtx, *typedSource.GetArtifact(),
+			*chart.DeepCopy(), changed || force)
 	default:
 		err := fmt.Errorf("unable to reconcile unsupported source reference kind '%s'", chart.Spec.SourceRef.Kind)
 		return ctrl.Result{Requeue: false}, err
 	}
+	if force && reconcileErr == nil {
+		reconciledChart.Status.LastHandledForceRefetchAt = refetch
+	}
+
+	// Delay the retry until the reset of the rate limit of the upstream, if
+	// the reconciliation was rejected by it
+	reconcileErr = recordUpstreamRateLimit(ctx, r.retryLimiter, req, sourcev1.HelmChartKind, &chart,
+		repositoryURL, rateLimits, reconcileErr)
+
+	// Stall the chart on a connection denied by the egress policy, as
+	// retrying does not resolve it
+	if egress.IsDenied(reconcileErr) {
+		reconciledChart = sourcev1.HelmChartStalled(reconciledChart, sourcev1.EgressDeniedReason, reconcileErr.Error())
+	}
+
+	// Record the artifact written by the reconciliation as in the storage
+	r.Storage.recordArtifactInStorage(&reconciledChart.Status.Conditions, reconciledChart.Generation,
+		chart.GetArtifact(), reconciledChart.GetArtifact())
+
+	// Record the failures to fetch the upstream
+	r.FetchMetrics.record(sourcev1.HelmChartKind, &reconciledChart, reconciledChart.Status.Conditions, reconcileErr)
+
+	// Record the time of the next retry of a failed reconciliation
+	reconciledChart.Status.NextRetryTime = r.retryLimiter.nextRetryTime(req, reconcileErr, reconciledChart.Status.Conditions)
+
+	// Record the trace of the reconciliation, and the revision of its span
+	reconciledChart.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, reconciledChart.Status.Conditions, reconcileErr)
+	spanRevision(ctx, reconciledChart.GetArtifact())
 
 	// Update status with the reconciliation result
+	setReconcilePhase(ctx, reconcilePhaseUpdatingStatus)
 	if err := r.updateStatus(ctx, req, reconciledChart.Status); err != nil {
 		log.Error(err, "unable to update status")
 		return ctrl.Result{Requeue: true}, err
 	}
 
+	// If the artifact exceeds the maximum size, record the failure and
+	// requeue at the interval, as retrying does not resolve it
+	if reconcileErr != nil && apimeta.IsStatusConditionTrue(reconciledChart.Status.Conditions, meta.StalledCondition) {
+		r.event(ctx, reconciledChart, events.EventSeverityError, reconcileErr.Error(), nil)
+		r.recordReadiness(ctx, reconciledChart)
+		if reconcileRequestPending(ctx, r, &reconciledChart, reconciledChart.Status.GetLastHandledReconcileRequest()) {
+			return ctrl.Result{Requeue: true}, reconcileErr
+		}
+		return ctrl.Result{RequeueAfter: r.intervalJitter.interval(chart.GetInterval().Duration)}, nil
+	}
+
 	// If reconciliation failed, record the failure and requeue immediately
 	if reconcileErr != nil {
-		r.event(ctx, reconciledChart, events.EventSeverityError, reconcileErr.Error())
+		r.event(ctx, reconciledChart, events.EventSeverityError, reconcileErr.Error(), nil)
 		r.recordReadiness(ctx, reconciledChart)
+		if next := reconciledChart.Status.NextRetryTime; next != nil {
+			log.Info(fmt.Sprintf("Reconciliation failed, retrying at %s", next.Format(time.RFC3339)))
+		}
 		return ctrl.Result{Requeue: true}, reconcileErr
 	}
 
-	// Emit an event if we did not have an artifact before, or the revision has changed
+	// Emit an event and purge the previous artifacts if we did not have an artifact before, or the revision has changed
 	if (chart.GetArtifact() == nil && reconciledChart.GetArtifact() != nil) ||
 		(chart.GetArtifact() != nil && reconciledChart.GetArtifact() != nil && reconciledChart.GetArtifact().Revision != chart.GetArtifact().Revision) {
-		r.event(ctx, reconciledChart, events.EventSeverityInfo, sourcev1.HelmChartReadyMessage(reconciledChart))
+		metadata := r.Storage.artifactMetadata(reconciledChart.GetArtifact(), upstreamURL(source))
+		r.event(ctx, reconciledChart, events.EventSeverityInfo, sourcev1.HelmChartReadyMessage(reconciledChart), metadata)
+		if err := r.gc(reconciledChart); err != nil {
+			log.Error(err, "unable to purge old artifacts")
+		}
 	}
 	r.recordReadiness(ctx, reconciledChart)
 
+	// Shift the next run by a jitter, for the sources to drift apart
+	interval := r.intervalJitter.interval(chart.GetInterval().Duration)
 	log.Info(fmt.Sprintf("Reconciliation finished in %s, next run in %s",
 		time.Now().Sub(start).String(),
-		chart.GetInterval().Duration.String(),
+		interval.String(),
 	))
-	return ctrl.Result{RequeueAfter: chart.GetInterval().Duration}, nil
+	// Reconcile again right away if the object was annotated with a
+	// reconcile request during the reconciliation, as it is not handled
+	if reconcileRequestPending(ctx, r, &reconciledChart, reconciledChart.Status.GetLastHandledReconcileRequest()) {
+		log.Info("Reconcile request received during the reconciliation, reconciling again")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: interval}, nil
 }
 
 type HelmChartReconcilerOptions struct {
 	MaxConcurrentReconciles int
+	MinRetryDelay           time.Duration
+	MaxRetryDelay           time.Duration
+	Drainer                 *Drainer
+	IntervalJitter          *IntervalJitter
+	ReconcileTracker        *ReconcileTracker
+	Validator               *SourceValidator
+	Defaults                *SourceDefaults
+	ReconcileTracer         *ReconcileTracer
+	ReconcileSpans          *ReconcileSpans
+	NamespaceLimiter        *NamespaceLimiter
 }
 
 func (r *HelmChartReconciler) getSource(ctx context.Context, chart sourcev1.HelmChart) (sourcev1.Source, error) {
@@ -296,65 +479,201 @@ func (r *HelmChartReconciler) getSource(ctx context.Context, chart sourcev1.Helm
 	return source, nil
 }
 
+// chartVerificationSupported returns an error if the provider of the given
+// verification of a HelmChart, if any, does not support the charts of the
+// given source: cosign verifies the charts from the HelmRepository sources
+// of the 'oci' type, and provenance the charts from the other HelmRepository
+// sources.
+func chartVerificationSupported(verification *sourcev1.OCIRepositoryVerification, source sourcev1.Source) error {
+	if verification == nil {
+		return nil
+	}
+	_, isHelmRepository := source.(*sourcev1.HelmRepository)
+	if verification.Provider == sourcev1.ProvenanceVerificationProvider {
+		if !isHelmRepository || isOCIHelmRepository(source) {
+			return errors.New("provenance verification is only supported for charts from HelmRepository sources of the default type")
+		}
+		return nil
+	}
+	if !isOCIHelmRepository(source) {
+		return errors.New("cosign verification is only supported for charts from HelmRepository sources of the 'oci' type")
+	}
+	return nil
+}
+
+// isOCIHelmRepository returns if the given source is a HelmRepository of the
+// 'oci' type.
+func isOCIHelmRepository(source sourcev1.Source) bool {
+	repository, ok := source.(*sourcev1.HelmRepository)
+	return ok && repository.Spec.Type == sourcev1.HelmRepositoryTypeOCI
+}
+
 func (r *HelmChartReconciler) reconcileFromHelmRepository(ctx context.Context,
 	repository sourcev1.HelmRepository, chart sourcev1.HelmChart, force bool) (sourcev1.HelmChart, error) {
-	// Configure ChartRepository getter options
-	clientOpts := []getter.Option{
-		getter.WithURL(repository.Spec.URL),
-		getter.WithTimeout(repository.Spec.Timeout.Duration),
-		getter.WithPassCredentialsAll(repository.Spec.PassCredentials),
+	// the timeout of the chart is the timeout of the repository, or its default
+	r.defaults.apply(&repository)
+
+	if err := chartVerificationSupported(chart.Spec.Verification, &repository); err != nil {
+		return sourcev1.HelmChartNotVerified(chart, err.Error()), err
 	}
-	if secret, err := r.getHelmRepositorySecret(ctx, &repository); err != nil {
+
+	tracePhase(ctx, tracePhaseAuth)
+	secret, err := r.getHelmRepositorySecret(ctx, chart, &repository)
+	if err != nil {
 		return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
-	} else if secret != nil {
-		opts, cleanup, err := helm.ClientOptionsFromSecret(*secret)
-		if err != nil {
-			err = fmt.Errorf("auth options error: %w", err)
-			return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
-		}
-		defer cleanup()
-		clientOpts = append(clientOpts, opts...)
 	}
 
-	// Initialize the chart repository and load the index file
-	chartRepo, err := helm.NewChartRepository(repository.Spec.URL, r.Getters, clientOpts)
+	mirror, err := r.ociMirror(ctx, &repository)
 	if err != nil {
-		switch err.(type) {
-		case *url.Error:
-			return sourcev1.HelmChartNotReady(chart, sourcev1.URLInvalidReason, err.Error()), err
-		default:
+		return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
+	}
+
+	var chartRepo *helm.ChartRepository
+	if repository.Spec.Type == sourcev1.HelmRepositoryTypeOCI {
+		// Resolve the versions against the tags of the chart in the
+		// registry, as it has no index
+		tracePhase(ctx, tracePhaseFetch)
+		ociCtx, cancel := context.WithTimeout(ctx, repository.Spec.Timeout.Duration)
+		defer cancel()
+		chartRepo, err = helm.NewOCIChartRepository(ociCtx, repository.Spec.URL, chart.Spec.Chart, secret, mirror)
+		if err != nil {
+			if oci.IsAuthError(err) {
+				return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
+			}
 			return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
 		}
+	} else {
+		// Configure ChartRepository getter options
+		clientOpts := []getter.Option{
+			getter.WithURL(repository.Spec.URL),
+			getter.WithTimeout(repository.Spec.Timeout.Duration),
+			getter.WithPassCredentialsAll(repository.Spec.PassCredentials),
+		}
+		if secret != nil {
+			opts, cleanup, err := helm.ClientOptionsFromSecret(*secret)
+			if err != nil {
+				err = fmt.Errorf("auth options error: %w", err)
+				return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
+			}
+			defer cleanup()
+			clientOpts = append(clientOpts, opts...)
+		}
+
+		proxy, warnings, err := proxyFromSecretRef(ctx, r.Client, repository.GetNamespace(), repository.Spec.ProxySecretRef)
+		for _, w := range warnings {
+			r.event(ctx, chart, events.EventSeverityError, w, nil)
+		}
+		if err != nil {
+			return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
+		}
+		caBundle, err := caBundleFromRef(ctx, r.Client, repository.GetNamespace(), repository.Spec.CARef)
+		if err != nil {
+			return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
+		}
+
+		// Initialize the chart repository and load the index file
+		tracePhase(ctx, tracePhaseFetch)
+		chartRepo, err = helm.NewChartRepository(repository.Spec.URL, r.Getters, clientOpts)
+		if err != nil {
+			switch err.(type) {
+			case *url.Error:
+				return sourcev1.HelmChartNotReady(chart, sourcev1.URLInvalidReason, err.Error()), err
+			default:
+				return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+			}
+		}
+		if err := withTransport(chartRepo, &repository, secret, proxy, caBundle); err != nil {
+			err = fmt.Errorf("auth options error: %w", err)
+			return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
+		}
+		if forceRefetch(ctx) {
+			// Download the index instead of loading the index of the repository
+			// artifact, when forced to refetch
+			if err := chartRepo.DownloadIndex(); err != nil {
+				return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+			}
+		} else if index, ok := r.IndexCache.Get(indexCacheKey(&repository)); ok {
+			// Use the parsed index of the repository artifact
+			chartRepo.Index = index
+		} else {
+			if err := r.Storage.VerifyArtifact(*repository.GetArtifact()); err != nil {
+				err = fmt.Errorf("artifact verification error: %w", err)
+				return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+			}
+			indexFile, err := os.Open(r.Storage.LocalPath(*repository.GetArtifact()))
+			if err != nil {
+				return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+			}
+			b, err := io.ReadAll(indexFile)
+			if err != nil {
+				return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+			}
+			if err = chartRepo.LoadIndex(b); err != nil {
+				return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+			}
+			r.IndexCache.Set(indexCacheKey(&repository), chartRepo.Index)
+		}
 	}
-	indexFile, err := os.Open(r.Storage.LocalPath(*repository.GetArtifact()))
+
+	// Lookup the chart version in the chart repository index
+	chartVer, err := chartRepo.Get(chart.Spec.Chart, chart.Spec.Version)
 	if err != nil {
-		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+		return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
 	}
-	b, err := io.ReadAll(indexFile)
+
+	// Keep the pinned version under the Manual version update policy, and
+	// announce a newer matching version once
+	available := chart.Status.AvailableVersion
+	chartVer, err = resolveChartVersion(&chart, chartRepo, chartVer)
 	if err != nil {
 		return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
 	}
-	if err = chartRepo.LoadIndex(b); err != nil {
-		return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+	if v := chart.Status.AvailableVersion; v != "" && v != available {
+		r.event(ctx, chart, events.EventSeverityInfo, fmt.Sprintf("Chart version %s is available, the pinned version %s is kept until a version bump is requested",
+			v, chart.Status.PinnedVersion), nil)
 	}
+	tracePhaseDetail(ctx, "version %s", chartVer.Version)
 
-	// Lookup the chart version in the chart repository index
-	chartVer, err := chartRepo.Get(chart.Spec.Chart, chart.Spec.Version)
-	if err != nil {
-		return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+	// Verify the cosign signature of the manifest of the chart version
+	// before the chart is pulled, on every reconciliation for a revoked key
+	// to take effect, and pull the chart of the verified digest
+	if verification := chart.Spec.Verification; verification != nil && verification.Provider != sourcev1.ProvenanceVerificationProvider {
+		tracePhase(ctx, tracePhaseVerify)
+		ociCtx, cancel := context.WithTimeout(ctx, repository.Spec.Timeout.Duration)
+		defer cancel()
+		resolved, err := helm.ResolveOCIChart(ociCtx, chartVer, secret, mirror)
+		if err != nil {
+			return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+		}
+		identity, err := verifyCosignSignature(ociCtx, r.Client, r.KeylessRoots, r.RekorKeys, resolved.Client,
+			chart.Namespace, *verification, resolved.Digest)
+		if err != nil {
+			err = fmt.Errorf("signature verification of chart version %s '%s' failed: %w", chartVer.Version, resolved.Digest, err)
+			return sourcev1.HelmChartNotVerified(chart, err.Error()), err
+		}
+		subject := fmt.Sprintf("chart version %s '%s'", chartVer.Version, resolved.Digest)
+		chart = sourcev1.HelmChartVerified(chart, *identity, verifiedSignatureMessage(subject, *identity))
+		chartVer = resolved.Version
+		tracePhase(ctx, tracePhaseFetch)
 	}
 
 	// Return early if the revision is still the same as the current artifact
 	newArtifact := r.Storage.NewArtifactFor(chart.Kind, chart.GetObjectMeta(), chartVer.Version,
 		fmt.Sprintf("%s-%s.tgz", chartVer.Name, chartVer.Version))
-	if !force && repository.GetArtifact().HasRevision(newArtifact.Revision) {
-		if newArtifact.URL != chart.GetArtifact().URL {
+	if !force && apimeta.IsStatusConditionTrue(chart.Status.Conditions, meta.ReadyCondition) && chart.GetArtifact().HasRevision(newArtifact.Revision) {
+		if !r.Storage.currentURL(chart.GetArtifact().URL) {
 			r.Storage.SetArtifactURL(chart.GetArtifact())
 			chart.Status.URL = r.Storage.SetHostname(chart.Status.URL)
 		}
 		return chart, nil
 	}
 
+	// ensure there is space for the artifact
+	if err := r.storagePruner().ensureSpace(ctx); err != nil {
+		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageFullReason, err.Error()), err
+	}
+
+	setReconcilePhase(ctx, reconcilePhaseStoring)
 	// Ensure artifact directory exists
 	err = r.Storage.MkdirAll(newArtifact)
 	if err != nil {
@@ -375,20 +694,26 @@ func (r *HelmChartReconciler) reconcileFromHelmRepository(ctx context.Context,
 	if err != nil {
 		return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
 	}
-	tmpFile, err := os.CreateTemp("", fmt.Sprintf("%s-%s-", chart.Namespace, chart.Name))
-	if err != nil {
-		return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
-	}
-	defer os.RemoveAll(tmpFile.Name())
-	if _, err = io.Copy(tmpFile, res); err != nil {
-		tmpFile.Close()
-		return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+
+	// Verify the provenance of the downloaded chart before it is packaged
+	if verification := chart.Spec.Verification; verification != nil && verification.Provider == sourcev1.ProvenanceVerificationProvider {
+		tracePhase(ctx, tracePhaseVerify)
+		identity, err := r.verifyProvenance(ctx, chart, chartRepo, chartVer, res.Bytes())
+		if err != nil {
+			err = fmt.Errorf("provenance verification of chart version %s failed: %w", chartVer.Version, err)
+			return sourcev1.HelmChartNotVerified(chart, err.Error()), err
+		}
+		message := fmt.Sprintf("Verified provenance of chart version %s signed by '%s' with key '%s'",
+			chartVer.Version, identity.Subject, identity.Key)
+		chart = sourcev1.HelmChartVerified(chart, *identity, message)
 	}
-	tmpFile.Close()
 
 	// Check if we need to repackage the chart with the declared defaults files.
+	tracePhase(ctx, tracePhaseArchive)
+	// The downloaded chart is held in memory, and only written to disk once,
+	// either to the artifact path, or packaged with the new default values.
 	var (
-		pkgPath      = tmpFile.Name()
+		pkgPath      string
 		readyReason  = sourcev1.ChartPullSucceededReason
 		readyMessage = fmt.Sprintf("Fetched revision: %s", newArtifact.Revision)
 	)
@@ -398,7 +723,7 @@ func (r *HelmChartReconciler) reconcileFromHelmRepository(ctx context.Context,
 		valuesMap := make(map[string]interface{})
 
 		// Load the chart
-		helmChart, err := loader.LoadFile(pkgPath)
+		helmChart, err := loader.LoadArchive(bytes.NewReader(res.Bytes()))
 		if err != nil {
 			err = fmt.Errorf("load chart error: %w", err)
 			return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
@@ -460,24 +785,51 @@ func (r *HelmChartReconciler) reconcileFromHelmRepository(ctx context.Context,
 			err = fmt.Errorf("chart package error: %w", err)
 			return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPackageFailedReason, err.Error()), err
 		}
-
-		// Copy the packaged chart to the artifact path
-		if err := r.Storage.CopyFromPath(&newArtifact, pkgPath); err != nil {
-			err = fmt.Errorf("failed to write chart package to storage: %w", err)
-			return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+		if err := normalizeChartPackage(pkgPath); err != nil {
+			err = fmt.Errorf("chart package error: %w", err)
+			return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPackageFailedReason, err.Error()), err
 		}
 
 		readyMessage = fmt.Sprintf("Fetched and packaged revision: %s", newArtifact.Revision)
 		readyReason = sourcev1.ChartPackageSucceededReason
 	}
 
+	// Repackage the chart with canonical entries, so that the checksum of the
+	// artifact only depends on the content of the chart
+	if chart.Spec.Normalize {
+		if pkgPath == "" {
+			tmpDir, err := os.MkdirTemp("", fmt.Sprintf("%s-%s-", chart.Namespace, chart.Name))
+			if err != nil {
+				err = fmt.Errorf("tmp dir error: %w", err)
+				return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+			}
+			defer os.RemoveAll(tmpDir)
+			pkgPath = filepath.Join(tmpDir, filepath.Base(newArtifact.Path))
+			if err := os.WriteFile(pkgPath, res.Bytes(), 0644); err != nil {
+				err = fmt.Errorf("chart package error: %w", err)
+				return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+			}
+		}
+		if err := canonicalizeChartPackage(pkgPath); err != nil {
+			err = fmt.Errorf("chart normalization error: %w", err)
+			return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPackageFailedReason, err.Error()), err
+		}
+	}
+
 	// Write artifact to storage
-	if err := r.Storage.CopyFromPath(&newArtifact, pkgPath); err != nil {
+	storage := r.Storage.WithArtifactMaxSize(chart.Spec.MaxArtifactSize)
+	if pkgPath != "" {
+		err = storage.CopyFromPath(&newArtifact, pkgPath)
+	} else {
+		err = storage.Copy(&newArtifact, bytes.NewReader(res.Bytes()))
+	}
+	if err != nil {
 		err = fmt.Errorf("unable to write chart file: %w", err)
-		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+		return helmChartStorageFailure(chart, err), err
 	}
 
 	// Update symlink
+	tracePhase(ctx, tracePhaseStore)
 	chartUrl, err := r.Storage.Symlink(newArtifact, fmt.Sprintf("%s-latest.tgz", chartVer.Name))
 	if err != nil {
 		err = fmt.Errorf("storage error: %w", err)
@@ -498,12 +850,18 @@ func (r *HelmChartReconciler) reconcileFromTarballArtifact(ctx context.Context,
 	defer os.RemoveAll(tmpDir)
 
 	// Open the tarball artifact file and untar files into working directory
+	tracePhase(ctx, tracePhaseVerify)
+	if err := r.Storage.VerifyArtifact(artifact); err != nil {
+		err = fmt.Errorf("artifact verification error: %w", err)
+		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+	}
+	tracePhase(ctx, tracePhaseFetch)
 	f, err := os.Open(r.Storage.LocalPath(artifact))
 	if err != nil {
 		err = fmt.Errorf("artifact open error: %w", err)
 		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
 	}
-	if _, err = untar.Untar(f, tmpDir); err != nil {
+	if err = untarArtifact(artifact, f, tmpDir); err != nil {
 		f.Close()
 		err = fmt.Errorf("artifact untar error: %w", err)
 		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
@@ -525,21 +883,18 @@ func (r *HelmChartReconciler) reconcileFromTarballArtifact(ctx context.Context,
 		err = fmt.Errorf("load chart error: %w", err)
 		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
 	}
+	tracePhaseDetail(ctx, "version %s", helmChart.Metadata.Version)
 
-	// Return early if the revision is still the same as the current chart artifact
-	newArtifact := r.Storage.NewArtifactFor(chart.Kind, chart.ObjectMeta.GetObjectMeta(), helmChart.Metadata.Version,
-		fmt.Sprintf("%s-%s.tgz", helmChart.Metadata.Name, helmChart.Metadata.Version))
-	if !force && apimeta.IsStatusConditionTrue(chart.Status.Conditions, meta.ReadyCondition) && chart.GetArtifact().HasRevision(newArtifact.Revision) {
-		if newArtifact.URL != artifact.URL {
-			r.Storage.SetArtifactURL(chart.GetArtifact())
-			chart.Status.URL = r.Storage.SetHostname(chart.Status.URL)
-		}
-		return chart, nil
+	// Package a new chart for every revision of the source under the
+	// Revision reconcile strategy, with the revision as build metadata
+	if chart.Spec.ReconcileStrategy == sourcev1.ReconcileStrategyRevision {
+		helmChart.Metadata.Version = helm.VersionWithRevision(helmChart.Metadata.Version, artifact.Revision)
 	}
 
-	// Either (re)package the chart with the declared default values file,
-	// or write the chart directly to storage.
-	pkgPath := chartPath
+	// Merge the declared values files in order into the default values of the
+	// chart, which is then packaged with a version of which the build metadata
+	// is the digest of the merged values, so that a change of the values
+	// produces a new revision even if the chart version is unchanged.
 	isValuesFileOverriden := false
 	if len(chart.GetValuesFiles()) > 0 {
 		valuesMap := make(map[string]interface{})
@@ -579,8 +934,26 @@ func (r *HelmChartReconciler) reconcileFromTarballArtifact(ctx context.Context,
 		if err != nil {
 			return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPackageFailedReason, err.Error()), err
 		}
+		if isValuesFileOverriden {
+			helmChart.Metadata.Version = helm.VersionWithValuesDigest(helmChart.Metadata.Version, yamlBytes)
+		}
 	}
 
+	// Return early if the revision is still the same as the current chart artifact
+	newArtifact := r.Storage.NewArtifactFor(chart.Kind, chart.ObjectMeta.GetObjectMeta(), helmChart.Metadata.Version,
+		fmt.Sprintf("%s-%s.tgz", helmChart.Metadata.Name, helmChart.Metadata.Version))
+	if !force && apimeta.IsStatusConditionTrue(chart.Status.Conditions, meta.ReadyCondition) && chart.GetArtifact().HasRevision(newArtifact.Revision) {
+		if !r.Storage.currentURL(chart.GetArtifact().URL) {
+			r.Storage.SetArtifactURL(chart.GetArtifact())
+			chart.Status.URL = r.Storage.SetHostname(chart.Status.URL)
+		}
+		return chart, nil
+	}
+
+	// Either (re)package the chart with the declared default values file,
+	// or write the chart directly to storage.
+	pkgPath := chartPath
+
 	isDir := chartFileInfo.IsDir()
 	switch {
 	case isDir:
@@ -614,63 +987,20 @@ func (r *HelmChartReconciler) reconcileFromTarballArtifact(ctx context.Context,
 				continue
 			}
 
-			// Discover existing HelmRepository by URL
+			// Discover the HelmRepository of the dependency by name or URL
 			repository, err := r.resolveDependencyRepository(ctx, dep, chart.Namespace)
 			if err != nil {
-				repository = &sourcev1.HelmRepository{
-					Spec: sourcev1.HelmRepositorySpec{
-						URL:     dep.Repository,
-						Timeout: &metav1.Duration{Duration: 60 * time.Second},
-					},
-				}
-			}
-
-			// Configure ChartRepository getter options
-			clientOpts := []getter.Option{
-				getter.WithURL(repository.Spec.URL),
-				getter.WithTimeout(repository.Spec.Timeout.Duration),
-				getter.WithPassCredentialsAll(repository.Spec.PassCredentials),
-			}
-			if secret, err := r.getHelmRepositorySecret(ctx, repository); err != nil {
-				return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
-			} else if secret != nil {
-				opts, cleanup, err := helm.ClientOptionsFromSecret(*secret)
-				if err != nil {
-					err = fmt.Errorf("auth options error: %w", err)
-					return sourcev1.HelmChartNotReady(chart, sourcev1.AuthenticationFailedReason, err.Error()), err
-				}
-				defer cleanup()
-				clientOpts = append(clientOpts, opts...)
+				return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
 			}
-
-			// Initialize the chart repository and load the index file
-			chartRepo, err := helm.NewChartRepository(repository.Spec.URL, r.Getters, clientOpts)
+			chartRepo, cleanup, err := r.dependencyChartRepository(ctx, chart, dep, repository)
+			defer cleanup()
 			if err != nil {
-				switch err.(type) {
-				case *url.Error:
-					return sourcev1.HelmChartNotReady(chart, sourcev1.URLInvalidReason, err.Error()), err
-				default:
-					return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
-				}
-			}
-			if repository.Status.Artifact != nil {
-				indexFile, err := os.Open(r.Storage.LocalPath(*repository.GetArtifact()))
-				if err != nil {
-					return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
-				}
-				b, err := io.ReadAll(indexFile)
-				if err != nil {
-					return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
-				}
-				if err = chartRepo.LoadIndex(b); err != nil {
-					return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
-				}
-			} else {
-				// Download index
-				err = chartRepo.DownloadIndex()
-				if err != nil {
-					return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPullFailedReason, err.Error()), err
+				reason := sourcev1.ChartPullFailedReason
+				var repoErr *dependencyRepositoryError
+				if errors.As(err, &repoErr) {
+					reason = repoErr.reason
 				}
+				return sourcev1.HelmChartNotReady(chart, reason, err.Error()), err
 			}
 
 			dwr = append(dwr, &helm.DependencyWithRepository{
@@ -695,13 +1025,27 @@ func (r *HelmChartReconciler) reconcileFromTarballArtifact(ctx context.Context,
 
 		fallthrough
 	case isValuesFileOverriden:
+		tracePhase(ctx, tracePhaseArchive)
 		pkgPath, err = chartutil.Save(helmChart, tmpDir)
 		if err != nil {
 			err = fmt.Errorf("chart package error: %w", err)
 			return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPackageFailedReason, err.Error()), err
 		}
+		if err := normalizeChartPackage(pkgPath); err != nil {
+			err = fmt.Errorf("chart package error: %w", err)
+			return sourcev1.HelmChartNotReady(chart, sourcev1.ChartPackageFailedReason, err.Error()), err
+		}
+	}
+
+	// ensure there is space for the artifact
+	if err := r.storagePruner().ensureSpace(ctx); err != nil {
+		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageFullReason, err.Error()), err
 	}
 
+	setReconcilePhase(ctx, reconcilePhaseStoring)
+	if !isDir && !isValuesFileOverriden {
+		tracePhase(ctx, tracePhaseArchive)
+	}
 	// Ensure artifact directory exists
 	err = r.Storage.MkdirAll(newArtifact)
 	if err != nil {
@@ -718,12 +1062,13 @@ func (r *HelmChartReconciler) reconcileFromTarballArtifact(ctx context.Context,
 	defer unlock()
 
 	// Copy the packaged chart to the artifact path
-	if err := r.Storage.CopyFromPath(&newArtifact, pkgPath); err != nil {
+	if err := r.Storage.WithArtifactMaxSize(chart.Spec.MaxArtifactSize).CopyFromPath(&newArtifact, pkgPath); err != nil {
 		err = fmt.Errorf("failed to write chart package to storage: %w", err)
-		return sourcev1.HelmChartNotReady(chart, sourcev1.StorageOperationFailedReason, err.Error()), err
+		return helmChartStorageFailure(chart, err), err
 	}
 
 	// Update symlink
+	tracePhase(ctx, tracePhaseStore)
 	cUrl, err := r.Storage.Symlink(newArtifact, fmt.Sprintf("%s-latest.tgz", helmChart.Metadata.Name))
 	if err != nil {
 		err = fmt.Errorf("storage error: %w", err)
@@ -738,7 +1083,7 @@ func (r *HelmChartReconciler) reconcileDelete(ctx context.Context, chart sourcev
 	// Our finalizer is still present, so lets handle garbage collection
 	if err := r.gc(chart); err != nil {
 		r.event(ctx, chart, events.EventSeverityError,
-			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()))
+			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()), nil)
 		// Return the error so we retry the failed garbage collection
 		return ctrl.Result{}, err
 	}
@@ -756,57 +1101,99 @@ func (r *HelmChartReconciler) reconcileDelete(ctx context.Context, chart sourcev
 	return ctrl.Result{}, nil
 }
 
+// helmChartStorageFailure returns the given v1beta1.HelmChart marked as not
+// ready for the given error returned by the Storage, or as stalled if the
+// chart package exceeds the maximum artifact size.
+func helmChartStorageFailure(chart sourcev1.HelmChart, err error) sourcev1.HelmChart {
+	if isArtifactSizeError(err) {
+		return sourcev1.HelmChartStalled(chart, sourcev1.ArtifactTooLargeReason, err.Error())
+	}
+	return sourcev1.HelmChartNotReady(chart, storageFailureReason(err), err.Error())
+}
+
 // resetStatus returns a modified v1beta1.HelmChart and a boolean indicating
-// if the status field has been reset.
+// if the status field has been reset. The meta.ReconcilingCondition of a
+// status that is not reset is set, as a reconciliation is under way.
 func (r *HelmChartReconciler) resetStatus(chart sourcev1.HelmChart) (sourcev1.HelmChart, bool) {
-	// We do not have an artifact, or it does no longer exist
-	if chart.GetArtifact() == nil || !r.Storage.ArtifactExist(*chart.GetArtifact()) {
+	// Verify that the artifact is in the storage and intact
+	inStorage := r.Storage.artifactInStorage(chart.GetArtifact(), chart.Generation)
+	changed := false
+	switch {
+	case inStorage.Status != metav1.ConditionTrue:
+		// We do not have an artifact, or it is missing or corrupt
 		chart = sourcev1.HelmChartProgressing(chart)
 		chart.Status.Artifact = nil
-		return chart, true
-	}
-	// The chart specification has changed
-	if chart.Generation != chart.Status.ObservedGeneration {
-		return sourcev1.HelmChartProgressing(chart), true
+		changed = true
+	case chart.Generation != chart.Status.ObservedGeneration:
+		chart = sourcev1.HelmChartProgressing(chart)
+		changed = true
+	default:
+		chart = sourcev1.HelmChartReconciling(chart)
 	}
-	return chart, false
+	return chart, setArtifactInStorage(&chart.Status.Conditions, inStorage) || changed
 }
 
 // gc performs a garbage collection for the given v1beta1.HelmChart.
-// It removes all but the current artifact except for when the
-// deletion timestamp is set, which will result in the removal of
-// all artifacts for the resource.
+// It removes the previous artifacts which exceed the retention of the
+// storage, except for when the deletion timestamp is set, which will
+// result in the removal of all artifacts for the resource.
 func (r *HelmChartReconciler) gc(chart sourcev1.HelmChart) error {
 	if !chart.DeletionTimestamp.IsZero() {
-		return r.Storage.RemoveAll(r.Storage.NewArtifactFor(chart.Kind, chart.GetObjectMeta(), "", "*"))
+		return r.Storage.RemoveDeleted(chart.Kind, chart.GetObjectMeta())
 	}
 	if chart.GetArtifact() != nil {
-		return r.Storage.RemoveAllButCurrent(*chart.GetArtifact())
+		_, err := r.Storage.GarbageCollect(*chart.GetArtifact())
+		return err
 	}
 	return nil
 }
 
 // event emits a Kubernetes event and forwards the event to notification
 // controller if configured.
-func (r *HelmChartReconciler) event(ctx context.Context, chart sourcev1.HelmChart, severity, msg string) {
+func (r *HelmChartReconciler) event(ctx context.Context, chart sourcev1.HelmChart, severity, msg string, metadata map[string]string) {
 	log := logr.FromContext(ctx)
+	msg = redact.String(msg)
+
+	// Duplicates are recorded as Kubernetes events nonetheless, which bump
+	// the count of the existing event
+	suppressed := r.EventLimiter.suppress(sourcev1.HelmChartKind, &chart, severity, msg)
+	if suppressed == eventRateLimitedCause {
+		return
+	}
+
 	if r.EventRecorder != nil {
-		r.EventRecorder.Eventf(&chart, "Normal", severity, msg)
+		if len(metadata) > 0 {
+			r.EventRecorder.AnnotatedEventf(&chart, metadata, "Normal", severity, msg)
+		} else {
+			r.EventRecorder.Eventf(&chart, "Normal", severity, msg)
+		}
 	}
-	if r.ExternalEventRecorder != nil {
+	if r.ExternalEventRecorder != nil && suppressed == "" {
 		objRef, err := reference.GetReference(r.Scheme, &chart)
 		if err != nil {
 			log.Error(err, "unable to send event")
 			return
 		}
 
-		if err := r.ExternalEventRecorder.Eventf(*objRef, nil, severity, severity, msg); err != nil {
+		if err := r.ExternalEventRecorder.Eventf(*objRef, metadata, severity, severity, msg); err != nil {
 			log.Error(err, "unable to send event")
 			return
 		}
 	}
 }
 
+// storagePruner returns the pruner of the storage, which emits events with the
+// recorders of the reconciler.
+func (r *HelmChartReconciler) storagePruner() *storagePruner {
+	return &storagePruner{
+		Reader:                r.Client,
+		Scheme:                r.Scheme,
+		Storage:               r.Storage,
+		EventRecorder:         r.EventRecorder,
+		ExternalEventRecorder: r.ExternalEventRecorder,
+	}
+}
+
 func (r *HelmChartReconciler) recordReadiness(ctx context.Context, chart sourcev1.HelmChart) {
 	log := logr.FromContext(ctx)
 	if r.MetricsRecorder == nil {
@@ -828,6 +1215,8 @@ func (r *HelmChartReconciler) recordReadiness(ctx context.Context, chart sourcev
 }
 
 func (r *HelmChartReconciler) updateStatus(ctx context.Context, req ctrl.Request, newStatus sourcev1.HelmChartStatus) error {
+	redact.Conditions(newStatus.Conditions)
+
 	var chart sourcev1.HelmChart
 	if err := r.Get(ctx, req.NamespacedName, &chart); err != nil {
 		return err
@@ -859,29 +1248,43 @@ func (r *HelmChartReconciler) indexHelmChartBySource(o client.Object) []string {
 	return []string{fmt.Sprintf("%s/%s", hc.Spec.SourceRef.Kind, hc.Spec.SourceRef.Name)}
 }
 
-func (r *HelmChartReconciler) resolveDependencyRepository(ctx context.Context, dep *helmchart.Dependency, namespace string) (*sourcev1.HelmRepository, error) {
-	u := helm.NormalizeChartRepositoryURL(dep.Repository)
-	if u == "" {
-		return nil, fmt.Errorf("invalid repository URL")
+// verifyProvenance verifies the provenance file of the given chart version
+// of the given repository, of which the package is given, with the PGP
+// public keyrings of the secret of the verification of the given chart, and
+// returns the identity of the verified signature.
+func (r *HelmChartReconciler) verifyProvenance(ctx context.Context, chart sourcev1.HelmChart, chartRepo *helm.ChartRepository,
+	chartVer *repo.ChartVersion, pkg []byte) (*sourcev1.OCIRepositoryVerifiedIdentity, error) {
+	if chart.Spec.Verification.SecretRef == nil {
+		return nil, errors.New("provenance verification requires a secretRef with the PGP public keyrings")
 	}
-
-	listOpts := []client.ListOption{
-		client.InNamespace(namespace),
-		client.MatchingFields{sourcev1.HelmRepositoryURLIndexKey: u},
+	name := types.NamespacedName{
+		Namespace: chart.Namespace,
+		Name:      chart.Spec.Verification.SecretRef.Name,
+	}
+	var secret corev1.Secret
+	if err := r.Client.Get(ctx, name, &secret); err != nil {
+		return nil, fmt.Errorf("PGP public keys secret error: %w", err)
 	}
-	var list sourcev1.HelmRepositoryList
-	err := r.Client.List(ctx, &list, listOpts...)
+	keyrings, err := helm.KeyringsFromSecret(&secret)
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve HelmRepositoryList: %w", err)
+		return nil, err
 	}
-	if len(list.Items) > 0 {
-		return &list.Items[0], nil
+	verified, err := chartRepo.VerifyProvenance(chartVer, pkg, keyrings)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, fmt.Errorf("no HelmRepository found")
+	return &sourcev1.OCIRepositoryVerifiedIdentity{
+		Digest:  verified.Digest,
+		Key:     verified.Key,
+		Subject: verified.Signer,
+	}, nil
 }
 
-func (r *HelmChartReconciler) getHelmRepositorySecret(ctx context.Context, repository *sourcev1.HelmRepository) (*corev1.Secret, error) {
+// getHelmRepositorySecret returns the auth secret of the given HelmRepository,
+// if any, with the mistakes in the encoding of its data corrected by
+// secretdata.Correct, which are emitted as warning events of the given chart.
+func (r *HelmChartReconciler) getHelmRepositorySecret(ctx context.Context, chart sourcev1.HelmChart,
+	repository *sourcev1.HelmRepository) (*corev1.Secret, error) {
 	if repository.Spec.SecretRef != nil {
 		name := types.NamespacedName{
 			Namespace: repository.GetNamespace(),
@@ -894,19 +1297,46 @@ func (r *HelmChartReconciler) getHelmRepositorySecret(ctx context.Context, repos
 			err = fmt.Errorf("auth secret error: %w", err)
 			return nil, err
 		}
-		return &secret, nil
+		corrected, warnings := secretdata.Correct(secret)
+		for _, w := range warnings {
+			r.event(ctx, chart, events.EventSeverityError, w, nil)
+		}
+		return &corrected, nil
 	}
 
 	return nil, nil
 }
 
+// ociMirror returns the mirror of the registry of the given OCI
+// HelmRepository, with its credentials, or nil if the repository is not of
+// the 'oci' type or the controller has no mirror of its registry.
+func (r *HelmChartReconciler) ociMirror(ctx context.Context, repository *sourcev1.HelmRepository) (*helm.OCIMirror, error) {
+	if repository.Spec.Type != sourcev1.HelmRepositoryTypeOCI {
+		return nil, nil
+	}
+	u, err := url.Parse(repository.Spec.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	mirror := r.Mirrors.Lookup(u.Host)
+	if mirror == nil {
+		return nil, nil
+	}
+	secret, err := mirrorSecret(ctx, r.Client, mirror)
+	if err != nil {
+		return nil, err
+	}
+	return &helm.OCIMirror{Mirror: mirror, Secret: secret, Fallback: r.MirrorFallback}, nil
+}
+
 func (r *HelmChartReconciler) requestsForHelmRepositoryChange(o client.Object) []reconcile.Request {
 	repo, ok := o.(*sourcev1.HelmRepository)
 	if !ok {
 		panic(fmt.Sprintf("Expected a HelmRepository, got %T", o))
 	}
-	// If we do not have an artifact, we have no requests to make
-	if repo.GetArtifact() == nil {
+	// If we do not have an artifact, we have no requests to make, unless the
+	// repository is of the 'oci' type
+	if repo.GetArtifact() == nil && repo.Spec.Type != sourcev1.HelmRepositoryTypeOCI {
 		return nil
 	}
 
@@ -929,6 +1359,38 @@ func (r *HelmChartReconciler) requestsForHelmRepositoryChange(o client.Object) [
 	return reqs
 }
 
+// requestsForSecretChange returns the reconcile requests for the HelmChart objects of which the HelmRepository
+// references the given Secret, with the credentials to fetch the chart. Only the HelmRepository objects in the namespace
+// of the Secret can reference it.
+func (r *HelmChartReconciler) requestsForSecretChange(o client.Object) []reconcile.Request {
+	secret, ok := o.(*corev1.Secret)
+	if !ok {
+		panic(fmt.Sprintf("Expected a Secret, got %T", o))
+	}
+
+	ctx := context.Background()
+	var repositories sourcev1.HelmRepositoryList
+	if err := r.List(ctx, &repositories, client.InNamespace(secret.Namespace)); err != nil {
+		return nil
+	}
+	var reqs []reconcile.Request
+	for _, repo := range repositories.Items {
+		if !containsString(indexBySecretRefs(&repo), secret.Name) {
+			continue
+		}
+		var list sourcev1.HelmChartList
+		if err := r.List(ctx, &list, client.InNamespace(secret.Namespace), client.MatchingFields{
+			sourcev1.SourceIndexKey: fmt.Sprintf("%s/%s", sourcev1.HelmRepositoryKind, repo.Name),
+		}); err != nil {
+			return nil
+		}
+		for _, i := range list.Items {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&i)})
+		}
+	}
+	return reqs
+}
+
 func (r *HelmChartReconciler) requestsForGitRepositoryChange(o client.Object) []reconcile.Request {
 	repo, ok := o.(*sourcev1.GitRepository)
 	if !ok {
@@ -1000,6 +1462,14 @@ func validHelmChartName(s string) error {
 }
 
 func (r *HelmChartReconciler) recordSuspension(ctx context.Context, chart sourcev1.HelmChart) {
+	name := types.NamespacedName{Namespace: chart.Namespace, Name: chart.Name}
+	if !chart.DeletionTimestamp.IsZero() {
+		forgetSuspendStatus(r.MetricsRecorder, sourcev1.HelmChartKind, name)
+		return
+	}
+	if recordSuspend(sourcev1.HelmChartKind, name, chart.Spec.Suspend) {
+		r.event(ctx, chart, events.EventSeverityInfo, suspendMessage(chart.Spec.Suspend), nil)
+	}
 	if r.MetricsRecorder == nil {
 		return
 	}
@@ -1011,9 +1481,5 @@ func (r *HelmChartReconciler) recordSuspension(ctx context.Context, chart source
 		return
 	}
 
-	if !chart.DeletionTimestamp.IsZero() {
-		r.MetricsRecorder.RecordSuspend(*objRef, false)
-	} else {
-		r.MetricsRecorder.RecordSuspend(*objRef, chart.Spec.Suspend)
-	}
+	r.MetricsRecorder.RecordSuspend(*objRef, chart.Spec.Suspend)
 }
@@ -756,6 +756,8 @@ var _ = Describe("HelmChartReconciler", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(helmChart.Values["testDefault"]).To(BeTrue())
 				Expect(helmChart.Values["testOverride"]).To(BeTrue())
+				Expect(got.Status.Artifact.Revision).To(HavePrefix("0.2.0+"))
+				Expect(helmChart.Metadata.Version).To(Equal(got.Status.Artifact.Revision))
 			})
 
 			When("Setting invalid valuesFiles attribute", func() {
@@ -0,0 +1,227 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/runtime/events"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/helm"
+	"github.com/fluxcd/source-controller/pkg/oci"
+)
+
+// dependencyRepositoryError is returned when the ChartRepository of a
+// dependency of a chart can't be initialized, with the reason of the
+// HelmChart condition.
+type dependencyRepositoryError struct {
+	reason string
+	err    error
+}
+
+func (e *dependencyRepositoryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dependencyRepositoryError) Unwrap() error {
+	return e.err
+}
+
+// dependencyRepositoryName returns the name of the HelmRepository referenced
+// by the given repository of a dependency, with the '@<name>' or
+// 'alias:<name>' syntax of Helm for named repositories, or an empty string
+// if it is not a named repository.
+func dependencyRepositoryName(repository string) string {
+	if strings.HasPrefix(repository, "@") {
+		return strings.TrimPrefix(repository, "@")
+	}
+	if strings.HasPrefix(repository, "alias:") {
+		return strings.TrimPrefix(repository, "alias:")
+	}
+	return ""
+}
+
+// resolveDependencyRepository returns the HelmRepository of the given
+// dependency in the given namespace: the HelmRepository of the name of a
+// named repository, or the first HelmRepository with the URL of the
+// dependency. A URL without a HelmRepository returns a HelmRepository of the
+// URL without credentials, of the 'oci' type for an 'oci://' URL.
+func (r *HelmChartReconciler) resolveDependencyRepository(ctx context.Context, dep *helmchart.Dependency, namespace string) (*sourcev1.HelmRepository, error) {
+	if name := dependencyRepositoryName(dep.Repository); name != "" {
+		var repository sourcev1.HelmRepository
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &repository)
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("no HelmRepository '%s' found for the repository '%s' of dependency '%s'",
+				name, dep.Repository, dep.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve HelmRepository '%s': %w", name, err)
+		}
+		return &repository, nil
+	}
+
+	u := helm.NormalizeChartRepositoryURL(dep.Repository)
+	if u == "" {
+		return nil, fmt.Errorf("invalid repository URL")
+	}
+	listOpts := []client.ListOption{
+		client.InNamespace(namespace),
+		client.MatchingFields{sourcev1.HelmRepositoryURLIndexKey: u},
+	}
+	var list sourcev1.HelmRepositoryList
+	if err := r.Client.List(ctx, &list, listOpts...); err != nil {
+		return nil, fmt.Errorf("unable to retrieve HelmRepositoryList: %w", err)
+	}
+	if len(list.Items) > 0 {
+		return &list.Items[0], nil
+	}
+
+	repository := &sourcev1.HelmRepository{Spec: sourcev1.HelmRepositorySpec{URL: dep.Repository}}
+	if strings.HasPrefix(dep.Repository, "oci://") {
+		repository.Spec.Type = sourcev1.HelmRepositoryTypeOCI
+	}
+	return repository, nil
+}
+
+// dependencyChartRepository returns the ChartRepository of the given
+// dependency of the given chart, which is served by the given HelmRepository,
+// with the credentials, proxy and CA bundle of the repository. The index is
+// loaded from the index cache or the artifact of the repository, if any, and
+// downloaded otherwise or when forced to refetch. For a repository of the
+// 'oci' type, the index has the tags of the chart of the dependency. The
+// returned function removes the temporary files of the credentials, once the
+// dependency is downloaded.
+func (r *HelmChartReconciler) dependencyChartRepository(ctx context.Context, chart sourcev1.HelmChart,
+	dep *helmchart.Dependency, repository *sourcev1.HelmRepository) (*helm.ChartRepository, func(), error) {
+	r.defaults.apply(repository)
+	cleanup := func() {}
+
+	secret, err := r.getHelmRepositorySecret(ctx, chart, repository)
+	if err != nil {
+		return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.AuthenticationFailedReason, err: err}
+	}
+
+	if repository.Spec.Type == sourcev1.HelmRepositoryTypeOCI {
+		mirror, err := r.ociMirror(ctx, repository)
+		if err != nil {
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.AuthenticationFailedReason, err: err}
+		}
+		// The timeout of the repository applies to the download of the
+		// dependency, which is done after this function returns
+		ociCtx, cancel := context.WithTimeout(ctx, repository.Spec.Timeout.Duration)
+		chartRepo, err := helm.NewOCIChartRepository(ociCtx, repository.Spec.URL, dep.Name, secret, mirror)
+		if err != nil {
+			cancel()
+			if oci.IsAuthError(err) {
+				return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.AuthenticationFailedReason, err: err}
+			}
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.ChartPullFailedReason, err: err}
+		}
+		return chartRepo, cancel, nil
+	}
+
+	// Configure ChartRepository getter options
+	clientOpts := []getter.Option{
+		getter.WithURL(repository.Spec.URL),
+		getter.WithTimeout(repository.Spec.Timeout.Duration),
+		getter.WithPassCredentialsAll(repository.Spec.PassCredentials),
+	}
+	if secret != nil {
+		opts, secretCleanup, err := helm.ClientOptionsFromSecret(*secret)
+		if err != nil {
+			err = fmt.Errorf("auth options error: %w", err)
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.AuthenticationFailedReason, err: err}
+		}
+		cleanup = secretCleanup
+		clientOpts = append(clientOpts, opts...)
+	}
+
+	proxy, warnings, err := proxyFromSecretRef(ctx, r.Client, repository.GetNamespace(), repository.Spec.ProxySecretRef)
+	for _, w := range warnings {
+		r.event(ctx, chart, events.EventSeverityError, w, nil)
+	}
+	if err != nil {
+		return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.AuthenticationFailedReason, err: err}
+	}
+	caBundle, err := caBundleFromRef(ctx, r.Client, repository.GetNamespace(), repository.Spec.CARef)
+	if err != nil {
+		return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.AuthenticationFailedReason, err: err}
+	}
+
+	// Initialize the chart repository and load the index file
+	chartRepo, err := helm.NewChartRepository(repository.Spec.URL, r.Getters, clientOpts)
+	if err != nil {
+		switch err.(type) {
+		case *url.Error:
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.URLInvalidReason, err: err}
+		default:
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.ChartPullFailedReason, err: err}
+		}
+	}
+	if err := withTransport(chartRepo, repository, secret, proxy, caBundle); err != nil {
+		err = fmt.Errorf("auth options error: %w", err)
+		return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.AuthenticationFailedReason, err: err}
+	}
+
+	// Load the index of the repository artifact, from the index cache if it
+	// is cached, or download the index if there is none or when forced to
+	// refetch
+	var cachedIndex *repo.IndexFile
+	if !forceRefetch(ctx) {
+		cachedIndex, _ = r.IndexCache.Get(indexCacheKey(repository))
+	}
+	switch {
+	case cachedIndex != nil:
+		chartRepo.Index = cachedIndex
+	case repository.GetArtifact() != nil && !forceRefetch(ctx):
+		if err := r.Storage.VerifyArtifact(*repository.GetArtifact()); err != nil {
+			err = fmt.Errorf("artifact verification error: %w", err)
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.StorageOperationFailedReason, err: err}
+		}
+		indexFile, err := os.Open(r.Storage.LocalPath(*repository.GetArtifact()))
+		if err != nil {
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.StorageOperationFailedReason, err: err}
+		}
+		b, err := io.ReadAll(indexFile)
+		indexFile.Close()
+		if err != nil {
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.ChartPullFailedReason, err: err}
+		}
+		if err = chartRepo.LoadIndex(b); err != nil {
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.ChartPullFailedReason, err: err}
+		}
+		r.IndexCache.Set(indexCacheKey(repository), chartRepo.Index)
+	default:
+		if err := chartRepo.DownloadIndex(); err != nil {
+			return nil, cleanup, &dependencyRepositoryError{reason: sourcev1.ChartPullFailedReason, err: err}
+		}
+	}
+	return chartRepo, cleanup, nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestDependencyRepositoryName(t *testing.T) {
+	tests := []struct {
+		repository string
+		want       string
+	}{
+		{repository: "@internal", want: "internal"},
+		{repository: "alias:internal", want: "internal"},
+		{repository: "https://charts.example.com"},
+		{repository: "oci://ghcr.io/stefanprodan/charts"},
+		{repository: "file://../common"},
+	}
+	for _, tt := range tests {
+		if got := dependencyRepositoryName(tt.repository); got != tt.want {
+			t.Errorf("dependencyRepositoryName(%q) = %q, want %q", tt.repository, got, tt.want)
+		}
+	}
+}
+
+func TestHelmChartReconciler_dependencyRepository(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	index := repo.NewIndexFile()
+	if err := index.MustAdd(&helmchart.Metadata{APIVersion: helmchart.APIVersionV2, Name: "common", Version: "1.2.0"},
+		"common-1.2.0.tgz", "", "sha256:abc"); err != nil {
+		t.Fatal(err)
+	}
+	indexFile, err := yaml.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the index is only served with the credentials of the repository
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if u, p, ok := req.BasicAuth(); !ok || u != "flux" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path != "/index.yaml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(indexFile)
+	}))
+	t.Cleanup(server.Close)
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	objects := []runtime.Object{
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "internal-auth", Namespace: "default"},
+			Data:       map[string][]byte{"username": []byte("flux"), "password": []byte("secret")},
+		},
+		&sourcev1.HelmRepository{
+			ObjectMeta: metav1.ObjectMeta{Name: "internal", Namespace: "default"},
+			Spec: sourcev1.HelmRepositorySpec{
+				URL:       server.URL,
+				SecretRef: &meta.LocalObjectReference{Name: "internal-auth"},
+			},
+		},
+		&sourcev1.HelmRepository{
+			ObjectMeta: metav1.ObjectMeta{Name: "anonymous", Namespace: "default"},
+			Spec:       sourcev1.HelmRepositorySpec{URL: server.URL},
+		},
+	}
+	r := &HelmChartReconciler{
+		Client:  fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).Build(),
+		Storage: storage,
+		Getters: getter.Providers{{Schemes: []string{"http", "https"}, New: getter.NewHTTPGetter}},
+	}
+	chart := sourcev1.HelmChart{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+
+	// a named repository is resolved to the HelmRepository of the name, and
+	// its index is downloaded with its credentials
+	dep := &helmchart.Dependency{Name: "common", Version: "1.x", Repository: "@internal"}
+	repository, err := r.resolveDependencyRepository(context.TODO(), dep, chart.Namespace)
+	if err != nil {
+		t.Fatalf("resolveDependencyRepository() error = %v", err)
+	}
+	if repository.Name != "internal" {
+		t.Fatalf("resolveDependencyRepository() = %s, want the internal HelmRepository", repository.Name)
+	}
+	chartRepo, cleanup, err := r.dependencyChartRepository(context.TODO(), chart, dep, repository)
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("dependencyChartRepository() error = %v", err)
+	}
+	if cv, err := chartRepo.Get(dep.Name, dep.Version); err != nil || cv.Version != "1.2.0" {
+		t.Errorf("Get() = %v, %v, want version 1.2.0 of the dependency", cv, err)
+	}
+
+	// the HelmRepository of another name has no credentials
+	dep = &helmchart.Dependency{Name: "common", Version: "1.x", Repository: "alias:anonymous"}
+	repository, err = r.resolveDependencyRepository(context.TODO(), dep, chart.Namespace)
+	if err != nil {
+		t.Fatalf("resolveDependencyRepository() error = %v", err)
+	}
+	_, cleanup, err = r.dependencyChartRepository(context.TODO(), chart, dep, repository)
+	defer cleanup()
+	var repoErr *dependencyRepositoryError
+	if !errors.As(err, &repoErr) || repoErr.reason != sourcev1.ChartPullFailedReason {
+		t.Errorf("dependencyChartRepository() without credentials error = %v, want a pull failure", err)
+	}
+
+	// a named repository without HelmRepository is not resolved
+	dep = &helmchart.Dependency{Name: "common", Version: "1.x", Repository: "@missing"}
+	if _, err := r.resolveDependencyRepository(context.TODO(), dep, chart.Namespace); err == nil ||
+		!strings.Contains(err.Error(), "no HelmRepository 'missing' found") {
+		t.Errorf("resolveDependencyRepository() of a missing repository error = %v, want not found", err)
+	}
+	dep = &helmchart.Dependency{Name: "common", Version: "1.x", Repository: "@internal"}
+	if _, err := r.resolveDependencyRepository(context.TODO(), dep, "other"); err == nil {
+		t.Error("resolveDependencyRepository() of a repository in another namespace error = nil, want not found")
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"helm.sh/helm/v3/pkg/repo"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+const (
+	// indexCacheHit and indexCacheMiss are the events of the index cache
+	// events metric.
+	indexCacheHit  = "hit"
+	indexCacheMiss = "miss"
+
+	// DefaultIndexCacheTTL is the default duration for which an index is
+	// kept in the IndexCache.
+	DefaultIndexCacheTTL = 15 * time.Minute
+)
+
+// indexCacheEventsCounter counts the lookups of the indexes of the Helm
+// repositories in the IndexCache.
+var indexCacheEventsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gotk_helm_index_cache_events_total",
+		Help: "The number of lookups of Helm repository indexes in the index cache, by event (hit or miss).",
+	},
+	[]string{"event"},
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(indexCacheEventsCounter)
+}
+
+// IndexCache is an LRU cache of the parsed indexes of the artifacts of the
+// HelmRepository objects, shared by the reconciles of the HelmChart objects,
+// which otherwise read and parse the index of their repository, of tens of
+// MB for large repositories, at every reconcile. The indexes are keyed by the
+// URL of the repository and the checksum of the artifact, so that a new
+// artifact is never served from the cache, and are evicted after the TTL
+// since they were cached, or when MaxSize more recently used indexes are
+// cached. The cached indexes are shared, and must not be modified. A nil
+// IndexCache caches nothing.
+type IndexCache struct {
+	// MaxSize is the maximum number of cached indexes.
+	MaxSize int
+
+	// TTL is the duration for which an index is cached.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// indexCacheEntry is a cached index and the time it expires.
+type indexCacheEntry struct {
+	key     string
+	index   *repo.IndexFile
+	expires time.Time
+}
+
+// NewIndexCache returns an IndexCache of the given maximum number of indexes
+// and TTL, or nil if the maximum is not positive.
+func NewIndexCache(maxSize int, ttl time.Duration) *IndexCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &IndexCache{
+		MaxSize: maxSize,
+		TTL:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// indexCacheKey returns the key of the index of the artifact of the given
+// HelmRepository in the IndexCache, or an empty string if it has no
+// artifact.
+func indexCacheKey(repository *sourcev1.HelmRepository) string {
+	artifact := repository.GetArtifact()
+	if artifact == nil || artifact.Checksum == "" {
+		return ""
+	}
+	return repository.Spec.URL + "@" + artifact.Checksum
+}
+
+// Get returns the cached index of the given key, and records the lookup in
+// the index cache events metric. It returns false if the index is not cached
+// or expired, or the key is empty.
+func (c *IndexCache) Get(key string) (*repo.IndexFile, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*indexCacheEntry)
+		if c.currentTime().Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			indexCacheEventsCounter.WithLabelValues(indexCacheHit).Inc()
+			return entry.index, true
+		}
+		c.remove(e)
+	}
+	indexCacheEventsCounter.WithLabelValues(indexCacheMiss).Inc()
+	return nil, false
+}
+
+// Set caches the given index with the given key, evicting the least
+// recently used indexes above the maximum. It does nothing if the key is
+// empty or the index is nil.
+func (c *IndexCache) Set(key string, index *repo.IndexFile) {
+	if c == nil || key == "" || index == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries, c.lru = map[string]*list.Element{}, list.New()
+	}
+	expires := c.currentTime().Add(c.TTL)
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*indexCacheEntry)
+		entry.index, entry.expires = index, expires
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&indexCacheEntry{key: key, index: index, expires: expires})
+	for c.lru.Len() > c.MaxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of cached indexes, including the expired indexes
+// which are not evicted yet.
+func (c *IndexCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *IndexCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*indexCacheEntry).key)
+}
+
+func (c *IndexCache) currentTime() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
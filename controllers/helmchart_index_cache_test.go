@@ -0,0 +1,93 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"helm.sh/helm/v3/pkg/repo"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestIndexCache(t *testing.T) {
+	now := time.Now()
+	c := NewIndexCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	hits := testutil.ToFloat64(indexCacheEventsCounter.WithLabelValues(indexCacheHit))
+	misses := testutil.ToFloat64(indexCacheEventsCounter.WithLabelValues(indexCacheMiss))
+
+	a, b, d := repo.NewIndexFile(), repo.NewIndexFile(), repo.NewIndexFile()
+	c.Set("a", a)
+	c.Set("b", b)
+	if got, ok := c.Get("a"); !ok || got != a {
+		t.Fatalf("Get(a) = %v, %v, want the cached index", got, ok)
+	}
+	// b is the least recently used index
+	c.Set("d", d)
+	if _, ok := c.Get("b"); ok {
+		t.Error("Get(b) is cached, want the least recently used index to be evicted")
+	}
+	if got, ok := c.Get("d"); !ok || got != d {
+		t.Errorf("Get(d) = %v, %v, want the cached index", got, ok)
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("Get(a) is cached after the TTL, want it to be expired")
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len() = %d, want the expired index to be evicted", c.Len())
+	}
+	if _, ok := c.Get(""); ok {
+		t.Error("Get() of an empty key is cached")
+	}
+
+	if got := testutil.ToFloat64(indexCacheEventsCounter.WithLabelValues(indexCacheHit)) - hits; got != 2 {
+		t.Errorf("index cache hits = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(indexCacheEventsCounter.WithLabelValues(indexCacheMiss)) - misses; got != 2 {
+		t.Errorf("index cache misses = %v, want 2", got)
+	}
+}
+
+func TestIndexCache_disabled(t *testing.T) {
+	c := NewIndexCache(0, time.Minute)
+	if c != nil {
+		t.Fatalf("NewIndexCache(0) = %v, want nil", c)
+	}
+	c.Set("a", repo.NewIndexFile())
+	if _, ok := c.Get("a"); ok || c.Len() != 0 {
+		t.Error("nil IndexCache cached an index")
+	}
+}
+
+func TestIndexCacheKey(t *testing.T) {
+	repository := &sourcev1.HelmRepository{Spec: sourcev1.HelmRepositorySpec{URL: "https://charts.example.com"}}
+	if got := indexCacheKey(repository); got != "" {
+		t.Errorf("indexCacheKey() without an artifact = %q, want an empty key", got)
+	}
+	repository.Status.Artifact = &sourcev1.Artifact{Checksum: "abc"}
+	if got := indexCacheKey(repository); got != "https://charts.example.com@abc" {
+		t.Errorf("indexCacheKey() = %q, want the URL and the checksum of the artifact", got)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// normalizeChartPackage rewrites the chart package at the given path, as packaged by Helm, with the entries
+// normalised like the entries of an archive of the Storage: without owner information, with the permissions of
+// archiveMode, and with a fixed modification time instead of the time of packaging. The order and contents of the
+// entries, and the gzip header of Helm, are kept. Identical charts thus result in identical packages, independent of
+// the source they were packaged from.
+func normalizeChartPackage(pkgPath string) (err error) {
+	f, err := os.Open(pkgPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	tf, err := os.CreateTemp(filepath.Split(pkgPath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tf.Close()
+			os.Remove(tf.Name())
+		}
+	}()
+
+	zw := gzip.NewWriter(tf)
+	zw.Header.Extra = zr.Header.Extra
+	zw.Header.Comment = zr.Header.Comment
+	tw := tar.NewWriter(zw)
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: header.Typeflag,
+			Name:     header.Name,
+			Linkname: header.Linkname,
+			Size:     header.Size,
+			Mode:     archiveMode(header.FileInfo()),
+			ModTime:  time.Time{},
+		}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return publishFile(tf, pkgPath, 0644)
+}
+
+// canonicalizeChartPackage rewrites the chart package at the given path with canonical entries, so that the package
+// only depends on the content of the chart, and not on how it was packaged: the files are written in lexical order of
+// their names, without owner information, with the 0644 permissions of Helm and a fixed modification time, and
+// without an extra field or comment in the gzip header. The directory entries, which Helm ignores, are removed.
+func canonicalizeChartPackage(pkgPath string) (err error) {
+	f, err := os.Open(pkgPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	type chartFile struct {
+		name string
+		data []byte
+	}
+	var files []chartFile
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg:
+		default:
+			return fmt.Errorf("unsupported type of entry '%s'", header.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		files = append(files, chartFile{name: header.Name, data: data})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+
+	tf, err := os.CreateTemp(filepath.Split(pkgPath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tf.Close()
+			os.Remove(tf.Name())
+		}
+	}()
+
+	zw := gzip.NewWriter(tf)
+	tw := tar.NewWriter(zw)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Size:     int64(len(file.data)),
+			Mode:     0644,
+			ModTime:  time.Time{},
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return publishFile(tf, pkgPath, 0644)
+}
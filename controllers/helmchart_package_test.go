@@ -0,0 +1,470 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// copyChartTree copies the chart in testdata to a new directory, with the given permissions for files and directories
+// and the given modification time, like a checkout of a Git repository or a download of the objects of a bucket.
+func copyChartTree(t *testing.T, fileMode, dirMode os.FileMode, modTime time.Time) string {
+	t.Helper()
+	src := "testdata/charts/helmchart"
+	dst := t.TempDir()
+	if err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			if err := os.MkdirAll(target, dirMode); err != nil {
+				return err
+			}
+			return os.Chmod(target, dirMode)
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, b, fileMode); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, fileMode); err != nil {
+			return err
+		}
+		return os.Chtimes(target, modTime, modTime)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+// archiveChartTree archives the given chart tree like a GitRepository
+// artifact of the given revision.
+func archiveChartTree(t *testing.T, storage *Storage, tree, revision string) sourcev1.Artifact {
+	t.Helper()
+	artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, &sourcev1.GitRepository{}, revision,
+		strings.ReplaceAll(revision, "/", "-")+".tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Archive(&artifact, tree, nil); err != nil {
+		t.Fatal(err)
+	}
+	return artifact
+}
+
+func TestStorage_ArchiveAcrossKinds(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	archive := func(t *testing.T, kind, tree string) []byte {
+		t.Helper()
+		artifact := storage.NewArtifactFor(kind, &sourcev1.GitRepository{}, "rev", "rev.tar.gz")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Archive(&artifact, tree, nil); err != nil {
+			t.Fatalf("Archive() error = %v", err)
+		}
+		b, err := os.ReadFile(storage.LocalPath(artifact))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// A Git checkout has the modes of the repository, the objects of a
+	// bucket are written with the umask of the controller.
+	git := archive(t, sourcev1.GitRepositoryKind, copyChartTree(t, 0644, 0755, time.Now()))
+	bucket := archive(t, sourcev1.BucketKind, copyChartTree(t, 0600, 0700, time.Now().Add(-time.Hour)))
+	if !bytes.Equal(git, bucket) {
+		t.Error("archives of identical Git and Bucket trees are not byte-identical")
+	}
+}
+
+func TestNormalizeChartPackage(t *testing.T) {
+	// pkg packages the chart of the given tree like the HelmChart reconciler,
+	// and returns the normalised package.
+	pkg := func(t *testing.T, tree string) []byte {
+		t.Helper()
+		c, err := loader.Load(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkgPath, err := chartutil.Save(c, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := normalizeChartPackage(pkgPath); err != nil {
+			t.Fatalf("normalizeChartPackage() error = %v", err)
+		}
+		b, err := os.ReadFile(pkgPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	git := pkg(t, copyChartTree(t, 0644, 0755, time.Now()))
+	// Helm records the time of packaging, which must not end up in the package
+	time.Sleep(time.Second)
+	bucket := pkg(t, copyChartTree(t, 0600, 0700, time.Now()))
+	if !bytes.Equal(git, bucket) {
+		t.Error("packages of identical charts from a Git and a Bucket tree are not byte-identical")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(git))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.Header.Comment != "Helm" {
+		t.Errorf("gzip comment = %q, want the one of Helm", zr.Header.Comment)
+	}
+	tr := tar.NewReader(zr)
+	var entries int
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entries++
+		if header.Mode != 0644 {
+			t.Errorf("%q mode = %o, want 0644", header.Name, header.Mode)
+		}
+		if header.Uid != 0 || header.Gid != 0 || header.Uname != "" || header.Gname != "" {
+			t.Errorf("%q owner = %d:%d (%s:%s), want none", header.Name, header.Uid, header.Gid, header.Uname, header.Gname)
+		}
+		if !header.ModTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("%q mtime = %v, want the Unix epoch", header.Name, header.ModTime)
+		}
+	}
+	if entries == 0 {
+		t.Fatal("package has no entries")
+	}
+
+	if _, err := loader.LoadArchive(bytes.NewReader(git)); err != nil {
+		t.Errorf("failed to load normalised package: %v", err)
+	}
+}
+
+func TestCanonicalizeChartPackage(t *testing.T) {
+	tree := copyChartTree(t, 0644, 0755, time.Now())
+
+	// canonicalize returns the canonical package of the package written by
+	// the given function.
+	canonicalize := func(t *testing.T, write func(pkgPath string)) []byte {
+		t.Helper()
+		pkgPath := filepath.Join(t.TempDir(), "helmchart-0.1.0.tgz")
+		write(pkgPath)
+		if err := canonicalizeChartPackage(pkgPath); err != nil {
+			t.Fatalf("canonicalizeChartPackage() error = %v", err)
+		}
+		b, err := os.ReadFile(pkgPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// The package of Helm
+	c, err := loader.Load(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helmPkg, err := chartutil.Save(c, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(helmPkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packaged := canonicalize(t, func(pkgPath string) {
+		if err := os.WriteFile(pkgPath, original, 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The same files repackaged by another tool: in the reverse order, with
+	// directory entries, owner information, other permissions and
+	// modification times, and a gzip header with a name and a comment
+	repackaged := canonicalize(t, func(pkgPath string) {
+		type file struct {
+			name string
+			data []byte
+		}
+		var files []file
+		zr, err := gzip.NewReader(bytes.NewReader(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(zr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, file{name: header.Name, data: b})
+		}
+
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Name, zw.Comment, zw.ModTime = "helmchart-0.1.0.tar", "repackaged", time.Now()
+		tw := tar.NewWriter(zw)
+		for _, dir := range []string{"helmchart/", "helmchart/templates/"} {
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := len(files) - 1; i >= 0; i-- {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     files[i].name,
+				Size:     int64(len(files[i].data)),
+				Mode:     0755,
+				Uid:      1000,
+				Gid:      1000,
+				Uname:    "packager",
+				ModTime:  time.Now().Add(-time.Duration(i) * time.Hour),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(files[i].data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pkgPath, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if !bytes.Equal(packaged, repackaged) {
+		t.Error("canonical packages of identical charts packaged differently are not byte-identical")
+	}
+
+	// The canonical package is loaded and rendered by Helm like the chart
+	want := c
+	c, err = loader.LoadArchive(bytes.NewReader(packaged))
+	if err != nil {
+		t.Fatalf("failed to load canonical package: %v", err)
+	}
+	if c.Name() != want.Name() || c.Metadata.Version != want.Metadata.Version || len(c.Templates) != len(want.Templates) ||
+		len(c.Files) != len(want.Files) {
+		t.Errorf("canonical package = %s-%s with %d templates and %d files, want %s-%s with %d templates and %d files",
+			c.Name(), c.Metadata.Version, len(c.Templates), len(c.Files),
+			want.Name(), want.Metadata.Version, len(want.Templates), len(want.Files))
+	}
+	install := action.NewInstall(&action.Configuration{})
+	install.ClientOnly, install.DryRun = true, true
+	install.ReleaseName, install.Namespace = "helmchart", "default"
+	if _, err := install.Run(c, nil); err != nil {
+		t.Errorf("failed to install canonical package: %v", err)
+	}
+
+	// A package with other entries than files is not normalized
+	pkgPath := filepath.Join(t.TempDir(), "helmchart-0.1.0.tgz")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "helmchart/link", Linkname: "/etc/passwd"}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	zw.Close()
+	if err := os.WriteFile(pkgPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := canonicalizeChartPackage(pkgPath); err == nil {
+		t.Error("canonicalizeChartPackage() of a package with a symlink succeeded")
+	}
+}
+
+func TestHelmChartReconciler_valuesFiles(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	r := &HelmChartReconciler{Storage: storage}
+
+	// archive archives the chart with the given override values like a
+	// GitRepository artifact of the given revision.
+	archive := func(t *testing.T, revision, override string) sourcev1.Artifact {
+		t.Helper()
+		tree := copyChartTree(t, 0644, 0755, time.Now())
+		if err := os.WriteFile(filepath.Join(tree, "override.yaml"), []byte(override), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return archiveChartTree(t, storage, tree, revision)
+	}
+
+	chart := sourcev1.HelmChart{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.HelmChartKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "helmchart", Namespace: "default"},
+		Spec: sourcev1.HelmChartSpec{
+			Chart:       ".",
+			ValuesFiles: []string{"values.yaml", "override.yaml"},
+		},
+	}
+	got, err := r.reconcileFromTarballArtifact(context.TODO(), archive(t, "main-1", "replicaCount: 3"), chart, false)
+	if err != nil {
+		t.Fatalf("reconcileFromTarballArtifact() error = %v", err)
+	}
+	revision := got.GetArtifact().Revision
+	if !strings.HasPrefix(revision, "0.1.0+") {
+		t.Fatalf("reconcileFromTarballArtifact() revision = %q, want the digest of the values", revision)
+	}
+	c, err := loader.Load(storage.LocalPath(*got.GetArtifact()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Metadata.Version != revision || c.Values["replicaCount"] != float64(3) || c.Values["image"] == nil {
+		t.Errorf("packaged chart version %q and values %v, want the merged values of revision %q",
+			c.Metadata.Version, c.Values, revision)
+	}
+
+	// the same values are not packaged again
+	same, err := r.reconcileFromTarballArtifact(context.TODO(), archive(t, "main-2", "replicaCount: 3"), got, false)
+	if err != nil {
+		t.Fatalf("reconcileFromTarballArtifact() error = %v", err)
+	}
+	if same.GetArtifact().Revision != revision || same.GetArtifact().Checksum != got.GetArtifact().Checksum {
+		t.Errorf("reconcileFromTarballArtifact() of the same values artifact = %+v, want %+v", same.GetArtifact(), got.GetArtifact())
+	}
+
+	// other values are packaged with the same chart version
+	other, err := r.reconcileFromTarballArtifact(context.TODO(), archive(t, "main-3", "replicaCount: 5"), got, false)
+	if err != nil {
+		t.Fatalf("reconcileFromTarballArtifact() error = %v", err)
+	}
+	if rev := other.GetArtifact().Revision; rev == revision || !strings.HasPrefix(rev, "0.1.0+") {
+		t.Errorf("reconcileFromTarballArtifact() of other values revision = %q, want a new revision", rev)
+	}
+}
+
+func TestHelmChartReconciler_reconcileStrategy(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	r := &HelmChartReconciler{Storage: storage}
+
+	tree := copyChartTree(t, 0644, 0755, time.Now())
+	first := archiveChartTree(t, storage, tree, "main/6f5a3c1b2e4d8f9a0b1c2d3e4f5a6b7c8d9e0f1a")
+	second := archiveChartTree(t, storage, tree, "main/0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f")
+
+	chart := sourcev1.HelmChart{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.HelmChartKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "helmchart", Namespace: "default"},
+		Spec:       sourcev1.HelmChartSpec{Chart: "."},
+	}
+
+	// the chart version is packaged once under the ChartVersion strategy
+	got, err := r.reconcileFromTarballArtifact(context.TODO(), first, chart, false)
+	if err != nil {
+		t.Fatalf("reconcileFromTarballArtifact() error = %v", err)
+	}
+	if rev := got.GetArtifact().Revision; rev != "0.1.0" {
+		t.Errorf("reconcileFromTarballArtifact() revision = %q, want the chart version", rev)
+	}
+	got, err = r.reconcileFromTarballArtifact(context.TODO(), second, got, false)
+	if err != nil {
+		t.Fatalf("reconcileFromTarballArtifact() error = %v", err)
+	}
+	if rev := got.GetArtifact().Revision; rev != "0.1.0" {
+		t.Errorf("reconcileFromTarballArtifact() of another revision = %q, want the chart version", rev)
+	}
+
+	// every revision of the source is packaged under the Revision strategy
+	chart.Spec.ReconcileStrategy = sourcev1.ReconcileStrategyRevision
+	got, err = r.reconcileFromTarballArtifact(context.TODO(), first, chart, false)
+	if err != nil {
+		t.Fatalf("reconcileFromTarballArtifact() error = %v", err)
+	}
+	if rev := got.GetArtifact().Revision; rev != "0.1.0+6f5a3c1b2e4d" {
+		t.Errorf("reconcileFromTarballArtifact() revision = %q, want the source revision as build metadata", rev)
+	}
+	got, err = r.reconcileFromTarballArtifact(context.TODO(), second, got, false)
+	if err != nil {
+		t.Fatalf("reconcileFromTarballArtifact() error = %v", err)
+	}
+	if rev := got.GetArtifact().Revision; rev != "0.1.0+0e1f2a3b4c5d" {
+		t.Errorf("reconcileFromTarballArtifact() of another revision = %q, want the new source revision", rev)
+	}
+	c, err := loader.Load(storage.LocalPath(*got.GetArtifact()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Metadata.Version != "0.1.0+0e1f2a3b4c5d" {
+		t.Errorf("packaged chart version = %q, want the revision of the artifact", c.Metadata.Version)
+	}
+}
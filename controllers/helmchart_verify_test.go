@@ -0,0 +1,277 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/helm"
+)
+
+func TestHelmChartReconciler_verify(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := newOCITestTLSRegistry(t)
+	secrets := []*corev1.Secret{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cosign", Namespace: "default"},
+			Data:       map[string][]byte{"cosign.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "default"},
+			Data:       map[string][]byte{"caFile": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.Certificate().Raw})},
+		},
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &HelmChartReconciler{
+		Client:  fake.NewClientBuilder().WithScheme(scheme).WithObjects(secrets[0], secrets[1]).Build(),
+		Storage: storage,
+	}
+
+	chartPackage, err := os.ReadFile("testdata/charts/helmchart-0.1.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := map[string][]byte{helm.ChartLayerMediaType + "0": chartPackage}
+	digest := registry.push(t, "0.1.0", layers, helm.ChartLayerMediaType)
+	registry.sign(t, digest, key)
+	legacyLayers := map[string][]byte{helm.LegacyChartLayerMediaType + "0": chartPackage}
+	unsignedDigest := registry.push(t, "0.2.0", legacyLayers, helm.LegacyChartLayerMediaType)
+	registry.content["/v2/app/tags/list"] = []byte(`{"name":"app","tags":["0.1.0","0.2.0"]}`)
+
+	repository := sourcev1.HelmRepository{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "default"},
+		Spec: sourcev1.HelmRepositorySpec{
+			Type:      sourcev1.HelmRepositoryTypeOCI,
+			URL:       "oci://" + strings.TrimPrefix(registry.URL, "https://"),
+			SecretRef: &meta.LocalObjectReference{Name: "registry"},
+		},
+	}
+	chart := sourcev1.HelmChart{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.HelmChartKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: sourcev1.HelmChartSpec{
+			Chart:        "app",
+			Version:      "0.1.0",
+			Verification: &sourcev1.OCIRepositoryVerification{Provider: "cosign", SecretRef: &meta.LocalObjectReference{Name: "cosign"}},
+		},
+	}
+
+	// a signed chart is verified with the key of the secret
+	got, err := r.reconcileFromHelmRepository(context.TODO(), repository, chart, false)
+	if err != nil {
+		t.Fatalf("reconcileFromHelmRepository() error = %v", err)
+	}
+	if got.GetArtifact() == nil || got.GetArtifact().Revision != "0.1.0" {
+		t.Errorf("reconcileFromHelmRepository() artifact = %+v, want revision 0.1.0", got.GetArtifact())
+	}
+	if want := (sourcev1.OCIRepositoryVerifiedIdentity{Digest: digest, Key: "cosign.pub"}); got.Status.VerifiedIdentity == nil || *got.Status.VerifiedIdentity != want {
+		t.Errorf("reconcileFromHelmRepository() verified identity = %+v, want %+v", got.Status.VerifiedIdentity, want)
+	}
+	if !apimeta.IsStatusConditionTrue(got.Status.Conditions, sourcev1.SourceVerifiedCondition) {
+		t.Errorf("reconcileFromHelmRepository() conditions = %v, want verified", got.Status.Conditions)
+	}
+
+	// an unsigned chart is not pulled
+	chart.Spec.Version = "0.2.0"
+	got, err = r.reconcileFromHelmRepository(context.TODO(), repository, chart, false)
+	if err == nil || !strings.Contains(err.Error(), "no signatures found") {
+		t.Errorf("reconcileFromHelmRepository() of an unsigned chart error = %v, want no signatures", err)
+	}
+	if got.GetArtifact() != nil {
+		t.Errorf("reconcileFromHelmRepository() of an unsigned chart artifact = %+v, want none", got.GetArtifact())
+	}
+	if c := apimeta.FindStatusCondition(got.Status.Conditions, sourcev1.SourceVerifiedCondition); c == nil ||
+		c.Status != metav1.ConditionFalse || c.Reason != sourcev1.VerificationFailedReason || !strings.Contains(c.Message, unsignedDigest) {
+		t.Errorf("reconcileFromHelmRepository() of an unsigned chart conditions = %v, want not verified", got.Status.Conditions)
+	}
+
+	// the charts of a repository which is not of the 'oci' type are not
+	// verified with cosign
+	repository.Spec.Type = sourcev1.HelmRepositoryTypeDefault
+	if _, err = r.reconcileFromHelmRepository(context.TODO(), repository, chart, false); err == nil ||
+		!strings.Contains(err.Error(), "cosign verification is only supported") {
+		t.Errorf("reconcileFromHelmRepository() of a default repository error = %v, want cosign to be unsupported", err)
+	}
+}
+
+func TestHelmChartReconciler_verifyProvenance(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	signer, err := openpgp.NewEntity("flux", "", "flux@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyring bytes.Buffer
+	if err := signer.Serialize(&keyring); err != nil {
+		t.Fatal(err)
+	}
+	prov, err := (&provenance.Signatory{Entity: signer}).ClearSign("testdata/charts/helmchart-0.1.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chartPackage, err := os.ReadFile("testdata/charts/helmchart-0.1.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := repo.NewIndexFile()
+	if err := index.MustAdd(&helmchart.Metadata{APIVersion: helmchart.APIVersionV2, Name: "helmchart", Version: "0.1.0"},
+		"helmchart-0.1.0.tgz", "", "sha256:abc"); err != nil {
+		t.Fatal(err)
+	}
+	indexFile, err := yaml.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"/index.yaml":               indexFile,
+		"/helmchart-0.1.0.tgz":      chartPackage,
+		"/helmchart-0.1.0.tgz.prov": []byte(prov),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, ok := files[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	}))
+	t.Cleanup(server.Close)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "pgp", Namespace: "default"},
+		Data:       map[string][]byte{"pubring.gpg": keyring.Bytes()},
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &HelmChartReconciler{
+		Client:  fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build(),
+		Storage: storage,
+		Getters: getter.Providers{{Schemes: []string{"http", "https"}, New: getter.NewHTTPGetter}},
+	}
+
+	repository := sourcev1.HelmRepository{
+		ObjectMeta: metav1.ObjectMeta{Name: "charts", Namespace: "default"},
+		Spec:       sourcev1.HelmRepositorySpec{URL: server.URL},
+	}
+	chart := sourcev1.HelmChart{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.HelmChartKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "helmchart", Namespace: "default"},
+		Spec: sourcev1.HelmChartSpec{
+			Chart:   "helmchart",
+			Version: "0.1.0",
+			Verification: &sourcev1.OCIRepositoryVerification{
+				Provider:  sourcev1.ProvenanceVerificationProvider,
+				SecretRef: &meta.LocalObjectReference{Name: "pgp"},
+			},
+		},
+	}
+	// download the index of the repository, which has no artifact
+	ctx := withForceRefetch(context.TODO(), true)
+
+	// a signed chart is verified with the keyring of the secret
+	got, err := r.reconcileFromHelmRepository(ctx, repository, chart, false)
+	if err != nil {
+		t.Fatalf("reconcileFromHelmRepository() error = %v", err)
+	}
+	if got.GetArtifact() == nil || got.GetArtifact().Revision != "0.1.0" {
+		t.Errorf("reconcileFromHelmRepository() artifact = %+v, want revision 0.1.0", got.GetArtifact())
+	}
+	if v := got.Status.VerifiedIdentity; v == nil || v.Key != "pubring.gpg" || v.Subject != "flux <flux@example.com>" ||
+		!strings.HasPrefix(v.Digest, "sha256:") {
+		t.Errorf("reconcileFromHelmRepository() verified identity = %+v, want the signer", v)
+	}
+	if !apimeta.IsStatusConditionTrue(got.Status.Conditions, sourcev1.SourceVerifiedCondition) {
+		t.Errorf("reconcileFromHelmRepository() conditions = %v, want verified", got.Status.Conditions)
+	}
+
+	// a chart without a provenance file is not stored
+	delete(files, "/helmchart-0.1.0.tgz.prov")
+	got, err = r.reconcileFromHelmRepository(ctx, repository, chart, true)
+	if err == nil || !strings.Contains(err.Error(), "failed to download provenance file") {
+		t.Errorf("reconcileFromHelmRepository() without provenance error = %v, want a download failure", err)
+	}
+	if c := apimeta.FindStatusCondition(got.Status.Conditions, meta.ReadyCondition); c == nil || c.Reason != sourcev1.VerificationFailedReason {
+		t.Errorf("reconcileFromHelmRepository() without provenance conditions = %v, want not verified", got.Status.Conditions)
+	}
+
+	// the charts of a repository of the 'oci' type are not verified with
+	// the provenance
+	repository.Spec.Type = sourcev1.HelmRepositoryTypeOCI
+	if _, err = r.reconcileFromHelmRepository(ctx, repository, chart, false); err == nil ||
+		!strings.Contains(err.Error(), "provenance verification is only supported") {
+		t.Errorf("reconcileFromHelmRepository() of an oci repository error = %v, want provenance to be unsupported", err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/helm"
+)
+
+// versionBumpRequest returns the value of the version bump annotation of the
+// given HelmChart, and if it is newer than the handled value of its status.
+func versionBumpRequest(chart *sourcev1.HelmChart) (string, bool) {
+	return annotationRequest(chart, sourcev1.VersionBumpAnnotation, chart.Status.LastHandledVersionBumpAt)
+}
+
+// resolveChartVersion returns the version of the chart of the given HelmChart
+// to fetch from the given chart repository, of which the given latest version
+// matches the version constraint, and records the resolution in the status of
+// the chart. Under the 'Auto' version update policy, this is the latest
+// version. Under the 'Manual' version update policy, this is the version
+// pinned in the status, unless no version is pinned, the spec changed since
+// the version was pinned, or a version bump is requested, in which case the
+// latest version is pinned. A newer latest version is recorded as available.
+func resolveChartVersion(chart *sourcev1.HelmChart, chartRepo *helm.ChartRepository, latest *repo.ChartVersion) (*repo.ChartVersion, error) {
+	if chart.Spec.VersionUpdatePolicy != sourcev1.VersionUpdatePolicyManual {
+		chart.Status.PinnedVersion, chart.Status.PinnedGeneration, chart.Status.AvailableVersion = "", 0, ""
+		return latest, nil
+	}
+
+	bump, bumpRequested := versionBumpRequest(chart)
+	if bumpRequested {
+		chart.Status.LastHandledVersionBumpAt = bump
+	}
+	if chart.Status.PinnedVersion == "" || chart.Status.PinnedGeneration != chart.Generation || bumpRequested {
+		chart.Status.PinnedVersion, chart.Status.PinnedGeneration, chart.Status.AvailableVersion = latest.Version, chart.Generation, ""
+		return latest, nil
+	}
+
+	pinned, err := chartRepo.Get(chart.Spec.Chart, chart.Status.PinnedVersion)
+	if err != nil || pinned.Version != chart.Status.PinnedVersion {
+		return nil, fmt.Errorf("pinned chart version '%s' not found, a version bump is required: %w",
+			chart.Status.PinnedVersion, repo.ErrNoChartVersion)
+	}
+	chart.Status.AvailableVersion = ""
+	if newerChartVersion(latest.Version, pinned.Version) {
+		chart.Status.AvailableVersion = latest.Version
+	}
+	return pinned, nil
+}
+
+// newerChartVersion returns if the given version is a newer semantic version
+// than the given current version.
+func newerChartVersion(version, current string) bool {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	c, err := semver.NewVersion(current)
+	if err != nil {
+		return version != current
+	}
+	return v.GreaterThan(c)
+}
+
+// VersionBumpRequestedPredicate passes the updates of a HelmChart of which the
+// version bump annotation changed, as the ReconcileRequestedPredicate does for
+// the reconcile request annotation.
+type VersionBumpRequestedPredicate struct {
+	predicate.Funcs
+}
+
+func (VersionBumpRequestedPredicate) Update(e event.UpdateEvent) bool {
+	return annotationChanged(e, sourcev1.VersionBumpAnnotation)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/helm"
+)
+
+// newVersionedChartRepository returns a ChartRepository of which the index
+// has the given versions of the 'podinfo' chart.
+func newVersionedChartRepository(t *testing.T, versions ...string) *helm.ChartRepository {
+	t.Helper()
+	index := repo.NewIndexFile()
+	for _, v := range versions {
+		if err := index.MustAdd(&chart.Metadata{APIVersion: chart.APIVersionV2, Name: "podinfo", Version: v},
+			"podinfo-"+v+".tgz", "https://example.com/charts", "sha256:"+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.SortEntries()
+	return &helm.ChartRepository{URL: "https://example.com/charts", Index: index}
+}
+
+func TestResolveChartVersion(t *testing.T) {
+	newChart := func(policy string) *sourcev1.HelmChart {
+		return &sourcev1.HelmChart{
+			ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default", Generation: 1},
+			Spec:       sourcev1.HelmChartSpec{Chart: "podinfo", Version: ">=1.0.0 <2.0.0", VersionUpdatePolicy: policy},
+		}
+	}
+	// resolve resolves the version of the given chart against the given
+	// repository, like the reconciliation of the chart
+	resolve := func(t *testing.T, c *sourcev1.HelmChart, chartRepo *helm.ChartRepository) string {
+		t.Helper()
+		latest, err := chartRepo.Get(c.Spec.Chart, c.Spec.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := resolveChartVersion(c, chartRepo, latest)
+		if err != nil {
+			t.Fatalf("resolveChartVersion() error = %v", err)
+		}
+		return v.Version
+	}
+
+	t.Run("auto", func(t *testing.T) {
+		c := newChart(sourcev1.VersionUpdatePolicyAuto)
+		if v := resolve(t, c, newVersionedChartRepository(t, "1.0.0")); v != "1.0.0" {
+			t.Errorf("version = %s, want 1.0.0", v)
+		}
+		if v := resolve(t, c, newVersionedChartRepository(t, "1.0.0", "1.1.0", "2.0.0")); v != "1.1.0" {
+			t.Errorf("version = %s, want the latest matching version 1.1.0", v)
+		}
+		if c.Status.PinnedVersion != "" || c.Status.AvailableVersion != "" {
+			t.Errorf("pinned version = %q, available version = %q, want none", c.Status.PinnedVersion, c.Status.AvailableVersion)
+		}
+	})
+
+	t.Run("manual", func(t *testing.T) {
+		c := newChart(sourcev1.VersionUpdatePolicyManual)
+
+		// the version is resolved when the chart is created
+		if v := resolve(t, c, newVersionedChartRepository(t, "1.0.0")); v != "1.0.0" {
+			t.Errorf("version = %s, want 1.0.0", v)
+		}
+		if c.Status.PinnedVersion != "1.0.0" || c.Status.PinnedGeneration != 1 {
+			t.Errorf("pinned version = %q at generation %d, want 1.0.0 at generation 1", c.Status.PinnedVersion, c.Status.PinnedGeneration)
+		}
+
+		// a newer matching version is detected, but not adopted
+		upgraded := newVersionedChartRepository(t, "1.0.0", "1.1.0", "2.0.0")
+		if v := resolve(t, c, upgraded); v != "1.0.0" {
+			t.Errorf("version = %s, want the pinned version 1.0.0", v)
+		}
+		if c.Status.AvailableVersion != "1.1.0" {
+			t.Errorf("available version = %q, want 1.1.0", c.Status.AvailableVersion)
+		}
+
+		// the version is bumped with the annotation, once
+		c.SetAnnotations(map[string]string{sourcev1.VersionBumpAnnotation: "2021-10-01T10:00:00Z"})
+		if v := resolve(t, c, upgraded); v != "1.1.0" {
+			t.Errorf("version after a bump = %s, want 1.1.0", v)
+		}
+		if c.Status.PinnedVersion != "1.1.0" || c.Status.AvailableVersion != "" ||
+			c.Status.LastHandledVersionBumpAt != "2021-10-01T10:00:00Z" {
+			t.Errorf("status after a bump = %+v, want 1.1.0 pinned and the bump handled", c.Status)
+		}
+		if v := resolve(t, c, newVersionedChartRepository(t, "1.0.0", "1.1.0", "1.2.0")); v != "1.1.0" {
+			t.Errorf("version after a handled bump = %s, want the pinned version 1.1.0", v)
+		}
+		if c.Status.AvailableVersion != "1.2.0" {
+			t.Errorf("available version = %q, want 1.2.0", c.Status.AvailableVersion)
+		}
+
+		// an older bump request is not handled
+		c.SetAnnotations(map[string]string{sourcev1.VersionBumpAnnotation: "2021-10-01T09:00:00Z"})
+		if v := resolve(t, c, newVersionedChartRepository(t, "1.0.0", "1.1.0", "1.2.0")); v != "1.1.0" {
+			t.Errorf("version after an older bump = %s, want the pinned version 1.1.0", v)
+		}
+
+		// the version is resolved again when the spec changes
+		c.Generation = 2
+		if v := resolve(t, c, newVersionedChartRepository(t, "1.0.0", "1.1.0", "1.2.0")); v != "1.2.0" {
+			t.Errorf("version after a spec change = %s, want 1.2.0", v)
+		}
+		if c.Status.PinnedVersion != "1.2.0" || c.Status.PinnedGeneration != 2 || c.Status.AvailableVersion != "" {
+			t.Errorf("status after a spec change = %+v, want 1.2.0 pinned at generation 2", c.Status)
+		}
+	})
+
+	t.Run("pinned version removed", func(t *testing.T) {
+		c := newChart(sourcev1.VersionUpdatePolicyManual)
+		c.Status.PinnedVersion, c.Status.PinnedGeneration = "1.0.0", 1
+		chartRepo := newVersionedChartRepository(t, "1.1.0")
+		latest, err := chartRepo.Get(c.Spec.Chart, c.Spec.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resolveChartVersion(c, chartRepo, latest); !errors.Is(err, repo.ErrNoChartVersion) {
+			t.Errorf("resolveChartVersion() error = %v, want %v", err, repo.ErrNoChartVersion)
+		}
+		if c.Status.PinnedVersion != "1.0.0" {
+			t.Errorf("pinned version = %q, want 1.0.0 to be kept", c.Status.PinnedVersion)
+		}
+	})
+
+	t.Run("switch to auto", func(t *testing.T) {
+		c := newChart(sourcev1.VersionUpdatePolicyManual)
+		c.Status.PinnedVersion, c.Status.PinnedGeneration, c.Status.AvailableVersion = "1.0.0", 1, "1.1.0"
+		c.Spec.VersionUpdatePolicy = ""
+		if v := resolve(t, c, newVersionedChartRepository(t, "1.0.0", "1.1.0")); v != "1.1.0" {
+			t.Errorf("version = %s, want 1.1.0", v)
+		}
+		if c.Status.PinnedVersion != "" || c.Status.PinnedGeneration != 0 || c.Status.AvailableVersion != "" {
+			t.Errorf("status = %+v, want the pin to be removed", c.Status)
+		}
+	})
+}
+
+func TestVersionBumpRequestedPredicate(t *testing.T) {
+	annotated := func(annotations map[string]string) *sourcev1.HelmChart {
+		return &sourcev1.HelmChart{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+	}
+	p := VersionBumpRequestedPredicate{}
+	if !p.Update(event.UpdateEvent{ObjectOld: annotated(nil), ObjectNew: annotated(map[string]string{sourcev1.VersionBumpAnnotation: "a"})}) {
+		t.Error("Update() of an added bump annotation = false")
+	}
+	if p.Update(event.UpdateEvent{ObjectOld: annotated(map[string]string{sourcev1.VersionBumpAnnotation: "a"}),
+		ObjectNew: annotated(map[string]string{sourcev1.VersionBumpAnnotation: "a", sourcev1.ForceRefetchAnnotation: "b"})}) {
+		t.Error("Update() of an unchanged bump annotation = true")
+	}
+}
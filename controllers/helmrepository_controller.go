@@ -33,10 +33,14 @@ import (
 	kuberecorder "k8s.io/client-go/tools/record"
 	"k8s.io/client-go/tools/reference"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"sigs.k8s.io/yaml"
 
 	"github.com/fluxcd/pkg/apis/meta"
@@ -45,13 +49,18 @@ import (
 	"github.com/fluxcd/pkg/runtime/predicates"
 
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/egress"
 	"github.com/fluxcd/source-controller/internal/helm"
+	"github.com/fluxcd/source-controller/internal/redact"
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
 )
 
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=helmrepositories,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=helmrepositories/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=helmrepositories/finalizers,verbs=get;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
 
 // HelmRepositoryReconciler reconciles a HelmRepository object
 type HelmRepositoryReconciler struct {
@@ -61,11 +70,28 @@ type HelmRepositoryReconciler struct {
 	Getters               getter.Providers
 	EventRecorder         kuberecorder.EventRecorder
 	ExternalEventRecorder *events.Recorder
+	EventLimiter          *EventLimiter
+	FetchMetrics          *FetchMetrics
 	MetricsRecorder       *metrics.Recorder
+	retryLimiter          *RetryLimiter
+	intervalJitter        *IntervalJitter
+	validator             *SourceValidator
+	defaults              *SourceDefaults
+	reconcileTracer       *ReconcileTracer
 }
 
 type HelmRepositoryReconcilerOptions struct {
 	MaxConcurrentReconciles int
+	MinRetryDelay           time.Duration
+	MaxRetryDelay           time.Duration
+	Drainer                 *Drainer
+	IntervalJitter          *IntervalJitter
+	ReconcileTracker        *ReconcileTracker
+	Validator               *SourceValidator
+	Defaults                *SourceDefaults
+	ReconcileTracer         *ReconcileTracer
+	ReconcileSpans          *ReconcileSpans
+	NamespaceLimiter        *NamespaceLimiter
 }
 
 func (r *HelmRepositoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -73,15 +99,56 @@ func (r *HelmRepositoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
 }
 
 func (r *HelmRepositoryReconciler) SetupWithManagerAndOptions(mgr ctrl.Manager, opts HelmRepositoryReconcilerOptions) error {
+	r.retryLimiter = NewRetryLimiter(opts.MinRetryDelay, opts.MaxRetryDelay)
+	r.intervalJitter = opts.IntervalJitter
+	r.validator = opts.Validator
+	r.defaults = opts.Defaults
+	r.reconcileTracer = opts.ReconcileTracer
+	if err := mgr.GetCache().IndexField(context.TODO(), &sourcev1.HelmRepository{}, sourcev1.SecretIndexKey,
+		indexBySecretRefs); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+	if err := mgr.GetCache().IndexField(context.TODO(), &sourcev1.HelmRepository{}, sourcev1.ConfigMapIndexKey,
+		indexByConfigMapRefs); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+
+	recordMaxConcurrentReconciles(sourcev1.HelmRepositoryKind, opts.MaxConcurrentReconciles)
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&sourcev1.HelmRepository{}).
-		WithEventFilter(predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{})).
-		WithOptions(controller.Options{MaxConcurrentReconciles: opts.MaxConcurrentReconciles}).
-		Complete(r)
+		For(&sourcev1.HelmRepository{}, builder.WithPredicates(
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}, ForceRefetchRequestedPredicate{}),
+		)).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSecretChange),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForConfigMapChange),
+		).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: opts.MaxConcurrentReconciles,
+			RateLimiter:             r.retryLimiter.rateLimiter(),
+		}).
+		Complete(opts.Drainer.Reconciler(opts.NamespaceLimiter.Reconciler(sourcev1.HelmRepositoryKind,
+			opts.ReconcileSpans.Reconciler(sourcev1.HelmRepositoryKind,
+				opts.ReconcileTracker.Reconciler(sourcev1.HelmRepositoryKind, r)))))
+}
+
+// requestsForSecretChange returns the reconcile requests for the HelmRepository objects that reference the given Secret.
+func (r *HelmRepositoryReconciler) requestsForSecretChange(o client.Object) []reconcile.Request {
+	return requestsForSecretChange(r, &sourcev1.HelmRepositoryList{}, o)
+}
+
+// requestsForConfigMapChange returns the reconcile requests for the HelmRepository objects that reference the given ConfigMap.
+func (r *HelmRepositoryReconciler) requestsForConfigMapChange(o client.Object) []reconcile.Request {
+	return requestsForConfigMapChange(r, &sourcev1.HelmRepositoryList{}, o)
 }
 
-func (r *HelmRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *HelmRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, retErr error) {
 	start := time.Now()
+	// redact the credentials from the error logged by the controller
+	defer func() { retErr = redact.Error(retErr) }()
 	log := logr.FromContext(ctx)
 
 	var repository sourcev1.HelmRepository
@@ -89,6 +156,14 @@ func (r *HelmRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// Record suspended status metric
+	defer r.recordSuspension(ctx, repository)
+
+	// Record the artifact URLs advertised in the status, to map the errors
+	// of the artifact server back to the object, and the size of the artifact
+	advertiseArtifact(sourcev1.HelmRepositoryKind, &repository)
+	recordArtifactSize(sourcev1.HelmRepositoryKind, &repository)
+
 	// Add our finalizer if it does not exist
 	if !controllerutil.ContainsFinalizer(&repository, sourcev1.SourceFinalizer) {
 		controllerutil.AddFinalizer(&repository, sourcev1.SourceFinalizer)
@@ -100,6 +175,9 @@ func (r *HelmRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 
 	// Examine if the object is under deletion
 	if !repository.ObjectMeta.DeletionTimestamp.IsZero() {
+		forgetReconciledSource(sourcev1.HelmRepositoryKind, req.NamespacedName)
+		r.FetchMetrics.forget(sourcev1.HelmRepositoryKind, &repository)
+		setReconcilePhase(ctx, reconcilePhaseDeleting)
 		return r.reconcileDelete(ctx, repository)
 	}
 
@@ -109,6 +187,32 @@ func (r *HelmRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return ctrl.Result{}, nil
 	}
 
+	// apply the default interval and timeout of the controller, if the spec
+	// omits them
+	r.defaults.apply(&repository)
+
+	// stagger the first reconciliations of the sources that are up to date
+	// after the start of the controller
+	upToDate := sourceUpToDate(&repository, repository.Status.ObservedGeneration,
+		repository.Status.GetLastHandledReconcileRequest(), repository.Status.Conditions)
+	if delay := r.intervalJitter.startupDelay(sourcev1.HelmRepositoryKind, req.NamespacedName, upToDate, repository.GetInterval().Duration); delay > 0 {
+		log.Info(fmt.Sprintf("Delaying the first reconciliation by %s", delay.String()))
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	recordReconcileStart(sourcev1.HelmRepositoryKind, start, repository.GetInterval().Duration)
+	ctx = r.reconcileTracer.start(ctx, start)
+
+	// cap the backoff of failed reconciliations at the retry interval
+	r.retryLimiter.setMaxDelay(req, repository.Spec.RetryInterval)
+
+	// record the duration and result of the reconciliation
+	reconciled := &repository
+	defer func() {
+		recordReconcile(sourcev1.HelmRepositoryKind, reconciled, start, retErr)
+		advertiseArtifact(sourcev1.HelmRepositoryKind, reconciled)
+		recordArtifactSize(sourcev1.HelmRepositoryKind, reconciled)
+	}()
+
 	// record reconciliation duration
 	if r.MetricsRecorder != nil {
 		objRef, err := reference.GetReference(r.Scheme, &repository)
@@ -118,16 +222,30 @@ func (r *HelmRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		defer r.MetricsRecorder.RecordDuration(*objRef, start)
 	}
 
-	// set initial status
-	if resetRepository, ok := r.resetStatus(repository); ok {
-		repository = resetRepository
-		if err := r.updateStatus(ctx, req, repository.Status); err != nil {
+	// stall the repository if its spec is invalid, e.g. it was created before
+	// the validation webhook was enabled, until it is corrected
+	if err := r.validator.validate(&repository); err != nil {
+		stalledRepository := sourcev1.HelmRepositoryStalled(*repository.DeepCopy(), sourcev1.SpecInvalidReason, err.Error())
+		stalledRepository.Status.ObservedGeneration = stalledRepository.Generation
+		stalledRepository.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, stalledRepository.Status.Conditions, nil)
+		reconciled = &stalledRepository
+		if err := r.updateStatus(ctx, req, stalledRepository.Status); err != nil {
 			log.Error(err, "unable to update status")
 			return ctrl.Result{Requeue: true}, err
 		}
-		r.recordReadiness(ctx, repository)
+		r.event(ctx, stalledRepository, events.EventSeverityError, err.Error(), nil)
+		r.recordReadiness(ctx, stalledRepository)
+		return ctrl.Result{}, nil
 	}
 
+	// set initial status
+	repository, _ = r.resetStatus(repository)
+	if err := r.updateStatus(ctx, req, repository.Status); err != nil {
+		log.Error(err, "unable to update status")
+		return ctrl.Result{Requeue: true}, err
+	}
+	r.recordReadiness(ctx, repository)
+
 	// record the value of the reconciliation request, if any
 	// TODO(hidde): would be better to defer this in combination with
 	//   always patching the status sub-resource after a reconciliation.
@@ -136,60 +254,142 @@ func (r *HelmRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 	}
 
 	// purge old artifacts from storage
+	tracePhase(ctx, tracePhaseGC)
 	if err := r.gc(repository); err != nil {
 		log.Error(err, "unable to purge old artifacts")
 	}
 
+	// bypass the caches if the repository was annotated with a force
+	// refetch request newer than the handled one
+	refetch, force := forceRefetchRequest(&repository, repository.Status.LastHandledForceRefetchAt)
+
 	// reconcile repository by downloading the index.yaml file
-	reconciledRepository, reconcileErr := r.reconcile(ctx, *repository.DeepCopy())
+	setReconcilePhase(ctx, reconcilePhaseFetching)
+	fetchCtx, rateLimits := transport.WithRateLimits(ctx)
+	reconciledRepository, reconcileErr := r.reconcile(withForceRefetch(fetchCtx, force), *repository.DeepCopy())
+	if force && reconcileErr == nil {
+		reconciledRepository.Status.LastHandledForceRefetchAt = refetch
+	}
+
+	// delay the retry until the reset of the rate limit of the upstream, if
+	// the reconciliation was rejected by it
+	reconcileErr = recordUpstreamRateLimit(ctx, r.retryLimiter, req, sourcev1.HelmRepositoryKind, &repository,
+		upstreamURL(&repository), rateLimits, reconcileErr)
+
+	// stall the repository on a connection denied by the egress policy, as
+	// retrying does not resolve it
+	if egress.IsDenied(reconcileErr) {
+		reconciledRepository = sourcev1.HelmRepositoryStalled(reconciledRepository, sourcev1.EgressDeniedReason, reconcileErr.Error())
+	}
+	reconciled = &reconciledRepository
+
+	// record the artifact written by the reconciliation as in the storage
+	r.Storage.recordArtifactInStorage(&reconciledRepository.Status.Conditions, reconciledRepository.Generation,
+		repository.GetArtifact(), reconciledRepository.GetArtifact())
+
+	// record the failures to fetch the upstream
+	r.FetchMetrics.record(sourcev1.HelmRepositoryKind, &reconciledRepository, reconciledRepository.Status.Conditions, reconcileErr)
+
+	// record the time of the next retry of a failed reconciliation
+	reconciledRepository.Status.NextRetryTime = r.retryLimiter.nextRetryTime(req, reconcileErr, reconciledRepository.Status.Conditions)
+
+	// record the trace of the reconciliation, and the revision of its span
+	reconciledRepository.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, reconciledRepository.Status.Conditions, reconcileErr)
+	spanRevision(ctx, reconciledRepository.GetArtifact())
 
 	// update status with the reconciliation result
+	setReconcilePhase(ctx, reconcilePhaseUpdatingStatus)
 	if err := r.updateStatus(ctx, req, reconciledRepository.Status); err != nil {
 		log.Error(err, "unable to update status")
 		return ctrl.Result{Requeue: true}, err
 	}
 
+	// if the artifact exceeds the maximum size, record the failure and
+	// requeue at the interval, as retrying does not resolve it
+	if reconcileErr != nil && apimeta.IsStatusConditionTrue(reconciledRepository.Status.Conditions, meta.StalledCondition) {
+		r.event(ctx, reconciledRepository, events.EventSeverityError, reconcileErr.Error(), nil)
+		r.recordReadiness(ctx, reconciledRepository)
+		if reconcileRequestPending(ctx, r, &reconciledRepository, reconciledRepository.Status.GetLastHandledReconcileRequest()) {
+			return ctrl.Result{Requeue: true}, reconcileErr
+		}
+		return ctrl.Result{RequeueAfter: r.intervalJitter.interval(repository.GetInterval().Duration)}, nil
+	}
+
 	// if reconciliation failed, record the failure and requeue immediately
 	if reconcileErr != nil {
-		r.event(ctx, reconciledRepository, events.EventSeverityError, reconcileErr.Error())
+		r.event(ctx, reconciledRepository, events.EventSeverityError, reconcileErr.Error(), nil)
 		r.recordReadiness(ctx, reconciledRepository)
+		if next := reconciledRepository.Status.NextRetryTime; next != nil {
+			log.Info(fmt.Sprintf("Reconciliation failed, retrying at %s", next.Format(time.RFC3339)))
+		}
 		return ctrl.Result{Requeue: true}, reconcileErr
 	}
 
-	// emit revision change event
-	if repository.Status.Artifact == nil || reconciledRepository.Status.Artifact.Revision != repository.Status.Artifact.Revision {
-		r.event(ctx, reconciledRepository, events.EventSeverityInfo, sourcev1.HelmRepositoryReadyMessage(reconciledRepository))
+	// emit revision change event and purge the previous artifacts, a
+	// repository of the 'oci' type has no artifact and is announced when it
+	// becomes ready
+	changed := reconciledRepository.Status.Artifact != nil && (repository.Status.Artifact == nil ||
+		reconciledRepository.Status.Artifact.Revision != repository.Status.Artifact.Revision)
+	if reconciledRepository.Spec.Type == sourcev1.HelmRepositoryTypeOCI {
+		changed = !apimeta.IsStatusConditionTrue(repository.Status.Conditions, meta.ReadyCondition)
+	}
+	if changed {
+		metadata := r.Storage.artifactMetadata(reconciledRepository.GetArtifact(), upstreamURL(&reconciledRepository))
+		r.event(ctx, reconciledRepository, events.EventSeverityInfo, sourcev1.HelmRepositoryReadyMessage(reconciledRepository), metadata)
+		if err := r.gc(reconciledRepository); err != nil {
+			log.Error(err, "unable to purge old artifacts")
+		}
 	}
 	r.recordReadiness(ctx, reconciledRepository)
 
+	// shift the next run by a jitter, for the sources to drift apart
+	interval := r.intervalJitter.interval(repository.GetInterval().Duration)
 	log.Info(fmt.Sprintf("Reconciliation finished in %s, next run in %s",
 		time.Now().Sub(start).String(),
-		repository.GetInterval().Duration.String(),
+		interval.String(),
 	))
 
-	return ctrl.Result{RequeueAfter: repository.GetInterval().Duration}, nil
+	// reconcile again right away if the object was annotated with a
+	// reconcile request during the reconciliation, as it is not handled
+	if reconcileRequestPending(ctx, r, &reconciledRepository, reconciledRepository.Status.GetLastHandledReconcileRequest()) {
+		log.Info("Reconcile request received during the reconciliation, reconciling again")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: interval}, nil
 }
 
 func (r *HelmRepositoryReconciler) reconcile(ctx context.Context, repository sourcev1.HelmRepository) (sourcev1.HelmRepository, error) {
+	if repository.Spec.Type == sourcev1.HelmRepositoryTypeOCI {
+		return r.reconcileOCI(ctx, repository)
+	}
+
+	tracePhase(ctx, tracePhaseAuth)
 	clientOpts := []getter.Option{
 		getter.WithURL(repository.Spec.URL),
 		getter.WithTimeout(repository.Spec.Timeout.Duration),
 		getter.WithPassCredentialsAll(repository.Spec.PassCredentials),
 	}
+	var secret *corev1.Secret
 	if repository.Spec.SecretRef != nil {
 		name := types.NamespacedName{
 			Namespace: repository.GetNamespace(),
 			Name:      repository.Spec.SecretRef.Name,
 		}
 
-		var secret corev1.Secret
-		err := r.Client.Get(ctx, name, &secret)
+		secret = &corev1.Secret{}
+		err := r.Client.Get(ctx, name, secret)
 		if err != nil {
 			err = fmt.Errorf("auth secret error: %w", err)
 			return sourcev1.HelmRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
 		}
+		corrected, warnings := secretdata.Correct(*secret)
+		for _, w := range warnings {
+			r.event(ctx, repository, events.EventSeverityError, w, nil)
+		}
+		secret = &corrected
 
-		opts, cleanup, err := helm.ClientOptionsFromSecret(secret)
+		opts, cleanup, err := helm.ClientOptionsFromSecret(*secret)
 		if err != nil {
 			err = fmt.Errorf("auth options error: %w", err)
 			return sourcev1.HelmRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
@@ -198,6 +398,19 @@ func (r *HelmRepositoryReconciler) reconcile(ctx context.Context, repository sou
 		clientOpts = append(clientOpts, opts...)
 	}
 
+	proxy, warnings, err := proxyFromSecretRef(ctx, r.Client, repository.GetNamespace(), repository.Spec.ProxySecretRef)
+	for _, w := range warnings {
+		r.event(ctx, repository, events.EventSeverityError, w, nil)
+	}
+	if err != nil {
+		return sourcev1.HelmRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+	}
+	caBundle, err := caBundleFromRef(ctx, r.Client, repository.GetNamespace(), repository.Spec.CARef)
+	if err != nil {
+		return sourcev1.HelmRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+	}
+
+	tracePhase(ctx, tracePhaseFetch)
 	chartRepo, err := helm.NewChartRepository(repository.Spec.URL, r.Getters, clientOpts)
 	if err != nil {
 		switch err.(type) {
@@ -207,10 +420,32 @@ func (r *HelmRepositoryReconciler) reconcile(ctx context.Context, repository sou
 			return sourcev1.HelmRepositoryNotReady(repository, sourcev1.IndexationFailedReason, err.Error()), err
 		}
 	}
-	if err := chartRepo.DownloadIndex(); err != nil {
+	// the index is downloaded with the getter of the controller, which sends
+	// conditional requests with the validators of the index of the current
+	// artifact, unless forced to refetch
+	if chartRepo.Client, err = newTransportGetter(&repository, secret, proxy, caBundle); err != nil {
+		err = fmt.Errorf("auth options error: %w", err)
+		return sourcev1.HelmRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+	}
+	var validators helm.CacheValidators
+	if !forceRefetch(ctx) {
+		validators = r.loadIndexValidators(repository)
+	}
+	validators, modified, err := chartRepo.DownloadIndexIfModified(validators)
+	if err != nil {
 		err = fmt.Errorf("failed to download repository index: %w", err)
 		return sourcev1.HelmRepositoryNotReady(repository, sourcev1.IndexationFailedReason, err.Error()), err
 	}
+	// return early on an index which is not modified since the current
+	// artifact
+	if !modified {
+		tracePhaseDetail(ctx, "revision %s, not modified", repository.GetArtifact().Revision)
+		if !r.Storage.currentURL(repository.GetArtifact().URL) {
+			r.Storage.SetArtifactURL(repository.GetArtifact())
+			repository.Status.URL = r.Storage.SetHostname(repository.Status.URL)
+		}
+		return repository, nil
+	}
 
 	indexBytes, err := yaml.Marshal(&chartRepo.Index)
 	if err != nil {
@@ -221,15 +456,27 @@ func (r *HelmRepositoryReconciler) reconcile(ctx context.Context, repository sou
 		repository.ObjectMeta.GetObjectMeta(),
 		hash,
 		fmt.Sprintf("index-%s.yaml", hash))
-	// return early on unchanged index
-	if apimeta.IsStatusConditionTrue(repository.Status.Conditions, meta.ReadyCondition) && repository.GetArtifact().HasRevision(artifact.Revision) {
-		if artifact.URL != repository.GetArtifact().URL {
+	tracePhaseDetail(ctx, "revision %s", hash)
+	// return early on unchanged index, unless forced to refetch
+	if !forceRefetch(ctx) && apimeta.IsStatusConditionTrue(repository.Status.Conditions, meta.ReadyCondition) && r.hasRevision(repository.GetArtifact(), artifact.Revision, indexBytes) {
+		if !r.Storage.currentURL(repository.GetArtifact().URL) {
 			r.Storage.SetArtifactURL(repository.GetArtifact())
 			repository.Status.URL = r.Storage.SetHostname(repository.Status.URL)
 		}
+		// the validators may have changed without changing the index
+		if err := r.saveIndexValidators(repository, *repository.GetArtifact(), validators); err != nil {
+			logr.FromContext(ctx).Error(err, "unable to write index validators")
+		}
 		return repository, nil
 	}
 
+	// ensure there is space for the artifact
+	if err := r.storagePruner().ensureSpace(ctx); err != nil {
+		return sourcev1.HelmRepositoryNotReady(repository, sourcev1.StorageFullReason, err.Error()), err
+	}
+
+	setReconcilePhase(ctx, reconcilePhaseStoring)
+	tracePhase(ctx, tracePhaseArchive)
 	// create artifact dir
 	err = r.Storage.MkdirAll(artifact)
 	if err != nil {
@@ -246,12 +493,22 @@ func (r *HelmRepositoryReconciler) reconcile(ctx context.Context, repository sou
 	defer unlock()
 
 	// save artifact to storage
-	if err := r.Storage.AtomicWriteFile(&artifact, bytes.NewReader(indexBytes), 0644); err != nil {
+	storage := r.Storage.WithArtifactMaxSize(repository.Spec.MaxArtifactSize)
+	if err := storage.AtomicWriteFile(&artifact, bytes.NewReader(indexBytes), 0644); err != nil {
 		err = fmt.Errorf("unable to write repository index file: %w", err)
-		return sourcev1.HelmRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
+		if isArtifactSizeError(err) {
+			return sourcev1.HelmRepositoryStalled(repository, sourcev1.ArtifactTooLargeReason, err.Error()), err
+		}
+		return sourcev1.HelmRepositoryNotReady(repository, storageFailureReason(err), err.Error()), err
+	}
+
+	// record the validators of the index for the next reconciliation
+	if err := r.saveIndexValidators(repository, artifact, validators); err != nil {
+		logr.FromContext(ctx).Error(err, "unable to write index validators")
 	}
 
 	// update index symlink
+	tracePhase(ctx, tracePhaseStore)
 	indexURL, err := r.Storage.Symlink(artifact, "index.yaml")
 	if err != nil {
 		err = fmt.Errorf("storage error: %w", err)
@@ -262,11 +519,65 @@ func (r *HelmRepositoryReconciler) reconcile(ctx context.Context, repository sou
 	return sourcev1.HelmRepositoryReady(repository, artifact, indexURL, sourcev1.IndexationSucceededReason, message), nil
 }
 
+// reconcileOCI reconciles a HelmRepository of the 'oci' type, which has no
+// index to fetch and thus no artifact: it validates the URL and the
+// credentials of the secret for the registry, and removes the artifacts of a
+// repository of which the type changed. The versions of the charts are
+// resolved against the tags of the registry by the HelmChart reconciler.
+func (r *HelmRepositoryReconciler) reconcileOCI(ctx context.Context, repository sourcev1.HelmRepository) (sourcev1.HelmRepository, error) {
+	tracePhase(ctx, tracePhaseAuth)
+	var secret *corev1.Secret
+	if repository.Spec.SecretRef != nil {
+		name := types.NamespacedName{
+			Namespace: repository.GetNamespace(),
+			Name:      repository.Spec.SecretRef.Name,
+		}
+
+		secret = &corev1.Secret{}
+		if err := r.Client.Get(ctx, name, secret); err != nil {
+			err = fmt.Errorf("auth secret error: %w", err)
+			return sourcev1.HelmRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+		}
+		corrected, warnings := secretdata.Correct(*secret)
+		for _, w := range warnings {
+			r.event(ctx, repository, events.EventSeverityError, w, nil)
+		}
+		secret = &corrected
+	}
+	if err := helm.ValidateOCIChartRepository(repository.Spec.URL, secret); err != nil {
+		err = fmt.Errorf("auth options error: %w", err)
+		return sourcev1.HelmRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+	}
+
+	if artifact := repository.GetArtifact(); artifact != nil {
+		if err := r.Storage.RemoveAll(*artifact); err != nil {
+			err = fmt.Errorf("unable to remove the artifacts of the repository index: %w", err)
+			return sourcev1.HelmRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
+		}
+	}
+
+	message := fmt.Sprintf("Helm repository of type '%s' is ready", sourcev1.HelmRepositoryTypeOCI)
+	return sourcev1.HelmRepositoryOCIReady(repository, sourcev1.RegistryConfiguredReason, message), nil
+}
+
+// hasRevision returns if the given artifact has the revision of the given
+// index, in the current or in the legacy SHA1 format. This keeps the artifacts
+// created by previous versions until the index changes, except in FIPS mode.
+func (r *HelmRepositoryReconciler) hasRevision(artifact *sourcev1.Artifact, revision string, index []byte) bool {
+	if artifact.HasRevision(revision) {
+		return true
+	}
+	if artifact == nil || len(artifact.Revision) != legacyChecksumLength {
+		return false
+	}
+	return artifact.HasRevision(r.Storage.LegacyChecksum(bytes.NewReader(index)))
+}
+
 func (r *HelmRepositoryReconciler) reconcileDelete(ctx context.Context, repository sourcev1.HelmRepository) (ctrl.Result, error) {
 	// Our finalizer is still present, so lets handle garbage collection
 	if err := r.gc(repository); err != nil {
 		r.event(ctx, repository, events.EventSeverityError,
-			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()))
+			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()), nil)
 		// Return the error so we retry the failed garbage collection
 		return ctrl.Result{}, err
 	}
@@ -285,54 +596,100 @@ func (r *HelmRepositoryReconciler) reconcileDelete(ctx context.Context, reposito
 }
 
 // resetStatus returns a modified v1beta1.HelmRepository and a boolean indicating
-// if the status field has been reset.
+// if the status field has been reset. The meta.ReconcilingCondition of a
+// status that is not reset is set, as a reconciliation is under way.
 func (r *HelmRepositoryReconciler) resetStatus(repository sourcev1.HelmRepository) (sourcev1.HelmRepository, bool) {
-	// We do not have an artifact, or it does no longer exist
-	if repository.GetArtifact() == nil || !r.Storage.ArtifactExist(*repository.GetArtifact()) {
+	// a repository of the 'oci' type has no artifact to verify
+	if repository.Spec.Type == sourcev1.HelmRepositoryTypeOCI && repository.GetArtifact() == nil {
+		changed := apimeta.FindStatusCondition(repository.Status.Conditions, sourcev1.ArtifactInStorageCondition) != nil
+		apimeta.RemoveStatusCondition(&repository.Status.Conditions, sourcev1.ArtifactInStorageCondition)
+		if repository.Generation != repository.Status.ObservedGeneration {
+			repository = sourcev1.HelmRepositoryProgressing(repository)
+			changed = true
+		} else {
+			repository = sourcev1.HelmRepositoryReconciling(repository)
+		}
+		return repository, changed
+	}
+
+	// verify that the artifact is in the storage and intact
+	inStorage := r.Storage.artifactInStorage(repository.GetArtifact(), repository.Generation)
+	changed := false
+	switch {
+	case inStorage.Status != metav1.ConditionTrue:
+		// We do not have an artifact, or it is missing or corrupt
 		repository = sourcev1.HelmRepositoryProgressing(repository)
 		repository.Status.Artifact = nil
-		return repository, true
-	}
-	if repository.Generation != repository.Status.ObservedGeneration {
-		return sourcev1.HelmRepositoryProgressing(repository), true
+		changed = true
+	case repository.Generation != repository.Status.ObservedGeneration:
+		repository = sourcev1.HelmRepositoryProgressing(repository)
+		changed = true
+	default:
+		repository = sourcev1.HelmRepositoryReconciling(repository)
 	}
-	return repository, false
+	return repository, setArtifactInStorage(&repository.Status.Conditions, inStorage) || changed
 }
 
 // gc performs a garbage collection for the given v1beta1.HelmRepository.
-// It removes all but the current artifact except for when the
-// deletion timestamp is set, which will result in the removal of
-// all artifacts for the resource.
+// It removes the previous artifacts which exceed the retention of the
+// storage, except for when the deletion timestamp is set, which will
+// result in the removal of all artifacts for the resource.
 func (r *HelmRepositoryReconciler) gc(repository sourcev1.HelmRepository) error {
 	if !repository.DeletionTimestamp.IsZero() {
-		return r.Storage.RemoveAll(r.Storage.NewArtifactFor(repository.Kind, repository.GetObjectMeta(), "", "*"))
+		return r.Storage.RemoveDeleted(repository.Kind, repository.GetObjectMeta())
 	}
 	if repository.GetArtifact() != nil {
-		return r.Storage.RemoveAllButCurrent(*repository.GetArtifact())
+		_, err := r.Storage.GarbageCollect(*repository.GetArtifact())
+		return err
 	}
 	return nil
 }
 
 // event emits a Kubernetes event and forwards the event to notification controller if configured
-func (r *HelmRepositoryReconciler) event(ctx context.Context, repository sourcev1.HelmRepository, severity, msg string) {
+func (r *HelmRepositoryReconciler) event(ctx context.Context, repository sourcev1.HelmRepository, severity, msg string, metadata map[string]string) {
 	log := logr.FromContext(ctx)
+	msg = redact.String(msg)
+
+	// Duplicates are recorded as Kubernetes events nonetheless, which bump
+	// the count of the existing event
+	suppressed := r.EventLimiter.suppress(sourcev1.HelmRepositoryKind, &repository, severity, msg)
+	if suppressed == eventRateLimitedCause {
+		return
+	}
+
 	if r.EventRecorder != nil {
-		r.EventRecorder.Eventf(&repository, "Normal", severity, msg)
+		if len(metadata) > 0 {
+			r.EventRecorder.AnnotatedEventf(&repository, metadata, "Normal", severity, msg)
+		} else {
+			r.EventRecorder.Eventf(&repository, "Normal", severity, msg)
+		}
 	}
-	if r.ExternalEventRecorder != nil {
+	if r.ExternalEventRecorder != nil && suppressed == "" {
 		objRef, err := reference.GetReference(r.Scheme, &repository)
 		if err != nil {
 			log.Error(err, "unable to send event")
 			return
 		}
 
-		if err := r.ExternalEventRecorder.Eventf(*objRef, nil, severity, severity, msg); err != nil {
+		if err := r.ExternalEventRecorder.Eventf(*objRef, metadata, severity, severity, msg); err != nil {
 			log.Error(err, "unable to send event")
 			return
 		}
 	}
 }
 
+// storagePruner returns the pruner of the storage, which emits events with the
+// recorders of the reconciler.
+func (r *HelmRepositoryReconciler) storagePruner() *storagePruner {
+	return &storagePruner{
+		Reader:                r.Client,
+		Scheme:                r.Scheme,
+		Storage:               r.Storage,
+		EventRecorder:         r.EventRecorder,
+		ExternalEventRecorder: r.ExternalEventRecorder,
+	}
+}
+
 func (r *HelmRepositoryReconciler) recordReadiness(ctx context.Context, repository sourcev1.HelmRepository) {
 	log := logr.FromContext(ctx)
 	if r.MetricsRecorder == nil {
@@ -354,6 +711,8 @@ func (r *HelmRepositoryReconciler) recordReadiness(ctx context.Context, reposito
 }
 
 func (r *HelmRepositoryReconciler) updateStatus(ctx context.Context, req ctrl.Request, newStatus sourcev1.HelmRepositoryStatus) error {
+	redact.Conditions(newStatus.Conditions)
+
 	var repository sourcev1.HelmRepository
 	if err := r.Get(ctx, req.NamespacedName, &repository); err != nil {
 		return err
@@ -366,6 +725,14 @@ func (r *HelmRepositoryReconciler) updateStatus(ctx context.Context, req ctrl.Re
 }
 
 func (r *HelmRepositoryReconciler) recordSuspension(ctx context.Context, hr sourcev1.HelmRepository) {
+	name := types.NamespacedName{Namespace: hr.Namespace, Name: hr.Name}
+	if !hr.DeletionTimestamp.IsZero() {
+		forgetSuspendStatus(r.MetricsRecorder, sourcev1.HelmRepositoryKind, name)
+		return
+	}
+	if recordSuspend(sourcev1.HelmRepositoryKind, name, hr.Spec.Suspend) {
+		r.event(ctx, hr, events.EventSeverityInfo, suspendMessage(hr.Spec.Suspend), nil)
+	}
 	if r.MetricsRecorder == nil {
 		return
 	}
@@ -377,9 +744,34 @@ func (r *HelmRepositoryReconciler) recordSuspension(ctx context.Context, hr sour
 		return
 	}
 
-	if !hr.DeletionTimestamp.IsZero() {
-		r.MetricsRecorder.RecordSuspend(*objRef, false)
-	} else {
-		r.MetricsRecorder.RecordSuspend(*objRef, hr.Spec.Suspend)
+	r.MetricsRecorder.RecordSuspend(*objRef, hr.Spec.Suspend)
+}
+
+// withTransport replaces the getter of the given chart repository with the
+// getter of newTransportGetter if the given HelmRepository has a server name,
+// or if the given proxy is not nil, or if there are CA certificates of its
+// config map.
+func withTransport(chartRepo *helm.ChartRepository, repository *sourcev1.HelmRepository, secret *corev1.Secret,
+	proxy transport.ProxyFunc, caBundle []byte) error {
+	if repository.Spec.ServerName == "" && proxy == nil && len(caBundle) == 0 {
+		return nil
+	}
+	g, err := newTransportGetter(repository, secret, proxy, caBundle)
+	if err != nil {
+		return err
 	}
+	chartRepo.Client = g
+	return nil
+}
+
+// newTransportGetter returns the getter of helm.NewTransportGetter for the
+// given HelmRepository, configured with the given secret of the
+// HelmRepository, which may be nil, and the given proxy and CA certificates
+// of its config map, if any. Unlike the getter of Helm, which verifies the
+// certificates of the server against the caFile of the secret only, it
+// verifies them against the system roots too.
+func newTransportGetter(repository *sourcev1.HelmRepository, secret *corev1.Secret, proxy transport.ProxyFunc,
+	caBundle []byte) (getter.Getter, error) {
+	return helm.NewTransportGetter(repository.Spec.URL, repository.Spec.ServerName, proxy,
+		secretWithCABundle(secret, caBundle), repository.Spec.PassCredentials, repository.Spec.Timeout.Duration)
 }
@@ -0,0 +1,101 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/helm"
+)
+
+// indexValidatorsSuffix is the suffix of the path of the index validators,
+// which are stored as a sidecar file next to the artifact.
+const indexValidatorsSuffix = ".validators.json"
+
+// indexValidators records the ETag and Last-Modified headers of the response
+// of the index of a HelmRepository artifact, to allow the next reconciliation
+// to download the index only if it is modified.
+type indexValidators struct {
+	// URL is the URL of the repository the index was downloaded from.
+	URL string `json:"url"`
+
+	// ETag is the ETag header of the response.
+	ETag string `json:"etag,omitempty"`
+
+	// LastModified is the Last-Modified header of the response.
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// indexValidatorsArtifact returns the v1beta1.Artifact of the index validators
+// of the given artifact.
+func indexValidatorsArtifact(artifact sourcev1.Artifact) sourcev1.Artifact {
+	return sourcev1.Artifact{
+		Path:     artifact.Path + indexValidatorsSuffix,
+		Revision: artifact.Revision,
+	}
+}
+
+// loadIndexValidators returns the validators of the index of the current
+// artifact of the given v1beta1.HelmRepository, or zero validators if the
+// repository is not ready, the artifact is missing from storage, or the index
+// was downloaded from a different URL.
+func (r *HelmRepositoryReconciler) loadIndexValidators(repository sourcev1.HelmRepository) helm.CacheValidators {
+	artifact := repository.GetArtifact()
+	if artifact == nil || !apimeta.IsStatusConditionTrue(repository.Status.Conditions, meta.ReadyCondition) ||
+		!r.Storage.ArtifactExist(*artifact) {
+		return helm.CacheValidators{}
+	}
+	b, err := os.ReadFile(r.Storage.LocalPath(indexValidatorsArtifact(*artifact)))
+	if err != nil {
+		return helm.CacheValidators{}
+	}
+	var v indexValidators
+	if err := json.Unmarshal(b, &v); err != nil || v.URL != repository.Spec.URL {
+		return helm.CacheValidators{}
+	}
+	return helm.CacheValidators{ETag: v.ETag, LastModified: v.LastModified}
+}
+
+// saveIndexValidators atomically writes the given validators of the index of
+// the given v1beta1.HelmRepository for the given artifact, or removes them if
+// there are none.
+func (r *HelmRepositoryReconciler) saveIndexValidators(repository sourcev1.HelmRepository, artifact sourcev1.Artifact,
+	validators helm.CacheValidators) error {
+	validatorsArtifact := indexValidatorsArtifact(artifact)
+	if validators.IsZero() {
+		if err := os.Remove(r.Storage.LocalPath(validatorsArtifact)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(indexValidators{
+		URL:          repository.Spec.URL,
+		ETag:         validators.ETag,
+		LastModified: validators.LastModified,
+	})
+	if err != nil {
+		return err
+	}
+	return r.Storage.AtomicWriteFile(&validatorsArtifact, bytes.NewReader(b), 0644)
+}
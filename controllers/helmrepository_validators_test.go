@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/helm"
+)
+
+func TestHelmRepositoryReconciler_indexValidators(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	r := &HelmRepositoryReconciler{Storage: storage}
+
+	repository := sourcev1.HelmRepository{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.HelmRepositoryKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"},
+		Spec:       sourcev1.HelmRepositorySpec{URL: "https://stefanprodan.github.io/podinfo"},
+	}
+	artifact := storage.NewArtifactFor(repository.Kind, repository.GetObjectMeta(), "abc", "index-abc.yaml")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&artifact, strings.NewReader("apiVersion: v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	validators := helm.CacheValidators{ETag: `"v1"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	if err := r.saveIndexValidators(repository, artifact, validators); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.loadIndexValidators(repository); !got.IsZero() {
+		t.Errorf("loadIndexValidators() without an artifact = %v, want none", got)
+	}
+	repository.Status.Artifact = &artifact
+	if got := r.loadIndexValidators(repository); !got.IsZero() {
+		t.Errorf("loadIndexValidators() of a repository which is not ready = %v, want none", got)
+	}
+	apimeta.SetStatusCondition(&repository.Status.Conditions, metav1.Condition{
+		Type: meta.ReadyCondition, Status: metav1.ConditionTrue, Reason: sourcev1.IndexationSucceededReason,
+	})
+	if got := r.loadIndexValidators(repository); got != validators {
+		t.Errorf("loadIndexValidators() = %v, want %v", got, validators)
+	}
+
+	changed := repository
+	changed.Spec.URL = "https://charts.example.com"
+	if got := r.loadIndexValidators(changed); !got.IsZero() {
+		t.Errorf("loadIndexValidators() of another URL = %v, want none", got)
+	}
+
+	// an index without validators removes the validators of the artifact
+	if err := r.saveIndexValidators(repository, artifact, helm.CacheValidators{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.loadIndexValidators(repository); !got.IsZero() {
+		t.Errorf("loadIndexValidators() after removal = %v, want none", got)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/apis/meta"
+)
+
+const (
+	// DefaultIntervalJitterPercentage is the default jitter of the interval
+	// of the sources, in percent of the interval.
+	DefaultIntervalJitterPercentage = 5
+	// DefaultStartupRampUp is the default window over which the first
+	// reconciliations of the sources that are up to date are staggered after
+	// the start of the controller.
+	DefaultStartupRampUp = 30 * time.Second
+)
+
+// IntervalJitter spreads the reconciliations of the sources over time, so
+// that the sources reconciled at once, e.g. after the start of the
+// controller, do not stay phase-locked and reconcile together at every
+// interval. The requeue after a successful reconciliation is shifted by a
+// random duration of up to Percentage percent of the interval, earlier or
+// later, and the first reconciliations of the sources that are up to date are
+// delayed by a random duration of up to RampUp after the start of the
+// controller. The reconciliations requested with the reconcile annotation,
+// e.g. by a webhook, are not delayed.
+type IntervalJitter struct {
+	// Percentage is the maximum jitter of the interval, in percent of the
+	// interval.
+	Percentage int
+	// RampUp is the window over which the first reconciliations are
+	// staggered, zero disables the staggering.
+	RampUp time.Duration
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	start time.Time
+	seen  map[string]bool
+	now   func() time.Time
+}
+
+// NewIntervalJitter returns an IntervalJitter with the given percentage and
+// ramp-up window.
+func NewIntervalJitter(percentage int, rampUp time.Duration) *IntervalJitter {
+	return &IntervalJitter{
+		Percentage: percentage,
+		RampUp:     rampUp,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		seen:       map[string]bool{},
+		now:        time.Now,
+	}
+}
+
+// interval returns the given interval shifted by a random jitter, a nil
+// IntervalJitter returns the interval as is.
+func (j *IntervalJitter) interval(interval time.Duration) time.Duration {
+	if j == nil || j.Percentage <= 0 || interval <= 0 {
+		return interval
+	}
+	max := int64(interval) * int64(j.Percentage) / 100
+	if max <= 0 {
+		return interval
+	}
+	j.mu.Lock()
+	jitter := j.rand.Int63n(2*max+1) - max
+	j.mu.Unlock()
+	return interval + time.Duration(jitter)
+}
+
+// startupDelay returns the duration by which the first reconciliation of the
+// source of the given kind and key is delayed after the start of the
+// controller, zero if it is reconciled right away. Only the sources that are
+// up to date are delayed, within the RampUp window since the first
+// reconciliation of the controller and at most by their interval.
+func (j *IntervalJitter) startupDelay(kind string, key client.ObjectKey, upToDate bool, interval time.Duration) time.Duration {
+	if j == nil || j.RampUp <= 0 {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	if j.start.IsZero() {
+		j.start = now
+	}
+	elapsed := now.Sub(j.start)
+	if elapsed >= j.RampUp {
+		// the ramp-up is over, the sources are no longer tracked
+		j.seen = nil
+		return 0
+	}
+	id := kind + "/" + key.String()
+	if j.seen[id] {
+		return 0
+	}
+	j.seen[id] = true
+	if !upToDate {
+		return 0
+	}
+
+	window := j.RampUp
+	if interval > 0 && interval < window {
+		window = interval
+	}
+	delay := time.Duration(j.rand.Int63n(int64(window))) - elapsed
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// sourceUpToDate returns if a source is ready for its current generation and
+// has no pending reconcile request, i.e. its reconciliation can be delayed
+// without delaying a change or a requested reconciliation.
+func sourceUpToDate(obj client.Object, observedGeneration int64, lastHandledReconcileAt string, conditions []metav1.Condition) bool {
+	if obj.GetGeneration() != observedGeneration || !apimeta.IsStatusConditionTrue(conditions, meta.ReadyCondition) {
+		return false
+	}
+	if v, ok := meta.ReconcileAnnotationValue(obj.GetAnnotations()); ok && v != lastHandledReconcileAt {
+		return false
+	}
+	return true
+}
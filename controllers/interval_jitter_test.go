@@ -0,0 +1,128 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestIntervalJitter_interval(t *testing.T) {
+	j := NewIntervalJitter(10, 0)
+	interval := 10 * time.Minute
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		got := j.interval(interval)
+		if got < 9*time.Minute || got > 11*time.Minute {
+			t.Fatalf("interval() = %s, want within 10%% of %s", got, interval)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Error("interval() is not jittered")
+	}
+
+	var disabled *IntervalJitter
+	if got := disabled.interval(interval); got != interval {
+		t.Errorf("interval() of a nil jitter = %s, want %s", got, interval)
+	}
+	if got := NewIntervalJitter(0, 0).interval(interval); got != interval {
+		t.Errorf("interval() without jitter = %s, want %s", got, interval)
+	}
+}
+
+func TestIntervalJitter_startupDelay(t *testing.T) {
+	now := time.Now()
+	j := NewIntervalJitter(0, time.Minute)
+	j.now = func() time.Time { return now }
+	key := types.NamespacedName{Namespace: "default", Name: "podinfo"}
+
+	// The first reconciliation of an up to date source is delayed within the
+	// window, capped at the interval
+	delay := j.startupDelay(sourcev1.GitRepositoryKind, key, true, 30*time.Second)
+	if delay < 0 || delay >= 30*time.Second {
+		t.Errorf("startupDelay() = %s, want within the interval", delay)
+	}
+	// The delayed reconciliation is not delayed again
+	if got := j.startupDelay(sourcev1.GitRepositoryKind, key, true, 30*time.Second); got != 0 {
+		t.Errorf("startupDelay() of a delayed source = %s, want 0", got)
+	}
+	// A source with the same name of another kind is tracked on its own
+	j.startupDelay(sourcev1.BucketKind, key, true, 30*time.Second)
+	if !j.seen[sourcev1.BucketKind+"/"+key.String()] {
+		t.Error("source of another kind is not tracked")
+	}
+	// A source that is not up to date is reconciled right away
+	other := types.NamespacedName{Namespace: "default", Name: "other"}
+	if got := j.startupDelay(sourcev1.GitRepositoryKind, other, false, time.Hour); got != 0 {
+		t.Errorf("startupDelay() of a source that is not up to date = %s, want 0", got)
+	}
+
+	// The sources are no longer delayed after the window
+	now = now.Add(time.Minute)
+	late := types.NamespacedName{Namespace: "default", Name: "late"}
+	if got := j.startupDelay(sourcev1.GitRepositoryKind, late, true, time.Hour); got != 0 {
+		t.Errorf("startupDelay() after the window = %s, want 0", got)
+	}
+	if j.seen != nil {
+		t.Error("sources are still tracked after the window")
+	}
+
+	var disabled *IntervalJitter
+	if got := disabled.startupDelay(sourcev1.GitRepositoryKind, key, true, time.Hour); got != 0 {
+		t.Errorf("startupDelay() of a nil jitter = %s, want 0", got)
+	}
+}
+
+func TestSourceUpToDate(t *testing.T) {
+	ready := metav1.Condition{Type: meta.ReadyCondition, Status: metav1.ConditionTrue}
+	newRepository := func(generation int64, annotation string) *sourcev1.GitRepository {
+		repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Generation: generation}}
+		if annotation != "" {
+			repository.Annotations = map[string]string{meta.ReconcileRequestAnnotation: annotation}
+		}
+		return repository
+	}
+	tests := []struct {
+		name       string
+		obj        *sourcev1.GitRepository
+		observed   int64
+		handled    string
+		conditions []metav1.Condition
+		want       bool
+	}{
+		{"ready", newRepository(1, ""), 1, "", []metav1.Condition{ready}, true},
+		{"handled request", newRepository(1, "a"), 1, "a", []metav1.Condition{ready}, true},
+		{"pending request", newRepository(1, "b"), 1, "a", []metav1.Condition{ready}, false},
+		{"new generation", newRepository(2, ""), 1, "", []metav1.Condition{ready}, false},
+		{"not ready", newRepository(1, ""), 1, "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sourceUpToDate(tt.obj, tt.observed, tt.handled, tt.conditions); got != tt.want {
+				t.Errorf("sourceUpToDate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// throttledReconcilesCounter counts the reconciliations of the sources that
+// are delayed by the NamespaceLimiter.
+var throttledReconcilesCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gotk_reconcile_throttled_total",
+		Help: "The number of reconciliations of the sources that are delayed by the rate limit of their namespace, by kind and namespace.",
+	},
+	[]string{"kind", "namespace"},
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(throttledReconcilesCounter)
+}
+
+// NamespaceLimiter limits the reconciliations of the sources of every kind
+// in a namespace to ReconcilesPerMinute, so that the sources of a namespace
+// can not take up the workers of a kind, e.g. thousands of GitRepositories
+// with a short interval. The limit of a namespace is overridden by the
+// ReconcilesPerMinuteAnnotation of the Namespace. A reconciliation above the
+// limit is not run, and the source is requeued once the namespace is below
+// the limit again. A nil NamespaceLimiter does not limit the reconciliations.
+type NamespaceLimiter struct {
+	// ReconcilesPerMinute is the maximum number of reconciliations per minute
+	// of the sources of a kind in a namespace without the annotation, zero
+	// means unlimited.
+	ReconcilesPerMinute int
+
+	reader   client.Reader
+	mu       sync.Mutex
+	limiters map[namespaceLimiterKey]*rate.Limiter
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// namespaceLimiterKey identifies the rate limiter of the sources of a kind
+// in a namespace.
+type namespaceLimiterKey struct {
+	kind, namespace string
+}
+
+// NewNamespaceLimiter returns a NamespaceLimiter with the given maximum
+// number of reconciliations per minute, which reads the overrides of the
+// Namespaces with the given reader.
+func NewNamespaceLimiter(reader client.Reader, reconcilesPerMinute int) *NamespaceLimiter {
+	return &NamespaceLimiter{
+		ReconcilesPerMinute: reconcilesPerMinute,
+		reader:              reader,
+		limiters:            map[namespaceLimiterKey]*rate.Limiter{},
+		now:                 time.Now,
+	}
+}
+
+// Reconciler returns the given reconciler of the given kind, of which the
+// reconciliations are limited per namespace. A nil NamespaceLimiter returns
+// the reconciler as is.
+func (l *NamespaceLimiter) Reconciler(kind string, r reconcile.Reconciler) reconcile.Reconciler {
+	if l == nil {
+		return r
+	}
+	return reconcile.Func(func(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+		if delay := l.delay(ctx, kind, req.Namespace); delay > 0 {
+			throttledReconcilesCounter.WithLabelValues(kind, req.Namespace).Inc()
+			return ctrl.Result{RequeueAfter: delay}, nil
+		}
+		return r.Reconcile(ctx, req)
+	})
+}
+
+// delay takes a reconciliation of the sources of the given kind in the given
+// namespace from its rate limiter, and returns zero, or the delay until the
+// namespace is below its limit if it is at its limit.
+func (l *NamespaceLimiter) delay(ctx context.Context, kind, namespace string) time.Duration {
+	perMinute := l.reconcilesPerMinute(ctx, namespace)
+	if perMinute <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := rate.Every(time.Minute / time.Duration(perMinute))
+	key := namespaceLimiterKey{kind: kind, namespace: namespace}
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(limit, perMinute)
+		l.limiters[key] = limiter
+	} else if limiter.Limit() != limit || limiter.Burst() != perMinute {
+		limiter.SetLimit(limit)
+		limiter.SetBurst(perMinute)
+	}
+
+	now := l.now()
+	reservation := limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		// the reconciliation is not run, it takes its turn with the
+		// reconciliations that are due when it is requeued
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// reconcilesPerMinute returns the maximum number of reconciliations per
+// minute of the sources in the given namespace, from the annotation of the
+// Namespace, or ReconcilesPerMinute if it has no valid annotation.
+func (l *NamespaceLimiter) reconcilesPerMinute(ctx context.Context, namespace string) int {
+	if l.reader == nil {
+		return l.ReconcilesPerMinute
+	}
+	var ns corev1.Namespace
+	if err := l.reader.Get(ctx, types.NamespacedName{Name: namespace}, &ns); err != nil {
+		return l.ReconcilesPerMinute
+	}
+	v, ok := ns.GetAnnotations()[sourcev1.ReconcilesPerMinuteAnnotation]
+	if !ok {
+		return l.ReconcilesPerMinute
+	}
+	perMinute, err := strconv.Atoi(v)
+	if err != nil || perMinute < 0 {
+		ctrl.LoggerFrom(ctx).Info("Ignoring invalid annotation of namespace, it must be a non-negative integer",
+			"annotation", sourcev1.ReconcilesPerMinuteAnnotation, "value", v)
+		return l.ReconcilesPerMinute
+	}
+	return perMinute
+}
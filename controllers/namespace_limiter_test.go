@@ -0,0 +1,132 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestNamespaceLimiter_Reconciler(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	namespace := func(name, perMinute string) *corev1.Namespace {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if perMinute != "" {
+			ns.Annotations = map[string]string{sourcev1.ReconcilesPerMinuteAnnotation: perMinute}
+		}
+		return ns
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		namespace("tenant", ""),
+		namespace("unlimited", "0"),
+		namespace("larger", "6"),
+		namespace("invalid", "many"),
+	).Build()
+
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	l := NewNamespaceLimiter(c, 2)
+	l.now = func() time.Time { return now }
+
+	reconciles := map[string]int{}
+	r := l.Reconciler(sourcev1.GitRepositoryKind, reconcile.Func(func(_ context.Context, req ctrl.Request) (ctrl.Result, error) {
+		reconciles[req.Namespace]++
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}))
+	reconcileIn := func(ns string) ctrl.Result {
+		t.Helper()
+		result, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: ns, Name: "podinfo"}})
+		if err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+		return result
+	}
+
+	// The namespace is throttled above its limit, and requeued once it is
+	// below the limit
+	for i := 0; i < 2; i++ {
+		if result := reconcileIn("tenant"); result.RequeueAfter != time.Minute {
+			t.Errorf("Reconcile() %d below the limit = %v, want the result of the reconciliation", i, result)
+		}
+	}
+	if result := reconcileIn("tenant"); result.RequeueAfter != 30*time.Second {
+		t.Errorf("Reconcile() above the limit = %v, want a requeue once a reconciliation is available", result)
+	}
+	if reconciles["tenant"] != 2 {
+		t.Errorf("reconciliations above the limit = %d, want 2", reconciles["tenant"])
+	}
+	now = now.Add(30 * time.Second)
+	if reconcileIn("tenant"); reconciles["tenant"] != 3 {
+		t.Errorf("reconciliations after the delay = %d, want 3", reconciles["tenant"])
+	}
+
+	// The other namespaces and kinds are not throttled by the namespace
+	if reconcileIn("other"); reconciles["other"] != 1 {
+		t.Errorf("reconciliations in another namespace = %d, want 1", reconciles["other"])
+	}
+	helmRepository := l.Reconciler(sourcev1.HelmRepositoryKind, reconcile.Func(func(context.Context, ctrl.Request) (ctrl.Result, error) {
+		return ctrl.Result{}, nil
+	}))
+	if result, _ := helmRepository.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "tenant"}}); result.RequeueAfter != 0 {
+		t.Errorf("Reconcile() of another kind = %v, want it not throttled", result)
+	}
+
+	// The annotation of the namespace overrides the limit
+	for i := 0; i < 10; i++ {
+		reconcileIn("unlimited")
+		reconcileIn("larger")
+		reconcileIn("invalid")
+	}
+	if reconciles["unlimited"] != 10 || reconciles["larger"] != 6 || reconciles["invalid"] != 2 {
+		t.Errorf("reconciliations with overrides = %v, want 10 unlimited, 6 larger and 2 invalid", reconciles)
+	}
+
+	// Without a limit, only the annotated namespaces are limited
+	l = NewNamespaceLimiter(c, 0)
+	l.now = func() time.Time { return now }
+	reconciles = map[string]int{}
+	r = l.Reconciler(sourcev1.GitRepositoryKind, reconcile.Func(func(_ context.Context, req ctrl.Request) (ctrl.Result, error) {
+		reconciles[req.Namespace]++
+		return ctrl.Result{}, nil
+	}))
+	for i := 0; i < 10; i++ {
+		reconcileIn("tenant")
+		reconcileIn("larger")
+	}
+	if reconciles["tenant"] != 10 || reconciles["larger"] != 6 {
+		t.Errorf("reconciliations without a limit = %v, want 10 tenant and 6 larger", reconciles)
+	}
+
+	var nilLimiter *NamespaceLimiter
+	inner := reconcile.Func(func(context.Context, ctrl.Request) (ctrl.Result, error) { return ctrl.Result{}, nil })
+	if got := nilLimiter.Reconciler(sourcev1.GitRepositoryKind, inner); got == nil {
+		t.Error("Reconciler() of a nil limiter = nil, want the reconciler")
+	}
+}
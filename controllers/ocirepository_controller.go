@@ -0,0 +1,901 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kuberecorder "k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/events"
+	"github.com/fluxcd/pkg/runtime/metrics"
+	"github.com/fluxcd/pkg/runtime/predicates"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/egress"
+	"github.com/fluxcd/source-controller/internal/redact"
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
+	"github.com/fluxcd/source-controller/pkg/oci"
+	"github.com/fluxcd/source-controller/pkg/sourceignore"
+)
+
+// +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=ocirepositories,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=ocirepositories/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=ocirepositories/finalizers,verbs=get;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// OCIRepositoryReconciler reconciles an OCIRepository object
+type OCIRepositoryReconciler struct {
+	client.Client
+	Scheme                *runtime.Scheme
+	Storage               *Storage
+	EventRecorder         kuberecorder.EventRecorder
+	ExternalEventRecorder *events.Recorder
+	EventLimiter          *EventLimiter
+	FetchMetrics          *FetchMetrics
+	MetricsRecorder       *metrics.Recorder
+	// KeylessRoots are the trusted roots of the certificates of the keyless
+	// signatures, keyless verification fails if nil.
+	KeylessRoots *x509.CertPool
+	// RekorKeys are the public keys of the Rekor transparency logs of the
+	// keyless signatures, in addition to the pinned key of the public log.
+	RekorKeys *oci.RekorKeys
+	// Mirrors are the mirrors of the registries through which the artifacts
+	// are pulled, if any.
+	Mirrors *oci.Mirrors
+	// MirrorFallback enables pulling an artifact from the registry of its
+	// URL when the mirror of the registry misses it.
+	MirrorFallback  bool
+	retryLimiter    *RetryLimiter
+	intervalJitter  *IntervalJitter
+	validator       *SourceValidator
+	defaults        *SourceDefaults
+	reconcileTracer *ReconcileTracer
+	// pulls holds a token for every layer pull in progress, if the number
+	// of concurrent pulls is bounded.
+	pulls chan struct{}
+}
+
+type OCIRepositoryReconcilerOptions struct {
+	MaxConcurrentReconciles int
+	MinRetryDelay           time.Duration
+	MaxRetryDelay           time.Duration
+	Drainer                 *Drainer
+	IntervalJitter          *IntervalJitter
+	ReconcileTracker        *ReconcileTracker
+	Validator               *SourceValidator
+	Defaults                *SourceDefaults
+	ReconcileTracer         *ReconcileTracer
+	ReconcileSpans          *ReconcileSpans
+	NamespaceLimiter        *NamespaceLimiter
+	// MaxConcurrentPulls is the maximum number of layers pulled at once by
+	// all reconciliations, zero means unbounded.
+	MaxConcurrentPulls int
+}
+
+func (r *OCIRepositoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return r.SetupWithManagerAndOptions(mgr, OCIRepositoryReconcilerOptions{})
+}
+
+func (r *OCIRepositoryReconciler) SetupWithManagerAndOptions(mgr ctrl.Manager, opts OCIRepositoryReconcilerOptions) error {
+	r.retryLimiter = NewRetryLimiter(opts.MinRetryDelay, opts.MaxRetryDelay)
+	r.intervalJitter = opts.IntervalJitter
+	r.validator = opts.Validator
+	r.defaults = opts.Defaults
+	r.reconcileTracer = opts.ReconcileTracer
+	if opts.MaxConcurrentPulls > 0 {
+		r.pulls = make(chan struct{}, opts.MaxConcurrentPulls)
+	}
+	if err := mgr.GetCache().IndexField(context.TODO(), &sourcev1.OCIRepository{}, sourcev1.SecretIndexKey,
+		indexBySecretRefs); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+
+	recordMaxConcurrentReconciles(sourcev1.OCIRepositoryKind, opts.MaxConcurrentReconciles)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&sourcev1.OCIRepository{}, builder.WithPredicates(
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}, ForceRefetchRequestedPredicate{}),
+		)).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSecretChange),
+		).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: opts.MaxConcurrentReconciles,
+			RateLimiter:             r.retryLimiter.rateLimiter(),
+		}).
+		Complete(opts.Drainer.Reconciler(opts.NamespaceLimiter.Reconciler(sourcev1.OCIRepositoryKind,
+			opts.ReconcileSpans.Reconciler(sourcev1.OCIRepositoryKind,
+				opts.ReconcileTracker.Reconciler(sourcev1.OCIRepositoryKind, r)))))
+}
+
+// requestsForSecretChange returns the reconcile requests for the OCIRepository objects that reference the given Secret.
+func (r *OCIRepositoryReconciler) requestsForSecretChange(o client.Object) []reconcile.Request {
+	return requestsForSecretChange(r, &sourcev1.OCIRepositoryList{}, o)
+}
+
+func (r *OCIRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, retErr error) {
+	start := time.Now()
+	// redact the credentials from the error logged by the controller
+	defer func() { retErr = redact.Error(retErr) }()
+	log := logr.FromContext(ctx)
+
+	var repository sourcev1.OCIRepository
+	if err := r.Get(ctx, req.NamespacedName, &repository); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Record suspended status metric
+	defer r.recordSuspension(ctx, repository)
+
+	// Record the artifact URLs advertised in the status, to map the errors
+	// of the artifact server back to the object, and the size of the artifact
+	advertiseArtifact(sourcev1.OCIRepositoryKind, &repository)
+	recordArtifactSize(sourcev1.OCIRepositoryKind, &repository)
+
+	// Add our finalizer if it does not exist
+	if !controllerutil.ContainsFinalizer(&repository, sourcev1.SourceFinalizer) {
+		controllerutil.AddFinalizer(&repository, sourcev1.SourceFinalizer)
+		if err := r.Update(ctx, &repository); err != nil {
+			log.Error(err, "unable to register finalizer")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Examine if the object is under deletion
+	if !repository.ObjectMeta.DeletionTimestamp.IsZero() {
+		forgetReconciledSource(sourcev1.OCIRepositoryKind, req.NamespacedName)
+		r.FetchMetrics.forget(sourcev1.OCIRepositoryKind, &repository)
+		setReconcilePhase(ctx, reconcilePhaseDeleting)
+		return r.reconcileDelete(ctx, repository)
+	}
+
+	// Return early if the object is suspended.
+	if repository.Spec.Suspend {
+		log.Info("Reconciliation is suspended for this object")
+		return ctrl.Result{}, nil
+	}
+
+	// apply the default interval and timeout of the controller, if the spec
+	// omits them
+	r.defaults.apply(&repository)
+
+	// stagger the first reconciliations of the sources that are up to date
+	// after the start of the controller
+	upToDate := sourceUpToDate(&repository, repository.Status.ObservedGeneration,
+		repository.Status.GetLastHandledReconcileRequest(), repository.Status.Conditions)
+	if delay := r.intervalJitter.startupDelay(sourcev1.OCIRepositoryKind, req.NamespacedName, upToDate, repository.GetInterval().Duration); delay > 0 {
+		log.Info(fmt.Sprintf("Delaying the first reconciliation by %s", delay.String()))
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	recordReconcileStart(sourcev1.OCIRepositoryKind, start, repository.GetInterval().Duration)
+	ctx = r.reconcileTracer.start(ctx, start)
+
+	// cap the backoff of failed reconciliations at the retry interval
+	r.retryLimiter.setMaxDelay(req, repository.Spec.RetryInterval)
+
+	// record the duration and result of the reconciliation
+	reconciled := &repository
+	defer func() {
+		recordReconcile(sourcev1.OCIRepositoryKind, reconciled, start, retErr)
+		advertiseArtifact(sourcev1.OCIRepositoryKind, reconciled)
+		recordArtifactSize(sourcev1.OCIRepositoryKind, reconciled)
+	}()
+
+	// record reconciliation duration
+	if r.MetricsRecorder != nil {
+		objRef, err := reference.GetReference(r.Scheme, &repository)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		defer r.MetricsRecorder.RecordDuration(*objRef, start)
+	}
+
+	// stall the repository if its spec is invalid, e.g. it was created before
+	// the validation webhook was enabled, until it is corrected
+	if err := r.validator.validate(&repository); err != nil {
+		stalledRepository := sourcev1.OCIRepositoryStalled(*repository.DeepCopy(), sourcev1.SpecInvalidReason, err.Error())
+		stalledRepository.Status.ObservedGeneration = stalledRepository.Generation
+		stalledRepository.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, stalledRepository.Status.Conditions, nil)
+		reconciled = &stalledRepository
+		if err := r.updateStatus(ctx, req, stalledRepository.Status); err != nil {
+			log.Error(err, "unable to update status")
+			return ctrl.Result{Requeue: true}, err
+		}
+		r.event(ctx, stalledRepository, events.EventSeverityError, err.Error(), nil)
+		r.recordReadiness(ctx, stalledRepository)
+		return ctrl.Result{}, nil
+	}
+
+	// set initial status
+	repository, _ = r.resetStatus(repository)
+	if err := r.updateStatus(ctx, req, repository.Status); err != nil {
+		log.Error(err, "unable to update status")
+		return ctrl.Result{Requeue: true}, err
+	}
+	r.recordReadiness(ctx, repository)
+
+	// record the value of the reconciliation request, if any
+	// TODO(hidde): would be better to defer this in combination with
+	//   always patching the status sub-resource after a reconciliation.
+	if v, ok := meta.ReconcileAnnotationValue(repository.GetAnnotations()); ok {
+		repository.Status.SetLastHandledReconcileRequest(v)
+	}
+
+	// purge old artifacts from storage
+	tracePhase(ctx, tracePhaseGC)
+	if err := r.gc(repository); err != nil {
+		log.Error(err, "unable to purge old artifacts")
+	}
+
+	// bypass the caches if the repository was annotated with a force
+	// refetch request newer than the handled one
+	refetch, force := forceRefetchRequest(&repository, repository.Status.LastHandledForceRefetchAt)
+
+	// reconcile repository by pulling the artifact
+	setReconcilePhase(ctx, reconcilePhaseFetching)
+	fetchCtx, rateLimits := transport.WithRateLimits(ctx)
+	reconciledRepository, reconcileErr := r.reconcile(withForceRefetch(fetchCtx, force), *repository.DeepCopy())
+	if force && reconcileErr == nil {
+		reconciledRepository.Status.LastHandledForceRefetchAt = refetch
+	}
+
+	// delay the retry until the reset of the rate limit of the upstream, if
+	// the reconciliation was rejected by it
+	reconcileErr = recordUpstreamRateLimit(ctx, r.retryLimiter, req, sourcev1.OCIRepositoryKind, &repository,
+		upstreamURL(&repository), rateLimits, reconcileErr)
+
+	// stall the repository on a connection denied by the egress policy, as
+	// retrying does not resolve it
+	if egress.IsDenied(reconcileErr) {
+		reconciledRepository = sourcev1.OCIRepositoryStalled(reconciledRepository, sourcev1.EgressDeniedReason, reconcileErr.Error())
+	}
+	reconciled = &reconciledRepository
+
+	// record the artifact written by the reconciliation as in the storage
+	r.Storage.recordArtifactInStorage(&reconciledRepository.Status.Conditions, reconciledRepository.Generation,
+		repository.GetArtifact(), reconciledRepository.GetArtifact())
+
+	// record the failures to fetch the upstream
+	r.FetchMetrics.record(sourcev1.OCIRepositoryKind, &reconciledRepository, reconciledRepository.Status.Conditions, reconcileErr)
+
+	// record the time of the next retry of a failed reconciliation
+	reconciledRepository.Status.NextRetryTime = r.retryLimiter.nextRetryTime(req, reconcileErr, reconciledRepository.Status.Conditions)
+
+	// record the trace of the reconciliation, and the revision of its span
+	reconciledRepository.Status.LastReconcileTrace = r.reconcileTracer.finish(ctx, reconciledRepository.Status.Conditions, reconcileErr)
+	spanRevision(ctx, reconciledRepository.GetArtifact())
+
+	// update status with the reconciliation result
+	setReconcilePhase(ctx, reconcilePhaseUpdatingStatus)
+	if err := r.updateStatus(ctx, req, reconciledRepository.Status); err != nil {
+		log.Error(err, "unable to update status")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// if the artifact exceeds the maximum size or has an unsupported layer,
+	// record the failure and requeue at the interval, as retrying does not
+	// resolve it
+	if reconcileErr != nil && apimeta.IsStatusConditionTrue(reconciledRepository.Status.Conditions, meta.StalledCondition) {
+		r.event(ctx, reconciledRepository, events.EventSeverityError, reconcileErr.Error(), nil)
+		r.recordReadiness(ctx, reconciledRepository)
+		if reconcileRequestPending(ctx, r, &reconciledRepository, reconciledRepository.Status.GetLastHandledReconcileRequest()) {
+			return ctrl.Result{Requeue: true}, reconcileErr
+		}
+		return ctrl.Result{RequeueAfter: r.intervalJitter.interval(repository.GetInterval().Duration)}, nil
+	}
+
+	// if reconciliation failed, record the failure and requeue immediately
+	if reconcileErr != nil {
+		r.event(ctx, reconciledRepository, events.EventSeverityError, reconcileErr.Error(), nil)
+		r.recordReadiness(ctx, reconciledRepository)
+		if next := reconciledRepository.Status.NextRetryTime; next != nil {
+			log.Info(fmt.Sprintf("Reconciliation failed, retrying at %s", next.Format(time.RFC3339)))
+		}
+		return ctrl.Result{Requeue: true}, reconcileErr
+	}
+
+	// emit revision change event and purge the previous artifacts
+	if repository.Status.Artifact == nil || reconciledRepository.Status.Artifact.Revision != repository.Status.Artifact.Revision {
+		metadata := r.Storage.artifactMetadata(reconciledRepository.GetArtifact(), upstreamURL(&reconciledRepository))
+		r.event(ctx, reconciledRepository, events.EventSeverityInfo, sourcev1.OCIRepositoryReadyMessage(reconciledRepository), metadata)
+		if err := r.gc(reconciledRepository); err != nil {
+			log.Error(err, "unable to purge old artifacts")
+		}
+	}
+	r.recordReadiness(ctx, reconciledRepository)
+
+	// shift the next run by a jitter, for the sources to drift apart
+	interval := r.intervalJitter.interval(repository.GetInterval().Duration)
+	log.Info(fmt.Sprintf("Reconciliation finished in %s, next run in %s",
+		time.Now().Sub(start).String(),
+		interval.String(),
+	))
+
+	// reconcile again right away if the object was annotated with a
+	// reconcile request during the reconciliation, as it is not handled
+	if reconcileRequestPending(ctx, r, &reconciledRepository, reconciledRepository.Status.GetLastHandledReconcileRequest()) {
+		log.Info("Reconcile request received during the reconciliation, reconciling again")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+func (r *OCIRepositoryReconciler) reconcile(ctx context.Context, repository sourcev1.OCIRepository) (sourcev1.OCIRepository, error) {
+	host, name, err := oci.ParseURL(repository.Spec.URL)
+	if err != nil {
+		return sourcev1.OCIRepositoryNotReady(repository, sourcev1.URLInvalidReason, err.Error()), err
+	}
+
+	tracePhase(ctx, tracePhaseAuth)
+	registries, err := r.registries(ctx, repository, host, name)
+	if err != nil {
+		return sourcev1.OCIRepositoryNotReady(repository, sourcev1.AuthenticationFailedReason, err.Error()), err
+	}
+
+	tracePhase(ctx, tracePhaseFetch)
+	ociCtx, cancel := context.WithTimeout(ctx, repository.Spec.Timeout.Duration)
+	defer cancel()
+
+	// resolve the reference with the mirror first, if any, and with the
+	// registry of the URL only if the mirror misses it and fallback is
+	// enabled. A digest is resolved as is, and the manifest is verified
+	// against it, whichever registry serves it.
+	var registry ociRegistry
+	var ref, digest string
+	var manifest *oci.Manifest
+	for i, candidate := range registries {
+		ref, err = candidate.client.Resolve(ociCtx, repository.Spec.Reference)
+		if err == nil {
+			manifest, digest, err = candidate.client.Manifest(ociCtx, ref)
+		}
+		if err == nil {
+			registry = candidate
+			break
+		}
+		if i < len(registries)-1 && oci.IsNotFound(err) {
+			ctrl.LoggerFrom(ctx).Info(fmt.Sprintf("Mirror '%s' misses the artifact, falling back to '%s': %s",
+				candidate.host, registries[i+1].host, err.Error()))
+			continue
+		}
+		return sourcev1.OCIRepositoryNotReady(repository, ociFailureReason(err), err.Error()), err
+	}
+	repository.Status.RegistryHost = registry.host
+	tracePhaseDetail(ctx, "revision %s", digest)
+
+	// verify the signature of the manifest before any of its layers is
+	// pulled, on every reconciliation for a revoked key to take effect
+	if repository.Spec.Verification != nil {
+		tracePhase(ctx, tracePhaseVerify)
+		identity, err := verifyCosignSignature(ociCtx, r.Client, r.KeylessRoots, r.RekorKeys, registry.client,
+			repository.Namespace, *repository.Spec.Verification, digest)
+		if err != nil {
+			err = fmt.Errorf("signature verification of '%s' failed: %w", digest, err)
+			return sourcev1.OCIRepositoryNotVerified(repository, err.Error()), err
+		}
+		message := verifiedSignatureMessage("revision "+digest, *identity)
+		repository = sourcev1.OCIRepositoryVerified(repository, *identity, message)
+		tracePhase(ctx, tracePhaseFetch)
+	} else {
+		repository.Status.VerifiedIdentity = nil
+	}
+
+	// the file name is the encoded part of the digest, without the algorithm
+	fileName := digest[strings.Index(digest, ":")+1:]
+	artifact := r.Storage.NewArtifactFor(repository.Kind, repository.GetObjectMeta(), digest, fileName+r.Storage.ArchiveExtension())
+
+	// return early on unchanged digest, unless forced to refetch
+	if !forceRefetch(ctx) && apimeta.IsStatusConditionTrue(repository.Status.Conditions, meta.ReadyCondition) && repository.GetArtifact().HasRevision(artifact.Revision) {
+		if !r.Storage.currentURL(repository.GetArtifact().URL) {
+			r.Storage.SetArtifactURL(repository.GetArtifact())
+			repository.Status.URL = r.Storage.SetHostname(repository.Status.URL)
+		}
+		return repository, nil
+	}
+
+	// reject the artifact before pulling any of its layers if one of them
+	// can not be unpacked, pulling it again does not resolve it
+	if len(manifest.Layers) == 0 {
+		err = fmt.Errorf("artifact '%s' has no layers", digest)
+		return sourcev1.OCIRepositoryStalled(repository, sourcev1.OCILayerUnsupportedReason, err.Error()), err
+	}
+	for _, layer := range manifest.Layers {
+		if !oci.IsLayerSupported(layer.MediaType) {
+			err = fmt.Errorf("layer '%s' of artifact '%s' has the unsupported media type '%s', expected one of: %s",
+				layer.Digest, digest, layer.MediaType, strings.Join(oci.LayerMediaTypes, ", "))
+			return sourcev1.OCIRepositoryStalled(repository, sourcev1.OCILayerUnsupportedReason, err.Error()), err
+		}
+	}
+
+	// unpack the layers in order, the files of a layer replace the files of
+	// the previous layers
+	tmpDir, err := os.MkdirTemp("", repository.Name)
+	if err != nil {
+		err = fmt.Errorf("tmp dir error: %w", err)
+		return sourcev1.OCIRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, layer := range manifest.Layers {
+		if err := r.unpackLayer(ociCtx, registry.client, layer, tmpDir); err != nil {
+			err = fmt.Errorf("failed to unpack layer '%s': %w", layer.Digest, err)
+			return sourcev1.OCIRepositoryNotReady(repository, ociFailureReason(err), err.Error()), err
+		}
+	}
+
+	// ensure there is space for the artifact
+	if err := r.storagePruner().ensureSpace(ctx); err != nil {
+		return sourcev1.OCIRepositoryNotReady(repository, sourcev1.StorageFullReason, err.Error()), err
+	}
+
+	setReconcilePhase(ctx, reconcilePhaseStoring)
+	tracePhase(ctx, tracePhaseArchive)
+	// create artifact dir
+	err = r.Storage.MkdirAll(artifact)
+	if err != nil {
+		err = fmt.Errorf("mkdir dir error: %w", err)
+		return sourcev1.OCIRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
+	}
+
+	// acquire lock
+	unlock, err := r.Storage.Lock(artifact)
+	if err != nil {
+		err = fmt.Errorf("unable to acquire lock: %w", err)
+		return sourcev1.OCIRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
+	}
+	defer unlock()
+
+	// archive artifact and check integrity
+	ignoreDomain := strings.Split(tmpDir, string(filepath.Separator))
+	ps, err := sourceignore.LoadIgnorePatterns(tmpDir, ignoreDomain)
+	if err != nil {
+		err = fmt.Errorf(".sourceignore error: %w", err)
+		return sourcev1.OCIRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
+	}
+	if repository.Spec.Ignore != nil {
+		ps = append(ps, sourceignore.ReadPatterns(strings.NewReader(*repository.Spec.Ignore), ignoreDomain)...)
+	}
+	storage := r.Storage.WithArtifactMaxSize(repository.Spec.MaxArtifactSize)
+	if err := storage.Archive(&artifact, tmpDir, SourceIgnoreFilter(ps, ignoreDomain)); err != nil {
+		err = fmt.Errorf("storage archive error: %w", err)
+		if isArtifactSizeError(err) {
+			return sourcev1.OCIRepositoryStalled(repository, sourcev1.ArtifactTooLargeReason, err.Error()), err
+		}
+		return sourcev1.OCIRepositoryNotReady(repository, storageFailureReason(err), err.Error()), err
+	}
+
+	// update latest symlink
+	tracePhase(ctx, tracePhaseStore)
+	url, err := r.Storage.Symlink(artifact, "latest"+r.Storage.ArchiveExtension())
+	if err != nil {
+		err = fmt.Errorf("storage symlink error: %w", err)
+		return sourcev1.OCIRepositoryNotReady(repository, sourcev1.StorageOperationFailedReason, err.Error()), err
+	}
+
+	message := fmt.Sprintf("Fetched revision: %s", artifact.Revision)
+	if ref != digest {
+		message = fmt.Sprintf("Fetched revision: %s of '%s'", artifact.Revision, ref)
+	}
+	return sourcev1.OCIRepositoryReady(repository, artifact, url, sourcev1.OCIOperationSucceedReason, message), nil
+}
+
+// ociRegistry is a registry from which an artifact is pulled, the registry
+// of the URL of an OCIRepository or its mirror.
+type ociRegistry struct {
+	host   string
+	client *oci.Client
+}
+
+// registries returns the registries from which the artifact of the given
+// repository, of the given registry host and repository name, is pulled in
+// order: the mirror of the host if the controller has one, and the registry
+// of the URL without a mirror, or as the fallback of the mirror if enabled.
+func (r *OCIRepositoryReconciler) registries(ctx context.Context, repository sourcev1.OCIRepository, host, name string) ([]ociRegistry, error) {
+	var registries []ociRegistry
+	if mirror := r.Mirrors.Lookup(host); mirror != nil {
+		secret, err := mirrorSecret(ctx, r.Client, mirror)
+		if err != nil {
+			return nil, err
+		}
+		client, err := mirror.NewClient(name, secret)
+		if err != nil {
+			return nil, fmt.Errorf("mirror '%s' auth options error: %w", mirror.Mirror, err)
+		}
+		registries = append(registries, ociRegistry{host: mirror.MirrorHost(), client: client})
+		if !r.MirrorFallback {
+			return registries, nil
+		}
+	}
+
+	var secret *corev1.Secret
+	if repository.Spec.SecretRef != nil {
+		secretName := types.NamespacedName{
+			Namespace: repository.GetNamespace(),
+			Name:      repository.Spec.SecretRef.Name,
+		}
+
+		secret = &corev1.Secret{}
+		if err := r.Client.Get(ctx, secretName, secret); err != nil {
+			return nil, fmt.Errorf("auth secret error: %w", err)
+		}
+		corrected, warnings := secretdata.Correct(*secret)
+		for _, w := range warnings {
+			r.event(ctx, repository, events.EventSeverityError, w, nil)
+		}
+		secret = &corrected
+	}
+	client, err := oci.NewClient(repository, secret)
+	if err != nil {
+		return nil, fmt.Errorf("auth options error: %w", err)
+	}
+	return append(registries, ociRegistry{host: host, client: client}), nil
+}
+
+// mirrorSecret returns the secret of the credentials of the given mirror, or
+// nil if it has none. It is shared by the OCIRepository and HelmChart
+// reconcilers.
+func mirrorSecret(ctx context.Context, c client.Reader, mirror *oci.Mirror) (*corev1.Secret, error) {
+	if mirror.SecretRef == nil {
+		return nil, nil
+	}
+	secretName := types.NamespacedName{
+		Namespace: mirror.SecretRef.Namespace,
+		Name:      mirror.SecretRef.Name,
+	}
+	var secret corev1.Secret
+	if err := c.Get(ctx, secretName, &secret); err != nil {
+		return nil, fmt.Errorf("mirror '%s' auth secret error: %w", mirror.Mirror, err)
+	}
+	return &secret, nil
+}
+
+// verifyCosignSignature verifies the cosign signature of the manifest of the
+// given digest in the given registry, with the public keys of the secret in
+// the given namespace of the given verification, or else keyless against
+// its identities with the given roots, and returns the identity of the
+// verified signature. It is shared by the OCIRepository and HelmChart
+// reconcilers.
+func verifyCosignSignature(ctx context.Context, c client.Reader, keylessRoots *x509.CertPool, rekorKeys *oci.RekorKeys,
+	registry *oci.Client, namespace string, verification sourcev1.OCIRepositoryVerification, digest string) (*sourcev1.OCIRepositoryVerifiedIdentity, error) {
+	verifier := &oci.Verifier{}
+	if verification.SecretRef != nil {
+		name := types.NamespacedName{
+			Namespace: namespace,
+			Name:      verification.SecretRef.Name,
+		}
+		var secret corev1.Secret
+		if err := c.Get(ctx, name, &secret); err != nil {
+			return nil, fmt.Errorf("cosign public keys secret error: %w", err)
+		}
+		keys, err := oci.PublicKeysFromSecret(&secret)
+		if err != nil {
+			return nil, err
+		}
+		verifier.PublicKeys = keys
+	} else {
+		if keylessRoots == nil {
+			return nil, fmt.Errorf("keyless verification requires the trusted roots of the controller, see --cosign-roots-file")
+		}
+		if len(verification.MatchOIDCIdentity) == 0 {
+			return nil, fmt.Errorf("keyless verification requires at least one identity in matchOIDCIdentity")
+		}
+		for _, match := range verification.MatchOIDCIdentity {
+			identity, err := compileOIDCIdentity(match)
+			if err != nil {
+				return nil, err
+			}
+			verifier.Identities = append(verifier.Identities, identity)
+		}
+		rekorURL := verification.RekorURL
+		if rekorURL == "" {
+			rekorURL = oci.DefaultRekorURL
+		}
+		key := rekorKeys.Lookup(rekorURL)
+		if key == nil {
+			return nil, fmt.Errorf("keyless verification requires the public key of the transparency log '%s', see --cosign-rekor-keys-file", rekorURL)
+		}
+		verifier.Roots, verifier.RekorPublicKey = keylessRoots, key
+	}
+
+	signatures, err := registry.Signatures(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	verified, err := verifier.Verify(digest, signatures)
+	if err != nil {
+		return nil, err
+	}
+	return &sourcev1.OCIRepositoryVerifiedIdentity{
+		Digest:  digest,
+		Key:     verified.Key,
+		Issuer:  verified.Issuer,
+		Subject: verified.Subject,
+	}, nil
+}
+
+// verifiedSignatureMessage returns the message of the SourceVerifiedCondition
+// for the given identity of the verified signature of the given subject,
+// e.g. 'revision <digest>'.
+func verifiedSignatureMessage(subject string, identity sourcev1.OCIRepositoryVerifiedIdentity) string {
+	if identity.Key == "" {
+		return fmt.Sprintf("Verified signature of %s of subject '%s' issued by '%s'", subject, identity.Subject, identity.Issuer)
+	}
+	return fmt.Sprintf("Verified signature of %s with key '%s'", subject, identity.Key)
+}
+
+// compileOIDCIdentity returns the oci.Identity of the given match, of which
+// the regular expressions must match the whole issuer and subject.
+func compileOIDCIdentity(match sourcev1.OIDCIdentityMatch) (oci.Identity, error) {
+	issuer, err := regexp.Compile("^(?:" + match.Issuer + ")$")
+	if err != nil {
+		return oci.Identity{}, fmt.Errorf("invalid issuer regular expression '%s': %w", match.Issuer, err)
+	}
+	subject, err := regexp.Compile("^(?:" + match.Subject + ")$")
+	if err != nil {
+		return oci.Identity{}, fmt.Errorf("invalid subject regular expression '%s': %w", match.Subject, err)
+	}
+	return oci.Identity{Issuer: issuer, Subject: subject}, nil
+}
+
+// LoadKeylessRoots returns the pool of the PEM encoded certificates of the
+// given file, the roots trusted for the keyless verification.
+func LoadKeylessRoots(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM encoded certificates in '%s'", path)
+	}
+	return pool, nil
+}
+
+// unpackLayer pulls the given gzip compressed tarball layer with the given
+// client to a temporary file, and extracts it into the given directory once
+// it is verified against its digest. The layer is streamed to the file, so
+// that the memory of a pull does not grow with the size of the layer, and
+// the pulls are bounded by the maximum of concurrent pulls, if any.
+func (r *OCIRepositoryReconciler) unpackLayer(ctx context.Context, registry *oci.Client, layer oci.Descriptor, dir string) error {
+	release, err := r.acquirePull(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	f, err := registry.BlobFile(ctx, layer, "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("gzip error: %w", err)
+	}
+	return extractTarball(zr, dir)
+}
+
+// acquirePull waits for a pull slot if the concurrent pulls are bounded, and
+// returns the function that releases it.
+func (r *OCIRepositoryReconciler) acquirePull(ctx context.Context) (func(), error) {
+	if r.pulls == nil {
+		return func() {}, nil
+	}
+	select {
+	case r.pulls <- struct{}{}:
+		return func() { <-r.pulls }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a pull slot: %w", ctx.Err())
+	}
+}
+
+// ociFailureReason returns the reason of the Ready condition for the given
+// error of the registry.
+func ociFailureReason(err error) string {
+	if oci.IsAuthError(err) {
+		return sourcev1.AuthenticationFailedReason
+	}
+	return sourcev1.OCIOperationFailedReason
+}
+
+func (r *OCIRepositoryReconciler) reconcileDelete(ctx context.Context, repository sourcev1.OCIRepository) (ctrl.Result, error) {
+	// Our finalizer is still present, so lets handle garbage collection
+	if err := r.gc(repository); err != nil {
+		r.event(ctx, repository, events.EventSeverityError,
+			fmt.Sprintf("garbage collection for deleted resource failed: %s", err.Error()), nil)
+		// Return the error so we retry the failed garbage collection
+		return ctrl.Result{}, err
+	}
+
+	// Record deleted status
+	r.recordReadiness(ctx, repository)
+
+	// Remove our finalizer from the list and update it
+	controllerutil.RemoveFinalizer(&repository, sourcev1.SourceFinalizer)
+	if err := r.Update(ctx, &repository); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Stop reconciliation as the object is being deleted
+	return ctrl.Result{}, nil
+}
+
+// resetStatus returns a modified v1beta1.OCIRepository and a boolean indicating
+// if the status field has been reset. The meta.ReconcilingCondition of a
+// status that is not reset is set, as a reconciliation is under way.
+func (r *OCIRepositoryReconciler) resetStatus(repository sourcev1.OCIRepository) (sourcev1.OCIRepository, bool) {
+	// verify that the artifact is in the storage and intact
+	inStorage := r.Storage.artifactInStorage(repository.GetArtifact(), repository.Generation)
+	changed := false
+	switch {
+	case inStorage.Status != metav1.ConditionTrue:
+		// We do not have an artifact, or it is missing or corrupt
+		repository = sourcev1.OCIRepositoryProgressing(repository)
+		repository.Status.Artifact = nil
+		changed = true
+	case repository.Generation != repository.Status.ObservedGeneration:
+		repository = sourcev1.OCIRepositoryProgressing(repository)
+		changed = true
+	default:
+		repository = sourcev1.OCIRepositoryReconciling(repository)
+	}
+	return repository, setArtifactInStorage(&repository.Status.Conditions, inStorage) || changed
+}
+
+// gc performs a garbage collection for the given v1beta1.OCIRepository.
+// It removes the previous artifacts which exceed the retention of the
+// storage, except for when the deletion timestamp is set, which will
+// result in the removal of all artifacts for the resource.
+func (r *OCIRepositoryReconciler) gc(repository sourcev1.OCIRepository) error {
+	if !repository.DeletionTimestamp.IsZero() {
+		return r.Storage.RemoveDeleted(repository.Kind, repository.GetObjectMeta())
+	}
+	if repository.GetArtifact() != nil {
+		_, err := r.Storage.GarbageCollect(*repository.GetArtifact())
+		return err
+	}
+	return nil
+}
+
+// storagePruner returns the pruner of the storage, which emits events with the
+// recorders of the reconciler.
+func (r *OCIRepositoryReconciler) storagePruner() *storagePruner {
+	return &storagePruner{
+		Reader:                r.Client,
+		Scheme:                r.Scheme,
+		Storage:               r.Storage,
+		EventRecorder:         r.EventRecorder,
+		ExternalEventRecorder: r.ExternalEventRecorder,
+	}
+}
+
+// event emits a Kubernetes event and forwards the event to notification controller if configured
+func (r *OCIRepositoryReconciler) event(ctx context.Context, repository sourcev1.OCIRepository, severity, msg string, metadata map[string]string) {
+	log := logr.FromContext(ctx)
+	msg = redact.String(msg)
+
+	// Duplicates are recorded as Kubernetes events nonetheless, which bump
+	// the count of the existing event
+	suppressed := r.EventLimiter.suppress(sourcev1.OCIRepositoryKind, &repository, severity, msg)
+	if suppressed == eventRateLimitedCause {
+		return
+	}
+
+	if r.EventRecorder != nil {
+		if len(metadata) > 0 {
+			r.EventRecorder.AnnotatedEventf(&repository, metadata, "Normal", severity, msg)
+		} else {
+			r.EventRecorder.Eventf(&repository, "Normal", severity, msg)
+		}
+	}
+	if r.ExternalEventRecorder != nil && suppressed == "" {
+		objRef, err := reference.GetReference(r.Scheme, &repository)
+		if err != nil {
+			log.Error(err, "unable to send event")
+			return
+		}
+
+		if err := r.ExternalEventRecorder.Eventf(*objRef, metadata, severity, severity, msg); err != nil {
+			log.Error(err, "unable to send event")
+			return
+		}
+	}
+}
+
+func (r *OCIRepositoryReconciler) recordReadiness(ctx context.Context, repository sourcev1.OCIRepository) {
+	log := logr.FromContext(ctx)
+	if r.MetricsRecorder == nil {
+		return
+	}
+	objRef, err := reference.GetReference(r.Scheme, &repository)
+	if err != nil {
+		log.Error(err, "unable to record readiness metric")
+		return
+	}
+	if rc := apimeta.FindStatusCondition(repository.Status.Conditions, meta.ReadyCondition); rc != nil {
+		r.MetricsRecorder.RecordCondition(*objRef, *rc, !repository.DeletionTimestamp.IsZero())
+	} else {
+		r.MetricsRecorder.RecordCondition(*objRef, metav1.Condition{
+			Type:   meta.ReadyCondition,
+			Status: metav1.ConditionUnknown,
+		}, !repository.DeletionTimestamp.IsZero())
+	}
+}
+
+func (r *OCIRepositoryReconciler) updateStatus(ctx context.Context, req ctrl.Request, newStatus sourcev1.OCIRepositoryStatus) error {
+	redact.Conditions(newStatus.Conditions)
+
+	var repository sourcev1.OCIRepository
+	if err := r.Get(ctx, req.NamespacedName, &repository); err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(repository.DeepCopy())
+	repository.Status = newStatus
+
+	return r.Status().Patch(ctx, &repository, patch)
+}
+
+func (r *OCIRepositoryReconciler) recordSuspension(ctx context.Context, repository sourcev1.OCIRepository) {
+	name := types.NamespacedName{Namespace: repository.Namespace, Name: repository.Name}
+	if !repository.DeletionTimestamp.IsZero() {
+		forgetSuspendStatus(r.MetricsRecorder, sourcev1.OCIRepositoryKind, name)
+		return
+	}
+	if recordSuspend(sourcev1.OCIRepositoryKind, name, repository.Spec.Suspend) {
+		r.event(ctx, repository, events.EventSeverityInfo, suspendMessage(repository.Spec.Suspend), nil)
+	}
+	if r.MetricsRecorder == nil {
+		return
+	}
+	log := logr.FromContext(ctx)
+
+	objRef, err := reference.GetReference(r.Scheme, &repository)
+	if err != nil {
+		log.Error(err, "unable to record suspended metric")
+		return
+	}
+
+	r.MetricsRecorder.RecordSuspend(*objRef, repository.Spec.Suspend)
+}
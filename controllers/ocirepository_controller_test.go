@@ -0,0 +1,451 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/egress"
+	"github.com/fluxcd/source-controller/pkg/oci"
+)
+
+// ociTestRegistry serves the manifests and blobs of an anonymous registry.
+type ociTestRegistry struct {
+	*httptest.Server
+	content map[string][]byte
+}
+
+func newOCITestRegistry(t *testing.T) *ociTestRegistry {
+	t.Helper()
+	r := &ociTestRegistry{content: map[string][]byte{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// newOCITestTLSRegistry returns an ociTestRegistry served over TLS, with a
+// certificate trusted by the Client of the server.
+func newOCITestTLSRegistry(t *testing.T) *ociTestRegistry {
+	t.Helper()
+	r := &ociTestRegistry{content: map[string][]byte{}}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *ociTestRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	b, ok := r.content[req.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if strings.Contains(req.URL.Path, "/manifests/") {
+		w.Header().Set("Content-Type", oci.ManifestMediaType)
+	}
+	w.Write(b)
+}
+
+// push adds a manifest with the given layers under the given tag and its
+// digest, and returns the digest of the manifest.
+func (r *ociTestRegistry) push(t *testing.T, tag string, layers map[string][]byte, mediaTypes ...string) string {
+	t.Helper()
+	digestOf := func(b []byte) string { return fmt.Sprintf("sha256:%x", sha256.Sum256(b)) }
+	manifest := oci.Manifest{SchemaVersion: 2, MediaType: oci.ManifestMediaType}
+	for i, mediaType := range mediaTypes {
+		layer := layers[mediaType+fmt.Sprint(i)]
+		r.content["/v2/app/blobs/"+digestOf(layer)] = layer
+		manifest.Layers = append(manifest.Layers, oci.Descriptor{MediaType: mediaType, Digest: digestOf(layer), Size: int64(len(layer))})
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.content["/v2/app/manifests/"+tag] = b
+	r.content["/v2/app/manifests/"+digestOf(b)] = b
+	return digestOf(b)
+}
+
+// sign adds the cosign signature of the manifest of the given digest, signed
+// with the given key.
+func (r *ociTestRegistry) sign(t *testing.T, digest string, key *ecdsa.PrivateKey) {
+	t.Helper()
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"app"},`+
+		`"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, digest))
+	sum := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(payload))
+	r.content["/v2/app/blobs/"+payloadDigest] = payload
+	manifest := oci.Manifest{SchemaVersion: 2, MediaType: oci.ManifestMediaType, Layers: []oci.Descriptor{{
+		MediaType:   oci.SimpleSigningMediaType,
+		Digest:      payloadDigest,
+		Size:        int64(len(payload)),
+		Annotations: map[string]string{"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(signature)},
+	}}}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.content["/v2/app/manifests/"+strings.Replace(digest, ":", "-", 1)+".sig"] = b
+}
+
+// gzipTarball returns a gzip compressed tarball of the given files.
+func gzipTarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var entries []tarEntry
+	for name, content := range files {
+		entries = append(entries, tarEntry{name: name, typeflag: tar.TypeReg, content: content})
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(writeTarball(t, entries)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOCIRepositoryReconciler_reconcile(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	r := &OCIRepositoryReconciler{Storage: storage}
+
+	registry := newOCITestRegistry(t)
+	digest := registry.push(t, "v1.0.0", map[string][]byte{
+		oci.FluxContentMediaType + "0": gzipTarball(t, map[string]string{"deploy.yaml": "v1", "README.md": "readme", "extra.txt": "extra"}),
+		oci.TarGzipMediaType + "1":     gzipTarball(t, map[string]string{"deploy.yaml": "v2"}),
+	}, oci.FluxContentMediaType, oci.TarGzipMediaType)
+
+	ignore := "*.txt"
+	repository := sourcev1.OCIRepository{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.OCIRepositoryKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "ocirepository", Namespace: "default"},
+		Spec: sourcev1.OCIRepositorySpec{
+			URL:       "oci://" + strings.TrimPrefix(registry.URL, "http://") + "/app",
+			Reference: &sourcev1.OCIRepositoryRef{Tag: "v1.0.0"},
+			Insecure:  true,
+			Ignore:    &ignore,
+			Timeout:   &metav1.Duration{Duration: 5 * time.Second},
+		},
+	}
+
+	// The layers are unpacked in order into the artifact, the revision is
+	// the digest of the manifest
+	got, err := r.reconcile(context.TODO(), repository)
+	if err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	artifact := got.GetArtifact()
+	if artifact == nil || artifact.Revision != digest {
+		t.Fatalf("reconcile() artifact = %+v, want revision %s", artifact, digest)
+	}
+	f, err := os.Open(storage.LocalPath(*artifact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	untarDir := t.TempDir()
+	if err := untarArtifact(*artifact, f, untarDir); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(untarDir, "deploy.yaml")); err != nil || string(b) != "v2" {
+		t.Errorf("deploy.yaml = %q, %v, want the content of the last layer", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(untarDir, "extra.txt")); !os.IsNotExist(err) {
+		t.Errorf("extra.txt is in the artifact, want it ignored")
+	}
+
+	// A layer with an unsupported media type stalls the repository
+	registry.push(t, "v2.0.0", map[string][]byte{
+		"application/vnd.cncf.helm.chart.content.v1.tar+gzip0": []byte("chart"),
+	}, "application/vnd.cncf.helm.chart.content.v1.tar+gzip")
+	repository.Spec.Reference.Tag = "v2.0.0"
+	got, err = r.reconcile(context.TODO(), repository)
+	if err == nil || !strings.Contains(err.Error(), "unsupported media type 'application/vnd.cncf.helm.chart.content.v1.tar+gzip'") {
+		t.Errorf("reconcile() of an unsupported layer error = %v, want an unsupported media type error", err)
+	}
+	if c := apimeta.FindStatusCondition(got.Status.Conditions, meta.StalledCondition); c == nil || c.Reason != sourcev1.OCILayerUnsupportedReason {
+		t.Errorf("reconcile() of an unsupported layer conditions = %v, want stalled", got.Status.Conditions)
+	}
+
+	// An unknown tag fails the reconciliation
+	repository.Spec.Reference.Tag = "v3.0.0"
+	got, err = r.reconcile(context.TODO(), repository)
+	if c := apimeta.FindStatusCondition(got.Status.Conditions, meta.ReadyCondition); err == nil || c == nil || c.Reason != sourcev1.OCIOperationFailedReason {
+		t.Errorf("reconcile() of an unknown tag = %v, %v, want %s", got.Status.Conditions, err, sourcev1.OCIOperationFailedReason)
+	}
+}
+
+func TestOCIRepositoryReconciler_verify(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cosign", Namespace: "default"},
+		Data:       map[string][]byte{"cosign.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})},
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &OCIRepositoryReconciler{
+		Client:  fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build(),
+		Storage: storage,
+	}
+
+	registry := newOCITestRegistry(t)
+	layers := map[string][]byte{oci.FluxContentMediaType + "0": gzipTarball(t, map[string]string{"deploy.yaml": "v1"})}
+	digest := registry.push(t, "v1.0.0", layers, oci.FluxContentMediaType)
+	registry.sign(t, digest, key)
+	repository := sourcev1.OCIRepository{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.OCIRepositoryKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "ocirepository", Namespace: "default"},
+		Spec: sourcev1.OCIRepositorySpec{
+			URL:          "oci://" + strings.TrimPrefix(registry.URL, "http://") + "/app",
+			Reference:    &sourcev1.OCIRepositoryRef{Tag: "v1.0.0"},
+			Insecure:     true,
+			Timeout:      &metav1.Duration{Duration: 5 * time.Second},
+			Verification: &sourcev1.OCIRepositoryVerification{Provider: "cosign", SecretRef: &meta.LocalObjectReference{Name: "cosign"}},
+		},
+	}
+
+	// a signed artifact is verified with the key of the secret
+	got, err := r.reconcile(context.TODO(), repository)
+	if err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	if got.GetArtifact() == nil || got.GetArtifact().Revision != digest {
+		t.Errorf("reconcile() artifact = %+v, want revision %s", got.GetArtifact(), digest)
+	}
+	if want := (sourcev1.OCIRepositoryVerifiedIdentity{Digest: digest, Key: "cosign.pub"}); got.Status.VerifiedIdentity == nil || *got.Status.VerifiedIdentity != want {
+		t.Errorf("reconcile() verified identity = %+v, want %+v", got.Status.VerifiedIdentity, want)
+	}
+	if !apimeta.IsStatusConditionTrue(got.Status.Conditions, sourcev1.SourceVerifiedCondition) {
+		t.Errorf("reconcile() conditions = %v, want verified", got.Status.Conditions)
+	}
+
+	// an unsigned artifact is not pulled
+	layers = map[string][]byte{oci.FluxContentMediaType + "0": gzipTarball(t, map[string]string{"deploy.yaml": "v2"})}
+	unsignedDigest := registry.push(t, "v2.0.0", layers, oci.FluxContentMediaType)
+	repository.Spec.Reference.Tag = "v2.0.0"
+	got, err = r.reconcile(context.TODO(), repository)
+	if err == nil || !strings.Contains(err.Error(), "no signatures found") {
+		t.Errorf("reconcile() of an unsigned artifact error = %v, want no signatures", err)
+	}
+	if got.GetArtifact() != nil {
+		t.Errorf("reconcile() of an unsigned artifact artifact = %+v, want none", got.GetArtifact())
+	}
+	if c := apimeta.FindStatusCondition(got.Status.Conditions, sourcev1.SourceVerifiedCondition); c == nil ||
+		c.Status != metav1.ConditionFalse || c.Reason != sourcev1.VerificationFailedReason || !strings.Contains(c.Message, unsignedDigest) {
+		t.Errorf("reconcile() of an unsigned artifact conditions = %v, want not verified", got.Status.Conditions)
+	}
+	if c := apimeta.FindStatusCondition(got.Status.Conditions, meta.ReadyCondition); c == nil || c.Reason != sourcev1.VerificationFailedReason {
+		t.Errorf("reconcile() of an unsigned artifact conditions = %v, want not ready", got.Status.Conditions)
+	}
+
+	// keyless verification requires the trusted roots of the controller
+	repository.Spec.Reference.Tag = "v1.0.0"
+	repository.Spec.Verification = &sourcev1.OCIRepositoryVerification{
+		MatchOIDCIdentity: []sourcev1.OIDCIdentityMatch{{Issuer: ".*", Subject: ".*"}},
+	}
+	if _, err = r.reconcile(context.TODO(), repository); err == nil || !strings.Contains(err.Error(), "keyless verification requires the trusted roots") {
+		t.Errorf("reconcile() keyless without roots error = %v, want the roots to be required", err)
+	}
+}
+
+func TestOCIRepositoryReconciler_mirror(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	origin, mirror := newOCITestRegistry(t), newOCITestRegistry(t)
+	originHost, mirrorHost := strings.TrimPrefix(origin.URL, "http://"), strings.TrimPrefix(mirror.URL, "http://")
+	r := &OCIRepositoryReconciler{
+		Storage: storage,
+		Mirrors: &oci.Mirrors{Mirrors: []oci.Mirror{{Host: originHost, Mirror: mirrorHost, Insecure: true}}},
+	}
+
+	layers := map[string][]byte{oci.FluxContentMediaType + "0": gzipTarball(t, map[string]string{"deploy.yaml": "v1"})}
+	mirror.push(t, "v1.0.0", layers, oci.FluxContentMediaType)
+	digest := origin.push(t, "v1.0.0", layers, oci.FluxContentMediaType)
+	repository := sourcev1.OCIRepository{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.OCIRepositoryKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "ocirepository", Namespace: "default"},
+		Spec: sourcev1.OCIRepositorySpec{
+			URL:       "oci://" + originHost + "/app",
+			Reference: &sourcev1.OCIRepositoryRef{Tag: "v1.0.0"},
+			Insecure:  true,
+			Timeout:   &metav1.Duration{Duration: 5 * time.Second},
+		},
+	}
+
+	// the artifact is pulled from the mirror
+	got, err := r.reconcile(context.TODO(), repository)
+	if err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	if got.GetArtifact() == nil || got.GetArtifact().Revision != digest || got.Status.RegistryHost != mirrorHost {
+		t.Errorf("reconcile() = %+v from %s, want revision %s from the mirror %s", got.GetArtifact(), got.Status.RegistryHost, digest, mirrorHost)
+	}
+
+	// an artifact missed by the mirror is not pulled from the origin, unless
+	// fallback is enabled
+	layers = map[string][]byte{oci.FluxContentMediaType + "0": gzipTarball(t, map[string]string{"deploy.yaml": "v2"})}
+	digest = origin.push(t, "v2.0.0", layers, oci.FluxContentMediaType)
+	origin.content["/v2/app/manifests/"+digest] = origin.content["/v2/app/manifests/v2.0.0"]
+	repository.Spec.Reference = &sourcev1.OCIRepositoryRef{Digest: digest}
+	if _, err := r.reconcile(context.TODO(), repository); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("reconcile() of a missed artifact error = %v, want not found", err)
+	}
+	r.MirrorFallback = true
+	got, err = r.reconcile(context.TODO(), repository)
+	if err != nil {
+		t.Fatalf("reconcile() with fallback error = %v", err)
+	}
+	if got.GetArtifact() == nil || got.GetArtifact().Revision != digest || got.Status.RegistryHost != originHost {
+		t.Errorf("reconcile() with fallback = %+v from %s, want revision %s from %s", got.GetArtifact(), got.Status.RegistryHost, digest, originHost)
+	}
+
+	// the manifest of a digest served by the mirror is verified against it
+	mirror.content["/v2/app/manifests/"+digest] = mirror.content["/v2/app/manifests/v1.0.0"]
+	if _, err := r.reconcile(context.TODO(), repository); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("reconcile() of a tampered mirror error = %v, want a digest mismatch", err)
+	}
+}
+
+func TestOCIRepositoryReconciler_egressPolicy(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	r := &OCIRepositoryReconciler{Storage: storage}
+
+	registry := newOCITestRegistry(t)
+	layers := map[string][]byte{oci.FluxContentMediaType + "0": gzipTarball(t, map[string]string{"deploy.yaml": "v1"})}
+	registry.push(t, "v1.0.0", layers, oci.FluxContentMediaType)
+	repository := sourcev1.OCIRepository{
+		TypeMeta:   metav1.TypeMeta{Kind: sourcev1.OCIRepositoryKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "ocirepository", Namespace: "default"},
+		Spec: sourcev1.OCIRepositorySpec{
+			URL:       "oci://" + strings.TrimPrefix(registry.URL, "http://") + "/app",
+			Reference: &sourcev1.OCIRepositoryRef{Tag: "v1.0.0"},
+			Insecure:  true,
+			Timeout:   &metav1.Duration{Duration: 5 * time.Second},
+		},
+	}
+
+	policy, err := egress.NewPolicy(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress.SetPolicy(policy)
+	defer egress.SetPolicy(nil)
+	if _, err := r.reconcile(context.TODO(), repository); !egress.IsDenied(err) || !strings.Contains(err.Error(), "rule '127.0.0.0/8'") {
+		t.Errorf("reconcile() error = %v, want denied by the rule of the egress policy", err)
+	}
+}
+
+func TestOCIRepositoryReconciler_acquirePull(t *testing.T) {
+	r := &OCIRepositoryReconciler{}
+	release, err := r.acquirePull(context.TODO())
+	if err != nil {
+		t.Fatalf("expected the pulls not to be bounded, got %v", err)
+	}
+	release()
+
+	r.pulls = make(chan struct{}, 1)
+	release, err = r.acquirePull(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.acquirePull(ctx); err == nil || !strings.Contains(err.Error(), "waiting for a pull slot") {
+		t.Errorf("expected to wait for the pull in progress, got %v", err)
+	}
+	release()
+	if release, err = r.acquirePull(context.TODO()); err != nil {
+		t.Errorf("expected the released slot to be acquired, got %v", err)
+	}
+	release()
+}
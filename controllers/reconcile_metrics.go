@@ -0,0 +1,285 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/metrics"
+)
+
+const (
+	// reconcileSucceeded is the result of a reconciliation after which the
+	// source is ready.
+	reconcileSucceeded = "success"
+	// reconcileFailed is the result of a reconciliation that failed, or
+	// after which the source is not ready.
+	reconcileFailed = "error"
+	// reconcileStalled is the result of a reconciliation after which the
+	// source is stalled, until its spec changes.
+	reconcileStalled = "stalled"
+)
+
+var (
+	// maxConcurrentReconcilesGauge is the number of concurrent reconciles of
+	// the controller of each kind of source.
+	maxConcurrentReconcilesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_max_concurrent_reconciles",
+			Help: "The maximum number of concurrent reconciles of the controller of a kind of source.",
+		},
+		[]string{"kind"},
+	)
+	// reconcileDurationHistogram is the duration of the reconciliations by
+	// kind and Ready status after the reconciliation.
+	reconcileDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gotk_source_reconcile_duration_seconds",
+			Help:    "The duration in seconds of the reconciliations of a kind of source, by Ready status after the reconciliation.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+		},
+		[]string{"kind", "ready"},
+	)
+	// reconcileTotalCounter counts the reconciliations by kind, Ready status
+	// after the reconciliation and result.
+	reconcileTotalCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_source_reconcile_total",
+			Help: "The number of reconciliations of a kind of source, by Ready status after the reconciliation and result: 'success', 'error' or 'stalled'.",
+		},
+		[]string{"kind", "ready", "result"},
+	)
+	// sourcesGauge is the number of sources by kind and Ready status after
+	// their last reconciliation.
+	sourcesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_sources",
+			Help: "The number of sources of a kind, by Ready status after their last reconciliation.",
+		},
+		[]string{"kind", "ready"},
+	)
+	// lastSuccessfulReconcileGauge is the time of the last successful
+	// reconciliation of any source of a kind.
+	lastSuccessfulReconcileGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_source_last_successful_reconcile_timestamp_seconds",
+			Help: "The Unix time of the last successful reconciliation of any source of a kind.",
+		},
+		[]string{"kind"},
+	)
+	// reconcileStartPhaseHistogram is the phase of the start of the
+	// reconciliations within the interval of the sources, from 0 to 1. The
+	// reconciliations of phase-locked sources start at the same phase, while
+	// they are evenly distributed once the sources drift apart.
+	reconcileStartPhaseHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gotk_source_reconcile_start_phase",
+			Help:    "The phase of the start of the reconciliations of a kind of source within their interval, from 0 to 1.",
+			Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+		},
+		[]string{"kind"},
+	)
+	// artifactSizeGauge is the size in bytes of the artifact in the status of
+	// a source.
+	artifactSizeGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_artifact_size_bytes",
+			Help: "The size in bytes of the artifact in the status of a source.",
+		},
+		[]string{"kind", "name", "namespace"},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(maxConcurrentReconcilesGauge, reconcileDurationHistogram, reconcileTotalCounter,
+		sourcesGauge, lastSuccessfulReconcileGauge, reconcileStartPhaseHistogram, artifactSizeGauge)
+}
+
+// recordMaxConcurrentReconciles records the maximum number of concurrent
+// reconciles of the controller of the given kind, which defaults to one.
+func recordMaxConcurrentReconciles(kind string, n int) {
+	if n < 1 {
+		n = 1
+	}
+	maxConcurrentReconcilesGauge.WithLabelValues(kind).Set(float64(n))
+}
+
+// recordReconcileStart records the phase of the given start of a
+// reconciliation of the given kind within the given interval of the source.
+func recordReconcileStart(kind string, start time.Time, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	reconcileStartPhaseHistogram.WithLabelValues(kind).Observe(reconcileStartPhase(start, interval))
+}
+
+// reconcileStartPhase returns the phase of the given start within the given
+// interval, from 0 to 1.
+func reconcileStartPhase(start time.Time, interval time.Duration) float64 {
+	return float64(start.UnixNano()%int64(interval)) / float64(interval)
+}
+
+// sourceReadiness is the Ready status of the sources after their last
+// reconciliation, by kind and namespaced name, from which the sourcesGauge is
+// computed.
+var sourceReadiness = struct {
+	sync.Mutex
+	byKind map[string]map[types.NamespacedName]metav1.ConditionStatus
+}{byKind: map[string]map[types.NamespacedName]metav1.ConditionStatus{}}
+
+// reconciledSource is a source of which the reconciliation is recorded.
+type reconciledSource interface {
+	GetName() string
+	GetNamespace() string
+	meta.ObjectWithStatusConditions
+}
+
+// recordReconcile records the duration and result of the reconciliation of the given source, which started at the
+// given time and failed with the given error, if any, labelled with the Ready status of the source after the
+// reconciliation.
+func recordReconcile(kind string, source reconciledSource, start time.Time, err error) {
+	conditions := *source.GetStatusConditions()
+	ready := metav1.ConditionUnknown
+	if rc := apimeta.FindStatusCondition(conditions, meta.ReadyCondition); rc != nil {
+		ready = rc.Status
+	}
+	result := reconcileResult(conditions, err)
+	if result == reconcileSucceeded {
+		lastSuccessfulReconcileGauge.WithLabelValues(kind).SetToCurrentTime()
+	}
+	reconcileDurationHistogram.WithLabelValues(kind, string(ready)).Observe(time.Since(start).Seconds())
+	reconcileTotalCounter.WithLabelValues(kind, string(ready), result).Inc()
+
+	sourceReadiness.Lock()
+	defer sourceReadiness.Unlock()
+	sources, ok := sourceReadiness.byKind[kind]
+	if !ok {
+		sources = map[types.NamespacedName]metav1.ConditionStatus{}
+		sourceReadiness.byKind[kind] = sources
+	}
+	sources[types.NamespacedName{Namespace: source.GetNamespace(), Name: source.GetName()}] = ready
+	updateSourcesGauge(kind)
+}
+
+// recordArtifactSize records the size of the artifact in the status of the given source of the given kind in the
+// artifactSizeGauge, or removes its artifactSizeGauge if it has no artifact, or an artifact without size.
+func recordArtifactSize(kind string, source artifactSource) {
+	artifact := source.GetArtifact()
+	if artifact == nil || artifact.Size == nil {
+		artifactSizeGauge.DeleteLabelValues(kind, source.GetName(), source.GetNamespace())
+		return
+	}
+	artifactSizeGauge.WithLabelValues(kind, source.GetName(), source.GetNamespace()).Set(float64(*artifact.Size))
+}
+
+// reconcileResult returns the result of a reconciliation with the given
+// resulting conditions and error.
+func reconcileResult(conditions []metav1.Condition, err error) string {
+	switch {
+	case apimeta.IsStatusConditionTrue(conditions, meta.StalledCondition):
+		return reconcileStalled
+	case err == nil && apimeta.IsStatusConditionTrue(conditions, meta.ReadyCondition):
+		return reconcileSucceeded
+	default:
+		return reconcileFailed
+	}
+}
+
+// forgetReconciledSource removes the source of the given kind with the given namespaced name from the sourcesGauge,
+// and removes its spec.suspend, artifactSizeGauge and advertised artifact URLs, when it is deleted.
+func forgetReconciledSource(kind string, name types.NamespacedName) {
+	sourceSuspension.Lock()
+	delete(sourceSuspension.byKind[kind], name)
+	sourceSuspension.Unlock()
+
+	forgetAdvertisedArtifact(kind, name)
+	artifactSizeGauge.DeleteLabelValues(kind, name.Name, name.Namespace)
+
+	sourceReadiness.Lock()
+	defer sourceReadiness.Unlock()
+	if _, ok := sourceReadiness.byKind[kind][name]; !ok {
+		return
+	}
+	delete(sourceReadiness.byKind[kind], name)
+	updateSourcesGauge(kind)
+}
+
+// sourceSuspension is the spec.suspend of the sources at their last reconciliation, by kind and namespaced name, to
+// detect when a source is suspended or resumed.
+var sourceSuspension = struct {
+	sync.Mutex
+	byKind map[string]map[types.NamespacedName]bool
+}{byKind: map[string]map[types.NamespacedName]bool{}}
+
+// recordSuspend records whether the source of the given kind with the given namespaced name is suspended. It returns
+// true if the source was suspended or resumed since its previous reconciliation. The first reconciliation of a source
+// after the controller started is not a transition.
+func recordSuspend(kind string, name types.NamespacedName, suspend bool) bool {
+	sourceSuspension.Lock()
+	defer sourceSuspension.Unlock()
+	sources, ok := sourceSuspension.byKind[kind]
+	if !ok {
+		sources = map[types.NamespacedName]bool{}
+		sourceSuspension.byKind[kind] = sources
+	}
+	previous, observed := sources[name]
+	sources[name] = suspend
+	return observed && previous != suspend
+}
+
+// forgetSuspendStatus removes the gotk_suspend_status series of the source of the given kind with the given namespaced
+// name from the given recorder, when it is deleted.
+func forgetSuspendStatus(recorder *metrics.Recorder, kind string, name types.NamespacedName) {
+	if recorder == nil {
+		return
+	}
+	// The recorder does not remove its series, and the suspend gauge is its
+	// only gauge with these labels
+	for _, collector := range recorder.Collectors() {
+		if gauge, ok := collector.(*prometheus.GaugeVec); ok {
+			gauge.DeleteLabelValues(kind, name.Name, name.Namespace)
+		}
+	}
+}
+
+// suspendMessage returns the message of the event emitted when a source is suspended or resumed.
+func suspendMessage(suspend bool) string {
+	if suspend {
+		return "Reconciliation suspended"
+	}
+	return "Reconciliation resumed"
+}
+
+// updateSourcesGauge sets the sourcesGauge of the given kind to the number of sources by Ready status, it must be
+// called with the sourceReadiness locked.
+func updateSourcesGauge(kind string) {
+	counts := map[metav1.ConditionStatus]int{metav1.ConditionTrue: 0, metav1.ConditionFalse: 0, metav1.ConditionUnknown: 0}
+	for _, ready := range sourceReadiness.byKind[kind] {
+		counts[ready]++
+	}
+	for ready, n := range counts {
+		sourcesGauge.WithLabelValues(kind, string(ready)).Set(float64(n))
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/metrics"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestRecordReconcile(t *testing.T) {
+	// A kind of its own, the reconcilers of the suite record the others
+	const kind = "ReconcileMetricsTest"
+	newSource := func(name string, conditions ...metav1.Condition) *sourcev1.GitRepository {
+		repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		repository.Status.Conditions = conditions
+		return repository
+	}
+	ready := metav1.Condition{Type: meta.ReadyCondition, Status: metav1.ConditionTrue}
+	notReady := metav1.Condition{Type: meta.ReadyCondition, Status: metav1.ConditionFalse}
+	stalled := metav1.Condition{Type: meta.StalledCondition, Status: metav1.ConditionTrue}
+
+	recordReconcile(kind, newSource("a", ready), time.Now(), nil)
+	if got := testutil.ToFloat64(lastSuccessfulReconcileGauge.WithLabelValues(kind)); got == 0 {
+		t.Error("last successful reconcile timestamp is not set")
+	}
+	recordReconcile(kind, newSource("b", notReady), time.Now(), errors.New("clone failed"))
+	recordReconcile(kind, newSource("c", notReady, stalled), time.Now(), nil)
+	// A source without conditions is not ready
+	recordReconcile(kind, newSource("d"), time.Now(), nil)
+	// A source reconciled again is counted once, with its last status
+	recordReconcile(kind, newSource("a", ready), time.Now(), nil)
+
+	results := []struct {
+		ready, result string
+		want          float64
+	}{
+		{"True", reconcileSucceeded, 2},
+		{"False", reconcileFailed, 1},
+		{"False", reconcileStalled, 1},
+		{"Unknown", reconcileFailed, 1},
+	}
+	for _, r := range results {
+		if got := testutil.ToFloat64(reconcileTotalCounter.WithLabelValues(kind, r.ready, r.result)); got != r.want {
+			t.Errorf("reconciles with ready %s and result %s = %v, want %v", r.ready, r.result, got, r.want)
+		}
+	}
+
+	sources := map[string]float64{"True": 1, "False": 2, "Unknown": 1}
+	for status, want := range sources {
+		if got := testutil.ToFloat64(sourcesGauge.WithLabelValues(kind, status)); got != want {
+			t.Errorf("sources with ready %s = %v, want %v", status, got, want)
+		}
+	}
+
+	// A deleted source is no longer counted
+	forgetReconciledSource(kind, types.NamespacedName{Namespace: "default", Name: "b"})
+	if got := testutil.ToFloat64(sourcesGauge.WithLabelValues(kind, "False")); got != 1 {
+		t.Errorf("sources with ready False after deletion = %v, want 1", got)
+	}
+}
+
+func TestRecordArtifactSize(t *testing.T) {
+	const kind = "ArtifactSizeMetricsTest"
+	size := int64(1024)
+	repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	repository.Status.Artifact = &sourcev1.Artifact{Path: "artifact.tar.gz", Size: &size}
+
+	recordArtifactSize(kind, repository)
+	if got := testutil.ToFloat64(artifactSizeGauge.WithLabelValues(kind, "repository", "default")); got != 1024 {
+		t.Errorf("artifact size = %v, want 1024", got)
+	}
+
+	// An artifact without size, e.g. of a previous version of the controller,
+	// is not recorded
+	repository.Status.Artifact.Size = nil
+	recordArtifactSize(kind, repository)
+	if artifactSizeGauge.DeleteLabelValues(kind, "repository", "default") {
+		t.Error("artifact size without size is recorded")
+	}
+
+	// A deleted source is no longer recorded
+	repository.Status.Artifact.Size = &size
+	recordArtifactSize(kind, repository)
+	forgetReconciledSource(kind, types.NamespacedName{Namespace: "default", Name: "repository"})
+	if artifactSizeGauge.DeleteLabelValues(kind, "repository", "default") {
+		t.Error("artifact size of a deleted source is recorded")
+	}
+}
+
+func TestRecordSuspend(t *testing.T) {
+	const kind = "SuspendMetricsTest"
+	name := types.NamespacedName{Namespace: "default", Name: "podinfo"}
+
+	// The first reconciliation after the start of the controller is not a
+	// transition
+	if recordSuspend(kind, name, false) {
+		t.Error("first reconciliation is reported as a transition")
+	}
+	if recordSuspend(kind, name, false) {
+		t.Error("reconciliation without a change of spec.suspend is reported as a transition")
+	}
+	if !recordSuspend(kind, name, true) {
+		t.Error("suspension is not reported as a transition")
+	}
+	if !recordSuspend(kind, name, false) {
+		t.Error("resumption is not reported as a transition")
+	}
+
+	forgetReconciledSource(kind, name)
+	if recordSuspend(kind, name, true) {
+		t.Error("first reconciliation of a recreated source is reported as a transition")
+	}
+}
+
+func TestForgetSuspendStatus(t *testing.T) {
+	recorder := metrics.NewRecorder()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(recorder.Collectors()...)
+	for _, name := range []string{"a", "b"} {
+		ref := corev1.ObjectReference{Kind: sourcev1.GitRepositoryKind, Name: name, Namespace: "default"}
+		recorder.RecordSuspend(ref, true)
+		recorder.RecordCondition(ref, metav1.Condition{Type: meta.ReadyCondition, Status: metav1.ConditionTrue}, false)
+	}
+
+	// The series of a deleted source is removed
+	forgetSuspendStatus(recorder, sourcev1.GitRepositoryKind, types.NamespacedName{Namespace: "default", Name: "a"})
+	if n, err := testutil.GatherAndCount(registry, "gotk_suspend_status"); err != nil || n != 1 {
+		t.Errorf("gotk_suspend_status series = %d, %v, want the series of the remaining source", n, err)
+	}
+	if n, err := testutil.GatherAndCount(registry, "gotk_reconcile_condition"); err != nil || n != 8 {
+		t.Errorf("gotk_reconcile_condition series = %d, %v, want the series of both sources", n, err)
+	}
+	forgetSuspendStatus(nil, sourcev1.GitRepositoryKind, types.NamespacedName{Namespace: "default", Name: "b"})
+}
+
+func TestReconcileStartPhase(t *testing.T) {
+	interval := time.Minute
+	start := time.Unix(0, 0).Add(100 * interval)
+	tests := []struct {
+		start time.Time
+		want  float64
+	}{
+		{start, 0},
+		{start.Add(interval / 2), 0.5},
+		{start.Add(interval + interval/4), 0.25},
+	}
+	for _, tt := range tests {
+		if got := reconcileStartPhase(tt.start, interval); got != tt.want {
+			t.Errorf("reconcileStartPhase(%s) = %v, want %v", tt.start, got, tt.want)
+		}
+	}
+}
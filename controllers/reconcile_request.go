@@ -0,0 +1,39 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/apis/meta"
+)
+
+// reconcileRequestPending returns if the reconcile request annotation of the
+// given object changed since the handled value recorded in its status, i.e.
+// the object was annotated again while it was reconciled. The request is then
+// not handled by the reconciliation, and the object must be reconciled again
+// for the requester to observe it in status.lastHandledReconcileAt.
+func reconcileRequestPending(ctx context.Context, c client.Reader, obj client.Object, handled string) bool {
+	latest := obj.DeepCopyObject().(client.Object)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), latest); err != nil {
+		return false
+	}
+	v, ok := meta.ReconcileAnnotationValue(latest.GetAnnotations())
+	return ok && v != handled
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestReconcileRequestPending(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	bucket := &sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(bucket).Build()
+	ctx := context.TODO()
+
+	annotate := func(value string) {
+		t.Helper()
+		obj := &sourcev1.Bucket{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(bucket), obj); err != nil {
+			t.Fatal(err)
+		}
+		patch := client.MergeFrom(obj.DeepCopy())
+		obj.SetAnnotations(map[string]string{meta.ReconcileRequestAnnotation: value})
+		if err := c.Patch(ctx, obj, patch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An object without a reconcile request
+	if reconcileRequestPending(ctx, c, bucket, "") {
+		t.Error("request is pending for an object without annotation")
+	}
+
+	// The reconciliation handles the request of the object it started with
+	annotate("first")
+	if reconcileRequestPending(ctx, c, bucket, "first") {
+		t.Error("handled request is pending")
+	}
+
+	// A request annotated during the reconciliation is not handled by it
+	annotate("second")
+	if !reconcileRequestPending(ctx, c, bucket, "first") {
+		t.Error("request annotated during the reconciliation is not pending")
+	}
+
+	// A deleted object is not reconciled again
+	if err := c.Delete(ctx, bucket); err != nil {
+		t.Fatal(err)
+	}
+	if reconcileRequestPending(ctx, c, bucket, "first") {
+		t.Error("request is pending for a deleted object")
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/redact"
+)
+
+const (
+	// spanAttributeKind is the attribute of the kind of the source of a span.
+	spanAttributeKind = attribute.Key("source.kind")
+	// spanAttributeNamespace is the attribute of the namespace of the source
+	// of a span.
+	spanAttributeNamespace = attribute.Key("source.namespace")
+	// spanAttributeName is the attribute of the name of the source of a span.
+	spanAttributeName = attribute.Key("source.name")
+	// spanAttributeRevision is the attribute of the revision of the artifact
+	// of the reconciliation of a span.
+	spanAttributeRevision = attribute.Key("source.revision")
+)
+
+// ReconcileSpans exports an OpenTelemetry span of every reconciliation of a
+// source, with a child span of each of the phases of the trace of the
+// reconciliation, e.g. its auth, fetch, verify, archive and store phases.
+// The spans have the kind, namespace and name of the source, and the span of
+// the reconciliation the revision of its artifact. The span of the
+// reconciliation is in the context of the reconciliation, for the outbound
+// requests to propagate it. A nil ReconcileSpans exports nothing, and adds
+// nothing to the reconciliations.
+type ReconcileSpans struct {
+	tracer trace.Tracer
+}
+
+// NewReconcileSpans returns a ReconcileSpans which starts the spans with the
+// given tracer.
+func NewReconcileSpans(tracer trace.Tracer) *ReconcileSpans {
+	return &ReconcileSpans{tracer: tracer}
+}
+
+// reconcileSpanKey is the key of the spans in the context of a
+// reconciliation.
+type reconcileSpanKey struct{}
+
+// reconcileSpan is the span of a reconciliation in progress, and the span of
+// its current phase.
+type reconcileSpan struct {
+	mu     sync.Mutex
+	tracer trace.Tracer
+	ctx    context.Context
+	attrs  []attribute.KeyValue
+	phase  trace.Span
+}
+
+// Reconciler returns the given reconciler of the given kind, of which the
+// reconciliations are exported as spans. A nil ReconcileSpans returns the
+// reconciler as is.
+func (s *ReconcileSpans) Reconciler(kind string, r reconcile.Reconciler) reconcile.Reconciler {
+	if s == nil {
+		return r
+	}
+	return reconcile.Func(func(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+		attrs := []attribute.KeyValue{
+			spanAttributeKind.String(kind),
+			spanAttributeNamespace.String(req.Namespace),
+			spanAttributeName.String(req.Name),
+		}
+		ctx, span := s.tracer.Start(ctx, "reconcile "+kind, trace.WithAttributes(attrs...))
+		rs := &reconcileSpan{tracer: s.tracer, ctx: ctx, attrs: attrs}
+		result, err := r.Reconcile(context.WithValue(ctx, reconcileSpanKey{}, rs), req)
+		rs.mu.Lock()
+		if rs.phase != nil {
+			endSpan(rs.phase, err)
+			rs.phase = nil
+		}
+		rs.mu.Unlock()
+		endSpan(span, err)
+		return result, err
+	})
+}
+
+// spanPhase ends the span of the current phase of the span of the given
+// context, if any, and starts the span of the phase with the given name.
+func spanPhase(ctx context.Context, name string) {
+	rs, ok := ctx.Value(reconcileSpanKey{}).(*reconcileSpan)
+	if !ok {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.phase != nil {
+		rs.phase.End()
+	}
+	_, rs.phase = rs.tracer.Start(rs.ctx, name, trace.WithAttributes(rs.attrs...))
+}
+
+// spanRevision records the revision of the given artifact on the span of the
+// reconciliation of the given context, if any.
+func spanRevision(ctx context.Context, artifact *sourcev1.Artifact) {
+	if _, ok := ctx.Value(reconcileSpanKey{}).(*reconcileSpan); !ok || artifact == nil {
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(spanAttributeRevision.String(artifact.Revision))
+}
+
+// endSpan ends the given span, with the redacted error, if any, as its
+// status.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, redact.String(err.Error()))
+	}
+	span.End()
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/redact"
+)
+
+const (
+	// tracePhaseGC is the phase in which the previous artifacts of a source
+	// are garbage collected.
+	tracePhaseGC = "gc"
+	// tracePhaseAuth is the phase in which the credentials of a source are
+	// read, and its client is configured.
+	tracePhaseAuth = "auth"
+	// tracePhaseFetch is the phase in which the upstream of a source is
+	// fetched, e.g. a Git repository is cloned.
+	tracePhaseFetch = "fetch"
+	// tracePhaseVerify is the phase in which the fetched upstream is
+	// verified, e.g. the signature of a Git commit.
+	tracePhaseVerify = "verify"
+	// tracePhaseArchive is the phase in which the artifact is built, e.g.
+	// archived or packaged, and written to the storage.
+	tracePhaseArchive = "archive"
+	// tracePhaseStore is the phase in which the artifact is made available,
+	// e.g. its latest symlink is updated.
+	tracePhaseStore = "store"
+
+	// DefaultReconcileTraceMaxSize is the default maximum size of a trace,
+	// in bytes of its JSON encoding.
+	DefaultReconcileTraceMaxSize = 1024
+)
+
+// ReconcileTracer records a compact trace of every reconciliation of a
+// source, its ordered phases with their duration, which replaces the trace
+// of the previous reconciliation in the status of the source when the
+// reconciliation completes. The trace is capped at MaxSize bytes, by dropping
+// the details of the phases first, then the first phases. The details are
+// redacted, as they may contain URLs. A nil ReconcileTracer records nothing,
+// and removes the trace from the status.
+type ReconcileTracer struct {
+	// MaxSize is the maximum size of a trace, in bytes of its JSON encoding,
+	// zero does not cap the trace.
+	MaxSize int
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// NewReconcileTracer returns a ReconcileTracer with the given maximum size.
+func NewReconcileTracer(maxSize int) *ReconcileTracer {
+	return &ReconcileTracer{MaxSize: maxSize, now: time.Now}
+}
+
+// reconcileTraceKey is the key of the trace in the context of a
+// reconciliation.
+type reconcileTraceKey struct{}
+
+// reconcileTrace is the trace of a reconciliation in progress.
+type reconcileTrace struct {
+	mu         sync.Mutex
+	now        func() time.Time
+	start      time.Time
+	phaseStart time.Time
+	phaseOpen  bool
+	phases     []sourcev1.ReconcileTracePhase
+}
+
+// start returns the given context with a new trace of a reconciliation,
+// which started at the given time. A nil ReconcileTracer returns the context
+// as is.
+func (t *ReconcileTracer) start(ctx context.Context, start time.Time) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, reconcileTraceKey{}, &reconcileTrace{now: t.now, start: start})
+}
+
+// tracePhase ends the current phase of the trace of the given context, if
+// any, and starts the phase with the given name, as well as the span of the
+// phase, if any.
+func tracePhase(ctx context.Context, name string) {
+	spanPhase(ctx, name)
+	trace, ok := ctx.Value(reconcileTraceKey{}).(*reconcileTrace)
+	if !ok {
+		return
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	now := trace.now()
+	trace.endPhase(now)
+	trace.phases = append(trace.phases, sourcev1.ReconcileTracePhase{Name: name})
+	trace.phaseStart, trace.phaseOpen = now, true
+}
+
+// tracePhaseDetail sets the detail of the current phase of the trace of the
+// given context, if any.
+func tracePhaseDetail(ctx context.Context, format string, a ...interface{}) {
+	trace, ok := ctx.Value(reconcileTraceKey{}).(*reconcileTrace)
+	if !ok {
+		return
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	if n := len(trace.phases); n > 0 {
+		trace.phases[n-1].Detail = redact.String(fmt.Sprintf(format, a...))
+	}
+}
+
+// endPhase records the duration of the current phase, if any, the caller
+// must hold the lock.
+func (t *reconcileTrace) endPhase(now time.Time) {
+	if t.phaseOpen {
+		t.phases[len(t.phases)-1].Duration = roundedDuration(now.Sub(t.phaseStart))
+		t.phaseOpen = false
+	}
+}
+
+// finish ends the trace of the given context, and returns it with the result
+// of the reconciliation, from the given conditions and error. The error is
+// the detail of the phase that failed, the last one. It returns nil if the
+// context has no trace.
+func (t *ReconcileTracer) finish(ctx context.Context, conditions []metav1.Condition, err error) *sourcev1.ReconcileTrace {
+	if t == nil {
+		return nil
+	}
+	trace, ok := ctx.Value(reconcileTraceKey{}).(*reconcileTrace)
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		tracePhaseDetail(ctx, "%s", err.Error())
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	now := trace.now()
+	trace.endPhase(now)
+	result := &sourcev1.ReconcileTrace{
+		StartTime: metav1.NewTime(trace.start),
+		Duration:  roundedDuration(now.Sub(trace.start)),
+		Result:    reconcileResult(conditions, err),
+		Phases:    append([]sourcev1.ReconcileTracePhase(nil), trace.phases...),
+	}
+	capReconcileTrace(result, t.MaxSize)
+	return result
+}
+
+// capReconcileTrace caps the given trace at the given size, in bytes of its
+// JSON encoding, by dropping the details of the phases in order, the detail
+// of the last phase, which has the error of a failed reconciliation, last,
+// and then the first phases.
+func capReconcileTrace(trace *sourcev1.ReconcileTrace, maxSize int) {
+	if maxSize <= 0 {
+		return
+	}
+	fits := func() bool {
+		b, err := json.Marshal(trace)
+		return err == nil && len(b) <= maxSize
+	}
+	for i := range trace.Phases {
+		if fits() {
+			return
+		}
+		if trace.Phases[i].Detail != "" {
+			trace.Phases[i].Detail = ""
+			trace.Truncated = true
+		}
+	}
+	for len(trace.Phases) > 0 && !fits() {
+		trace.Phases = trace.Phases[1:]
+		trace.Truncated = true
+	}
+}
+
+// roundedDuration returns the given duration rounded to the millisecond,
+// for a compact trace. A positive duration is at least a millisecond.
+func roundedDuration(d time.Duration) metav1.Duration {
+	rounded := d.Round(time.Millisecond)
+	if rounded == 0 && d > 0 {
+		rounded = time.Millisecond
+	}
+	return metav1.Duration{Duration: rounded}
+}
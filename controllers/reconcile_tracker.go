@@ -0,0 +1,155 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// reconcilePhaseStarting is the phase of a reconciliation that did not
+	// fetch its upstream yet, e.g. while its status is reset.
+	reconcilePhaseStarting = "starting"
+	// reconcilePhaseFetching is the phase of a reconciliation that fetches
+	// its upstream, e.g. clones a Git repository.
+	reconcilePhaseFetching = "fetching"
+	// reconcilePhaseStoring is the phase of a reconciliation that writes its
+	// artifact to the storage.
+	reconcilePhaseStoring = "storing"
+	// reconcilePhaseUpdatingStatus is the phase of a reconciliation that
+	// records its result in the status of the source.
+	reconcilePhaseUpdatingStatus = "updating-status"
+	// reconcilePhaseDeleting is the phase of a reconciliation that removes
+	// the artifacts of a deleted source.
+	reconcilePhaseDeleting = "deleting"
+)
+
+// InFlightReconcile is a reconciliation in progress.
+type InFlightReconcile struct {
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Phase     string    `json:"phase"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// ReconcileTracker tracks the reconciliations in progress, and their phase,
+// to diagnose the reconciliations that hang, e.g. on a Git operation. It is
+// served as a JSON list by the debug endpoint. A nil ReconcileTracker tracks
+// nothing.
+type ReconcileTracker struct {
+	mu       sync.Mutex
+	next     uint64
+	inFlight map[uint64]*InFlightReconcile
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// NewReconcileTracker returns an empty ReconcileTracker.
+func NewReconcileTracker() *ReconcileTracker {
+	return &ReconcileTracker{
+		inFlight: map[uint64]*InFlightReconcile{},
+		now:      time.Now,
+	}
+}
+
+// trackedReconcileKey is the key of the tracked reconciliation in the
+// context of a reconciliation.
+type trackedReconcileKey struct{}
+
+// trackedReconcile is the tracked reconciliation in the context of a
+// reconciliation.
+type trackedReconcile struct {
+	tracker *ReconcileTracker
+	id      uint64
+}
+
+// Reconciler returns the given reconciler of the given kind, of which the
+// reconciliations are tracked. A nil ReconcileTracker returns the reconciler
+// as is.
+func (t *ReconcileTracker) Reconciler(kind string, r reconcile.Reconciler) reconcile.Reconciler {
+	if t == nil {
+		return r
+	}
+	return reconcile.Func(func(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+		t.mu.Lock()
+		t.next++
+		id := t.next
+		t.inFlight[id] = &InFlightReconcile{
+			Kind:      kind,
+			Namespace: req.Namespace,
+			Name:      req.Name,
+			Phase:     reconcilePhaseStarting,
+			StartedAt: t.now(),
+		}
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			delete(t.inFlight, id)
+			t.mu.Unlock()
+		}()
+		return r.Reconcile(context.WithValue(ctx, trackedReconcileKey{}, trackedReconcile{tracker: t, id: id}), req)
+	})
+}
+
+// InFlight returns the reconciliations in progress, the oldest first.
+func (t *ReconcileTracker) InFlight() []InFlightReconcile {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	reconciles := make([]InFlightReconcile, 0, len(t.inFlight))
+	for _, r := range t.inFlight {
+		reconciles = append(reconciles, *r)
+	}
+	t.mu.Unlock()
+	sort.Slice(reconciles, func(i, j int) bool {
+		return reconciles[i].StartedAt.Before(reconciles[j].StartedAt)
+	})
+	return reconciles
+}
+
+// ServeHTTP serves the reconciliations in progress as a JSON list.
+func (t *ReconcileTracker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.InFlight()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// setReconcilePhase records the given phase of the tracked reconciliation of
+// the given context, if any.
+func setReconcilePhase(ctx context.Context, phase string) {
+	tracked, ok := ctx.Value(trackedReconcileKey{}).(trackedReconcile)
+	if !ok {
+		return
+	}
+	tracked.tracker.mu.Lock()
+	defer tracked.tracker.mu.Unlock()
+	if r, ok := tracked.tracker.inFlight[tracked.id]; ok {
+		r.Phase = phase
+	}
+}
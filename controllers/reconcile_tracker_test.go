@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestReconcileTracker(t *testing.T) {
+	tracker := NewReconcileTracker()
+	now := time.Now()
+	tracker.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	r := reconcile.Func(func(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+		setReconcilePhase(ctx, reconcilePhaseFetching)
+		started <- struct{}{}
+		<-release
+		return ctrl.Result{}, nil
+	})
+	done := make(chan struct{})
+	for _, name := range []string{"a", "b"} {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}
+		go func() {
+			tracker.Reconciler(sourcev1.GitRepositoryKind, r).Reconcile(context.Background(), req)
+			done <- struct{}{}
+		}()
+		<-started
+	}
+
+	rec := httptest.NewRecorder()
+	tracker.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/reconciles", nil))
+	var got []InFlightReconcile
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("in-flight reconciles = %v, want 2", got)
+	}
+	for i, name := range []string{"a", "b"} {
+		if got[i].Kind != sourcev1.GitRepositoryKind || got[i].Name != name || got[i].Namespace != "default" ||
+			got[i].Phase != reconcilePhaseFetching {
+			t.Errorf("in-flight reconcile %d = %+v, want %s fetching", i, got[i], name)
+		}
+	}
+	if !got[0].StartedAt.Before(got[1].StartedAt) {
+		t.Error("in-flight reconciles are not sorted by start")
+	}
+
+	close(release)
+	<-done
+	<-done
+	if got := tracker.InFlight(); len(got) != 0 {
+		t.Errorf("in-flight reconciles after completion = %v, want none", got)
+	}
+
+	// The phase of a reconciliation that is not tracked is ignored
+	setReconcilePhase(context.Background(), reconcilePhaseFetching)
+	var disabled *ReconcileTracker
+	if disabled.Reconciler(sourcev1.GitRepositoryKind, r) == nil || disabled.InFlight() != nil {
+		t.Error("nil tracker does not return the reconciler as is")
+	}
+}
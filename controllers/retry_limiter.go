@@ -0,0 +1,175 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fluxcd/pkg/apis/meta"
+)
+
+const (
+	// DefaultMinRetryDelay is the default delay of the first retry of a
+	// failed reconciliation, as the default rate limiter of controller-runtime.
+	DefaultMinRetryDelay = 5 * time.Millisecond
+	// DefaultMaxRetryDelay is the default maximum delay between the retries
+	// of a failed reconciliation, as the default rate limiter of
+	// controller-runtime.
+	DefaultMaxRetryDelay = 1000 * time.Second
+)
+
+// RetryLimiter is the workqueue.RateLimiter of the failed reconciliations of
+// a source controller. The delay of a retry doubles with every failure of the
+// object, from MinDelay up to MaxDelay, or up to the retry interval of the
+// object if it is shorter. The retry of an object rate limited by its
+// upstream is instead delayed until the rate limit is reset.
+type RetryLimiter struct {
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	mu          sync.Mutex
+	failures    map[interface{}]int
+	maxDelays   map[interface{}]time.Duration
+	retryAfters map[interface{}]time.Time
+}
+
+// NewRetryLimiter returns a RetryLimiter with the given minimum and maximum
+// delay, a zero delay defaults to DefaultMinRetryDelay or
+// DefaultMaxRetryDelay.
+func NewRetryLimiter(minDelay, maxDelay time.Duration) *RetryLimiter {
+	if minDelay <= 0 {
+		minDelay = DefaultMinRetryDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxRetryDelay
+	}
+	return &RetryLimiter{
+		MinDelay:    minDelay,
+		MaxDelay:    maxDelay,
+		failures:    map[interface{}]int{},
+		maxDelays:   map[interface{}]time.Duration{},
+		retryAfters: map[interface{}]time.Time{},
+	}
+}
+
+// rateLimiter returns the rate limiter of the work queue of a controller,
+// which limits the retries of every object by the RetryLimiter and the
+// retries of all objects by the overall rate of the default rate limiter of
+// controller-runtime.
+func (l *RetryLimiter) rateLimiter() workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		l,
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+// When returns the delay of the next retry of the given item, and records
+// its failure.
+func (l *RetryLimiter) When(item interface{}) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delay := l.delay(item)
+	l.failures[item]++
+	return delay
+}
+
+// Forget resets the failures and the retry interval of the given item.
+func (l *RetryLimiter) Forget(item interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, item)
+	delete(l.maxDelays, item)
+	delete(l.retryAfters, item)
+}
+
+// NumRequeues returns the number of failures of the given item.
+func (l *RetryLimiter) NumRequeues(item interface{}) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failures[item]
+}
+
+// setMaxDelay caps the delay of the retries of the given item at the given
+// retry interval of the object, nil uses the MaxDelay.
+func (l *RetryLimiter) setMaxDelay(item interface{}, interval *metav1.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if interval == nil || interval.Duration <= 0 {
+		delete(l.maxDelays, item)
+		return
+	}
+	l.maxDelays[item] = interval.Duration
+}
+
+// setRetryAfter delays the retries of the given item until the given time,
+// at which the rate limit of its upstream is reset, instead of backing off.
+// A zero time backs off again.
+func (l *RetryLimiter) setRetryAfter(item interface{}, t time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.IsZero() {
+		delete(l.retryAfters, item)
+		return
+	}
+	l.retryAfters[item] = t
+}
+
+// nextRetryTime returns the time of the next retry of the given item after
+// a reconciliation with the given error and resulting conditions, without
+// recording the failure. It returns nil if the reconciliation succeeded or
+// stalled, as the object is then reconciled at its interval.
+func (l *RetryLimiter) nextRetryTime(item interface{}, reconcileErr error, conditions []metav1.Condition) *metav1.Time {
+	if l == nil || reconcileErr == nil || apimeta.IsStatusConditionTrue(conditions, meta.StalledCondition) {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := metav1.NewTime(time.Now().Add(l.delay(item)))
+	return &t
+}
+
+// delay returns the delay of the next retry of the given item, the caller
+// must hold the lock.
+func (l *RetryLimiter) delay(item interface{}) time.Duration {
+	if t, ok := l.retryAfters[item]; ok {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	maxDelay := l.MaxDelay
+	if d, ok := l.maxDelays[item]; ok && d < maxDelay {
+		maxDelay = d
+	}
+	delay := float64(l.MinDelay) * math.Pow(2, float64(l.failures[item]))
+	if delay > float64(maxDelay) {
+		return maxDelay
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/pkg/apis/meta"
+)
+
+func TestNewRetryLimiter(t *testing.T) {
+	l := NewRetryLimiter(0, 0)
+	if l.MinDelay != DefaultMinRetryDelay || l.MaxDelay != DefaultMaxRetryDelay {
+		t.Errorf("delays = %s, %s, want the defaults %s, %s", l.MinDelay, l.MaxDelay, DefaultMinRetryDelay, DefaultMaxRetryDelay)
+	}
+	l = NewRetryLimiter(time.Second, time.Minute)
+	if l.MinDelay != time.Second || l.MaxDelay != time.Minute {
+		t.Errorf("delays = %s, %s, want 1s, 1m0s", l.MinDelay, l.MaxDelay)
+	}
+}
+
+func TestRetryLimiter_When(t *testing.T) {
+	l := NewRetryLimiter(time.Second, time.Minute)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "podinfo"}}
+	other := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "other"}}
+
+	// The delay doubles with every failure up to the maximum
+	for _, want := range []time.Duration{1, 2, 4, 8, 16, 32, 60, 60} {
+		if got := l.When(req); got != want*time.Second {
+			t.Errorf("When() = %s, want %s", got, want*time.Second)
+		}
+	}
+	if got := l.NumRequeues(req); got != 8 {
+		t.Errorf("NumRequeues() = %d, want 8", got)
+	}
+	if got := l.When(other); got != time.Second {
+		t.Errorf("When() of another object = %s, want 1s", got)
+	}
+
+	// The retry interval of the object caps the delay, but does not
+	// exceed the maximum
+	l.setMaxDelay(req, &metav1.Duration{Duration: 10 * time.Second})
+	if got := l.When(req); got != 10*time.Second {
+		t.Errorf("When() with a retry interval = %s, want 10s", got)
+	}
+	l.setMaxDelay(req, &metav1.Duration{Duration: time.Hour})
+	if got := l.When(req); got != time.Minute {
+		t.Errorf("When() with a retry interval above the maximum = %s, want 1m0s", got)
+	}
+
+	// The next retry time does not record a failure
+	next := l.nextRetryTime(req, errors.New("clone failed"), nil)
+	if next == nil || next.Sub(time.Now()) > time.Minute {
+		t.Errorf("nextRetryTime() = %v, want within 1m0s", next)
+	}
+	if got := l.NumRequeues(req); got != 10 {
+		t.Errorf("NumRequeues() after nextRetryTime() = %d, want 10", got)
+	}
+	stalled := []metav1.Condition{{Type: meta.StalledCondition, Status: metav1.ConditionTrue}}
+	if next := l.nextRetryTime(req, errors.New("artifact too large"), stalled); next != nil {
+		t.Errorf("nextRetryTime() of a stalled object = %v, want nil", next)
+	}
+	if next := l.nextRetryTime(req, nil, nil); next != nil {
+		t.Errorf("nextRetryTime() of a successful reconciliation = %v, want nil", next)
+	}
+
+	// A success resets the failures and the retry interval
+	l.setMaxDelay(req, &metav1.Duration{Duration: 10 * time.Second})
+	l.Forget(req)
+	if got := l.NumRequeues(req); got != 0 {
+		t.Errorf("NumRequeues() after Forget() = %d, want 0", got)
+	}
+	for _, want := range []time.Duration{1, 2, 4, 8, 16} {
+		if got := l.When(req); got != want*time.Second {
+			t.Errorf("When() after Forget() = %s, want %s", got, want*time.Second)
+		}
+	}
+
+	// The rate limiter of the controller delays by the RetryLimiter
+	if got := l.rateLimiter().When(other); got != 2*time.Second {
+		t.Errorf("When() of the controller rate limiter = %s, want 2s", got)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// indexBySecretRefs returns the names of the Secrets referenced by the given source, for the sourcev1.SecretIndexKey
+// index. The Secrets are in the namespace of the source.
+func indexBySecretRefs(o client.Object) []string {
+	var names []string
+	add := func(name string) {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	switch s := o.(type) {
+	case *sourcev1.GitRepository:
+		if s.Spec.SecretRef != nil {
+			add(s.Spec.SecretRef.Name)
+		}
+		if s.Spec.Verification != nil {
+			add(s.Spec.Verification.SecretRef.Name)
+		}
+		for _, ref := range s.Spec.SubmoduleSecretRefs {
+			add(ref.SecretRef.Name)
+		}
+		if s.Spec.ProxySecretRef != nil {
+			add(s.Spec.ProxySecretRef.Name)
+		}
+	case *sourcev1.HelmRepository:
+		if s.Spec.SecretRef != nil {
+			add(s.Spec.SecretRef.Name)
+		}
+		if s.Spec.ProxySecretRef != nil {
+			add(s.Spec.ProxySecretRef.Name)
+		}
+	case *sourcev1.OCIRepository:
+		if s.Spec.SecretRef != nil {
+			add(s.Spec.SecretRef.Name)
+		}
+	case *sourcev1.Bucket:
+		if s.Spec.SecretRef != nil {
+			add(s.Spec.SecretRef.Name)
+		}
+		if s.Spec.STS != nil && s.Spec.STS.WebIdentityTokenSecretRef != nil {
+			add(s.Spec.STS.WebIdentityTokenSecretRef.Name)
+		}
+		if s.Spec.ProxySecretRef != nil {
+			add(s.Spec.ProxySecretRef.Name)
+		}
+	default:
+		panic(fmt.Sprintf("Expected a GitRepository, HelmRepository, OCIRepository or Bucket, got %T", o))
+	}
+	return names
+}
+
+// requestsForSecretChange returns the reconcile requests for the sources of the given list type that reference the
+// given Secret, listed with the sourcev1.SecretIndexKey index. Only the sources in the namespace of the Secret can
+// reference it.
+func requestsForSecretChange(r client.Reader, list client.ObjectList, o client.Object) []reconcile.Request {
+	secret, ok := o.(*corev1.Secret)
+	if !ok {
+		panic(fmt.Sprintf("Expected a Secret, got %T", o))
+	}
+
+	return requestsForIndexedName(r, list, sourcev1.SecretIndexKey, secret)
+}
+
+// requestsForIndexedName returns the reconcile requests for the sources of the given list type in the namespace of
+// the given object, of which the given index contains the name of the object.
+func requestsForIndexedName(r client.Reader, list client.ObjectList, indexKey string, o client.Object) []reconcile.Request {
+	if err := r.List(context.Background(), list, client.InNamespace(o.GetNamespace()), client.MatchingFields{
+		indexKey: o.GetName(),
+	}); err != nil {
+		return nil
+	}
+	items, err := apimeta.ExtractList(list)
+	if err != nil {
+		return nil
+	}
+	var reqs []reconcile.Request
+	for _, item := range items {
+		if obj, ok := item.(client.Object); ok {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(obj)})
+		}
+	}
+	return reqs
+}
+
+// containsString returns true if the given slice contains the given string.
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestIndexBySecretRefs(t *testing.T) {
+	tests := []struct {
+		name   string
+		source client.Object
+		want   []string
+	}{
+		{
+			name:   "GitRepository without secrets",
+			source: &sourcev1.GitRepository{},
+		},
+		{
+			name: "GitRepository with auth and verification secrets",
+			source: &sourcev1.GitRepository{Spec: sourcev1.GitRepositorySpec{
+				SecretRef: &meta.LocalObjectReference{Name: "auth"},
+				Verification: &sourcev1.GitRepositoryVerification{
+					Mode:      "head",
+					SecretRef: meta.LocalObjectReference{Name: "pgp-public-keys"},
+				},
+			}},
+			want: []string{"auth", "pgp-public-keys"},
+		},
+		{
+			name: "GitRepository with submodule secrets",
+			source: &sourcev1.GitRepository{Spec: sourcev1.GitRepositorySpec{
+				SecretRef: &meta.LocalObjectReference{Name: "auth"},
+				SubmoduleSecretRefs: []sourcev1.GitRepositorySubmoduleSecretRef{
+					{Host: "gitlab.com", SecretRef: meta.LocalObjectReference{Name: "gitlab-auth"}},
+				},
+			}},
+			want: []string{"auth", "gitlab-auth"},
+		},
+		{
+			name: "GitRepository with proxy secret",
+			source: &sourcev1.GitRepository{Spec: sourcev1.GitRepositorySpec{
+				ProxySecretRef: &meta.LocalObjectReference{Name: "proxy"},
+			}},
+			want: []string{"proxy"},
+		},
+		{
+			name: "HelmRepository with auth and proxy secrets",
+			source: &sourcev1.HelmRepository{Spec: sourcev1.HelmRepositorySpec{
+				SecretRef:      &meta.LocalObjectReference{Name: "auth"},
+				ProxySecretRef: &meta.LocalObjectReference{Name: "proxy"},
+			}},
+			want: []string{"auth", "proxy"},
+		},
+		{
+			name: "OCIRepository with registry secret",
+			source: &sourcev1.OCIRepository{Spec: sourcev1.OCIRepositorySpec{
+				SecretRef: &meta.LocalObjectReference{Name: "registry"},
+			}},
+			want: []string{"registry"},
+		},
+		{
+			name: "Bucket with credentials and web identity token secrets",
+			source: &sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+				SecretRef: &meta.LocalObjectReference{Name: "credentials"},
+				STS: &sourcev1.BucketSTSSpec{
+					WebIdentityTokenSecretRef: &meta.LocalObjectReference{Name: "token"},
+				},
+			}},
+			want: []string{"credentials", "token"},
+		},
+		{
+			name: "Bucket with proxy secret",
+			source: &sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+				ProxySecretRef: &meta.LocalObjectReference{Name: "proxy"},
+			}},
+			want: []string{"proxy"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := indexBySecretRefs(tt.source); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("indexBySecretRefs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+// caBundleFromRef returns the PEM encoded CA certificates of the key of the
+// ConfigMap with the given reference in the given namespace, read from its
+// data or binary data. It returns nil if the reference is nil, and an error
+// if the ConfigMap or the key is missing, or the key does not contain any PEM
+// encoded certificates.
+func caBundleFromRef(ctx context.Context, c client.Reader, namespace string,
+	ref *sourcev1.ConfigMapKeyReference) ([]byte, error) {
+	if ref == nil {
+		return nil, nil
+	}
+	var cm corev1.ConfigMap
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &cm); err != nil {
+		return nil, fmt.Errorf("CA config map error: %w", err)
+	}
+	key := ref.GetKey()
+	caBundle, ok := cm.BinaryData[key]
+	if data, found := cm.Data[key]; found {
+		caBundle, ok = []byte(data), true
+	}
+	if !ok {
+		return nil, fmt.Errorf("CA config map error: invalid '%s' config map data: required key '%s'", cm.Name, key)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("CA config map error: invalid '%s' config map data: key '%s' does not contain any PEM encoded certificates%s",
+			cm.Name, key, secretdata.Hint(key, caBundle))
+	}
+	return caBundle, nil
+}
+
+// appendCABundle returns the given CA bundle appended with the given CA
+// certificates, separated by a newline.
+func appendCABundle(caBundle, certs []byte) []byte {
+	if len(caBundle) == 0 {
+		return certs
+	}
+	bundle := append(append([]byte{}, caBundle...), '\n')
+	return append(bundle, certs...)
+}
+
+// secretWithCABundle returns a copy of the given Secret, which may be nil, of
+// which the 'caFile' field, or else the 'ca.crt' field, is appended with the
+// given CA certificates, for the certificates of the server to be verified
+// against both. It returns the given Secret if there are no CA certificates.
+func secretWithCABundle(secret *corev1.Secret, caBundle []byte) *corev1.Secret {
+	if len(caBundle) == 0 {
+		return secret
+	}
+	s := &corev1.Secret{}
+	if secret != nil {
+		s = secret.DeepCopy()
+	}
+	if s.Data == nil {
+		s.Data = map[string][]byte{}
+	}
+	field := transport.CAFileField
+	if _, ok := s.Data[field]; !ok {
+		if _, ok := s.Data[transport.CACrtField]; ok {
+			field = transport.CACrtField
+		}
+	}
+	s.Data[field] = appendCABundle(s.Data[field], caBundle)
+	return s
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestCABundleFromRef(t *testing.T) {
+	ca, err := os.ReadFile("testdata/certs/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "internal-ca", Namespace: "default"},
+			Data:       map[string]string{"ca.crt": string(ca), "invalid": "not a certificate"},
+			BinaryData: map[string][]byte{"bundle.pem": ca},
+		},
+	).Build()
+	ctx := context.TODO()
+
+	if got, err := caBundleFromRef(ctx, c, "default", nil); got != nil || err != nil {
+		t.Errorf("caBundleFromRef() without a reference = %q, %v, want nil", got, err)
+	}
+	for _, key := range []string{"", "ca.crt", "bundle.pem"} {
+		got, err := caBundleFromRef(ctx, c, "default", &sourcev1.ConfigMapKeyReference{Name: "internal-ca", Key: key})
+		if err != nil || !bytes.Equal(got, ca) {
+			t.Errorf("caBundleFromRef() of the '%s' key = %q, %v, want the CA certificate", key, got, err)
+		}
+	}
+
+	tests := []struct {
+		ref     sourcev1.ConfigMapKeyReference
+		wantErr string
+	}{
+		{ref: sourcev1.ConfigMapKeyReference{Name: "missing"}, wantErr: "not found"},
+		{ref: sourcev1.ConfigMapKeyReference{Name: "internal-ca", Key: "tls.crt"}, wantErr: "required key 'tls.crt'"},
+		{ref: sourcev1.ConfigMapKeyReference{Name: "internal-ca", Key: "invalid"},
+			wantErr: "key 'invalid' does not contain any PEM encoded certificates"},
+	}
+	for _, tt := range tests {
+		_, err := caBundleFromRef(ctx, c, "default", &tt.ref)
+		if err == nil || !strings.Contains(err.Error(), "CA config map error") || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("caBundleFromRef(%v) error = %v, want a CA config map error containing %q", tt.ref, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSecretWithCABundle(t *testing.T) {
+	secret := &corev1.Secret{Data: map[string][]byte{"username": []byte("user"), "ca.crt": []byte("secret CA")}}
+
+	if got := secretWithCABundle(secret, nil); got != secret {
+		t.Errorf("secretWithCABundle() without CA certificates = %v, want the secret", got)
+	}
+	got := secretWithCABundle(secret, []byte("config map CA"))
+	if string(got.Data["ca.crt"]) != "secret CA\nconfig map CA" || string(got.Data["username"]) != "user" {
+		t.Errorf("secretWithCABundle() = %v, want the secret with both CA certificates", got.Data)
+	}
+	if string(secret.Data["ca.crt"]) != "secret CA" {
+		t.Errorf("secretWithCABundle() modified the secret: %v", secret.Data)
+	}
+	got = secretWithCABundle(nil, []byte("config map CA"))
+	if string(got.Data["caFile"]) != "config map CA" {
+		t.Errorf("secretWithCABundle() without a secret = %v, want the CA certificates in the caFile field", got.Data)
+	}
+}
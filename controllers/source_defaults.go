@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// builtinTimeouts are the timeouts of the sources of which the spec omits
+// the timeout, by kind, if the controller has no default timeout for them.
+var builtinTimeouts = map[string]time.Duration{
+	sourcev1.GitRepositoryKind:  20 * time.Second,
+	sourcev1.BucketKind:         20 * time.Second,
+	sourcev1.HelmRepositoryKind: 60 * time.Second,
+	sourcev1.OCIRepositoryKind:  60 * time.Second,
+}
+
+// SourceDefaults are the interval and the timeout of the sources of which
+// the spec omits them. The defaults of a kind override the defaults of all
+// kinds, which override the built-in timeout of the kind; a source without
+// an interval and without a default interval is stalled, as before the
+// interval was optional.
+//
+// The defaults are applied at every reconciliation, and the effective
+// interval and timeout recorded in the status of the source, so that a
+// change of the defaults applies to the sources at their next
+// reconciliation. A default timeout longer than the interval of a source is
+// shortened to the interval, while a timeout in the spec longer than the
+// interval is invalid. A nil SourceDefaults applies the built-in timeouts.
+type SourceDefaults struct {
+	// Interval is the default interval of all kinds, zero means none.
+	Interval time.Duration
+	// Timeout is the default timeout of all kinds, zero means the built-in
+	// timeout of the kind.
+	Timeout time.Duration
+	// KindIntervals are the default intervals by kind.
+	KindIntervals map[string]time.Duration
+	// KindTimeouts are the default timeouts by kind.
+	KindTimeouts map[string]time.Duration
+}
+
+// NewSourceDefaults returns the SourceDefaults with the given default
+// interval and timeout, and the given defaults by kind in the format of
+// '<kind>=<duration>', or an error if a kind or a duration is invalid.
+func NewSourceDefaults(interval, timeout time.Duration, kindIntervals, kindTimeouts map[string]string) (*SourceDefaults, error) {
+	if interval < 0 || timeout < 0 {
+		return nil, fmt.Errorf("the default interval '%s' and timeout '%s' must not be negative", interval, timeout)
+	}
+	d := &SourceDefaults{Interval: interval, Timeout: timeout}
+	var err error
+	if d.KindIntervals, err = parseKindDurations(kindIntervals, sourcev1.GitRepositoryKind, sourcev1.HelmRepositoryKind,
+		sourcev1.HelmChartKind, sourcev1.BucketKind, sourcev1.OCIRepositoryKind); err != nil {
+		return nil, fmt.Errorf("invalid default interval: %w", err)
+	}
+	// the timeout of a HelmChart is the timeout of its HelmRepository
+	if d.KindTimeouts, err = parseKindDurations(kindTimeouts, sourcev1.GitRepositoryKind, sourcev1.HelmRepositoryKind,
+		sourcev1.BucketKind, sourcev1.OCIRepositoryKind); err != nil {
+		return nil, fmt.Errorf("invalid default timeout: %w", err)
+	}
+	return d, nil
+}
+
+// parseKindDurations parses the given durations by kind, which must be one of
+// the given kinds.
+func parseKindDurations(values map[string]string, kinds ...string) (map[string]time.Duration, error) {
+	durations := map[string]time.Duration{}
+	for kind, value := range values {
+		if !containsString(kinds, kind) {
+			return nil, fmt.Errorf("unsupported kind '%s', must be one of %v", kind, kinds)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration '%s' of %s: %w", value, kind, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("the duration '%s' of %s must be positive", value, kind)
+		}
+		durations[kind] = d
+	}
+	return durations, nil
+}
+
+// apply sets the interval and the timeout of the given source to the
+// defaults of its kind if its spec omits them, and records the effective
+// values in its status. The source is expected to be a copy of which the spec
+// is not written back.
+func (d *SourceDefaults) apply(obj sourcev1.Source) {
+	switch s := obj.(type) {
+	case *sourcev1.GitRepository:
+		s.Status.EffectiveInterval = d.applyInterval(sourcev1.GitRepositoryKind, &s.Spec.Interval)
+		s.Status.EffectiveTimeout = d.applyTimeout(sourcev1.GitRepositoryKind, &s.Spec.Timeout, s.Spec.Interval.Duration)
+	case *sourcev1.HelmRepository:
+		s.Status.EffectiveInterval = d.applyInterval(sourcev1.HelmRepositoryKind, &s.Spec.Interval)
+		s.Status.EffectiveTimeout = d.applyTimeout(sourcev1.HelmRepositoryKind, &s.Spec.Timeout, s.Spec.Interval.Duration)
+	case *sourcev1.HelmChart:
+		s.Status.EffectiveInterval = d.applyInterval(sourcev1.HelmChartKind, &s.Spec.Interval)
+	case *sourcev1.Bucket:
+		s.Status.EffectiveInterval = d.applyInterval(sourcev1.BucketKind, &s.Spec.Interval)
+		s.Status.EffectiveTimeout = d.applyTimeout(sourcev1.BucketKind, &s.Spec.Timeout, s.Spec.Interval.Duration)
+	case *sourcev1.OCIRepository:
+		s.Status.EffectiveInterval = d.applyInterval(sourcev1.OCIRepositoryKind, &s.Spec.Interval)
+		s.Status.EffectiveTimeout = d.applyTimeout(sourcev1.OCIRepositoryKind, &s.Spec.Timeout, s.Spec.Interval.Duration)
+	}
+}
+
+// applyInterval sets the given interval to the default interval of the given
+// kind if it is zero, and returns the effective interval, or nil if there is
+// none.
+func (d *SourceDefaults) applyInterval(kind string, interval *metav1.Duration) *metav1.Duration {
+	if interval.Duration <= 0 && d != nil {
+		if v, ok := d.KindIntervals[kind]; ok {
+			interval.Duration = v
+		} else {
+			interval.Duration = d.Interval
+		}
+	}
+	if interval.Duration <= 0 {
+		return nil
+	}
+	return &metav1.Duration{Duration: interval.Duration}
+}
+
+// applyTimeout sets the given timeout to the default timeout of the given
+// kind, at most the given interval, if it is nil, and returns the effective
+// timeout.
+func (d *SourceDefaults) applyTimeout(kind string, timeout **metav1.Duration, interval time.Duration) *metav1.Duration {
+	if *timeout == nil {
+		v := builtinTimeouts[kind]
+		if d != nil {
+			if kv, ok := d.KindTimeouts[kind]; ok {
+				v = kv
+			} else if d.Timeout > 0 {
+				v = d.Timeout
+			}
+		}
+		if interval > 0 && v > interval {
+			v = interval
+		}
+		*timeout = &metav1.Duration{Duration: v}
+	}
+	return &metav1.Duration{Duration: (*timeout).Duration}
+}
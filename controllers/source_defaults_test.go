@@ -0,0 +1,141 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestNewSourceDefaults(t *testing.T) {
+	tests := []struct {
+		name          string
+		kindIntervals map[string]string
+		kindTimeouts  map[string]string
+		wantErr       string
+	}{
+		{name: "none"},
+		{name: "kinds", kindIntervals: map[string]string{sourcev1.HelmChartKind: "1h"},
+			kindTimeouts: map[string]string{sourcev1.GitRepositoryKind: "1m"}},
+		{name: "unsupported kind", kindIntervals: map[string]string{"Kustomization": "1h"},
+			wantErr: "unsupported kind 'Kustomization'"},
+		{name: "helm chart timeout", kindTimeouts: map[string]string{sourcev1.HelmChartKind: "1m"},
+			wantErr: "unsupported kind 'HelmChart'"},
+		{name: "invalid duration", kindTimeouts: map[string]string{sourcev1.BucketKind: "1 minute"},
+			wantErr: "invalid duration '1 minute' of Bucket"},
+		{name: "zero duration", kindIntervals: map[string]string{sourcev1.BucketKind: "0s"},
+			wantErr: "must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSourceDefaults(time.Minute, 0, tt.kindIntervals, tt.kindTimeouts)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSourceDefaults_apply(t *testing.T) {
+	duration := func(d time.Duration) *metav1.Duration { return &metav1.Duration{Duration: d} }
+	defaults, err := NewSourceDefaults(10*time.Minute, 2*time.Minute,
+		map[string]string{sourcev1.HelmRepositoryKind: "1h"}, map[string]string{sourcev1.GitRepositoryKind: "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		defaults     *SourceDefaults
+		obj          sourcev1.Source
+		wantInterval *metav1.Duration
+		wantTimeout  *metav1.Duration
+	}{
+		{name: "spec", defaults: defaults,
+			obj:          &sourcev1.GitRepository{Spec: sourcev1.GitRepositorySpec{Interval: *duration(time.Minute), Timeout: duration(5 * time.Second)}},
+			wantInterval: duration(time.Minute), wantTimeout: duration(5 * time.Second)},
+		{name: "kind defaults", defaults: defaults,
+			obj:          &sourcev1.GitRepository{},
+			wantInterval: duration(10 * time.Minute), wantTimeout: duration(30 * time.Second)},
+		{name: "kind interval", defaults: defaults,
+			obj:          &sourcev1.HelmRepository{},
+			wantInterval: duration(time.Hour), wantTimeout: duration(2 * time.Minute)},
+		{name: "timeout capped at interval", defaults: defaults,
+			obj:          &sourcev1.Bucket{Spec: sourcev1.BucketSpec{Interval: *duration(time.Minute)}},
+			wantInterval: duration(time.Minute), wantTimeout: duration(time.Minute)},
+		{name: "helm chart", defaults: defaults,
+			obj:          &sourcev1.HelmChart{},
+			wantInterval: duration(10 * time.Minute)},
+		{name: "built-in timeout",
+			obj:          &sourcev1.OCIRepository{Spec: sourcev1.OCIRepositorySpec{Interval: *duration(5 * time.Minute)}},
+			wantInterval: duration(5 * time.Minute), wantTimeout: duration(60 * time.Second)},
+		{name: "no interval",
+			obj:         &sourcev1.GitRepository{},
+			wantTimeout: duration(20 * time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.defaults.apply(tt.obj)
+
+			var interval, timeout, effectiveInterval, effectiveTimeout *metav1.Duration
+			switch s := tt.obj.(type) {
+			case *sourcev1.GitRepository:
+				interval, timeout = &s.Spec.Interval, s.Spec.Timeout
+				effectiveInterval, effectiveTimeout = s.Status.EffectiveInterval, s.Status.EffectiveTimeout
+			case *sourcev1.HelmRepository:
+				interval, timeout = &s.Spec.Interval, s.Spec.Timeout
+				effectiveInterval, effectiveTimeout = s.Status.EffectiveInterval, s.Status.EffectiveTimeout
+			case *sourcev1.HelmChart:
+				interval, effectiveInterval = &s.Spec.Interval, s.Status.EffectiveInterval
+			case *sourcev1.Bucket:
+				interval, timeout = &s.Spec.Interval, s.Spec.Timeout
+				effectiveInterval, effectiveTimeout = s.Status.EffectiveInterval, s.Status.EffectiveTimeout
+			case *sourcev1.OCIRepository:
+				interval, timeout = &s.Spec.Interval, s.Spec.Timeout
+				effectiveInterval, effectiveTimeout = s.Status.EffectiveInterval, s.Status.EffectiveTimeout
+			}
+
+			if !equalDuration(effectiveInterval, tt.wantInterval) {
+				t.Errorf("expected effective interval %v, got %v", tt.wantInterval, effectiveInterval)
+			}
+			if tt.wantInterval != nil && interval.Duration != tt.wantInterval.Duration {
+				t.Errorf("expected interval %s, got %s", tt.wantInterval.Duration, interval.Duration)
+			}
+			if !equalDuration(effectiveTimeout, tt.wantTimeout) {
+				t.Errorf("expected effective timeout %v, got %v", tt.wantTimeout, effectiveTimeout)
+			}
+			if !equalDuration(timeout, tt.wantTimeout) {
+				t.Errorf("expected timeout %v, got %v", tt.wantTimeout, timeout)
+			}
+		})
+	}
+}
+
+func equalDuration(a, b *metav1.Duration) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Duration == b.Duration
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+// proxyFromSecretRef returns the transport.ProxyFunc of the proxy secret with
+// the given reference in the given namespace, corrected with
+// secretdata.Correct, and the warnings of the correction. It returns nil if
+// the reference is nil, for the requests to be sent through the proxy of the
+// environment of the controller.
+func proxyFromSecretRef(ctx context.Context, c client.Reader, namespace string,
+	ref *meta.LocalObjectReference) (transport.ProxyFunc, []string, error) {
+	if ref == nil {
+		return nil, nil, nil
+	}
+	var secret corev1.Secret
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &secret); err != nil {
+		return nil, nil, fmt.Errorf("proxy secret error: %w", err)
+	}
+	secret, warnings := secretdata.Correct(secret)
+	proxy, err := transport.ProxyFromSecret(&secret)
+	if err != nil {
+		return nil, warnings, fmt.Errorf("proxy secret error: %w", err)
+	}
+	return proxy, warnings, nil
+}
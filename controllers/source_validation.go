@@ -0,0 +1,464 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	gopath "path"
+	"regexp"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/redact"
+)
+
+const (
+	// DefaultMinInterval is the default minimum interval of the sources.
+	DefaultMinInterval = time.Second
+	// SourceValidationPath is the path at which the SourceValidator is
+	// served by the webhook server of the controller.
+	SourceValidationPath = "/validate-source-toolkit-fluxcd-io-v1beta1"
+)
+
+// SourceValidator validates the spec of the sources against the rules that
+// the schema of the CRDs can not express, for all kinds with the same rules
+// where their fields overlap:
+//
+//   - the interval is at least MinInterval,
+//   - the timeout does not exceed the interval,
+//   - the scheme of a URL is supported by the kind,
+//   - a URL does not embed credentials, which belong in the secret of the
+//     source.
+//
+// It is served as a validating admission webhook, which rejects the invalid
+// objects, and is applied at the start of every reconciliation, which stalls
+// the objects accepted before the webhook was enabled or the rules changed
+// until their spec is corrected. A nil SourceValidator accepts all objects.
+type SourceValidator struct {
+	// MinInterval is the minimum interval of a source, a source can not be
+	// reconciled continuously with a zero interval even without a minimum.
+	MinInterval time.Duration
+	// Defaults are applied to the sources validated by the webhook, as they
+	// are at the start of every reconciliation.
+	Defaults *SourceDefaults
+}
+
+// NewSourceValidator returns a SourceValidator with the given minimum
+// interval.
+func NewSourceValidator(minInterval time.Duration) *SourceValidator {
+	return &SourceValidator{MinInterval: minInterval}
+}
+
+// Handle validates the source of the given admission request, and denies the
+// request if its spec is invalid. The deletions, the requests of other kinds,
+// and the updates which leave the spec unchanged or of an object being
+// deleted are allowed, so that the finalizer of an object which became
+// invalid by a new rule can still be removed.
+func (v *SourceValidator) Handle(_ context.Context, req admission.Request) admission.Response {
+	if req.Operation == admissionv1.Delete {
+		return admission.Allowed("")
+	}
+	obj := newValidatedSource(req.Kind.Kind)
+	if obj == nil {
+		return admission.Allowed("")
+	}
+	if err := json.Unmarshal(req.Object.Raw, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if req.Operation == admissionv1.Update {
+		if obj.GetDeletionTimestamp() != nil {
+			return admission.Allowed("")
+		}
+		old := newValidatedSource(req.Kind.Kind)
+		if len(req.OldObject.Raw) > 0 && json.Unmarshal(req.OldObject.Raw, old) == nil &&
+			apiequality.Semantic.DeepEqual(sourceSpec(obj), sourceSpec(old)) {
+			return admission.Allowed("")
+		}
+	}
+	v.Defaults.apply(obj)
+	if err := v.validate(obj); err != nil {
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// newValidatedSource returns an empty source of the given kind, or nil if
+// the kind is not validated.
+func newValidatedSource(kind string) validatedSource {
+	switch kind {
+	case sourcev1.GitRepositoryKind:
+		return &sourcev1.GitRepository{}
+	case sourcev1.HelmRepositoryKind:
+		return &sourcev1.HelmRepository{}
+	case sourcev1.HelmChartKind:
+		return &sourcev1.HelmChart{}
+	case sourcev1.BucketKind:
+		return &sourcev1.Bucket{}
+	case sourcev1.OCIRepositoryKind:
+		return &sourcev1.OCIRepository{}
+	default:
+		return nil
+	}
+}
+
+// sourceSpec returns the spec of the given source.
+func sourceSpec(obj validatedSource) interface{} {
+	switch s := obj.(type) {
+	case *sourcev1.GitRepository:
+		return s.Spec
+	case *sourcev1.HelmRepository:
+		return s.Spec
+	case *sourcev1.HelmChart:
+		return s.Spec
+	case *sourcev1.Bucket:
+		return s.Spec
+	case *sourcev1.OCIRepository:
+		return s.Spec
+	default:
+		return nil
+	}
+}
+
+// validatedSource is a source of which the spec is validated.
+type validatedSource interface {
+	sourcev1.Source
+	metav1.Object
+}
+
+// validate returns an error naming every rule violated by the spec of the
+// given source, or nil if the spec is valid or v is nil.
+func (v *SourceValidator) validate(obj validatedSource) error {
+	if v == nil {
+		return nil
+	}
+	spec := field.NewPath("spec")
+	interval := obj.GetInterval().Duration
+	errs := v.validateInterval(spec.Child("interval"), interval)
+	switch s := obj.(type) {
+	case *sourcev1.GitRepository:
+		errs = append(errs, validateTimeout(spec.Child("timeout"), s.Spec.Timeout, interval)...)
+		errs = append(errs, validateURL(spec.Child("url"), s.Spec.URL, "http", "https", "ssh")...)
+		// the options of go-git are validated against the implementation
+		// selected for the URL
+		gitSpec := s.Spec
+		gitSpec.GitImplementation = s.GetGitImplementation()
+		errs = append(errs, validateSparseCheckout(spec, gitSpec)...)
+		errs = append(errs, validateFetchOptions(spec, gitSpec)...)
+		errs = append(errs, validateGitVerification(spec.Child("verify"), gitSpec)...)
+		errs = append(errs, validateSubmodules(spec, gitSpec)...)
+		errs = append(errs, validateGitHTTPOptions(spec, gitSpec)...)
+	case *sourcev1.HelmRepository:
+		errs = append(errs, validateTimeout(spec.Child("timeout"), s.Spec.Timeout, interval)...)
+		if s.Spec.Type == sourcev1.HelmRepositoryTypeOCI {
+			errs = append(errs, validateURL(spec.Child("url"), s.Spec.URL, "oci")...)
+			errs = append(errs, validateOCIHelmRepository(spec, s.Spec)...)
+		} else {
+			errs = append(errs, validateURL(spec.Child("url"), s.Spec.URL, "http", "https")...)
+		}
+	case *sourcev1.HelmChart:
+		// the type of a HelmRepository source is only known when the chart
+		// is reconciled
+		if s.Spec.Verification != nil && s.Spec.SourceRef.Kind != sourcev1.HelmRepositoryKind {
+			errs = append(errs, field.Forbidden(spec.Child("verify"),
+				"only supported for charts from HelmRepository sources"))
+		}
+		if s.Spec.ReconcileStrategy == sourcev1.ReconcileStrategyRevision && s.Spec.SourceRef.Kind == sourcev1.HelmRepositoryKind {
+			errs = append(errs, field.Forbidden(spec.Child("reconcileStrategy"),
+				"'Revision' is only supported for charts from GitRepository and Bucket sources"))
+		}
+		if v := s.Spec.Verification; v != nil && v.Provider == sourcev1.ProvenanceVerificationProvider {
+			if v.SecretRef == nil {
+				errs = append(errs, field.Required(spec.Child("verify", "secretRef"),
+					"must be a secret reference to the PGP public keyrings of the provenance verification"))
+			}
+		} else {
+			errs = append(errs, validateOCIVerification(spec.Child("verify"), v)...)
+		}
+	case *sourcev1.Bucket:
+		errs = append(errs, validateTimeout(spec.Child("timeout"), s.Spec.Timeout, interval)...)
+		errs = append(errs, validateEndpoint(spec.Child("endpoint"), s.Spec.Endpoint)...)
+		if s.Spec.STS != nil {
+			errs = append(errs, validateURL(spec.Child("sts", "endpoint"), s.Spec.STS.Endpoint, "http", "https")...)
+		}
+	case *sourcev1.OCIRepository:
+		errs = append(errs, validateTimeout(spec.Child("timeout"), s.Spec.Timeout, interval)...)
+		errs = append(errs, validateURL(spec.Child("url"), s.Spec.URL, "oci")...)
+		if v := s.Spec.Verification; v != nil && v.Provider == sourcev1.ProvenanceVerificationProvider {
+			errs = append(errs, field.NotSupported(spec.Child("verify", "provider"), v.Provider,
+				[]string{sourcev1.CosignVerificationProvider}))
+		}
+		errs = append(errs, validateOCIVerification(spec.Child("verify"), s.Spec.Verification)...)
+	}
+	return errs.ToAggregate()
+}
+
+// validateSparseCheckout validates that the sparse checkout paths of the
+// given spec of a GitRepository, if any, are under the root of the
+// repository, and that they are not combined with the libgit2
+// implementation or the recursion of submodules.
+func validateSparseCheckout(path *field.Path, spec sourcev1.GitRepositorySpec) field.ErrorList {
+	if len(spec.SparseCheckout) == 0 {
+		return nil
+	}
+	var errs field.ErrorList
+	if spec.GitImplementation == sourcev1.LibGit2Implementation {
+		errs = append(errs, field.Forbidden(path.Child("sparseCheckout"),
+			fmt.Sprintf("not supported by the '%s' Git implementation", sourcev1.LibGit2Implementation)))
+	}
+	if spec.RecurseSubmodules {
+		errs = append(errs, field.Forbidden(path.Child("sparseCheckout"), "can not be combined with recurseSubmodules"))
+	}
+	for i, p := range spec.SparseCheckout {
+		c := gopath.Clean(strings.Trim(p, "/"))
+		if c == "." || c == ".." || strings.HasPrefix(c, "../") {
+			errs = append(errs, field.Invalid(path.Child("sparseCheckout").Index(i), p,
+				"must be a path under the root of the repository"))
+		}
+	}
+	return errs
+}
+
+// validateFetchOptions validates that the depth of the given spec of a
+// GitRepository is not negative, and that the depth and the fetch of all
+// the branches are not combined with the libgit2 implementation, which
+// always clones the full repository.
+func validateFetchOptions(path *field.Path, spec sourcev1.GitRepositorySpec) field.ErrorList {
+	var errs field.ErrorList
+	if spec.Depth < 0 {
+		errs = append(errs, field.Invalid(path.Child("depth"), spec.Depth, "must not be negative"))
+	}
+	if spec.GitImplementation != sourcev1.LibGit2Implementation {
+		return errs
+	}
+	notSupported := fmt.Sprintf("not supported by the '%s' Git implementation", sourcev1.LibGit2Implementation)
+	if spec.Depth > 0 {
+		errs = append(errs, field.Forbidden(path.Child("depth"), notSupported))
+	}
+	if spec.AllBranches {
+		errs = append(errs, field.Forbidden(path.Child("allBranches"), notSupported))
+	}
+	return errs
+}
+
+// validateSubmodules validates that the hosts of the submodule secrets of
+// the given spec of a GitRepository, if any, are unique, and that the
+// options of the submodules are not combined with the libgit2
+// implementation, which does not support them.
+func validateSubmodules(path *field.Path, spec sourcev1.GitRepositorySpec) field.ErrorList {
+	var errs field.ErrorList
+	if spec.SubmoduleDepth < 0 {
+		errs = append(errs, field.Invalid(path.Child("submoduleDepth"), spec.SubmoduleDepth, "must not be negative"))
+	}
+	hosts := make(map[string]bool, len(spec.SubmoduleSecretRefs))
+	for i, ref := range spec.SubmoduleSecretRefs {
+		hostPath := path.Child("submoduleSecretRefs").Index(i).Child("host")
+		switch {
+		case ref.Host == "":
+			errs = append(errs, field.Required(hostPath, "must be the host of the URLs of the submodules"))
+		case hosts[ref.Host]:
+			errs = append(errs, field.Duplicate(hostPath, ref.Host))
+		}
+		hosts[ref.Host] = true
+	}
+	if spec.GitImplementation == sourcev1.LibGit2Implementation {
+		notSupported := fmt.Sprintf("not supported by the '%s' Git implementation", sourcev1.LibGit2Implementation)
+		if spec.SubmoduleDepth > 0 {
+			errs = append(errs, field.Forbidden(path.Child("submoduleDepth"), notSupported))
+		}
+		if len(spec.SubmoduleSecretRefs) > 0 {
+			errs = append(errs, field.Forbidden(path.Child("submoduleSecretRefs"), notSupported))
+		}
+	}
+	return errs
+}
+
+// validateGitHTTPOptions validates that the proxy secret and the CA config
+// map of the given spec of a GitRepository, if any, are not combined with an
+// SSH URL, of which the connections are neither sent through the proxy nor
+// verified against the CA certificates, or with the libgit2 implementation.
+func validateGitHTTPOptions(path *field.Path, spec sourcev1.GitRepositorySpec) field.ErrorList {
+	var errs field.ErrorList
+	isSSH := false
+	if u, err := url.Parse(spec.URL); err == nil && u.Scheme == "ssh" {
+		isSSH = true
+	}
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{name: "proxySecretRef", set: spec.ProxySecretRef != nil},
+		{name: "caRef", set: spec.CARef != nil},
+	} {
+		if !option.set {
+			continue
+		}
+		if isSSH {
+			errs = append(errs, field.Forbidden(path.Child(option.name), "requires an HTTP(S) URL"))
+		}
+		if spec.GitImplementation == sourcev1.LibGit2Implementation {
+			errs = append(errs, field.Forbidden(path.Child(option.name),
+				fmt.Sprintf("not supported by the '%s' Git implementation", sourcev1.LibGit2Implementation)))
+		}
+	}
+	return errs
+}
+
+// validateGitVerification validates that the verification of the annotated
+// tag of the given spec of a GitRepository, if any, is for a tag or semver
+// reference, and is not combined with the libgit2 implementation.
+func validateGitVerification(path *field.Path, spec sourcev1.GitRepositorySpec) field.ErrorList {
+	if spec.Verification == nil || spec.Verification.Mode != sourcev1.GitVerificationModeTag {
+		return nil
+	}
+	var errs field.ErrorList
+	if ref := spec.Reference; ref == nil || ref.Commit != "" || (ref.Tag == "" && ref.SemVer == "") {
+		errs = append(errs, field.Invalid(path.Child("mode"), spec.Verification.Mode,
+			"requires a tag or semver reference"))
+	}
+	if spec.GitImplementation == sourcev1.LibGit2Implementation {
+		errs = append(errs, field.Forbidden(path.Child("mode"),
+			fmt.Sprintf("not supported by the '%s' Git implementation", sourcev1.LibGit2Implementation)))
+	}
+	return errs
+}
+
+// validateOCIHelmRepository validates that the given spec of a HelmRepository
+// of the 'oci' type has none of the fields which apply to an index served
+// over HTTP/S only.
+func validateOCIHelmRepository(path *field.Path, spec sourcev1.HelmRepositorySpec) field.ErrorList {
+	var errs field.ErrorList
+	if spec.PassCredentials {
+		errs = append(errs, field.Forbidden(path.Child("passCredentials"), "not supported for the 'oci' type"))
+	}
+	if spec.ServerName != "" {
+		errs = append(errs, field.Forbidden(path.Child("serverName"), "not supported for the 'oci' type"))
+	}
+	if spec.ProxySecretRef != nil {
+		errs = append(errs, field.Forbidden(path.Child("proxySecretRef"), "not supported for the 'oci' type"))
+	}
+	if spec.CARef != nil {
+		errs = append(errs, field.Forbidden(path.Child("caRef"), "not supported for the 'oci' type"))
+	}
+	return errs
+}
+
+// validateOCIVerification validates that the given keyless verification, if
+// any, has identities with valid regular expressions, and a valid Rekor URL.
+func validateOCIVerification(path *field.Path, verification *sourcev1.OCIRepositoryVerification) field.ErrorList {
+	if verification == nil || verification.SecretRef != nil {
+		return nil
+	}
+	var errs field.ErrorList
+	if len(verification.MatchOIDCIdentity) == 0 {
+		errs = append(errs, field.Required(path.Child("matchOIDCIdentity"),
+			"must contain at least one identity for the keyless verification"))
+	}
+	for i, match := range verification.MatchOIDCIdentity {
+		if _, err := regexp.Compile(match.Issuer); err != nil {
+			errs = append(errs, field.Invalid(path.Child("matchOIDCIdentity").Index(i).Child("issuer"), match.Issuer, err.Error()))
+		}
+		if _, err := regexp.Compile(match.Subject); err != nil {
+			errs = append(errs, field.Invalid(path.Child("matchOIDCIdentity").Index(i).Child("subject"), match.Subject, err.Error()))
+		}
+	}
+	if verification.RekorURL != "" {
+		errs = append(errs, validateURL(path.Child("rekorURL"), verification.RekorURL, "http", "https")...)
+	}
+	return errs
+}
+
+// validateInterval validates that the given interval is at least the minimum
+// interval, and positive.
+func (v *SourceValidator) validateInterval(path *field.Path, interval time.Duration) field.ErrorList {
+	min := v.MinInterval
+	if interval <= 0 && min <= 0 {
+		return field.ErrorList{field.Invalid(path, interval.String(), "must be greater than 0s")}
+	}
+	if interval < min {
+		return field.ErrorList{field.Invalid(path, interval.String(), fmt.Sprintf("must be at least %s", min.String()))}
+	}
+	return nil
+}
+
+// validateTimeout validates that the given timeout, if any, does not exceed
+// the given interval.
+func validateTimeout(path *field.Path, timeout *metav1.Duration, interval time.Duration) field.ErrorList {
+	if timeout == nil || timeout.Duration <= interval {
+		return nil
+	}
+	return field.ErrorList{field.Invalid(path, timeout.Duration.String(),
+		fmt.Sprintf("must not exceed the interval %s", interval.String()))}
+}
+
+// validateURL validates that the given URL has one of the given schemes and
+// a host, and does not embed credentials. The user of an SSH URL is allowed,
+// as it is the user of the Git server, e.g. 'git', but not its password.
+func validateURL(path *field.Path, rawURL string, schemes ...string) field.ErrorList {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// the error of url.Parse contains the URL, and its credentials
+		return field.ErrorList{field.Invalid(path, redact.String(rawURL), "must be a valid URL")}
+	}
+	var errs field.ErrorList
+	if !containsString(schemes, u.Scheme) {
+		errs = append(errs, field.NotSupported(path.Child("scheme"), u.Scheme, schemes))
+	}
+	if u.Host == "" {
+		errs = append(errs, field.Required(path.Child("host"), "must contain a host"))
+	}
+	errs = append(errs, validateUserinfo(path, u)...)
+	return errs
+}
+
+// validateEndpoint validates that the given bucket endpoint is a host with an
+// optional port, or a URL with the 'http' or 'https' scheme, and does not
+// embed credentials.
+func validateEndpoint(path *field.Path, endpoint string) field.ErrorList {
+	if strings.Contains(endpoint, "://") {
+		return validateURL(path, endpoint, "http", "https")
+	}
+	u, err := url.Parse("https://" + endpoint)
+	if err != nil || u.Host == "" {
+		return field.ErrorList{field.Invalid(path, redact.String(endpoint), "must be a host with an optional port, or an HTTP/S URL")}
+	}
+	return validateUserinfo(path, u)
+}
+
+// validateUserinfo validates that the given URL does not embed credentials,
+// the user of an SSH URL is allowed.
+func validateUserinfo(path *field.Path, u *url.URL) field.ErrorList {
+	if u.User == nil {
+		return nil
+	}
+	if _, hasPassword := u.User.Password(); u.Scheme == "ssh" && !hasPassword {
+		return nil
+	}
+	// the value is omitted, as it is the credentials
+	return field.ErrorList{field.Forbidden(path.Child("userinfo"),
+		"must not embed credentials, use the secret reference of the source")}
+}
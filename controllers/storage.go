@@ -19,24 +19,32 @@ package controllers
 import (
 	"archive/tar"
 	"compress/gzip"
-	"crypto/sha1"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/klauspost/compress/zstd"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/fluxcd/pkg/lockedfile"
 
-	"github.com/fluxcd/pkg/untar"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/fips"
 	"github.com/fluxcd/source-controller/internal/fs"
 	"github.com/fluxcd/source-controller/pkg/sourceignore"
 )
@@ -49,22 +57,188 @@ type Storage struct {
 	// Hostname is the file server host name used to compose the artifacts URIs.
 	Hostname string `json:"hostname"`
 
+	// Scheme is the URL scheme of the file server used to compose the
+	// artifacts URIs, 'http' or 'https'.
+	Scheme string `json:"scheme"`
+
 	// Timeout for artifacts operations
 	Timeout time.Duration `json:"timeout"`
+
+	// ArtifactRetentionRecords is the maximum number of artifacts kept for a
+	// source by the garbage collection, including the current one. Zero
+	// means unlimited.
+	ArtifactRetentionRecords int `json:"artifactRetentionRecords"`
+
+	// ArtifactRetentionTTL is the duration for which previous artifacts of a
+	// source are kept by the garbage collection. Zero means unlimited.
+	ArtifactRetentionTTL time.Duration `json:"artifactRetentionTTL"`
+
+	// RetainDeletedArtifacts keeps the artifacts of deleted sources in the
+	// storage, instead of removing the storage directory of a source when it
+	// is deleted.
+	RetainDeletedArtifacts bool `json:"retainDeletedArtifacts"`
+
+	// ArchiveEncoding is the compression of the tarball artifacts,
+	// ArchiveEncodingGzip or ArchiveEncodingZstd.
+	ArchiveEncoding string `json:"archiveEncoding"`
+
+	// ArchiveCompressionLevel is the gzip compression level of the tarball
+	// artifacts, from gzip.HuffmanOnly to gzip.BestCompression.
+	ArchiveCompressionLevel int `json:"archiveCompressionLevel"`
+
+	// ArtifactMaxSize is the maximum size in bytes of an artifact, writing an
+	// artifact that exceeds it fails with an ArtifactSizeError. Zero means
+	// unlimited.
+	ArtifactMaxSize int64 `json:"artifactMaxSize"`
+
+	// DigestAlgorithm is the algorithm of the digest of the artifacts,
+	// 'sha256', 'sha384' or 'sha512'. The checksum of the artifacts is always
+	// SHA256.
+	DigestAlgorithm string `json:"digestAlgorithm"`
+
+	// Backend is the remote store of the artifacts, if any. The artifacts
+	// are always written to the BasePath, and uploaded to the Backend.
+	Backend StorageBackend `json:"-"`
+
+	// SigningKey is the private key with which the SHA256 checksum of every
+	// artifact is signed when it is written, if any.
+	SigningKey crypto.Signer `json:"-"`
+
+	// Deduplicate stores identical artifacts of different sources once in
+	// the BasePath, with the artifact files of the sources as hard links to
+	// a file of their content.
+	Deduplicate bool `json:"deduplicate"`
+
+	// HighWatermark is the percentage of the capacity of the file system of
+	// the BasePath above which the oldest previous artifacts are pruned,
+	// beyond their retention, and no artifacts are written. Zero disables it.
+	HighWatermark int `json:"highWatermark"`
+
+	// ArtifactChecksumInterval is the interval at which the artifacts are
+	// verified against their digest at the start of the reconciliations.
+	// In between, an artifact of which the size and modification time did not
+	// change since its last verification is not read. Zero verifies the
+	// digest at every reconciliation.
+	ArtifactChecksumInterval time.Duration `json:"artifactChecksumInterval"`
+
+	// verified are the artifacts verified against their digest, shared by
+	// the copies of the Storage.
+	verified *verifiedArtifacts
+
+	// WriteRetries is the number of times the write of an artifact is
+	// retried after a transient error of the file system, e.g. a stale NFS
+	// file handle, from the content already fetched. Zero disables the
+	// retries.
+	WriteRetries int `json:"writeRetries"`
+
+	// statfs returns the usage of the file system at the given path, it is
+	// replaced in tests.
+	statfs func(path string) (storageUsage, error)
+
+	// createTemp creates the temporary files to which the artifacts are
+	// written, it is replaced in tests to inject faults.
+	createTemp func(dir, pattern string) (tempFile, error)
+}
+
+// ArtifactSizeError is returned when writing an artifact is aborted because it exceeds the ArtifactMaxSize of the
+// Storage.
+type ArtifactSizeError struct {
+	// Limit is the maximum size of the artifact in bytes.
+	Limit int64
+	// Size is the size of the artifact in bytes when it was aborted.
+	Size int64
+}
+
+func (e *ArtifactSizeError) Error() string {
+	return fmt.Sprintf("artifact size of at least %d bytes exceeds the maximum of %d bytes", e.Size, e.Limit)
+}
+
+const (
+	// ArchiveEncodingGzip is the encoding of gzip compressed tarball
+	// artifacts, with the '.tar.gz' extension.
+	ArchiveEncodingGzip = "gzip"
+
+	// ArchiveEncodingZstd is the encoding of zstd compressed tarball
+	// artifacts, with the '.tar.zst' extension.
+	ArchiveEncodingZstd = "zstd"
+)
+
+// archiveExtensions are the file extensions of the tarball artifacts by
+// encoding.
+var archiveExtensions = map[string]string{
+	ArchiveEncodingGzip: ".tar.gz",
+	ArchiveEncodingZstd: ".tar.zst",
 }
 
-// NewStorage creates the storage helper for a given path and hostname
+// NewStorage creates the storage helper for a given path and hostname. The garbage collection of the storage keeps
+// the artifacts of a source within the DefaultArtifactRetentionRecords and the DefaultArtifactRetentionTTL, the
+// tarball artifacts are gzip compressed at the default level, the digest of the artifacts is SHA256, the artifacts
+// are verified against their digest at the DefaultArtifactChecksumInterval, and their writes are retried
+// DefaultStorageWriteRetries times.
 func NewStorage(basePath string, hostname string, timeout time.Duration) (*Storage, error) {
 	if f, err := os.Stat(basePath); os.IsNotExist(err) || !f.IsDir() {
 		return nil, fmt.Errorf("invalid dir path: %s", basePath)
 	}
 	return &Storage{
-		BasePath: basePath,
-		Hostname: hostname,
-		Timeout:  timeout,
+		BasePath:                 basePath,
+		Hostname:                 urlHost(hostname),
+		Scheme:                   "http",
+		Timeout:                  timeout,
+		ArtifactRetentionRecords: DefaultArtifactRetentionRecords,
+		ArtifactRetentionTTL:     DefaultArtifactRetentionTTL,
+		ArchiveEncoding:          ArchiveEncodingGzip,
+		ArchiveCompressionLevel:  gzip.DefaultCompression,
+		DigestAlgorithm:          DefaultDigestAlgorithm,
+		ArtifactChecksumInterval: DefaultArtifactChecksumInterval,
+		WriteRetries:             DefaultStorageWriteRetries,
+		verified:                 newVerifiedArtifacts(),
 	}, nil
 }
 
+// urlHost returns the given host name, with an optional port, as the host of a URL: a literal IPv6 address without a
+// port is enclosed in brackets, e.g. 'fd00::1' is '[fd00::1]', for the port not to be confused with its last group.
+func urlHost(hostname string) string {
+	if ip := net.ParseIP(hostname); ip != nil && ip.To4() == nil {
+		return "[" + hostname + "]"
+	}
+	return hostname
+}
+
+// isArtifactSizeError returns if the given error is, or wraps, an ArtifactSizeError.
+func isArtifactSizeError(err error) bool {
+	var sizeErr *ArtifactSizeError
+	return errors.As(err, &sizeErr)
+}
+
+// WithArtifactMaxSize returns a copy of the Storage with the given maximum artifact size, if it is lower than the
+// ArtifactMaxSize. A nil or zero size keeps the ArtifactMaxSize.
+func (s *Storage) WithArtifactMaxSize(size *resource.Quantity) *Storage {
+	c := *s
+	if size != nil && size.Value() > 0 && (c.ArtifactMaxSize <= 0 || size.Value() < c.ArtifactMaxSize) {
+		c.ArtifactMaxSize = size.Value()
+	}
+	return &c
+}
+
+// ValidateArchiveOptions returns an error if the ArchiveEncoding or the ArchiveCompressionLevel is not supported.
+func (s *Storage) ValidateArchiveOptions() error {
+	if _, ok := archiveExtensions[s.ArchiveEncoding]; !ok {
+		return fmt.Errorf("unsupported archive encoding '%s'", s.ArchiveEncoding)
+	}
+	if _, err := gzip.NewWriterLevel(io.Discard, s.ArchiveCompressionLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ArchiveExtension returns the file extension of the tarball artifacts for the ArchiveEncoding, e.g. '.tar.gz'.
+func (s *Storage) ArchiveExtension() string {
+	if ext, ok := archiveExtensions[s.ArchiveEncoding]; ok {
+		return ext
+	}
+	return archiveExtensions[ArchiveEncodingGzip]
+}
+
 // NewArtifactFor returns a new v1beta1.Artifact.
 func (s *Storage) NewArtifactFor(kind string, metadata metav1.Object, revision, fileName string) sourcev1.Artifact {
 	path := sourcev1.ArtifactPath(kind, metadata.GetNamespace(), metadata.GetName(), fileName)
@@ -81,15 +255,20 @@ func (s Storage) SetArtifactURL(artifact *sourcev1.Artifact) {
 	if artifact.Path == "" {
 		return
 	}
-	artifact.URL = fmt.Sprintf("http://%s/%s", s.Hostname, artifact.Path)
+	artifact.URL = s.url(artifact.Path)
 }
 
-// SetHostname sets the hostname of the given URL string to the current Storage.Hostname and returns the result.
+// SetHostname sets the scheme and hostname of the given URL string to the current Storage.Scheme and
+// Storage.Hostname and returns the result. With a Backend, it returns the URL of the Backend for the same file.
 func (s Storage) SetHostname(URL string) string {
+	if s.Backend != nil {
+		return s.backendURL(URL)
+	}
 	u, err := url.Parse(URL)
 	if err != nil {
 		return ""
 	}
+	u.Scheme = s.Scheme
 	u.Host = s.Hostname
 	return u.String()
 }
@@ -100,13 +279,49 @@ func (s *Storage) MkdirAll(artifact sourcev1.Artifact) error {
 	return os.MkdirAll(dir, 0777)
 }
 
-// RemoveAll calls os.RemoveAll for the given v1beta1.Artifact base dir.
+// RemoveAll calls os.RemoveAll for the given v1beta1.Artifact base dir, and removes the objects in the dir from the
+// Backend.
 func (s *Storage) RemoveAll(artifact sourcev1.Artifact) error {
 	dir := filepath.Dir(s.LocalPath(artifact))
-	return os.RemoveAll(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	s.collectContent()
+	if s.Backend == nil {
+		return nil
+	}
+	objects, err := s.listBackendObjects(artifact)
+	if err != nil {
+		return err
+	}
+	if _, errors := s.removeBackendObjects(objects); len(errors) > 0 {
+		return fmt.Errorf("failed to remove objects: %s", strings.Join(errors, " "))
+	}
+	return nil
+}
+
+// Remove removes the file of the given v1beta1.Artifact, its signature and written files, and their objects in the Backend. The
+// deduplicated content of the file is removed with it, as the artifact is removed when it is corrupt.
+func (s *Storage) Remove(artifact sourcev1.Artifact) error {
+	s.removeContentOf(s.LocalPath(artifact), artifact.Checksum)
+	for _, p := range []string{s.LocalPath(artifact), s.LocalPath(artifact) + SignatureExtension, s.LocalPath(artifact) + writtenExtension} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if s.Backend == nil {
+		return nil
+	}
+	ctx, cancel := s.backendContext()
+	defer cancel()
+	if err := s.Backend.Remove(ctx, artifact.Path); err != nil {
+		return err
+	}
+	return s.Backend.Remove(ctx, artifact.Path+SignatureExtension)
 }
 
-// RemoveAllButCurrent removes all files for the given v1beta1.Artifact base dir, excluding the current one.
+// RemoveAllButCurrent removes all files for the given v1beta1.Artifact base dir, excluding the current one
+// and its sidecar files (e.g. the bucket index).
 func (s *Storage) RemoveAllButCurrent(artifact sourcev1.Artifact) error {
 	localPath := s.LocalPath(artifact)
 	dir := filepath.Dir(localPath)
@@ -117,13 +332,33 @@ func (s *Storage) RemoveAllButCurrent(artifact sourcev1.Artifact) error {
 			return nil
 		}
 
-		if path != localPath && !info.IsDir() && info.Mode()&os.ModeSymlink != os.ModeSymlink {
+		// Keep the current artifact and its sidecar files
+		if path == localPath || strings.HasPrefix(path, localPath+".") {
+			return nil
+		}
+		if !info.IsDir() && info.Mode()&os.ModeSymlink != os.ModeSymlink {
 			if err := os.Remove(path); err != nil {
 				errors = append(errors, info.Name())
 			}
 		}
 		return nil
 	})
+	s.collectContent()
+
+	if s.Backend != nil {
+		objects, err := s.listBackendObjects(artifact)
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+		var previous []BackendObject
+		for _, o := range objects {
+			if o.LinkTarget == "" && o.Path != artifact.Path && !strings.HasPrefix(o.Path, artifact.Path+".") {
+				previous = append(previous, o)
+			}
+		}
+		_, removeErrors := s.removeBackendObjects(previous)
+		errors = append(errors, removeErrors...)
+	}
 
 	if len(errors) > 0 {
 		return fmt.Errorf("failed to remove files: %s", strings.Join(errors, " "))
@@ -131,11 +366,170 @@ func (s *Storage) RemoveAllButCurrent(artifact sourcev1.Artifact) error {
 	return nil
 }
 
+// GarbageCollect removes the previous artifacts in the base dir of the given v1beta1.Artifact, with their sidecar
+// files (e.g. the bucket index), that exceed the ArtifactRetentionRecords or are older than the ArtifactRetentionTTL.
+// The given artifact and the most recently written artifact, which may not be advertised yet, are never removed. It
+// returns the paths of the removed files. Files that can not be removed are listed in the returned error, and are
+// removed by the next garbage collection.
+func (s *Storage) GarbageCollect(artifact sourcev1.Artifact) ([]string, error) {
+	localPath := s.LocalPath(artifact)
+	dir := filepath.Dir(localPath)
+	files, err := localStoredFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed, errors []string
+	for _, f := range s.expiredFiles(files, filepath.Base(localPath)) {
+		path := filepath.Join(dir, f.name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errors = append(errors, f.name)
+			continue
+		}
+		removed = append(removed, path)
+		recordGarbageCollection(f.size)
+	}
+	if len(removed) > 0 {
+		s.collectContent()
+	}
+
+	if s.Backend != nil {
+		objects, err := s.listBackendObjects(artifact)
+		if err != nil {
+			return removed, err
+		}
+		// Links are kept, like the symlinks in the directory
+		files = nil
+		byName := map[string]BackendObject{}
+		for _, o := range objects {
+			if o.LinkTarget != "" {
+				continue
+			}
+			name := filepath.Base(o.Path)
+			files = append(files, storedFile{name: name, size: o.Size, modTime: o.ModTime})
+			byName[name] = o
+		}
+		var expired []BackendObject
+		for _, f := range s.expiredFiles(files, filepath.Base(localPath)) {
+			expired = append(expired, byName[f.name])
+		}
+		backendRemoved, backendErrors := s.removeBackendObjects(expired)
+		for _, o := range backendRemoved {
+			removed = append(removed, o.Path)
+			recordGarbageCollection(o.Size)
+		}
+		errors = append(errors, backendErrors...)
+	}
+
+	if len(errors) > 0 {
+		return removed, fmt.Errorf("failed to remove files: %s", strings.Join(errors, " "))
+	}
+	return removed, nil
+}
+
+// storedFile is a file in the directory of the artifacts of a source, in the BasePath or the Backend.
+type storedFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// localStoredFiles returns the regular files in the given directory of the BasePath, the symlinks are skipped.
+func localStoredFiles(dir string) ([]storedFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var files []storedFile
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, storedFile{name: entry.Name(), size: fi.Size(), modTime: fi.ModTime()})
+	}
+	return files, nil
+}
+
+// artifactRecord is an artifact in the directory of a source, with its sidecar files.
+type artifactRecord struct {
+	name    string
+	modTime time.Time
+	files   []storedFile
+}
+
+// artifactRecords groups the given files by the artifact they belong to. It returns the records sorted from the most
+// recently written artifact to the oldest one.
+func artifactRecords(files []storedFile) []*artifactRecord {
+	records := map[string]*artifactRecord{}
+	var names []string
+	for _, f := range files {
+		records[f.name] = &artifactRecord{name: f.name, modTime: f.modTime, files: []storedFile{f}}
+		names = append(names, f.name)
+	}
+	// The artifact of a sidecar file is the longest name that is a prefix of
+	// the name of the sidecar. An artifact linked to stored content was
+	// written at the modification time of its written file.
+	sort.Strings(names)
+	for i := len(names) - 1; i >= 0; i-- {
+		for j := i - 1; j >= 0; j-- {
+			if strings.HasPrefix(names[i], names[j]+".") {
+				if names[i] == names[j]+writtenExtension && records[names[i]].modTime.After(records[names[j]].modTime) {
+					records[names[j]].modTime = records[names[i]].modTime
+				}
+				records[names[j]].files = append(records[names[j]].files, records[names[i]].files...)
+				delete(records, names[i])
+				break
+			}
+		}
+	}
+
+	var sorted []*artifactRecord
+	for _, r := range records {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].modTime.After(sorted[j].modTime) })
+	return sorted
+}
+
+// expiredFiles returns the files of the previous artifacts, and their sidecar files, that exceed the
+// ArtifactRetentionRecords or are older than the ArtifactRetentionTTL. The files of the artifact with the given
+// current name, and of the most recently written artifact, are never returned.
+func (s *Storage) expiredFiles(files []storedFile, current string) []storedFile {
+	records := artifactRecords(files)
+	if len(records) == 0 {
+		return nil
+	}
+	newest := records[0]
+	var previous []*artifactRecord
+	for _, r := range records {
+		if r.name != current {
+			previous = append(previous, r)
+		}
+	}
+
+	var expired []storedFile
+	kept := 1
+	for _, r := range previous {
+		if r == newest || ((s.ArtifactRetentionRecords <= 0 || kept < s.ArtifactRetentionRecords) &&
+			(s.ArtifactRetentionTTL <= 0 || time.Since(r.modTime) < s.ArtifactRetentionTTL)) {
+			kept++
+			continue
+		}
+		expired = append(expired, r.files...)
+	}
+	return expired
+}
+
 // ArtifactExist returns a boolean indicating whether the v1beta1.Artifact exists in storage and is a regular file.
+// With a Backend, an artifact that does not exist in the BasePath is restored from the Backend.
 func (s *Storage) ArtifactExist(artifact sourcev1.Artifact) bool {
 	fi, err := os.Lstat(s.LocalPath(artifact))
 	if err != nil {
-		return false
+		return s.Backend != nil && os.IsNotExist(err) && s.restore(artifact) == nil
 	}
 	return fi.Mode().IsRegular()
 }
@@ -162,15 +556,33 @@ func SourceIgnoreFilter(ps []gitignore.Pattern, domain []string) ArchiveFileFilt
 
 // Archive atomically archives the given directory as a tarball to the given v1beta1.Artifact path, excluding
 // directories and any ArchiveFileFilter matches. While archiving, any environment specific data (for example,
-// the user and group name) is stripped from file headers.
+// the user and group name) is stripped from file headers, the permissions are normalised and the files are written
+// in lexical order of their paths, so that identical trees result in byte-identical archives. The files are streamed
+// from the directory through the compressor into the temporary file of the artifact, which is hashed while written,
+// so that archiving needs no more disk space than the compressed size of the artifact.
 // If successful, it sets the checksum and last update time on the artifact.
-func (s *Storage) Archive(artifact *sourcev1.Artifact, dir string, filter ArchiveFileFilter) (err error) {
+func (s *Storage) Archive(artifact *sourcev1.Artifact, dir string, filter ArchiveFileFilter) error {
+	return s.ArchiveWithModTimes(artifact, dir, filter, nil)
+}
+
+// ArchiveWithModTimes archives the given directory like Archive, but records the modification times of the given
+// map, keyed by the slash separated path of the files relative to the directory, in the file headers. The times are
+// rounded down to the second, files without a modification time in the map are recorded with the zero time.
+// Directories are only included when the map has a modification time for their path with a trailing slash.
+// The archive is written again from the directory after a transient error of the file system.
+func (s *Storage) ArchiveWithModTimes(artifact *sourcev1.Artifact, dir string, filter ArchiveFileFilter, modTimes map[string]time.Time) error {
 	if f, err := os.Stat(dir); os.IsNotExist(err) || !f.IsDir() {
 		return fmt.Errorf("invalid dir path: %s", dir)
 	}
+	return s.retryWrite(nil, func() error {
+		return s.archive(artifact, dir, filter, modTimes)
+	})
+}
 
+// archive writes the archive of ArchiveWithModTimes once.
+func (s *Storage) archive(artifact *sourcev1.Artifact, dir string, filter ArchiveFileFilter, modTimes map[string]time.Time) (err error) {
 	localPath := s.LocalPath(*artifact)
-	tf, err := os.CreateTemp(filepath.Split(localPath))
+	tf, err := s.createTempFile(filepath.Split(localPath))
 	if err != nil {
 		return err
 	}
@@ -181,18 +593,33 @@ func (s *Storage) Archive(artifact *sourcev1.Artifact, dir string, filter Archiv
 		}
 	}()
 
-	h := newHash()
-	mw := io.MultiWriter(h, tf)
+	h := s.newArtifactHash()
+	mw := s.limitSize(io.MultiWriter(h, tf))
 
-	gw := gzip.NewWriter(mw)
-	tw := tar.NewWriter(gw)
+	// Collect the entries first, so that they can be written in lexical order
+	// of their names, independent of the order of the directory walk.
+	var entries []*archiveEntry
 	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// Ignore anything that is not a file (directories, symlinks)
-		if !fi.Mode().IsRegular() {
+		relFilePath := p
+		if filepath.IsAbs(dir) {
+			relFilePath, err = filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Ignore anything that is not a file (symlinks), and directories without a modification time
+		isDir := false
+		if fi.IsDir() {
+			if _, ok := modTimes[filepath.ToSlash(relFilePath)+"/"]; !ok {
+				return nil
+			}
+			isDir = true
+		} else if !fi.Mode().IsRegular() {
 			return nil
 		}
 
@@ -208,14 +635,10 @@ func (s *Storage) Archive(artifact *sourcev1.Artifact, dir string, filter Archiv
 		// The name needs to be modified to maintain directory structure
 		// as tar.FileInfoHeader only has access to the base name of the file.
 		// Ref: https://golang.org/src/archive/tar/common.go?#L626
-		relFilePath := p
-		if filepath.IsAbs(dir) {
-			relFilePath, err = filepath.Rel(dir, p)
-			if err != nil {
-				return err
-			}
+		header.Name = filepath.ToSlash(relFilePath)
+		if isDir {
+			header.Name += "/"
 		}
-		header.Name = relFilePath
 
 		// We want to remove any environment specific data as well, this
 		// ensures the checksum is purely content based.
@@ -223,101 +646,185 @@ func (s *Storage) Archive(artifact *sourcev1.Artifact, dir string, filter Archiv
 		header.Uid = 0
 		header.Uname = ""
 		header.Gname = ""
-		header.ModTime = time.Time{}
+		header.Mode = archiveMode(fi)
+		header.ModTime = modTimes[header.Name].Truncate(time.Second)
 		header.AccessTime = time.Time{}
 		header.ChangeTime = time.Time{}
 
-		if err := tw.WriteHeader(header); err != nil {
-			return err
-		}
-
-		f, err := os.Open(p)
-		if err != nil {
-			f.Close()
-			return err
-		}
-		if _, err := io.Copy(tw, f); err != nil {
-			f.Close()
-			return err
-		}
-		return f.Close()
+		entries = append(entries, &archiveEntry{header: header, path: p})
+		return nil
 	}); err != nil {
-		tw.Close()
-		gw.Close()
 		tf.Close()
 		return err
 	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].header.Name < entries[j].header.Name
+	})
 
-	if err := tw.Close(); err != nil {
-		gw.Close()
+	// The encoding is determined by the extension of the artifact, an
+	// artifact with any other extension is gzip compressed.
+	var cw io.WriteCloser
+	if strings.HasSuffix(artifact.Path, archiveExtensions[ArchiveEncodingZstd]) {
+		cw, err = zstd.NewWriter(mw)
+	} else {
+		// The gzip header is left empty, it would otherwise record a
+		// modification time and file name.
+		cw, err = gzip.NewWriterLevel(mw, s.ArchiveCompressionLevel)
+	}
+	if err != nil {
 		tf.Close()
 		return err
 	}
-	if err := gw.Close(); err != nil {
+	tw := tar.NewWriter(cw)
+	for _, entry := range entries {
+		if err := entry.write(tw); err != nil {
+			tw.Close()
+			cw.Close()
+			tf.Close()
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		cw.Close()
 		tf.Close()
 		return err
 	}
-	if err := tf.Close(); err != nil {
+	if err := cw.Close(); err != nil {
+		tf.Close()
 		return err
 	}
 
-	if err := os.Chmod(tmpName, 0644); err != nil {
+	if err := publishFile(tf, localPath, 0644); err != nil {
 		return err
 	}
-
-	if err := fs.RenameWithFallback(tmpName, localPath); err != nil {
+	s.deduplicate(localPath, h)
+	if err := s.upload(artifact.Path, localPath, ""); err != nil {
 		return err
 	}
 
-	artifact.Checksum = fmt.Sprintf("%x", h.Sum(nil))
+	setChecksum(artifact, h)
+	if err := s.sign(artifact, h); err != nil {
+		return err
+	}
 	artifact.LastUpdateTime = metav1.Now()
 	return nil
 }
 
-// AtomicWriteFile atomically writes the io.Reader contents to the v1beta1.Artifact path.
-// If successful, it sets the checksum and last update time on the artifact.
-func (s *Storage) AtomicWriteFile(artifact *sourcev1.Artifact, reader io.Reader, mode os.FileMode) (err error) {
-	localPath := s.LocalPath(*artifact)
-	tf, err := os.CreateTemp(filepath.Split(localPath))
+// limitSize returns a writer that writes to the given io.Writer, and fails with an ArtifactSizeError once more than the
+// ArtifactMaxSize is written.
+func (s *Storage) limitSize(w io.Writer) io.Writer {
+	if s.ArtifactMaxSize <= 0 {
+		return w
+	}
+	return &sizeLimitWriter{w: w, limit: s.ArtifactMaxSize}
+}
+
+// sizeLimitWriter is an io.Writer that fails with an ArtifactSizeError
+// instead of writing more than the limit.
+type sizeLimitWriter struct {
+	w     io.Writer
+	limit int64
+	size  int64
+}
+
+func (w *sizeLimitWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	if w.size > w.limit {
+		return 0, &ArtifactSizeError{Limit: w.limit, Size: w.size}
+	}
+	return w.w.Write(p)
+}
+
+// archiveEntry is a file or directory to be written to an archive.
+type archiveEntry struct {
+	header *tar.Header
+	path   string
+}
+
+// write writes the header of the entry to the given tar.Writer, followed by
+// the contents of the file.
+func (e *archiveEntry) write(tw *tar.Writer) error {
+	if err := tw.WriteHeader(e.header); err != nil {
+		return err
+	}
+	if e.header.Typeflag == tar.TypeDir {
+		return nil
+	}
+
+	f, err := os.Open(e.path)
 	if err != nil {
 		return err
 	}
-	tfName := tf.Name()
-	defer func() {
-		if err != nil {
-			os.Remove(tfName)
-		}
-	}()
+	if _, err := io.Copy(tw, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	h := newHash()
-	mw := io.MultiWriter(h, tf)
+// archiveMode returns the normalised permissions of the given file in an
+// archive: 0755 for directories and executable files, 0644 for any other file.
+func archiveMode(fi os.FileInfo) int64 {
+	if fi.IsDir() || fi.Mode().Perm()&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
 
-	if _, err := io.Copy(mw, reader); err != nil {
+// publishFile flushes the given temporary file to disk, closes it, and renames it with the given mode to the given
+// path, so that readers of the path always see either the previous or the complete new file. The temporary file must
+// reside in the directory of the path, as a rename across file systems is not atomic.
+func publishFile(tf tempFile, localPath string, mode os.FileMode) error {
+	if err := tf.Sync(); err != nil {
 		tf.Close()
 		return err
 	}
 	if err := tf.Close(); err != nil {
 		return err
 	}
-
-	if err := os.Chmod(tfName, mode); err != nil {
+	if err := os.Chmod(tf.Name(), mode); err != nil {
 		return err
 	}
+	if err := os.Rename(tf.Name(), localPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(localPath))
+}
 
-	if err := fs.RenameWithFallback(tfName, localPath); err != nil {
+// syncDir flushes the entries of the given directory to disk, to persist a rename.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
 		return err
 	}
+	return d.Close()
+}
 
-	artifact.Checksum = fmt.Sprintf("%x", h.Sum(nil))
-	artifact.LastUpdateTime = metav1.Now()
-	return nil
+// AtomicWriteFile atomically writes the io.Reader contents to the v1beta1.Artifact path.
+// If successful, it sets the checksum and last update time on the artifact. The contents of an io.Reader which is
+// an io.Seeker are written again after a transient error of the file system.
+func (s *Storage) AtomicWriteFile(artifact *sourcev1.Artifact, reader io.Reader, mode os.FileMode) error {
+	return s.retryWrite(reader, func() error {
+		return s.writeFile(artifact, reader, mode)
+	})
 }
 
 // Copy atomically copies the io.Reader contents to the v1beta1.Artifact path.
-// If successful, it sets the checksum and last update time on the artifact.
-func (s *Storage) Copy(artifact *sourcev1.Artifact, reader io.Reader) (err error) {
+// If successful, it sets the checksum and last update time on the artifact. The contents of an io.Reader which is
+// an io.Seeker are copied again after a transient error of the file system.
+func (s *Storage) Copy(artifact *sourcev1.Artifact, reader io.Reader) error {
+	return s.AtomicWriteFile(artifact, reader, 0644)
+}
+
+// writeFile writes the io.Reader contents to the v1beta1.Artifact path with the given mode once.
+func (s *Storage) writeFile(artifact *sourcev1.Artifact, reader io.Reader, mode os.FileMode) (err error) {
 	localPath := s.LocalPath(*artifact)
-	tf, err := os.CreateTemp(filepath.Split(localPath))
+	tf, err := s.createTempFile(filepath.Split(localPath))
 	if err != nil {
 		return err
 	}
@@ -328,22 +835,26 @@ func (s *Storage) Copy(artifact *sourcev1.Artifact, reader io.Reader) (err error
 		}
 	}()
 
-	h := newHash()
-	mw := io.MultiWriter(h, tf)
+	h := s.newArtifactHash()
+	mw := s.limitSize(io.MultiWriter(h, tf))
 
 	if _, err := io.Copy(mw, reader); err != nil {
 		tf.Close()
 		return err
 	}
-	if err := tf.Close(); err != nil {
+
+	if err := publishFile(tf, localPath, mode); err != nil {
 		return err
 	}
-
-	if err := fs.RenameWithFallback(tfName, localPath); err != nil {
+	s.deduplicate(localPath, h)
+	if err := s.upload(artifact.Path, localPath, ""); err != nil {
 		return err
 	}
 
-	artifact.Checksum = fmt.Sprintf("%x", h.Sum(nil))
+	setChecksum(artifact, h)
+	if err := s.sign(artifact, h); err != nil {
+		return err
+	}
 	artifact.LastUpdateTime = metav1.Now()
 	return nil
 }
@@ -359,7 +870,8 @@ func (s *Storage) CopyFromPath(artifact *sourcev1.Artifact, path string) (err er
 	return s.Copy(artifact, f)
 }
 
-// CopyToPath copies the contents in the (sub)path of the given artifact to the given path.
+// CopyToPath copies the contents in the (sub)path of the given artifact to the given path, after verifying the
+// artifact against its digest.
 func (s *Storage) CopyToPath(artifact *sourcev1.Artifact, subPath, toPath string) error {
 	// create a tmp directory to store artifact
 	tmp, err := os.MkdirTemp("", "flux-include-")
@@ -368,6 +880,10 @@ func (s *Storage) CopyToPath(artifact *sourcev1.Artifact, subPath, toPath string
 	}
 	defer os.RemoveAll(tmp)
 
+	if err := s.VerifyArtifact(*artifact); err != nil {
+		return err
+	}
+
 	// read artifact file content
 	localPath := s.LocalPath(*artifact)
 	f, err := os.Open(localPath)
@@ -378,7 +894,7 @@ func (s *Storage) CopyToPath(artifact *sourcev1.Artifact, subPath, toPath string
 
 	// untar the artifact
 	untarPath := filepath.Join(tmp, "unpack")
-	if _, err = untar.Untar(f, untarPath); err != nil {
+	if err = untarArtifact(*artifact, f, untarPath); err != nil {
 		return err
 	}
 
@@ -398,7 +914,96 @@ func (s *Storage) CopyToPath(artifact *sourcev1.Artifact, subPath, toPath string
 	return nil
 }
 
+// untarArtifact reads the tarball of the given v1beta1.Artifact from r and writes it into dir with extractTarball. The
+// encoding of the tarball is determined by the extension of the artifact path, so that artifacts written with a
+// previous ArchiveEncoding can still be read.
+func untarArtifact(artifact sourcev1.Artifact, r io.Reader, dir string) error {
+	if !strings.HasSuffix(artifact.Path, archiveExtensions[ArchiveEncodingZstd]) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("requires gzip-compressed body: %w", err)
+		}
+		defer zr.Close()
+		return extractTarball(zr, dir)
+	}
+
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return extractTarball(zr, dir)
+}
+
+// ArtifactHeaders sets the Content-Type, and for zstd compressed tarballs the Content-Encoding, of the artifacts
+// served by the given http.Handler. Gzip compressed tarballs are served without a Content-Encoding, as clients that
+// request a gzip encoding would otherwise transparently decompress them. The Content-Encoding is only set once the
+// response is written with the content of the file, as http.ServeContent omits the Content-Length of encoded
+// responses.
+func ArtifactHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType, encoding := artifactContentHeaders(r.URL.Path)
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if encoding != "" {
+			w = &encodingResponseWriter{ResponseWriter: w, encoding: encoding}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// artifactContentHeaders returns the Content-Type and Content-Encoding of the tarball artifact at the given path, or
+// empty strings for any other file.
+func artifactContentHeaders(p string) (string, string) {
+	switch {
+	case strings.HasSuffix(p, archiveExtensions[ArchiveEncodingGzip]):
+		return "application/gzip", ""
+	case strings.HasSuffix(p, archiveExtensions[ArchiveEncodingZstd]):
+		return "application/x-tar", ArchiveEncodingZstd
+	}
+	return "", ""
+}
+
+// encodingResponseWriter is a http.ResponseWriter that sets the Content-Encoding header of responses with the content
+// of a file.
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	wroteHeader bool
+}
+
+func (w *encodingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code == http.StatusOK || code == http.StatusPartialContent {
+			w.Header().Set("Content-Encoding", w.encoding)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *encodingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom allows the underlying http.ResponseWriter to send the file with sendfile, it implements io.ReaderFrom.
+func (w *encodingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
 // Symlink creates or updates a symbolic link for the given v1beta1.Artifact and returns the URL for the symlink.
+// The link is updated by renaming a new link over it, so that readers never observe a missing link. With a Backend,
+// the link is uploaded as a copy of the artifact.
 func (s *Storage) Symlink(artifact sourcev1.Artifact, linkName string) (string, error) {
 	localPath := s.LocalPath(artifact)
 	dir := filepath.Dir(localPath)
@@ -416,18 +1021,126 @@ func (s *Storage) Symlink(artifact sourcev1.Artifact, linkName string) (string,
 	if err := os.Rename(tmpLink, link); err != nil {
 		return "", err
 	}
+	if err := syncDir(dir); err != nil {
+		return "", err
+	}
 
-	url := fmt.Sprintf("http://%s/%s", s.Hostname, filepath.Join(filepath.Dir(artifact.Path), linkName))
-	return url, nil
+	linkPath := filepath.Join(filepath.Dir(artifact.Path), linkName)
+	if err := s.upload(linkPath, link, artifact.Path); err != nil {
+		return "", err
+	}
+	return s.url(linkPath), nil
 }
 
-// Checksum returns the SHA1 checksum for the data of the given io.Reader as a string.
+// Checksum returns the SHA256 checksum for the data of the given io.Reader as a string.
 func (s *Storage) Checksum(reader io.Reader) string {
 	h := newHash()
 	_, _ = io.Copy(h, reader)
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// legacyChecksumLength is the length of the hex encoded SHA1 checksums and revisions of the artifacts created by
+// previous versions.
+const legacyChecksumLength = 40
+
+// LegacyChecksum returns the SHA1 checksum for the data of the given io.Reader as a string, the checksum of artifacts
+// created by previous versions. It returns an empty string in FIPS mode, in which the artifacts of previous versions
+// are not kept, but created again with a SHA256 checksum.
+func (s *Storage) LegacyChecksum(reader io.Reader) string {
+	h, err := fips.Legacy(fips.SHA1, "checksum of the artifacts of previous versions")
+	if err != nil {
+		return ""
+	}
+	_, _ = io.Copy(h, reader)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// VerifyArtifact verifies the content of the given v1beta1.Artifact against its digest, of any of the supported
+// algorithms. Artifacts created by previous versions have no digest and are verified against their checksum, SHA256 or
+// SHA1. Artifacts without a digest or checksum are not verified. With a Backend, an artifact that is missing in the BasePath or fails the verification is restored
+// from the Backend, and verified again.
+func (s *Storage) VerifyArtifact(artifact sourcev1.Artifact) error {
+	err := s.verifyFile(artifact)
+	if err == nil || s.Backend == nil {
+		return err
+	}
+	// The corrupt content must not be linked by the next artifacts
+	s.removeContentOf(s.LocalPath(artifact), artifact.Checksum)
+	if err := s.restore(artifact); err != nil {
+		return err
+	}
+	return s.verifyFile(artifact)
+}
+
+// verifyFile verifies the file of the given v1beta1.Artifact in the BasePath against its digest.
+func (s *Storage) verifyFile(artifact sourcev1.Artifact) error {
+	digest := artifact.Digest
+	if digest == "" {
+		digest = artifact.Checksum
+	}
+	if digest == "" {
+		return nil
+	}
+	f, err := os.Open(s.LocalPath(artifact))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := VerifyDigest(f, digest); err != nil {
+		return fmt.Errorf("artifact '%s': %w", artifact.Path, err)
+	}
+	return nil
+}
+
+// VerifyDigest verifies the data of the given io.Reader against the given digest, in the form of
+// '<algorithm>:<checksum>' or of a bare checksum, of which the algorithm is determined by its length.
+func VerifyDigest(reader io.Reader, digest string) error {
+	algorithm, checksum, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+	h, err := newDigestHash(algorithm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, reader); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != checksum {
+		return fmt.Errorf("%s checksum '%s' does not match '%s'", algorithm, got, checksum)
+	}
+	return nil
+}
+
+// parseDigest returns the algorithm and the checksum of the given digest, in the form of '<algorithm>:<checksum>' or
+// of a bare checksum, of which the algorithm is determined by its length.
+func parseDigest(digest string) (string, string, error) {
+	algorithm, checksum := "", digest
+	if parts := strings.SplitN(digest, ":", 2); len(parts) == 2 {
+		algorithm, checksum = parts[0], parts[1]
+	} else {
+		for alg, newHash := range digestAlgorithms {
+			if len(checksum) == newHash().Size()*2 {
+				algorithm = alg
+			}
+		}
+		if len(checksum) == legacyChecksumLength {
+			return fips.SHA1, strings.ToLower(checksum), nil
+		}
+	}
+	newHash, ok := digestAlgorithms[algorithm]
+	if !ok {
+		if algorithm == "" {
+			return "", "", fmt.Errorf("invalid digest '%s'", digest)
+		}
+		return "", "", fmt.Errorf("unsupported digest algorithm '%s'", algorithm)
+	}
+	if len(checksum) != newHash().Size()*2 {
+		return "", "", fmt.Errorf("invalid %s digest '%s'", algorithm, digest)
+	}
+	return algorithm, strings.ToLower(checksum), nil
+}
+
 // Lock creates a file lock for the given v1beta1.Artifact.
 func (s *Storage) Lock(artifact sourcev1.Artifact) (unlock func(), err error) {
 	lockFile := s.LocalPath(artifact) + ".lock"
@@ -447,7 +1160,75 @@ func (s *Storage) LocalPath(artifact sourcev1.Artifact) string {
 	return path
 }
 
-// newHash returns a new SHA1 hash.
+// DefaultDigestAlgorithm is the default algorithm of the digest of artifacts, and the algorithm of their checksum.
+const DefaultDigestAlgorithm = "sha256"
+
+// digestAlgorithms are the hashes by digest algorithm, all approved by FIPS 140. The bare SHA1 checksums of the
+// artifacts created by previous versions are verified with the legacy hash of the fips package.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// newDigestHash returns a new hash of the given digest algorithm, or the legacy SHA1 hash of the checksums of the
+// artifacts created by previous versions, which returns an error in FIPS mode.
+func newDigestHash(algorithm string) (hash.Hash, error) {
+	if algorithm == fips.SHA1 {
+		return fips.Legacy(fips.SHA1, "checksum of the artifacts of previous versions")
+	}
+	return digestAlgorithms[algorithm](), nil
+}
+
+// ValidateDigestAlgorithm returns an error if the DigestAlgorithm is not supported.
+func (s *Storage) ValidateDigestAlgorithm() error {
+	switch s.DigestAlgorithm {
+	case "sha256", "sha384", "sha512":
+		return nil
+	}
+	return fmt.Errorf("unsupported digest algorithm '%s', must be one of sha256, sha384 or sha512", s.DigestAlgorithm)
+}
+
+// newHash returns a new SHA256 hash.
 func newHash() hash.Hash {
-	return sha1.New()
+	return sha256.New()
+}
+
+// artifactHash is an io.Writer that computes the SHA256 checksum, the digest and the size of an artifact.
+type artifactHash struct {
+	checksum  hash.Hash
+	algorithm string
+	digest    hash.Hash
+	size      int64
+}
+
+// newArtifactHash returns an artifactHash with the DigestAlgorithm.
+func (s *Storage) newArtifactHash() *artifactHash {
+	h := &artifactHash{checksum: newHash(), algorithm: DefaultDigestAlgorithm}
+	if newDigest, ok := digestAlgorithms[s.DigestAlgorithm]; ok && s.DigestAlgorithm != DefaultDigestAlgorithm {
+		h.algorithm, h.digest = s.DigestAlgorithm, newDigest()
+	}
+	return h
+}
+
+func (h *artifactHash) Write(p []byte) (int, error) {
+	h.checksum.Write(p)
+	if h.digest != nil {
+		h.digest.Write(p)
+	}
+	h.size += int64(len(p))
+	return len(p), nil
+}
+
+// setChecksum sets the checksum, digest and size of the given v1beta1.Artifact to the sums of the given
+// artifactHash, so that they always describe the same file.
+func setChecksum(artifact *sourcev1.Artifact, h *artifactHash) {
+	artifact.Checksum = fmt.Sprintf("%x", h.checksum.Sum(nil))
+	digest := artifact.Checksum
+	if h.digest != nil {
+		digest = fmt.Sprintf("%x", h.digest.Sum(nil))
+	}
+	artifact.Digest = fmt.Sprintf("%s:%s", h.algorithm, digest)
+	size := h.size
+	artifact.Size = &size
 }
@@ -0,0 +1,244 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+const (
+	// StorageBackendFilesystem is the default storage backend, which only
+	// stores the artifacts in the local directory of the Storage.
+	StorageBackendFilesystem = "filesystem"
+
+	// StorageBackendS3 is the storage backend that stores the artifacts in
+	// an S3 compatible bucket.
+	StorageBackendS3 = "s3"
+)
+
+// StorageBackend is a remote store of the artifacts of the Storage, e.g. an S3 compatible bucket. When the Storage has
+// a backend, the artifacts are written to the local directory of the Storage as before, and uploaded to the backend
+// once complete. The local directory then serves as a cache of the backend: artifacts that are missing locally, e.g.
+// after the controller moved to another node, are restored from the backend. The artifact URLs point to the backend.
+type StorageBackend interface {
+	// Upload stores the file at the given local path as the given object.
+	Upload(ctx context.Context, object BackendObject, localPath string) error
+
+	// Download writes the content of the object at the given path to the
+	// given io.Writer. It returns an error wrapping os.ErrNotExist if the
+	// object does not exist.
+	Download(ctx context.Context, path string, w io.Writer) error
+
+	// List returns the objects in the directory at the given path, without
+	// the objects in its subdirectories.
+	List(ctx context.Context, dir string) ([]BackendObject, error)
+
+	// Remove removes the object at the given path. Removing an object that
+	// does not exist is not an error.
+	Remove(ctx context.Context, path string) error
+
+	// URL returns the URL at which consumers download the object at the
+	// given path, without making a request to the backend.
+	URL(path string) string
+}
+
+// expiringURLBackend is implemented by the StorageBackends of which the URLs expire, e.g. presigned URLs, which are
+// renewed independently of the reconciliations of the sources.
+type expiringURLBackend interface {
+	// Keep returns true if the given URL of an object is valid long enough
+	// not to be renewed yet, in which case URL returns it for the same
+	// object until it must be renewed, also after the controller restarted.
+	Keep(URL string) bool
+
+	// RenewInterval returns the interval at which the URLs in the status of
+	// the sources are renewed, or zero if they do not expire.
+	RenewInterval() time.Duration
+}
+
+// BackendObject is an object of a StorageBackend.
+type BackendObject struct {
+	// Path is the path of the object, which is the path of the artifact,
+	// e.g. 'gitrepository/<namespace>/<name>/<revision>.tar.gz'.
+	Path string
+
+	// Size is the size of the object in bytes.
+	Size int64
+
+	// ModTime is the modification time of the object.
+	ModTime time.Time
+
+	// ContentType and ContentEncoding are the headers the object is served
+	// with.
+	ContentType     string
+	ContentEncoding string
+
+	// LinkTarget is the path of the artifact of a link, e.g. the 'latest'
+	// link of a source, which is a copy of the artifact in the backend. It
+	// is empty for any other object.
+	LinkTarget string
+}
+
+// backendContext returns the context for an operation on the Backend of the Storage, which times out after the
+// Timeout of the Storage.
+func (s *Storage) backendContext() (context.Context, context.CancelFunc) {
+	if s.Timeout > 0 {
+		return context.WithTimeout(context.Background(), s.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// url returns the URL of the file at the given artifact path, served by the Backend or else by the file server.
+func (s Storage) url(artifactPath string) string {
+	if s.Backend != nil {
+		return s.Backend.URL(artifactPath)
+	}
+	return fmt.Sprintf("%s://%s/%s", s.Scheme, s.Hostname, artifactPath)
+}
+
+// backendURL returns the URL of the Backend for the given URL of a file of an artifact, served by the file server or
+// the Backend.
+func (s Storage) backendURL(URL string) string {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return ""
+	}
+	artifactPath := urlArtifactPath(u)
+	if artifactPath == "" {
+		return ""
+	}
+	return s.Backend.URL(artifactPath)
+}
+
+// urlArtifactPath returns the path of the file of an artifact at the given URL, or an empty string if the URL is not
+// the URL of a file of an artifact.
+func urlArtifactPath(u *url.URL) string {
+	// The path of an artifact file is '<kind>/<namespace>/<name>/<file>', which
+	// is the end of the path of the URL of the file server and of any backend.
+	elems := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(elems) < 4 {
+		return ""
+	}
+	return path.Join(elems[len(elems)-4:]...)
+}
+
+// currentURL returns true if the given URL of a file of an artifact is advertised, and is not about to expire.
+func (s Storage) currentURL(URL string) bool {
+	if !s.isAdvertised(URL) {
+		return false
+	}
+	if b, ok := s.Backend.(expiringURLBackend); ok {
+		return b.Keep(URL)
+	}
+	return true
+}
+
+// renewInterval returns the interval at which the URLs of the artifacts are renewed, or zero if they do not expire.
+func (s Storage) renewInterval() time.Duration {
+	if b, ok := s.Backend.(expiringURLBackend); ok {
+		return b.RenewInterval()
+	}
+	return 0
+}
+
+// upload stores the file at the given local path as the object with the given artifact path in the Backend, as a link
+// to the given target if not empty.
+func (s *Storage) upload(artifactPath, localPath, linkTarget string) error {
+	if s.Backend == nil {
+		return nil
+	}
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	object := BackendObject{
+		Path:       artifactPath,
+		Size:       fi.Size(),
+		ModTime:    fi.ModTime(),
+		LinkTarget: linkTarget,
+	}
+	object.ContentType, object.ContentEncoding = artifactContentHeaders(artifactPath)
+
+	ctx, cancel := s.backendContext()
+	defer cancel()
+	if err := s.Backend.Upload(ctx, object, localPath); err != nil {
+		return fmt.Errorf("failed to upload artifact '%s': %w", artifactPath, err)
+	}
+	return nil
+}
+
+// restore downloads the object of the given artifact from the Backend to the local path of the artifact.
+func (s *Storage) restore(artifact sourcev1.Artifact) (err error) {
+	localPath := s.LocalPath(artifact)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0777); err != nil {
+		return err
+	}
+	tf, err := os.CreateTemp(filepath.Split(localPath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tf.Close()
+			os.Remove(tf.Name())
+		}
+	}()
+
+	ctx, cancel := s.backendContext()
+	defer cancel()
+	if err := s.Backend.Download(ctx, artifact.Path, tf); err != nil {
+		return fmt.Errorf("failed to download artifact '%s': %w", artifact.Path, err)
+	}
+	return publishFile(tf, localPath, 0644)
+}
+
+// listBackendObjects returns the objects in the directory of the given artifact in the Backend.
+func (s *Storage) listBackendObjects(artifact sourcev1.Artifact) ([]BackendObject, error) {
+	ctx, cancel := s.backendContext()
+	defer cancel()
+	objects, err := s.Backend.List(ctx, path.Dir(artifact.Path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects of artifact '%s': %w", artifact.Path, err)
+	}
+	return objects, nil
+}
+
+// removeBackendObjects removes the given objects from the Backend. It returns the removed objects, and the names of
+// the objects that could not be removed.
+func (s *Storage) removeBackendObjects(objects []BackendObject) ([]BackendObject, []string) {
+	ctx, cancel := s.backendContext()
+	defer cancel()
+	var removed []BackendObject
+	var errors []string
+	for _, o := range objects {
+		if err := s.Backend.Remove(ctx, o.Path); err != nil {
+			errors = append(errors, path.Base(o.Path))
+			continue
+		}
+		removed = append(removed, o)
+	}
+	return removed, errors
+}
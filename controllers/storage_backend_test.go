@@ -0,0 +1,482 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestS3Backend(t *testing.T) {
+	server := &s3Server{}
+	backend := newTestS3Backend(t, server, S3BackendOptions{PresignExpiry: time.Hour})
+	ctx := context.TODO()
+
+	local := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(local, []byte("artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	artifact := BackendObject{Path: "gitrepository/default/podinfo/revision.tar.zst", ContentType: "application/x-tar", ContentEncoding: "zstd"}
+	if err := backend.Upload(ctx, artifact, local); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	link := BackendObject{Path: "gitrepository/default/podinfo/latest.tar.zst", LinkTarget: artifact.Path}
+	if err := backend.Upload(ctx, link, local); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if err := backend.Upload(ctx, BackendObject{Path: "gitrepository/default/podinfo-other/revision.tar.gz"}, local); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+
+	objects, err := backend.List(ctx, "gitrepository/default/podinfo")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("List() returned %d objects, want 2", len(objects))
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Path < objects[j].Path })
+	if got := objects[0]; got.Path != link.Path || got.LinkTarget != artifact.Path || got.Size != int64(len("artifact")) {
+		t.Errorf("List() link = %+v, want a link to '%s'", got, artifact.Path)
+	}
+	if got := objects[1]; got.Path != artifact.Path || got.LinkTarget != "" || got.ContentType != "application/x-tar" ||
+		got.ContentEncoding != "zstd" || got.ModTime.IsZero() {
+		t.Errorf("List() artifact = %+v, want '%s' with its headers", got, artifact.Path)
+	}
+
+	var b bytes.Buffer
+	if err := backend.Download(ctx, artifact.Path, &b); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if b.String() != "artifact" {
+		t.Errorf("Download() content = %q, want %q", b.String(), "artifact")
+	}
+
+	if err := backend.Remove(ctx, artifact.Path); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if err := backend.Remove(ctx, artifact.Path); err != nil {
+		t.Errorf("Remove() of a removed object error = %v", err)
+	}
+	if err := backend.Download(ctx, artifact.Path, io.Discard); !os.IsNotExist(err) {
+		t.Errorf("Download() of a removed object error = %v, want not exist", err)
+	}
+
+	u, err := url.Parse(backend.URL(artifact.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/artifacts/"+artifact.Path || u.Query().Get("X-Amz-Signature") == "" || u.Query().Get("X-Amz-Expires") != "3600" {
+		t.Errorf("URL() = %s, want a presigned URL of '%s' expiring in 1h", u, artifact.Path)
+	}
+
+	gateway := newTestS3Backend(t, server, S3BackendOptions{URL: "https://cdn.example.com/flux/"})
+	if got, want := gateway.URL(artifact.Path), "https://cdn.example.com/flux/"+artifact.Path; got != want {
+		t.Errorf("URL() with a gateway = %s, want %s", got, want)
+	}
+	if got := gateway.RenewInterval(); got != 0 {
+		t.Errorf("RenewInterval() with a gateway = %s, want 0", got)
+	}
+
+	if _, err := NewS3Backend(S3BackendOptions{Endpoint: "s3.example.com", Bucket: "artifacts", PresignExpiry: 8 * 24 * time.Hour}); err == nil {
+		t.Error("NewS3Backend() with a presign expiry of 8 days did not return an error")
+	}
+}
+
+func TestStorage_Backend(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	server := &s3Server{}
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	storage.Backend = newTestS3Backend(t, server, S3BackendOptions{URL: "https://cdn.example.com"})
+	storage.ArtifactRetentionRecords = 2
+
+	src := t.TempDir()
+	obj := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+	var artifacts []sourcev1.Artifact
+	for _, revision := range []string{"one", "two", "three"} {
+		if err := os.WriteFile(filepath.Join(src, "file"), []byte(revision), 0644); err != nil {
+			t.Fatal(err)
+		}
+		artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, obj, revision, revision+".tar.gz")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Archive(&artifact, src, nil); err != nil {
+			t.Fatalf("Archive() error = %v", err)
+		}
+		artifacts = append(artifacts, artifact)
+		// The artifacts are ordered by their modification time
+		time.Sleep(10 * time.Millisecond)
+	}
+	current := artifacts[2]
+
+	if got, want := current.URL, "https://cdn.example.com/gitrepository/default/podinfo/three.tar.gz"; got != want {
+		t.Errorf("artifact URL = %s, want %s", got, want)
+	}
+	if got, want := storage.SetHostname("http://hostname/gitrepository/default/podinfo/latest.tar.gz"), "https://cdn.example.com/gitrepository/default/podinfo/latest.tar.gz"; got != want {
+		t.Errorf("SetHostname() = %s, want %s", got, want)
+	}
+	o := server.object(current.Path)
+	if o == nil {
+		t.Fatalf("artifact '%s' was not uploaded", current.Path)
+	}
+	if got := storage.Checksum(bytes.NewReader(o.data)); got != current.Checksum {
+		t.Errorf("checksum of the uploaded artifact = %s, want %s", got, current.Checksum)
+	}
+	if o.header.Get("Content-Type") != "application/gzip" {
+		t.Errorf("Content-Type of the uploaded artifact = %s, want application/gzip", o.header.Get("Content-Type"))
+	}
+
+	linkURL, err := storage.Symlink(current, "latest.tar.gz")
+	if err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+	if want := "https://cdn.example.com/gitrepository/default/podinfo/latest.tar.gz"; linkURL != want {
+		t.Errorf("Symlink() URL = %s, want %s", linkURL, want)
+	}
+	link := server.object("gitrepository/default/podinfo/latest.tar.gz")
+	if link == nil || !bytes.Equal(link.data, o.data) || link.header.Get("X-Amz-Meta-"+s3LinkTargetMetadata) != current.Path {
+		t.Errorf("link was not uploaded as a copy of '%s'", current.Path)
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		if err := os.Remove(storage.LocalPath(current)); err != nil {
+			t.Fatal(err)
+		}
+		if !storage.ArtifactExist(current) {
+			t.Fatal("ArtifactExist() = false for an artifact in the backend")
+		}
+		if err := storage.VerifyArtifact(current); err != nil {
+			t.Errorf("VerifyArtifact() of the restored artifact error = %v", err)
+		}
+
+		if err := os.WriteFile(storage.LocalPath(current), []byte("corrupt"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.VerifyArtifact(current); err != nil {
+			t.Errorf("VerifyArtifact() of a corrupt local artifact error = %v", err)
+		}
+
+		missing := storage.NewArtifactFor(sourcev1.GitRepositoryKind, obj, "missing", "missing.tar.gz")
+		if storage.ArtifactExist(missing) {
+			t.Error("ArtifactExist() = true for an artifact that does not exist")
+		}
+
+		server.object(current.Path).data = []byte("corrupt")
+		if err := os.Remove(storage.LocalPath(current)); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.VerifyArtifact(current); err == nil {
+			t.Error("VerifyArtifact() of a corrupt artifact in the backend did not return an error")
+		}
+		server.object(current.Path).data = o.data
+	})
+
+	t.Run("garbage collection", func(t *testing.T) {
+		removed, err := storage.GarbageCollect(current)
+		if err != nil {
+			t.Fatalf("GarbageCollect() error = %v", err)
+		}
+		if !containsString(removed, artifacts[0].Path) || !containsString(removed, storage.LocalPath(artifacts[0])) {
+			t.Errorf("GarbageCollect() removed %v, want the local file and the object of '%s'", removed, artifacts[0].Path)
+		}
+		for _, p := range []string{artifacts[1].Path, current.Path, "gitrepository/default/podinfo/latest.tar.gz"} {
+			if server.object(p) == nil {
+				t.Errorf("GarbageCollect() removed the object '%s'", p)
+			}
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if err := storage.RemoveAllButCurrent(current); err != nil {
+			t.Fatalf("RemoveAllButCurrent() error = %v", err)
+		}
+		if server.object(artifacts[1].Path) != nil {
+			t.Errorf("RemoveAllButCurrent() kept the object '%s'", artifacts[1].Path)
+		}
+		if server.object(current.Path) == nil || server.object("gitrepository/default/podinfo/latest.tar.gz") == nil {
+			t.Error("RemoveAllButCurrent() removed the current artifact or its link")
+		}
+
+		if err := storage.RemoveAll(current); err != nil {
+			t.Fatalf("RemoveAll() error = %v", err)
+		}
+		if n := len(server.objects); n != 0 {
+			t.Errorf("RemoveAll() kept %d objects", n)
+		}
+	})
+}
+
+func TestS3Backend_URL(t *testing.T) {
+	backend := newTestS3Backend(t, &s3Server{}, S3BackendOptions{PresignExpiry: time.Hour})
+	p := "gitrepository/default/podinfo/revision.tar.gz"
+
+	// The presigned URL does not change on every call
+	presigned := backend.URL(p)
+	if got := backend.URL(p); got != presigned {
+		t.Errorf("URL() = %s, want the previous URL %s", got, presigned)
+	}
+	if got := backend.RenewInterval(); got != 15*time.Minute {
+		t.Errorf("RenewInterval() = %s, want a quarter of the presign expiry", got)
+	}
+
+	// A URL presigned before a restart is kept while more than half of its
+	// expiry remains
+	withDate := func(date time.Time) string {
+		u, err := url.Parse(presigned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		q.Set("X-Amz-Date", date.UTC().Format(s3PresignDateFormat))
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	restarted := newTestS3Backend(t, &s3Server{}, S3BackendOptions{PresignExpiry: time.Hour})
+	previous := withDate(time.Now().Add(-20 * time.Minute))
+	if !restarted.Keep(previous) {
+		t.Errorf("Keep() of a URL presigned 20m ago = false, want true")
+	}
+	if got := restarted.URL(p); got != previous {
+		t.Errorf("URL() after Keep() = %s, want the kept URL %s", got, previous)
+	}
+
+	// A URL about to expire is renewed
+	if restarted.Keep(withDate(time.Now().Add(-40 * time.Minute))) {
+		t.Errorf("Keep() of a URL presigned 40m ago = true, want false")
+	}
+	for _, URL := range []string{"https://s3.example.com/artifacts/" + p, "https://s3.example.com/artifacts"} {
+		if restarted.Keep(URL) {
+			t.Errorf("Keep(%s) = true, want false", URL)
+		}
+	}
+
+	// The URL of a removed object is presigned again
+	if err := restarted.Remove(context.TODO(), p); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.URL(p); got == previous {
+		t.Error("URL() of a removed object returned the previous URL")
+	}
+}
+
+// newTestS3Backend returns an S3Backend with the given options for the bucket 'artifacts' of the given s3Server.
+func newTestS3Backend(t *testing.T, handler *s3Server, opts S3BackendOptions) *S3Backend {
+	t.Helper()
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		env := env
+		if v, ok := os.LookupEnv(env); ok {
+			t.Cleanup(func() { os.Setenv(env, v) })
+		} else {
+			t.Cleanup(func() { os.Unsetenv(env) })
+		}
+	}
+	os.Setenv("AWS_ACCESS_KEY_ID", "access")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Endpoint = u.Host
+	opts.Bucket = "artifacts"
+	opts.Region = "us-east-1"
+	opts.Insecure = true
+	backend, err := NewS3Backend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+// s3Server is an in-memory S3 compatible service with a bucket named 'artifacts', which implements the requests of
+// the S3Backend.
+type s3Server struct {
+	mu      sync.Mutex
+	objects map[string]*s3Object
+}
+
+type s3Object struct {
+	data    []byte
+	header  http.Header
+	modTime time.Time
+}
+
+func (s *s3Server) object(key string) *s3Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[key]
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/artifacts/")
+	if key == r.URL.Path {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects == nil {
+		s.objects = map[string]*s3Object{}
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case r.Method == http.MethodPut:
+		data, err := readS3Payload(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		header := http.Header{}
+		for k, v := range r.Header {
+			if k == "Content-Type" || k == "Content-Encoding" || strings.HasPrefix(k, "X-Amz-Meta-") {
+				header[k] = v
+			}
+		}
+		s.objects[key] = &s3Object{data: data, header: header, modTime: time.Now()}
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := s.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		for k, v := range o.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, key, o.modTime, bytes.NewReader(o.data))
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// list answers a ListObjectsV2 request.
+func (s *s3Server) list(w http.ResponseWriter, r *http.Request) {
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+	type content struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []content      `xml:"Contents"`
+		CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+	}{Name: "artifacts", Prefix: prefix}
+
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	prefixes := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			p := key[:len(prefix)+i+len(delimiter)]
+			if !prefixes[p] {
+				prefixes[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+			}
+			continue
+		}
+		o := s.objects[key]
+		result.Contents = append(result.Contents, content{Key: key, LastModified: o.modTime.UTC(), ETag: `"etag"`, Size: int64(len(o.data))})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// readS3Payload returns the payload of the given PUT request, decoding the chunks of a streaming signature.
+func readS3Payload(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk header %q", line)
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, message)
+}
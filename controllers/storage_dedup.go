@@ -0,0 +1,171 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// sha256Checksum matches a hex encoded SHA256 checksum.
+var sha256Checksum = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// contentDir is the directory of the BasePath in which the content of the deduplicated artifacts is stored by
+// checksum, as '.content/sha256/<checksum>'. The artifact files of the sources are hard links to these files, the
+// number of links of a content file is thus the number of artifacts that reference it, plus one.
+const contentDir = ".content"
+
+// writtenExtension is the extension of the sidecar file of an artifact linked to stored content, of which the
+// modification time is the time at which the artifact was written. The modification time of the artifact file is the
+// one of the content, which is shared by the artifacts of other sources.
+const writtenExtension = ".written"
+
+// contentPath returns the local path of the content with the given SHA256 checksum.
+func (s *Storage) contentPath(checksum string) string {
+	return filepath.Join(s.BasePath, contentDir, "sha256", checksum)
+}
+
+// deduplicate replaces the published artifact file at the given local path with a hard link to the stored content
+// with the same checksum, or stores the file as the content if there is none. Simultaneous writers of the same content
+// agree on the first file that is linked as the content, and a content file removed by collectContent in the meantime
+// is stored again. Failures are ignored, the artifact is then kept as a file of its own, e.g. on a file system without
+// hard links.
+func (s *Storage) deduplicate(localPath string, h *artifactHash) {
+	if !s.Deduplicate {
+		return
+	}
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return
+	}
+	if _, ok := linkCount(fi); !ok {
+		return
+	}
+	contentPath := s.contentPath(fmt.Sprintf("%x", h.checksum.Sum(nil)))
+	if err := os.MkdirAll(filepath.Dir(contentPath), 0777); err != nil {
+		return
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(localPath, contentPath)
+		if err == nil {
+			_ = syncDir(filepath.Dir(contentPath))
+			return
+		}
+		if !os.IsExist(err) {
+			return
+		}
+		if err := linkContent(localPath, contentPath); !os.IsNotExist(err) {
+			return
+		}
+	}
+}
+
+// linkContent atomically replaces the file at the given local path with a hard link to the content file at the given
+// path, if they have the same size and mode. The time at which the artifact is written is recorded in its sidecar
+// file for the garbage collection, the content and the artifacts of other sources that link it are not modified.
+func linkContent(localPath, contentPath string) error {
+	local, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	content, err := os.Stat(contentPath)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(local, content) {
+		return nil
+	}
+	if local.Size() != content.Size() || local.Mode() != content.Mode() {
+		return fmt.Errorf("content '%s' does not match artifact '%s'", contentPath, localPath)
+	}
+
+	// A unique name in the directory of the artifact for the link, which is
+	// renamed over the artifact
+	tf, err := os.CreateTemp(filepath.Split(localPath))
+	if err != nil {
+		return err
+	}
+	tf.Close()
+	link := tf.Name()
+	if err := os.Remove(link); err != nil {
+		return err
+	}
+	if err := os.Link(contentPath, link); err != nil {
+		return err
+	}
+	if err := touch(localPath + writtenExtension); err != nil {
+		os.Remove(link)
+		return err
+	}
+	if err := os.Rename(link, localPath); err != nil {
+		os.Remove(link)
+		return err
+	}
+	return syncDir(filepath.Dir(localPath))
+}
+
+// touch creates the empty file at the given path, or sets its modification time to the current time.
+func touch(path string) error {
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// collectContent removes the stored content that is no longer referenced by any artifact, of which the content file
+// is the only link. An artifact that links the content while it is removed keeps its file, the content is stored
+// again by the next artifact with the same checksum.
+func (s *Storage) collectContent() {
+	if !s.Deduplicate {
+		return
+	}
+	dir := filepath.Join(s.BasePath, contentDir, "sha256")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if n, ok := linkCount(fi); ok && n == 1 {
+			_ = os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// removeContentOf removes the stored content with the given checksum if it is the file at the given local path, e.g.
+// when the artifact is corrupt. The artifacts of other sources that link the same content keep their file until they
+// are verified themselves.
+func (s *Storage) removeContentOf(localPath, checksum string) {
+	if !s.Deduplicate || !sha256Checksum.MatchString(checksum) {
+		return
+	}
+	local, err := os.Stat(localPath)
+	if err != nil {
+		return
+	}
+	contentPath := s.contentPath(checksum)
+	if content, err := os.Stat(contentPath); err == nil && os.SameFile(local, content) {
+		_ = os.Remove(contentPath)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// storedContent returns the names of the files in the content directory of the given storage.
+func storedContent(t *testing.T, storage *Storage) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(storage.BasePath, contentDir, "sha256"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestStorage_Deduplicate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("artifacts are not deduplicated on windows")
+	}
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	storage.Deduplicate = true
+	tree := copyChartTree(t, 0644, 0755, time.Now())
+
+	// Sources in different namespaces for the same repository and branch
+	// produce the same content in parallel
+	const sources = 8
+	artifacts := make([]sourcev1.Artifact, sources)
+	var wg sync.WaitGroup
+	errs := make(chan error, sources)
+	for i := range artifacts {
+		artifacts[i] = storage.NewArtifactFor(sourcev1.GitRepositoryKind,
+			&metav1.ObjectMeta{Name: "podinfo", Namespace: fmt.Sprintf("tenant-%d", i)}, "rev", "rev.tar.gz")
+		if err := storage.MkdirAll(artifacts[i]); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(artifact *sourcev1.Artifact) {
+			defer wg.Done()
+			if err := storage.Archive(artifact, tree, nil); err != nil {
+				errs <- err
+			}
+		}(&artifacts[i])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Archive() error = %v", err)
+	}
+
+	content := storedContent(t, storage)
+	if len(content) != 1 || content[0] != artifacts[0].Checksum {
+		t.Fatalf("stored content = %v, want the checksum of the artifacts %q", content, artifacts[0].Checksum)
+	}
+	contentInfo, err := os.Stat(storage.contentPath(artifacts[0].Checksum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, artifact := range artifacts {
+		if artifact.Checksum != artifacts[0].Checksum {
+			t.Errorf("checksum of %q = %q, want %q", artifact.Path, artifact.Checksum, artifacts[0].Checksum)
+		}
+		fi, err := os.Stat(storage.LocalPath(artifact))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(fi, contentInfo) {
+			t.Errorf("artifact %q is not a link to the stored content", artifact.Path)
+		}
+	}
+	if n, _ := linkCount(contentInfo); n != sources+1 {
+		t.Errorf("links of the stored content = %d, want %d", n, sources+1)
+	}
+
+	// The shared content is kept while any source references it
+	for _, artifact := range artifacts[1:] {
+		if err := storage.RemoveAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content := storedContent(t, storage); len(content) != 1 {
+		t.Fatalf("stored content = %v, want the content of the remaining artifact", content)
+	}
+	if err := storage.VerifyArtifact(artifacts[0]); err != nil {
+		t.Errorf("remaining artifact does not verify: %v", err)
+	}
+
+	// A new revision of the last source releases the content
+	next := storage.NewArtifactFor(sourcev1.GitRepositoryKind,
+		&metav1.ObjectMeta{Name: "podinfo", Namespace: "tenant-0"}, "next", "next.tar.gz")
+	if err := storage.AtomicWriteFile(&next, bytes.NewReader([]byte("next revision")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.RemoveAllButCurrent(next); err != nil {
+		t.Fatal(err)
+	}
+	if content := storedContent(t, storage); len(content) != 1 || content[0] != next.Checksum {
+		t.Errorf("stored content = %v, want only the content of the new revision %q", content, next.Checksum)
+	}
+}
+
+func TestStorage_DeduplicateRewrite(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("artifacts are not deduplicated on windows")
+	}
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	storage.Deduplicate = true
+
+	a := storage.NewArtifactFor(sourcev1.HelmRepositoryKind, &metav1.ObjectMeta{Name: "a", Namespace: "default"}, "rev", "index.yaml")
+	b := storage.NewArtifactFor(sourcev1.HelmRepositoryKind, &metav1.ObjectMeta{Name: "b", Namespace: "default"}, "rev", "index.yaml")
+	for _, artifact := range []*sourcev1.Artifact{&a, &b} {
+		if err := storage.MkdirAll(*artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AtomicWriteFile(artifact, bytes.NewReader([]byte("index")), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Linking the content of the other sources does not modify the time at
+	// which their artifacts were written
+	written := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(storage.LocalPath(a), written, written); err != nil {
+		t.Fatal(err)
+	}
+	c := storage.NewArtifactFor(sourcev1.HelmRepositoryKind, &metav1.ObjectMeta{Name: "c", Namespace: "default"}, "rev", "index.yaml")
+	if err := storage.MkdirAll(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&c, bytes.NewReader([]byte("index")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(storage.LocalPath(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(written) {
+		t.Errorf("modification time of the other source = %v, want %v", fi.ModTime(), written)
+	}
+	files, err := localStoredFiles(filepath.Dir(storage.LocalPath(c)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := artifactRecords(files); len(records) != 1 || len(records[0].files) != 2 || time.Since(records[0].modTime) > time.Minute {
+		t.Errorf("records = %+v, want the artifact with its written file at the current time", records)
+	}
+
+	// Rewriting an artifact with other content does not modify the content
+	// shared with the other source
+	if err := storage.AtomicWriteFile(&a, bytes.NewReader([]byte("other index")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(storage.LocalPath(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "index" {
+		t.Errorf("content of the other source = %q, want %q", got, "index")
+	}
+	if len(storedContent(t, storage)) != 2 {
+		t.Errorf("stored content = %v, want the content of both artifacts", storedContent(t, storage))
+	}
+
+	// The content of a corrupt artifact is removed, and not linked by the
+	// next artifact with the same checksum
+	if err := storage.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(storage.contentPath(b.Checksum)); !os.IsNotExist(err) {
+		t.Errorf("content of the removed artifact is kept: %v", err)
+	}
+}
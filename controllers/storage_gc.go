@@ -0,0 +1,189 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime"
+	kuberecorder "k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/events"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+const (
+	// DefaultArtifactRetentionRecords is the default maximum number of
+	// artifacts kept for a source, i.e. only the current artifact is kept.
+	DefaultArtifactRetentionRecords = 1
+
+	// DefaultArtifactRetentionTTL is the default duration for which the
+	// previous artifacts of a source are kept, within the
+	// ArtifactRetentionRecords.
+	DefaultArtifactRetentionTTL = 60 * time.Second
+)
+
+var (
+	// gcDeletedFilesCounter counts the files removed by the garbage
+	// collection of artifacts.
+	gcDeletedFilesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gotk_artifact_gc_deleted_files_total",
+			Help: "The number of artifact files deleted by the garbage collection.",
+		},
+	)
+	// gcReclaimedBytesCounter counts the size of the files removed by the
+	// garbage collection of artifacts.
+	gcReclaimedBytesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gotk_artifact_gc_reclaimed_bytes_total",
+			Help: "The total size in bytes of the artifact files deleted by the garbage collection.",
+		},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(gcDeletedFilesCounter, gcReclaimedBytesCounter)
+}
+
+// recordGarbageCollection records the removal of a file of the given size.
+func recordGarbageCollection(size int64) {
+	gcDeletedFilesCounter.Inc()
+	gcReclaimedBytesCounter.Add(float64(size))
+}
+
+// ArtifactGarbageCollector periodically collects the garbage of the artifacts
+// of all sources, in addition to the garbage collection by the reconcilers
+// after an artifact rotation. It retries the removal of files that failed
+// before, and removes previous artifacts once they expire. When the usage of
+// the storage is above its HighWatermark, it prunes the storage, and emits an
+// event with the recorders for the sources of which artifacts are pruned.
+type ArtifactGarbageCollector struct {
+	client.Reader
+	Scheme                *runtime.Scheme
+	Storage               *Storage
+	EventRecorder         kuberecorder.EventRecorder
+	ExternalEventRecorder *events.Recorder
+
+	// Interval is the interval of the garbage collection.
+	Interval time.Duration
+}
+
+// Start runs the garbage collection at the interval until the given context
+// is done, it implements manager.Runnable.
+func (gc *ArtifactGarbageCollector) Start(ctx context.Context) error {
+	ticker := time.NewTicker(gc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gc.collect(ctx)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the garbage
+// collection only runs on the leader, which owns the storage.
+func (gc *ArtifactGarbageCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// collect collects the garbage of the current artifacts of all sources that
+// are not being deleted. Failures are logged, and retried at the next
+// interval.
+func (gc *ArtifactGarbageCollector) collect(ctx context.Context) {
+	log := ctrl.LoggerFrom(ctx).WithName("artifact-gc")
+
+	sources, err := listSources(ctx, gc)
+	if err != nil {
+		log.Error(err, "unable to list sources")
+		return
+	}
+	for _, source := range sources {
+		if source.GetArtifact() == nil || !source.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+		removed, err := gc.Storage.GarbageCollect(*source.GetArtifact())
+		if err != nil {
+			log.Error(err, "unable to purge old artifacts", "artifact", source.GetArtifact().Path)
+		}
+		if len(removed) > 0 {
+			log.V(1).Info(fmt.Sprintf("Removed %d files of old artifacts", len(removed)), "artifact", source.GetArtifact().Path)
+		}
+	}
+
+	pruner := &storagePruner{
+		Reader:                gc.Reader,
+		Scheme:                gc.Scheme,
+		Storage:               gc.Storage,
+		EventRecorder:         gc.EventRecorder,
+		ExternalEventRecorder: gc.ExternalEventRecorder,
+	}
+	if err := pruner.ensureSpace(ctx); err != nil {
+		log.Error(err, "unable to free storage space")
+	}
+}
+
+// artifactSource is a source with an artifact in the storage.
+type artifactSource interface {
+	client.Object
+	sourcev1.Source
+	meta.ObjectWithStatusConditions
+}
+
+// listSources returns the sources of all kinds with an artifact in the
+// storage.
+func listSources(ctx context.Context, reader client.Reader) ([]artifactSource, error) {
+	var buckets sourcev1.BucketList
+	var gitRepositories sourcev1.GitRepositoryList
+	var helmCharts sourcev1.HelmChartList
+	var helmRepositories sourcev1.HelmRepositoryList
+	var ociRepositories sourcev1.OCIRepositoryList
+	for _, list := range []client.ObjectList{&buckets, &gitRepositories, &helmCharts, &helmRepositories, &ociRepositories} {
+		if err := reader.List(ctx, list); err != nil {
+			return nil, err
+		}
+	}
+
+	var sources []artifactSource
+	for i := range buckets.Items {
+		sources = append(sources, &buckets.Items[i])
+	}
+	for i := range gitRepositories.Items {
+		sources = append(sources, &gitRepositories.Items[i])
+	}
+	for i := range helmCharts.Items {
+		sources = append(sources, &helmCharts.Items[i])
+	}
+	for i := range helmRepositories.Items {
+		sources = append(sources, &helmRepositories.Items[i])
+	}
+	for i := range ociRepositories.Items {
+		sources = append(sources, &ociRepositories.Items[i])
+	}
+	return sources, nil
+}
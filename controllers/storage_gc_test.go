@@ -0,0 +1,118 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestArtifactGarbageCollector_collect(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	storage.ArtifactRetentionTTL = time.Hour
+	storage.ArtifactRetentionRecords = 0
+
+	// writeArtifacts writes a current and an expired artifact for the given
+	// source, and returns the current one.
+	writeArtifacts := func(t *testing.T, kind string, obj metav1.Object) sourcev1.Artifact {
+		t.Helper()
+		current := storage.NewArtifactFor(kind, obj, "current", "current.tar.gz")
+		expired := storage.NewArtifactFor(kind, obj, "expired", "expired.tar.gz")
+		if err := storage.MkdirAll(current); err != nil {
+			t.Fatal(err)
+		}
+		for _, artifact := range []sourcev1.Artifact{current, expired} {
+			if err := os.WriteFile(storage.LocalPath(artifact), []byte("artifact"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		modTime := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(storage.LocalPath(expired), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+
+	bucket := &sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"}}
+	bucketArtifact := writeArtifacts(t, sourcev1.BucketKind, bucket)
+	bucket.Status.Artifact = &bucketArtifact
+
+	repository := &sourcev1.HelmRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	repositoryArtifact := writeArtifacts(t, sourcev1.HelmRepositoryKind, repository)
+	repository.Status.Artifact = &repositoryArtifact
+
+	// The artifacts of a source without an artifact in its status are kept
+	chart := &sourcev1.HelmChart{ObjectMeta: metav1.ObjectMeta{Name: "chart", Namespace: "default"}}
+	writeArtifacts(t, sourcev1.HelmChartKind, chart)
+
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	gc := &ArtifactGarbageCollector{
+		Reader:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(bucket, repository, chart).Build(),
+		Storage:  storage,
+		Interval: time.Minute,
+	}
+
+	deleted := testutil.ToFloat64(gcDeletedFilesCounter)
+	reclaimed := testutil.ToFloat64(gcReclaimedBytesCounter)
+	gc.collect(context.TODO())
+
+	for _, tt := range []struct {
+		kind string
+		obj  metav1.Object
+		want bool
+	}{
+		{kind: sourcev1.BucketKind, obj: bucket, want: false},
+		{kind: sourcev1.HelmRepositoryKind, obj: repository, want: false},
+		{kind: sourcev1.HelmChartKind, obj: chart, want: true},
+	} {
+		for _, name := range []string{"current.tar.gz", "expired.tar.gz"} {
+			artifact := storage.NewArtifactFor(tt.kind, tt.obj, "", name)
+			want := tt.want || name == "current.tar.gz"
+			if got := storage.ArtifactExist(artifact); got != want {
+				t.Errorf("%s exists = %v, want %v", filepath.Join(tt.kind, name), got, want)
+			}
+		}
+	}
+	if got := testutil.ToFloat64(gcDeletedFilesCounter) - deleted; got != 2 {
+		t.Errorf("deleted files metric increased by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(gcReclaimedBytesCounter) - reclaimed; got != 16 {
+		t.Errorf("reclaimed bytes metric increased by %v, want 16", got)
+	}
+}
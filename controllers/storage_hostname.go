@@ -0,0 +1,178 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// ArtifactURLRewriter rewrites the URLs of the artifacts in the status of all sources when the controller starts, if
+// they are not served at the advertised address of the Storage, e.g. after the name of the Service of the controller
+// changed. Only the scheme and host of the URLs are compared, the artifacts themselves are left untouched. The
+// reconcilers rewrite the URLs of any source modified in the meantime.
+//
+// When the URLs of the Backend of the Storage expire, e.g. presigned URLs, they are also renewed periodically, for
+// the sources that are suspended or fail to reconcile not to advertise expired URLs.
+type ArtifactURLRewriter struct {
+	client.Client
+	Storage *Storage
+}
+
+// Start rewrites the URLs of the artifacts once, and then renews them periodically if they expire, until the given
+// context is done. It implements manager.Runnable.
+func (w *ArtifactURLRewriter) Start(ctx context.Context) error {
+	w.rewrite(ctx)
+	interval := w.Storage.renewInterval()
+	if interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			w.rewrite(ctx)
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the URLs are
+// only rewritten by the leader, which serves the artifacts.
+func (w *ArtifactURLRewriter) NeedLeaderElection() bool {
+	return true
+}
+
+// rewrite rewrites the URLs of the artifacts of all sources that are not served at the advertised address, or are
+// about to expire. Failures are logged.
+func (w *ArtifactURLRewriter) rewrite(ctx context.Context) {
+	log := ctrl.LoggerFrom(ctx).WithName("artifact-url-rewriter")
+
+	sources, err := listSources(ctx, w)
+	if err != nil {
+		log.Error(err, "unable to list sources")
+		return
+	}
+	var rewritten int
+	for _, source := range sources {
+		ok, err := w.rewriteSource(ctx, source)
+		if err != nil {
+			log.Error(err, "unable to rewrite artifact URL", "artifact", source.GetArtifact().Path)
+			continue
+		}
+		if ok {
+			rewritten++
+		}
+	}
+	if rewritten > 0 {
+		log.Info(fmt.Sprintf("Rewrote the artifact URLs of %d sources", rewritten), "hostname", w.Storage.Hostname)
+	}
+}
+
+// rewriteSource rewrites the URLs in the status of the given source with a patch of its status, if any of them is not
+// served at the advertised address or is about to expire. It returns true if the URLs were rewritten. A source that
+// has been modified since it was listed is left to its reconciler.
+func (w *ArtifactURLRewriter) rewriteSource(ctx context.Context, source artifactSource) (bool, error) {
+	if source.GetArtifact() == nil {
+		return false, nil
+	}
+	current := true
+	for _, URL := range statusURLs(source) {
+		// Every URL is checked, to keep the other URLs that are current
+		if URL != "" && !w.Storage.currentURL(URL) {
+			current = false
+		}
+	}
+	if current {
+		return false, nil
+	}
+
+	patch := client.MergeFromWithOptions(source.DeepCopyObject().(client.Object), client.MergeFromWithOptimisticLock{})
+	switch s := source.(type) {
+	case *sourcev1.Bucket:
+		w.Storage.SetArtifactURL(s.Status.Artifact)
+		s.Status.URL = w.Storage.SetHostname(s.Status.URL)
+	case *sourcev1.GitRepository:
+		w.Storage.SetArtifactURL(s.Status.Artifact)
+		s.Status.URL = w.Storage.SetHostname(s.Status.URL)
+		for _, included := range s.Status.IncludedArtifacts {
+			w.Storage.SetArtifactURL(included)
+		}
+	case *sourcev1.HelmChart:
+		w.Storage.SetArtifactURL(s.Status.Artifact)
+		s.Status.URL = w.Storage.SetHostname(s.Status.URL)
+	case *sourcev1.HelmRepository:
+		w.Storage.SetArtifactURL(s.Status.Artifact)
+		s.Status.URL = w.Storage.SetHostname(s.Status.URL)
+	case *sourcev1.OCIRepository:
+		w.Storage.SetArtifactURL(s.Status.Artifact)
+		s.Status.URL = w.Storage.SetHostname(s.Status.URL)
+	}
+	if err := w.Status().Patch(ctx, source, patch); err != nil {
+		if apierrors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// statusURLs returns the URLs in the status of the given source.
+func statusURLs(source artifactSource) []string {
+	urls := []string{source.GetArtifact().URL}
+	switch s := source.(type) {
+	case *sourcev1.Bucket:
+		urls = append(urls, s.Status.URL)
+	case *sourcev1.GitRepository:
+		urls = append(urls, s.Status.URL)
+		for _, included := range s.Status.IncludedArtifacts {
+			urls = append(urls, included.URL)
+		}
+	case *sourcev1.HelmChart:
+		urls = append(urls, s.Status.URL)
+	case *sourcev1.HelmRepository:
+		urls = append(urls, s.Status.URL)
+	case *sourcev1.OCIRepository:
+		urls = append(urls, s.Status.URL)
+	}
+	return urls
+}
+
+// isAdvertised returns true if the given URL of an artifact has the scheme and host of the URLs of the artifacts of
+// the Storage. The rest of the URL, e.g. the signature of a presigned URL of the Backend, is not compared.
+func (s Storage) isAdvertised(URL string) bool {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return false
+	}
+	// Any path results in the same scheme and host
+	want, err := url.Parse(s.url("artifact"))
+	if err != nil {
+		return true
+	}
+	return u.Scheme == want.Scheme && u.Host == want.Host
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestArtifactURLRewriter_rewrite(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	// The storage before the restart, advertised at the previous name of the
+	// Service of the controller
+	before, err := NewStorage(dir, "source-controller.flux-system", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	newArtifact := func(kind string, obj metav1.Object) *sourcev1.Artifact {
+		artifact := before.NewArtifactFor(kind, obj, "revision", "revision.tar.gz")
+		artifact.Checksum = "checksum"
+		return &artifact
+	}
+
+	repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	repository.Status.Artifact = newArtifact(sourcev1.GitRepositoryKind, repository)
+	repository.Status.URL = "http://source-controller.flux-system/gitrepository/default/repository/latest.tar.gz"
+	repository.Status.IncludedArtifacts = []*sourcev1.Artifact{newArtifact(sourcev1.GitRepositoryKind, &metav1.ObjectMeta{Name: "included", Namespace: "default"})}
+	chart := &sourcev1.HelmChart{ObjectMeta: metav1.ObjectMeta{Name: "chart", Namespace: "default"}}
+	chart.Status.Artifact = newArtifact(sourcev1.HelmChartKind, chart)
+	bucket := &sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"}}
+	ociRepository := &sourcev1.OCIRepository{ObjectMeta: metav1.ObjectMeta{Name: "oci", Namespace: "default"}}
+	ociRepository.Status.Artifact = newArtifact(sourcev1.OCIRepositoryKind, ociRepository)
+	ociRepository.Status.URL = "http://source-controller.flux-system/ocirepository/default/oci/latest.tar.gz"
+
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(repository, chart, bucket, ociRepository).Build()
+
+	// The storage after the restart, advertised at the new name
+	after, err := NewStorage(dir, "artifacts.flux-system:8080", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	w := &ArtifactURLRewriter{Client: c, Storage: after}
+	if err := w.Start(context.TODO()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	var gotRepository sourcev1.GitRepository
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(repository), &gotRepository); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://artifacts.flux-system:8080/gitrepository/default/repository/revision.tar.gz"; gotRepository.Status.Artifact.URL != want {
+		t.Errorf("artifact URL = %q, want %q", gotRepository.Status.Artifact.URL, want)
+	}
+	if want := "http://artifacts.flux-system:8080/gitrepository/default/repository/latest.tar.gz"; gotRepository.Status.URL != want {
+		t.Errorf("URL = %q, want %q", gotRepository.Status.URL, want)
+	}
+	if got := gotRepository.Status.IncludedArtifacts[0].URL; !strings.HasPrefix(got, "http://artifacts.flux-system:8080/") {
+		t.Errorf("included artifact URL = %q, want the new hostname", got)
+	}
+	// The artifact is not rotated
+	if got := gotRepository.Status.Artifact; got.Revision != "revision" || got.Checksum != "checksum" || got.Path != repository.Status.Artifact.Path {
+		t.Errorf("artifact = %+v, want the previous artifact with a rewritten URL", got)
+	}
+	// The spec and metadata are not modified
+	if gotRepository.Generation != repository.Generation {
+		t.Errorf("generation = %d, want %d", gotRepository.Generation, repository.Generation)
+	}
+
+	var gotChart sourcev1.HelmChart
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(chart), &gotChart); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://artifacts.flux-system:8080/helmchart/default/chart/revision.tar.gz"; gotChart.Status.Artifact.URL != want {
+		t.Errorf("chart artifact URL = %q, want %q", gotChart.Status.Artifact.URL, want)
+	}
+
+	var gotOCIRepository sourcev1.OCIRepository
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(ociRepository), &gotOCIRepository); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://artifacts.flux-system:8080/ocirepository/default/oci/revision.tar.gz"; gotOCIRepository.Status.Artifact.URL != want {
+		t.Errorf("OCI repository artifact URL = %q, want %q", gotOCIRepository.Status.Artifact.URL, want)
+	}
+	if want := "http://artifacts.flux-system:8080/ocirepository/default/oci/latest.tar.gz"; gotOCIRepository.Status.URL != want {
+		t.Errorf("OCI repository URL = %q, want %q", gotOCIRepository.Status.URL, want)
+	}
+
+	// A second restart at the same address leaves the sources untouched
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(repository), &gotRepository); err != nil {
+		t.Fatal(err)
+	}
+	resourceVersion := gotRepository.ResourceVersion
+	if err := w.Start(context.TODO()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(repository), &gotRepository); err != nil {
+		t.Fatal(err)
+	}
+	if gotRepository.ResourceVersion != resourceVersion {
+		t.Error("source with an advertised artifact URL was patched")
+	}
+}
+
+func TestArtifactURLRewriter_renew(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	backend := newTestS3Backend(t, &s3Server{}, S3BackendOptions{PresignExpiry: time.Hour})
+	storage.Backend = backend
+
+	// Suspended sources, which are not reconciled, with URLs presigned 20m
+	// and 40m ago
+	presigned := func(name string, age time.Duration) *sourcev1.GitRepository {
+		repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		repository.Spec.Suspend = true
+		artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, repository, "revision", "revision.tar.gz")
+		u, err := url.Parse(artifact.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		q.Set("X-Amz-Date", time.Now().Add(-age).UTC().Format(s3PresignDateFormat))
+		u.RawQuery = q.Encode()
+		artifact.URL = u.String()
+		repository.Status.Artifact = &artifact
+		return repository
+	}
+	valid := presigned("valid", 20*time.Minute)
+	expiring := presigned("expiring", 40*time.Minute)
+	// The restart of the controller
+	backend.presigned = map[string]presignedURL{}
+
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(valid, expiring).Build()
+	w := &ArtifactURLRewriter{Client: c, Storage: storage}
+	w.rewrite(context.TODO())
+
+	var got sourcev1.GitRepository
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(valid), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Artifact.URL != valid.Status.Artifact.URL {
+		t.Errorf("URL = %s, want the valid URL %s", got.Status.Artifact.URL, valid.Status.Artifact.URL)
+	}
+	if URL := storage.url(valid.Status.Artifact.Path); URL != valid.Status.Artifact.URL {
+		t.Errorf("URL of the next reconciliation = %s, want the valid URL %s", URL, valid.Status.Artifact.URL)
+	}
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(expiring), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Artifact.URL == expiring.Status.Artifact.URL || !backend.Keep(got.Status.Artifact.URL) {
+		t.Errorf("URL = %s, want a renewed URL", got.Status.Artifact.URL)
+	}
+}
+
+func TestStorage_isAdvertised(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), "source-controller.flux-system", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "http://source-controller.flux-system/gitrepository/default/repository/revision.tar.gz", want: true},
+		{url: "http://source-controller.flux-system/helmchart/default/chart/chart-0.1.0.tgz", want: true},
+		{url: "http://source-controller.flux-system:9090/gitrepository/default/repository/revision.tar.gz", want: false},
+		{url: "https://source-controller.flux-system/gitrepository/default/repository/revision.tar.gz", want: false},
+		{url: "http://source-controller/gitrepository/default/repository/revision.tar.gz", want: false},
+		{url: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := storage.isAdvertised(tt.url); got != tt.want {
+			t.Errorf("isAdvertised(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
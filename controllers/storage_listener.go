@@ -0,0 +1,105 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// unixSocketPrefix is the prefix of a storage address which is the path of a
+// unix domain socket, e.g. 'unix:///var/run/source-controller/artifacts.sock'.
+const unixSocketPrefix = "unix://"
+
+// DefaultStorageSocketMode is the default permissions of the unix domain
+// socket of the artifact server, which the sidecars of the pod running as the
+// same user or group can connect to.
+const DefaultStorageSocketMode os.FileMode = 0660
+
+// IsUnixSocketAddress returns if the given storage address is the path of a
+// unix domain socket.
+func IsUnixSocketAddress(addr string) bool {
+	return strings.HasPrefix(addr, unixSocketPrefix)
+}
+
+// storageNetwork returns the network and the address of the artifact server
+// for the given storage address: 'unix' and the path of the socket for an
+// address with the 'unix://' prefix, and 'tcp' and the address otherwise.
+func storageNetwork(addr string) (network, address string) {
+	if IsUnixSocketAddress(addr) {
+		return "unix", strings.TrimPrefix(addr, unixSocketPrefix)
+	}
+	return "tcp", addr
+}
+
+// ListenStorage listens on the given storage address, a TCP address or the
+// path of a unix domain socket with the 'unix://' prefix. The socket is
+// created with the given permissions, and replaces the socket left at the path
+// by a previous run, if any, but not a file of another type. The socket is
+// removed when the listener is closed.
+func ListenStorage(addr string, socketMode os.FileMode) (net.Listener, error) {
+	network, address := storageNetwork(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	if !filepath.IsAbs(address) {
+		return nil, fmt.Errorf("invalid storage address '%s', the path of the socket must be absolute", addr)
+	}
+	if fi, err := os.Lstat(address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("unable to listen on '%s', the file exists and is not a socket", address)
+		}
+		if err := os.Remove(address); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket: %w", err)
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address, socketMode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("unable to set the permissions of the socket: %w", err)
+	}
+	return ln, nil
+}
+
+// ParseStorageAdvURL parses the given advertised URL of the artifacts, of
+// which the scheme and host, with an optional port, replace the scheme of the
+// artifact server and the advertised address in the URLs of the artifacts,
+// e.g. 'https://artifacts.example.com' for a sidecar serving the artifacts
+// over HTTPS in front of an artifact server listening on a unix socket.
+func ParseStorageAdvURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid advertised URL '%s': %w", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid advertised URL '%s', the scheme must be 'http' or 'https'", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid advertised URL '%s', the host must be set", s)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return nil, fmt.Errorf("invalid advertised URL '%s', only the scheme, host and port can be set", s)
+	}
+	return u, nil
+}
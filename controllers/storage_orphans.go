@@ -0,0 +1,143 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// RemoveDeleted removes the storage directory of the given deleted source of the given kind, with all its artifacts,
+// unless RetainDeletedArtifacts is set.
+func (s *Storage) RemoveDeleted(kind string, metadata metav1.Object) error {
+	if s.RetainDeletedArtifacts {
+		return nil
+	}
+	return s.RemoveAll(s.NewArtifactFor(kind, metadata, "", "*"))
+}
+
+// RemoveOrphans removes the storage directories of the sources in the given namespace, or in all namespaces if it is
+// empty, that are not in the given set of artifact directories of existing sources, as returned by
+// sourcev1.ArtifactDir. A directory modified after the given time is kept, as it may belong to a source created after
+// the existing sources were listed. It returns the removed directories, relative to the BasePath.
+func (s *Storage) RemoveOrphans(namespace string, sources map[string]bool, before time.Time) ([]string, error) {
+	if namespace == "" {
+		namespace = "*"
+	}
+	var removed, errors []string
+	for _, kind := range artifactKinds {
+		dirs, err := filepath.Glob(filepath.Join(s.BasePath, sourcev1.ArtifactDir(kind, namespace, "*")))
+		if err != nil {
+			return removed, err
+		}
+		for _, dir := range dirs {
+			rel, err := filepath.Rel(s.BasePath, dir)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			if sources[rel] {
+				continue
+			}
+			fi, err := os.Stat(dir)
+			if err != nil || !fi.IsDir() || fi.ModTime().After(before) {
+				continue
+			}
+			parts := strings.Split(rel, "/")
+			orphan := &metav1.ObjectMeta{Namespace: parts[1], Name: parts[2]}
+			if err := s.RemoveAll(s.NewArtifactFor(kind, orphan, "", "*")); err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+			removed = append(removed, rel)
+		}
+	}
+	if len(errors) > 0 {
+		return removed, fmt.Errorf("failed to remove orphaned artifacts: %s", strings.Join(errors, " "))
+	}
+	return removed, nil
+}
+
+// ArtifactOrphanCollector removes the storage directories of the sources that
+// no longer exist when the controller starts, e.g. of sources deleted while
+// the controller was not running, or before their storage directory was
+// removed on deletion.
+type ArtifactOrphanCollector struct {
+	client.Reader
+	Scheme  *runtime.Scheme
+	Storage *Storage
+
+	// Namespace restricts the collection to the storage directories of the
+	// sources in the namespace, when the controller only watches a single
+	// namespace. Empty means all namespaces.
+	Namespace string
+}
+
+// Start collects the orphaned storage directories once, it implements
+// manager.Runnable.
+func (c *ArtifactOrphanCollector) Start(ctx context.Context) error {
+	c.collect(ctx)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the
+// collection only runs on the leader, which owns the storage.
+func (c *ArtifactOrphanCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// collect removes the storage directories without a source. Failures are
+// logged, and retried at the next start of the controller.
+func (c *ArtifactOrphanCollector) collect(ctx context.Context) {
+	log := ctrl.LoggerFrom(ctx).WithName("artifact-orphan-collector")
+
+	before := time.Now()
+	list, err := listSources(ctx, c)
+	if err != nil {
+		log.Error(err, "unable to list sources")
+		return
+	}
+	sources := map[string]bool{}
+	for _, source := range list {
+		gvk, err := apiutil.GVKForObject(source, c.Scheme)
+		if err != nil {
+			log.Error(err, "unable to get the kind of source", "name", source.GetName(), "namespace", source.GetNamespace())
+			return
+		}
+		sources[sourcev1.ArtifactDir(gvk.Kind, source.GetNamespace(), source.GetName())] = true
+	}
+
+	removed, err := c.Storage.RemoveOrphans(c.Namespace, sources, before)
+	if err != nil {
+		log.Error(err, "unable to remove orphaned artifacts")
+	}
+	for _, dir := range removed {
+		log.Info("Removed orphaned artifacts", "dir", dir)
+	}
+}
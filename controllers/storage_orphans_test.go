@@ -0,0 +1,136 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestStorage_RemoveOrphans(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	write := func(kind, namespace, name string, modTime time.Time) {
+		t.Helper()
+		artifact := storage.NewArtifactFor(kind, &metav1.ObjectMeta{Name: name, Namespace: namespace}, "rev", "index.yaml")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AtomicWriteFile(&artifact, bytes.NewReader([]byte("index")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Dir(storage.LocalPath(artifact)), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := time.Now()
+	old := before.Add(-time.Hour)
+	write(sourcev1.HelmRepositoryKind, "default", "podinfo", old)
+	write(sourcev1.HelmRepositoryKind, "default", "deleted", old)
+	write(sourcev1.GitRepositoryKind, "default", "podinfo", old)
+	write(sourcev1.BucketKind, "tenant", "deleted", old)
+	// Created after the sources were listed
+	write(sourcev1.HelmChartKind, "default", "created", before.Add(time.Minute))
+
+	sources := map[string]bool{
+		sourcev1.ArtifactDir(sourcev1.HelmRepositoryKind, "default", "podinfo"): true,
+		sourcev1.ArtifactDir(sourcev1.GitRepositoryKind, "default", "podinfo"):  true,
+	}
+
+	// Only the directories of the given namespace are removed
+	removed, err := storage.RemoveOrphans("default", sources, before)
+	if err != nil {
+		t.Fatalf("RemoveOrphans() error = %v", err)
+	}
+	if want := []string{"helmrepository/default/deleted"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("RemoveOrphans() removed %v, want %v", removed, want)
+	}
+
+	removed, err = storage.RemoveOrphans("", sources, before)
+	if err != nil {
+		t.Fatalf("RemoveOrphans() error = %v", err)
+	}
+	if want := []string{"bucket/tenant/deleted"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("RemoveOrphans() removed %v, want %v", removed, want)
+	}
+
+	var kept []string
+	for _, p := range []string{"bucket/tenant/deleted", "gitrepository/default/podinfo", "helmchart/default/created",
+		"helmrepository/default/deleted", "helmrepository/default/podinfo"} {
+		if _, err := os.Stat(filepath.Join(dir, p)); err == nil {
+			kept = append(kept, p)
+		}
+	}
+	sort.Strings(kept)
+	if want := []string{"gitrepository/default/podinfo", "helmchart/default/created", "helmrepository/default/podinfo"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept directories %v, want %v", kept, want)
+	}
+}
+
+func TestStorage_RemoveDeleted(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	obj := &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}
+	artifact := storage.NewArtifactFor(sourcev1.HelmRepositoryKind, obj, "rev", "index.yaml")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&artifact, bytes.NewReader([]byte("index")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.RetainDeletedArtifacts = true
+	if err := storage.RemoveDeleted(sourcev1.HelmRepositoryKind, obj); err != nil {
+		t.Fatalf("RemoveDeleted() error = %v", err)
+	}
+	if !storage.ArtifactExist(artifact) {
+		t.Error("artifact of the deleted source is removed, want it retained")
+	}
+
+	storage.RetainDeletedArtifacts = false
+	if err := storage.RemoveDeleted(sourcev1.HelmRepositoryKind, obj); err != nil {
+		t.Fatalf("RemoveDeleted() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(storage.LocalPath(artifact))); !os.IsNotExist(err) {
+		t.Errorf("storage directory of the deleted source is kept: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	ctrl "sigs.k8s.io/controller-runtime"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// storageCheck is the name of the readiness check of the storage.
+	storageCheck = "storage"
+	// artifactServerCheck is the name of the readiness check of the
+	// artifact server.
+	artifactServerCheck = "artifact-server"
+
+	// probeFile is the file written and removed in the BasePath by the
+	// readiness check of the storage. It is always the same file, so that a
+	// probe that fails to remove it does not leave garbage behind.
+	probeFile = ".readyz"
+)
+
+var (
+	// readinessCheckFailingGauge is 1 for a failing readiness check, and 0
+	// otherwise.
+	readinessCheckFailingGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_readiness_check_failing",
+			Help: "Whether a readiness check of the controller is failing, by check.",
+		},
+		[]string{"check"},
+	)
+	// readinessCheckFailuresCounter counts the failures of the readiness
+	// checks, excluding the cached results.
+	readinessCheckFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_readiness_check_failures_total",
+			Help: "The number of failures of a readiness check of the controller, by check.",
+		},
+		[]string{"check"},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(readinessCheckFailingGauge, readinessCheckFailuresCounter)
+}
+
+// ReadinessProbe checks that the controller can produce and serve artifacts:
+// that a file can be written to and removed from the storage, e.g. not on a
+// read-only or full volume, and that the artifact server accepts connections.
+// The result of a check is cached for the CacheDuration, so that frequent
+// probes do not hit the storage. A change of the result of a check is
+// logged with the reason of the failure.
+type ReadinessProbe struct {
+	Storage *Storage
+
+	// ServerAddress is the address of the artifact server, a host without
+	// a name, e.g. ':9090', is the local host, or the path of its unix
+	// domain socket with the 'unix://' prefix.
+	ServerAddress string
+
+	// CacheDuration is the duration for which the result of a check is
+	// reused.
+	CacheDuration time.Duration
+
+	// Replica is the name of the replica of the controller, e.g. the name
+	// of its pod, appended to the name of the probe file, so that the
+	// replicas sharing the storage do not probe the same file.
+	Replica string
+
+	// Standby fails the check of the artifact server while the replica can
+	// not serve the artifacts.
+	Standby *StandbyGate
+
+	mu      sync.Mutex
+	results map[string]*probeResult
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// probeResult is the cached result of a check.
+type probeResult struct {
+	checked time.Time
+	err     error
+}
+
+// StorageCheck is the healthz.Checker of the storage.
+func (p *ReadinessProbe) StorageCheck(_ *http.Request) error {
+	return p.check(storageCheck, p.checkStorage)
+}
+
+// ArtifactServerCheck is the healthz.Checker of the artifact server.
+func (p *ReadinessProbe) ArtifactServerCheck(_ *http.Request) error {
+	return p.check(artifactServerCheck, p.checkArtifactServer)
+}
+
+// check returns the cached result of the named check, or runs the check if
+// the result is older than the CacheDuration.
+func (p *ReadinessProbe) check(name string, run func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.now == nil {
+		p.now = time.Now
+	}
+	if p.results == nil {
+		p.results = map[string]*probeResult{}
+	}
+	now := p.now()
+	last, ok := p.results[name]
+	if ok && now.Sub(last.checked) < p.CacheDuration {
+		return last.err
+	}
+
+	err := run()
+	p.results[name] = &probeResult{checked: now, err: err}
+	log := ctrl.Log.WithName("readiness")
+	switch {
+	case err != nil:
+		readinessCheckFailuresCounter.WithLabelValues(name).Inc()
+		readinessCheckFailingGauge.WithLabelValues(name).Set(1)
+		if !ok || last.err == nil || last.err.Error() != err.Error() {
+			log.Error(err, "readiness check failed", "check", name)
+		}
+	default:
+		readinessCheckFailingGauge.WithLabelValues(name).Set(0)
+		if ok && last.err != nil {
+			log.Info("readiness check recovered", "check", name)
+		}
+	}
+	return err
+}
+
+// checkStorage writes and removes the probe file in the BasePath.
+func (p *ReadinessProbe) checkStorage() error {
+	name := probeFile
+	if p.Replica != "" {
+		name = probeFile + "-" + p.Replica
+	}
+	path := filepath.Join(p.Storage.BasePath, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("storage is not writable: %w", err)
+	}
+	_, err = f.Write([]byte("ok"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("storage is not writable: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("storage is not writable: %w", err)
+	}
+	return nil
+}
+
+// checkArtifactServer connects to the ServerAddress, and verifies that the
+// replica can serve the artifacts.
+func (p *ReadinessProbe) checkArtifactServer() error {
+	if err := p.Standby.err(); err != nil {
+		return err
+	}
+	network, address := storageNetwork(p.ServerAddress)
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		return fmt.Errorf("artifact server is not accepting connections: %w", err)
+	}
+	return conn.Close()
+}
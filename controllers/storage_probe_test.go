@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReadinessProbe_StorageCheck(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	now := time.Now()
+	p := &ReadinessProbe{Storage: storage, CacheDuration: 5 * time.Second, now: func() time.Time { return now }}
+
+	if err := p.StorageCheck(nil); err != nil {
+		t.Fatalf("StorageCheck() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, probeFile)); !os.IsNotExist(err) {
+		t.Errorf("probe file is left in the storage: %v", err)
+	}
+
+	// A storage that cannot be written to, the result is cached
+	storage.BasePath = filepath.Join(dir, "missing")
+	now = now.Add(5 * time.Second)
+	if err := p.StorageCheck(nil); err == nil {
+		t.Fatal("StorageCheck() of a storage that cannot be written to succeeded")
+	}
+	if got := testutil.ToFloat64(readinessCheckFailingGauge.WithLabelValues(storageCheck)); got != 1 {
+		t.Errorf("failing gauge = %v, want 1", got)
+	}
+	if err := os.Mkdir(storage.BasePath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	if err := p.StorageCheck(nil); err == nil {
+		t.Error("StorageCheck() within the cache duration is not cached")
+	}
+
+	// The probe recovers once the result expires
+	now = now.Add(5 * time.Second)
+	if err := p.StorageCheck(nil); err != nil {
+		t.Errorf("StorageCheck() after recovery error = %v", err)
+	}
+	if got := testutil.ToFloat64(readinessCheckFailingGauge.WithLabelValues(storageCheck)); got != 0 {
+		t.Errorf("failing gauge after recovery = %v, want 0", got)
+	}
+}
+
+func TestReadinessProbe_ArtifactServerCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	p := &ReadinessProbe{ServerAddress: ln.Addr().String()}
+
+	if err := p.ArtifactServerCheck(nil); err != nil {
+		t.Errorf("ArtifactServerCheck() error = %v", err)
+	}
+	ln.Close()
+	if err := p.ArtifactServerCheck(nil); err == nil {
+		t.Error("ArtifactServerCheck() of a closed listener succeeded")
+	}
+}
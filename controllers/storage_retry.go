@@ -0,0 +1,142 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// DefaultStorageWriteRetries is the default number of times the write of an
+// artifact is retried after a transient error of the file system.
+const DefaultStorageWriteRetries = 3
+
+// storageWriteRetryDelay is the delay before the first retry of the write of
+// an artifact, doubled for every next retry, it is replaced in tests.
+var storageWriteRetryDelay = 100 * time.Millisecond
+
+// transientStorageErrors are the errors of the file system after which the
+// write of an artifact is retried: a stale NFS file handle, an interrupted
+// system call, a resource temporarily unavailable, and an I/O error, which
+// NFS soft mounts return for a timed out write.
+var transientStorageErrors = []error{syscall.ESTALE, syscall.EINTR, syscall.EAGAIN, syscall.EIO}
+
+var (
+	// storageWriteRetriesCounter counts the retries of the writes of the
+	// artifacts after a transient error of the file system.
+	storageWriteRetriesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gotk_storage_write_retries_total",
+			Help: "The number of retries of the writes of artifacts to the storage after a transient error of the file system.",
+		},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(storageWriteRetriesCounter)
+}
+
+// tempFile is the temporary file to which an artifact is written before it
+// is renamed to the path of the artifact.
+type tempFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+	Name() string
+}
+
+// createTempFile creates a temporary file in the given directory, with the
+// createTemp function of the Storage if any.
+func (s *Storage) createTempFile(dir, pattern string) (tempFile, error) {
+	if s.createTemp != nil {
+		return s.createTemp(dir, pattern)
+	}
+	return os.CreateTemp(dir, pattern)
+}
+
+// isTransientStorageError returns if the given error is, or wraps, one of
+// the transientStorageErrors.
+func isTransientStorageError(err error) bool {
+	for _, transient := range transientStorageErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// storageFailureReason returns the reason of the Ready condition of a source
+// of which the artifact failed to be written with the given error: the
+// StorageFullReason if the file system has no space left, the
+// StorageReadOnlyReason if it is read-only, and the
+// StorageOperationFailedReason otherwise.
+func storageFailureReason(err error) string {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return sourcev1.StorageFullReason
+	case errors.Is(err, syscall.EROFS):
+		return sourcev1.StorageReadOnlyReason
+	default:
+		return sourcev1.StorageOperationFailedReason
+	}
+}
+
+// retryWrite runs the given write of an artifact, and runs it again after a
+// transient error of the file system, up to the WriteRetries of the Storage,
+// after a delay doubled for every retry. The given reader of the content of
+// the write, if any, is sought back to its offset before every retry, so
+// that the content is not fetched again; the write of the content of a reader
+// which is not an io.Seeker is not retried.
+func (s *Storage) retryWrite(reader io.Reader, write func() error) error {
+	rewind := func() error { return nil }
+	if reader != nil {
+		seeker, ok := reader.(io.Seeker)
+		if !ok {
+			return write()
+		}
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return write()
+		}
+		rewind = func() error {
+			_, err := seeker.Seek(offset, io.SeekStart)
+			return err
+		}
+	}
+
+	delay := storageWriteRetryDelay
+	for retry := 0; ; retry++ {
+		err := write()
+		if err == nil || retry >= s.WriteRetries || !isTransientStorageError(err) {
+			return err
+		}
+		if err := rewind(); err != nil {
+			return err
+		}
+		storageWriteRetriesCounter.Inc()
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
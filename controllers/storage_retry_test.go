@@ -0,0 +1,277 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// faultyFS creates temporary files of which the writes fail with an error of
+// the file system, for the first files.
+type faultyFS struct {
+	// err is the error of the failing writes.
+	err error
+	// faults is the number of files of which the writes fail.
+	faults int
+	// writes is the number of files created, i.e. of attempted writes.
+	writes int
+}
+
+func (fs *faultyFS) createTemp(dir, pattern string) (tempFile, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	fs.writes++
+	faulty := fs.faults > 0
+	if faulty {
+		fs.faults--
+	}
+	return &faultyFile{f: f, err: fs.err, faulty: faulty}, nil
+}
+
+// faultyFile is a temporary file of a faultyFS. It does not embed the
+// *os.File, so that io.Copy cannot bypass its Write with the ReadFrom or
+// WriteString of the file.
+type faultyFile struct {
+	f      *os.File
+	err    error
+	faulty bool
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if f.faulty {
+		return 0, &os.PathError{Op: "write", Path: f.f.Name(), Err: f.err}
+	}
+	return f.f.Write(p)
+}
+
+func (f *faultyFile) Sync() error  { return f.f.Sync() }
+func (f *faultyFile) Close() error { return f.f.Close() }
+func (f *faultyFile) Name() string { return f.f.Name() }
+
+// newFaultyStorage returns a Storage of which the writes of the artifacts fail
+// with the given error the given number of times, and which retries them
+// without delay.
+func newFaultyStorage(t *testing.T, err error, faults int) (*Storage, *faultyFS) {
+	t.Helper()
+	dir := t.TempDir()
+	storage, serr := NewStorage(dir, "hostname", time.Minute)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	fs := &faultyFS{err: err, faults: faults}
+	storage.createTemp = fs.createTemp
+
+	delay := storageWriteRetryDelay
+	storageWriteRetryDelay = 0
+	t.Cleanup(func() { storageWriteRetryDelay = delay })
+	return storage, fs
+}
+
+// tempFiles returns the names of the temporary files left in the directory
+// of the given artifact.
+func tempFiles(t *testing.T, storage *Storage, artifact sourcev1.Artifact) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(storage.LocalPath(artifact)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Name() != filepath.Base(artifact.Path) {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestStorage_Archive_retry(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the checksum of the archive written without faults
+	storage, _ := newFaultyStorage(t, syscall.ESTALE, 0)
+	want := storage.NewArtifactFor(sourcev1.GitRepositoryKind, &metav1.ObjectMeta{Name: "want", Namespace: "default"}, "rev", "rev.tar.gz")
+	if err := storage.MkdirAll(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Archive(&want, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		err        error
+		faults     int
+		wantWrites int
+		wantErr    error
+		wantReason string
+	}{
+		{name: "stale file handle", err: syscall.ESTALE, faults: 1, wantWrites: 2},
+		{name: "interrupted system call", err: syscall.EINTR, faults: 2, wantWrites: 3},
+		{name: "I/O error", err: syscall.EIO, faults: 3, wantWrites: 4},
+		{name: "retries exhausted", err: syscall.ESTALE, faults: 4, wantWrites: 4,
+			wantErr: syscall.ESTALE, wantReason: sourcev1.StorageOperationFailedReason},
+		{name: "no space left", err: syscall.ENOSPC, faults: 1, wantWrites: 1,
+			wantErr: syscall.ENOSPC, wantReason: sourcev1.StorageFullReason},
+		{name: "read-only file system", err: syscall.EROFS, faults: 1, wantWrites: 1,
+			wantErr: syscall.EROFS, wantReason: sourcev1.StorageReadOnlyReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage, fs := newFaultyStorage(t, tt.err, tt.faults)
+			artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}, "rev", "rev.tar.gz")
+			if err := storage.MkdirAll(artifact); err != nil {
+				t.Fatal(err)
+			}
+			retries := testutil.ToFloat64(storageWriteRetriesCounter)
+
+			err := storage.Archive(&artifact, src, nil)
+			if fs.writes != tt.wantWrites {
+				t.Errorf("expected %d writes, got %d", tt.wantWrites, fs.writes)
+			}
+			if got := testutil.ToFloat64(storageWriteRetriesCounter) - retries; got != float64(tt.wantWrites-1) {
+				t.Errorf("expected %d retries to be counted, got %v", tt.wantWrites-1, got)
+			}
+			if names := tempFiles(t, storage, artifact); len(names) != 0 {
+				t.Errorf("expected no temporary files to be left, got %v", names)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				if reason := storageFailureReason(fmt.Errorf("storage archive error: %w", err)); reason != tt.wantReason {
+					t.Errorf("expected reason %s, got %s", tt.wantReason, reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the write to be retried, got %v", err)
+			}
+			if artifact.Checksum != want.Checksum {
+				t.Errorf("expected the checksum of the archive without faults %s, got %s", want.Checksum, artifact.Checksum)
+			}
+			fi, err := os.Stat(storage.LocalPath(artifact))
+			if err != nil {
+				t.Fatalf("expected the artifact to be written: %v", err)
+			}
+			// the size is the one of the written file, not of the failed writes
+			if artifact.Size == nil || *artifact.Size != fi.Size() || *artifact.Size != *want.Size {
+				t.Errorf("expected the size of the artifact file %d, got %v", fi.Size(), artifact.Size)
+			}
+		})
+	}
+}
+
+func TestStorage_Copy_retry(t *testing.T) {
+	content := strings.Repeat("chart", 1<<14)
+
+	t.Run("seekable reader", func(t *testing.T) {
+		storage, fs := newFaultyStorage(t, syscall.ESTALE, 2)
+		artifact := storage.NewArtifactFor(sourcev1.HelmChartKind, &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}, "1.0.0", "podinfo-1.0.0.tgz")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		// the content is copied from the offset of the reader
+		reader := bytes.NewReader([]byte("skip" + content))
+		if _, err := reader.Seek(4, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storage.Copy(&artifact, reader); err != nil {
+			t.Fatalf("expected the copy to be retried, got %v", err)
+		}
+		if fs.writes != 3 {
+			t.Errorf("expected the copy to be retried twice, got %d writes", fs.writes)
+		}
+		b, err := os.ReadFile(storage.LocalPath(artifact))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("expected the content to be copied, got %d bytes", len(b))
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		storage, _ := newFaultyStorage(t, syscall.EIO, 1)
+		artifact := storage.NewArtifactFor(sourcev1.HelmChartKind, &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}, "1.0.0", "podinfo-1.0.0.tgz")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(t.TempDir(), "podinfo-1.0.0.tgz")
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storage.CopyFromPath(&artifact, p); err != nil {
+			t.Fatalf("expected the copy to be retried, got %v", err)
+		}
+		if b, err := os.ReadFile(storage.LocalPath(artifact)); err != nil || string(b) != content {
+			t.Errorf("expected the content to be copied, got %d bytes, %v", len(b), err)
+		}
+	})
+
+	t.Run("reader without seeker", func(t *testing.T) {
+		storage, fs := newFaultyStorage(t, syscall.ESTALE, 1)
+		artifact := storage.NewArtifactFor(sourcev1.HelmChartKind, &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}, "1.0.0", "podinfo-1.0.0.tgz")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+
+		err := storage.Copy(&artifact, io.MultiReader(strings.NewReader(content)))
+		if !errors.Is(err, syscall.ESTALE) {
+			t.Fatalf("expected the copy not to be retried, got %v", err)
+		}
+		if fs.writes != 1 {
+			t.Errorf("expected 1 write, got %d", fs.writes)
+		}
+	})
+
+	t.Run("retries disabled", func(t *testing.T) {
+		storage, fs := newFaultyStorage(t, syscall.ESTALE, 1)
+		storage.WriteRetries = 0
+		artifact := storage.NewArtifactFor(sourcev1.HelmChartKind, &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}, "1.0.0", "podinfo-1.0.0.tgz")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storage.Copy(&artifact, strings.NewReader(content)); !errors.Is(err, syscall.ESTALE) {
+			t.Fatalf("expected the copy not to be retried, got %v", err)
+		}
+		if fs.writes != 1 {
+			t.Errorf("expected 1 write, got %d", fs.writes)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/fluxcd/source-controller/internal/fips"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+const (
+	// s3LinkTargetMetadata is the user metadata of the objects of links with
+	// the path of the artifact they point to.
+	s3LinkTargetMetadata = "Flux-Link-Target"
+
+	// maxS3PresignExpiry is the maximum expiry of a presigned URL.
+	maxS3PresignExpiry = 7 * 24 * time.Hour
+
+	// s3PresignDateFormat is the format of the signing time of a presigned
+	// URL, in its X-Amz-Date query parameter.
+	s3PresignDateFormat = "20060102T150405Z"
+)
+
+// S3BackendOptions are the options of an S3Backend.
+type S3BackendOptions struct {
+	// Endpoint is the host, and optional port, of the S3 compatible service.
+	Endpoint string
+	// Bucket is the name of the bucket the artifacts are stored in.
+	Bucket string
+	// Region is the region of the bucket.
+	Region string
+	// Insecure connects to the Endpoint over plain HTTP.
+	Insecure bool
+	// URL is the base URL of a gateway that serves the objects of the
+	// bucket, e.g. a CDN. When empty, the artifact URLs are presigned.
+	URL string
+	// PresignExpiry is the expiry of the presigned artifact URLs.
+	PresignExpiry time.Duration
+}
+
+// S3Backend is a StorageBackend that stores the artifacts in an S3 compatible bucket. The credentials are retrieved
+// from the environment, the shared credentials file, or the IAM role of the controller.
+//
+// The presigned URLs of the objects are kept until less than half of their expiry remains, for the URLs in the status
+// of the sources not to change on every reconciliation.
+type S3Backend struct {
+	client        *minio.Client
+	bucket        string
+	baseURL       *url.URL
+	presignExpiry time.Duration
+
+	mu        sync.Mutex
+	presigned map[string]presignedURL
+}
+
+// presignedURL is a presigned URL of an object, and the time at which it expires.
+type presignedURL struct {
+	url     string
+	expires time.Time
+}
+
+// NewS3Backend creates the S3Backend with the given options.
+func NewS3Backend(opts S3BackendOptions) (*S3Backend, error) {
+	if opts.Endpoint == "" || opts.Bucket == "" {
+		return nil, fmt.Errorf("the endpoint and bucket of the S3 storage backend are required")
+	}
+	b := &S3Backend{
+		bucket:        opts.Bucket,
+		presignExpiry: opts.PresignExpiry,
+		presigned:     map[string]presignedURL{},
+	}
+	if opts.URL != "" {
+		u, err := url.Parse(strings.TrimSuffix(opts.URL, "/"))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 storage backend URL '%s'", opts.URL)
+		}
+		b.baseURL = u
+	} else if opts.PresignExpiry <= 0 || opts.PresignExpiry > maxS3PresignExpiry {
+		return nil, fmt.Errorf("invalid S3 storage backend presign expiry '%s', must be at most %s", opts.PresignExpiry, maxS3PresignExpiry)
+	}
+
+	httpTransport, err := minio.DefaultTransport(!opts.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	httpTransport.DialContext = transport.NewDialer().DialContext
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{Client: &http.Client{Transport: transport.WithUserAgent(transport.NewControllerTransport())}},
+		}),
+		Secure:    !opts.Insecure,
+		Region:    opts.Region,
+		Transport: transport.WithUserAgent(httpTransport),
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.client = client
+	return b, nil
+}
+
+// Upload implements StorageBackend. The content of the object is verified by the service against its MD5 checksum,
+// except in FIPS mode, in which it is only protected by TLS, or by the SHA256 of the signature of the requests over
+// HTTP.
+func (b *S3Backend) Upload(ctx context.Context, object BackendObject, localPath string) error {
+	opts := minio.PutObjectOptions{
+		ContentType:     object.ContentType,
+		ContentEncoding: object.ContentEncoding,
+		SendContentMd5:  !fips.Enabled(),
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = "application/octet-stream"
+	}
+	if object.LinkTarget != "" {
+		opts.UserMetadata = map[string]string{s3LinkTargetMetadata: object.LinkTarget}
+	}
+	_, err := b.client.FPutObject(ctx, b.bucket, object.Path, localPath, opts)
+	return err
+}
+
+// Download implements StorageBackend.
+func (b *S3Backend) Download(ctx context.Context, p string, w io.Writer) error {
+	obj, err := b.client.GetObject(ctx, b.bucket, p, minio.GetObjectOptions{})
+	if err != nil {
+		return b.objectError(p, err)
+	}
+	defer obj.Close()
+	if _, err := io.Copy(w, obj); err != nil {
+		return b.objectError(p, err)
+	}
+	return nil
+}
+
+// List implements StorageBackend. The metadata of every object is retrieved to tell the links from the artifacts, as
+// not all services list the user metadata of objects. The modification time is the one of the listing, which is more
+// precise than the one of the metadata.
+func (b *S3Backend) List(ctx context.Context, dir string) ([]BackendObject, error) {
+	var objects []BackendObject
+	for info := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: strings.TrimSuffix(dir, "/") + "/"}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		if strings.HasSuffix(info.Key, "/") {
+			continue
+		}
+		stat, err := b.client.StatObject(ctx, b.bucket, info.Key, minio.StatObjectOptions{})
+		if err != nil {
+			if os.IsNotExist(b.objectError(info.Key, err)) {
+				continue
+			}
+			return nil, err
+		}
+		objects = append(objects, BackendObject{
+			Path:            info.Key,
+			Size:            stat.Size,
+			ModTime:         info.LastModified,
+			ContentType:     stat.ContentType,
+			ContentEncoding: stat.Metadata.Get("Content-Encoding"),
+			LinkTarget:      stat.UserMetadata[s3LinkTargetMetadata],
+		})
+	}
+	return objects, nil
+}
+
+// Remove implements StorageBackend.
+func (b *S3Backend) Remove(ctx context.Context, p string) error {
+	b.mu.Lock()
+	delete(b.presigned, p)
+	b.mu.Unlock()
+	return b.client.RemoveObject(ctx, b.bucket, p, minio.RemoveObjectOptions{})
+}
+
+// URL implements StorageBackend. Without a gateway URL, it returns a presigned URL that expires after the presign
+// expiry. The same URL is returned until less than half of its expiry remains.
+func (b *S3Backend) URL(p string) string {
+	if b.baseURL != nil {
+		u := *b.baseURL
+		u.Path = path.Join(u.Path, p)
+		return u.String()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if presigned, ok := b.presigned[p]; ok && b.fresh(presigned.expires) {
+		return presigned.url
+	}
+	now := time.Now()
+	u, err := b.client.PresignedGetObject(context.Background(), b.bucket, p, b.presignExpiry, nil)
+	if err != nil {
+		// The URL of the object, which is only accessible if the bucket
+		// allows anonymous reads.
+		u := *b.client.EndpointURL()
+		u.Path = path.Join("/", b.bucket, p)
+		return u.String()
+	}
+	b.presigned[p] = presignedURL{url: u.String(), expires: now.Add(b.presignExpiry)}
+	return u.String()
+}
+
+// Keep implements expiringURLBackend. A presigned URL is kept if it expires after more than half of the presign
+// expiry, and replaces any other URL of its object, e.g. presigned after the controller restarted, as it is the URL
+// advertised in the status of a source.
+func (b *S3Backend) Keep(URL string) bool {
+	if b.baseURL != nil {
+		return true
+	}
+	u, err := url.Parse(URL)
+	if err != nil {
+		return false
+	}
+	p := urlArtifactPath(u)
+	if p == "" {
+		return false
+	}
+
+	date, err := time.Parse(s3PresignDateFormat, u.Query().Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	seconds, err := strconv.Atoi(u.Query().Get("X-Amz-Expires"))
+	if err != nil {
+		return false
+	}
+	expires := date.Add(time.Duration(seconds) * time.Second)
+	if !b.fresh(expires) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.presigned[p] = presignedURL{url: URL, expires: expires}
+	return true
+}
+
+// RenewInterval implements expiringURLBackend. The presigned URLs are renewed every quarter of the presign expiry, at
+// the latest when a quarter of their expiry remains.
+func (b *S3Backend) RenewInterval() time.Duration {
+	if b.baseURL != nil {
+		return 0
+	}
+	return b.presignExpiry / 4
+}
+
+// fresh returns true if a presigned URL that expires at the given time is not renewed yet.
+func (b *S3Backend) fresh(expires time.Time) bool {
+	return time.Until(expires) > b.presignExpiry/2
+}
+
+// objectError returns an error wrapping os.ErrNotExist if the given error is returned for an object that does not
+// exist, and the given error otherwise.
+func (b *S3Backend) objectError(p string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return &os.PathError{Op: "get", Path: p, Err: os.ErrNotExist}
+	}
+	return err
+}
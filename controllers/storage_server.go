@@ -0,0 +1,214 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+)
+
+// maxCachedDigests is the maximum number of file digests cached by the ArtifactServer.
+const maxCachedDigests = 4096
+
+// ArtifactServer serves the files in the storage over HTTP. Files are served with an ETag header with their checksum,
+// and a Last-Modified header with their modification time, so that clients can make conditional GET and HEAD
+// requests with If-None-Match and If-Modified-Since headers, which are answered with a 304 Not Modified response if
+// the file is unchanged. Downloads can be resumed with a request for a single byte range, which is answered with a 206
+// Partial Content response, also in combination with an If-Range header. Paths that do not resolve to a path in the
+// storage are not found.
+type ArtifactServer struct {
+	// root is the base path of the storage, with all symlinks evaluated.
+	root    string
+	handler http.Handler
+	dirs    http.Handler
+
+	mu      sync.Mutex
+	digests map[string]fileDigest
+
+	// downloads holds a token for every download in progress, if the
+	// number of concurrent downloads is limited.
+	downloads chan struct{}
+	// bandwidth limits the aggregate bandwidth of all downloads, if set.
+	bandwidth *rate.Limiter
+}
+
+// fileDigest is the checksum of a file with the given size and modification time.
+type fileDigest struct {
+	size     int64
+	modTime  time.Time
+	checksum string
+}
+
+// NewArtifactServer creates the ArtifactServer for the storage at the given base path.
+func NewArtifactServer(basePath string) (*ArtifactServer, error) {
+	root, err := filepath.EvalSymlinks(basePath)
+	if err != nil {
+		return nil, err
+	}
+	s := &ArtifactServer{
+		root:    root,
+		dirs:    http.FileServer(http.Dir(root)),
+		digests: map[string]fileDigest{},
+	}
+	s.handler = ArtifactHeaders(http.HandlerFunc(s.serveFile))
+	return s, nil
+}
+
+// NewArtifactServerTLSConfig returns the tls.Config for serving artifacts over HTTPS with the certificate and key at
+// the given paths, and the certwatcher.CertWatcher that reloads them when they change, which must be started. The
+// reloaded certificate is used for new connections, without closing the connections of downloads in progress. If the
+// given client CA path is not empty, clients must authenticate with a certificate signed by the CA.
+func NewArtifactServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, *certwatcher.CertWatcher, error) {
+	watcher, err := certwatcher.New(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: watcher.GetCertificate,
+	}
+	if clientCAFile != "" {
+		b, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, nil, fmt.Errorf("no certificates found in client CA file '%s'", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, watcher, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *ArtifactServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	release, ok := s.acquireDownload()
+	if !ok {
+		rejectDownload(w)
+		return
+	}
+	defer release()
+	if s.bandwidth != nil {
+		w = &bandwidthResponseWriter{ResponseWriter: w, request: r, limiter: s.bandwidth}
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// serveFile serves the file at the path of the request, after resolving the symlinks of the path, e.g. the 'latest'
+// symlink of a source. The file is opened once, so that its ETag matches the served content while the symlink is
+// updated. Anything but a regular file is served by the http.FileServer of the storage.
+func (s *ArtifactServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	localPath := filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	resolved, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		s.dirs.ServeHTTP(w, r)
+		return
+	}
+	if !s.contains(resolved) {
+		// A symlink pointing outside of the storage is served as if it
+		// does not exist, without disclosing its target.
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		s.dirs.ServeHTTP(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		s.dirs.ServeHTTP(w, r)
+		return
+	}
+	checksum, err := s.checksum(resolved, fi, f)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, checksum))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if strings.Contains(r.Header.Get("Range"), ",") {
+		// Requests for multiple ranges are served with the full content,
+		// instead of a multipart response.
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, path.Base(r.URL.Path), fi.ModTime(), f)
+}
+
+// contains returns if the given path, with all symlinks evaluated, is in the storage.
+func (s *ArtifactServer) contains(p string) bool {
+	return p == s.root || strings.HasPrefix(p, s.root+string(filepath.Separator))
+}
+
+// checksum returns the checksum of the given file at the given path with the given os.FileInfo, and seeks the file
+// back to its start. The checksum is cached until the size or modification time of the file changes.
+func (s *ArtifactServer) checksum(p string, fi os.FileInfo, f io.ReadSeeker) (string, error) {
+	s.mu.Lock()
+	d, ok := s.digests[p]
+	s.mu.Unlock()
+	if ok && d.size == fi.Size() && d.modTime.Equal(fi.ModTime()) {
+		return d.checksum, nil
+	}
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	d = fileDigest{size: fi.Size(), modTime: fi.ModTime(), checksum: fmt.Sprintf("%x", h.Sum(nil))}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.digests) >= maxCachedDigests {
+		// Drop the digests of files that have been garbage collected, or
+		// start over if the storage holds more files than the cache.
+		for k := range s.digests {
+			if _, err := os.Stat(k); err != nil {
+				delete(s.digests, k)
+			}
+		}
+		if len(s.digests) >= maxCachedDigests {
+			s.digests = map[string]fileDigest{}
+		}
+	}
+	s.digests[p] = d
+	return d.checksum, nil
+}
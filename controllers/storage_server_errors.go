@@ -0,0 +1,303 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kuberecorder "k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/fluxcd/pkg/runtime/events"
+)
+
+const (
+	// DefaultArtifactErrorThreshold is the default number of error
+	// responses for the advertised URLs of a source within the window, at
+	// which the source is alerted.
+	DefaultArtifactErrorThreshold = 10
+	// DefaultArtifactErrorWindow is the default window in which the error
+	// responses for the advertised URLs of a source are counted.
+	DefaultArtifactErrorWindow = 5 * time.Minute
+
+	// maxArtifactErrorAlerts is the number of alerts queued for the
+	// ArtifactErrorMonitor, above which alerts are dropped.
+	maxArtifactErrorAlerts = 64
+)
+
+var (
+	// artifactURLErrorsCounter counts the error responses of the artifact
+	// server for the advertised URLs of the sources.
+	artifactURLErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_artifact_url_errors_total",
+			Help: "The number of error responses of the artifact server for the advertised artifact URLs of a source.",
+		},
+		[]string{"kind", "name", "namespace"},
+	)
+	// artifactURLAlertsCounter counts the times the error responses for the
+	// advertised URLs of a source reached the threshold within the window.
+	artifactURLAlertsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_artifact_url_error_alerts_total",
+			Help: "The number of times the error responses for the advertised artifact URLs of a source reached the threshold within the window.",
+		},
+		[]string{"kind", "name", "namespace"},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(artifactURLErrorsCounter, artifactURLAlertsCounter)
+}
+
+// advertisedSource is a source by kind and namespaced name.
+type advertisedSource struct {
+	kind string
+	types.NamespacedName
+}
+
+// advertisedArtifacts are the URL paths advertised in the status of the
+// sources, the paths of their artifact and of the link to it, by path and by
+// source. It is maintained by the reconcilers, to map the requests to the
+// artifact server back to the sources.
+var advertisedArtifacts = struct {
+	sync.Mutex
+	byPath   map[string]advertisedSource
+	bySource map[advertisedSource][]string
+}{byPath: map[string]advertisedSource{}, bySource: map[advertisedSource][]string{}}
+
+// advertiseArtifact records the URL paths advertised in the status of the
+// given source of the given kind, replacing the paths it advertised before.
+func advertiseArtifact(kind string, source artifactSource) {
+	key := advertisedSource{kind: kind, NamespacedName: types.NamespacedName{Namespace: source.GetNamespace(), Name: source.GetName()}}
+	var paths []string
+	if artifact := source.GetArtifact(); artifact != nil {
+		for _, rawURL := range []string{artifact.URL, sourceStatusURL(source)} {
+			if u, err := url.Parse(rawURL); err == nil && rawURL != "" {
+				paths = append(paths, u.Path)
+			}
+		}
+	}
+
+	advertisedArtifacts.Lock()
+	defer advertisedArtifacts.Unlock()
+	for _, p := range advertisedArtifacts.bySource[key] {
+		delete(advertisedArtifacts.byPath, p)
+	}
+	if len(paths) == 0 {
+		delete(advertisedArtifacts.bySource, key)
+		return
+	}
+	for _, p := range paths {
+		advertisedArtifacts.byPath[p] = key
+	}
+	advertisedArtifacts.bySource[key] = paths
+}
+
+// forgetAdvertisedArtifact forgets the URL paths advertised by the source of
+// the given kind with the given namespaced name, and its metrics.
+func forgetAdvertisedArtifact(kind string, name types.NamespacedName) {
+	key := advertisedSource{kind: kind, NamespacedName: name}
+	advertisedArtifacts.Lock()
+	for _, p := range advertisedArtifacts.bySource[key] {
+		delete(advertisedArtifacts.byPath, p)
+	}
+	delete(advertisedArtifacts.bySource, key)
+	advertisedArtifacts.Unlock()
+
+	artifactURLErrorsCounter.DeleteLabelValues(kind, name.Name, name.Namespace)
+	artifactURLAlertsCounter.DeleteLabelValues(kind, name.Name, name.Namespace)
+}
+
+// advertisingSource returns the source advertising the given URL path, if
+// any.
+func advertisingSource(urlPath string) (advertisedSource, bool) {
+	advertisedArtifacts.Lock()
+	defer advertisedArtifacts.Unlock()
+	source, ok := advertisedArtifacts.byPath[urlPath]
+	return source, ok
+}
+
+// ArtifactErrorMonitor counts the error responses of the artifact server for
+// the URLs advertised in the status of the sources, so that a source of
+// which the consumers fail to fetch the artifact is noticed on the source
+// side. Once the error responses for the URLs of a source reach the
+// Threshold within the Window, a warning event is emitted for the source and
+// the alerts metric of the source is incremented, at most once per Window.
+// The requests for the paths that no source advertises are not counted.
+// A nil ArtifactErrorMonitor counts nothing.
+type ArtifactErrorMonitor struct {
+	client.Client
+	EventRecorder         kuberecorder.EventRecorder
+	ExternalEventRecorder *events.Recorder
+
+	// Threshold is the number of error responses within the Window at which
+	// a source is alerted.
+	Threshold int
+	// Window is the window in which the error responses are counted.
+	Window time.Duration
+
+	mu     sync.Mutex
+	errors map[advertisedSource]*artifactErrors
+	alerts chan artifactErrorAlert
+	now    func() time.Time
+}
+
+// artifactErrors are the error responses for the URLs of a source within
+// the window starting at start.
+type artifactErrors struct {
+	start   time.Time
+	count   int
+	alerted bool
+}
+
+// artifactErrorAlert is the alert of a source of which the error responses
+// reached the threshold, with the last error response.
+type artifactErrorAlert struct {
+	source advertisedSource
+	path   string
+	code   int
+	count  int
+}
+
+// NewArtifactErrorMonitor returns an ArtifactErrorMonitor with the given
+// threshold and window, which emits the events of its alerts once started.
+func NewArtifactErrorMonitor(threshold int, window time.Duration) *ArtifactErrorMonitor {
+	return &ArtifactErrorMonitor{
+		Threshold: threshold,
+		Window:    window,
+		errors:    map[advertisedSource]*artifactErrors{},
+		alerts:    make(chan artifactErrorAlert, maxArtifactErrorAlerts),
+		now:       time.Now,
+	}
+}
+
+// Handler returns the given handler of the artifacts, of which the error
+// responses for the advertised URLs of the sources are counted.
+func (m *ArtifactErrorMonitor) Handler(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &accessLogResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		if rw.code >= http.StatusBadRequest {
+			m.record(r.URL.Path, rw.code)
+		}
+	})
+}
+
+// record counts the error response with the given code for the given URL
+// path, and queues an alert for its source if the errors reached the
+// threshold within the window.
+func (m *ArtifactErrorMonitor) record(urlPath string, code int) {
+	source, ok := advertisingSource(urlPath)
+	if !ok {
+		return
+	}
+	artifactURLErrorsCounter.WithLabelValues(source.kind, source.Name, source.Namespace).Inc()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	e, ok := m.errors[source]
+	if !ok || now.Sub(e.start) >= m.Window {
+		// drop the errors of the other sources of which the window passed
+		for s, e := range m.errors {
+			if now.Sub(e.start) >= m.Window {
+				delete(m.errors, s)
+			}
+		}
+		e = &artifactErrors{start: now}
+		m.errors[source] = e
+	}
+	e.count++
+	if e.alerted || e.count < m.Threshold {
+		return
+	}
+	e.alerted = true
+	artifactURLAlertsCounter.WithLabelValues(source.kind, source.Name, source.Namespace).Inc()
+	select {
+	case m.alerts <- artifactErrorAlert{source: source, path: urlPath, code: code, count: e.count}:
+	default:
+		// the events are not worth blocking the downloads for, the metric
+		// records the alert nonetheless
+	}
+}
+
+// Start emits the events of the alerts until the given context is done, it
+// implements manager.Runnable.
+func (m *ArtifactErrorMonitor) Start(ctx context.Context) error {
+	for {
+		select {
+		case alert := <-m.alerts:
+			m.event(ctx, alert)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the errors
+// are counted by every replica that serves the artifacts.
+func (m *ArtifactErrorMonitor) NeedLeaderElection() bool {
+	return false
+}
+
+// event emits a warning Kubernetes event for the source of the given alert,
+// and forwards the event to notification controller if configured.
+func (m *ArtifactErrorMonitor) event(ctx context.Context, alert artifactErrorAlert) {
+	log := ctrl.LoggerFrom(ctx).WithName("artifact-error-monitor")
+
+	source := newBundledSource(alert.source.kind)
+	if source == nil {
+		return
+	}
+	if err := m.Get(ctx, alert.source.NamespacedName, source); err != nil {
+		log.Error(err, "unable to get source of failing artifact URL", "kind", alert.source.kind,
+			"name", alert.source.Name, "namespace", alert.source.Namespace)
+		return
+	}
+	msg := fmt.Sprintf("the artifact server answered %d requests for the artifact URLs of the source with an error within %s, the last one for '%s' with '%d %s'",
+		alert.count, m.Window.String(), alert.path, alert.code, http.StatusText(alert.code))
+	log.Info(msg, "kind", alert.source.kind, "name", alert.source.Name, "namespace", alert.source.Namespace)
+
+	if m.EventRecorder != nil {
+		m.EventRecorder.Eventf(source, corev1.EventTypeWarning, events.EventSeverityError, msg)
+	}
+	if m.ExternalEventRecorder != nil {
+		objRef, err := reference.GetReference(m.Scheme(), source)
+		if err != nil {
+			log.Error(err, "unable to send event")
+			return
+		}
+		if err := m.ExternalEventRecorder.Eventf(*objRef, nil, events.EventSeverityError, events.EventSeverityError, msg); err != nil {
+			log.Error(err, "unable to send event")
+		}
+	}
+}
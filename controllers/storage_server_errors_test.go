@@ -0,0 +1,146 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestAdvertiseArtifact(t *testing.T) {
+	repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+	repository.Status.Artifact = &sourcev1.Artifact{
+		Path: "gitrepository/default/podinfo/a.tar.gz",
+		URL:  "http://source-controller.flux-system/gitrepository/default/podinfo/a.tar.gz",
+	}
+	repository.Status.URL = "http://source-controller.flux-system/gitrepository/default/podinfo/latest.tar.gz"
+	name := types.NamespacedName{Namespace: "default", Name: "podinfo"}
+	defer forgetAdvertisedArtifact(sourcev1.GitRepositoryKind, name)
+
+	advertiseArtifact(sourcev1.GitRepositoryKind, repository)
+	for _, p := range []string{"/gitrepository/default/podinfo/a.tar.gz", "/gitrepository/default/podinfo/latest.tar.gz"} {
+		if s, ok := advertisingSource(p); !ok || s.NamespacedName != name || s.kind != sourcev1.GitRepositoryKind {
+			t.Errorf("expected %s to be advertised by the repository, got %v", p, s)
+		}
+	}
+
+	// the artifact of the next revision replaces the previous one
+	repository.Status.Artifact.URL = "http://source-controller.flux-system/gitrepository/default/podinfo/b.tar.gz"
+	advertiseArtifact(sourcev1.GitRepositoryKind, repository)
+	if _, ok := advertisingSource("/gitrepository/default/podinfo/a.tar.gz"); ok {
+		t.Error("expected the previous artifact not to be advertised")
+	}
+	if _, ok := advertisingSource("/gitrepository/default/podinfo/b.tar.gz"); !ok {
+		t.Error("expected the artifact to be advertised")
+	}
+
+	forgetAdvertisedArtifact(sourcev1.GitRepositoryKind, name)
+	if _, ok := advertisingSource("/gitrepository/default/podinfo/latest.tar.gz"); ok {
+		t.Error("expected the artifact of the deleted repository not to be advertised")
+	}
+}
+
+func TestArtifactErrorMonitor(t *testing.T) {
+	bucket := &sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"}}
+	bucket.Status.Artifact = &sourcev1.Artifact{URL: "http://source-controller.flux-system/bucket/default/bucket/a.tar.gz"}
+	advertiseArtifact(sourcev1.BucketKind, bucket)
+	defer forgetAdvertisedArtifact(sourcev1.BucketKind, types.NamespacedName{Namespace: "default", Name: "bucket"})
+
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	m := NewArtifactErrorMonitor(3, time.Minute)
+	m.Client = fake.NewClientBuilder().WithScheme(scheme).WithObjects(bucket).Build()
+	m.EventRecorder = recorder
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	handler := m.Handler(http.NotFoundHandler())
+	get := func(p string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+	errors := func() float64 {
+		return testutil.ToFloat64(artifactURLErrorsCounter.WithLabelValues(sourcev1.BucketKind, "bucket", "default"))
+	}
+	alerts := func() float64 {
+		return testutil.ToFloat64(artifactURLAlertsCounter.WithLabelValues(sourcev1.BucketKind, "bucket", "default"))
+	}
+
+	// the paths that no source advertises are not counted
+	get("/bucket/default/bucket/b.tar.gz")
+	get("/bucket/default/bucket/a.tar.gz")
+	get("/bucket/default/bucket/a.tar.gz")
+	if got := errors(); got != 2 {
+		t.Errorf("expected 2 errors, got %v", got)
+	}
+	if got := alerts(); got != 0 {
+		t.Errorf("expected no alert below the threshold, got %v", got)
+	}
+
+	// the source is alerted once within the window
+	get("/bucket/default/bucket/a.tar.gz")
+	get("/bucket/default/bucket/a.tar.gz")
+	if got := alerts(); got != 1 {
+		t.Errorf("expected 1 alert, got %v", got)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Start(ctx)
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "Warning") || !strings.Contains(event, "/bucket/default/bucket/a.tar.gz") ||
+			!strings.Contains(event, "404 Not Found") {
+			t.Errorf("unexpected event: %s", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an event for the source")
+	}
+
+	// the errors are counted again in the next window
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		get("/bucket/default/bucket/a.tar.gz")
+	}
+	if got := alerts(); got != 2 {
+		t.Errorf("expected 2 alerts, got %v", got)
+	}
+}
+
+func TestArtifactErrorMonitor_nil(t *testing.T) {
+	var m *ArtifactErrorMonitor
+	next := http.NotFoundHandler()
+	rec := httptest.NewRecorder()
+	m.Handler(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected the response of the handler, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// downloadRetryAfter is the Retry-After of the responses to requests
+	// rejected by the concurrency limit of the ArtifactServer.
+	downloadRetryAfter = 5 * time.Second
+
+	// maxBandwidthBurst is the maximum number of bytes written at once by a
+	// download limited by the bandwidth limit of the ArtifactServer.
+	maxBandwidthBurst = 256 << 10
+)
+
+var (
+	// downloadsInFlightGauge counts the artifact downloads in progress.
+	downloadsInFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gotk_artifact_downloads_in_flight",
+			Help: "The number of artifact downloads in progress.",
+		},
+	)
+	// downloadsThrottledCounter counts the artifact downloads that were
+	// rejected by the concurrency limit, or delayed by the bandwidth limit.
+	downloadsThrottledCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_artifact_downloads_throttled_total",
+			Help: "The number of artifact downloads rejected by the concurrency limit or delayed by the bandwidth limit.",
+		},
+		[]string{"limit"},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(downloadsInFlightGauge, downloadsThrottledCounter)
+}
+
+// SetLimits sets the maximum number of concurrent downloads, and the maximum aggregate bandwidth in bytes per second
+// of all downloads. A limit of zero means unlimited. Requests exceeding the concurrency limit are answered with a
+// 503 Service Unavailable response with a Retry-After header. It must be called before the ArtifactServer serves
+// requests.
+func (s *ArtifactServer) SetLimits(maxDownloads int, maxBandwidth int64) {
+	s.downloads = nil
+	if maxDownloads > 0 {
+		s.downloads = make(chan struct{}, maxDownloads)
+	}
+	s.bandwidth = nil
+	if maxBandwidth > 0 {
+		burst := maxBandwidth
+		if burst > maxBandwidthBurst {
+			burst = maxBandwidthBurst
+		}
+		s.bandwidth = rate.NewLimiter(rate.Limit(maxBandwidth), int(burst))
+	}
+}
+
+// acquireDownload returns if a download may start within the concurrency limit, and if so counts it as in flight
+// until the returned function is called.
+func (s *ArtifactServer) acquireDownload() (func(), bool) {
+	if s.downloads != nil {
+		select {
+		case s.downloads <- struct{}{}:
+		default:
+			downloadsThrottledCounter.WithLabelValues("concurrency").Inc()
+			return nil, false
+		}
+	}
+	downloadsInFlightGauge.Inc()
+	return func() {
+		downloadsInFlightGauge.Dec()
+		if s.downloads != nil {
+			<-s.downloads
+		}
+	}, true
+}
+
+// rejectDownload answers a request rejected by the concurrency limit.
+func rejectDownload(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(downloadRetryAfter.Seconds())))
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// bandwidthResponseWriter is a http.ResponseWriter that limits the rate at which the content is written to the
+// bandwidth shared by all downloads.
+type bandwidthResponseWriter struct {
+	http.ResponseWriter
+	request   *http.Request
+	limiter   *rate.Limiter
+	throttled bool
+}
+
+func (w *bandwidthResponseWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if n > w.limiter.Burst() {
+			n = w.limiter.Burst()
+		}
+		if err := w.wait(n); err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// wait blocks until the given number of bytes may be written, or the request is done. The download is counted as
+// throttled the first time it has to wait.
+func (w *bandwidthResponseWriter) wait(n int) error {
+	r := w.limiter.ReserveN(time.Now(), n)
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if !w.throttled {
+		w.throttled = true
+		downloadsThrottledCounter.WithLabelValues("bandwidth").Inc()
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-w.request.Context().Done():
+		r.Cancel()
+		return w.request.Context().Err()
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+var (
+	// artifactRequestsCounter counts the requests to the artifact server.
+	artifactRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_artifact_requests_total",
+			Help: "The number of requests to the artifact server.",
+		},
+		[]string{"kind", "code"},
+	)
+	// artifactServedBytesCounter counts the bytes served by the artifact
+	// server.
+	artifactServedBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_artifact_served_bytes_total",
+			Help: "The total number of bytes of the responses of the artifact server.",
+		},
+		[]string{"kind", "code"},
+	)
+	// artifactRequestDurationHistogram observes the duration of the
+	// requests to the artifact server.
+	artifactRequestDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gotk_artifact_request_duration_seconds",
+			Help:    "The duration in seconds of the requests to the artifact server.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 4, 8),
+		},
+		[]string{"kind", "code"},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(artifactRequestsCounter, artifactServedBytesCounter, artifactRequestDurationHistogram)
+}
+
+// artifactKinds are the source kinds by the first element of the path of their artifacts.
+var artifactKinds = map[string]string{
+	strings.ToLower(sourcev1.BucketKind):         sourcev1.BucketKind,
+	strings.ToLower(sourcev1.GitRepositoryKind):  sourcev1.GitRepositoryKind,
+	strings.ToLower(sourcev1.HelmChartKind):      sourcev1.HelmChartKind,
+	strings.ToLower(sourcev1.HelmRepositoryKind): sourcev1.HelmRepositoryKind,
+	strings.ToLower(sourcev1.OCIRepositoryKind):  sourcev1.OCIRepositoryKind,
+}
+
+// artifactKind returns the source kind of the artifact at the given URL path, or 'unknown' for any other path. The
+// path itself is not used as a label, as the number of its values is unbounded.
+func artifactKind(urlPath string) string {
+	elem := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)[0]
+	if kind, ok := artifactKinds[elem]; ok {
+		return kind
+	}
+	return "unknown"
+}
+
+// ArtifactAccessLog records the requests to the given http.Handler in the request metrics of the artifact server,
+// labelled by the source kind and the status code, and logs them with the given logr.Logger at verbosity level 1.
+// The address and user agent of the client are only logged.
+func ArtifactAccessLog(next http.Handler, log logr.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &accessLogResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		duration := time.Since(start)
+
+		kind, code := artifactKind(r.URL.Path), strconv.Itoa(rw.code)
+		artifactRequestsCounter.WithLabelValues(kind, code).Inc()
+		artifactServedBytesCounter.WithLabelValues(kind, code).Add(float64(rw.bytes))
+		artifactRequestDurationHistogram.WithLabelValues(kind, code).Observe(duration.Seconds())
+
+		log.V(1).Info("served artifact request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"code", rw.code,
+			"bytes", rw.bytes,
+			"duration", duration.String(),
+			"remoteAddr", r.RemoteAddr,
+			"userAgent", r.UserAgent(),
+		)
+	})
+}
+
+// accessLogResponseWriter is a http.ResponseWriter that records the status code and the number of bytes of the
+// response.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	code        int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *accessLogResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom allows the underlying http.ResponseWriter to send the file with sendfile, it implements io.ReaderFrom.
+func (w *accessLogResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.wroteHeader = true
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.bytes += n
+	return n, err
+}
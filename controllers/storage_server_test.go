@@ -0,0 +1,776 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestArtifactServer(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	obj := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+	writeArtifact := func(t *testing.T, name, content string) sourcev1.Artifact {
+		t.Helper()
+		artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, obj, "revision", name)
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AtomicWriteFile(&artifact, strings.NewReader(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return artifact
+	}
+	gzArtifact := writeArtifact(t, "revision.tar.gz", "gzip artifact")
+	zstArtifact := writeArtifact(t, "revision.tar.zst", "zstd artifact")
+	if _, err := storage.Symlink(gzArtifact, "latest.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlink to a file outside of the storage
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(filepath.Dir(storage.LocalPath(gzArtifact)), "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewArtifactServer(storage.BasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(storage.LocalPath(gzArtifact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := fi.ModTime().UTC().Format(http.TimeFormat)
+	gzETag := fmt.Sprintf(`"%s"`, gzArtifact.Checksum)
+	zstETag := fmt.Sprintf(`"%s"`, zstArtifact.Checksum)
+	artifactPath := "/" + gzArtifact.Path
+	latestPath := "/" + filepath.ToSlash(filepath.Join(filepath.Dir(gzArtifact.Path), "latest.tar.gz"))
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       map[string]string
+		wantCode     int
+		wantBody     string
+		wantETag     string
+		wantEncoding string
+	}{
+		{name: "GET", method: http.MethodGet, path: artifactPath, wantCode: http.StatusOK, wantBody: "gzip artifact", wantETag: gzETag},
+		{name: "HEAD", method: http.MethodHead, path: artifactPath, wantCode: http.StatusOK, wantETag: gzETag},
+		{name: "GET latest symlink", method: http.MethodGet, path: latestPath, wantCode: http.StatusOK, wantBody: "gzip artifact", wantETag: gzETag},
+		{
+			name: "GET zstd", method: http.MethodGet, path: "/" + zstArtifact.Path,
+			wantCode: http.StatusOK, wantBody: "zstd artifact", wantETag: zstETag, wantEncoding: "zstd",
+		},
+		{
+			name: "If-None-Match matching", method: http.MethodGet, path: artifactPath,
+			header:   map[string]string{"If-None-Match": gzETag},
+			wantCode: http.StatusNotModified, wantETag: gzETag,
+		},
+		{
+			name: "If-None-Match matching latest symlink", method: http.MethodHead, path: latestPath,
+			header:   map[string]string{"If-None-Match": gzETag},
+			wantCode: http.StatusNotModified, wantETag: gzETag,
+		},
+		{
+			name: "If-None-Match matching zstd", method: http.MethodGet, path: "/" + zstArtifact.Path,
+			header:   map[string]string{"If-None-Match": zstETag},
+			wantCode: http.StatusNotModified, wantETag: zstETag,
+		},
+		{
+			name: "If-None-Match not matching", method: http.MethodGet, path: artifactPath,
+			header:   map[string]string{"If-None-Match": zstETag},
+			wantCode: http.StatusOK, wantBody: "gzip artifact", wantETag: gzETag,
+		},
+		{
+			name: "If-Modified-Since not modified", method: http.MethodGet, path: artifactPath,
+			header:   map[string]string{"If-Modified-Since": lastModified},
+			wantCode: http.StatusNotModified, wantETag: gzETag,
+		},
+		{
+			name: "If-Modified-Since modified", method: http.MethodGet, path: artifactPath,
+			header:   map[string]string{"If-Modified-Since": fi.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat)},
+			wantCode: http.StatusOK, wantBody: "gzip artifact", wantETag: gzETag,
+		},
+		{name: "not found", method: http.MethodGet, path: "/gitrepository/default/podinfo/missing.tar.gz", wantCode: http.StatusNotFound},
+		{name: "parent traversal", method: http.MethodGet, path: "/../../" + filepath.Base(outside), wantCode: http.StatusNotFound},
+		{
+			name: "symlink outside of the storage", method: http.MethodGet,
+			path:     "/" + filepath.ToSlash(filepath.Join(filepath.Dir(gzArtifact.Path), "escape")),
+			wantCode: http.StatusNotFound,
+		},
+		{name: "POST", method: http.MethodPost, path: artifactPath, wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := rec.Body.String(); tt.method != http.MethodHead && tt.wantBody != "" && got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if strings.Contains(rec.Body.String(), outside) || strings.Contains(rec.Body.String(), storage.BasePath) {
+				t.Errorf("body %q discloses a local path", rec.Body.String())
+			}
+
+			switch rec.Code {
+			case http.StatusOK:
+				if got := rec.Header().Get("Last-Modified"); got != lastModified {
+					t.Errorf("Last-Modified = %q, want %q", got, lastModified)
+				}
+				want := len(tt.wantBody)
+				if got, err := strconv.Atoi(rec.Header().Get("Content-Length")); (err != nil || got != want) && tt.method == http.MethodGet {
+					t.Errorf("Content-Length = %q, want %d", rec.Header().Get("Content-Length"), want)
+				}
+				if tt.method == http.MethodHead && rec.Body.Len() != 0 {
+					t.Errorf("HEAD response has a body of %d bytes", rec.Body.Len())
+				}
+			case http.StatusNotModified:
+				if rec.Body.Len() != 0 {
+					t.Errorf("304 response has a body of %d bytes", rec.Body.Len())
+				}
+			}
+		})
+	}
+
+	t.Run("HEAD Content-Length", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, artifactPath, nil))
+		if got := rec.Header().Get("Content-Length"); got != strconv.FormatInt(fi.Size(), 10) {
+			t.Errorf("Content-Length = %q, want %d", got, fi.Size())
+		}
+	})
+
+	t.Run("modified file", func(t *testing.T) {
+		modified := writeArtifact(t, "revision.tar.gz", "modified gzip artifact")
+		modTime := fi.ModTime().Add(time.Second)
+		if err := os.Chtimes(storage.LocalPath(modified), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, latestPath, nil)
+		req.Header.Set("If-None-Match", gzETag)
+		server.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+		if got, want := rec.Header().Get("ETag"), fmt.Sprintf(`"%s"`, modified.Checksum); got != want {
+			t.Errorf("ETag = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestArtifactServer_Range(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	obj := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+	artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, obj, "revision", "revision.tar.zst")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&artifact, strings.NewReader("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(storage.LocalPath(artifact))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewArtifactServer(storage.BasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := fmt.Sprintf(`"%s"`, artifact.Checksum)
+
+	tests := []struct {
+		name             string
+		header           map[string]string
+		wantCode         int
+		wantBody         string
+		wantContentRange string
+	}{
+		{name: "no range", wantCode: http.StatusOK, wantBody: "0123456789"},
+		{name: "range", header: map[string]string{"Range": "bytes=2-5"}, wantCode: http.StatusPartialContent, wantBody: "2345", wantContentRange: "bytes 2-5/10"},
+		{name: "open-ended range", header: map[string]string{"Range": "bytes=7-"}, wantCode: http.StatusPartialContent, wantBody: "789", wantContentRange: "bytes 7-9/10"},
+		{name: "suffix range", header: map[string]string{"Range": "bytes=-3"}, wantCode: http.StatusPartialContent, wantBody: "789", wantContentRange: "bytes 7-9/10"},
+		{name: "range ending past EOF", header: map[string]string{"Range": "bytes=8-100"}, wantCode: http.StatusPartialContent, wantBody: "89", wantContentRange: "bytes 8-9/10"},
+		{name: "range past EOF", header: map[string]string{"Range": "bytes=20-"}, wantCode: http.StatusRequestedRangeNotSatisfiable, wantContentRange: "bytes */10"},
+		{name: "multiple ranges", header: map[string]string{"Range": "bytes=0-1,4-5"}, wantCode: http.StatusOK, wantBody: "0123456789"},
+		{
+			name:     "If-Range matching ETag",
+			header:   map[string]string{"Range": "bytes=5-", "If-Range": etag},
+			wantCode: http.StatusPartialContent, wantBody: "56789", wantContentRange: "bytes 5-9/10",
+		},
+		{
+			name:     "If-Range matching Last-Modified",
+			header:   map[string]string{"Range": "bytes=5-", "If-Range": fi.ModTime().UTC().Format(http.TimeFormat)},
+			wantCode: http.StatusPartialContent, wantBody: "56789", wantContentRange: "bytes 5-9/10",
+		},
+		{
+			name:     "If-Range not matching",
+			header:   map[string]string{"Range": "bytes=5-", "If-Range": `"previous"`},
+			wantCode: http.StatusOK, wantBody: "0123456789",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+artifact.Path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want %q", got, "bytes")
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.wantContentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantContentRange)
+			}
+			if tt.wantBody == "" {
+				return
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(tt.wantBody)) {
+				t.Errorf("Content-Length = %q, want %d", got, len(tt.wantBody))
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != "zstd" {
+				t.Errorf("Content-Encoding = %q, want %q", got, "zstd")
+			}
+		})
+	}
+}
+
+func TestArtifactServer_TLS(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "127.0.0.1", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	storage.Scheme = "https"
+
+	obj := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+	artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, obj, "revision", "revision.tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("artifact"), 1<<20)
+	if err := storage.AtomicWriteFile(&artifact, bytes.NewReader(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(artifact.URL, "https://127.0.0.1/") {
+		t.Errorf("artifact URL = %q, want an https URL", artifact.URL)
+	}
+	if got, want := storage.SetHostname("http://old-host/"+artifact.Path), artifact.URL; got != want {
+		t.Errorf("SetHostname() = %q, want %q", got, want)
+	}
+
+	ca := newTestCA(t)
+	certDir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(certDir, "tls.crt"), filepath.Join(certDir, "tls.key"), filepath.Join(certDir, "ca.crt")
+	serverCert, serverKey := ca.issue(t, "127.0.0.1")
+	for dst, b := range map[string][]byte{certFile: serverCert, keyFile: serverKey, caFile: ca.pem} {
+		if err := os.WriteFile(dst, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, watcher, err := NewArtifactServerTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.Start(ctx)
+
+	handler, err := NewArtifactServer(storage.BasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler, ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(ln)
+	defer server.Close()
+	artifactURL := fmt.Sprintf("https://%s/%s", ln.Addr().String(), artifact.Path)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(ca.pem)
+	clientCertPEM, clientKeyPEM := ca.issue(t, "127.0.0.1")
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newClient returns a client with the given client certificates, and a
+	// new connection for every request, which records the serial number of
+	// the server certificate.
+	var serial atomic.Value
+	newClient := func(certs []tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{
+				RootCAs:      rootCAs,
+				Certificates: certs,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					serial.Store(cs.PeerCertificates[0].SerialNumber.String())
+					return nil
+				},
+			},
+		}}
+	}
+	client := newClient([]tls.Certificate{clientCert})
+
+	t.Run("client certificate", func(t *testing.T) {
+		res, err := client.Get(artifactURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want %d", res.StatusCode, http.StatusOK)
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		res, err := newClient(nil).Get(artifactURL)
+		if err == nil {
+			res.Body.Close()
+			t.Fatal("request without a client certificate succeeded")
+		}
+	})
+
+	t.Run("certificate reload", func(t *testing.T) {
+		// A download in progress while the certificate is reloaded
+		res, err := client.Get(artifactURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		head := make([]byte, 1024)
+		if _, err := io.ReadFull(res.Body, head); err != nil {
+			t.Fatal(err)
+		}
+		previous := serial.Load().(string)
+
+		newCert, newKey := ca.issue(t, "127.0.0.1")
+		if err := os.WriteFile(keyFile, newKey, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(certFile, newCert, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		reloaded := newClient([]tls.Certificate{clientCert})
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if res, err := reloaded.Get(artifactURL); err == nil {
+				res.Body.Close()
+				if serial.Load().(string) != previous {
+					break
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("certificate was not reloaded")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		rest, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("download in progress failed after the certificate reload: %v", err)
+		}
+		if got := len(head) + len(rest); got != len(content) {
+			t.Errorf("downloaded %d bytes, want %d", got, len(content))
+		}
+	})
+}
+
+// testCA is a certificate authority that issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA returns a new self-signed testCA.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key for server and client
+// authentication with the given IP address, signed by the testCA.
+func (ca *testCA) issue(t *testing.T, ip string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: ip},
+		IPAddresses:  []net.IP{net.ParseIP(ip)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// blockingResponseWriter is a http.ResponseWriter that signals the first
+// write of the content, and blocks it until released.
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	writing  chan struct{}
+	released chan struct{}
+	once     sync.Once
+}
+
+func (w *blockingResponseWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.released
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestArtifactServer_SetLimits(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	obj := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+	artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, obj, "revision", "revision.tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("artifact"), 32<<10)
+	if err := storage.AtomicWriteFile(&artifact, bytes.NewReader(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("concurrent downloads", func(t *testing.T) {
+		server, err := NewArtifactServer(storage.BasePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.SetLimits(1, 0)
+		inFlight := testutil.ToFloat64(downloadsInFlightGauge)
+		throttled := testutil.ToFloat64(downloadsThrottledCounter.WithLabelValues("concurrency"))
+
+		// A download in progress
+		w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), released: make(chan struct{})}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+artifact.Path, nil))
+		}()
+		<-w.writing
+		if got := testutil.ToFloat64(downloadsInFlightGauge) - inFlight; got != 1 {
+			t.Errorf("downloads in flight = %v, want 1", got)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+artifact.Path, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		if got := rec.Header().Get("Retry-After"); got != "5" {
+			t.Errorf("Retry-After = %q, want %q", got, "5")
+		}
+		if got := testutil.ToFloat64(downloadsThrottledCounter.WithLabelValues("concurrency")) - throttled; got != 1 {
+			t.Errorf("throttled downloads metric increased by %v, want 1", got)
+		}
+
+		close(w.released)
+		<-done
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Errorf("download in progress = %d with %d bytes, want %d with %d bytes", w.Code, w.Body.Len(), http.StatusOK, len(content))
+		}
+		if got := testutil.ToFloat64(downloadsInFlightGauge) - inFlight; got != 0 {
+			t.Errorf("downloads in flight = %v, want 0", got)
+		}
+
+		rec = httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+artifact.Path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("status after the download = %d, want %d", rec.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("bandwidth", func(t *testing.T) {
+		server, err := NewArtifactServer(storage.BasePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The burst of the limit is served at once, the remainder is
+		// served in about a second.
+		server.SetLimits(0, int64(len(content)/2))
+		throttled := testutil.ToFloat64(downloadsThrottledCounter.WithLabelValues("bandwidth"))
+
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+artifact.Path, nil))
+		elapsed := time.Since(start)
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), content) {
+			t.Fatalf("download = %d with %d bytes, want %d with %d bytes", rec.Code, rec.Body.Len(), http.StatusOK, len(content))
+		}
+		if elapsed < 800*time.Millisecond {
+			t.Errorf("download took %v, want about 1s", elapsed)
+		}
+		if got := testutil.ToFloat64(downloadsThrottledCounter.WithLabelValues("bandwidth")) - throttled; got != 1 {
+			t.Errorf("throttled downloads metric increased by %v, want 1", got)
+		}
+	})
+}
+
+func TestArtifactAccessLog(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	obj := &sourcev1.HelmChart{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+	artifact := storage.NewArtifactFor(sourcev1.HelmChartKind, obj, "1.0.0", "podinfo-1.0.0.tgz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("chart")
+	if err := storage.AtomicWriteFile(&artifact, bytes.NewReader(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewArtifactServer(storage.BasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantKind  string
+		wantCode  int
+		wantBytes int
+	}{
+		{name: "artifact", method: http.MethodGet, path: "/" + artifact.Path, wantKind: sourcev1.HelmChartKind, wantCode: http.StatusOK, wantBytes: len(content)},
+		{name: "head", method: http.MethodHead, path: "/" + artifact.Path, wantKind: sourcev1.HelmChartKind, wantCode: http.StatusOK},
+		{name: "not found", method: http.MethodGet, path: "/gitrepository/default/podinfo/missing.tar.gz", wantKind: sourcev1.GitRepositoryKind, wantCode: http.StatusNotFound, wantBytes: len("404 page not found\n")},
+		{name: "method not allowed", method: http.MethodPost, path: "/" + artifact.Path, wantKind: sourcev1.HelmChartKind, wantCode: http.StatusMethodNotAllowed, wantBytes: len("Method Not Allowed\n")},
+		{name: "other path", method: http.MethodGet, path: "/other/podinfo", wantKind: "unknown", wantCode: http.StatusNotFound, wantBytes: len("404 page not found\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := strconv.Itoa(tt.wantCode)
+			requests := testutil.ToFloat64(artifactRequestsCounter.WithLabelValues(tt.wantKind, code))
+			served := testutil.ToFloat64(artifactServedBytesCounter.WithLabelValues(tt.wantKind, code))
+
+			log := &recordingLogger{}
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("User-Agent", "flux-test")
+			rec := httptest.NewRecorder()
+			ArtifactAccessLog(server, log).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := testutil.ToFloat64(artifactRequestsCounter.WithLabelValues(tt.wantKind, code)) - requests; got != 1 {
+				t.Errorf("requests metric increased by %v, want 1", got)
+			}
+			if got := testutil.ToFloat64(artifactServedBytesCounter.WithLabelValues(tt.wantKind, code)) - served; got != float64(tt.wantBytes) {
+				t.Errorf("served bytes metric increased by %v, want %d", got, tt.wantBytes)
+			}
+
+			if len(log.entries) != 1 {
+				t.Fatalf("logged %d entries, want 1", len(log.entries))
+			}
+			entry := log.entries[0]
+			if entry.level != 1 {
+				t.Errorf("logged at level %d, want 1", entry.level)
+			}
+			for k, want := range map[string]interface{}{
+				"method":     tt.method,
+				"path":       tt.path,
+				"code":       tt.wantCode,
+				"bytes":      int64(tt.wantBytes),
+				"remoteAddr": req.RemoteAddr,
+				"userAgent":  "flux-test",
+			} {
+				if got := entry.values[k]; got != want {
+					t.Errorf("logged %s = %v, want %v", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+// recordingLogger is a logr.Logger that records the entries logged with Info.
+type recordingLogger struct {
+	level   int
+	entries []logEntry
+	parent  *recordingLogger
+}
+
+type logEntry struct {
+	level  int
+	msg    string
+	values map[string]interface{}
+}
+
+func (l *recordingLogger) root() *recordingLogger {
+	if l.parent != nil {
+		return l.parent.root()
+	}
+	return l
+}
+
+func (l *recordingLogger) Enabled() bool { return true }
+
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	values := map[string]interface{}{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		values[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	root := l.root()
+	root.entries = append(root.entries, logEntry{level: l.level, msg: msg, values: values})
+}
+
+func (l *recordingLogger) Error(err error, msg string, keysAndValues ...interface{}) {}
+
+func (l *recordingLogger) V(level int) logr.Logger {
+	return &recordingLogger{level: l.level + level, parent: l}
+}
+
+func (l *recordingLogger) WithValues(keysAndValues ...interface{}) logr.Logger { return l }
+
+func (l *recordingLogger) WithName(name string) logr.Logger { return l }
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// SignatureExtension is the extension of the signature file of an artifact, which is stored next to the artifact as
+// '<artifact>.sig'.
+const SignatureExtension = ".sig"
+
+// LoadSigningKey returns the private key of the PEM file at the given path, with which the Storage signs the artifacts.
+// The key is an unencrypted ECDSA or RSA key, in PKCS #8, SEC 1 or PKCS #1 form.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in signing key '%s'", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block '%s' in signing key '%s', must be an unencrypted private key", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key '%s': %w", path, err)
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case *rsa.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported signing key '%s' of type %T, must be an ECDSA or RSA key", path, key)
+}
+
+// sign signs the SHA256 checksum of the given v1beta1.Artifact with the SigningKey, and stores the base64 encoded
+// signature in the signature file of the artifact and in its Signature. The signature is the one of
+// 'cosign sign-blob' of the artifact: an ASN.1 signature for an ECDSA key, and a PKCS #1 v1.5 signature for an RSA key.
+// Without a SigningKey, any previous signature file of the artifact is removed.
+func (s *Storage) sign(artifact *sourcev1.Artifact, h *artifactHash) error {
+	sigPath := s.LocalPath(*artifact) + SignatureExtension
+	if s.SigningKey == nil {
+		artifact.Signature = ""
+		if err := os.Remove(sigPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	sig, err := s.SigningKey.Sign(rand.Reader, h.checksum.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to sign artifact: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(sig)
+
+	tf, err := os.CreateTemp(filepath.Split(sigPath))
+	if err != nil {
+		return err
+	}
+	if _, err := tf.WriteString(encoded); err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return err
+	}
+	if err := publishFile(tf, sigPath, 0644); err != nil {
+		os.Remove(tf.Name())
+		return err
+	}
+	if err := s.upload(artifact.Path+SignatureExtension, sigPath, ""); err != nil {
+		return err
+	}
+
+	artifact.Signature = encoded
+	return nil
+}
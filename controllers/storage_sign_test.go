@@ -0,0 +1,205 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// writeSigningKey writes the given PEM block to a file, and returns its path.
+func writeSigningKey(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "cosign.key")
+	if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPKCS8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{name: "SEC 1 ECDSA key", path: writeSigningKey(t, "EC PRIVATE KEY", ecDER)},
+		{name: "PKCS #8 RSA key", path: writeSigningKey(t, "PRIVATE KEY", rsaPKCS8)},
+		{name: "PKCS #1 RSA key", path: writeSigningKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))},
+		{name: "Ed25519 key", path: writeSigningKey(t, "PRIVATE KEY", edPKCS8), wantErr: "must be an ECDSA or RSA key"},
+		{name: "encrypted cosign key", path: writeSigningKey(t, "ENCRYPTED COSIGN PRIVATE KEY", []byte("key")), wantErr: "must be an unencrypted private key"},
+		{name: "invalid key", path: writeSigningKey(t, "EC PRIVATE KEY", []byte("key")), wantErr: "failed to parse signing key"},
+		{name: "missing key", path: filepath.Join(t.TempDir(), "cosign.key"), wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := LoadSigningKey(tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadSigningKey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadSigningKey() error = %v", err)
+			}
+			if key == nil {
+				t.Fatal("LoadSigningKey() returned no key")
+			}
+		})
+	}
+}
+
+func TestStorage_sign(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// verify verifies the signature of the artifact like 'cosign verify-blob'
+	// with the given public key.
+	verify := func(t *testing.T, artifact sourcev1.Artifact, pub crypto.PublicKey) {
+		t.Helper()
+		b, err := os.ReadFile(storage.LocalPath(artifact) + SignatureExtension)
+		if err != nil {
+			t.Fatalf("failed to read signature file: %v", err)
+		}
+		if string(b) != artifact.Signature {
+			t.Errorf("signature file = %q, want the signature of the artifact %q", b, artifact.Signature)
+		}
+		sig, err := base64.StdEncoding.DecodeString(string(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(storage.LocalPath(artifact))
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(content)
+		switch k := pub.(type) {
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(k, digest[:], sig) {
+				t.Error("ECDSA signature does not verify")
+			}
+		case *rsa.PublicKey:
+			if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+				t.Errorf("RSA signature does not verify: %v", err)
+			}
+		}
+	}
+
+	artifact := storage.NewArtifactFor(sourcev1.HelmRepositoryKind, &sourcev1.HelmRepository{}, "rev", "index.yaml")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.SigningKey = ecKey
+	if err := storage.AtomicWriteFile(&artifact, bytes.NewReader([]byte("index")), 0644); err != nil {
+		t.Fatalf("AtomicWriteFile() error = %v", err)
+	}
+	verify(t, artifact, &ecKey.PublicKey)
+
+	// A rotated key signs the next artifact
+	storage.SigningKey = rsaKey
+	if err := storage.Copy(&artifact, bytes.NewReader([]byte("index of the next revision"))); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	verify(t, artifact, &rsaKey.PublicKey)
+
+	tarball := storage.NewArtifactFor(sourcev1.GitRepositoryKind, &sourcev1.GitRepository{}, "rev", "rev.tar.gz")
+	if err := storage.MkdirAll(tarball); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Archive(&tarball, copyChartTree(t, 0644, 0755, time.Now()), nil); err != nil {
+		t.Fatalf("Archive() error = %v", err)
+	}
+	verify(t, tarball, &rsaKey.PublicKey)
+
+	// Without a key, the artifact is written without a signature
+	storage.SigningKey = nil
+	if err := storage.Copy(&artifact, bytes.NewReader([]byte("unsigned index"))); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if artifact.Signature != "" {
+		t.Errorf("signature = %q, want none", artifact.Signature)
+	}
+	if _, err := os.Stat(storage.LocalPath(artifact) + SignatureExtension); !os.IsNotExist(err) {
+		t.Errorf("signature file of the previous artifact is not removed: %v", err)
+	}
+
+	// The signature file is removed with the artifact
+	if err := storage.Remove(tarball); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(storage.LocalPath(tarball) + SignatureExtension); !os.IsNotExist(err) {
+		t.Errorf("signature file is not removed with the artifact: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errStandbyStorage is the reason for which a standby replica does not serve
+// the artifacts.
+var errStandbyStorage = errors.New("this replica is not the leader and does not share the storage of the leader, " +
+	"the artifacts are served by the leader only: run the replicas with --storage-shared on a ReadWriteMany volume " +
+	"to serve the artifacts from all replicas")
+
+// StandbyGate gates the artifact server of a replica of the controller,
+// which serves the artifacts whether it is the elected leader or not, while
+// only the leader reconciles the sources. A standby replica serves the
+// artifacts written by the leader if the storage is shared by the replicas,
+// e.g. a ReadWriteMany volume. Otherwise its storage does not contain the
+// artifacts of the leader, and it answers with a 503 Service Unavailable
+// until it is elected, and its artifact server readiness check fails, so
+// that it does not receive the traffic of the Service. A nil StandbyGate
+// serves all requests.
+type StandbyGate struct {
+	// SharedStorage is true if the storage is shared with the leader.
+	SharedStorage bool
+
+	elected <-chan struct{}
+}
+
+// NewStandbyGate returns a StandbyGate for the given channel, which is
+// closed when the replica is elected leader, e.g. manager.Elected().
+func NewStandbyGate(elected <-chan struct{}, sharedStorage bool) *StandbyGate {
+	return &StandbyGate{SharedStorage: sharedStorage, elected: elected}
+}
+
+// Handler returns the given handler of the artifacts, which answers with a
+// 503 Service Unavailable while the replica can not serve the artifacts.
+func (g *StandbyGate) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := g.err(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// err returns errStandbyStorage if the replica can not serve the artifacts,
+// as it is neither the leader nor shares its storage.
+func (g *StandbyGate) err() error {
+	if g == nil || g.SharedStorage {
+		return nil
+	}
+	select {
+	case <-g.elected:
+		return nil
+	default:
+		return errStandbyStorage
+	}
+}
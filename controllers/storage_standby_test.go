@@ -0,0 +1,78 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStandbyGate_Handler(t *testing.T) {
+	artifacts := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("artifact"))
+	})
+	get := func(g *StandbyGate) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		g.Handler(artifacts).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/gitrepository/default/podinfo/rev.tar.gz", nil))
+		return rec
+	}
+
+	// A standby without the storage of the leader is unavailable until it
+	// is elected
+	elected := make(chan struct{})
+	g := NewStandbyGate(elected, false)
+	rec := get(g)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status of a standby with its own storage = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if !strings.Contains(rec.Body.String(), "--storage-shared") {
+		t.Errorf("body of a standby with its own storage = %q, want the reason", rec.Body.String())
+	}
+	close(elected)
+	if rec := get(g); rec.Code != http.StatusOK || rec.Body.String() != "artifact" {
+		t.Errorf("leader response = %d %q, want the artifact", rec.Code, rec.Body.String())
+	}
+
+	// A standby with the shared storage serves the artifacts of the leader
+	if rec := get(NewStandbyGate(make(chan struct{}), true)); rec.Code != http.StatusOK {
+		t.Errorf("status of a standby with the shared storage = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := get(nil); rec.Code != http.StatusOK {
+		t.Errorf("status without gate = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestReadinessProbe_ArtifactServerCheckStandby(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	elected := make(chan struct{})
+	p := &ReadinessProbe{ServerAddress: ln.Addr().String(), Standby: NewStandbyGate(elected, false)}
+
+	if err := p.ArtifactServerCheck(nil); err != errStandbyStorage {
+		t.Errorf("ArtifactServerCheck() of a standby with its own storage error = %v, want %v", err, errStandbyStorage)
+	}
+	close(elected)
+	if err := p.ArtifactServerCheck(nil); err != nil {
+		t.Errorf("ArtifactServerCheck() of the leader error = %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+// +build !windows
+
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"syscall"
+)
+
+// statfs returns the usage of the file system at the given path. The available space is the space available to the
+// controller, without the space reserved for the root user.
+func statfs(path string) (storageUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return storageUsage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	return storageUsage{
+		used:      (uint64(st.Blocks) - uint64(st.Bfree)) * bsize,
+		available: uint64(st.Bavail) * bsize,
+	}, nil
+}
+
+// linkCount returns the number of hard links of the file with the given os.FileInfo, and false if it is unknown.
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
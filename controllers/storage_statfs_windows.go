@@ -0,0 +1,34 @@
+// +build windows
+
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+)
+
+// statfs is not supported on Windows, the usage of the storage is unknown.
+func statfs(path string) (storageUsage, error) {
+	return storageUsage{}, fmt.Errorf("storage usage of '%s' is not supported on windows", path)
+}
+
+// linkCount is not supported on Windows, the artifacts are not deduplicated.
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
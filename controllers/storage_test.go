@@ -18,18 +18,34 @@ package controllers
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/fips"
 )
 
 func createStoragePath() (string, error) {
@@ -68,6 +84,43 @@ func TestStorageConstructor(t *testing.T) {
 	}
 }
 
+func TestStorage_IPv6Hostname(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	tests := []struct {
+		hostname string
+		wantURL  string
+	}{
+		{hostname: "fd00::1", wantURL: "http://[fd00::1]/gitrepository/default/podinfo/revision.tar.gz"},
+		{hostname: "[fd00::1]:9090", wantURL: "http://[fd00::1]:9090/gitrepository/default/podinfo/revision.tar.gz"},
+		{hostname: "10.0.0.1:9090", wantURL: "http://10.0.0.1:9090/gitrepository/default/podinfo/revision.tar.gz"},
+		{hostname: "source-controller.flux-system", wantURL: "http://source-controller.flux-system/gitrepository/default/podinfo/revision.tar.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			storage, err := NewStorage(dir, tt.hostname, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			artifact := sourcev1.Artifact{Path: "gitrepository/default/podinfo/revision.tar.gz"}
+			storage.SetArtifactURL(&artifact)
+			if artifact.URL != tt.wantURL {
+				t.Errorf("SetArtifactURL() = %s, want %s", artifact.URL, tt.wantURL)
+			}
+			if got := storage.SetHostname("http://10.0.0.2:9090/gitrepository/default/podinfo/revision.tar.gz"); got != tt.wantURL {
+				t.Errorf("SetHostname() = %s, want %s", got, tt.wantURL)
+			}
+			if _, err := url.Parse(artifact.URL); err != nil {
+				t.Errorf("artifact URL %s is invalid: %v", artifact.URL, err)
+			}
+		})
+	}
+}
+
 // walks a tar.gz and looks for paths with the basename. It does not match
 // symlinks properly at this time because that's painful.
 func walkTar(tarFile string, match string) (int64, bool, error) {
@@ -241,6 +294,80 @@ func TestStorage_Archive(t *testing.T) {
 	}
 }
 
+func TestStorage_ArchiveWithModTimes(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	modTime := time.Date(2021, 10, 12, 8, 30, 0, 500, time.UTC)
+	modTimes := map[string]time.Time{"dir/file.yaml": modTime}
+
+	archive := func(t *testing.T) sourcev1.Artifact {
+		t.Helper()
+		files := t.TempDir()
+		for _, name := range []string{"dir/file.yaml", "other.yaml"} {
+			p := filepath.Join(files, name)
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		artifact := sourcev1.Artifact{
+			Path: filepath.Join(randStringRunes(10), randStringRunes(10), randStringRunes(10)+".tar.gz"),
+		}
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatalf("artifact directory creation failed: %v", err)
+		}
+		if err := storage.ArchiveWithModTimes(&artifact, files, nil, modTimes); err != nil {
+			t.Fatalf("ArchiveWithModTimes() error = %v", err)
+		}
+		return artifact
+	}
+
+	first := archive(t)
+	f, err := os.Open(storage.LocalPath(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		// The zero time is recorded as the Unix epoch
+		want := time.Unix(0, 0)
+		if modTime, ok := modTimes[header.Name]; ok {
+			want = modTime.Truncate(time.Second)
+		}
+		if !header.ModTime.Equal(want) {
+			t.Errorf("%q mtime = %v, want %v", header.Name, header.ModTime, want)
+		}
+	}
+
+	// Files written at another time result in the same artifact
+	time.Sleep(10 * time.Millisecond)
+	if second := archive(t); second.Checksum != first.Checksum {
+		t.Errorf("checksum of second archive %s does not match %s", second.Checksum, first.Checksum)
+	}
+}
+
 func TestStorageRemoveAllButCurrent(t *testing.T) {
 	t.Run("bad directory in archive", func(t *testing.T) {
 		dir, err := os.MkdirTemp("", "")
@@ -258,4 +385,942 @@ func TestStorageRemoveAllButCurrent(t *testing.T) {
 			t.Fatal("Did not error while pruning non-existent path")
 		}
 	})
+
+	t.Run("keeps sidecar files of current artifact", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		s, err := NewStorage(dir, "hostname", time.Minute)
+		if err != nil {
+			t.Fatalf("Valid path did not successfully return: %v", err)
+		}
+
+		current := sourcev1.Artifact{Path: "bucket/default/test/current.tar.gz"}
+		files := map[string]bool{
+			"current.tar.gz":            true,
+			"current.tar.gz.index.json": true,
+			"old.tar.gz":                false,
+			"old.tar.gz.index.json":     false,
+		}
+		artifactDir := filepath.Dir(s.LocalPath(current))
+		if err := os.MkdirAll(artifactDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name := range files {
+			if err := os.WriteFile(filepath.Join(artifactDir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.RemoveAllButCurrent(current); err != nil {
+			t.Fatal(err)
+		}
+		for name, keep := range files {
+			_, err := os.Stat(filepath.Join(artifactDir, name))
+			if exists := err == nil; exists != keep {
+				t.Errorf("%q exists = %v, want %v", name, exists, keep)
+			}
+		}
+	})
+}
+
+func TestStorage_GarbageCollect(t *testing.T) {
+	// The files of the artifact dir, with their age in minutes
+	files := map[string]int{
+		"current.tar.gz":            30,
+		"current.tar.gz.index.json": 30,
+		"current.tar.gz.lock":       30,
+		"newest.tar.gz":             0,
+		"recent.tar.gz":             40,
+		"recent.tar.gz.index.json":  40,
+		"old.tar.gz":                90,
+		"old.tar.gz.index.json":     90,
+		"old.tar.gz.lock":           90,
+		"oldest.tar.gz":             180,
+	}
+	tests := []struct {
+		name        string
+		records     int
+		ttl         time.Duration
+		wantRemoved []string
+	}{
+		{
+			name:    "only current",
+			records: 1,
+			wantRemoved: []string{
+				"old.tar.gz", "old.tar.gz.index.json", "old.tar.gz.lock", "oldest.tar.gz",
+				"recent.tar.gz", "recent.tar.gz.index.json",
+			},
+		},
+		{
+			name:        "records",
+			records:     3,
+			wantRemoved: []string{"old.tar.gz", "old.tar.gz.index.json", "old.tar.gz.lock", "oldest.tar.gz"},
+		},
+		{
+			name:        "ttl",
+			ttl:         time.Hour,
+			wantRemoved: []string{"old.tar.gz", "old.tar.gz.index.json", "old.tar.gz.lock", "oldest.tar.gz"},
+		},
+		{
+			name:        "records and ttl",
+			records:     4,
+			ttl:         2 * time.Hour,
+			wantRemoved: []string{"oldest.tar.gz"},
+		},
+		{
+			name: "unlimited",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := createStoragePath()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(cleanupStoragePath(dir))
+
+			s, err := NewStorage(dir, "hostname", time.Minute)
+			if err != nil {
+				t.Fatalf("error while bootstrapping storage: %v", err)
+			}
+			s.ArtifactRetentionRecords = tt.records
+			s.ArtifactRetentionTTL = tt.ttl
+
+			current := sourcev1.Artifact{Path: "bucket/default/test/current.tar.gz"}
+			artifactDir := filepath.Dir(s.LocalPath(current))
+			if err := os.MkdirAll(artifactDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, age := range files {
+				p := filepath.Join(artifactDir, name)
+				if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := time.Now().Add(-time.Duration(age) * time.Minute)
+				if err := os.Chtimes(p, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink(s.LocalPath(current), filepath.Join(artifactDir, "latest.tar.gz")); err != nil {
+				t.Fatal(err)
+			}
+
+			removed, err := s.GarbageCollect(current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range removed {
+				got = append(got, filepath.Base(p))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantRemoved) {
+				t.Errorf("GarbageCollect() removed %v, want %v", got, tt.wantRemoved)
+			}
+			for _, name := range append(tt.wantRemoved, "latest.tar.gz") {
+				_, err := os.Lstat(filepath.Join(artifactDir, name))
+				if exists := err == nil; exists != (name == "latest.tar.gz") {
+					t.Errorf("%q exists = %v after garbage collection", name, exists)
+				}
+			}
+		})
+	}
+
+	t.Run("nonexistent dir", func(t *testing.T) {
+		dir, err := createStoragePath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cleanupStoragePath(dir))
+
+		s, err := NewStorage(dir, "hostname", time.Minute)
+		if err != nil {
+			t.Fatalf("error while bootstrapping storage: %v", err)
+		}
+		if removed, err := s.GarbageCollect(sourcev1.Artifact{Path: "bucket/default/test/current.tar.gz"}); err != nil || len(removed) > 0 {
+			t.Errorf("GarbageCollect() = %v, %v, want nothing removed", removed, err)
+		}
+	})
+}
+
+func TestStorage_VerifyArtifact(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	content := "content of the artifact"
+	artifact := sourcev1.Artifact{Path: filepath.Join(randStringRunes(10), randStringRunes(10), "artifact.txt")}
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&artifact, strings.NewReader(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if want := storage.Checksum(strings.NewReader(content)); artifact.Checksum != want || artifact.Digest != "sha256:"+want {
+		t.Fatalf("AtomicWriteFile() got checksum %q and digest %q, want SHA256 %q", artifact.Checksum, artifact.Digest, want)
+	}
+	if artifact.Size == nil || *artifact.Size != int64(len(content)) {
+		t.Fatalf("AtomicWriteFile() got size %v, want %d", artifact.Size, len(content))
+	}
+
+	withChecksum := func(checksum, digest string) sourcev1.Artifact {
+		a := artifact
+		a.Checksum, a.Digest = checksum, digest
+		return a
+	}
+	sha1Sum := storage.LegacyChecksum(strings.NewReader(content))
+	sha512Sum := fmt.Sprintf("%x", sha512.Sum512([]byte(content)))
+	zeros := strings.Repeat("0", 64)
+	tests := []struct {
+		name     string
+		artifact sourcev1.Artifact
+		legacy   bool
+		wantErr  string
+	}{
+		{name: "digest", artifact: artifact},
+		{name: "SHA256 checksum without digest", artifact: withChecksum(artifact.Checksum, "")},
+		{name: "legacy SHA1 checksum", artifact: withChecksum(sha1Sum, ""), legacy: true},
+		{name: "no checksum", artifact: withChecksum("", "")},
+		{name: "SHA512 digest", artifact: withChecksum(artifact.Checksum, "sha512:"+sha512Sum)},
+		{name: "digest without algorithm", artifact: withChecksum(artifact.Checksum, sha512Sum)},
+		{
+			name:     "digest mismatch",
+			artifact: withChecksum(artifact.Checksum, "sha256:"+zeros),
+			wantErr:  "does not match '" + zeros + "'",
+		},
+		{
+			name:     "legacy checksum mismatch",
+			artifact: withChecksum(strings.Repeat("0", 40), ""),
+			legacy:   true,
+			wantErr:  "sha1 checksum '" + sha1Sum + "'",
+		},
+		{
+			name:     "unsupported algorithm",
+			artifact: withChecksum(artifact.Checksum, "md5:"+artifact.Checksum),
+			wantErr:  "unsupported digest algorithm 'md5'",
+		},
+		{
+			name:     "invalid digest",
+			artifact: withChecksum(artifact.Checksum, "sha256:"+sha1Sum),
+			wantErr:  "invalid sha256 digest",
+		},
+		{
+			name:     "digest without algorithm of unknown length",
+			artifact: withChecksum(artifact.Checksum, "0123"),
+			wantErr:  "invalid digest '0123'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.legacy && fips.Enabled() {
+				t.Skip("the SHA1 checksums of previous versions are not verified in FIPS mode")
+			}
+			err := storage.VerifyArtifact(tt.artifact)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyArtifact() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyArtifact() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStorage_VerifyArtifact_fips(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	artifact := sourcev1.Artifact{Path: filepath.Join(randStringRunes(10), randStringRunes(10), "artifact.txt")}
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&artifact, strings.NewReader("content of the artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fips.SetEnabled(true)
+	defer fips.SetEnabled(false)
+	if err := storage.VerifyArtifact(artifact); err != nil {
+		t.Errorf("VerifyArtifact() of a SHA256 artifact in FIPS mode error = %v", err)
+	}
+	if sum := storage.LegacyChecksum(strings.NewReader("content of the artifact")); sum != "" {
+		t.Errorf("LegacyChecksum() in FIPS mode = %q, want none", sum)
+	}
+	legacy := artifact
+	legacy.Checksum, legacy.Digest = strings.Repeat("0", 40), ""
+	var notApproved *fips.NotApprovedError
+	if err := storage.VerifyArtifact(legacy); !errors.As(err, &notApproved) {
+		t.Errorf("VerifyArtifact() of a SHA1 artifact in FIPS mode error = %v, want a NotApprovedError", err)
+	}
+}
+
+func TestStorage_ArchiveReproducible(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	type file struct {
+		name string
+		mode os.FileMode
+	}
+	// archive writes the files in the given order and with the given
+	// permissions, and returns the contents of the archive.
+	archive := func(t *testing.T, files []file, dirMode os.FileMode, modTime time.Time) []byte {
+		t.Helper()
+		tmp := t.TempDir()
+		for _, f := range files {
+			p := filepath.Join(tmp, f.name)
+			if err := os.MkdirAll(filepath.Dir(p), dirMode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(f.name), f.mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(p, f.mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		artifact := sourcev1.Artifact{
+			Path: filepath.Join(randStringRunes(10), randStringRunes(10), randStringRunes(10)+".tar.gz"),
+		}
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatalf("artifact directory creation failed: %v", err)
+		}
+		if err := storage.Archive(&artifact, tmp, nil); err != nil {
+			t.Fatalf("Archive() error = %v", err)
+		}
+		b, err := os.ReadFile(storage.LocalPath(artifact))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	first := archive(t, []file{
+		{name: "a.yaml", mode: 0644},
+		{name: "a/b.yaml", mode: 0600},
+		{name: "bin/run.sh", mode: 0755},
+		{name: "z/z.yaml", mode: 0640},
+	}, 0755, time.Date(2021, 10, 12, 8, 30, 0, 0, time.UTC))
+	second := archive(t, []file{
+		{name: "z/z.yaml", mode: 0664},
+		{name: "bin/run.sh", mode: 0700},
+		{name: "a/b.yaml", mode: 0644},
+		{name: "a.yaml", mode: 0666},
+	}, 0700, time.Now())
+	if !bytes.Equal(first, second) {
+		t.Error("archives of identical trees are not byte-identical")
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gzr)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+
+		wantMode := int64(0644)
+		if header.Name == "bin/run.sh" {
+			wantMode = 0755
+		}
+		if header.Mode != wantMode {
+			t.Errorf("%q mode = %o, want %o", header.Name, header.Mode, wantMode)
+		}
+		if header.Uid != 0 || header.Gid != 0 || header.Uname != "" || header.Gname != "" {
+			t.Errorf("%q owner = %d:%d (%s:%s), want none", header.Name, header.Uid, header.Gid, header.Uname, header.Gname)
+		}
+		if !header.ModTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("%q mtime = %v, want the Unix epoch", header.Name, header.ModTime)
+		}
+	}
+	wantNames := []string{"a.yaml", "a/b.yaml", "bin/run.sh", "z/z.yaml"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("archive entries = %v, want %v", names, wantNames)
+	}
+}
+
+func TestStorage_ArchiveEncoding(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	files := t.TempDir()
+	for name, content := range map[string]string{"app/deploy.yaml": "kind: Deployment", "app/svc.yaml": "kind: Service"} {
+		p := filepath.Join(files, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		encoding  string
+		level     int
+		wantExt   string
+		wantMagic []byte
+	}{
+		{name: "gzip default level", encoding: ArchiveEncodingGzip, level: gzip.DefaultCompression, wantExt: ".tar.gz", wantMagic: []byte{0x1f, 0x8b}},
+		{name: "gzip no compression", encoding: ArchiveEncodingGzip, level: gzip.NoCompression, wantExt: ".tar.gz", wantMagic: []byte{0x1f, 0x8b}},
+		{name: "gzip best compression", encoding: ArchiveEncodingGzip, level: gzip.BestCompression, wantExt: ".tar.gz", wantMagic: []byte{0x1f, 0x8b}},
+		{name: "zstd", encoding: ArchiveEncodingZstd, level: gzip.DefaultCompression, wantExt: ".tar.zst", wantMagic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage, err := NewStorage(dir, "hostname", time.Minute)
+			if err != nil {
+				t.Fatalf("error while bootstrapping storage: %v", err)
+			}
+			storage.ArchiveEncoding = tt.encoding
+			storage.ArchiveCompressionLevel = tt.level
+			if err := storage.ValidateArchiveOptions(); err != nil {
+				t.Fatalf("ValidateArchiveOptions() error = %v", err)
+			}
+			if ext := storage.ArchiveExtension(); ext != tt.wantExt {
+				t.Fatalf("ArchiveExtension() = %q, want %q", ext, tt.wantExt)
+			}
+
+			archive := func() sourcev1.Artifact {
+				artifact := sourcev1.Artifact{
+					Path: filepath.Join(randStringRunes(10), randStringRunes(10), randStringRunes(10)+storage.ArchiveExtension()),
+				}
+				if err := storage.MkdirAll(artifact); err != nil {
+					t.Fatalf("artifact directory creation failed: %v", err)
+				}
+				if err := storage.Archive(&artifact, files, nil); err != nil {
+					t.Fatalf("Archive() error = %v", err)
+				}
+				return artifact
+			}
+			artifact := archive()
+			if other := archive(); other.Checksum != artifact.Checksum {
+				t.Errorf("checksum of second archive %s does not match %s", other.Checksum, artifact.Checksum)
+			}
+
+			b, err := os.ReadFile(storage.LocalPath(artifact))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(b, tt.wantMagic) {
+				t.Errorf("archive starts with %x, want %x", b[:len(tt.wantMagic)], tt.wantMagic)
+			}
+
+			toPath := filepath.Join(t.TempDir(), "app")
+			if err := storage.CopyToPath(&artifact, "app", toPath); err != nil {
+				t.Fatalf("CopyToPath() error = %v", err)
+			}
+			if content, err := os.ReadFile(filepath.Join(toPath, "svc.yaml")); err != nil || string(content) != "kind: Service" {
+				t.Errorf("extracted svc.yaml = %q, %v, want %q", content, err, "kind: Service")
+			}
+		})
+	}
+}
+
+func TestStorage_ValidateArchiveOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		level    int
+		wantErr  string
+	}{
+		{name: "gzip", encoding: ArchiveEncodingGzip, level: gzip.BestSpeed},
+		{name: "zstd", encoding: ArchiveEncodingZstd, level: gzip.DefaultCompression},
+		{name: "unsupported encoding", encoding: "bzip2", level: gzip.DefaultCompression, wantErr: "unsupported archive encoding 'bzip2'"},
+		{name: "invalid level", encoding: ArchiveEncodingGzip, level: 10, wantErr: "gzip: invalid compression level: 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &Storage{ArchiveEncoding: tt.encoding, ArchiveCompressionLevel: tt.level}
+			err := storage.ValidateArchiveOptions()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateArchiveOptions() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("ValidateArchiveOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStorage_DigestAlgorithm(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	content := []byte("content of the artifact")
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+	tests := []struct {
+		algorithm  string
+		wantDigest string
+		wantErr    string
+	}{
+		{algorithm: "sha256", wantDigest: "sha256:" + checksum},
+		{algorithm: "sha384", wantDigest: fmt.Sprintf("sha384:%x", sha512.Sum384(content))},
+		{algorithm: "sha512", wantDigest: fmt.Sprintf("sha512:%x", sha512.Sum512(content))},
+		{algorithm: "md5", wantErr: "unsupported digest algorithm 'md5', must be one of sha256, sha384 or sha512"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			storage, err := NewStorage(dir, "hostname", time.Minute)
+			if err != nil {
+				t.Fatalf("error while bootstrapping storage: %v", err)
+			}
+			storage.DigestAlgorithm = tt.algorithm
+			err = storage.ValidateDigestAlgorithm()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("ValidateDigestAlgorithm() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateDigestAlgorithm() error = %v", err)
+			}
+
+			artifact := sourcev1.Artifact{Path: path.Join(tt.algorithm, "default", "podinfo", "artifact.txt")}
+			if err := storage.MkdirAll(artifact); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.AtomicWriteFile(&artifact, bytes.NewReader(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if artifact.Checksum != checksum || artifact.Digest != tt.wantDigest {
+				t.Errorf("AtomicWriteFile() got checksum %q and digest %q, want %q and %q", artifact.Checksum, artifact.Digest, checksum, tt.wantDigest)
+			}
+			if err := storage.VerifyArtifact(artifact); err != nil {
+				t.Errorf("VerifyArtifact() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestStorage_ArtifactMaxSize(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	storage.ArtifactMaxSize = 64
+
+	src := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789"), 1024)
+	if err := os.WriteFile(filepath.Join(src, "file"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		write func(artifact *sourcev1.Artifact) error
+	}{
+		{name: "Archive", write: func(artifact *sourcev1.Artifact) error {
+			return storage.Archive(artifact, src, nil)
+		}},
+		{name: "AtomicWriteFile", write: func(artifact *sourcev1.Artifact) error {
+			return storage.AtomicWriteFile(artifact, bytes.NewReader(content), 0644)
+		}},
+		{name: "CopyFromPath", write: func(artifact *sourcev1.Artifact) error {
+			return storage.CopyFromPath(artifact, filepath.Join(src, "file"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			artifact := sourcev1.Artifact{Path: filepath.Join(tt.name, "artifact.tar.gz")}
+			if err := storage.MkdirAll(artifact); err != nil {
+				t.Fatal(err)
+			}
+			err := tt.write(&artifact)
+			var sizeErr *ArtifactSizeError
+			if !errors.As(err, &sizeErr) {
+				t.Fatalf("error = %v, want an ArtifactSizeError", err)
+			}
+			if sizeErr.Limit != 64 || sizeErr.Size <= 64 {
+				t.Errorf("ArtifactSizeError = %+v, want a size over the limit of 64", sizeErr)
+			}
+			entries, err := os.ReadDir(filepath.Dir(storage.LocalPath(artifact)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("artifact directory contains %d files after the aborted write, want none", len(entries))
+			}
+		})
+	}
+}
+
+func TestStorage_ArchiveWithoutIntermediateCopies(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	// A large fixture of incompressible files
+	src := t.TempDir()
+	var size int64
+	for i := 0; i < 3; i++ {
+		content := make([]byte, 4<<20)
+		if _, err := rand.Read(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, fmt.Sprintf("file-%d", i)), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		size += int64(len(content))
+	}
+
+	// Any temporary file outside of the storage fails the archive
+	tmpDir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	t.Cleanup(func() { os.Setenv("TMPDIR", tmpDir) })
+
+	// storageFiles returns the files in the storage, and their total size
+	storageFiles := func() ([]string, int64) {
+		var files []string
+		var total int64
+		if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				files = append(files, p)
+				total += fi.Size()
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return files, total
+	}
+
+	artifact := sourcev1.Artifact{Path: filepath.Join("gitrepository", "default", "large", "artifact.tar.gz")}
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	var maxFiles int
+	filter := func(p string, fi os.FileInfo) bool {
+		if files, _ := storageFiles(); len(files) > maxFiles {
+			maxFiles = len(files)
+		}
+		return false
+	}
+	if err := storage.Archive(&artifact, src, filter); err != nil {
+		t.Fatalf("Archive() error = %v", err)
+	}
+	if maxFiles != 1 {
+		t.Errorf("storage contains %d files while archiving, want only the temporary file of the artifact", maxFiles)
+	}
+
+	files, total := storageFiles()
+	if len(files) != 1 || files[0] != storage.LocalPath(artifact) {
+		t.Fatalf("storage contains %v after archiving, want only the artifact", files)
+	}
+	if total < size {
+		t.Errorf("artifact size = %d, want at least the size of the incompressible fixture (%d)", total, size)
+	}
+	if err := storage.VerifyArtifact(artifact); err != nil {
+		t.Errorf("VerifyArtifact() error = %v", err)
+	}
+}
+
+func TestStorage_WithArtifactMaxSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int64
+		size    *resource.Quantity
+		wantMax int64
+	}{
+		{name: "nil size", limit: 100, size: nil, wantMax: 100},
+		{name: "zero size", limit: 100, size: resource.NewQuantity(0, resource.BinarySI), wantMax: 100},
+		{name: "lower size", limit: 100, size: resource.NewQuantity(10, resource.BinarySI), wantMax: 10},
+		{name: "size capped at the limit", limit: 100, size: resource.NewQuantity(1000, resource.BinarySI), wantMax: 100},
+		{name: "unlimited", limit: 0, size: resource.NewQuantity(1000, resource.BinarySI), wantMax: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &Storage{ArtifactMaxSize: tt.limit}
+			if got := storage.WithArtifactMaxSize(tt.size).ArtifactMaxSize; got != tt.wantMax {
+				t.Errorf("WithArtifactMaxSize() ArtifactMaxSize = %d, want %d", got, tt.wantMax)
+			}
+			if storage.ArtifactMaxSize != tt.limit {
+				t.Errorf("WithArtifactMaxSize() modified the Storage, ArtifactMaxSize = %d, want %d", storage.ArtifactMaxSize, tt.limit)
+			}
+		})
+	}
+}
+
+func TestArtifactHeaders(t *testing.T) {
+	handler := ArtifactHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		path         string
+		wantType     string
+		wantEncoding string
+	}{
+		{path: "/gitrepository/default/podinfo/latest.tar.gz", wantType: "application/gzip"},
+		{path: "/gitrepository/default/podinfo/latest.tar.zst", wantType: "application/x-tar", wantEncoding: "zstd"},
+		{path: "/helmchart/default/podinfo/podinfo-1.0.0.tgz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+		})
+	}
+}
+
+// BenchmarkStorage_Archive benchmarks the archiving of a large tree, with
+// 2000 files of 8KiB of YAML, for every encoding and gzip compression level.
+// The size of the artifact is reported as the 'bytes/artifact' metric.
+func BenchmarkStorage_Archive(b *testing.B) {
+	dir, err := createStoragePath()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(cleanupStoragePath(dir))
+
+	files := b.TempDir()
+	for i := 0; i < 2000; i++ {
+		var content bytes.Buffer
+		for content.Len() < 8<<10 {
+			fmt.Fprintf(&content, "- name: app-%d-%d\n  image: ghcr.io/stefanprodan/podinfo:%d.%d.%d\n", i, content.Len(), i%7, i%13, content.Len()%17)
+		}
+		p := filepath.Join(files, fmt.Sprintf("dir-%d", i%20), fmt.Sprintf("file-%d.yaml", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(p, content.Bytes(), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bm := range []struct {
+		name     string
+		encoding string
+		level    int
+	}{
+		{name: "gzip-none", encoding: ArchiveEncodingGzip, level: gzip.NoCompression},
+		{name: "gzip-speed", encoding: ArchiveEncodingGzip, level: gzip.BestSpeed},
+		{name: "gzip-default", encoding: ArchiveEncodingGzip, level: gzip.DefaultCompression},
+		{name: "gzip-best", encoding: ArchiveEncodingGzip, level: gzip.BestCompression},
+		{name: "zstd", encoding: ArchiveEncodingZstd, level: gzip.DefaultCompression},
+	} {
+		bm := bm
+		b.Run(bm.name, func(b *testing.B) {
+			storage, err := NewStorage(dir, "hostname", time.Minute)
+			if err != nil {
+				b.Fatalf("error while bootstrapping storage: %v", err)
+			}
+			storage.ArchiveEncoding = bm.encoding
+			storage.ArchiveCompressionLevel = bm.level
+			artifact := sourcev1.Artifact{
+				Path: filepath.Join("bench", bm.name, "artifact"+storage.ArchiveExtension()),
+			}
+			if err := storage.MkdirAll(artifact); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := storage.Archive(&artifact, files, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			fi, err := os.Stat(storage.LocalPath(artifact))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(fi.Size()), "bytes/artifact")
+		})
+	}
+}
+
+// newTestStorage returns a Storage in a new temporary directory, which is
+// removed at the end of the test.
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	return storage
+}
+
+func TestStorage_RotateWhileServing(t *testing.T) {
+	storage := newTestStorage(t)
+	// Previous artifacts are kept for the duration of the test, as readers
+	// may still download them.
+	storage.ArtifactRetentionRecords = 0
+	storage.ArtifactRetentionTTL = time.Hour
+
+	fs, err := NewArtifactServer(storage.BasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+
+	const size = 256 << 10
+	obj := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "default"}}
+
+	// publish writes an artifact with a content of the given revision, and
+	// returns the paths of the artifact and the latest symlink.
+	publish := func(revision int) (string, string, error) {
+		artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, obj, fmt.Sprint(revision), fmt.Sprintf("%d.tar.gz", revision))
+		if err := storage.MkdirAll(artifact); err != nil {
+			return "", "", err
+		}
+		content := bytes.Repeat([]byte{byte(revision)}, size)
+		if err := storage.AtomicWriteFile(&artifact, bytes.NewReader(content), 0644); err != nil {
+			return "", "", err
+		}
+		if _, err := storage.Symlink(artifact, "latest.tar.gz"); err != nil {
+			return "", "", err
+		}
+		if _, err := storage.GarbageCollect(artifact); err != nil {
+			return "", "", err
+		}
+		return "/" + artifact.Path, "/" + path.Join(path.Dir(artifact.Path), "latest.tar.gz"), nil
+	}
+
+	var advertised atomic.Value
+	artifactPath, latestPath, err := publish(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertised.Store(artifactPath)
+
+	// get downloads the given path and returns an error if the response is
+	// not the complete content of a single revision.
+	get := func(p string) error {
+		resp, err := http.Get(server.URL + p)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s: status %d", p, resp.StatusCode)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("GET %s: %w", p, err)
+		}
+		if len(b) != size {
+			return fmt.Errorf("GET %s: read %d bytes, want %d", p, len(b), size)
+		}
+		if bytes.Count(b, b[:1]) != size {
+			return fmt.Errorf("GET %s: content of multiple revisions", p)
+		}
+		return nil
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, p := range []string{advertised.Load().(string), latestPath} {
+					if err := get(p); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for revision := 1; revision < 100; revision++ {
+		p, _, err := publish(revision)
+		if err != nil {
+			close(done)
+			wg.Wait()
+			t.Fatal(err)
+		}
+		advertised.Store(p)
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
 }
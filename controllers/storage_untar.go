@@ -0,0 +1,236 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveEntryError is returned when extracting a tarball is aborted because an entry of the tarball would be written
+// outside of the target directory.
+type ArchiveEntryError struct {
+	// Name is the name of the offending entry.
+	Name string
+	// Reason describes why the entry was rejected.
+	Reason string
+}
+
+func (e *ArchiveEntryError) Error() string {
+	return fmt.Sprintf("unsafe archive entry '%s': %s", e.Name, e.Reason)
+}
+
+// extractTarball reads the uncompressed tarball from r and writes it into dir, while guarding against entries that
+// would be written outside of dir. It rejects entries with an absolute name or a parent directory reference, entries
+// that would be written through a symlink, hard links to anything but a regular file in dir, and symlinks that do not
+// resolve to a path in dir. Symlinks are created after all other entries, so that no entry can be written through
+// them. Directories, regular files, hard links and symlinks are extracted, extended headers are skipped, and any
+// other entry type is rejected.
+func extractTarball(r io.Reader, dir string) error {
+	t0 := time.Now()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	type symlink struct {
+		name, target string
+	}
+	var symlinks []symlink
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar error: %w", err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader, tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			continue
+		}
+
+		name, err := entryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			if hdr.Typeflag == tar.TypeDir {
+				continue
+			}
+			return &ArchiveEntryError{Name: hdr.Name, Reason: "not a directory"}
+		}
+		if err := checkNoSymlinks(dir, hdr.Name, name); err != nil {
+			return err
+		}
+		abs := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(abs, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+				return err
+			}
+			if err := extractFile(tr, hdr, abs, t0); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := entryName(hdr.Linkname)
+			if err != nil {
+				return &ArchiveEntryError{Name: hdr.Name, Reason: fmt.Sprintf("invalid hard link target '%s'", hdr.Linkname)}
+			}
+			if err := checkNoSymlinks(dir, hdr.Name, target); err != nil {
+				return err
+			}
+			targetAbs := filepath.Join(dir, filepath.FromSlash(target))
+			if fi, err := os.Lstat(targetAbs); err != nil || !fi.Mode().IsRegular() {
+				return &ArchiveEntryError{Name: hdr.Name, Reason: fmt.Sprintf("hard link target '%s' is not a regular file in the archive", hdr.Linkname)}
+			}
+			if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(targetAbs, abs); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if hdr.Linkname == "" || path.IsAbs(hdr.Linkname) || filepath.IsAbs(hdr.Linkname) || strings.Contains(hdr.Linkname, `\`) {
+				return &ArchiveEntryError{Name: hdr.Name, Reason: fmt.Sprintf("invalid symlink target '%s'", hdr.Linkname)}
+			}
+			if target := path.Join(path.Dir(name), hdr.Linkname); target == ".." || strings.HasPrefix(target, "../") {
+				return &ArchiveEntryError{Name: hdr.Name, Reason: fmt.Sprintf("symlink target '%s' is outside of the directory", hdr.Linkname)}
+			}
+			symlinks = append(symlinks, symlink{name: name, target: hdr.Linkname})
+		default:
+			return &ArchiveEntryError{Name: hdr.Name, Reason: fmt.Sprintf("unsupported entry type '%c'", hdr.Typeflag)}
+		}
+	}
+
+	if len(symlinks) == 0 {
+		return nil
+	}
+	for _, l := range symlinks {
+		if err := checkNoSymlinks(dir, l.name, l.name); err != nil {
+			return err
+		}
+		abs := filepath.Join(dir, filepath.FromSlash(l.name))
+		if _, err := os.Lstat(abs); err == nil {
+			return &ArchiveEntryError{Name: l.name, Reason: "symlink conflicts with another entry"}
+		}
+		if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(filepath.FromSlash(l.target), abs); err != nil {
+			return err
+		}
+	}
+
+	// A symlink that is within dir on its own may still point outside of dir
+	// through another symlink, the symlinks are therefore only accepted once
+	// they all exist and resolve to a path in dir.
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	for _, l := range symlinks {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(l.name)))
+		if err != nil {
+			return &ArchiveEntryError{Name: l.name, Reason: fmt.Sprintf("symlink target '%s' does not exist in the directory", l.target)}
+		}
+		if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return &ArchiveEntryError{Name: l.name, Reason: fmt.Sprintf("symlink target '%s' is outside of the directory", l.target)}
+		}
+	}
+	return nil
+}
+
+// extractFile writes the content of the current entry of tr with the given header to the given path. The permissions
+// of the file are limited to the permission bits of the header, and the modification time is clamped at t0.
+func extractFile(tr *tar.Reader, hdr *tar.Header, abs string, t0 time.Time) error {
+	f, err := os.OpenFile(abs, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, tr)
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing to %s: %w", hdr.Name, err)
+	}
+	if n != hdr.Size {
+		return fmt.Errorf("only wrote %d bytes to %s; expected %d", n, hdr.Name, hdr.Size)
+	}
+	modTime := hdr.ModTime
+	if modTime.After(t0) {
+		modTime = t0
+	}
+	if !modTime.IsZero() {
+		// A failure to set the modification time is benign, it is not relied on.
+		_ = os.Chtimes(abs, modTime, modTime)
+	}
+	return nil
+}
+
+// entryName returns the cleaned slash separated name of the given entry name, or an ArchiveEntryError if the name is
+// empty, absolute, or contains a parent directory reference or a backslash.
+func entryName(name string) (string, error) {
+	switch {
+	case name == "":
+		return "", &ArchiveEntryError{Name: name, Reason: "empty name"}
+	case path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "":
+		return "", &ArchiveEntryError{Name: name, Reason: "absolute name"}
+	case strings.Contains(name, `\`):
+		return "", &ArchiveEntryError{Name: name, Reason: "name contains a backslash"}
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", &ArchiveEntryError{Name: name, Reason: "name contains a parent directory reference"}
+		}
+	}
+	return path.Clean(name), nil
+}
+
+// checkNoSymlinks returns an ArchiveEntryError for the entry with the given name if any of the existing elements of
+// the given cleaned path in dir, including the last, is a symlink.
+func checkNoSymlinks(dir, entry, name string) error {
+	p := dir
+	for _, elem := range strings.Split(name, "/") {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return &ArchiveEntryError{Name: entry, Reason: "path is written through a symlink"}
+		}
+	}
+	return nil
+}
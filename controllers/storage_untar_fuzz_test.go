@@ -0,0 +1,102 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzExtractTarball extracts tarballs with fuzzed entry names and link targets, and fails if anything is written
+// outside of the target directory or if a symlink in the directory resolves outside of it.
+func FuzzExtractTarball(f *testing.F) {
+	f.Add("dir/file", "link", "dir/file", byte(tar.TypeSymlink))
+	f.Add("../escape", "link", "../../etc", byte(tar.TypeSymlink))
+	f.Add("link/file", "link", ".", byte(tar.TypeSymlink))
+	f.Add("file", "hardlink", "../outside/file", byte(tar.TypeLink))
+	f.Add("/abs", "a/b", "../../..", byte(tar.TypeSymlink))
+
+	f.Fuzz(func(t *testing.T, name, linkName, linkTarget string, linkType byte) {
+		if linkType != tar.TypeSymlink && linkType != tar.TypeLink {
+			linkType = tar.TypeSymlink
+		}
+		root := t.TempDir()
+		dir := filepath.Join(root, "a", "b", "unpack")
+		outside := filepath.Join(root, "a", "b", "outside")
+		if err := os.MkdirAll(outside, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(outside, "file"), []byte("outside"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range []*tar.Header{
+			{Name: linkName, Typeflag: linkType, Linkname: linkTarget},
+			{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+			{Name: name + "/" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		} {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := tw.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return
+		}
+
+		extractErr := extractTarball(bytes.NewReader(buf.Bytes()), dir)
+
+		if err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == root || p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+				// The symlinks of a tarball that was extracted must resolve
+				// to a path in the directory.
+				if extractErr == nil && fi.Mode()&os.ModeSymlink != 0 {
+					resolved, err := filepath.EvalSymlinks(p)
+					if err != nil || !strings.HasPrefix(resolved, dir+string(filepath.Separator)) && resolved != dir {
+						t.Errorf("symlink %s resolves to %s outside of the directory", p, resolved)
+					}
+				}
+				return nil
+			}
+			if rel, _ := filepath.Rel(root, p); rel != "a" && rel != filepath.Join("a", "b") && rel != filepath.Join("a", "b", "outside") && rel != filepath.Join("a", "b", "outside", "file") {
+				t.Errorf("%s was written outside of the directory", p)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(filepath.Join(outside, "file")); err != nil || string(b) != "outside" {
+			t.Errorf("file outside of the directory was modified: %q, %v", b, err)
+		}
+	})
+}
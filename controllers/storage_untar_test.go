@@ -0,0 +1,218 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a tarball written by writeTarball.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+// writeTarball returns an uncompressed tarball with the given entries.
+func writeTarball(t testing.TB, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644}
+		switch e.typeflag {
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.content))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTarball(t *testing.T) {
+	tests := []struct {
+		name      string
+		entries   []tarEntry
+		wantEntry string
+		wantFiles map[string]string
+	}{
+		{
+			name: "parent reference within the directory",
+			entries: []tarEntry{
+				{name: "./", typeflag: tar.TypeDir},
+				{name: "dir/", typeflag: tar.TypeDir},
+				{name: "dir/file", typeflag: tar.TypeReg, content: "file"},
+				{name: "dir/../other", typeflag: tar.TypeReg, content: "other"},
+			},
+			wantEntry: "dir/../other",
+		},
+		{
+			name: "regular files, links and symlinks",
+			entries: []tarEntry{
+				{name: "dir/file", typeflag: tar.TypeReg, content: "file"},
+				{name: "hardlink", typeflag: tar.TypeLink, linkname: "dir/file"},
+				{name: "symlink", typeflag: tar.TypeSymlink, linkname: "dir/file"},
+				{name: "dir/up", typeflag: tar.TypeSymlink, linkname: "../hardlink"},
+			},
+			wantFiles: map[string]string{"dir/file": "file", "hardlink": "file", "symlink": "file", "dir/up": "file"},
+		},
+		{
+			name:      "absolute name",
+			entries:   []tarEntry{{name: "/etc/cron.d/x", typeflag: tar.TypeReg, content: "x"}},
+			wantEntry: "/etc/cron.d/x",
+		},
+		{
+			name:      "parent traversal",
+			entries:   []tarEntry{{name: "../../etc/cron.d/x", typeflag: tar.TypeReg, content: "x"}},
+			wantEntry: "../../etc/cron.d/x",
+		},
+		{
+			name:      "backslash",
+			entries:   []tarEntry{{name: `..\x`, typeflag: tar.TypeReg, content: "x"}},
+			wantEntry: `..\x`,
+		},
+		{
+			name: "hard link outside of the directory",
+			entries: []tarEntry{
+				{name: "passwd", typeflag: tar.TypeLink, linkname: "../../etc/passwd"},
+			},
+			wantEntry: "passwd",
+		},
+		{
+			name: "hard link to an absolute path",
+			entries: []tarEntry{
+				{name: "passwd", typeflag: tar.TypeLink, linkname: "/etc/passwd"},
+			},
+			wantEntry: "passwd",
+		},
+		{
+			name: "hard link through a symlink",
+			entries: []tarEntry{
+				{name: "up", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "dir/file", typeflag: tar.TypeReg, content: "file"},
+				{name: "link", typeflag: tar.TypeLink, linkname: "up/dir/file"},
+			},
+			wantEntry: "link",
+		},
+		{
+			name: "absolute symlink",
+			entries: []tarEntry{
+				{name: "etc", typeflag: tar.TypeSymlink, linkname: "/etc"},
+			},
+			wantEntry: "etc",
+		},
+		{
+			name: "symlink outside of the directory",
+			entries: []tarEntry{
+				{name: "dir/etc", typeflag: tar.TypeSymlink, linkname: "../../etc"},
+			},
+			wantEntry: "dir/etc",
+		},
+		{
+			name: "symlink outside of the directory through another symlink",
+			entries: []tarEntry{
+				{name: "a/b/s", typeflag: tar.TypeSymlink, linkname: "d/../../../y"},
+				{name: "a/b/d", typeflag: tar.TypeSymlink, linkname: "../../x"},
+				{name: "x/", typeflag: tar.TypeDir},
+			},
+			wantEntry: "a/b/s",
+		},
+		{
+			name: "dangling symlink",
+			entries: []tarEntry{
+				{name: "missing", typeflag: tar.TypeSymlink, linkname: "does-not-exist"},
+			},
+			wantEntry: "missing",
+		},
+		{
+			name: "write through a symlink",
+			entries: []tarEntry{
+				{name: "dir", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "dir/file", typeflag: tar.TypeReg, content: "file"},
+			},
+			wantEntry: "dir",
+		},
+		{
+			name: "symlink then write through the symlink",
+			entries: []tarEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "target"},
+				{name: "link", typeflag: tar.TypeReg, content: "x"},
+			},
+			wantEntry: "link",
+		},
+		{
+			name:      "unsupported entry type",
+			entries:   []tarEntry{{name: "fifo", typeflag: tar.TypeFifo}},
+			wantEntry: "fifo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "a", "b", "unpack")
+
+			err := extractTarball(bytes.NewReader(writeTarball(t, tt.entries)), dir)
+			if tt.wantEntry == "" {
+				if err != nil {
+					t.Fatalf("extractTarball() error = %v", err)
+				}
+				for name, want := range tt.wantFiles {
+					if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+						t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+					}
+				}
+				return
+			}
+
+			var entryErr *ArchiveEntryError
+			if !errors.As(err, &entryErr) {
+				t.Fatalf("extractTarball() error = %v, want an ArchiveEntryError", err)
+			}
+			if entryErr.Name != tt.wantEntry {
+				t.Errorf("ArchiveEntryError.Name = %q, want %q", entryErr.Name, tt.wantEntry)
+			}
+			if err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if fi.Mode().IsRegular() && !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+					t.Errorf("file %s was written outside of the directory", p)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kuberecorder "k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/fluxcd/pkg/runtime/events"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+var (
+	// storageUsedBytesGauge is the used space of the file system of the
+	// storage.
+	storageUsedBytesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gotk_artifact_storage_used_bytes",
+			Help: "The used space in bytes of the file system of the artifact storage.",
+		},
+	)
+	// storageAvailableBytesGauge is the available space of the file system
+	// of the storage.
+	storageAvailableBytesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gotk_artifact_storage_available_bytes",
+			Help: "The available space in bytes of the file system of the artifact storage.",
+		},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(storageUsedBytesGauge, storageAvailableBytesGauge)
+}
+
+// storageUsage is the usage of the file system of the storage.
+type storageUsage struct {
+	used      uint64
+	available uint64
+}
+
+// percentage returns the used space as a percentage of the capacity, which is the used and available space.
+func (u storageUsage) percentage() float64 {
+	if u.used+u.available == 0 {
+		return 0
+	}
+	return float64(u.used) / float64(u.used+u.available) * 100
+}
+
+// StorageFullError is returned when the usage of the storage is above its HighWatermark, and no previous artifacts are
+// left to prune.
+type StorageFullError struct {
+	// Used and Available are the used and available space in bytes.
+	Used, Available uint64
+	// HighWatermark is the HighWatermark of the Storage.
+	HighWatermark int
+}
+
+func (e *StorageFullError) Error() string {
+	return fmt.Sprintf("storage full: %d bytes used and %d bytes available, above the high watermark of %d%%",
+		e.Used, e.Available, e.HighWatermark)
+}
+
+// ValidateHighWatermark returns an error if the HighWatermark is not a percentage.
+func (s *Storage) ValidateHighWatermark() error {
+	if s.HighWatermark < 0 || s.HighWatermark > 100 {
+		return fmt.Errorf("invalid storage high watermark '%d', must be a percentage between 0 and 100", s.HighWatermark)
+	}
+	return nil
+}
+
+// usage returns the usage of the file system of the BasePath, and records it in the storage usage metrics.
+func (s *Storage) usage() (storageUsage, error) {
+	fn := s.statfs
+	if fn == nil {
+		fn = statfs
+	}
+	u, err := fn(s.BasePath)
+	if err != nil {
+		return u, err
+	}
+	storageUsedBytesGauge.Set(float64(u.used))
+	storageAvailableBytesGauge.Set(float64(u.available))
+	return u, nil
+}
+
+// aboveHighWatermark returns true if the given usage of the storage is above the HighWatermark.
+func (s *Storage) aboveHighWatermark(u storageUsage) bool {
+	return s.HighWatermark > 0 && u.percentage() >= float64(s.HighWatermark)
+}
+
+// Prune removes the oldest artifacts of all sources in the BasePath, with their sidecar files, until the usage of the
+// storage is below the HighWatermark. The given artifacts, which are advertised in the status of the sources, and the
+// most recently written artifact of every source, which may not be advertised yet, are never removed. The retention
+// of the artifacts is not taken into account. It returns the paths of the removed files.
+func (s *Storage) Prune(advertised []sourcev1.Artifact) ([]string, error) {
+	keep := map[string]bool{}
+	for _, artifact := range advertised {
+		keep[s.LocalPath(artifact)] = true
+	}
+
+	// The directories of the artifacts are '<kind>/<namespace>/<name>'
+	dirs, err := filepath.Glob(filepath.Join(s.BasePath, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		dir    string
+		record *artifactRecord
+	}
+	var candidates []candidate
+	for _, dir := range dirs {
+		files, err := localStoredFiles(dir)
+		if err != nil {
+			continue
+		}
+		records := artifactRecords(files)
+		for i, r := range records {
+			if i == 0 || keep[filepath.Join(dir, r.name)] {
+				continue
+			}
+			candidates = append(candidates, candidate{dir: dir, record: r})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].record.modTime.Before(candidates[j].record.modTime)
+	})
+
+	var removed []string
+	for _, c := range candidates {
+		u, err := s.usage()
+		if err != nil {
+			return removed, err
+		}
+		if !s.aboveHighWatermark(u) {
+			break
+		}
+		for _, f := range c.record.files {
+			path := filepath.Join(c.dir, f.name)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			removed = append(removed, path)
+			recordGarbageCollection(f.size)
+		}
+		s.collectContent()
+	}
+	return removed, nil
+}
+
+// storagePruner prunes the Storage when its usage is above the HighWatermark, and emits a warning event for the
+// sources of which artifacts are pruned.
+type storagePruner struct {
+	client.Reader
+	Scheme                *runtime.Scheme
+	Storage               *Storage
+	EventRecorder         kuberecorder.EventRecorder
+	ExternalEventRecorder *events.Recorder
+}
+
+// ensureSpace prunes the Storage if its usage is above the HighWatermark. It returns a StorageFullError if the usage
+// is still above the HighWatermark after pruning. Failures to determine the usage are logged, and do not prevent the
+// artifacts from being written.
+func (p *storagePruner) ensureSpace(ctx context.Context) error {
+	log := ctrl.LoggerFrom(ctx).WithName("storage-pruner")
+
+	u, err := p.Storage.usage()
+	if err != nil {
+		log.Error(err, "unable to determine storage usage")
+		return nil
+	}
+	if !p.Storage.aboveHighWatermark(u) {
+		return nil
+	}
+
+	// Without the advertised artifacts, nothing can be pruned safely
+	sources, err := listSources(ctx, p)
+	if err != nil {
+		log.Error(err, "unable to list sources")
+		return &StorageFullError{Used: u.used, Available: u.available, HighWatermark: p.Storage.HighWatermark}
+	}
+	var advertised []sourcev1.Artifact
+	sourcesByDir := map[string][]artifactSource{}
+	for _, source := range sources {
+		if artifact := source.GetArtifact(); artifact != nil {
+			advertised = append(advertised, *artifact)
+			dir := filepath.Dir(p.Storage.LocalPath(*artifact))
+			sourcesByDir[dir] = append(sourcesByDir[dir], source)
+		}
+	}
+	removed, err := p.Storage.Prune(advertised)
+	if err != nil {
+		log.Error(err, "unable to prune storage")
+	}
+
+	prunedByDir := map[string]int{}
+	for _, path := range removed {
+		prunedByDir[filepath.Dir(path)]++
+	}
+	for dir, n := range prunedByDir {
+		msg := fmt.Sprintf("storage usage above the high watermark of %d%%: pruned %d files of previous artifacts",
+			p.Storage.HighWatermark, n)
+		for _, source := range sourcesByDir[dir] {
+			p.event(ctx, source, msg)
+		}
+	}
+	if len(removed) > 0 {
+		log.Info(fmt.Sprintf("Pruned %d files of previous artifacts", len(removed)), "highWatermark", p.Storage.HighWatermark)
+	}
+
+	if u, err = p.Storage.usage(); err == nil && p.Storage.aboveHighWatermark(u) {
+		return &StorageFullError{Used: u.used, Available: u.available, HighWatermark: p.Storage.HighWatermark}
+	}
+	return nil
+}
+
+// event emits a warning Kubernetes event and forwards the event to
+// notification controller if configured.
+func (p *storagePruner) event(ctx context.Context, source artifactSource, msg string) {
+	log := ctrl.LoggerFrom(ctx)
+
+	if p.EventRecorder != nil {
+		p.EventRecorder.Eventf(source, corev1.EventTypeWarning, events.EventSeverityError, msg)
+	}
+	if p.ExternalEventRecorder != nil {
+		objRef, err := reference.GetReference(p.Scheme, source)
+		if err != nil {
+			log.Error(err, "unable to send event")
+			return
+		}
+
+		if err := p.ExternalEventRecorder.Eventf(*objRef, nil, events.EventSeverityError, events.EventSeverityError, msg); err != nil {
+			log.Error(err, "unable to send event")
+			return
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// newSmallStorage returns a Storage on a file system with the given capacity in bytes, of which the files in the
+// storage are the only used space, like a small tmpfs mounted at the storage path.
+func newSmallStorage(t *testing.T, capacity uint64) *Storage {
+	t.Helper()
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	storage.statfs = func(path string) (storageUsage, error) {
+		var used uint64
+		if err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				used += uint64(fi.Size())
+			}
+			return err
+		}); err != nil {
+			return storageUsage{}, err
+		}
+		if used > capacity {
+			used = capacity
+		}
+		return storageUsage{used: used, available: capacity - used}, nil
+	}
+	return storage
+}
+
+// writeFixtureArtifacts writes an artifact of 100 bytes for every given name to the directory of the given source,
+// with a modification time that increases in the order of the names, and returns the artifacts.
+func writeFixtureArtifacts(t *testing.T, storage *Storage, kind string, obj metav1.Object, names ...string) []sourcev1.Artifact {
+	t.Helper()
+	var artifacts []sourcev1.Artifact
+	for i, name := range names {
+		artifact := storage.NewArtifactFor(kind, obj, name, name+".tar.gz")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(storage.LocalPath(artifact), make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(time.Duration(i-len(names)) * time.Hour)
+		if err := os.Chtimes(storage.LocalPath(artifact), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	return artifacts
+}
+
+func TestStorage_usage(t *testing.T) {
+	storage := newSmallStorage(t, 1000)
+	obj := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	writeFixtureArtifacts(t, storage, sourcev1.GitRepositoryKind, obj, "a", "b", "c")
+
+	u, err := storage.usage()
+	if err != nil {
+		t.Fatalf("usage() error = %v", err)
+	}
+	if u.used != 300 || u.available != 700 || u.percentage() != 30 {
+		t.Errorf("usage() = %+v (%v%%), want 300 bytes used and 700 bytes available (30%%)", u, u.percentage())
+	}
+	if got := testutil.ToFloat64(storageUsedBytesGauge); got != 300 {
+		t.Errorf("used bytes metric = %v, want 300", got)
+	}
+	if got := testutil.ToFloat64(storageAvailableBytesGauge); got != 700 {
+		t.Errorf("available bytes metric = %v, want 700", got)
+	}
+
+	// The usage of the file system of an actual storage path
+	fsStorage, err := NewStorage(t.TempDir(), "hostname", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := fsStorage.usage(); err != nil || u.used+u.available == 0 {
+		t.Errorf("usage() = %+v, %v, want the usage of the file system", u, err)
+	}
+}
+
+func TestStorage_Prune(t *testing.T) {
+	storage := newSmallStorage(t, 1000)
+	storage.HighWatermark = 50
+
+	repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	bucket := &sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"}}
+	// The artifact names are ordered by their modification time, across the
+	// sources: 'r-advertised' is the oldest artifact, and is advertised.
+	repositoryArtifacts := writeFixtureArtifacts(t, storage, sourcev1.GitRepositoryKind, repository,
+		"r-advertised", "r-previous-1", "r-previous-3", "r-newest")
+	bucketArtifacts := writeFixtureArtifacts(t, storage, sourcev1.BucketKind, bucket,
+		"b-previous-2", "b-advertised")
+	// Interleave the modification times of the previous artifacts
+	for _, tt := range []struct {
+		artifact sourcev1.Artifact
+		age      time.Duration
+	}{
+		{artifact: repositoryArtifacts[1], age: 30 * time.Hour},
+		{artifact: bucketArtifacts[0], age: 20 * time.Hour},
+		{artifact: repositoryArtifacts[2], age: 10 * time.Hour},
+	} {
+		modTime := time.Now().Add(-tt.age)
+		if err := os.Chtimes(storage.LocalPath(tt.artifact), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A sidecar is removed with its artifact
+	if err := os.WriteFile(storage.LocalPath(repositoryArtifacts[1])+".index", make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 700 bytes are used, pruning the two oldest previous artifacts, and the
+	// sidecar, is enough to reach the high watermark of 50%
+	advertised := []sourcev1.Artifact{repositoryArtifacts[0], bucketArtifacts[1]}
+	removed, err := storage.Prune(advertised)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	var names []string
+	for _, p := range removed {
+		names = append(names, filepath.Base(p))
+	}
+	if want := "r-previous-1.tar.gz r-previous-1.tar.gz.index b-previous-2.tar.gz"; strings.Join(names, " ") != want {
+		t.Errorf("Prune() removed %v, want %s", names, want)
+	}
+
+	// The advertised and newest artifacts are kept, even if the usage stays
+	// above the high watermark
+	storage.HighWatermark = 10
+	removed, err = storage.Prune(advertised)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if len(removed) != 1 || filepath.Base(removed[0]) != "r-previous-3.tar.gz" {
+		t.Errorf("Prune() removed %v, want only r-previous-3.tar.gz", removed)
+	}
+	for _, artifact := range []sourcev1.Artifact{repositoryArtifacts[0], repositoryArtifacts[3], bucketArtifacts[1]} {
+		if !storage.ArtifactExist(artifact) {
+			t.Errorf("artifact %s was pruned", artifact.Path)
+		}
+	}
+}
+
+func TestStoragePruner_ensureSpace(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("below the high watermark", func(t *testing.T) {
+		storage := newSmallStorage(t, 1000)
+		storage.HighWatermark = 90
+		repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+		artifacts := writeFixtureArtifacts(t, storage, sourcev1.GitRepositoryKind, repository, "previous", "current")
+		repository.Status.Artifact = &artifacts[1]
+
+		recorder := record.NewFakeRecorder(10)
+		pruner := &storagePruner{
+			Reader:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(repository).Build(),
+			Scheme:        scheme,
+			Storage:       storage,
+			EventRecorder: recorder,
+		}
+		if err := pruner.ensureSpace(context.TODO()); err != nil {
+			t.Fatalf("ensureSpace() error = %v", err)
+		}
+		if !storage.ArtifactExist(artifacts[0]) {
+			t.Error("previous artifact was pruned below the high watermark")
+		}
+		if len(recorder.Events) != 0 {
+			t.Errorf("emitted %d events, want none", len(recorder.Events))
+		}
+	})
+
+	t.Run("pruned below the high watermark", func(t *testing.T) {
+		storage := newSmallStorage(t, 400)
+		storage.HighWatermark = 80
+		repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+		artifacts := writeFixtureArtifacts(t, storage, sourcev1.GitRepositoryKind, repository, "previous-1", "previous-2", "current")
+		repository.Status.Artifact = &artifacts[2]
+		// The artifacts of another source are not pruned
+		chart := &sourcev1.HelmChart{ObjectMeta: metav1.ObjectMeta{Name: "chart", Namespace: "default"}}
+		chartArtifacts := writeFixtureArtifacts(t, storage, sourcev1.HelmChartKind, chart, "current")
+		chart.Status.Artifact = &chartArtifacts[0]
+
+		recorder := record.NewFakeRecorder(10)
+		pruner := &storagePruner{
+			Reader:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(repository, chart).Build(),
+			Scheme:        scheme,
+			Storage:       storage,
+			EventRecorder: recorder,
+		}
+		if err := pruner.ensureSpace(context.TODO()); err != nil {
+			t.Fatalf("ensureSpace() error = %v", err)
+		}
+		if storage.ArtifactExist(artifacts[0]) {
+			t.Error("oldest previous artifact was not pruned")
+		}
+		if !storage.ArtifactExist(artifacts[1]) {
+			t.Error("previous artifact was pruned once below the high watermark")
+		}
+		if len(recorder.Events) != 1 {
+			t.Fatalf("emitted %d events, want 1", len(recorder.Events))
+		}
+		if event := <-recorder.Events; !strings.HasPrefix(event, "Warning error ") || !strings.Contains(event, "pruned 1 files") {
+			t.Errorf("event = %q, want a warning of the error severity about the pruned files", event)
+		}
+	})
+
+	t.Run("storage full", func(t *testing.T) {
+		storage := newSmallStorage(t, 200)
+		storage.HighWatermark = 90
+		repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+		artifacts := writeFixtureArtifacts(t, storage, sourcev1.GitRepositoryKind, repository, "current", "newest")
+		repository.Status.Artifact = &artifacts[0]
+
+		pruner := &storagePruner{
+			Reader:  fake.NewClientBuilder().WithScheme(scheme).WithObjects(repository).Build(),
+			Scheme:  scheme,
+			Storage: storage,
+		}
+		err := pruner.ensureSpace(context.TODO())
+		var fullErr *StorageFullError
+		if !errors.As(err, &fullErr) {
+			t.Fatalf("ensureSpace() error = %v, want a StorageFullError", err)
+		}
+		if fullErr.Used != 200 || fullErr.Available != 0 || fullErr.HighWatermark != 90 {
+			t.Errorf("StorageFullError = %+v, want 200 bytes used and none available", fullErr)
+		}
+		for _, artifact := range artifacts {
+			if !storage.ArtifactExist(artifact) {
+				t.Errorf("artifact %s was pruned", artifact.Path)
+			}
+		}
+	})
+}
+
+func TestStorage_ValidateHighWatermark(t *testing.T) {
+	for _, tt := range []struct {
+		watermark int
+		wantErr   bool
+	}{
+		{watermark: 0},
+		{watermark: 90},
+		{watermark: 100},
+		{watermark: -1, wantErr: true},
+		{watermark: 101, wantErr: true},
+	} {
+		storage := &Storage{HighWatermark: tt.watermark}
+		if err := storage.ValidateHighWatermark(); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateHighWatermark() with %d error = %v, wantErr %v", tt.watermark, err, tt.wantErr)
+		}
+	}
+}
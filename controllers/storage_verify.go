@@ -0,0 +1,418 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kuberecorder "k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/events"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// DefaultArtifactChecksumInterval is the default interval at which the
+// artifacts are verified against their digest at the start of the
+// reconciliations.
+const DefaultArtifactChecksumInterval = time.Hour
+
+// corruptArtifactsCounter counts the corrupt artifacts found by the
+// verification of the storage.
+var corruptArtifactsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gotk_artifact_corrupt_total",
+		Help: "The number of corrupt artifacts found by the verification of the storage.",
+	},
+	[]string{"kind", "name", "namespace"},
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(corruptArtifactsCounter)
+}
+
+// ArtifactVerifier verifies the artifacts of all sources against their
+// checksum when the controller starts, and optionally at an interval. The
+// artifact of a source that is missing or does not match its checksum is
+// removed from the storage and the status of the source, and the
+// reconciliation of the source is requested to produce a new artifact.
+type ArtifactVerifier struct {
+	client.Client
+	Storage               *Storage
+	EventRecorder         kuberecorder.EventRecorder
+	ExternalEventRecorder *events.Recorder
+
+	// Interval is the interval of the verification after the verification at
+	// start. Zero disables the periodic verification.
+	Interval time.Duration
+
+	// RequeueLimiter limits the rate at which the reconciliation of sources
+	// with a corrupt artifact is requested, so that the upstreams of the
+	// sources are not hit all at once.
+	RequeueLimiter *rate.Limiter
+}
+
+// Start verifies the artifacts, and then at the interval until the given
+// context is done, it implements manager.Runnable.
+func (v *ArtifactVerifier) Start(ctx context.Context) error {
+	v.verify(ctx)
+	if v.Interval <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(v.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			v.verify(ctx)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the
+// verification only runs on the leader, which owns the storage.
+func (v *ArtifactVerifier) NeedLeaderElection() bool {
+	return true
+}
+
+// verify verifies the current artifacts of all sources that are not being
+// deleted, and heals the sources with a corrupt artifact. Failures are
+// logged, and retried at the next interval.
+func (v *ArtifactVerifier) verify(ctx context.Context) {
+	log := ctrl.LoggerFrom(ctx).WithName("artifact-verifier")
+
+	sources, err := listSources(ctx, v)
+	if err != nil {
+		log.Error(err, "unable to list sources")
+		return
+	}
+	for _, source := range sources {
+		if source.GetArtifact() == nil || !source.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+		verifyErr := v.Storage.VerifyArtifact(*source.GetArtifact())
+		if verifyErr == nil {
+			if err := v.backfillSize(ctx, source); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Error(err, "unable to record artifact size", "name", source.GetName(), "namespace", source.GetNamespace())
+			}
+			continue
+		}
+		if err := v.heal(ctx, source, verifyErr); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error(err, "unable to heal corrupt artifact", "name", source.GetName(), "namespace", source.GetNamespace())
+		}
+	}
+}
+
+// backfillSize records the size of the verified artifact of the given source
+// in its status, if the artifact was created by a previous version of the
+// controller without size. A source that has been modified since it was
+// listed is left untouched, its size is recorded at the next verification.
+func (v *ArtifactVerifier) backfillSize(ctx context.Context, source artifactSource) error {
+	if source.GetArtifact().Size != nil {
+		return nil
+	}
+	gvk, err := apiutil.GVKForObject(source, v.Scheme())
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(v.Storage.LocalPath(*source.GetArtifact()))
+	if err != nil {
+		return err
+	}
+
+	patch := client.MergeFromWithOptions(source.DeepCopyObject().(client.Object), client.MergeFromWithOptimisticLock{})
+	size := fi.Size()
+	source.GetArtifact().Size = &size
+	if err := v.Status().Patch(ctx, source, patch); err != nil {
+		if apierrors.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+	recordArtifactSize(gvk.Kind, source)
+	return nil
+}
+
+// heal removes the corrupt artifact of the given source from the status and
+// the storage, and requests the reconciliation of the source once allowed by
+// the RequeueLimiter. A source that has been modified since it was listed,
+// e.g. by a reconciliation that replaced the artifact, is left untouched.
+func (v *ArtifactVerifier) heal(ctx context.Context, source artifactSource, verifyErr error) error {
+	gvk, err := apiutil.GVKForObject(source, v.Scheme())
+	if err != nil {
+		return err
+	}
+	artifact := *source.GetArtifact()
+	msg := fmt.Sprintf("artifact verification failed, requesting reconciliation: %s", verifyErr.Error())
+
+	patch := client.MergeFromWithOptions(source.DeepCopyObject().(client.Object), client.MergeFromWithOptimisticLock{})
+	switch s := source.(type) {
+	case *sourcev1.Bucket:
+		s.Status.Artifact = nil
+	case *sourcev1.GitRepository:
+		s.Status.Artifact = nil
+	case *sourcev1.HelmChart:
+		s.Status.Artifact = nil
+	case *sourcev1.HelmRepository:
+		s.Status.Artifact = nil
+	case *sourcev1.OCIRepository:
+		s.Status.Artifact = nil
+	}
+	meta.SetResourceCondition(source, meta.ReadyCondition, metav1.ConditionFalse, sourcev1.StorageOperationFailedReason, msg)
+	inStorage := artifactNotInStorageCondition(artifact, verifyErr, source.GetGeneration())
+	apimeta.SetStatusCondition(source.GetStatusConditions(), inStorage)
+	if err := v.Status().Patch(ctx, source, patch); err != nil {
+		if apierrors.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+
+	corruptArtifactsCounter.WithLabelValues(gvk.Kind, source.GetName(), source.GetNamespace()).Inc()
+	v.event(ctx, source, msg)
+	if err := v.Storage.Remove(artifact); err != nil {
+		return err
+	}
+
+	if v.RequeueLimiter != nil {
+		if err := v.RequeueLimiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	patch = client.MergeFrom(source.DeepCopyObject().(client.Object))
+	annotations := source.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[meta.ReconcileRequestAnnotation] = time.Now().Format(time.RFC3339Nano)
+	source.SetAnnotations(annotations)
+	return v.Patch(ctx, source, patch)
+}
+
+// event emits a warning Kubernetes event and forwards the event to
+// notification controller if configured.
+func (v *ArtifactVerifier) event(ctx context.Context, source artifactSource, msg string) {
+	log := ctrl.LoggerFrom(ctx)
+
+	if v.EventRecorder != nil {
+		v.EventRecorder.Eventf(source, corev1.EventTypeWarning, events.EventSeverityError, msg)
+	}
+	if v.ExternalEventRecorder != nil {
+		objRef, err := reference.GetReference(v.Scheme(), source)
+		if err != nil {
+			log.Error(err, "unable to send event")
+			return
+		}
+
+		if err := v.ExternalEventRecorder.Eventf(*objRef, nil, events.EventSeverityError, events.EventSeverityError, msg); err != nil {
+			log.Error(err, "unable to send event")
+			return
+		}
+	}
+}
+
+// verifiedArtifacts are the artifact files verified against their digest, by
+// local path, with their size and modification time when they were verified.
+type verifiedArtifacts struct {
+	mu    sync.Mutex
+	files map[string]verifiedFile
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// verifiedFile is the size and modification time of a verified artifact
+// file, and the time of its verification.
+type verifiedFile struct {
+	size       int64
+	modTime    time.Time
+	verifiedAt time.Time
+}
+
+func newVerifiedArtifacts() *verifiedArtifacts {
+	return &verifiedArtifacts{files: map[string]verifiedFile{}, now: time.Now}
+}
+
+// fresh returns if the file at the given path with the given info was
+// verified within the given interval, and did not change since.
+func (v *verifiedArtifacts) fresh(path string, fi os.FileInfo, interval time.Duration) bool {
+	if v == nil || interval <= 0 {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	f, ok := v.files[path]
+	return ok && f.size == fi.Size() && f.modTime.Equal(fi.ModTime()) && v.now().Sub(f.verifiedAt) < interval
+}
+
+// record records the file at the given path as verified, if it exists.
+func (v *verifiedArtifacts) record(path string) {
+	if v == nil {
+		return
+	}
+	fi, err := os.Lstat(path)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err != nil {
+		delete(v.files, path)
+		return
+	}
+	v.files[path] = verifiedFile{size: fi.Size(), modTime: fi.ModTime(), verifiedAt: v.now()}
+}
+
+// forget removes the file at the given path from the verified files.
+func (v *verifiedArtifacts) forget(path string) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.files, path)
+}
+
+// checkArtifact returns an error if the given v1beta1.Artifact is missing
+// from the storage, or does not match its digest. The digest is only verified
+// if the artifact changed since its last verification, or at the
+// ArtifactChecksumInterval, the other checks only compare the size and
+// modification time of the artifact file with those of its last verification.
+// With a Backend, a missing or corrupt artifact is restored from the
+// Backend.
+func (s *Storage) checkArtifact(artifact sourcev1.Artifact) error {
+	localPath := s.LocalPath(artifact)
+	fi, err := os.Lstat(localPath)
+	switch {
+	case err == nil && s.verified.fresh(localPath, fi, s.ArtifactChecksumInterval):
+		return nil
+	case os.IsNotExist(err) && !s.ArtifactExist(artifact):
+		s.verified.forget(localPath)
+		return fmt.Errorf("artifact '%s' is missing from the storage: %w", artifact.Path, err)
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	if err := s.VerifyArtifact(artifact); err != nil {
+		s.verified.forget(localPath)
+		return err
+	}
+	s.verified.record(localPath)
+	return nil
+}
+
+// artifactInStorage verifies the given v1beta1.Artifact of a source at the
+// start of a reconciliation, and returns its ArtifactInStorageCondition for
+// the given generation of the source. A corrupt artifact is removed from the
+// storage, so that it is not served until the artifact is produced again.
+func (s *Storage) artifactInStorage(artifact *sourcev1.Artifact, generation int64) metav1.Condition {
+	if artifact == nil {
+		return metav1.Condition{
+			Type:               sourcev1.ArtifactInStorageCondition,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: generation,
+			Reason:             sourcev1.ArtifactMissingReason,
+			Message:            "no artifact",
+		}
+	}
+	err := s.checkArtifact(*artifact)
+	if err == nil {
+		return artifactInStorageCondition(*artifact, generation)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		if err := s.Remove(*artifact); err != nil && !os.IsNotExist(err) {
+			ctrl.Log.WithName("storage").Error(err, "unable to remove corrupt artifact", "path", artifact.Path)
+		}
+	}
+	return artifactNotInStorageCondition(*artifact, err, generation)
+}
+
+// recordArtifactInStorage sets the ArtifactInStorageCondition in the given
+// conditions of a source with the given generation after a reconciliation,
+// if the reconciliation wrote a new artifact, i.e. the given artifact after
+// the reconciliation differs from the given artifact before. The new
+// artifact is recorded as verified.
+func (s *Storage) recordArtifactInStorage(conditions *[]metav1.Condition, generation int64, before, after *sourcev1.Artifact) {
+	if after == nil || (before != nil && before.Path == after.Path && before.Checksum == after.Checksum &&
+		before.LastUpdateTime.Equal(&after.LastUpdateTime)) {
+		return
+	}
+	s.verified.record(s.LocalPath(*after))
+	setArtifactInStorage(conditions, artifactInStorageCondition(*after, generation))
+}
+
+// artifactInStorageCondition returns the 'True' ArtifactInStorageCondition
+// of the given v1beta1.Artifact for the given generation.
+func artifactInStorageCondition(artifact sourcev1.Artifact, generation int64) metav1.Condition {
+	return metav1.Condition{
+		Type:               sourcev1.ArtifactInStorageCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             sourcev1.ArtifactStoredReason,
+		Message:            fmt.Sprintf("artifact '%s' is in the storage", artifact.Path),
+	}
+}
+
+// artifactNotInStorageCondition returns the 'False'
+// ArtifactInStorageCondition of the given v1beta1.Artifact that failed the
+// verification with the given error, for the given generation.
+func artifactNotInStorageCondition(artifact sourcev1.Artifact, err error, generation int64) metav1.Condition {
+	reason := sourcev1.ArtifactCorruptReason
+	if errors.Is(err, os.ErrNotExist) {
+		reason = sourcev1.ArtifactMissingReason
+	}
+	return metav1.Condition{
+		Type:               sourcev1.ArtifactInStorageCondition,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            fmt.Sprintf("artifact '%s' failed the verification, producing it again: %s", artifact.Path, err.Error()),
+	}
+}
+
+// setArtifactInStorage sets the given ArtifactInStorageCondition in the given
+// conditions, and returns if it changed.
+func setArtifactInStorage(conditions *[]metav1.Condition, condition metav1.Condition) bool {
+	if c := apimeta.FindStatusCondition(*conditions, condition.Type); c != nil && c.Status == condition.Status &&
+		c.Reason == condition.Reason && c.Message == condition.Message && c.ObservedGeneration == condition.ObservedGeneration {
+		return false
+	}
+	apimeta.SetStatusCondition(conditions, condition)
+	return true
+}
@@ -0,0 +1,385 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+func TestArtifactVerifier_verify(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	// writeArtifact writes an artifact for the given source, and replaces
+	// its content with the given content if not nil.
+	writeArtifact := func(t *testing.T, kind string, obj metav1.Object, content []byte) *sourcev1.Artifact {
+		t.Helper()
+		artifact := storage.NewArtifactFor(kind, obj, "revision", "revision.tar.gz")
+		if err := storage.MkdirAll(artifact); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AtomicWriteFile(&artifact, strings.NewReader("artifact"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if content != nil {
+			if err := os.WriteFile(storage.LocalPath(artifact), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &artifact
+	}
+
+	repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	repository.Status.Artifact = writeArtifact(t, sourcev1.GitRepositoryKind, repository, nil)
+
+	// A truncated artifact
+	bucket := &sourcev1.Bucket{ObjectMeta: metav1.ObjectMeta{Name: "bucket", Namespace: "default"}}
+	bucket.Status.Artifact = writeArtifact(t, sourcev1.BucketKind, bucket, []byte("arti"))
+
+	// A missing artifact
+	chart := &sourcev1.HelmChart{ObjectMeta: metav1.ObjectMeta{Name: "chart", Namespace: "default"}}
+	chart.Status.Artifact = writeArtifact(t, sourcev1.HelmChartKind, chart, nil)
+	if err := os.Remove(storage.LocalPath(*chart.Status.Artifact)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A truncated artifact of an OCI repository
+	ociRepository := &sourcev1.OCIRepository{ObjectMeta: metav1.ObjectMeta{Name: "oci", Namespace: "default"}}
+	ociRepository.Status.Artifact = writeArtifact(t, sourcev1.OCIRepositoryKind, ociRepository, []byte("arti"))
+
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	v := &ArtifactVerifier{
+		Client:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(repository, bucket, chart, ociRepository).Build(),
+		Storage:       storage,
+		EventRecorder: recorder,
+	}
+
+	corrupt := testutil.ToFloat64(corruptArtifactsCounter.WithLabelValues(sourcev1.BucketKind, "bucket", "default"))
+	v.verify(context.TODO())
+
+	var gotRepository sourcev1.GitRepository
+	if err := v.Get(context.TODO(), client.ObjectKeyFromObject(repository), &gotRepository); err != nil {
+		t.Fatal(err)
+	}
+	if gotRepository.GetArtifact() == nil || !storage.ArtifactExist(*gotRepository.GetArtifact()) {
+		t.Error("valid artifact was removed")
+	}
+	if _, ok := gotRepository.GetAnnotations()[meta.ReconcileRequestAnnotation]; ok {
+		t.Error("reconciliation was requested for a valid artifact")
+	}
+
+	for _, tt := range []struct {
+		obj      artifactSource
+		key      client.ObjectKey
+		artifact sourcev1.Artifact
+		reason   string
+	}{
+		{obj: &sourcev1.Bucket{}, key: client.ObjectKeyFromObject(bucket), artifact: *bucket.Status.Artifact,
+			reason: sourcev1.ArtifactCorruptReason},
+		{obj: &sourcev1.HelmChart{}, key: client.ObjectKeyFromObject(chart), artifact: *chart.Status.Artifact,
+			reason: sourcev1.ArtifactMissingReason},
+		{obj: &sourcev1.OCIRepository{}, key: client.ObjectKeyFromObject(ociRepository), artifact: *ociRepository.Status.Artifact,
+			reason: sourcev1.ArtifactCorruptReason},
+	} {
+		obj, key, artifact := tt.obj, tt.key, tt.artifact
+		if err := v.Get(context.TODO(), key, obj); err != nil {
+			t.Fatal(err)
+		}
+		if obj.GetArtifact() != nil {
+			t.Errorf("%s artifact = %v, want nil", key, obj.GetArtifact())
+		}
+		c := apimeta.FindStatusCondition(*obj.GetStatusConditions(), meta.ReadyCondition)
+		if c == nil || c.Status != metav1.ConditionFalse || c.Reason != sourcev1.StorageOperationFailedReason {
+			t.Errorf("%s ready condition = %v, want false with reason %s", key, c, sourcev1.StorageOperationFailedReason)
+		}
+		c = apimeta.FindStatusCondition(*obj.GetStatusConditions(), sourcev1.ArtifactInStorageCondition)
+		if c == nil || c.Status != metav1.ConditionFalse || c.Reason != tt.reason {
+			t.Errorf("%s artifact in storage condition = %v, want false with reason %s", key, c, tt.reason)
+		}
+		if _, ok := obj.GetAnnotations()[meta.ReconcileRequestAnnotation]; !ok {
+			t.Errorf("%s reconciliation was not requested", key)
+		}
+		if storage.ArtifactExist(artifact) {
+			t.Errorf("%s corrupt artifact was not removed", key)
+		}
+	}
+
+	if got := testutil.ToFloat64(corruptArtifactsCounter.WithLabelValues(sourcev1.BucketKind, "bucket", "default")) - corrupt; got != 1 {
+		t.Errorf("corrupt artifacts metric increased by %v, want 1", got)
+	}
+	if got := len(recorder.Events); got != 3 {
+		t.Errorf("recorded %d events, want 3", got)
+	}
+	event := <-recorder.Events
+	if !strings.HasPrefix(event, "Warning error artifact verification failed") {
+		t.Errorf("event = %q, want a warning for the failed verification", event)
+	}
+}
+
+func TestArtifactVerifier_backfillSize(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	// An artifact written by a previous version of the controller, without
+	// size
+	repository := &sourcev1.OCIRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	artifact := storage.NewArtifactFor(sourcev1.OCIRepositoryKind, repository, "revision", "revision.tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&artifact, strings.NewReader("artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	artifact.Size = nil
+	repository.Status.Artifact = &artifact
+
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	v := &ArtifactVerifier{
+		Client:  fake.NewClientBuilder().WithScheme(scheme).WithObjects(repository).Build(),
+		Storage: storage,
+	}
+
+	v.verify(context.TODO())
+
+	var got sourcev1.OCIRepository
+	if err := v.Get(context.TODO(), client.ObjectKeyFromObject(repository), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetArtifact() == nil || got.GetArtifact().Size == nil || *got.GetArtifact().Size != int64(len("artifact")) {
+		t.Errorf("artifact = %v, want the size of the artifact file", got.GetArtifact())
+	}
+	if got.GetArtifact().Checksum != artifact.Checksum {
+		t.Errorf("artifact checksum = %q, want %q", got.GetArtifact().Checksum, artifact.Checksum)
+	}
+	if size := testutil.ToFloat64(artifactSizeGauge.WithLabelValues(sourcev1.OCIRepositoryKind, "repository", "default")); size != 8 {
+		t.Errorf("artifact size metric = %v, want 8", size)
+	}
+
+	// The source is not patched once its size is recorded
+	version := got.GetResourceVersion()
+	v.verify(context.TODO())
+	if err := v.Get(context.TODO(), client.ObjectKeyFromObject(repository), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetResourceVersion() != version {
+		t.Errorf("source with a size was patched, resource version %s, want %s", got.GetResourceVersion(), version)
+	}
+}
+
+func TestArtifactVerifier_healModified(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+
+	repository := &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "default"}}
+	artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, repository, "revision", "revision.tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&artifact, strings.NewReader("artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repository.Status.Artifact = &artifact
+
+	scheme := runtime.NewScheme()
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	v := &ArtifactVerifier{
+		Client:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(repository).Build(),
+		Storage:       storage,
+		EventRecorder: recorder,
+	}
+
+	// The source is modified after it was listed
+	var listed sourcev1.GitRepository
+	if err := v.Get(context.TODO(), client.ObjectKeyFromObject(repository), &listed); err != nil {
+		t.Fatal(err)
+	}
+	modified := listed.DeepCopy()
+	modified.Spec.Interval = metav1.Duration{Duration: time.Minute}
+	if err := v.Update(context.TODO(), modified); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.heal(context.TODO(), &listed, errors.New("checksum mismatch")); err != nil {
+		t.Fatalf("heal() error = %v", err)
+	}
+	var got sourcev1.GitRepository
+	if err := v.Get(context.TODO(), client.ObjectKeyFromObject(repository), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetArtifact() == nil {
+		t.Error("artifact of modified source was removed from the status")
+	}
+	if !storage.ArtifactExist(artifact) {
+		t.Error("artifact of modified source was removed from the storage")
+	}
+	if _, ok := got.GetAnnotations()[meta.ReconcileRequestAnnotation]; ok {
+		t.Error("reconciliation of modified source was requested")
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("recorded %d events, want none", len(recorder.Events))
+	}
+}
+
+func TestStorage_artifactInStorage(t *testing.T) {
+	dir, err := createStoragePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupStoragePath(dir))
+	storage, err := NewStorage(dir, "hostname", time.Minute)
+	if err != nil {
+		t.Fatalf("error while bootstrapping storage: %v", err)
+	}
+	now := time.Now()
+	storage.verified.now = func() time.Time { return now }
+
+	artifact := storage.NewArtifactFor(sourcev1.GitRepositoryKind, &metav1.ObjectMeta{Name: "podinfo", Namespace: "default"},
+		"revision", "revision.tar.gz")
+	if err := storage.MkdirAll(artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AtomicWriteFile(&artifact, strings.NewReader("artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	localPath := storage.LocalPath(artifact)
+
+	assertCondition := func(t *testing.T, c metav1.Condition, status metav1.ConditionStatus, reason string) {
+		t.Helper()
+		if c.Type != sourcev1.ArtifactInStorageCondition || c.Status != status || c.Reason != reason || c.ObservedGeneration != 2 {
+			t.Errorf("condition = %+v, want %s with reason %s for generation 2", c, status, reason)
+		}
+	}
+
+	assertCondition(t, storage.artifactInStorage(nil, 2), metav1.ConditionFalse, sourcev1.ArtifactMissingReason)
+	assertCondition(t, storage.artifactInStorage(&artifact, 2), metav1.ConditionTrue, sourcev1.ArtifactStoredReason)
+
+	// The content of an artifact that did not change in size and
+	// modification time since its verification is not read again within the
+	// checksum interval
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(localPath, []byte("artifacx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(localPath, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	assertCondition(t, storage.artifactInStorage(&artifact, 2), metav1.ConditionTrue, sourcev1.ArtifactStoredReason)
+
+	// The content is verified once the checksum interval elapsed, and the
+	// corrupt artifact is removed
+	now = now.Add(storage.ArtifactChecksumInterval)
+	assertCondition(t, storage.artifactInStorage(&artifact, 2), metav1.ConditionFalse, sourcev1.ArtifactCorruptReason)
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Errorf("corrupt artifact is not removed: %v", err)
+	}
+	assertCondition(t, storage.artifactInStorage(&artifact, 2), metav1.ConditionFalse, sourcev1.ArtifactMissingReason)
+
+	// A new artifact written by a reconciliation is in the storage, and not
+	// read again at the next reconciliation
+	next := artifact
+	if err := storage.AtomicWriteFile(&next, strings.NewReader("next"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var conditions []metav1.Condition
+	storage.recordArtifactInStorage(&conditions, 2, &artifact, &artifact)
+	if len(conditions) != 0 {
+		t.Errorf("conditions = %v, want none for an unchanged artifact", conditions)
+	}
+	storage.recordArtifactInStorage(&conditions, 2, nil, &next)
+	if c := apimeta.FindStatusCondition(conditions, sourcev1.ArtifactInStorageCondition); c == nil {
+		t.Fatal("artifact in storage condition is not set")
+	} else {
+		assertCondition(t, *c, metav1.ConditionTrue, sourcev1.ArtifactStoredReason)
+	}
+	if fi, err = os.Stat(localPath); err != nil {
+		t.Fatal(err)
+	}
+	if !storage.verified.fresh(localPath, fi, storage.ArtifactChecksumInterval) {
+		t.Error("new artifact is verified again at the next reconciliation")
+	}
+}
+
+func TestSetArtifactInStorage(t *testing.T) {
+	var conditions []metav1.Condition
+	missing := metav1.Condition{Type: sourcev1.ArtifactInStorageCondition, Status: metav1.ConditionFalse,
+		Reason: sourcev1.ArtifactMissingReason, Message: "no artifact"}
+	if !setArtifactInStorage(&conditions, missing) {
+		t.Error("new condition is not reported as a change")
+	}
+	if setArtifactInStorage(&conditions, missing) {
+		t.Error("same condition is reported as a change")
+	}
+	stored := metav1.Condition{Type: sourcev1.ArtifactInStorageCondition, Status: metav1.ConditionTrue,
+		Reason: sourcev1.ArtifactStoredReason, Message: "artifact 'a' is in the storage"}
+	if !setArtifactInStorage(&conditions, stored) || !apimeta.IsStatusConditionTrue(conditions, sourcev1.ArtifactInStorageCondition) {
+		t.Error("changed condition is not set")
+	}
+}
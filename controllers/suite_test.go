@@ -102,7 +102,8 @@ var _ = BeforeSuite(func(done Done) {
 	storage, err = NewStorage(tmpStoragePath, "localhost:5050", time.Second*30)
 	Expect(err).NotTo(HaveOccurred(), "failed to create tmp storage")
 	// serve artifacts from the filesystem, as done in main.go
-	fs := http.FileServer(http.Dir(tmpStoragePath))
+	fs, err := NewArtifactServer(tmpStoragePath)
+	Expect(err).NotTo(HaveOccurred(), "failed to create artifact server")
 	http.Handle("/", fs)
 	go http.ListenAndServe(":5050", nil)
 
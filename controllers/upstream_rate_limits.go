@@ -0,0 +1,184 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+var (
+	// upstreamRateLimitedCounter counts the reconciliations of the sources
+	// rejected by the rate limit of their upstream host, with an exemplar of
+	// the trace of the reconciliation, or else of the source.
+	upstreamRateLimitedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotk_source_upstream_rate_limited_total",
+			Help: "The number of reconciliations of the sources rejected by the rate limit of their upstream host, e.g. with 429 Too Many Requests.",
+		},
+		[]string{"host"},
+	)
+	// upstreamRateLimitRemainingGauge is the number of remaining requests of
+	// the rate limit of an upstream host.
+	upstreamRateLimitRemainingGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_source_upstream_rate_limit_remaining",
+			Help: "The number of remaining requests of the rate limit of the upstream host of the sources, as of the last reconciliation that observed it.",
+		},
+		[]string{"host"},
+	)
+	// upstreamRateLimitResetGauge is the time at which the rate limit of an
+	// upstream host is reset.
+	upstreamRateLimitResetGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotk_source_upstream_rate_limit_reset_timestamp_seconds",
+			Help: "The Unix time at which the rate limit of the upstream host of the sources is reset, as of the last reconciliation that observed it.",
+		},
+		[]string{"host"},
+	)
+)
+
+func init() {
+	crtlmetrics.Registry.MustRegister(upstreamRateLimitedCounter, upstreamRateLimitRemainingGauge, upstreamRateLimitResetGauge)
+}
+
+// upstreamRateLimit returns the rate limit of the upstream of a source
+// observed during its reconciliation, from the given RateLimits of the
+// requests of the reconciliation and the reconciliation error, nil if the
+// reconciliation was not rejected by a rate limit. The error of a client
+// that does not use the transport of the controller, e.g. of Helm or of
+// libgit2, is rate limited if it has a 429 status, without a reset time.
+func upstreamRateLimit(limits *transport.RateLimits, reconcileErr error) *transport.RateLimit {
+	if limit := limits.Limited(); limit != nil {
+		return limit
+	}
+	if reconcileErr != nil && containsAny(strings.ToLower(reconcileErr.Error()), "429 too many requests", "status code: 429") {
+		return &transport.RateLimit{Limited: true, Remaining: -1}
+	}
+	return nil
+}
+
+// recordUpstreamRateLimit records the rate limits observed during the
+// reconciliation of the given source of the given kind in the metrics of the
+// host of the given upstream URL, e.g. the URL of its spec, for the hosts of
+// the metrics to be bounded by the hosts of the sources. It delays the retry
+// of the source until the reset of the rate limit, and returns the
+// reconciliation error with the host and the time of the reset, if the
+// reconciliation was rejected by a rate limit.
+func recordUpstreamRateLimit(ctx context.Context, l *RetryLimiter, item interface{}, kind string, obj metav1.Object,
+	upstreamURL string, limits *transport.RateLimits, reconcileErr error) error {
+	host := upstreamHost(upstreamURL)
+	limit := upstreamRateLimit(limits, reconcileErr)
+	if host != "" {
+		remaining := -1
+		var reset time.Time
+		for _, observed := range limits.Observed() {
+			if observed.Remaining >= 0 && (remaining < 0 || observed.Remaining < remaining) {
+				remaining = observed.Remaining
+			}
+			if observed.Reset.After(reset) {
+				reset = observed.Reset
+			}
+		}
+		if remaining >= 0 {
+			upstreamRateLimitRemainingGauge.WithLabelValues(host).Set(float64(remaining))
+		}
+		if !reset.IsZero() {
+			upstreamRateLimitResetGauge.WithLabelValues(host).Set(float64(reset.Unix()))
+		}
+		if limit != nil {
+			counter := upstreamRateLimitedCounter.WithLabelValues(host)
+			if exemplar := rateLimitExemplar(ctx, kind, obj); exemplar != nil {
+				counter.(prometheus.ExemplarAdder).AddWithExemplar(1, exemplar)
+			} else {
+				counter.Inc()
+			}
+		}
+	}
+
+	if limit == nil {
+		l.setRetryAfter(item, time.Time{})
+		return reconcileErr
+	}
+	l.setRetryAfter(item, limit.Reset)
+	if reconcileErr == nil {
+		return nil
+	}
+	if host == "" {
+		host = limit.Host
+	}
+	by := "the upstream"
+	if host != "" {
+		by = fmt.Sprintf("'%s'", host)
+	}
+	if limit.Reset.IsZero() {
+		return fmt.Errorf("%w, rate limited by %s", reconcileErr, by)
+	}
+	return fmt.Errorf("%w, rate limited by %s until %s", reconcileErr, by, limit.Reset.UTC().Format(time.RFC3339))
+}
+
+// rateLimitExemplar returns the exemplar of a rate limited reconciliation of
+// the given source of the given kind: the ID of the trace of the
+// reconciliation, or else the kind, namespace and name of the source, nil if
+// they exceed the size of an exemplar.
+func rateLimitExemplar(ctx context.Context, kind string, obj metav1.Object) prometheus.Labels {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return prometheus.Labels{"trace_id": sc.TraceID().String()}
+	}
+	source := fmt.Sprintf("%s/%s/%s", kind, obj.GetNamespace(), obj.GetName())
+	if utf8.RuneCountInString("source"+source) > prometheus.ExemplarMaxRunes {
+		return nil
+	}
+	return prometheus.Labels{"source": source}
+}
+
+// upstreamHost returns the host name of the given upstream URL, or of the
+// given endpoint or URL without a scheme, empty if it has none.
+func upstreamHost(upstreamURL string) string {
+	if upstreamURL == "" {
+		return ""
+	}
+	if !strings.Contains(upstreamURL, "://") {
+		// e.g. an endpoint 'minio:9000', or an SCP-like Git URL
+		// 'git@github.com:org/repo'
+		hostport := strings.SplitN(upstreamURL, "/", 2)[0]
+		if i := strings.LastIndex(hostport, "@"); i >= 0 {
+			hostport = hostport[i+1:]
+		}
+		if host, _, err := net.SplitHostPort(hostport); err == nil {
+			return host
+		}
+		return strings.Trim(hostport, "[]")
+	}
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+func TestUpstreamHost(t *testing.T) {
+	tests := map[string]string{
+		"":                                   "",
+		"https://github.com/fluxcd/flux2":    "github.com",
+		"ssh://git@github.com:22/org/repo":   "github.com",
+		"git@gitlab.com:org/repo.git":        "gitlab.com",
+		"oci://ghcr.io/org/app":              "ghcr.io",
+		"https://[::1]:8443/charts":          "::1",
+		"http://minio.minio.svc:9000/charts": "minio.minio.svc",
+		"minio.minio.svc:9000":               "minio.minio.svc",
+	}
+	for in, want := range tests {
+		if got := upstreamHost(in); got != want {
+			t.Errorf("upstreamHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRecordUpstreamRateLimit(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, limits := transport.WithRateLimits(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport.WithUserAgent(nil)}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	l := NewRetryLimiter(time.Second, time.Minute)
+	obj := &metav1.ObjectMeta{Namespace: "default", Name: "podinfo"}
+	host := "rate-limit.example.com"
+	before := testutil.ToFloat64(upstreamRateLimitedCounter.WithLabelValues(host))
+	fetchErr := errors.New("unable to clone")
+	err = recordUpstreamRateLimit(context.Background(), l, "item", sourcev1.GitRepositoryKind, obj,
+		"https://"+host+"/org/repo", limits, fetchErr)
+	if !errors.Is(err, fetchErr) || !strings.Contains(err.Error(), "rate limited by '"+host+"' until "+reset.UTC().Format(time.RFC3339)) {
+		t.Errorf("recordUpstreamRateLimit() error = %v, want the host and the reset", err)
+	}
+	if got := testutil.ToFloat64(upstreamRateLimitedCounter.WithLabelValues(host)); got != before+1 {
+		t.Errorf("rate limited counter = %v, want %v", got, before+1)
+	}
+	if got := testutil.ToFloat64(upstreamRateLimitRemainingGauge.WithLabelValues(host)); got != 0 {
+		t.Errorf("remaining gauge = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(upstreamRateLimitResetGauge.WithLabelValues(host)); got != float64(reset.Unix()) {
+		t.Errorf("reset gauge = %v, want %v", got, reset.Unix())
+	}
+	if delay := l.When("item"); delay < 59*time.Minute {
+		t.Errorf("When() of a rate limited item = %v, want the delay until the reset", delay)
+	}
+
+	// the 429 status of a client that does not use the transport of the
+	// controller is rate limited, without a reset
+	_, noLimits := transport.WithRateLimits(context.Background())
+	helmErr := errors.New("failed to fetch https://charts.example.com/index.yaml : 429 Too Many Requests")
+	err = recordUpstreamRateLimit(context.Background(), l, "item", sourcev1.HelmRepositoryKind, obj,
+		"https://charts.example.com", noLimits, helmErr)
+	if err == nil || !strings.HasSuffix(err.Error(), "rate limited by 'charts.example.com'") {
+		t.Errorf("recordUpstreamRateLimit() error = %v, want rate limited without a reset", err)
+	}
+	if delay := l.When("item"); delay > time.Minute {
+		t.Errorf("When() without a reset = %v, want the backoff", delay)
+	}
+
+	// a reconciliation that is not rate limited is left as is
+	if err := recordUpstreamRateLimit(context.Background(), l, "item", sourcev1.HelmRepositoryKind, obj,
+		"https://charts.example.com", noLimits, fetchErr); err != fetchErr {
+		t.Errorf("recordUpstreamRateLimit() error = %v, want %v", err, fetchErr)
+	}
+}
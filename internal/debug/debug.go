@@ -0,0 +1,83 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package debug serves the debug endpoints of the controller, the profiles
+// of net/http/pprof and the reconciliations in progress. The endpoints are
+// for debugging only, they are served on the metrics listener to the
+// requests from a loopback address, e.g. through a port-forward to the pod.
+package debug
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+const (
+	// PprofPath is the path of the index of the pprof profiles.
+	PprofPath = "/debug/pprof/"
+	// ReconcilesPath is the path of the reconciliations in progress.
+	ReconcilesPath = "/debug/reconciles"
+)
+
+// Registrar registers the handlers of extra paths on a listener, e.g. the
+// metrics listener of a manager.
+type Registrar interface {
+	AddMetricsExtraHandler(path string, handler http.Handler) error
+}
+
+// SetupHandlers registers the debug endpoints with the given Registrar,
+// serving the reconciliations in progress with the given handler.
+func SetupHandlers(r Registrar, reconciles http.Handler) error {
+	endpoints := map[string]http.Handler{
+		PprofPath:             http.HandlerFunc(pprof.Index),
+		PprofPath + "cmdline": http.HandlerFunc(pprof.Cmdline),
+		PprofPath + "profile": http.HandlerFunc(pprof.Profile),
+		PprofPath + "symbol":  http.HandlerFunc(pprof.Symbol),
+		PprofPath + "trace":   http.HandlerFunc(pprof.Trace),
+		ReconcilesPath:        reconciles,
+	}
+	for path, h := range endpoints {
+		if err := r.AddMetricsExtraHandler(path, LoopbackOnly(h)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoopbackOnly returns the given handler, restricted to the requests from a
+// loopback address. The other requests are not found, as if the endpoint was
+// not enabled.
+func LoopbackOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopback(r.RemoteAddr) {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback returns if the host of the given address is a loopback IP
+// address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
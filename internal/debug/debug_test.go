@@ -0,0 +1,124 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package debug
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveMux registers the extra handlers on a http.ServeMux, as the metrics
+// listener of a manager.
+type serveMux struct {
+	*http.ServeMux
+}
+
+func (m serveMux) AddMetricsExtraHandler(path string, h http.Handler) error {
+	m.Handle(path, h)
+	return nil
+}
+
+// newMetricsServer returns a server of metrics, with the debug endpoints if
+// enabled.
+func newMetricsServer(t *testing.T, enabled bool) *httptest.Server {
+	t.Helper()
+	mux := serveMux{http.NewServeMux()}
+	mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "gotk_sources 1")
+	}))
+	if enabled {
+		reconciles := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			io.WriteString(w, `[{"kind":"GitRepository"}]`)
+		})
+		if err := SetupHandlers(mux, reconciles); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSetupHandlers(t *testing.T) {
+	tests := []struct {
+		path     string
+		contains string
+	}{
+		{PprofPath, "goroutine"},
+		{PprofPath + "goroutine?debug=1", "goroutine profile"},
+		{PprofPath + "cmdline", ""},
+		{ReconcilesPath, "GitRepository"},
+	}
+	for _, enabled := range []bool{true, false} {
+		server := newMetricsServer(t, enabled)
+		for _, tt := range tests {
+			resp, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			want := http.StatusNotFound
+			if enabled {
+				want = http.StatusOK
+			}
+			if resp.StatusCode != want {
+				t.Errorf("status of %s with enabled %v = %d, want %d", tt.path, enabled, resp.StatusCode, want)
+			}
+			if enabled && !strings.Contains(string(body), tt.contains) {
+				t.Errorf("body of %s does not contain %q", tt.path, tt.contains)
+			}
+		}
+
+		// The metrics are served regardless of the debug endpoints
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status of the metrics with enabled %v = %d, want %d", enabled, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+func TestLoopbackOnly(t *testing.T) {
+	h := LoopbackOnly(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"127.0.0.1:43210", http.StatusOK},
+		{"[::1]:43210", http.StatusOK},
+		{"10.0.0.1:43210", http.StatusNotFound},
+		{"[fd00::1]:43210", http.StatusNotFound},
+		{"invalid", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, PprofPath, nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("status from %s = %d, want %d", tt.remoteAddr, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Policy is the policy of the outbound connections of the controller to the
+// endpoints of the sources, e.g. to keep tenants from fetching from the
+// metadata service of the cloud provider or from other internal hosts.
+//
+// A rule is a host name, e.g. 'metadata.google.internal', a wildcard of the
+// subdomains of a host name, e.g. '*.internal', an IP address, or a CIDR,
+// e.g. '169.254.0.0/16'. A connection is denied if its host name or the
+// address it resolved to matches a deny rule. When the policy has allow
+// rules, a connection is also denied unless its host name or the address it
+// resolved to matches an allow rule.
+type Policy struct {
+	// Allow are the rules of the hosts the sources may connect to, all the
+	// hosts that are not denied if it is empty.
+	Allow []string `json:"allow,omitempty"`
+
+	// Deny are the rules of the hosts the sources may not connect to, they
+	// take precedence over the Allow rules.
+	Deny []string `json:"deny,omitempty"`
+
+	allow, deny []rule
+}
+
+// rule is a compiled rule of a Policy.
+type rule struct {
+	text string
+	// host is the lower case host name, with a '*.' prefix for a wildcard.
+	host string
+	cidr *net.IPNet
+}
+
+// NewPolicy returns the Policy of the given allow and deny rules, or an error
+// if one of them is invalid.
+func NewPolicy(allow, deny []string) (*Policy, error) {
+	p := &Policy{Allow: allow, Deny: deny}
+	var err error
+	if p.allow, err = compileRules(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = compileRules(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPolicy returns the Policy of the given YAML or JSON file.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode the egress policy of '%s': %w", path, err)
+	}
+	policy, err := NewPolicy(p.Allow, p.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress policy '%s': %w", path, err)
+	}
+	return policy, nil
+}
+
+func compileRules(texts []string) ([]rule, error) {
+	rules := make([]rule, 0, len(texts))
+	for _, text := range texts {
+		r := rule{text: text}
+		switch {
+		case strings.Contains(text, "/"):
+			_, cidr, err := net.ParseCIDR(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule '%s': %w", text, err)
+			}
+			r.cidr = cidr
+		case net.ParseIP(text) != nil:
+			ip := net.ParseIP(text)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			r.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		default:
+			r.host = strings.ToLower(strings.TrimSuffix(text, "."))
+			if !validHostPattern(r.host) {
+				return nil, fmt.Errorf("invalid rule '%s': must be a host name, a '*.' wildcard of the subdomains of a host name, an IP address or a CIDR", text)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// validHostPattern returns if the given lower case pattern is a host name,
+// optionally prefixed with a '*.' wildcard.
+func validHostPattern(pattern string) bool {
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchHost returns if the rule matches the given lower case host name.
+func (r rule) matchHost(host string) bool {
+	if r.host == "" {
+		return false
+	}
+	if strings.HasPrefix(r.host, "*.") {
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return host == r.host
+}
+
+// matchIP returns if the rule matches the given IP address.
+func (r rule) matchIP(ip net.IP) bool {
+	return r.cidr != nil && ip != nil && r.cidr.Contains(ip)
+}
+
+// DeniedError is the error of a connection denied by a Policy.
+type DeniedError struct {
+	// Host is the host name of the connection.
+	Host string
+
+	// IP is the address the host name resolved to, if the connection was
+	// denied after it was resolved.
+	IP net.IP
+
+	// Rule is the rule which denied the connection, empty if it was denied
+	// as no allow rule matches it.
+	Rule string
+}
+
+func (e *DeniedError) Error() string {
+	addr := e.Host
+	if e.IP != nil && !e.IP.Equal(net.ParseIP(e.Host)) {
+		addr = fmt.Sprintf("%s (%s)", e.Host, e.IP)
+	}
+	if e.Rule == "" {
+		return fmt.Sprintf("connection to '%s' denied by the egress policy: no allow rule matches", addr)
+	}
+	return fmt.Sprintf("connection to '%s' denied by the egress policy rule '%s'", addr, e.Rule)
+}
+
+// IsDenied returns if the given error is, or wraps, a DeniedError.
+func IsDenied(err error) bool {
+	var deniedErr *DeniedError
+	return errors.As(err, &deniedErr)
+}
+
+// CheckHost checks the host name of a connection before it is resolved. It
+// returns a DeniedError if the host name matches a deny rule, or if it is an
+// IP address denied by CheckIP. The allow rules of a host name are checked by
+// CheckIP, as an allowed CIDR may match the address it resolves to. A nil
+// Policy allows all the connections.
+func (p *Policy) CheckHost(host string) error {
+	if p == nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(host, ip)
+	}
+	for _, r := range p.deny {
+		if r.matchHost(host) {
+			return &DeniedError{Host: host, Rule: r.text}
+		}
+	}
+	return nil
+}
+
+// CheckIP checks the connection to the given host name, at the given address
+// it resolved to. It returns a DeniedError if the host name or the address
+// matches a deny rule, or if the Policy has allow rules and neither matches
+// any of them. A nil Policy allows all the connections.
+func (p *Policy) CheckIP(host string, ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	for _, r := range p.deny {
+		if r.matchHost(host) || r.matchIP(ip) {
+			return &DeniedError{Host: host, IP: ip, Rule: r.text}
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, r := range p.allow {
+		if r.matchHost(host) || r.matchIP(ip) {
+			return nil
+		}
+	}
+	return &DeniedError{Host: host, IP: ip}
+}
+
+// CheckURL checks the host of the given URL, and all the addresses it
+// resolves to, for the clients of which the connections can not be checked
+// when they are dialed, e.g. as a proxy resolves the host. A host that can
+// not be resolved is checked by its name only: when the Policy has allow
+// rules, it is denied unless its name matches one of them, as it may resolve
+// to an address that is not allowed where it is connected to. A nil Policy
+// allows all the URLs.
+func (p *Policy) CheckURL(ctx context.Context, rawURL string) error {
+	if p == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	host := u.Hostname()
+	if err := p.CheckHost(host); err != nil {
+		return err
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return p.CheckIP(host, nil)
+	}
+	for _, addr := range addrs {
+		if err := p.CheckIP(host, addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	policyMu sync.RWMutex
+	policy   *Policy
+)
+
+// CurrentPolicy returns the Policy of the controller set with SetPolicy, nil
+// if it has none.
+func CurrentPolicy() *Policy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policy
+}
+
+// SetPolicy sets the Policy of the outbound connections of the controller to
+// the endpoints of the sources, nil to allow all the connections.
+func SetPolicy(p *Policy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy = p
+}
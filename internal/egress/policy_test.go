@@ -0,0 +1,186 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package egress
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		wantErr string
+	}{
+		{name: "valid", rules: []string{"github.com", "*.internal", "169.254.169.254", "10.0.0.0/8", "fd00::/8", "metadata.google.internal."}},
+		{name: "invalid CIDR", rules: []string{"10.0.0.0/33"}, wantErr: "invalid rule '10.0.0.0/33'"},
+		{name: "URL", rules: []string{"https://github.com"}, wantErr: "invalid rule 'https://github.com'"},
+		{name: "inner wildcard", rules: []string{"api.*.internal"}, wantErr: "invalid rule 'api.*.internal'"},
+		{name: "empty", rules: []string{""}, wantErr: "invalid rule ''"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicy(nil, tt.rules)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewPolicy() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewPolicy() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicy_CheckIP(t *testing.T) {
+	denyOnly, err := NewPolicy(nil, []string{"169.254.0.0/16", "metadata.google.internal", "*.svc.cluster.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowList, err := NewPolicy([]string{"*.github.com", "203.0.113.0/24"}, []string{"203.0.113.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		policy   *Policy
+		host     string
+		ip       string
+		wantRule string
+		wantDeny bool
+	}{
+		{name: "no policy", host: "169.254.169.254", ip: "169.254.169.254"},
+		{name: "public host", policy: denyOnly, host: "github.com", ip: "140.82.121.3"},
+		{name: "public name of a denied address", policy: denyOnly, host: "metadata.example.com", ip: "169.254.169.254",
+			wantDeny: true, wantRule: "169.254.0.0/16"},
+		{name: "IPv4-mapped IPv6 address", policy: denyOnly, host: "metadata.example.com", ip: "::ffff:169.254.169.254",
+			wantDeny: true, wantRule: "169.254.0.0/16"},
+		{name: "denied host", policy: denyOnly, host: "Metadata.Google.Internal.", ip: "10.0.0.1",
+			wantDeny: true, wantRule: "metadata.google.internal"},
+		{name: "denied subdomain", policy: denyOnly, host: "kube-dns.kube-system.svc.cluster.local", ip: "10.96.0.10",
+			wantDeny: true, wantRule: "*.svc.cluster.local"},
+		{name: "wildcard does not match the domain", policy: denyOnly, host: "svc.cluster.local", ip: "10.96.0.10"},
+		{name: "allowed host", policy: allowList, host: "api.github.com", ip: "140.82.121.6"},
+		{name: "allowed CIDR", policy: allowList, host: "charts.example.com", ip: "203.0.113.10"},
+		{name: "deny takes precedence", policy: allowList, host: "charts.example.com", ip: "203.0.113.1",
+			wantDeny: true, wantRule: "203.0.113.1"},
+		{name: "not allowed", policy: allowList, host: "gitlab.com", ip: "172.65.251.78", wantDeny: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.CheckIP(tt.host, net.ParseIP(tt.ip))
+			if !tt.wantDeny {
+				if err != nil {
+					t.Fatalf("CheckIP() error = %v", err)
+				}
+				return
+			}
+			deniedErr, ok := err.(*DeniedError)
+			if !ok {
+				t.Fatalf("CheckIP() error = %v, want a DeniedError", err)
+			}
+			if deniedErr.Rule != tt.wantRule {
+				t.Errorf("CheckIP() rule = %q, want %q", deniedErr.Rule, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestPolicy_CheckHost(t *testing.T) {
+	policy, err := NewPolicy([]string{"github.com", "10.0.0.0/8"}, []string{"*.internal", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the allow rules of a name are checked once it is resolved
+	if err := policy.CheckHost("gitlab.com"); err != nil {
+		t.Errorf("CheckHost(gitlab.com) error = %v, want nil", err)
+	}
+	if err := policy.CheckHost("metadata.internal"); !IsDenied(err) {
+		t.Errorf("CheckHost(metadata.internal) error = %v, want denied", err)
+	}
+	if err := policy.CheckHost("[10.0.0.1]"); !IsDenied(err) {
+		t.Errorf("CheckHost([10.0.0.1]) error = %v, want denied", err)
+	}
+	if err := policy.CheckHost("192.168.0.1"); !IsDenied(err) {
+		t.Errorf("CheckHost(192.168.0.1) error = %v, want not allowed", err)
+	}
+	if err := policy.CheckHost("10.0.0.2"); err != nil {
+		t.Errorf("CheckHost(10.0.0.2) error = %v, want nil", err)
+	}
+}
+
+func TestPolicy_CheckURL(t *testing.T) {
+	policy, err := NewPolicy(nil, []string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = policy.CheckURL(context.TODO(), "ssh://git@localhost:2222/org/repo")
+	if !IsDenied(err) || !strings.Contains(err.Error(), "connection to 'localhost (") {
+		t.Errorf("CheckURL() of a name resolving to a denied address error = %v, want denied", err)
+	}
+	if err := policy.CheckURL(context.TODO(), "https://[::1]/index.yaml"); !IsDenied(err) {
+		t.Errorf("CheckURL() of a denied address error = %v, want denied", err)
+	}
+	if err := policy.CheckURL(context.TODO(), "https://192.0.2.1/index.yaml"); err != nil {
+		t.Errorf("CheckURL() of an address that is not denied error = %v", err)
+	}
+	if err := policy.CheckURL(context.TODO(), "https://unresolvable.invalid/index.yaml"); err != nil {
+		t.Errorf("CheckURL() of an unresolvable name without allow rules error = %v", err)
+	}
+
+	// a name that can not be resolved must match an allow rule by its name
+	policy, err = NewPolicy([]string{"10.0.0.0/8", "*.allowed.invalid"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = policy.CheckURL(context.TODO(), "https://internal.invalid/index.yaml")
+	if !IsDenied(err) || err.Error() != "connection to 'internal.invalid' denied by the egress policy: no allow rule matches" {
+		t.Errorf("CheckURL() of an unresolvable name error = %v, want denied", err)
+	}
+	if err := policy.CheckURL(context.TODO(), "https://charts.allowed.invalid/index.yaml"); err != nil {
+		t.Errorf("CheckURL() of an allowed name error = %v", err)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("allow:\n- '*.github.com'\ndeny:\n- 169.254.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("LoadPolicy() error = %v", err)
+	}
+	if err := policy.CheckIP("api.github.com", net.ParseIP("169.254.169.254")); !IsDenied(err) {
+		t.Errorf("CheckIP() error = %v, want denied", err)
+	}
+
+	if err := os.WriteFile(path, []byte("deny:\n- 169.254.0.0/16\nignore:\n- github.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPolicy(path); err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Errorf("LoadPolicy() of an unknown field error = %v, want unknown field", err)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fips restricts the hashes of the controller to the algorithms
+// approved by FIPS 140, and isolates the MD5 and SHA-1 hashes that are still
+// required by the artifacts of previous versions and by external protocols.
+package fips
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// MD5 is the name of the MD5 algorithm.
+	MD5 = "md5"
+	// SHA1 is the name of the SHA-1 algorithm.
+	SHA1 = "sha1"
+)
+
+// enabled is 1 if the FIPS mode was enabled with SetEnabled, and 0 otherwise.
+var enabled int32
+
+// Enabled returns if the controller runs in FIPS mode: built with the 'fips'
+// tag, started with the 'fips140=on' or 'fips140=only' setting of the GODEBUG
+// environment variable, or enabled with SetEnabled.
+func Enabled() bool {
+	return buildTag || atomic.LoadInt32(&enabled) == 1 || godebugEnabled(os.Getenv("GODEBUG"))
+}
+
+// SetEnabled enables or disables the FIPS mode, which can not be disabled
+// when it is enabled by the build tag or by GODEBUG.
+func SetEnabled(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&enabled, i)
+}
+
+// godebugEnabled returns if the given GODEBUG value enables the FIPS 140 mode
+// of the Go cryptographic module.
+func godebugEnabled(godebug string) bool {
+	for _, setting := range strings.Split(godebug, ",") {
+		switch strings.TrimSpace(setting) {
+		case "fips140=on", "fips140=only":
+			return true
+		}
+	}
+	return false
+}
+
+// NotApprovedError is returned for a hash that is not approved by FIPS 140,
+// in FIPS mode.
+type NotApprovedError struct {
+	// Algorithm is the name of the hash.
+	Algorithm string
+	// Use is what the hash is used for.
+	Use string
+}
+
+func (e *NotApprovedError) Error() string {
+	return fmt.Sprintf("%s is not approved in FIPS mode, required for the %s", e.Algorithm, e.Use)
+}
+
+// Legacy returns a new hash of the given MD5 or SHA1 algorithm for the given
+// use, e.g. 'SSH host key fingerprint', which must be required by the
+// artifacts of previous versions or by an external protocol. It returns a
+// *NotApprovedError in FIPS mode.
+func Legacy(algorithm, use string) (hash.Hash, error) {
+	if Enabled() {
+		return nil, &NotApprovedError{Algorithm: algorithm, Use: use}
+	}
+	switch algorithm {
+	case MD5:
+		return md5.New(), nil
+	case SHA1:
+		return sha1.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported legacy hash algorithm '%s'", algorithm)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fips
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestGodebugEnabled(t *testing.T) {
+	tests := map[string]bool{
+		"":                           false,
+		"fips140=off":                false,
+		"fips140=on":                 true,
+		"http2client=0,fips140=only": true,
+		"fips140=debug":              false,
+	}
+	for in, want := range tests {
+		if got := godebugEnabled(in); got != want {
+			t.Errorf("godebugEnabled(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	defer SetEnabled(false)
+
+	if !buildTag && !godebugEnabled(os.Getenv("GODEBUG")) {
+		for _, algorithm := range []string{MD5, SHA1} {
+			if _, err := Legacy(algorithm, "test"); err != nil {
+				t.Errorf("Legacy(%q) error = %v", algorithm, err)
+			}
+		}
+		if _, err := Legacy("md4", "test"); err == nil {
+			t.Error("Legacy() of an unsupported algorithm returned no error")
+		}
+	}
+
+	SetEnabled(true)
+	if !Enabled() {
+		t.Fatal("Enabled() = false after SetEnabled(true)")
+	}
+	_, err := Legacy(SHA1, "SSH host key fingerprint")
+	var notApproved *NotApprovedError
+	if !errors.As(err, &notApproved) || notApproved.Algorithm != SHA1 {
+		t.Errorf("Legacy() in FIPS mode error = %v, want a NotApprovedError", err)
+	}
+}
@@ -17,8 +17,11 @@ limitations under the License.
 package helm
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"reflect"
+	"regexp"
+	"strings"
 
 	helmchart "helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
@@ -57,3 +60,54 @@ func OverwriteChartDefaultValues(chart *helmchart.Chart, data []byte) (bool, err
 	// This should never happen, helm charts must have a values.yaml file to be valid
 	return false, fmt.Errorf("failed to locate values file: %s", chartutil.ValuesfileName)
 }
+
+// ValuesDigestLength is the number of hexadecimal characters of the digest of
+// the values appended to a chart version by VersionWithValuesDigest.
+const ValuesDigestLength = 12
+
+// RevisionLength is the maximum number of characters of the revision
+// appended to a chart version by VersionWithRevision.
+const RevisionLength = 12
+
+// VersionWithValuesDigest returns the given chart version with the truncated
+// SHA-256 digest of the given default values appended as semver build
+// metadata, so that a chart packaged with different default values has a
+// different version. The digest is appended to the build metadata of the
+// version, if any.
+func VersionWithValuesDigest(version string, values []byte) string {
+	digest := fmt.Sprintf("%x", sha256.Sum256(values))[:ValuesDigestLength]
+	return versionWithBuildMetadata(version, digest)
+}
+
+// VersionWithRevision returns the given chart version with the given source
+// revision appended as semver build metadata, so that a chart packaged from
+// another revision of its source has a different version. Only the last
+// segment of the revision is appended, e.g. the commit SHA of a Git revision
+// '<branch>/<sha>', truncated to RevisionLength characters, with the
+// characters which are invalid in build metadata replaced with '-'.
+func VersionWithRevision(version, revision string) string {
+	if i := strings.LastIndex(revision, "/"); i >= 0 {
+		revision = revision[i+1:]
+	}
+	if len(revision) > RevisionLength {
+		revision = revision[:RevisionLength]
+	}
+	revision = invalidBuildMetadata.ReplaceAllString(revision, "-")
+	if revision == "" {
+		return version
+	}
+	return versionWithBuildMetadata(version, revision)
+}
+
+// invalidBuildMetadata matches the characters which are invalid in the
+// identifiers of semver build metadata.
+var invalidBuildMetadata = regexp.MustCompile(`[^0-9A-Za-z-]`)
+
+// versionWithBuildMetadata appends the given identifier to the build
+// metadata of the given version.
+func versionWithBuildMetadata(version, identifier string) string {
+	if strings.Contains(version, "+") {
+		return version + "." + identifier
+	}
+	return version + "+" + identifier
+}
@@ -18,8 +18,10 @@ package helm
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/Masterminds/semver/v3"
 	helmchart "helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
 )
@@ -111,3 +113,47 @@ func TestOverwriteChartDefaultValues(t *testing.T) {
 		})
 	}
 }
+
+func TestVersionWithValuesDigest(t *testing.T) {
+	values := []byte("replicaCount: 2")
+	got := VersionWithValuesDigest("0.1.0", values)
+	if !strings.HasPrefix(got, "0.1.0+") || len(got) != len("0.1.0+")+ValuesDigestLength {
+		t.Fatalf("VersionWithValuesDigest() = %q, want the digest as build metadata", got)
+	}
+	if _, err := semver.StrictNewVersion(got); err != nil {
+		t.Errorf("VersionWithValuesDigest() = %q, want a valid version: %v", got, err)
+	}
+	if again := VersionWithValuesDigest("0.1.0", values); again != got {
+		t.Errorf("VersionWithValuesDigest() = %q, want a stable version %q", again, got)
+	}
+	if other := VersionWithValuesDigest("0.1.0", []byte("replicaCount: 3")); other == got {
+		t.Errorf("VersionWithValuesDigest() of other values = %q, want another version", other)
+	}
+	withMetadata := VersionWithValuesDigest("0.1.0+build.1", values)
+	if want := "0.1.0+build.1." + strings.TrimPrefix(got, "0.1.0+"); withMetadata != want {
+		t.Errorf("VersionWithValuesDigest() with build metadata = %q, want %q", withMetadata, want)
+	}
+}
+
+func TestVersionWithRevision(t *testing.T) {
+	tests := []struct {
+		version  string
+		revision string
+		want     string
+	}{
+		{version: "0.1.0", revision: "main/6f5a3c1b2e4d8f9a0b1c2d3e4f5a6b7c8d9e0f1a", want: "0.1.0+6f5a3c1b2e4d"},
+		{version: "0.1.0", revision: "6f5a3c1b", want: "0.1.0+6f5a3c1b"},
+		{version: "0.1.0+build.1", revision: "v1.0.0/6f5a3c1b2e4d8f9a", want: "0.1.0+build.1.6f5a3c1b2e4d"},
+		{version: "0.1.0", revision: "release_1", want: "0.1.0+release-1"},
+		{version: "0.1.0", revision: "main/", want: "0.1.0"},
+	}
+	for _, tt := range tests {
+		got := VersionWithRevision(tt.version, tt.revision)
+		if got != tt.want {
+			t.Errorf("VersionWithRevision(%q, %q) = %q, want %q", tt.version, tt.revision, got, tt.want)
+		}
+		if _, err := semver.StrictNewVersion(got); err != nil {
+			t.Errorf("VersionWithRevision(%q, %q) = %q, want a valid version: %v", tt.version, tt.revision, got, err)
+		}
+	}
+}
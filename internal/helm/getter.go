@@ -17,14 +17,53 @@ limitations under the License.
 package helm
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
 	"helm.sh/helm/v3/pkg/getter"
 	corev1 "k8s.io/api/core/v1"
+
+	"github.com/fluxcd/source-controller/internal/egress"
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
 )
 
+// NewHTTPGetter returns a getter.NewHTTPGetter with the given options, which
+// sends the User-Agent of the controller instead of the User-Agent of Helm,
+// and checks the URL of every request against the egress policy of the
+// controller. The client of Helm can not be given the transport of the
+// controller, the redirects of the requests are therefore not checked.
+func NewHTTPGetter(options ...getter.Option) (getter.Getter, error) {
+	opts := append([]getter.Option{}, options...)
+	g, err := getter.NewHTTPGetter(append(opts, getter.WithUserAgent(transport.UserAgent()))...)
+	if err != nil {
+		return nil, err
+	}
+	return &egressGetter{Getter: g}, nil
+}
+
+// egressGetter is a getter.Getter which checks the URLs against the egress
+// policy of the controller.
+type egressGetter struct {
+	getter.Getter
+}
+
+// Get checks the given URL against the egress policy before it is fetched.
+func (g *egressGetter) Get(url string, options ...getter.Option) (*bytes.Buffer, error) {
+	if err := egress.CurrentPolicy().CheckURL(context.Background(), url); err != nil {
+		return nil, err
+	}
+	return g.Getter.Get(url, options...)
+}
+
 // ClientOptionsFromSecret constructs a getter.Option slice for the given secret.
 // It returns the slice, and a callback to remove temporary files.
 func ClientOptionsFromSecret(secret corev1.Secret) ([]getter.Option, func(), error) {
@@ -50,7 +89,8 @@ func ClientOptionsFromSecret(secret corev1.Secret) ([]getter.Option, func(), err
 // given v1.Secret and returns the result.
 //
 // Secrets with no username AND password are ignored, if only one is defined it
-// returns an error.
+// returns an error. It returns an error naming the suspected problem if the
+// encoding of either is mistaken, as detected by secretdata.CheckCredential.
 func BasicAuthFromSecret(secret corev1.Secret) (getter.Option, error) {
 	username, password := string(secret.Data["username"]), string(secret.Data["password"])
 	switch {
@@ -59,6 +99,11 @@ func BasicAuthFromSecret(secret corev1.Secret) (getter.Option, error) {
 	case username == "" || password == "":
 		return nil, fmt.Errorf("invalid '%s' secret data: required fields 'username' and 'password'", secret.Name)
 	}
+	for _, field := range []string{"username", "password"} {
+		if err := secretdata.CheckCredential(secret.Name, field, secret.Data[field]); err != nil {
+			return nil, err
+		}
+	}
 	return getter.WithBasicAuth(username, password), nil
 }
 
@@ -67,7 +112,9 @@ func BasicAuthFromSecret(secret corev1.Secret) (getter.Option, error) {
 // callback to remove the temporary TLS files.
 //
 // Secrets with no certFile, keyFile, AND caFile are ignored, if only a
-// certBytes OR keyBytes is defined it returns an error.
+// certBytes OR keyBytes is defined it returns an error. It returns an error
+// naming the suspected problem if the encoding of any of them is mistaken, as
+// detected by secretdata.CheckPEM.
 func TLSClientConfigFromSecret(secret corev1.Secret) (getter.Option, func(), error) {
 	certBytes, keyBytes, caBytes := secret.Data["certFile"], secret.Data["keyFile"], secret.Data["caFile"]
 	switch {
@@ -77,6 +124,11 @@ func TLSClientConfigFromSecret(secret corev1.Secret) (getter.Option, func(), err
 		return nil, nil, fmt.Errorf("invalid '%s' secret data: fields 'certFile' and 'keyFile' require each other's presence",
 			secret.Name)
 	}
+	for _, field := range []string{"certFile", "keyFile", "caFile"} {
+		if err := secretdata.CheckPEM(secret.Name, field, secret.Data[field]); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// create tmp dir for TLS files
 	tmp, err := os.MkdirTemp("", "helm-tls-"+secret.Name)
@@ -110,3 +162,124 @@ func TLSClientConfigFromSecret(secret corev1.Secret) (getter.Option, func(), err
 
 	return getter.WithTLSClientConfig(certFile, keyFile, caFile), cleanup, nil
 }
+
+// NewTransportGetter returns a getter.Getter for the repository with the
+// given URL, with a transport of the controller instead of the transport of
+// the getter of Helm, which can not be configured: of which the server is
+// addressed by the given name instead of the host of the URL, if any, as
+// described by transport.WithServerName, and which sends the requests
+// through the proxy of the given ProxyFunc instead of the proxy of the
+// environment, if not nil. The basic auth and TLS configuration are taken
+// from the given secret, which may be nil, in the same way as by
+// ClientOptionsFromSecret, the getter.Options given to Get are ignored.
+func NewTransportGetter(repositoryURL, serverName string, proxy transport.ProxyFunc, secret *corev1.Secret,
+	passCredentials bool, timeout time.Duration) (getter.Getter, error) {
+	u, err := url.Parse(repositoryURL)
+	if err != nil {
+		return nil, err
+	}
+	g := &transportGetter{url: u, passCredentials: passCredentials}
+	var config *tls.Config
+	if secret != nil {
+		g.username, g.password = string(secret.Data["username"]), string(secret.Data["password"])
+		if (g.username == "") != (g.password == "") {
+			return nil, fmt.Errorf("invalid '%s' secret data: required fields 'username' and 'password'", secret.Name)
+		}
+		for _, field := range []string{"username", "password"} {
+			if err := secretdata.CheckCredential(secret.Name, field, secret.Data[field]); err != nil {
+				return nil, err
+			}
+		}
+		if config, err = transport.TLSConfigFromSecret(secret); err != nil {
+			return nil, err
+		}
+		certBytes, keyBytes := secret.Data["certFile"], secret.Data["keyFile"]
+		if (len(certBytes) > 0) != (len(keyBytes) > 0) {
+			return nil, fmt.Errorf("invalid '%s' secret data: fields 'certFile' and 'keyFile' require each other's presence",
+				secret.Name)
+		}
+		if len(certBytes) > 0 {
+			cert, err := tls.X509KeyPair(certBytes, keyBytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s' secret data: %w%s%s", secret.Name, err,
+					secretdata.Hint("certFile", certBytes), secretdata.Hint("keyFile", keyBytes))
+			}
+			if config == nil {
+				config = &tls.Config{}
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+	}
+	t := transport.NewProxyTransport(config, proxy)
+	// the chart archives are stored as served, as by the getter of Helm
+	t.DisableCompression = true
+	var rt http.RoundTripper = t
+	if serverName != "" {
+		rt = transport.WithServerName(t, u.Host, serverName)
+	}
+	g.client = &http.Client{
+		Transport: transport.WithUserAgent(rt),
+		Timeout:   timeout,
+	}
+	return g, nil
+}
+
+// transportGetter is a getter.Getter with the client of
+// NewTransportGetter.
+type transportGetter struct {
+	client             *http.Client
+	url                *url.URL
+	username, password string
+	passCredentials    bool
+}
+
+// Get fetches the given URL, with the basic auth credentials if the URL has
+// the scheme and host of the repository or the credentials are passed to any
+// host, as by the getter of Helm.
+func (g *transportGetter) Get(href string, _ ...getter.Option) (*bytes.Buffer, error) {
+	buf, _, err := g.GetIfModified(href, CacheValidators{})
+	return buf, err
+}
+
+// GetIfModified fetches the given URL as Get, conditionally on the given
+// validators of the last response, if any. It returns a nil buffer if the
+// server responds that the content is not modified, and the validators of
+// the response otherwise.
+func (g *transportGetter) GetIfModified(href string, validators CacheValidators) (*bytes.Buffer, CacheValidators, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return nil, CacheValidators{}, err
+	}
+	req, err := http.NewRequest(http.MethodGet, href, nil)
+	if err != nil {
+		return nil, CacheValidators{}, err
+	}
+	if g.username != "" && (g.passCredentials || (u.Scheme == g.url.Scheme && u.Host == g.url.Host)) {
+		req.SetBasicAuth(g.username, g.password)
+	}
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, CacheValidators{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && !validators.IsZero() {
+		return nil, validators, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, CacheValidators{}, fmt.Errorf("failed to fetch %s : %s", href, resp.Status)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, resp.Body); err != nil {
+		return nil, CacheValidators{}, err
+	}
+	return buf, CacheValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
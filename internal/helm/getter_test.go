@@ -17,9 +17,28 @@ limitations under the License.
 package helm
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"helm.sh/helm/v3/pkg/getter"
 	corev1 "k8s.io/api/core/v1"
+
+	"github.com/fluxcd/source-controller/internal/egress"
+	"github.com/fluxcd/source-controller/internal/transport"
 )
 
 var (
@@ -83,6 +102,9 @@ func TestBasicAuthFromSecret(t *testing.T) {
 		{"without username", basicAuthSecretFixture, func(s *corev1.Secret) { delete(s.Data, "username") }, true, true},
 		{"without password", basicAuthSecretFixture, func(s *corev1.Secret) { delete(s.Data, "password") }, true, true},
 		{"empty", corev1.Secret{}, nil, false, true},
+		{"username with a byte order mark", basicAuthSecretFixture, func(s *corev1.Secret) { s.Data["username"] = []byte("\xef\xbb\xbfuser") }, true, true},
+		{"password with a CRLF line ending", basicAuthSecretFixture, func(s *corev1.Secret) { s.Data["password"] = []byte("password\r\n") }, true, true},
+		{"password base64 encoded twice", basicAuthSecretFixture, func(s *corev1.Secret) { s.Data["password"] = []byte("cGFzc3dvcmQ=") }, false, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -116,6 +138,11 @@ func TestTLSClientConfigFromSecret(t *testing.T) {
 		{"without keyFile", tlsSecretFixture, func(s *corev1.Secret) { delete(s.Data, "keyFile") }, true, true},
 		{"without caFile", tlsSecretFixture, func(s *corev1.Secret) { delete(s.Data, "caFile") }, false, false},
 		{"empty", corev1.Secret{}, nil, false, true},
+		{"certFile with a byte order mark", tlsSecretFixture, func(s *corev1.Secret) { s.Data["certFile"] = []byte("\xef\xbb\xbffixture") }, true, true},
+		{"keyFile with CRLF line endings", tlsSecretFixture, func(s *corev1.Secret) { s.Data["keyFile"] = []byte("fixture\r\n") }, true, true},
+		{"caFile base64 encoded twice", tlsSecretFixture, func(s *corev1.Secret) {
+			s.Data["caFile"] = []byte(base64.StdEncoding.EncodeToString([]byte("-----BEGIN CERTIFICATE-----\nZml4dHVyZQ==\n-----END CERTIFICATE-----\n")))
+		}, true, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -138,3 +165,216 @@ func TestTLSClientConfigFromSecret(t *testing.T) {
 		})
 	}
 }
+
+func TestNewHTTPGetter(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer server.Close()
+
+	g, err := NewHTTPGetter(getter.WithUserAgent("Helm/3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(server.URL + "/index.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if got != transport.UserAgent() {
+		t.Errorf("User-Agent = %q, want %q", got, transport.UserAgent())
+	}
+}
+
+func TestNewHTTPGetter_egressPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer server.Close()
+
+	policy, err := egress.NewPolicy(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress.SetPolicy(policy)
+	defer egress.SetPolicy(nil)
+
+	g, err := NewHTTPGetter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(server.URL + "/index.yaml"); !egress.IsDenied(err) {
+		t.Errorf("Get() error = %v, want denied by the egress policy", err)
+	}
+}
+
+func TestNewTransportGetter_serverName(t *testing.T) {
+	var host, sni, username string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, sni = r.Host, r.TLS.ServerName
+		username, _, _ = r.BasicAuth()
+		w.Write([]byte("apiVersion: v1"))
+	}))
+	certPEM, keyPEM := namedCertificate(t, "charts.internal.example.com")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+	secret := &corev1.Secret{Data: map[string][]byte{
+		"username": []byte("user"),
+		"password": []byte("password"),
+		"caFile":   certPEM,
+	}}
+
+	// the certificate is not valid for the address of the server
+	opts, cleanup, err := ClientOptionsFromSecret(*secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	g, err := NewHTTPGetter(append(opts, getter.WithURL(server.URL))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(server.URL + "/index.yaml"); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Get() without the server name error = %v, want a certificate error", err)
+	}
+
+	g, err = NewTransportGetter(server.URL, "charts.internal.example.com", nil, secret, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := g.Get(server.URL + "/index.yaml")
+	if err != nil {
+		t.Fatalf("Get() with the server name error = %v", err)
+	}
+	if b.String() != "apiVersion: v1" {
+		t.Errorf("Get() = %q, want the index", b.String())
+	}
+	u, _ := url.Parse(server.URL)
+	if want := "charts.internal.example.com:" + u.Port(); host != want || sni != "charts.internal.example.com" {
+		t.Errorf("expected Host %q and SNI of the server name, got %q and %q", want, host, sni)
+	}
+	if username != "user" {
+		t.Errorf("expected the credentials to be sent to the repository, got user %q", username)
+	}
+
+	// the certificate is verified against the server name
+	g, err = NewTransportGetter(server.URL, "git.internal.example.com", nil, secret, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(server.URL + "/index.yaml"); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Get() with another server name error = %v, want a certificate error", err)
+	}
+
+	// the credentials are checked as by ClientOptionsFromSecret
+	if _, err := NewTransportGetter(server.URL, "charts.internal.example.com", nil,
+		&corev1.Secret{Data: map[string][]byte{"certFile": certPEM}}, false, time.Minute); err == nil {
+		t.Error("NewTransportGetter() with a certFile and no keyFile error = nil, want an error")
+	}
+
+	// the mistakes in the encoding of the data are named by the errors
+	for _, tt := range []struct {
+		name    string
+		data    map[string][]byte
+		wantErr string
+	}{
+		{"username with a byte order mark", map[string][]byte{"username": []byte("\xef\xbb\xbfuser"), "password": []byte("password")},
+			"suspected a UTF-8 byte order mark in field 'username'"},
+		{"password with a CRLF line ending", map[string][]byte{"username": []byte("user"), "password": []byte("password\r\n")},
+			"suspected CRLF line endings in field 'password'"},
+		{"caFile base64 encoded twice", map[string][]byte{"caFile": []byte(base64.StdEncoding.EncodeToString(certPEM))},
+			"suspected a value base64 encoded twice in field 'caFile'"},
+		{"certFile with a byte order mark", map[string][]byte{"certFile": append([]byte("\xef\xbb\xbf"), certPEM...), "keyFile": keyPEM},
+			"suspected a UTF-8 byte order mark in field 'certFile'"},
+		{"keyFile base64 encoded twice", map[string][]byte{"certFile": certPEM, "keyFile": []byte(base64.StdEncoding.EncodeToString(keyPEM))},
+			"suspected a value base64 encoded twice in field 'keyFile'"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTransportGetter(server.URL, "charts.internal.example.com", nil,
+				&corev1.Secret{Data: tt.data}, false, time.Minute)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewTransportGetter() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the keys with CRLF line endings are tolerated
+	if _, err := NewTransportGetter(server.URL, "charts.internal.example.com", nil, &corev1.Secret{Data: map[string][]byte{
+		"certFile": bytes.ReplaceAll(certPEM, []byte("\n"), []byte("\r\n")),
+		"keyFile":  bytes.ReplaceAll(keyPEM, []byte("\n"), []byte("\r\n")),
+	}}, false, time.Minute); err != nil {
+		t.Errorf("NewTransportGetter() with CRLF line endings error = %v", err)
+	}
+}
+
+func TestNewTransportGetter_proxy(t *testing.T) {
+	var requestURL, username string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURL = r.URL.String()
+		username, _, _ = r.BasicAuth()
+		w.Write([]byte("apiVersion: v1"))
+	}))
+	defer proxy.Close()
+	proxyFunc, err := transport.ProxyFromSecret(&corev1.Secret{Data: map[string][]byte{
+		transport.ProxyAddressField: []byte(proxy.URL),
+		transport.ProxyNoProxyField: []byte("direct.example.com"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{Data: map[string][]byte{"username": []byte("user"), "password": []byte("password")}}
+
+	g, err := NewTransportGetter("http://charts.example.com", "", proxyFunc, secret, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := g.Get("http://charts.example.com/index.yaml")
+	if err != nil {
+		t.Fatalf("Get() through the proxy error = %v", err)
+	}
+	if b.String() != "apiVersion: v1" || requestURL != "http://charts.example.com/index.yaml" {
+		t.Errorf("Get() = %q with the proxy request %q, want the index through the proxy", b.String(), requestURL)
+	}
+	if username != "user" {
+		t.Errorf("expected the credentials to be sent to the repository, got user %q", username)
+	}
+
+	// the hosts of no_proxy are connected to directly
+	requestURL = ""
+	if _, err := g.Get("http://direct.example.com/index.yaml"); err == nil || requestURL != "" {
+		t.Errorf("Get() of a no_proxy host error = %v with the proxy request %q, want a direct connection", err, requestURL)
+	}
+}
+
+// namedCertificate returns a PEM encoded self-signed certificate and key for
+// the given DNS name only.
+func namedCertificate(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+	corev1 "k8s.io/api/core/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+	"github.com/fluxcd/source-controller/pkg/oci"
+)
+
+const (
+	// ChartLayerMediaType is the media type of the layer of a chart pushed
+	// to an OCI registry.
+	ChartLayerMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	// LegacyChartLayerMediaType is the media type of the layer of a chart
+	// pushed to an OCI registry by Helm before v3.7.
+	LegacyChartLayerMediaType = "application/tar+gzip"
+)
+
+// ValidateOCIChartRepository returns an error if the given URL of a
+// repository of charts in an OCI registry is not an 'oci://' URL of a host
+// and an optional path, or if the given Secret, which may be nil, has no
+// valid credentials or TLS configuration for the registry.
+func ValidateOCIChartRepository(repositoryURL string, secret *corev1.Secret) error {
+	u, err := url.Parse(repositoryURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "oci" || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid URL '%s': it must be in the form 'oci://<host>[/<path>]'", repositoryURL)
+	}
+	if _, err := oci.CredentialFromSecret(secret, u.Host); err != nil {
+		return err
+	}
+	if _, err := transport.TLSConfigFromSecret(secret); err != nil {
+		return err
+	}
+	_, err = transport.ClientCertificateFromSecret(secret)
+	return err
+}
+
+// OCIMirror is the mirror of the registry of a repository of charts, through
+// which the charts are pulled instead of from the registry of the repository
+// URL, as for an OCIRepository.
+type OCIMirror struct {
+	*oci.Mirror
+
+	// Secret has the credentials of the mirror, it may be nil.
+	Secret *corev1.Secret
+
+	// Fallback pulls the charts from the registry of the repository URL
+	// when the mirror misses them.
+	Fallback bool
+}
+
+// NewOCIChartRepository returns a ChartRepository for the chart with the
+// given name in the OCI registry at the given 'oci://' repository URL,
+// authorized with the given Secret, which may be nil, as by oci.NewClient,
+// and pulled through the given mirror of the registry, which may be nil.
+// As the registry has no index, the Index of the ChartRepository has the
+// tags of the chart which are semantic versions, with '_' read as '+' as
+// Helm replaces '+' with '_' when it pushes a chart. The Client pulls the
+// chart of a version of the Index with the given context.
+func NewOCIChartRepository(ctx context.Context, repositoryURL, name string, secret *corev1.Secret, mirror *OCIMirror) (*ChartRepository, error) {
+	chartURL := strings.TrimRight(repositoryURL, "/") + "/" + name
+	clients, err := newOCIClients(chartURL, secret, mirror)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	err = withOCIClient(clients, func(client *oci.Client) (err error) {
+		tags, err = client.Tags(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index := repo.NewIndexFile()
+	for _, tag := range tags {
+		version := strings.ReplaceAll(tag, "_", "+")
+		if _, err := semver.StrictNewVersion(version); err != nil {
+			continue
+		}
+		index.Entries[name] = append(index.Entries[name], &repo.ChartVersion{
+			Metadata: &helmchart.Metadata{APIVersion: helmchart.APIVersionV2, Name: name, Version: version},
+			URLs:     []string{chartURL + ":" + tag},
+		})
+	}
+	index.SortEntries()
+	return &ChartRepository{
+		URL:    repositoryURL,
+		Index:  index,
+		Client: &ociGetter{ctx: ctx, secret: secret, mirror: mirror},
+	}, nil
+}
+
+// newOCIClients returns the oci.Clients from which the chart of the given
+// 'oci://' URL is pulled in order: the client of the given mirror, if not
+// nil, and the client of the registry of the URL, authorized with the given
+// Secret, which may be nil, without a mirror or as the fallback of the
+// mirror.
+func newOCIClients(chartURL string, secret *corev1.Secret, mirror *OCIMirror) ([]*oci.Client, error) {
+	var clients []*oci.Client
+	if mirror != nil {
+		_, name, err := oci.ParseURL(chartURL)
+		if err != nil {
+			return nil, err
+		}
+		client, err := mirror.NewClient(name, mirror.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("mirror '%s' auth options error: %w", mirror.Mirror.Mirror, err)
+		}
+		clients = append(clients, client)
+		if !mirror.Fallback {
+			return clients, nil
+		}
+	}
+	client, err := oci.NewClient(sourcev1.OCIRepository{Spec: sourcev1.OCIRepositorySpec{URL: chartURL}}, secret)
+	if err != nil {
+		return nil, err
+	}
+	return append(clients, client), nil
+}
+
+// withOCIClient calls the given function with the given clients in order,
+// until it succeeds or fails with another error than a miss of the
+// registry, of which the next client is only tried for a mirror.
+func withOCIClient(clients []*oci.Client, fn func(*oci.Client) error) error {
+	var err error
+	for i, client := range clients {
+		if err = fn(client); err == nil || i == len(clients)-1 || !oci.IsNotFound(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// splitOCIChartURL returns the URL of the chart and the reference of the
+// given URL in the form 'oci://<host>/<path>/<chart>:<tag>' or
+// 'oci://<host>/<path>/<chart>@<digest>'.
+func splitOCIChartURL(href string) (string, string, error) {
+	if i := strings.LastIndex(href, "@"); i > strings.LastIndex(href, "/") {
+		return href[:i], href[i+1:], nil
+	}
+	i := strings.LastIndex(href, ":")
+	if i < strings.LastIndex(href, "/") {
+		return "", "", fmt.Errorf("invalid chart URL '%s': it has no tag", href)
+	}
+	return href[:i], href[i+1:], nil
+}
+
+// OCIChart is a version of a chart in an OCI registry resolved to the digest
+// of its manifest.
+type OCIChart struct {
+	// Version is a copy of the resolved chart version, of which the URL
+	// pulls the manifest of the Digest instead of the tag, for the pulled
+	// chart to be the resolved one even if the tag is pushed again.
+	Version *repo.ChartVersion
+
+	// Digest is the digest of the manifest of the chart.
+	Digest string
+
+	// Client is the oci.Client of the repository of the chart, e.g. to
+	// pull the signatures of the manifest.
+	Client *oci.Client
+}
+
+// ResolveOCIChart resolves the tag of the given version of a chart of a
+// ChartRepository returned by NewOCIChartRepository to the digest of its
+// manifest, in the registry authorized with the given Secret, which may be
+// nil, or in the given mirror of the registry, which may be nil.
+func ResolveOCIChart(ctx context.Context, cv *repo.ChartVersion, secret *corev1.Secret, mirror *OCIMirror) (*OCIChart, error) {
+	if len(cv.URLs) == 0 {
+		return nil, fmt.Errorf("chart '%s' version '%s' has no downloadable URLs", cv.Name, cv.Version)
+	}
+	chartURL, ref, err := splitOCIChartURL(cv.URLs[0])
+	if err != nil {
+		return nil, err
+	}
+	clients, err := newOCIClients(chartURL, secret, mirror)
+	if err != nil {
+		return nil, err
+	}
+	var client *oci.Client
+	var digest string
+	err = withOCIClient(clients, func(c *oci.Client) (err error) {
+		_, digest, err = c.Manifest(ctx, ref)
+		client = c
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	pinned := *cv
+	pinned.URLs = []string{chartURL + "@" + digest}
+	return &OCIChart{Version: &pinned, Digest: digest, Client: client}, nil
+}
+
+// ociGetter is a getter.Getter which pulls the charts of the URLs in the form
+// 'oci://<host>/<path>/<chart>:<tag>' or 'oci://<host>/<path>/<chart>@<digest>'
+// from an OCI registry.
+type ociGetter struct {
+	ctx    context.Context
+	secret *corev1.Secret
+	mirror *OCIMirror
+}
+
+// Get pulls the chart layer of the manifest of the tag or digest of the
+// given URL. The content of the layer is verified against its digest.
+func (g *ociGetter) Get(href string, _ ...getter.Option) (*bytes.Buffer, error) {
+	chartURL, ref, err := splitOCIChartURL(href)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := newOCIClients(chartURL, g.secret, g.mirror)
+	if err != nil {
+		return nil, err
+	}
+	var client *oci.Client
+	var manifest *oci.Manifest
+	err = withOCIClient(clients, func(c *oci.Client) (err error) {
+		manifest, _, err = c.Manifest(g.ctx, ref)
+		client = c
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var layer *oci.Descriptor
+	for i, l := range manifest.Layers {
+		if l.MediaType == ChartLayerMediaType || l.MediaType == LegacyChartLayerMediaType {
+			layer = &manifest.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return nil, fmt.Errorf("manifest of '%s' has no layer of media type '%s'", href, ChartLayerMediaType)
+	}
+
+	blob, err := client.Blob(g.ctx, *layer)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, blob); err != nil {
+		return nil, fmt.Errorf("failed to pull chart layer '%s': %w", layer.Digest, err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ProvenanceExtension is the extension of the provenance file of a chart,
+// served next to the chart package.
+const ProvenanceExtension = ".prov"
+
+// VerifiedProvenance describes the verified provenance of a chart package:
+// the field of the Secret with the keyring it was verified with, the
+// identity of the signer, and the digest of the package.
+type VerifiedProvenance struct {
+	Key    string
+	Signer string
+	Digest string
+}
+
+// KeyringsFromSecret returns the PGP public keyrings of the fields of the
+// given Secret, armored or binary as exported by 'gpg --export', by field
+// name. It returns an error if a field is not a keyring, or if the Secret has
+// no keyrings.
+func KeyringsFromSecret(secret *corev1.Secret) (map[string]openpgp.EntityList, error) {
+	keyrings := map[string]openpgp.EntityList{}
+	for name, b := range secret.Data {
+		keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+		if err != nil {
+			keyring, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid PGP keyring '%s' in secret '%s': %w", name, secret.Name, err)
+		}
+		keyrings[name] = keyring
+	}
+	if len(keyrings) == 0 {
+		return nil, fmt.Errorf("no PGP keyrings found in secret '%s'", secret.Name)
+	}
+	return keyrings, nil
+}
+
+// VerifyProvenance downloads the provenance file of the given chart version,
+// at the URL of the chart with the ProvenanceExtension, and verifies that it
+// is signed with a key of one of the given keyrings, in the order of their
+// names, and that it holds the digest of the given chart package.
+func (r *ChartRepository) VerifyProvenance(chart *repo.ChartVersion, pkg []byte,
+	keyrings map[string]openpgp.EntityList) (*VerifiedProvenance, error) {
+	if len(chart.URLs) == 0 {
+		return nil, fmt.Errorf("chart %q has no downloadable URLs", chart.Name)
+	}
+	u, err := r.resolveChartURL(chart.URLs[0])
+	if err != nil {
+		return nil, err
+	}
+	// the provenance file names the package by the name of the file the
+	// chart was downloaded from
+	fileName := path.Base(u.Path)
+	u.Path += ProvenanceExtension
+	if u.RawPath != "" {
+		u.RawPath += ProvenanceExtension
+	}
+	prov, err := r.Client.Get(u.String(), r.Options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download provenance file '%s': %w", u.String(), err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "provenance-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	pkgPath := filepath.Join(tmpDir, fileName)
+	if err := os.WriteFile(pkgPath, pkg, 0644); err != nil {
+		return nil, err
+	}
+	provPath := pkgPath + ProvenanceExtension
+	if err := os.WriteFile(provPath, prov.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(keyrings))
+	for name := range keyrings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []string
+	for _, name := range names {
+		signatory := &provenance.Signatory{KeyRing: keyrings[name]}
+		verification, err := signatory.Verify(pkgPath, provPath)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+		return &VerifiedProvenance{Key: name, Signer: entityName(verification.SignedBy), Digest: verification.FileHash}, nil
+	}
+	return nil, fmt.Errorf("provenance of '%s' can't be verified with the keyrings: %s", fileName, strings.Join(errs, "; "))
+}
+
+// entityName returns the first of the names of the identities of the given
+// entity in lexical order, e.g. 'Flux <flux@example.com>'.
+func entityName(entity *openpgp.Entity) string {
+	var names []string
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
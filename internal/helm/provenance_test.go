@@ -0,0 +1,121 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// newProvenanceKey returns a new PGP entity and its armored public key.
+func newProvenanceKey(t *testing.T, name string) (*openpgp.Entity, []byte) {
+	t.Helper()
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return entity, buf.Bytes()
+}
+
+func TestKeyringsFromSecret(t *testing.T) {
+	_, armored := newProvenanceKey(t, "flux")
+	entity, _ := newProvenanceKey(t, "binary")
+	var binary bytes.Buffer
+	if err := entity.Serialize(&binary); err != nil {
+		t.Fatal(err)
+	}
+
+	keyrings, err := KeyringsFromSecret(&corev1.Secret{Data: map[string][]byte{
+		"armored.asc": armored,
+		"pubring.gpg": binary.Bytes(),
+	}})
+	if err != nil {
+		t.Fatalf("KeyringsFromSecret() error = %v", err)
+	}
+	if len(keyrings["armored.asc"]) != 1 || len(keyrings["pubring.gpg"]) != 1 {
+		t.Errorf("KeyringsFromSecret() = %v, want a key in each keyring", keyrings)
+	}
+
+	if _, err := KeyringsFromSecret(&corev1.Secret{Data: map[string][]byte{"key": []byte("invalid")}}); err == nil {
+		t.Error("KeyringsFromSecret() of an invalid keyring succeeded")
+	}
+	if _, err := KeyringsFromSecret(&corev1.Secret{}); err == nil {
+		t.Error("KeyringsFromSecret() without keyrings succeeded")
+	}
+}
+
+func TestChartRepository_VerifyProvenance(t *testing.T) {
+	pkg, err := os.ReadFile("testdata/charts/helmchart-0.1.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := newProvenanceKey(t, "flux")
+	prov, err := (&provenance.Signatory{Entity: signer}).ClearSign("testdata/charts/helmchart-0.1.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, trusted := newProvenanceKey(t, "flux")
+	keyrings, err := KeyringsFromSecret(&corev1.Secret{Data: map[string][]byte{"other.asc": trusted}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyrings["signer.asc"] = openpgp.EntityList{signer}
+
+	mg := &mockGetter{response: []byte(prov)}
+	r := &ChartRepository{URL: "https://example.com/charts", Client: mg}
+	cv := &repo.ChartVersion{URLs: []string{"helmchart-0.1.0.tgz?token=abc"}}
+
+	verified, err := r.VerifyProvenance(cv, pkg, keyrings)
+	if err != nil {
+		t.Fatalf("VerifyProvenance() error = %v", err)
+	}
+	if want := "https://example.com/charts/helmchart-0.1.0.tgz.prov?token=abc"; mg.requestedURL != want {
+		t.Errorf("VerifyProvenance() requested %s, want %s", mg.requestedURL, want)
+	}
+	if verified.Key != "signer.asc" || verified.Signer != "flux <flux@example.com>" || !strings.HasPrefix(verified.Digest, "sha256:") {
+		t.Errorf("VerifyProvenance() = %+v, want the signer key", verified)
+	}
+
+	// the provenance of another package is not verified
+	if _, err := r.VerifyProvenance(cv, append(pkg, 0), keyrings); err == nil || !strings.Contains(err.Error(), "sha256 sum does not match") {
+		t.Errorf("VerifyProvenance() of a modified package error = %v, want a digest mismatch", err)
+	}
+	// an untrusted signer is not verified
+	delete(keyrings, "signer.asc")
+	if _, err := r.VerifyProvenance(cv, pkg, keyrings); err == nil || !strings.Contains(err.Error(), "other.asc") {
+		t.Errorf("VerifyProvenance() with an untrusted signer error = %v, want a failure of every keyring", err)
+	}
+}
@@ -152,27 +152,61 @@ func (r *ChartRepository) DownloadChart(chart *repo.ChartVersion) (*bytes.Buffer
 	//  always the correct one to pick, check for updates once in awhile.
 	//  Ref: https://github.com/helm/helm/blob/v3.3.0/pkg/downloader/chart_downloader.go#L241
 	ref := chart.URLs[0]
-	u, err := url.Parse(ref)
+	u, err := r.resolveChartURL(ref)
 	if err != nil {
-		err = fmt.Errorf("invalid chart URL format '%s': %w", ref, err)
 		return nil, err
 	}
 
-	// Prepend the chart repository base URL if the URL is relative
-	if !u.IsAbs() {
-		repoURL, err := url.Parse(r.URL)
-		if err != nil {
-			err = fmt.Errorf("invalid chart repository URL format '%s': %w", r.URL, err)
-			return nil, err
+	res, err := r.Client.Get(u.String(), r.Options...)
+	if err != nil {
+		if u.String() != ref {
+			return nil, fmt.Errorf("failed to download chart '%s' resolved from '%s': %w", u.String(), ref, err)
 		}
-		q := repoURL.Query()
-		// Trailing slash is required for ResolveReference to work
-		repoURL.Path = strings.TrimSuffix(repoURL.Path, "/") + "/"
-		u = repoURL.ResolveReference(u)
-		u.RawQuery = q.Encode()
+		return nil, fmt.Errorf("failed to download chart '%s': %w", ref, err)
+	}
+	return res, nil
+}
+
+// resolveChartURL returns the URL of the given chart URL of the index. A
+// relative URL is resolved against the URL of the index as described by
+// RFC 3986, e.g. 'charts/foo-1.0.0.tgz' and './charts/foo-1.0.0.tgz' against
+// the path of the repository and '/charts/foo-1.0.0.tgz' against its host.
+// The query of the repository URL, e.g. a token, is kept if the chart URL has
+// none.
+func (r *ChartRepository) resolveChartURL(ref string) (*url.URL, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart URL format '%s': %w", ref, err)
 	}
+	if u.IsAbs() {
+		return u, nil
+	}
+
+	indexURL, err := r.indexURL()
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart repository URL format '%s': %w", r.URL, err)
+	}
+	resolved := indexURL.ResolveReference(u)
+	if u.RawQuery == "" && !u.ForceQuery {
+		resolved.RawQuery = indexURL.RawQuery
+	}
+	return resolved, nil
+}
 
-	return r.Client.Get(u.String(), r.Options...)
+// indexURL returns the URL of the index of the chart repository.
+func (r *ChartRepository) indexURL() (*url.URL, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.RawPath != "" {
+		u.RawPath = path.Join(u.RawPath, "index.yaml")
+	}
+	u.Path = path.Join(u.Path, "index.yaml")
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	return u, nil
 }
 
 // LoadIndex loads the given bytes into the Index while performing
@@ -194,16 +228,60 @@ func (r *ChartRepository) LoadIndex(b []byte) error {
 	return nil
 }
 
+// CacheValidators are the validators of an HTTP response, with which the
+// content is fetched again only if it is modified.
+type CacheValidators struct {
+	// ETag is the ETag header of the response, sent as If-None-Match.
+	ETag string
+	// LastModified is the Last-Modified header of the response, sent as
+	// If-Modified-Since.
+	LastModified string
+}
+
+// IsZero returns true if the response had no validators.
+func (v CacheValidators) IsZero() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// ConditionalGetter is a getter.Getter which fetches a URL conditionally on
+// the validators of the last response. It returns a nil buffer if the content
+// is not modified, and the validators of the response otherwise.
+type ConditionalGetter interface {
+	GetIfModified(href string, validators CacheValidators) (*bytes.Buffer, CacheValidators, error)
+}
+
+// DownloadIndexIfModified downloads the chart repository index as
+// DownloadIndex, conditionally on the given validators of the last download
+// if the Client is a ConditionalGetter. It returns false, and leaves the
+// Index unset, if the index is not modified, and the validators of the
+// download, if any, otherwise.
+func (r *ChartRepository) DownloadIndexIfModified(validators CacheValidators) (CacheValidators, bool, error) {
+	g, ok := r.Client.(ConditionalGetter)
+	if !ok {
+		return CacheValidators{}, true, r.DownloadIndex()
+	}
+	u, err := r.indexURL()
+	if err != nil {
+		return CacheValidators{}, false, err
+	}
+	res, validators, err := g.GetIfModified(u.String(), validators)
+	if err != nil {
+		return CacheValidators{}, false, err
+	}
+	if res == nil {
+		return validators, false, nil
+	}
+	return validators, true, r.LoadIndex(res.Bytes())
+}
+
 // DownloadIndex attempts to download the chart repository index using
 // the Client and set Options, and loads the index file into the Index.
 // It returns an error on URL parsing and Client failures.
 func (r *ChartRepository) DownloadIndex() error {
-	u, err := url.Parse(r.URL)
+	u, err := r.indexURL()
 	if err != nil {
 		return err
 	}
-	u.RawPath = path.Join(u.RawPath, "index.yaml")
-	u.Path = path.Join(u.Path, "index.yaml")
 
 	res, err := r.Client.Get(u.String(), r.Options...)
 	if err != nil {
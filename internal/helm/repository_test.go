@@ -18,6 +18,9 @@ package helm
 
 import (
 	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
@@ -197,6 +200,105 @@ func TestChartRepository_DownloadChart(t *testing.T) {
 			},
 			wantURL: "https://example.com/charts/foo-1.0.0.tgz",
 		},
+		{
+			name: "relative URL with repository path",
+			url:  "https://example.com/helm/stable",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"charts/foo-1.0.0.tgz"},
+			},
+			wantURL: "https://example.com/helm/stable/charts/foo-1.0.0.tgz",
+		},
+		{
+			name: "relative URL with trailing slash",
+			url:  "https://example.com/helm/stable/",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"charts/foo-1.0.0.tgz"},
+			},
+			wantURL: "https://example.com/helm/stable/charts/foo-1.0.0.tgz",
+		},
+		{
+			name: "dot relative URL",
+			url:  "https://example.com/helm/stable/",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"./foo-1.0.0.tgz"},
+			},
+			wantURL: "https://example.com/helm/stable/foo-1.0.0.tgz",
+		},
+		{
+			name: "parent relative URL",
+			url:  "https://example.com/helm/stable",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"../incubator/foo-1.0.0.tgz"},
+			},
+			wantURL: "https://example.com/helm/incubator/foo-1.0.0.tgz",
+		},
+		{
+			name: "absolute-path URL",
+			url:  "https://example.com/helm/stable",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"/charts/foo-1.0.0.tgz"},
+			},
+			wantURL: "https://example.com/charts/foo-1.0.0.tgz",
+		},
+		{
+			name: "relative URL with port",
+			url:  "http://chartmuseum.example.com:8080/api/",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"charts/foo-1.0.0.tgz"},
+			},
+			wantURL: "http://chartmuseum.example.com:8080/api/charts/foo-1.0.0.tgz",
+		},
+		{
+			name: "network-path URL",
+			url:  "https://example.com/helm",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"//cdn.example.com/charts/foo-1.0.0.tgz"},
+			},
+			wantURL: "https://cdn.example.com/charts/foo-1.0.0.tgz",
+		},
+		{
+			name: "absolute URL",
+			url:  "https://example.com/helm",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"https://cdn.example.com/charts/foo-1.0.0.tgz"},
+			},
+			wantURL: "https://cdn.example.com/charts/foo-1.0.0.tgz",
+		},
+		{
+			name: "relative URL with repository query",
+			url:  "https://example.com/helm?token=secret",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"charts/foo-1.0.0.tgz"},
+			},
+			wantURL: "https://example.com/helm/charts/foo-1.0.0.tgz?token=secret",
+		},
+		{
+			name: "relative URL with query",
+			url:  "https://example.com/helm?token=secret",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"charts/foo-1.0.0.tgz?version=1"},
+			},
+			wantURL: "https://example.com/helm/charts/foo-1.0.0.tgz?version=1",
+		},
+		{
+			name: "relative URL with escaped repository path",
+			url:  "https://example.com/helm%2Fstable/",
+			chartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "chart"},
+				URLs:     []string{"charts/foo-1.0.0.tgz"},
+			},
+			wantURL: "https://example.com/helm%2Fstable/charts/foo-1.0.0.tgz",
+		},
 		{
 			name:         "no chart URL",
 			chartVersion: &repo.ChartVersion{Metadata: &chart.Metadata{Name: "chart"}},
@@ -230,6 +332,25 @@ func TestChartRepository_DownloadChart(t *testing.T) {
 	}
 }
 
+func TestChartRepository_DownloadChart_error(t *testing.T) {
+	r := &ChartRepository{
+		URL:    "https://example.com/helm/stable/",
+		Client: &mockGetter{err: errors.New("404 Not Found")},
+	}
+	_, err := r.DownloadChart(&repo.ChartVersion{
+		Metadata: &chart.Metadata{Name: "chart"},
+		URLs:     []string{"./charts/foo-1.0.0.tgz"},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{"'./charts/foo-1.0.0.tgz'", "'https://example.com/helm/stable/charts/foo-1.0.0.tgz'", "404 Not Found"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %s, got %v", want, err)
+		}
+	}
+}
+
 func TestChartRepository_DownloadIndex(t *testing.T) {
 	b, err := os.ReadFile(chartmuseumtestfile)
 	if err != nil {
@@ -249,6 +370,58 @@ func TestChartRepository_DownloadIndex(t *testing.T) {
 	verifyLocalIndex(t, r.Index)
 }
 
+func TestChartRepository_DownloadIndexIfModified(t *testing.T) {
+	b, err := os.ReadFile(chartmuseumtestfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write(b)
+	}))
+	defer server.Close()
+	g, err := NewTransportGetter(server.URL, "", nil, nil, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ChartRepository{URL: server.URL, Client: g}
+
+	validators, modified, err := r.DownloadIndexIfModified(CacheValidators{})
+	if err != nil || !modified {
+		t.Fatalf("DownloadIndexIfModified() without validators = %v, %v, want a modified index", modified, err)
+	}
+	verifyLocalIndex(t, r.Index)
+	want := CacheValidators{ETag: `"v1"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	if validators != want {
+		t.Errorf("DownloadIndexIfModified() validators = %v, want %v", validators, want)
+	}
+
+	r.Index = nil
+	got, modified, err := r.DownloadIndexIfModified(validators)
+	if err != nil || modified || r.Index != nil {
+		t.Errorf("DownloadIndexIfModified() with the validators = %v, %v, want the index not to be modified", modified, err)
+	}
+	if got != validators || requests != 2 {
+		t.Errorf("DownloadIndexIfModified() validators = %v after %d requests, want %v after 2", got, requests, validators)
+	}
+
+	// the getters of Helm do not send conditional requests
+	mg := mockGetter{response: b}
+	r = &ChartRepository{URL: "https://example.com", Client: &mg}
+	if validators, modified, err := r.DownloadIndexIfModified(want); err != nil || !modified || !validators.IsZero() {
+		t.Errorf("DownloadIndexIfModified() of a Helm getter = %v, %v, %v, want a modified index without validators",
+			validators, modified, err)
+	}
+	verifyLocalIndex(t, r.Index)
+}
+
 // Index load tests are derived from https://github.com/helm/helm/blob/v3.3.4/pkg/repo/index_test.go#L108
 // to ensure parity with Helm behaviour.
 func TestChartRepository_LoadIndex(t *testing.T) {
@@ -402,9 +575,13 @@ func verifyLocalIndex(t *testing.T, i *repo.IndexFile) {
 type mockGetter struct {
 	requestedURL string
 	response     []byte
+	err          error
 }
 
 func (g *mockGetter) Get(url string, options ...getter.Option) (*bytes.Buffer, error) {
 	g.requestedURL = url
+	if g.err != nil {
+		return nil, g.err
+	}
 	return bytes.NewBuffer(g.response), nil
 }
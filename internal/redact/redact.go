@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package redact removes credentials from the messages of errors before they
+// are logged, emitted as events or written to the status of objects.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Mask replaces the redacted values.
+const Mask = "***"
+
+// maxOpaqueLength is the length above which an opaque string, e.g. a token
+// without a key, is truncated.
+const maxOpaqueLength = 64
+
+var (
+	// userinfoPattern matches the userinfo of a URL with a scheme, e.g.
+	// 'https://user:password@'.
+	userinfoPattern = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.\-]*://)[^\s/?#@"'<>]+@`)
+
+	// authorizationPattern matches the value of an Authorization header,
+	// as written in a request dump or a printed http.Header, with its scheme.
+	authorizationPattern = regexp.MustCompile(`(?i)(\b(?:proxy-)?authorization"?\s*[:=]\s*["\[]?(?:(?:basic|bearer|token|aws4-hmac-sha256)\s+)?)[^\s,;"'\]}]+`)
+
+	// secretKeyPattern matches the value of a known secret key assigned with
+	// '=', e.g. in a query, or ':' in JSON, e.g. 'password=value' or
+	// '"token":"value"'.
+	secretKeyPattern = regexp.MustCompile(`(?i)(\b(?:aws_)?(?:password|passwd|pwd|token|access_?token|refresh_?token|id_?token|secret|client_?secret|secret_?key|secret_?access_?key|api_?key|session_?token|x-amz-signature|x-amz-credential|x-amz-security-token|sig)(?:=|"\s*:\s*"))[^\s&,;"'\]}]+`)
+
+	// passwordPattern matches the value of a password key written as
+	// 'key: value', e.g. in a YAML dump.
+	passwordPattern = regexp.MustCompile(`(?i)(\b(?:aws_)?(?:password|passwd|client_?secret|secret_?access_?key)\s*:\s*)[^\s,;"'\]}]+`)
+
+	// awsAccessKeyPattern matches AWS access key IDs.
+	awsAccessKeyPattern = regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)
+
+	// opaquePattern matches strings of the characters of base64, hex and
+	// JWT encoded tokens longer than maxOpaqueLength.
+	opaquePattern = regexp.MustCompile(fmt.Sprintf(`[A-Za-z0-9+=_\-.]{%d,}`, maxOpaqueLength+1))
+
+	// checksumPattern matches the hex encoded checksums and commit hashes,
+	// opaque strings of a checksum with a short prefix or suffix, e.g. the
+	// file name of an artifact, are kept.
+	checksumPattern = regexp.MustCompile(`[a-f0-9]{40,}`)
+)
+
+// String returns the given message with the credentials redacted: the
+// userinfo of URLs is removed, the values of Authorization headers, known
+// secret keys and AWS access key IDs are masked, and opaque strings longer
+// than 64 characters are truncated.
+func String(s string) string {
+	if s == "" {
+		return s
+	}
+	s = userinfoPattern.ReplaceAllString(s, "$1")
+	s = authorizationPattern.ReplaceAllString(s, "${1}"+Mask)
+	s = secretKeyPattern.ReplaceAllString(s, "${1}"+Mask)
+	s = passwordPattern.ReplaceAllString(s, "${1}"+Mask)
+	s = awsAccessKeyPattern.ReplaceAllString(s, Mask)
+	s = opaquePattern.ReplaceAllStringFunc(s, func(v string) string {
+		if loc := checksumPattern.FindStringIndex(v); loc != nil && len(v)-(loc[1]-loc[0]) <= 16 {
+			return v
+		}
+		return v[:4] + Mask
+	})
+	return s
+}
+
+// redactedError is an error of which the message is redacted, it unwraps to
+// the original error.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Error returns an error with the redacted message of the given error, which
+// unwraps to the given error for errors.Is and errors.As. It returns nil if
+// the given error is nil.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*redactedError); ok {
+		return err
+	}
+	msg := String(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+// Conditions redacts the messages of the given conditions in place.
+func Conditions(conditions []metav1.Condition) {
+	for i := range conditions {
+		conditions[i].Message = String(conditions[i].Message)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package secretdata detects the common mistakes in the encoding of the data
+// of the Secrets with the credentials of the sources: a UTF-8 byte order
+// mark, CRLF line endings, and values base64 encoded twice. The messages
+// name the fields of the Secrets and the suspected problems, never the values.
+package secretdata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The suspected problems in the encoding of a value.
+const (
+	ProblemBOM          = "a UTF-8 byte order mark"
+	ProblemCRLF         = "CRLF line endings"
+	ProblemDoubleBase64 = "a value base64 encoded twice"
+)
+
+// bom is the UTF-8 byte order mark.
+var bom = []byte("\xef\xbb\xbf")
+
+// pemFields are the fields of the Secrets holding PEM encoded data, or the
+// lines of an SSH known_hosts file.
+var pemFields = []string{"caFile", "ca.crt", "certFile", "keyFile", "tls.crt", "tls.key", "identity", "known_hosts"}
+
+// credentialFields are the fields of the Secrets holding a credential in
+// plaintext.
+var credentialFields = []string{"username", "password"}
+
+// CorrectPEM returns the given value of a field holding PEM encoded data
+// with the byte order mark and carriage returns removed, and decoded from
+// base64 if it is the base64 encoding of PEM encoded data, and the problems
+// it corrected. These corrections never change the decoded data.
+func CorrectPEM(value []byte) ([]byte, []string) {
+	var problems []string
+	if decoded, ok := decodeBase64(value); ok && !isPEM(value) && isPEM(decoded) {
+		value = decoded
+		problems = append(problems, ProblemDoubleBase64)
+	}
+	if bytes.HasPrefix(value, bom) {
+		value = bytes.TrimPrefix(value, bom)
+		problems = append(problems, ProblemBOM)
+	}
+	if bytes.Contains(value, []byte("\r")) {
+		value = bytes.ReplaceAll(bytes.ReplaceAll(value, []byte("\r\n"), []byte("\n")), []byte("\r"), []byte("\n"))
+		problems = append(problems, ProblemCRLF)
+	}
+	return value, problems
+}
+
+// CorrectCredential returns the given value of a field holding a plaintext
+// credential with the byte order mark and the trailing line ending removed,
+// and the problems it corrected. A value which looks base64 encoded twice is
+// not decoded, as a credential may be any string, it is reported by Suspect.
+func CorrectCredential(value []byte) ([]byte, []string) {
+	var problems []string
+	if bytes.HasPrefix(value, bom) {
+		value = bytes.TrimPrefix(value, bom)
+		problems = append(problems, ProblemBOM)
+	}
+	if bytes.HasSuffix(value, []byte("\r\n")) || bytes.HasSuffix(value, []byte("\r")) {
+		value = bytes.TrimRight(value, "\r\n")
+		problems = append(problems, ProblemCRLF)
+	}
+	return value, problems
+}
+
+// Suspect returns the problems of the encoding of the given value of a
+// field holding a plaintext credential which can not be corrected: a value
+// which decodes from base64 to printable text.
+func Suspect(value []byte) []string {
+	if decoded, ok := decodeBase64(value); ok && len(decoded) >= 4 && isPrintable(decoded) {
+		return []string{ProblemDoubleBase64}
+	}
+	return nil
+}
+
+// Correct returns a copy of the given Secret with the problems in the
+// encoding of its known fields corrected, with CorrectPEM and
+// CorrectCredential, and warnings naming the fields and the problems
+// corrected or suspected by Suspect.
+func Correct(secret corev1.Secret) (corev1.Secret, []string) {
+	corrected := *secret.DeepCopy()
+	var warnings []string
+	correct := func(fields []string, f func([]byte) ([]byte, []string)) {
+		for _, field := range fields {
+			value, ok := corrected.Data[field]
+			if !ok {
+				continue
+			}
+			value, problems := f(value)
+			if len(problems) > 0 {
+				corrected.Data[field] = value
+				warnings = append(warnings, fmt.Sprintf("corrected %s in field '%s' of secret '%s'",
+					strings.Join(problems, " and "), field, secret.Name))
+			}
+		}
+	}
+	correct(pemFields, CorrectPEM)
+	correct(credentialFields, CorrectCredential)
+	for _, field := range credentialFields {
+		if problems := Suspect(corrected.Data[field]); len(problems) > 0 {
+			warnings = append(warnings, fmt.Sprintf("suspected %s in field '%s' of secret '%s', the value is used as is",
+				strings.Join(problems, " and "), field, secret.Name))
+		}
+	}
+	sort.Strings(warnings)
+	return corrected, warnings
+}
+
+// Hint returns a suffix for the message of an error about the given value of
+// the given field holding PEM encoded data or known_hosts lines, naming the
+// problems CorrectPEM corrects in it, or else suspected by Suspect, e.g.
+// ", suspected CRLF line endings in field 'caFile'", or an empty string if
+// there are none.
+func Hint(field string, value []byte) string {
+	_, problems := CorrectPEM(value)
+	if len(problems) == 0 {
+		problems = Suspect(value)
+	}
+	if len(problems) > 0 {
+		return fmt.Sprintf(", suspected %s in field '%s'", strings.Join(problems, " and "), field)
+	}
+	return ""
+}
+
+// CheckPEM returns an error naming the given field of the given Secret and
+// the problems CorrectPEM corrects in the given value, if the value does not
+// contain PEM encoded data.
+func CheckPEM(secretName, field string, value []byte) error {
+	if isPEM(value) {
+		return nil
+	}
+	if hint := Hint(field, value); hint != "" {
+		return fmt.Errorf("invalid '%s' secret data: field '%s' does not contain PEM encoded data%s",
+			secretName, field, hint)
+	}
+	return nil
+}
+
+// CheckCredential returns an error naming the given field of the given
+// Secret and the problems CorrectCredential corrects in the given value, if
+// any.
+func CheckCredential(secretName, field string, value []byte) error {
+	if _, problems := CorrectCredential(value); len(problems) > 0 {
+		return fmt.Errorf("invalid '%s' secret data: suspected %s in field '%s'",
+			secretName, strings.Join(problems, " and "), field)
+	}
+	return nil
+}
+
+// CheckBOM returns an error naming the given field of the given Secret if the
+// given value starts with a byte order mark, which the parsers of some
+// fields accept as part of the value, e.g. of the host pattern of the first
+// line of known_hosts, which then never matches.
+func CheckBOM(secretName, field string, value []byte) error {
+	if bytes.HasPrefix(value, bom) {
+		return fmt.Errorf("invalid '%s' secret data: suspected %s in field '%s'", secretName, ProblemBOM, field)
+	}
+	return nil
+}
+
+// isPEM returns if the given value contains a PEM block.
+func isPEM(value []byte) bool {
+	block, _ := pem.Decode(value)
+	return block != nil
+}
+
+// decodeBase64 returns the given value decoded from standard base64, with
+// the whitespace, e.g. the line breaks of 'base64', removed, and if it is
+// valid base64.
+func decodeBase64(value []byte) ([]byte, bool) {
+	s := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, string(value))
+	if s == "" || len(s)%4 != 0 {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.Strict().DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// isPrintable returns if the given value is printable ASCII text, with tabs
+// and line breaks.
+func isPrintable(value []byte) bool {
+	for _, b := range value {
+		if (b < 0x20 || b > 0x7e) && b != '\t' && b != '\r' && b != '\n' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secretdata
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	pemFixture = "-----BEGIN CERTIFICATE-----\nTUlJQmZpeHR1cmU=\n-----END CERTIFICATE-----\n"
+
+	knownHostsFixture = "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"
+)
+
+func TestCorrectPEM(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		want         string
+		wantProblems []string
+	}{
+		{name: "valid", value: pemFixture, want: pemFixture},
+		{name: "byte order mark", value: "\xef\xbb\xbf" + pemFixture, want: pemFixture, wantProblems: []string{ProblemBOM}},
+		{name: "CRLF line endings", value: strings.ReplaceAll(pemFixture, "\n", "\r\n"), want: pemFixture,
+			wantProblems: []string{ProblemCRLF}},
+		{name: "base64 encoded twice", value: base64.StdEncoding.EncodeToString([]byte(pemFixture)), want: pemFixture,
+			wantProblems: []string{ProblemDoubleBase64}},
+		{name: "base64 encoded twice with line breaks", value: wrap(base64.StdEncoding.EncodeToString([]byte(pemFixture))),
+			want: pemFixture, wantProblems: []string{ProblemDoubleBase64}},
+		{name: "base64 encoded twice with CRLF line endings",
+			value: base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(pemFixture, "\n", "\r\n"))),
+			want:  pemFixture, wantProblems: []string{ProblemDoubleBase64, ProblemCRLF}},
+		{name: "known_hosts", value: knownHostsFixture, want: knownHostsFixture},
+		{name: "known_hosts with a byte order mark and CRLF line endings", value: "\xef\xbb\xbf" + strings.ReplaceAll(knownHostsFixture, "\n", "\r\n"),
+			want: knownHostsFixture, wantProblems: []string{ProblemBOM, ProblemCRLF}},
+		{name: "base64 which is not PEM", value: base64.StdEncoding.EncodeToString([]byte("fixture")),
+			want: base64.StdEncoding.EncodeToString([]byte("fixture"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problems := CorrectPEM([]byte(tt.value))
+			if string(got) != tt.want {
+				t.Errorf("CorrectPEM() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(problems, tt.wantProblems) {
+				t.Errorf("CorrectPEM() problems = %v, want %v", problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func TestCorrectCredential(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		want         string
+		wantProblems []string
+		wantSuspect  []string
+	}{
+		{name: "valid", value: "password", want: "password"},
+		{name: "byte order mark", value: "\xef\xbb\xbfpassword", want: "password", wantProblems: []string{ProblemBOM}},
+		{name: "CRLF line ending", value: "password\r\n", want: "password", wantProblems: []string{ProblemCRLF}},
+		{name: "base64 encoded twice", value: "c2VjcmV0LXBhc3N3b3Jk", want: "c2VjcmV0LXBhc3N3b3Jk",
+			wantSuspect: []string{ProblemDoubleBase64}},
+		{name: "base64 of binary data", value: "3q2+7w8gc8A=", want: "3q2+7w8gc8A="},
+		{name: "short base64", value: "YWJj", want: "YWJj"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problems := CorrectCredential([]byte(tt.value))
+			if string(got) != tt.want {
+				t.Errorf("CorrectCredential() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(problems, tt.wantProblems) {
+				t.Errorf("CorrectCredential() problems = %v, want %v", problems, tt.wantProblems)
+			}
+			if suspect := Suspect(got); !reflect.DeepEqual(suspect, tt.wantSuspect) {
+				t.Errorf("Suspect() = %v, want %v", suspect, tt.wantSuspect)
+			}
+		})
+	}
+}
+
+func TestCorrect(t *testing.T) {
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+		Data: map[string][]byte{
+			"username": []byte("user\r\n"),
+			"password": []byte("c2VjcmV0LXBhc3N3b3Jk"),
+			"caFile":   []byte(base64.StdEncoding.EncodeToString([]byte(pemFixture))),
+			"identity": []byte("\xef\xbb\xbf" + pemFixture),
+			"certFile": []byte(pemFixture),
+		},
+	}
+	corrected, warnings := Correct(secret)
+
+	want := map[string][]byte{
+		"username": []byte("user"),
+		"password": []byte("c2VjcmV0LXBhc3N3b3Jk"),
+		"caFile":   []byte(pemFixture),
+		"identity": []byte(pemFixture),
+		"certFile": []byte(pemFixture),
+	}
+	if !reflect.DeepEqual(corrected.Data, want) {
+		t.Errorf("Correct() data = %q, want %q", corrected.Data, want)
+	}
+	wantWarnings := []string{
+		"corrected CRLF line endings in field 'username' of secret 'creds'",
+		"corrected a UTF-8 byte order mark in field 'identity' of secret 'creds'",
+		"corrected a value base64 encoded twice in field 'caFile' of secret 'creds'",
+		"suspected a value base64 encoded twice in field 'password' of secret 'creds', the value is used as is",
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("Correct() warnings = %q, want %q", warnings, wantWarnings)
+	}
+
+	// the given secret is not modified
+	if string(secret.Data["username"]) != "user\r\n" {
+		t.Errorf("Correct() modified the given secret")
+	}
+}
+
+func TestCheckPEM(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "valid", value: pemFixture},
+		{name: "valid with CRLF line endings", value: strings.ReplaceAll(pemFixture, "\n", "\r\n")},
+		{name: "invalid", value: "fixture"},
+		{name: "byte order mark", value: "\xef\xbb\xbf" + pemFixture,
+			wantErr: "invalid 'creds' secret data: field 'caFile' does not contain PEM encoded data, suspected a UTF-8 byte order mark in field 'caFile'"},
+		{name: "base64 encoded twice", value: base64.StdEncoding.EncodeToString([]byte(pemFixture)),
+			wantErr: "invalid 'creds' secret data: field 'caFile' does not contain PEM encoded data, suspected a value base64 encoded twice in field 'caFile'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPEM("creds", "caFile", []byte(tt.value))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckPEM() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("CheckPEM() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// wrap returns the given base64 encoded value with line breaks every 76
+// characters, as encoded by 'base64'.
+func wrap(s string) string {
+	var b strings.Builder
+	for len(s) > 76 {
+		b.WriteString(s[:76] + "\n")
+		s = s[76:]
+	}
+	b.WriteString(s + "\n")
+	return b.String()
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing exports the OpenTelemetry traces of the controller to an
+// OTLP endpoint over HTTP. The exporter is configured with the standard
+// OTEL_EXPORTER_OTLP_* environment variables, e.g.
+// OTEL_EXPORTER_OTLP_ENDPOINT, and the resource with OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is the default name of the service of the traces of the
+// controller, and the name of its tracer.
+const ServiceName = "source-controller"
+
+// Provider is the provider of the tracer of the controller, which must be
+// shut down to export the last spans.
+type Provider struct {
+	provider *sdktrace.TracerProvider
+}
+
+// Setup returns the Provider of the spans exported to the OTLP endpoint,
+// sampling the given ratio of the traces, of which the parent is not sampled
+// by the caller, e.g. the traces of the reconciliations. It sets it as the
+// global TracerProvider, and the W3C trace context and baggage as the global
+// propagator of the outbound requests.
+func Setup(ctx context.Context, samplingRatio float64) (*Provider, error) {
+	if samplingRatio < 0 || samplingRatio > 1 {
+		return nil, fmt.Errorf("invalid sampling ratio '%v', must be between 0 and 1", samplingRatio)
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the OTLP exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String(ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect the resource of the traces: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return &Provider{provider: provider}, nil
+}
+
+// Tracer returns the tracer of the controller.
+func (p *Provider) Tracer() trace.Tracer {
+	return p.provider.Tracer(ServiceName)
+}
+
+// Shutdown exports the remaining spans, and stops the exporter.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	return p.provider.Shutdown(ctx)
+}
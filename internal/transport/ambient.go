@@ -0,0 +1,72 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	ambientHostsMu sync.RWMutex
+	ambientHosts   []string
+)
+
+// SetAmbientCredentialHosts sets the hosts which may be sent the tokens of
+// the identity of the controller, e.g. its Workload Identity, in addition to
+// the hosts of the storage services of the cloud providers. A host is a host
+// name, or a '*.' wildcard of the subdomains of a host name.
+func SetAmbientCredentialHosts(hosts []string) error {
+	patterns := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		pattern := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+		name := strings.TrimPrefix(pattern, "*.")
+		if name == "" || strings.ContainsAny(name, "*/:@") {
+			return fmt.Errorf("invalid ambient credential host '%s': it must be a host name, or a '*.' wildcard of the subdomains of a host name", host)
+		}
+		patterns = append(patterns, pattern)
+	}
+	ambientHostsMu.Lock()
+	defer ambientHostsMu.Unlock()
+	ambientHosts = patterns
+	return nil
+}
+
+// CheckAmbientCredentialEndpoint returns an error unless the given endpoint
+// may be sent the tokens of the identity of the controller: it must use
+// 'https' with a verified certificate, and its host must match one of the
+// given default hosts of the storage service, or one of the hosts set with
+// SetAmbientCredentialHosts. This keeps a tenant from collecting the tokens
+// of the controller with the endpoint of a source.
+func CheckAmbientCredentialEndpoint(endpoint *url.URL, insecure bool, defaults ...string) error {
+	if endpoint.Scheme != "https" || insecure {
+		return fmt.Errorf("the credentials of the controller identity require an 'https://' endpoint without spec.insecure")
+	}
+	host := strings.ToLower(strings.TrimSuffix(endpoint.Hostname(), "."))
+	ambientHostsMu.RLock()
+	patterns := append(append([]string{}, defaults...), ambientHosts...)
+	ambientHostsMu.RUnlock()
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) || host == pattern {
+			return nil
+		}
+	}
+	return fmt.Errorf("the credentials of the controller identity are not sent to the endpoint host '%s', "+
+		"a secret with credentials is required", endpoint.Hostname())
+}
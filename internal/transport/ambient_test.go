@@ -0,0 +1,61 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestCheckAmbientCredentialEndpoint(t *testing.T) {
+	defer SetAmbientCredentialHosts(nil)
+	if err := SetAmbientCredentialHosts([]string{"storage.internal.example.com", "*.blob.core.chinacloudapi.cn"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		endpoint string
+		insecure bool
+		wantErr  bool
+	}{
+		{endpoint: "https://storage.googleapis.com"},
+		{endpoint: "https://podinfo.blob.core.windows.net"},
+		{endpoint: "https://Storage.Internal.Example.com:8443"},
+		{endpoint: "https://podinfo.blob.core.chinacloudapi.cn"},
+		{endpoint: "https://blob.core.windows.net", wantErr: true},
+		{endpoint: "https://storage.googleapis.com.attacker.example.com", wantErr: true},
+		{endpoint: "https://attackerblob.core.windows.net", wantErr: true},
+		{endpoint: "http://storage.googleapis.com", wantErr: true},
+		{endpoint: "https://storage.googleapis.com", insecure: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckAmbientCredentialEndpoint(u, tt.insecure, "storage.googleapis.com", "*.blob.core.windows.net")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckAmbientCredentialEndpoint(%s, %v) error = %v, wantErr %v", tt.endpoint, tt.insecure, err, tt.wantErr)
+		}
+	}
+
+	for _, host := range []string{"", "*.", "https://storage.example.com", "storage.example.com/path"} {
+		if err := SetAmbientCredentialHosts([]string{host}); err == nil {
+			t.Errorf("SetAmbientCredentialHosts(%q) error = nil, want invalid", host)
+		}
+	}
+}
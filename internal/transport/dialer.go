@@ -0,0 +1,68 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/fluxcd/source-controller/internal/egress"
+)
+
+// FallbackDelay is the delay after which a connection to an address of a
+// dual-stack host of the other family is raced with the first attempt, as
+// described by the Happy Eyeballs of RFC 6555.
+const FallbackDelay = 300 * time.Millisecond
+
+// NewDialer returns the net.Dialer of the outbound connections of the
+// controller. It dials the IPv4 and IPv6 addresses of a host, in the order of
+// RFC 6724, and races the addresses of the other family after the
+// FallbackDelay, for a host of which one family is unreachable, e.g. the A
+// records of a host on an IPv6-only network, not to delay the connections.
+func NewDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: FallbackDelay,
+	}
+}
+
+// DialContext dials the given address with the dialer of NewDialer, if the
+// egress policy of the controller allows it: the host name is checked before
+// it is resolved, and every address it resolves to before it is connected to,
+// for a public name resolving to an internal address to be denied.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := NewDialer()
+	policy := egress.CurrentPolicy()
+	host, _, err := net.SplitHostPort(address)
+	if policy == nil || err != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	if err := policy.CheckHost(host); err != nil {
+		return nil, err
+	}
+	dialer.Control = func(_, address string, _ syscall.RawConn) error {
+		ip, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		return policy.CheckIP(host, net.ParseIP(ip))
+	}
+	return dialer.DialContext(ctx, network, address)
+}
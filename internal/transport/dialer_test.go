@@ -0,0 +1,265 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/source-controller/internal/egress"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// newTestResolver returns a net.Resolver of which the DNS server answers the
+// queries of any name with the given records by type.
+func newTestResolver(t *testing.T, records map[uint16]net.IP) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// the question is the name, of length-prefixed labels, followed
+			// by its type and class
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			query := buf[:end]
+			resp := append([]byte{}, query...)
+			binary.BigEndian.PutUint16(resp[2:], 0x8180)
+			binary.BigEndian.PutUint16(resp[6:], 0)
+			binary.BigEndian.PutUint16(resp[8:], 0)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			qtype := binary.BigEndian.Uint16(query[end-4:])
+			if ip, ok := records[qtype]; ok {
+				if ip4 := ip.To4(); qtype == dnsTypeA {
+					ip = ip4
+				}
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				answer := []byte{0xc0, 0x0c, 0, byte(qtype), 0, 1, 0, 0, 0, 60, 0, byte(len(ip))}
+				resp = append(append(resp, answer...), ip...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func TestNewDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	tests := []struct {
+		name    string
+		records map[uint16]net.IP
+	}{
+		{
+			name:    "AAAA records only",
+			records: map[uint16]net.IP{dnsTypeAAAA: net.IPv6loopback},
+		},
+		{
+			// TEST-NET-1 is not routed, the IPv6 address must be dialed
+			// after the fallback delay at the latest
+			name:    "unreachable A records",
+			records: map[uint16]net.IP{dnsTypeA: net.ParseIP("192.0.2.1"), dnsTypeAAAA: net.IPv6loopback},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := NewDialer()
+			dialer.Resolver = newTestResolver(t, tt.records)
+			transport := NewTransport(nil)
+			transport.DialContext = dialer.DialContext
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://registry.example.com:"+port+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := (&http.Client{Transport: transport}).Do(req)
+			if err != nil {
+				t.Fatalf("request to the IPv6 address of the host failed: %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestNewTransport_IPv6Literal(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+
+	resp, err := (&http.Client{Transport: NewTransport(nil), Timeout: 10 * time.Second}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request to %s failed: %v", server.URL, err)
+	}
+	resp.Body.Close()
+}
+
+func TestNewTransport_egressPolicy(t *testing.T) {
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer denied.Close()
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(denied.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer allowed.Close()
+	_, deniedPort, _ := net.SplitHostPort(denied.Listener.Addr().String())
+
+	policy, err := egress.NewPolicy(nil, []string{"127.0.0.1/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress.SetPolicy(policy)
+	defer egress.SetPolicy(nil)
+	client := &http.Client{Transport: NewTransport(nil), Timeout: 10 * time.Second}
+
+	// a name resolving to a denied address is denied after its resolution
+	_, err = client.Get("http://localhost:" + deniedPort)
+	if !egress.IsDenied(err) || !strings.Contains(err.Error(), "rule '127.0.0.1/32'") && !strings.Contains(err.Error(), "rule '::1'") {
+		t.Errorf("request to a denied address error = %v, want denied", err)
+	}
+
+	// the target of a redirect is checked against the policy
+	policy, err = egress.NewPolicy(nil, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress.SetPolicy(policy)
+	_, err = client.Get(allowed.URL)
+	if !egress.IsDenied(err) || !strings.Contains(err.Error(), "connection to 'localhost' denied by the egress policy rule 'localhost'") {
+		t.Errorf("request redirected to a denied host error = %v, want denied", err)
+	}
+	if resp, err := client.Get(denied.URL); err != nil {
+		t.Errorf("request to an allowed address error = %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestNewProxyTransport_egressPolicy(t *testing.T) {
+	// the proxy listens on another address of the loopback network than the
+	// denied one
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("unable to listen on a second loopback address: %v", err)
+	}
+	var proxied []string
+	proxy := &httptest.Server{
+		Listener: ln,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxied = append(proxied, r.URL.Host)
+		})},
+	}
+	proxy.Start()
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := egress.NewPolicy(nil, []string{"127.0.0.1/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress.SetPolicy(policy)
+	defer egress.SetPolicy(nil)
+	client := &http.Client{Transport: NewProxyTransport(nil, func(*http.Request) (*url.URL, error) {
+		return proxyURL, nil
+	}), Timeout: 10 * time.Second}
+
+	// a name resolving to a denied address is denied before it is sent to
+	// the proxy, which resolves it
+	_, err = client.Get("http://localhost:8080")
+	if !egress.IsDenied(err) {
+		t.Errorf("proxied request to a denied address error = %v, want denied", err)
+	}
+	if len(proxied) != 0 {
+		t.Errorf("proxied requests = %v, want none", proxied)
+	}
+
+	resp, err := client.Get("http://127.0.0.3:8080")
+	if err != nil {
+		t.Fatalf("proxied request to an allowed address error = %v", err)
+	}
+	resp.Body.Close()
+	if len(proxied) != 1 || proxied[0] != "127.0.0.3:8080" {
+		t.Errorf("proxied requests = %v, want the allowed request", proxied)
+	}
+
+	// a name the controller can not resolve, which the proxy may resolve,
+	// is denied unless its name is allowed
+	policy, err = egress.NewPolicy([]string{"127.0.0.0/8", "*.allowed.invalid"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress.SetPolicy(policy)
+	proxied = nil
+	_, err = client.Get("http://internal.invalid:8080")
+	if !egress.IsDenied(err) || !strings.Contains(err.Error(), "connection to 'internal.invalid' denied by the egress policy: no allow rule matches") {
+		t.Errorf("proxied request to an unresolvable name error = %v, want denied", err)
+	}
+	resp, err = client.Get("http://charts.allowed.invalid:8080")
+	if err != nil {
+		t.Fatalf("proxied request to an allowed unresolvable name error = %v", err)
+	}
+	resp.Body.Close()
+	if len(proxied) != 1 || proxied[0] != "charts.allowed.invalid:8080" {
+		t.Errorf("proxied requests = %v, want the allowed request", proxied)
+	}
+}
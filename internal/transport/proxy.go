@@ -0,0 +1,112 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/fluxcd/source-controller/internal/secretdata"
+)
+
+const (
+	// ProxyAddressField is the Secret field holding the URL of the proxy,
+	// e.g. 'http://proxy.example.com:3128'.
+	ProxyAddressField = "address"
+
+	// ProxyUsernameField and ProxyPasswordField are the Secret fields holding
+	// the optional credentials of the proxy.
+	ProxyUsernameField = "username"
+	ProxyPasswordField = "password"
+
+	// ProxyNoProxyField is the Secret field holding the optional comma
+	// separated hosts, domains and CIDRs which are connected to directly, in
+	// the format of the NO_PROXY environment variable.
+	ProxyNoProxyField = "no_proxy"
+)
+
+// ProxyFunc returns the URL of the proxy of a request, as http.Transport.Proxy,
+// or nil if the request is not sent through a proxy.
+type ProxyFunc func(*http.Request) (*url.URL, error)
+
+// ProxyFromSecret returns the ProxyFunc sending the HTTP and HTTPS requests
+// through the proxy with the 'address' and the optional 'username' and
+// 'password' fields of the given Secret, except the requests to the hosts of
+// its optional 'no_proxy' field, and to localhost. It returns nil if the
+// Secret is nil, and an error if the address is not an 'http://', 'https://'
+// or 'socks5://' URL, or only one of the credentials is set.
+func ProxyFromSecret(secret *corev1.Secret) (ProxyFunc, error) {
+	if secret == nil {
+		return nil, nil
+	}
+	address := string(secret.Data[ProxyAddressField])
+	if address == "" {
+		return nil, fmt.Errorf("invalid '%s' secret data: required field '%s'", secret.Name, ProxyAddressField)
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid '%s' secret data: field '%s': %w", secret.Name, ProxyAddressField, err)
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5":
+		return nil, fmt.Errorf("invalid '%s' secret data: field '%s' must be an 'http://', 'https://' or 'socks5://' URL",
+			secret.Name, ProxyAddressField)
+	case u.Host == "":
+		return nil, fmt.Errorf("invalid '%s' secret data: field '%s' has no host", secret.Name, ProxyAddressField)
+	}
+
+	username, password := string(secret.Data[ProxyUsernameField]), string(secret.Data[ProxyPasswordField])
+	if (username == "") != (password == "") {
+		return nil, fmt.Errorf("invalid '%s' secret data: fields '%s' and '%s' require each other's presence",
+			secret.Name, ProxyUsernameField, ProxyPasswordField)
+	}
+	if username != "" {
+		for _, field := range []string{ProxyUsernameField, ProxyPasswordField} {
+			if err := secretdata.CheckCredential(secret.Name, field, secret.Data[field]); err != nil {
+				return nil, err
+			}
+		}
+		u.User = url.UserPassword(username, password)
+	}
+
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  u.String(),
+		HTTPSProxy: u.String(),
+		NoProxy:    string(secret.Data[ProxyNoProxyField]),
+	}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}, nil
+}
+
+// NewProxyTransport returns the http.Transport of NewTransport, which sends
+// the requests through the proxy of the given ProxyFunc instead of the proxy
+// of the environment of the controller, unless the ProxyFunc is nil.
+func NewProxyTransport(config *tls.Config, proxy ProxyFunc) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		t.Proxy = proxy
+	}
+	t = WithEgressPolicy(t)
+	t.TLSClientConfig = config
+	return t
+}
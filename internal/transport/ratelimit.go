@@ -0,0 +1,191 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is the rate limit of an upstream host, as observed on the
+// responses to the requests to the host.
+type RateLimit struct {
+	// Host is the host of the requests.
+	Host string
+
+	// Limited is true if a request was rejected by the rate limit, with 429
+	// Too Many Requests, or with 403 Forbidden and no remaining request.
+	Limited bool
+
+	// Remaining is the number of remaining requests of the last response
+	// with an X-RateLimit-Remaining or RateLimit-Remaining header, -1 if
+	// none had one.
+	Remaining int
+
+	// Reset is the time at which the rate limit is reset, from the
+	// Retry-After, X-RateLimit-Reset or RateLimit-Reset header, zero if
+	// unknown.
+	Reset time.Time
+}
+
+// RateLimits records the rate limits of the hosts of the requests made with
+// a context of WithRateLimits, e.g. during the reconciliation of a source.
+type RateLimits struct {
+	mu     sync.Mutex
+	limits map[string]*RateLimit
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// rateLimitsKey is the key of the RateLimits in the context of a request.
+type rateLimitsKey struct{}
+
+// WithRateLimits returns the given context with a new RateLimits, which
+// records the rate limits of the requests made with the context through the
+// transport of WithUserAgent.
+func WithRateLimits(ctx context.Context) (context.Context, *RateLimits) {
+	limits := &RateLimits{limits: map[string]*RateLimit{}, now: time.Now}
+	return context.WithValue(ctx, rateLimitsKey{}, limits), limits
+}
+
+// Limited returns the rate limit of the host that rejected a request with
+// the latest reset, nil if no request was rejected. A nil RateLimits returns
+// nil.
+func (l *RateLimits) Limited() *RateLimit {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var limited *RateLimit
+	for _, limit := range l.limits {
+		if limit.Limited && (limited == nil || limit.Reset.After(limited.Reset)) {
+			c := *limit
+			limited = &c
+		}
+	}
+	return limited
+}
+
+// Observed returns the rate limits of all the hosts of which a response had
+// rate limit headers or rejected a request, sorted by host. A nil RateLimits
+// returns nil.
+func (l *RateLimits) Observed() []RateLimit {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits := make([]RateLimit, 0, len(l.limits))
+	for _, limit := range l.limits {
+		limits = append(limits, *limit)
+	}
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Host < limits[j].Host })
+	return limits
+}
+
+// observe records the rate limit of the given response to a request to the
+// given host, if it rejected the request or has rate limit headers. A
+// request once rejected by a host remains rejected, with the latest reset.
+func (l *RateLimits) observe(host string, resp *http.Response) {
+	now := l.now()
+	remaining := rateLimitRemaining(resp.Header)
+	limited := resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusForbidden && remaining == 0
+	reset := rateLimitReset(resp.Header, now)
+	if !limited && remaining < 0 && reset.IsZero() {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, ok := l.limits[host]
+	if !ok {
+		limit = &RateLimit{Host: host, Remaining: -1}
+		l.limits[host] = limit
+	}
+	limit.Limited = limit.Limited || limited
+	if remaining >= 0 {
+		limit.Remaining = remaining
+	}
+	if reset.After(limit.Reset) {
+		limit.Reset = reset
+	}
+}
+
+// rateLimitRemaining returns the remaining requests of the X-RateLimit-Remaining
+// header, e.g. of GitHub, or of the RateLimit-Remaining header, e.g. of
+// Docker Hub with its window '76;w=21600', -1 if neither is set.
+func rateLimitRemaining(h http.Header) int {
+	for _, key := range []string{"X-RateLimit-Remaining", "RateLimit-Remaining"} {
+		v := h.Get(key)
+		if i := strings.IndexByte(v, ';'); i >= 0 {
+			v = v[:i]
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return -1
+}
+
+// rateLimitReset returns the time at which the rate limit is reset, from the
+// Retry-After header, in seconds or as an HTTP date, or else from the
+// X-RateLimit-Reset or RateLimit-Reset header, in seconds or as a Unix time
+// for the values over a billion, e.g. of GitHub and GitLab. It returns zero
+// if none is set, and is never before now.
+func rateLimitReset(h http.Header, now time.Time) time.Time {
+	var reset time.Time
+	if v := strings.TrimSpace(h.Get("Retry-After")); v != "" {
+		if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+			reset = now.Add(time.Duration(s) * time.Second)
+		} else if t, err := http.ParseTime(v); err == nil {
+			reset = t
+		}
+	}
+	for _, key := range []string{"X-RateLimit-Reset", "RateLimit-Reset"} {
+		if !reset.IsZero() {
+			break
+		}
+		s, err := strconv.ParseInt(strings.TrimSpace(h.Get(key)), 10, 64)
+		switch {
+		case err != nil || s < 0:
+		case s > 1e9:
+			reset = time.Unix(s, 0)
+		default:
+			reset = now.Add(time.Duration(s) * time.Second)
+		}
+	}
+	if !reset.IsZero() && reset.Before(now) {
+		return now
+	}
+	return reset
+}
+
+// observeRateLimit records the rate limit of the given response in the
+// RateLimits of the context of the given request, if any.
+func observeRateLimit(req *http.Request, resp *http.Response) {
+	if limits, ok := req.Context().Value(rateLimitsKey{}).(*RateLimits); ok && resp != nil {
+		limits.observe(req.URL.Hostname(), resp)
+	}
+}
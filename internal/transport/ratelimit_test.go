@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitReset(t *testing.T) {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Time
+	}{
+		{name: "none", header: http.Header{}},
+		{name: "Retry-After seconds", header: http.Header{"Retry-After": []string{"120"}}, want: now.Add(2 * time.Minute)},
+		{name: "Retry-After date", header: http.Header{"Retry-After": []string{"Wed, 01 Sep 2021 12:05:00 GMT"}},
+			want: now.Add(5 * time.Minute)},
+		{name: "Retry-After takes precedence", header: http.Header{"Retry-After": []string{"60"}, "X-Ratelimit-Reset": []string{"1630500000"}},
+			want: now.Add(time.Minute)},
+		{name: "X-RateLimit-Reset Unix time", header: http.Header{"X-Ratelimit-Reset": []string{strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}},
+			want: now.Add(time.Hour)},
+		{name: "RateLimit-Reset seconds", header: http.Header{"Ratelimit-Reset": []string{"30"}}, want: now.Add(30 * time.Second)},
+		{name: "past reset", header: http.Header{"X-Ratelimit-Reset": []string{"1600000000"}}, want: now},
+		{name: "invalid", header: http.Header{"Retry-After": []string{"soon"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rateLimitReset(tt.header, now); !got.Equal(tt.want) {
+				t.Errorf("rateLimitReset() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRateLimits(t *testing.T) {
+	var status int
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	ctx, limits := WithRateLimits(context.Background())
+	now := time.Now().Truncate(time.Second)
+	limits.now = func() time.Time { return now }
+	get := func(s int, h http.Header) {
+		status, header = s, h
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: WithUserAgent(nil)}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get(http.StatusOK, nil)
+	if got := limits.Observed(); len(got) != 0 {
+		t.Fatalf("Observed() without rate limit headers = %v, want none", got)
+	}
+
+	get(http.StatusOK, http.Header{"Ratelimit-Remaining": []string{"76;w=21600"}})
+	got := limits.Observed()
+	if len(got) != 1 || got[0].Host != "127.0.0.1" || got[0].Remaining != 76 || got[0].Limited {
+		t.Fatalf("Observed() = %+v, want 76 remaining requests", got)
+	}
+	if limits.Limited() != nil {
+		t.Errorf("Limited() = %+v, want nil", limits.Limited())
+	}
+
+	get(http.StatusForbidden, http.Header{"X-Ratelimit-Remaining": []string{"0"}, "X-Ratelimit-Reset": []string{strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}})
+	get(http.StatusOK, nil)
+	limited := limits.Limited()
+	if limited == nil || limited.Remaining != 0 || !limited.Reset.Equal(now.Add(time.Hour)) {
+		t.Errorf("Limited() = %+v, want limited until the reset", limited)
+	}
+
+	var nilLimits *RateLimits
+	if nilLimits.Limited() != nil || nilLimits.Observed() != nil {
+		t.Error("nil RateLimits has rate limits")
+	}
+}
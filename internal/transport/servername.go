@@ -0,0 +1,73 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// WithServerName returns an http.RoundTripper of the given http.Transport,
+// of which the requests to the given URL host, e.g. the address of an ingress
+// reachable by IP only, address the server by the given name instead: the
+// name is sent as the TLS server name (SNI), the certificate of the server is
+// verified against it, and it is sent as the Host header, with the port of
+// the URL if any. The requests to any other host, e.g. of a redirect, are
+// sent as is.
+func WithServerName(t *http.Transport, host, serverName string) http.RoundTripper {
+	named := t.Clone()
+	if named.TLSClientConfig == nil {
+		named.TLSClientConfig = &tls.Config{}
+	}
+	named.TLSClientConfig.ServerName = serverName
+	return &serverNameTransport{
+		host:       host,
+		serverName: serverName,
+		named:      named,
+		next:       t,
+	}
+}
+
+// serverNameTransport is an http.RoundTripper which addresses the server of
+// a host by a name other than the host.
+type serverNameTransport struct {
+	host       string
+	serverName string
+	named      *http.Transport
+	next       *http.Transport
+}
+
+// RoundTrip implements http.RoundTripper, the request is cloned as a
+// RoundTripper must not modify the request.
+func (t *serverNameTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Host = t.serverName
+	if port := req.URL.Port(); port != "" {
+		req.Host = net.JoinHostPort(t.serverName, port)
+	}
+	return t.named.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the transports.
+func (t *serverNameTransport) CloseIdleConnections() {
+	t.named.CloseIdleConnections()
+	t.next.CloseIdleConnections()
+}
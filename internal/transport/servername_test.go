@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newNamedTLSServer starts a TLS server of which the certificate is valid for
+// the given DNS name only, and not for the address it listens on, and returns
+// it with a tls.Config trusting its certificate.
+func newNamedTLSServer(t *testing.T, name string, handler http.Handler) (*httptest.Server, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestWithServerName(t *testing.T) {
+	var host, sni string
+	server, config := newNamedTLSServer(t, "charts.internal.example.com", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, sni = r.Host, r.TLS.ServerName
+	}))
+	u, _ := url.Parse(server.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	// the certificate is not valid for the address of the server
+	if _, err := (&http.Client{Transport: NewTransport(config)}).Get(server.URL); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error without the server name, got %v", err)
+	}
+
+	client := &http.Client{Transport: WithServerName(NewTransport(config), u.Host, "charts.internal.example.com")}
+	resp, err := client.Get(server.URL + "/index.yaml")
+	if err != nil {
+		t.Fatalf("request with the server name failed: %v", err)
+	}
+	resp.Body.Close()
+	if sni != "charts.internal.example.com" {
+		t.Errorf("expected the server name to be sent as SNI, got %q", sni)
+	}
+	if want := net.JoinHostPort("charts.internal.example.com", port); host != want {
+		t.Errorf("expected Host %q, got %q", want, host)
+	}
+
+	// the certificate is verified against the server name
+	client = &http.Client{Transport: WithServerName(NewTransport(config), u.Host, "git.internal.example.com")}
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), "git.internal.example.com") {
+		t.Errorf("expected a certificate error for another server name, got %v", err)
+	}
+
+	// the requests to other hosts are sent as is
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer other.Close()
+	client = &http.Client{Transport: WithServerName(NewTransport(config), u.Host, "charts.internal.example.com")}
+	resp, err = client.Get(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := strings.TrimPrefix(other.URL, "http://"); host != want {
+		t.Errorf("expected Host %q for another host, got %q", want, host)
+	}
+}
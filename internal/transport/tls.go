@@ -0,0 +1,153 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/fluxcd/source-controller/internal/egress"
+	"github.com/fluxcd/source-controller/internal/secretdata"
+)
+
+const (
+	// CAFileField is the Secret field holding PEM encoded CA certificates,
+	// consistent with the Helm and Git secrets.
+	CAFileField = "caFile"
+
+	// CACrtField is the Secret field holding PEM encoded CA certificates in
+	// kubernetes.io/tls Secrets.
+	CACrtField = "ca.crt"
+
+	// CertFileField and KeyFileField are the Secret fields holding the PEM
+	// encoded client certificate and key, consistent with the Helm secrets.
+	CertFileField = "certFile"
+	KeyFileField  = "keyFile"
+)
+
+// TLSConfigFromSecret returns a tls.Config which verifies server certificates
+// against the system roots, and the CA certificates in the 'caFile' or
+// 'ca.crt' field of the given Secret. It returns nil if the Secret is nil or
+// has neither field, and an error if the field does not contain any PEM
+// encoded certificates, naming the suspected problem if its encoding is
+// mistaken, as detected by secretdata.Hint.
+func TLSConfigFromSecret(secret *corev1.Secret) (*tls.Config, error) {
+	if secret == nil {
+		return nil, nil
+	}
+	field := CAFileField
+	caBytes, ok := secret.Data[field]
+	if !ok {
+		field = CACrtField
+		if caBytes, ok = secret.Data[field]; !ok {
+			return nil, nil
+		}
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("invalid '%s' secret data: field '%s' does not contain any PEM encoded certificates%s",
+			secret.Name, field, secretdata.Hint(field, caBytes))
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// ClientCertificateFromSecret returns the client certificate in the
+// 'certFile' and 'keyFile' fields of the given Secret, or else in the
+// 'tls.crt' and 'tls.key' fields of kubernetes.io/tls Secrets. It returns nil
+// if the Secret is nil or has neither pair of fields, and an error if only
+// one field of a pair is set or the certificate and key are invalid.
+func ClientCertificateFromSecret(secret *corev1.Secret) (*tls.Certificate, error) {
+	if secret == nil {
+		return nil, nil
+	}
+	certField, keyField := CertFileField, KeyFileField
+	if _, ok := secret.Data[certField]; !ok {
+		if _, ok := secret.Data[keyField]; !ok {
+			certField, keyField = corev1.TLSCertKey, corev1.TLSPrivateKeyKey
+		}
+	}
+	certBytes, keyBytes := secret.Data[certField], secret.Data[keyField]
+	switch {
+	case len(certBytes) == 0 && len(keyBytes) == 0:
+		return nil, nil
+	case len(certBytes) == 0 || len(keyBytes) == 0:
+		return nil, fmt.Errorf("invalid '%s' secret data: fields '%s' and '%s' require each other's presence",
+			secret.Name, certField, keyField)
+	}
+	cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid '%s' secret data: %w%s%s", secret.Name, err,
+			secretdata.Hint(certField, certBytes), secretdata.Hint(keyField, keyBytes))
+	}
+	return &cert, nil
+}
+
+// NewTransport returns a clone of http.DefaultTransport for the connections
+// to the endpoints of the sources, with the given tls.Config, which may be
+// nil, and the dialer and egress policy of WithEgressPolicy.
+func NewTransport(config *tls.Config) *http.Transport {
+	return NewProxyTransport(config, nil)
+}
+
+// NewControllerTransport returns a clone of http.DefaultTransport with the
+// dual-stack dialer of NewDialer, for the connections of the controller
+// itself rather than of a source, e.g. to the instance metadata service for
+// the credentials of the controller, to which the egress policy does not
+// apply.
+func NewControllerTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = NewDialer().DialContext
+	return t
+}
+
+// WithEgressPolicy returns the given http.Transport, of which the connections
+// are dialed with DialContext, and the host of every request, including the
+// requests of the redirects, is checked against the egress policy of the
+// controller before it is sent. The host of a request sent through a proxy,
+// which resolves it instead of DialContext, is resolved and all its addresses
+// are checked, as by CheckURL.
+func WithEgressPolicy(t *http.Transport) *http.Transport {
+	t.DialContext = DialContext
+	proxy := t.Proxy
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		policy := egress.CurrentPolicy()
+		if err := policy.CheckHost(req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+		if proxy == nil {
+			return nil, nil
+		}
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		if err := policy.CheckURL(req.Context(), req.URL.String()); err != nil {
+			return nil, err
+		}
+		return proxyURL, nil
+	}
+	return t
+}
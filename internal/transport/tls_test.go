@@ -0,0 +1,189 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTLSConfigFromSecret(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	tests := []struct {
+		name       string
+		secret     *corev1.Secret
+		wantConfig bool
+		wantErr    string
+	}{
+		{
+			name: "nil secret",
+		},
+		{
+			name:   "no CA fields",
+			secret: &corev1.Secret{Data: map[string][]byte{"accesskey": []byte("access")}},
+		},
+		{
+			name:       "caFile",
+			secret:     &corev1.Secret{Data: map[string][]byte{CAFileField: caPEM}},
+			wantConfig: true,
+		},
+		{
+			name:       "ca.crt",
+			secret:     &corev1.Secret{Data: map[string][]byte{CACrtField: caPEM}},
+			wantConfig: true,
+		},
+		{
+			name: "invalid CA",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+				Data:       map[string][]byte{CACrtField: []byte("invalid")},
+			},
+			wantErr: "invalid 'creds' secret data: field 'ca.crt' does not contain any PEM encoded certificates",
+		},
+		{
+			name: "CA with a byte order mark",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+				Data:       map[string][]byte{CAFileField: append([]byte("\xef\xbb\xbf"), caPEM...)},
+			},
+			wantErr: "invalid 'creds' secret data: field 'caFile' does not contain any PEM encoded certificates, " +
+				"suspected a UTF-8 byte order mark in field 'caFile'",
+		},
+		{
+			name: "CA base64 encoded twice",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+				Data:       map[string][]byte{CACrtField: []byte(base64.StdEncoding.EncodeToString(caPEM))},
+			},
+			wantErr: "invalid 'creds' secret data: field 'ca.crt' does not contain any PEM encoded certificates, " +
+				"suspected a value base64 encoded twice in field 'ca.crt'",
+		},
+		{
+			name:       "CA with CRLF line endings",
+			secret:     &corev1.Secret{Data: map[string][]byte{CAFileField: bytes.ReplaceAll(caPEM, []byte("\n"), []byte("\r\n"))}},
+			wantConfig: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := TLSConfigFromSecret(tt.secret)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("TLSConfigFromSecret() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (config != nil) != tt.wantConfig {
+				t.Fatalf("TLSConfigFromSecret() config = %v, want config %v", config, tt.wantConfig)
+			}
+			if config == nil {
+				return
+			}
+			client := &http.Client{Transport: NewTransport(config)}
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatalf("request with CA from secret failed: %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+
+	// The server certificate is not trusted without the CA
+	client := &http.Client{Transport: NewTransport(nil)}
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected certificate error, got %v", err)
+	}
+}
+
+func TestClientCertificateFromSecret(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	keyDER, err := x509.MarshalPKCS8PrivateKey(server.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	tests := []struct {
+		name     string
+		secret   *corev1.Secret
+		wantCert bool
+		wantErr  string
+	}{
+		{name: "nil secret"},
+		{name: "no certificate fields", secret: &corev1.Secret{Data: map[string][]byte{CAFileField: certPEM}}},
+		{
+			name:     "certFile and keyFile",
+			secret:   &corev1.Secret{Data: map[string][]byte{CertFileField: certPEM, KeyFileField: keyPEM}},
+			wantCert: true,
+		},
+		{
+			name:     "tls.crt and tls.key",
+			secret:   &corev1.Secret{Data: map[string][]byte{corev1.TLSCertKey: certPEM, corev1.TLSPrivateKeyKey: keyPEM}},
+			wantCert: true,
+		},
+		{
+			name: "certFile without keyFile",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+				Data:       map[string][]byte{CertFileField: certPEM, corev1.TLSPrivateKeyKey: keyPEM},
+			},
+			wantErr: "invalid 'creds' secret data: fields 'certFile' and 'keyFile' require each other's presence",
+		},
+		{
+			name: "key base64 encoded twice",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+				Data:       map[string][]byte{CertFileField: certPEM, KeyFileField: []byte(base64.StdEncoding.EncodeToString(keyPEM))},
+			},
+			wantErr: "suspected a value base64 encoded twice in field 'keyFile'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := ClientCertificateFromSecret(tt.secret)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ClientCertificateFromSecret() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (cert != nil) != tt.wantCert {
+				t.Errorf("ClientCertificateFromSecret() = %v, want certificate %v", cert, tt.wantCert)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// userAgentProduct is the product of the User-Agent of the outbound
+// requests of the controller.
+const userAgentProduct = "source-controller"
+
+var (
+	userAgentMu sync.RWMutex
+	userAgent   = userAgentProduct + "/" + buildVersion()
+)
+
+// buildVersion returns the version of the controller from the build info of
+// the binary, without the 'v' prefix, or 'dev' for a build from a working
+// tree.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "dev"
+	}
+	return strings.TrimPrefix(info.Main.Version, "v")
+}
+
+// UserAgent returns the User-Agent of the outbound requests of the
+// controller, 'source-controller/<version>' followed by the suffix set with
+// SetUserAgentSuffix, if any.
+func UserAgent() string {
+	userAgentMu.RLock()
+	defer userAgentMu.RUnlock()
+	return userAgent
+}
+
+// SetUserAgentSuffix appends the given suffix to the User-Agent of the
+// outbound requests of the controller, e.g. to identify the cluster. It
+// returns an error if the suffix is not a valid header value.
+func SetUserAgentSuffix(suffix string) error {
+	suffix = strings.TrimSpace(suffix)
+	for _, r := range suffix {
+		if r < ' ' || r == 0x7f || r > '~' {
+			return fmt.Errorf("invalid User-Agent suffix '%s': it must only contain printable ASCII characters", suffix)
+		}
+	}
+	ua := userAgentProduct + "/" + buildVersion()
+	if suffix != "" {
+		ua += " " + suffix
+	}
+	userAgentMu.Lock()
+	defer userAgentMu.Unlock()
+	userAgent = ua
+	return nil
+}
+
+// WithUserAgent returns the given http.RoundTripper, which sets the
+// User-Agent of the controller on every request, replacing the User-Agent
+// of the client library, propagates the trace context of the request, if
+// tracing is enabled, and records the rate limit of the response in the
+// RateLimits of WithRateLimits, if any. A nil http.RoundTripper is
+// http.DefaultTransport.
+func WithUserAgent(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &userAgentTransport{next: rt}
+}
+
+// userAgentTransport is an http.RoundTripper which sets the User-Agent of
+// the controller.
+type userAgentTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper, the request is cloned as a
+// RoundTripper must not modify the request.
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", UserAgent())
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	resp, err := t.next.RoundTrip(req)
+	observeRateLimit(req, resp)
+	return resp, err
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped
+// http.RoundTripper, if it supports it.
+func (t *userAgentTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetUserAgentSuffix(t *testing.T) {
+	defer SetUserAgentSuffix("")
+
+	if ua := UserAgent(); !strings.HasPrefix(ua, "source-controller/") || strings.Contains(ua, " ") {
+		t.Errorf("UserAgent() = %q, want 'source-controller/<version>'", ua)
+	}
+	if err := SetUserAgentSuffix("cluster/prod-eu-1"); err != nil {
+		t.Fatal(err)
+	}
+	if ua := UserAgent(); !strings.HasPrefix(ua, "source-controller/") || !strings.HasSuffix(ua, " cluster/prod-eu-1") {
+		t.Errorf("UserAgent() = %q, want the suffix", ua)
+	}
+	if err := SetUserAgentSuffix("cluster\r\nX-Injected: true"); err == nil {
+		t.Error("SetUserAgentSuffix() of a suffix with a line break error = nil, want an error")
+	}
+	if ua := UserAgent(); !strings.HasSuffix(ua, " cluster/prod-eu-1") {
+		t.Errorf("UserAgent() after an invalid suffix = %q, want the previous suffix", ua)
+	}
+}
+
+func TestWithUserAgent(t *testing.T) {
+	defer SetUserAgentSuffix("")
+	if err := SetUserAgentSuffix("cluster/prod-eu-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "library/1.0")
+	resp, err := (&http.Client{Transport: WithUserAgent(nil)}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != UserAgent() {
+		t.Errorf("User-Agent = %q, want %q", got, UserAgent())
+	}
+	if req.UserAgent() != "library/1.0" {
+		t.Errorf("User-Agent of the original request = %q, want it unchanged", req.UserAgent())
+	}
+}
+
+func TestWithUserAgent_traceContext(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+	do := func() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: WithUserAgent(nil)}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// without tracing, no trace context is propagated
+	do()
+	if got != "" {
+		t.Errorf("traceparent without tracing = %q, want none", got)
+	}
+
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	do()
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"; got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+}
@@ -17,46 +17,69 @@ limitations under the License.
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	flag "github.com/spf13/pflag"
+	"golang.org/x/time/rate"
 	"helm.sh/helm/v3/pkg/getter"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	"github.com/fluxcd/pkg/runtime/client"
 	"github.com/fluxcd/pkg/runtime/events"
 	"github.com/fluxcd/pkg/runtime/leaderelection"
 	"github.com/fluxcd/pkg/runtime/logger"
 	"github.com/fluxcd/pkg/runtime/metrics"
-	"github.com/fluxcd/pkg/runtime/pprof"
 	"github.com/fluxcd/pkg/runtime/probes"
 
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
 	"github.com/fluxcd/source-controller/controllers"
+	"github.com/fluxcd/source-controller/internal/debug"
+	"github.com/fluxcd/source-controller/internal/egress"
+	"github.com/fluxcd/source-controller/internal/fips"
+	"github.com/fluxcd/source-controller/internal/helm"
+	"github.com/fluxcd/source-controller/internal/tracing"
+	"github.com/fluxcd/source-controller/internal/transport"
+	"github.com/fluxcd/source-controller/pkg/oci"
 	// +kubebuilder:scaffold:imports
 )
 
 const controllerName = "source-controller"
 
+// fileServerShutdownTimeout is the maximum duration for which the in-flight
+// downloads of the file server are waited for on shutdown.
+const fileServerShutdownTimeout = 5 * time.Second
+
+// leaderElectionJitterFactor is the JitterFactor of the leader elector of
+// client-go, by which the renew deadline must exceed the retry period.
+const leaderElectionJitterFactor = 1.2
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
 	getters  = getter.Providers{
 		getter.Provider{
 			Schemes: []string{"http", "https"},
-			New:     getter.NewHTTPGetter,
+			New:     helm.NewHTTPGetter,
 		},
 	}
 )
@@ -69,15 +92,89 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	var (
 		metricsAddr           string
 		eventsAddr            string
+		eventsDedupWindow     time.Duration
+		eventsMaxWarnings     int
+		fetchMetrics          string
 		healthAddr            string
+		enablePprof           bool
 		storagePath           string
 		storageAddr           string
 		storageAdvAddr        string
+		storageAdvURL         string
+		storageSocketMode     string
+		storageShared         bool
+		storageTLSCertFile    string
+		storageTLSKeyFile     string
+		storageTLSClientCA    string
+		storageMaxDownloads   int
+		storageMaxBandwidth   string
+		storageBackend        string
+		storageS3             controllers.S3BackendOptions
+		storageHighWatermark  int
+		storageWriteRetries   int
 		concurrent            int
+		concurrentGit         int
+		concurrentHelmRepo    int
+		concurrentHelmChart   int
+		concurrentBucket      int
+		concurrentOCIRepo     int
+		bucketConcurrency     int
+		bucketFullResync      time.Duration
+		bucketMaxObjects      int64
+		bucketMaxSize         string
+		helmIndexCacheSize    int
+		helmIndexCacheTTL     time.Duration
 		requeueDependency     time.Duration
+		minRetryDelay         time.Duration
+		maxRetryDelay         time.Duration
+		shutdownTimeout       time.Duration
+		intervalJitter        int
+		startupRampUp         time.Duration
+		minInterval           time.Duration
+		defaultInterval       time.Duration
+		defaultTimeout        time.Duration
+		defaultKindIntervals  map[string]string
+		defaultKindTimeouts   map[string]string
+		enableValidation      bool
+		webhookPort           int
+		webhookCertDir        string
+		reconcileTrace        bool
+		namespaceRateLimit    int
+		userAgentSuffix       string
+		egressPolicyFile      string
+		ambientHosts          []string
+		enableTracing         bool
+		tracingSamplingRatio  float64
+		retentionRecords      int
+		retentionTTL          time.Duration
+		retainDeleted         bool
+		gcInterval            time.Duration
+		artifactEncoding      string
+		artifactGzipLevel     int
+		artifactMaxSize       string
+		artifactDigestAlgo    string
+		artifactSigningKey    string
+		cosignRootsFile       string
+		cosignRekorKeysFile   string
+		registryMirrorsFile   string
+		ociMaxPulls           int
+		mirrorFallback        bool
+		artifactDedup         bool
+		verifyOnStart         bool
+		verifyInterval        time.Duration
+		checksumInterval      time.Duration
+		verifyRequeueRate     float64
+		errorThreshold        int
+		errorWindow           time.Duration
 		watchAllNamespaces    bool
 		clientOptions         client.Options
 		logOptions            logger.Options
@@ -88,17 +185,160 @@ func main() {
 		"The address the metric endpoint binds to.")
 	flag.StringVar(&eventsAddr, "events-addr", envOrDefault("EVENTS_ADDR", ""),
 		"The address of the events receiver.")
+	flag.DurationVar(&eventsDedupWindow, "events-dedup-window", 0,
+		"The duration within which an event identical to the last event of a source is not emitted again. Zero disables the deduplication.")
+	flag.IntVar(&eventsMaxWarnings, "events-max-warnings-per-hour", 0,
+		"The maximum number of repeated error events emitted per source per hour. Zero means unlimited.")
+	flag.StringVar(&fetchMetrics, "fetch-metrics-granularity", controllers.FetchMetricsPerObject,
+		"The granularity of the metrics of the failures to fetch the upstream of the sources, 'object' to label them by source or 'kind' for very large fleets.")
 	flag.StringVar(&healthAddr, "health-addr", ":9440", "The address the health endpoint binds to.")
+	flag.BoolVar(&enablePprof, "enable-pprof", false,
+		"Serve the pprof profiles and the reconciliations in progress on the metrics address under /debug, to the requests from localhost only. For debugging only.")
 	flag.StringVar(&storagePath, "storage-path", envOrDefault("STORAGE_PATH", ""),
 		"The local storage path.")
 	flag.StringVar(&storageAddr, "storage-addr", envOrDefault("STORAGE_ADDR", ":9090"),
-		"The address the static file server binds to.")
+		"The address the static file server binds to, or the path of its unix domain socket with the 'unix://' prefix, e.g. 'unix:///var/run/source-controller/artifacts.sock'.")
 	flag.StringVar(&storageAdvAddr, "storage-adv-addr", envOrDefault("STORAGE_ADV_ADDR", ""),
 		"The advertised address of the static file server.")
+	flag.StringVar(&storageAdvURL, "storage-adv-url", envOrDefault("STORAGE_ADV_URL", ""),
+		"The advertised URL of the artifacts, of which the scheme and host replace the scheme of the static file server and the --storage-adv-addr, e.g. the address of a sidecar in front of it.")
+	flag.StringVar(&storageSocketMode, "storage-socket-mode", fmt.Sprintf("%04o", controllers.DefaultStorageSocketMode),
+		"The permissions, in octal, of the unix domain socket of the static file server.")
+	flag.BoolVar(&storageShared, "storage-shared", false,
+		"The storage is shared by the replicas of the controller, e.g. a ReadWriteMany volume, and the artifacts written by the leader are served by all replicas.")
+	flag.StringVar(&storageTLSCertFile, "storage-tls-cert-file", "",
+		"The path of the TLS certificate of the static file server, which is reloaded on change. If set, artifacts are served over HTTPS.")
+	flag.StringVar(&storageTLSKeyFile, "storage-tls-key-file", "",
+		"The path of the TLS private key of the static file server, which is reloaded on change.")
+	flag.StringVar(&storageTLSClientCA, "storage-tls-client-ca-file", "",
+		"The path of the CA certificate used to verify the client certificates of the static file server. If set, clients must authenticate with a certificate signed by the CA.")
+	flag.IntVar(&storageMaxDownloads, "storage-max-concurrent-downloads", 0,
+		"The maximum number of concurrent artifact downloads from the static file server. Zero means unlimited.")
+	flag.StringVar(&storageMaxBandwidth, "storage-max-bandwidth", "0",
+		"The maximum aggregate bandwidth in bytes per second of the artifact downloads from the static file server, e.g. '100Mi'. Zero means unlimited.")
+	flag.StringVar(&storageBackend, "storage-backend", controllers.StorageBackendFilesystem,
+		"The store of the artifacts, 'filesystem' for the local storage path, or 's3' for an S3 compatible bucket, in addition to the local storage path.")
+	flag.StringVar(&storageS3.Endpoint, "storage-s3-endpoint", "",
+		"The endpoint of the S3 compatible service of the 's3' storage backend, e.g. 's3.amazonaws.com'.")
+	flag.StringVar(&storageS3.Bucket, "storage-s3-bucket", "",
+		"The bucket of the 's3' storage backend.")
+	flag.StringVar(&storageS3.Region, "storage-s3-region", "us-east-1",
+		"The region of the bucket of the 's3' storage backend.")
+	flag.BoolVar(&storageS3.Insecure, "storage-s3-insecure", false,
+		"Connect to the endpoint of the 's3' storage backend over plain HTTP.")
+	flag.StringVar(&storageS3.URL, "storage-s3-url", "",
+		"The base URL of a gateway serving the objects of the bucket of the 's3' storage backend. If not set, the artifact URLs are presigned.")
+	flag.DurationVar(&storageS3.PresignExpiry, "storage-s3-presign-expiry", 24*time.Hour,
+		"The expiry of the presigned artifact URLs of the 's3' storage backend, at most 168h. The URLs are renewed when less than half of their expiry remains.")
+	flag.IntVar(&storageHighWatermark, "storage-high-watermark", 0,
+		"The percentage of the capacity of the storage above which previous artifacts are pruned beyond their retention, and no artifacts are written. Zero disables it, as it requires the storage to be a dedicated volume.")
+	flag.IntVar(&storageWriteRetries, "storage-write-retries", controllers.DefaultStorageWriteRetries,
+		"The number of times the write of an artifact is retried after a transient error of the file system of the storage, e.g. a stale NFS file handle. Zero disables the retries.")
 	flag.IntVar(&concurrent, "concurrent", 2, "The number of concurrent reconciles per controller.")
+	flag.IntVar(&concurrentGit, "concurrent-gitrepository", 0,
+		"The number of concurrent GitRepository reconciles. Defaults to the value of --concurrent.")
+	flag.IntVar(&concurrentHelmRepo, "concurrent-helmrepository", 0,
+		"The number of concurrent HelmRepository reconciles. Defaults to the value of --concurrent.")
+	flag.IntVar(&concurrentHelmChart, "concurrent-helmchart", 0,
+		"The number of concurrent HelmChart reconciles. Defaults to the value of --concurrent.")
+	flag.IntVar(&concurrentBucket, "concurrent-bucket", 0,
+		"The number of concurrent Bucket reconciles. Defaults to the value of --concurrent.")
+	flag.IntVar(&concurrentOCIRepo, "concurrent-ocirepository", 0,
+		"The number of concurrent OCIRepository reconciles. Defaults to the value of --concurrent.")
+	flag.IntVar(&bucketConcurrency, "bucket-download-concurrency", 10,
+		"The number of objects downloaded in parallel by a single Bucket reconciliation.")
+	flag.DurationVar(&bucketFullResync, "bucket-full-resync-interval", 24*time.Hour,
+		"The interval at which all objects of a Bucket are downloaded again, instead of only new and modified objects. Zero disables incremental syncs.")
+	flag.Int64Var(&bucketMaxObjects, "bucket-max-objects", 0,
+		"The default maximum number of objects in a Bucket artifact. Zero means unlimited.")
+	flag.StringVar(&bucketMaxSize, "bucket-max-size", "0",
+		"The default maximum total size of the objects in a Bucket artifact, e.g. '10Gi'. Zero means unlimited.")
+	flag.IntVar(&helmIndexCacheSize, "helm-index-cache-max-size", 0,
+		"The maximum number of parsed Helm repository indexes cached in memory for the HelmChart reconciles. Zero disables the cache.")
+	flag.DurationVar(&helmIndexCacheTTL, "helm-index-cache-ttl", controllers.DefaultIndexCacheTTL,
+		"The duration for which a parsed Helm repository index is cached.")
+	flag.IntVar(&retentionRecords, "artifact-retention-records", controllers.DefaultArtifactRetentionRecords,
+		"The maximum number of artifacts kept in storage for a source, including the current one. Zero means unlimited.")
+	flag.DurationVar(&retentionTTL, "artifact-retention-ttl", controllers.DefaultArtifactRetentionTTL,
+		"The duration for which the previous artifacts of a source are kept in storage. Zero means unlimited.")
+	flag.BoolVar(&retainDeleted, "artifact-retain-deleted", false,
+		"Keep the artifacts of deleted sources in storage, and the storage directories without a source on start.")
+	flag.DurationVar(&gcInterval, "artifact-gc-interval", 10*time.Minute,
+		"The interval at which the previous artifacts of all sources are garbage collected. Zero disables the periodic garbage collection.")
+	flag.StringVar(&artifactEncoding, "artifact-encoding", controllers.ArchiveEncodingGzip,
+		"The compression of the tarball artifacts, 'gzip' or 'zstd'. Consumers of zstd artifacts must support zstd.")
+	flag.IntVar(&artifactGzipLevel, "artifact-gzip-level", gzip.DefaultCompression,
+		"The gzip compression level of the tarball artifacts, from 0 (no compression) to 9 (best compression), or -1 for the default level.")
+	flag.StringVar(&artifactMaxSize, "artifact-max-size", "0",
+		"The maximum size of an artifact, e.g. '500Mi'. Zero means unlimited.")
+	flag.StringVar(&artifactDigestAlgo, "artifact-digest-algorithm", controllers.DefaultDigestAlgorithm,
+		"The algorithm of the digest of the artifacts, 'sha256', 'sha384' or 'sha512'. The checksum of the artifacts is always SHA256.")
+	flag.StringVar(&artifactSigningKey, "artifact-signing-key", envOrDefault("ARTIFACT_SIGNING_KEY", ""),
+		"The path to the PEM encoded ECDSA or RSA private key with which the artifacts are signed, as with 'cosign sign-blob'. Empty disables the signing.")
+	flag.StringVar(&cosignRootsFile, "cosign-roots-file", envOrDefault("COSIGN_ROOTS_FILE", ""),
+		"The path to the PEM encoded Fulcio root certificates trusted for the keyless verification of the OCIRepository and HelmChart signatures. Empty disables the keyless verification.")
+	flag.StringVar(&cosignRekorKeysFile, "cosign-rekor-keys-file", envOrDefault("COSIGN_REKOR_KEYS_FILE", ""),
+		"The path to the YAML file of the public keys of the Rekor transparency logs trusted for the keyless verification, by log URL. The key of the public log at https://rekor.sigstore.dev is pinned.")
+	flag.StringVar(&registryMirrorsFile, "registry-mirrors-file", envOrDefault("REGISTRY_MIRRORS_FILE", ""),
+		"The path to the YAML file of the mirrors through which the OCIRepository artifacts and the charts of the OCI HelmRepositories are pulled, by registry host. Empty pulls from the registries of the URLs.")
+	flag.BoolVar(&mirrorFallback, "registry-mirror-fallback", false,
+		"Pull an OCIRepository artifact or an OCI chart from the registry of its URL when the mirror of the registry misses it.")
+	flag.IntVar(&ociMaxPulls, "oci-max-concurrent-pulls", 0,
+		"The maximum number of OCI artifact layers pulled at once, each streamed to a temporary file, across all OCIRepository reconciliations. Zero means unlimited.")
+	flag.BoolVar(&artifactDedup, "artifact-dedup", false,
+		"Store the identical artifacts of different sources once in the storage path, as hard links to a file of their content.")
+	flag.BoolVar(&verifyOnStart, "artifact-verify", true,
+		"Verify the artifacts of all sources against their checksum on start, and request the reconciliation of the sources with a corrupt artifact.")
+	flag.DurationVar(&verifyInterval, "artifact-verify-interval", 0,
+		"The interval at which the artifacts of all sources are verified after the verification on start. Zero disables the periodic verification.")
+	flag.DurationVar(&checksumInterval, "artifact-checksum-interval", controllers.DefaultArtifactChecksumInterval,
+		"The interval at which the artifact of a source is verified against its checksum at the start of its reconciliation, in between only its size and modification time are checked. Zero verifies the checksum at every reconciliation.")
+	flag.Float64Var(&verifyRequeueRate, "artifact-verify-requeue-rate", 1,
+		"The maximum number of sources with a corrupt artifact for which the reconciliation is requested per second.")
+	flag.IntVar(&errorThreshold, "artifact-error-threshold", controllers.DefaultArtifactErrorThreshold,
+		"The number of error responses of the artifact server for the advertised artifact URLs of a source within the --artifact-error-window, at which a warning event is emitted for the source. Zero disables it.")
+	flag.DurationVar(&errorWindow, "artifact-error-window", controllers.DefaultArtifactErrorWindow,
+		"The window in which the error responses for the advertised artifact URLs of a source are counted.")
 	flag.BoolVar(&watchAllNamespaces, "watch-all-namespaces", true,
 		"Watch for custom resources in all namespaces, if set to false it will only watch the runtime namespace.")
 	flag.DurationVar(&requeueDependency, "requeue-dependency", 30*time.Second, "The interval at which failing dependencies are reevaluated.")
+	bindRetryFlags(flag.CommandLine, &minRetryDelay, &maxRetryDelay)
+	flag.DurationVar(&shutdownTimeout, "graceful-shutdown-timeout", 20*time.Second,
+		"The maximum duration for which in-flight reconciliations are waited for on shutdown before they are aborted, it must be lower than the termination grace period of the pod.")
+	flag.IntVar(&intervalJitter, "interval-jitter-percentage", controllers.DefaultIntervalJitterPercentage,
+		"The maximum jitter of the interval of the sources after a successful reconciliation, in percent of the interval, for the sources to drift apart.")
+	flag.DurationVar(&startupRampUp, "startup-ramp-up", controllers.DefaultStartupRampUp,
+		"The window over which the first reconciliations of the sources that are up to date are staggered after the start of the controller, zero disables it.")
+	flag.DurationVar(&minInterval, "min-interval", controllers.DefaultMinInterval,
+		"The minimum interval of the sources, the sources with a shorter interval are rejected by the validation webhook and stalled.")
+	flag.DurationVar(&defaultInterval, "default-source-interval", 0,
+		"The interval of the sources of which the spec omits it, zero means none and the sources without an interval are stalled.")
+	flag.DurationVar(&defaultTimeout, "default-source-timeout", 0,
+		"The timeout of the sources of which the spec omits it, zero means the timeout of the kind, 20s for GitRepository and Bucket and 60s for HelmRepository and OCIRepository.")
+	flag.StringToStringVar(&defaultKindIntervals, "default-source-interval-per-kind", nil,
+		"The intervals of the sources of which the spec omits it by kind, overriding --default-source-interval, e.g. 'HelmRepository=1h,HelmChart=1h'.")
+	flag.StringToStringVar(&defaultKindTimeouts, "default-source-timeout-per-kind", nil,
+		"The timeouts of the sources of which the spec omits it by kind, overriding --default-source-timeout, e.g. 'GitRepository=1m,HelmRepository=1m'.")
+	flag.BoolVar(&enableValidation, "enable-validation-webhook", false,
+		"Serve the validating admission webhook of the sources, which rejects the sources that the controller would stall.")
+	flag.IntVar(&webhookPort, "webhook-port", 9443, "The port the validation webhook binds to.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "",
+		"The directory of the 'tls.crt' and 'tls.key' files of the validation webhook, defaults to '<tmp>/k8s-webhook-server/serving-certs'.")
+	flag.IntVar(&namespaceRateLimit, "namespace-reconciles-per-minute", 0,
+		fmt.Sprintf("The maximum number of reconciliations per minute of the sources of a kind in a namespace, above which the sources are requeued, overridden by the '%s' annotation of the Namespace. Zero means unlimited, unless the Namespace is annotated.",
+			sourcev1.ReconcilesPerMinuteAnnotation))
+	flag.StringVar(&userAgentSuffix, "user-agent-suffix", "",
+		"The suffix of the 'source-controller/<version>' User-Agent of the requests to the Git servers, Helm repositories and buckets, e.g. to identify the cluster.")
+	flag.StringVar(&egressPolicyFile, "egress-policy-file", envOrDefault("EGRESS_POLICY_FILE", ""),
+		"The path of the YAML file of the allow and deny rules of the hosts and CIDRs the sources may connect to.")
+	flag.StringSliceVar(&ambientHosts, "bucket-ambient-credential-hosts", nil,
+		"The endpoint hosts of the Buckets without credentials which may be sent the tokens of the identity of the controller, in addition to 'storage.googleapis.com' and '*.blob.core.windows.net'.")
+	flag.BoolVar(&reconcileTrace, "enable-reconcile-trace", false,
+		"Record a trace of the last reconciliation of the sources, its phases and their duration, in the status of the sources. The status of a source is then written at every reconciliation.")
+	flag.BoolVar(&enableTracing, "enable-tracing", false,
+		"Export the OpenTelemetry spans of the reconciliations and their phases to the OTLP endpoint of the OTEL_EXPORTER_OTLP_ENDPOINT environment variable.")
+	flag.Float64Var(&tracingSamplingRatio, "tracing-sampling-ratio", 1,
+		"The ratio of the reconciliations of which the spans are exported, between 0 and 1.")
 	clientOptions.BindFlags(flag.CommandLine)
 	logOptions.BindFlags(flag.CommandLine)
 	leaderElectionOptions.BindFlags(flag.CommandLine)
@@ -106,6 +346,46 @@ func main() {
 
 	ctrl.SetLogger(logger.NewLogger(logOptions))
 
+	maxSize, err := resource.ParseQuantity(bucketMaxSize)
+	if err != nil {
+		setupLog.Error(err, "invalid --bucket-max-size")
+		os.Exit(1)
+	}
+	artifactMaxBytes, err := resource.ParseQuantity(artifactMaxSize)
+	if err != nil {
+		setupLog.Error(err, "invalid --artifact-max-size")
+		os.Exit(1)
+	}
+	maxBandwidth, err := resource.ParseQuantity(storageMaxBandwidth)
+	if err != nil {
+		setupLog.Error(err, "invalid --storage-max-bandwidth")
+		os.Exit(1)
+	}
+	concurrentByKind := map[string]int{}
+	for _, c := range []struct {
+		kind, flag string
+		value      int
+	}{
+		{sourcev1.GitRepositoryKind, "concurrent-gitrepository", concurrentGit},
+		{sourcev1.HelmRepositoryKind, "concurrent-helmrepository", concurrentHelmRepo},
+		{sourcev1.HelmChartKind, "concurrent-helmchart", concurrentHelmChart},
+		{sourcev1.BucketKind, "concurrent-bucket", concurrentBucket},
+		{sourcev1.OCIRepositoryKind, "concurrent-ocirepository", concurrentOCIRepo},
+	} {
+		n, err := concurrentReconciles(c.flag, c.value, concurrent)
+		if err != nil {
+			setupLog.Error(err, "invalid controller options")
+			os.Exit(1)
+		}
+		concurrentByKind[c.kind] = n
+	}
+	setupLog.Info("concurrent reconciles",
+		sourcev1.GitRepositoryKind, concurrentByKind[sourcev1.GitRepositoryKind],
+		sourcev1.HelmRepositoryKind, concurrentByKind[sourcev1.HelmRepositoryKind],
+		sourcev1.HelmChartKind, concurrentByKind[sourcev1.HelmChartKind],
+		sourcev1.BucketKind, concurrentByKind[sourcev1.BucketKind],
+		sourcev1.OCIRepositoryKind, concurrentByKind[sourcev1.OCIRepositoryKind])
+
 	var eventRecorder *events.Recorder
 	if eventsAddr != "" {
 		if er, err := events.NewRecorder(eventsAddr, controllerName); err != nil {
@@ -115,6 +395,91 @@ func main() {
 			eventRecorder = er
 		}
 	}
+	if eventsMaxWarnings < 0 {
+		setupLog.Error(fmt.Errorf("invalid --events-max-warnings-per-hour '%d', must not be negative", eventsMaxWarnings), "invalid events options")
+		os.Exit(1)
+	}
+	eventLimiter := controllers.NewEventLimiter(eventsDedupWindow, eventsMaxWarnings)
+
+	if helmIndexCacheSize < 0 {
+		setupLog.Error(fmt.Errorf("invalid --helm-index-cache-max-size '%d', must not be negative", helmIndexCacheSize), "invalid Helm index cache options")
+		os.Exit(1)
+	}
+	if helmIndexCacheSize > 0 && helmIndexCacheTTL <= 0 {
+		setupLog.Error(fmt.Errorf("invalid --helm-index-cache-ttl '%s', must be positive", helmIndexCacheTTL), "invalid Helm index cache options")
+		os.Exit(1)
+	}
+	indexCache := controllers.NewIndexCache(helmIndexCacheSize, helmIndexCacheTTL)
+
+	if err := transport.SetUserAgentSuffix(userAgentSuffix); err != nil {
+		setupLog.Error(err, "invalid User-Agent options")
+		os.Exit(1)
+	}
+	setupLog.Info("user agent of the outbound requests", "userAgent", transport.UserAgent())
+	if fips.Enabled() {
+		setupLog.Info("FIPS mode enabled, the artifacts with the SHA1 checksums of previous versions are created again")
+	}
+
+	if err := transport.SetAmbientCredentialHosts(ambientHosts); err != nil {
+		setupLog.Error(err, "invalid ambient credential hosts")
+		os.Exit(1)
+	}
+
+	if egressPolicyFile != "" {
+		policy, err := egress.LoadPolicy(egressPolicyFile)
+		if err != nil {
+			setupLog.Error(err, "invalid egress policy")
+			os.Exit(1)
+		}
+		egress.SetPolicy(policy)
+		setupLog.Info("egress policy of the sources", "allow", policy.Allow, "deny", policy.Deny)
+	}
+
+	if fetchMetrics != controllers.FetchMetricsPerObject && fetchMetrics != controllers.FetchMetricsPerKind {
+		setupLog.Error(fmt.Errorf("invalid --fetch-metrics-granularity '%s', must be '%s' or '%s'",
+			fetchMetrics, controllers.FetchMetricsPerObject, controllers.FetchMetricsPerKind), "invalid metrics options")
+		os.Exit(1)
+	}
+	fetchFailures := controllers.NewFetchMetrics(fetchMetrics)
+
+	if err := validateRetryDelays(minRetryDelay, maxRetryDelay); err != nil {
+		setupLog.Error(err, "invalid retry options")
+		os.Exit(1)
+	}
+
+	if intervalJitter < 0 || intervalJitter >= 100 || startupRampUp < 0 {
+		setupLog.Error(fmt.Errorf("invalid --interval-jitter-percentage '%d' and --startup-ramp-up '%s', the percentage must be between 0 and 99 and the window must not be negative",
+			intervalJitter, startupRampUp), "invalid jitter options")
+		os.Exit(1)
+	}
+	jitter := controllers.NewIntervalJitter(intervalJitter, startupRampUp)
+
+	if minInterval < 0 {
+		setupLog.Error(fmt.Errorf("invalid --min-interval '%s', must not be negative", minInterval), "invalid validation options")
+		os.Exit(1)
+	}
+	sourceDefaults, err := controllers.NewSourceDefaults(defaultInterval, defaultTimeout, defaultKindIntervals, defaultKindTimeouts)
+	if err != nil {
+		setupLog.Error(err, "invalid source defaults")
+		os.Exit(1)
+	}
+	validator := controllers.NewSourceValidator(minInterval)
+	validator.Defaults = sourceDefaults
+
+	var reconcileTracer *controllers.ReconcileTracer
+	if reconcileTrace {
+		reconcileTracer = controllers.NewReconcileTracer(controllers.DefaultReconcileTraceMaxSize)
+	}
+
+	var reconcileSpans *controllers.ReconcileSpans
+	var tracingProvider *tracing.Provider
+	if enableTracing {
+		if tracingProvider, err = tracing.Setup(context.Background(), tracingSamplingRatio); err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		reconcileSpans = controllers.NewReconcileSpans(tracingProvider.Tracer())
+	}
 
 	metricsRecorder := metrics.NewRecorder()
 	crtlmetrics.Registry.MustRegister(metricsRecorder.Collectors()...)
@@ -124,12 +489,30 @@ func main() {
 		watchNamespace = os.Getenv("RUNTIME_NAMESPACE")
 	}
 
+	if err := validateLeaderElection(leaderElectionOptions); err != nil {
+		setupLog.Error(err, "invalid leader election options")
+		os.Exit(1)
+	}
+
+	if shutdownTimeout < 0 {
+		setupLog.Error(fmt.Errorf("invalid --graceful-shutdown-timeout '%s', must not be negative", shutdownTimeout), "invalid shutdown options")
+		os.Exit(1)
+	}
+	drainer := controllers.NewDrainer(shutdownTimeout)
+
+	if namespaceRateLimit < 0 {
+		setupLog.Error(fmt.Errorf("invalid --namespace-reconciles-per-minute '%d', must not be negative", namespaceRateLimit), "invalid rate limit options")
+		os.Exit(1)
+	}
+	gracefulShutdownTimeout := drainer.ShutdownTimeout()
+
 	restConfig := client.GetConfigOrDie(clientOptions)
 	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:                        scheme,
 		MetricsBindAddress:            metricsAddr,
 		HealthProbeBindAddress:        healthAddr,
-		Port:                          9443,
+		Port:                          webhookPort,
+		CertDir:                       webhookCertDir,
 		LeaderElection:                leaderElectionOptions.Enable,
 		LeaderElectionReleaseOnCancel: leaderElectionOptions.ReleaseOnCancel,
 		LeaseDuration:                 &leaderElectionOptions.LeaseDuration,
@@ -138,6 +521,7 @@ func main() {
 		LeaderElectionID:              fmt.Sprintf("%s-leader-election", controllerName),
 		Namespace:                     watchNamespace,
 		Logger:                        ctrl.Log,
+		GracefulShutdownTimeout:       &gracefulShutdownTimeout,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -145,12 +529,218 @@ func main() {
 	}
 
 	probes.SetupChecks(mgr, setupLog)
-	pprof.SetupHandlers(mgr, setupLog)
+	if enableValidation {
+		mgr.GetWebhookServer().Register(controllers.SourceValidationPath, &webhook.Admission{Handler: validator})
+	}
+	namespaceLimiter := controllers.NewNamespaceLimiter(mgr.GetClient(), namespaceRateLimit)
+	var reconcileTracker *controllers.ReconcileTracker
+	if enablePprof {
+		reconcileTracker = controllers.NewReconcileTracker()
+		if err := debug.SetupHandlers(mgr, reconcileTracker); err != nil {
+			setupLog.Error(err, "unable to add debug handlers")
+			os.Exit(1)
+		}
+	}
 
-	if storageAdvAddr == "" {
+	var storageListener net.Listener
+	if controllers.IsUnixSocketAddress(storageAddr) {
+		// Listen on the socket right away, to serve the artifacts on the
+		// socket only with the given permissions
+		mode, err := strconv.ParseUint(storageSocketMode, 8, 32)
+		if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+			setupLog.Error(fmt.Errorf("invalid --storage-socket-mode '%s', must be octal permissions, e.g. '0660'", storageSocketMode), "invalid storage options")
+			os.Exit(1)
+		}
+		storageListener, err = controllers.ListenStorage(storageAddr, os.FileMode(mode))
+		if err != nil {
+			setupLog.Error(err, "unable to listen on storage address")
+			os.Exit(1)
+		}
+	} else if _, port, err := net.SplitHostPort(storageAddr); err == nil && port == "0" {
+		// Listen on an ephemeral port right away, to advertise the chosen port
+		storageListener, err = net.Listen("tcp", storageAddr)
+		if err != nil {
+			setupLog.Error(err, "unable to listen on storage address")
+			os.Exit(1)
+		}
+		storageAddr = withListenerPort(storageAddr, storageListener)
+		storageAdvAddr = withListenerPort(storageAdvAddr, storageListener)
+	}
+	var advURL *url.URL
+	if storageAdvURL != "" {
+		u, err := controllers.ParseStorageAdvURL(storageAdvURL)
+		if err == nil && storageAdvAddr != "" {
+			err = fmt.Errorf("--storage-adv-addr and --storage-adv-url are mutually exclusive")
+		}
+		if err != nil {
+			setupLog.Error(err, "invalid storage options")
+			os.Exit(1)
+		}
+		advURL = u
+	}
+	switch {
+	case advURL != nil:
+		storageAdvAddr = advURL.Host
+	case storageAdvAddr == "" && controllers.IsUnixSocketAddress(storageAddr):
+		setupLog.Error(fmt.Errorf("--storage-adv-addr or --storage-adv-url must be set to serve the artifacts on a unix socket"), "invalid storage options")
+		os.Exit(1)
+	case storageAdvAddr == "":
 		storageAdvAddr = determineAdvStorageAddr(storageAddr, setupLog)
+	default:
+		storageAdvAddr = withLocalPort(storageAdvAddr, storageAddr)
 	}
+	setupLog.Info("advertising artifacts", "address", storageAdvAddr)
 	storage := mustInitStorage(storagePath, storageAdvAddr, setupLog)
+	// serve the artifacts on all replicas, the standby replicas serve them
+	// from the storage shared with the leader, if any
+	standby := controllers.NewStandbyGate(mgr.Elected(), storageShared)
+	readinessProbe := &controllers.ReadinessProbe{
+		Storage:       storage,
+		ServerAddress: storageAddr,
+		CacheDuration: 5 * time.Second,
+		Standby:       standby,
+	}
+	if storageShared {
+		readinessProbe.Replica = os.Getenv("HOSTNAME")
+	}
+	if err := mgr.AddReadyzCheck("storage", readinessProbe.StorageCheck); err != nil {
+		setupLog.Error(err, "unable to create ready check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("artifact-server", readinessProbe.ArtifactServerCheck); err != nil {
+		setupLog.Error(err, "unable to create ready check")
+		os.Exit(1)
+	}
+	var storageTLSConfig *tls.Config
+	if storageTLSCertFile != "" || storageTLSKeyFile != "" || storageTLSClientCA != "" {
+		if storageTLSCertFile == "" || storageTLSKeyFile == "" {
+			setupLog.Error(fmt.Errorf("both --storage-tls-cert-file and --storage-tls-key-file must be set"), "invalid file server TLS options")
+			os.Exit(1)
+		}
+		config, watcher, err := controllers.NewArtifactServerTLSConfig(storageTLSCertFile, storageTLSKeyFile, storageTLSClientCA)
+		if err != nil {
+			setupLog.Error(err, "unable to load file server TLS certificate")
+			os.Exit(1)
+		}
+		if err := mgr.Add(watcher); err != nil {
+			setupLog.Error(err, "unable to create file server TLS certificate watcher")
+			os.Exit(1)
+		}
+		storageTLSConfig = config
+		storage.Scheme = "https"
+	}
+	if advURL != nil {
+		// the artifacts are advertised with the scheme of the advertised URL,
+		// e.g. of a sidecar terminating TLS in front of the file server
+		storage.Scheme = advURL.Scheme
+	}
+	storage.ArtifactRetentionRecords = retentionRecords
+	storage.ArtifactRetentionTTL = retentionTTL
+	storage.RetainDeletedArtifacts = retainDeleted
+	storage.ArchiveEncoding = artifactEncoding
+	storage.ArchiveCompressionLevel = artifactGzipLevel
+	storage.ArtifactMaxSize = artifactMaxBytes.Value()
+	switch storageBackend {
+	case controllers.StorageBackendFilesystem:
+	case controllers.StorageBackendS3:
+		backend, err := controllers.NewS3Backend(storageS3)
+		if err != nil {
+			setupLog.Error(err, "unable to create S3 storage backend")
+			os.Exit(1)
+		}
+		storage.Backend = backend
+	default:
+		setupLog.Error(fmt.Errorf("unsupported storage backend '%s'", storageBackend), "invalid storage options")
+		os.Exit(1)
+	}
+	if err := storage.ValidateArchiveOptions(); err != nil {
+		setupLog.Error(err, "invalid archive options")
+		os.Exit(1)
+	}
+	storage.DigestAlgorithm = artifactDigestAlgo
+	if err := storage.ValidateDigestAlgorithm(); err != nil {
+		setupLog.Error(err, "invalid artifact digest algorithm")
+		os.Exit(1)
+	}
+	if artifactSigningKey != "" {
+		key, err := controllers.LoadSigningKey(artifactSigningKey)
+		if err != nil {
+			setupLog.Error(err, "invalid artifact signing key")
+			os.Exit(1)
+		}
+		storage.SigningKey = key
+	}
+	storage.Deduplicate = artifactDedup
+	storage.ArtifactChecksumInterval = checksumInterval
+	storage.HighWatermark = storageHighWatermark
+	if err := storage.ValidateHighWatermark(); err != nil {
+		setupLog.Error(err, "invalid storage options")
+		os.Exit(1)
+	}
+	if storageWriteRetries < 0 {
+		setupLog.Error(fmt.Errorf("invalid --storage-write-retries '%d', must not be negative", storageWriteRetries), "invalid storage options")
+		os.Exit(1)
+	}
+	storage.WriteRetries = storageWriteRetries
+	if gcInterval > 0 {
+		if err := mgr.Add(&controllers.ArtifactGarbageCollector{
+			Reader:                mgr.GetClient(),
+			Scheme:                mgr.GetScheme(),
+			Storage:               storage,
+			EventRecorder:         mgr.GetEventRecorderFor(controllerName),
+			ExternalEventRecorder: eventRecorder,
+			Interval:              gcInterval,
+		}); err != nil {
+			setupLog.Error(err, "unable to create artifact garbage collector")
+			os.Exit(1)
+		}
+	}
+	if !retainDeleted {
+		if err := mgr.Add(&controllers.ArtifactOrphanCollector{
+			Reader:    mgr.GetClient(),
+			Scheme:    mgr.GetScheme(),
+			Storage:   storage,
+			Namespace: watchNamespace,
+		}); err != nil {
+			setupLog.Error(err, "unable to create artifact orphan collector")
+			os.Exit(1)
+		}
+	}
+	if err := mgr.Add(&controllers.ArtifactURLRewriter{
+		Client:  mgr.GetClient(),
+		Storage: storage,
+	}); err != nil {
+		setupLog.Error(err, "unable to create artifact URL rewriter")
+		os.Exit(1)
+	}
+	var errorMonitor *controllers.ArtifactErrorMonitor
+	if errorThreshold > 0 {
+		if errorWindow <= 0 {
+			setupLog.Error(fmt.Errorf("invalid --artifact-error-window '%s', must be positive", errorWindow), "invalid artifact server options")
+			os.Exit(1)
+		}
+		errorMonitor = controllers.NewArtifactErrorMonitor(errorThreshold, errorWindow)
+		errorMonitor.Client = mgr.GetClient()
+		errorMonitor.EventRecorder = mgr.GetEventRecorderFor(controllerName)
+		errorMonitor.ExternalEventRecorder = eventRecorder
+		if err := mgr.Add(errorMonitor); err != nil {
+			setupLog.Error(err, "unable to create artifact error monitor")
+			os.Exit(1)
+		}
+	}
+	if verifyOnStart {
+		if err := mgr.Add(&controllers.ArtifactVerifier{
+			Client:                mgr.GetClient(),
+			Storage:               storage,
+			EventRecorder:         mgr.GetEventRecorderFor(controllerName),
+			ExternalEventRecorder: eventRecorder,
+			Interval:              verifyInterval,
+			RequeueLimiter:        rate.NewLimiter(rate.Limit(verifyRequeueRate), 1),
+		}); err != nil {
+			setupLog.Error(err, "unable to create artifact verifier")
+			os.Exit(1)
+		}
+	}
 
 	if err = (&controllers.GitRepositoryReconciler{
 		Client:                mgr.GetClient(),
@@ -158,10 +748,22 @@ func main() {
 		Storage:               storage,
 		EventRecorder:         mgr.GetEventRecorderFor(controllerName),
 		ExternalEventRecorder: eventRecorder,
+		EventLimiter:          eventLimiter,
+		FetchMetrics:          fetchFailures,
 		MetricsRecorder:       metricsRecorder,
 	}).SetupWithManagerAndOptions(mgr, controllers.GitRepositoryReconcilerOptions{
-		MaxConcurrentReconciles:   concurrent,
+		MaxConcurrentReconciles:   concurrentByKind[sourcev1.GitRepositoryKind],
 		DependencyRequeueInterval: requeueDependency,
+		MinRetryDelay:             minRetryDelay,
+		MaxRetryDelay:             maxRetryDelay,
+		Drainer:                   drainer,
+		IntervalJitter:            jitter,
+		ReconcileTracker:          reconcileTracker,
+		Validator:                 validator,
+		Defaults:                  sourceDefaults,
+		ReconcileTracer:           reconcileTracer,
+		ReconcileSpans:            reconcileSpans,
+		NamespaceLimiter:          namespaceLimiter,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", sourcev1.GitRepositoryKind)
 		os.Exit(1)
@@ -173,13 +775,46 @@ func main() {
 		Getters:               getters,
 		EventRecorder:         mgr.GetEventRecorderFor(controllerName),
 		ExternalEventRecorder: eventRecorder,
+		EventLimiter:          eventLimiter,
+		FetchMetrics:          fetchFailures,
 		MetricsRecorder:       metricsRecorder,
 	}).SetupWithManagerAndOptions(mgr, controllers.HelmRepositoryReconcilerOptions{
-		MaxConcurrentReconciles: concurrent,
+		MaxConcurrentReconciles: concurrentByKind[sourcev1.HelmRepositoryKind],
+		MinRetryDelay:           minRetryDelay,
+		MaxRetryDelay:           maxRetryDelay,
+		Drainer:                 drainer,
+		IntervalJitter:          jitter,
+		ReconcileTracker:        reconcileTracker,
+		Validator:               validator,
+		Defaults:                sourceDefaults,
+		ReconcileTracer:         reconcileTracer,
+		ReconcileSpans:          reconcileSpans,
+		NamespaceLimiter:        namespaceLimiter,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", sourcev1.HelmRepositoryKind)
 		os.Exit(1)
 	}
+	var keylessRoots *x509.CertPool
+	if cosignRootsFile != "" {
+		if keylessRoots, err = controllers.LoadKeylessRoots(cosignRootsFile); err != nil {
+			setupLog.Error(err, "invalid cosign roots")
+			os.Exit(1)
+		}
+	}
+	var rekorKeys *oci.RekorKeys
+	if cosignRekorKeysFile != "" {
+		if rekorKeys, err = oci.LoadRekorKeys(cosignRekorKeysFile); err != nil {
+			setupLog.Error(err, "invalid cosign Rekor keys")
+			os.Exit(1)
+		}
+	}
+	var registryMirrors *oci.Mirrors
+	if registryMirrorsFile != "" {
+		if registryMirrors, err = oci.LoadMirrors(registryMirrorsFile); err != nil {
+			setupLog.Error(err, "invalid registry mirrors")
+			os.Exit(1)
+		}
+	}
 	if err = (&controllers.HelmChartReconciler{
 		Client:                mgr.GetClient(),
 		Scheme:                mgr.GetScheme(),
@@ -187,9 +822,26 @@ func main() {
 		Getters:               getters,
 		EventRecorder:         mgr.GetEventRecorderFor(controllerName),
 		ExternalEventRecorder: eventRecorder,
+		EventLimiter:          eventLimiter,
+		FetchMetrics:          fetchFailures,
 		MetricsRecorder:       metricsRecorder,
+		IndexCache:            indexCache,
+		KeylessRoots:          keylessRoots,
+		RekorKeys:             rekorKeys,
+		Mirrors:               registryMirrors,
+		MirrorFallback:        mirrorFallback,
 	}).SetupWithManagerAndOptions(mgr, controllers.HelmChartReconcilerOptions{
-		MaxConcurrentReconciles: concurrent,
+		MaxConcurrentReconciles: concurrentByKind[sourcev1.HelmChartKind],
+		MinRetryDelay:           minRetryDelay,
+		MaxRetryDelay:           maxRetryDelay,
+		Drainer:                 drainer,
+		IntervalJitter:          jitter,
+		ReconcileTracker:        reconcileTracker,
+		Validator:               validator,
+		Defaults:                sourceDefaults,
+		ReconcileTracer:         reconcileTracer,
+		ReconcileSpans:          reconcileSpans,
+		NamespaceLimiter:        namespaceLimiter,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", sourcev1.HelmChartKind)
 		os.Exit(1)
@@ -200,41 +852,178 @@ func main() {
 		Storage:               storage,
 		EventRecorder:         mgr.GetEventRecorderFor(controllerName),
 		ExternalEventRecorder: eventRecorder,
+		EventLimiter:          eventLimiter,
+		FetchMetrics:          fetchFailures,
 		MetricsRecorder:       metricsRecorder,
 	}).SetupWithManagerAndOptions(mgr, controllers.BucketReconcilerOptions{
-		MaxConcurrentReconciles: concurrent,
+		MaxConcurrentReconciles: concurrentByKind[sourcev1.BucketKind],
+		DownloadConcurrency:     bucketConcurrency,
+		FullResyncInterval:      bucketFullResync,
+		MaxObjects:              bucketMaxObjects,
+		MaxSize:                 maxSize.Value(),
+		MinRetryDelay:           minRetryDelay,
+		MaxRetryDelay:           maxRetryDelay,
+		Drainer:                 drainer,
+		IntervalJitter:          jitter,
+		ReconcileTracker:        reconcileTracker,
+		Validator:               validator,
+		Defaults:                sourceDefaults,
+		ReconcileTracer:         reconcileTracer,
+		ReconcileSpans:          reconcileSpans,
+		NamespaceLimiter:        namespaceLimiter,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Bucket")
 		os.Exit(1)
 	}
+	if ociMaxPulls < 0 {
+		setupLog.Error(fmt.Errorf("invalid --oci-max-concurrent-pulls '%d', must not be negative", ociMaxPulls), "invalid OCI options")
+		os.Exit(1)
+	}
+	if err = (&controllers.OCIRepositoryReconciler{
+		Client:                mgr.GetClient(),
+		Scheme:                mgr.GetScheme(),
+		Storage:               storage,
+		EventRecorder:         mgr.GetEventRecorderFor(controllerName),
+		ExternalEventRecorder: eventRecorder,
+		EventLimiter:          eventLimiter,
+		FetchMetrics:          fetchFailures,
+		MetricsRecorder:       metricsRecorder,
+		KeylessRoots:          keylessRoots,
+		RekorKeys:             rekorKeys,
+		Mirrors:               registryMirrors,
+		MirrorFallback:        mirrorFallback,
+	}).SetupWithManagerAndOptions(mgr, controllers.OCIRepositoryReconcilerOptions{
+		MaxConcurrentReconciles: concurrentByKind[sourcev1.OCIRepositoryKind],
+		MaxConcurrentPulls:      ociMaxPulls,
+		MinRetryDelay:           minRetryDelay,
+		MaxRetryDelay:           maxRetryDelay,
+		Drainer:                 drainer,
+		IntervalJitter:          jitter,
+		ReconcileTracker:        reconcileTracker,
+		Validator:               validator,
+		Defaults:                sourceDefaults,
+		ReconcileTracer:         reconcileTracer,
+		ReconcileSpans:          reconcileSpans,
+		NamespaceLimiter:        namespaceLimiter,
+	}); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", sourcev1.OCIRepositoryKind)
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
+	if err := mgr.Add(drainer); err != nil {
+		setupLog.Error(err, "unable to create reconciliation drainer")
+		os.Exit(1)
+	}
 
-	go func() {
-		// Block until our controller manager is elected leader. We presume our
-		// entire process will terminate if we lose leadership, so we don't need
-		// to handle that.
-		<-mgr.Elected()
+	fileServer := &http.Server{Addr: storageAddr, TLSConfig: storageTLSConfig}
 
-		startFileServer(storage.BasePath, storageAddr, setupLog)
-	}()
+	go startFileServer(fileServer, storage.BasePath, storageListener, storageMaxDownloads, maxBandwidth.Value(), standby, errorMonitor, setupLog)
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		setupLog.Error(err, "problem running manager")
+	mgrErr := mgr.Start(ctrl.SetupSignalHandler())
+
+	// Close the file server once the reconciliations are drained, waiting for
+	// the in-flight downloads
+	ctx, cancel := context.WithTimeout(context.Background(), fileServerShutdownTimeout)
+	defer cancel()
+	if err := fileServer.Shutdown(ctx); err != nil {
+		setupLog.Error(err, "unable to drain file server connections")
+	}
+	if tracingProvider != nil {
+		if err := tracingProvider.Shutdown(ctx); err != nil {
+			setupLog.Error(err, "unable to export the last spans")
+		}
+	}
+
+	if mgrErr != nil {
+		setupLog.Error(mgrErr, "problem running manager")
 		os.Exit(1)
 	}
 }
 
-func startFileServer(path string, address string, l logr.Logger) {
-	l.Info("starting file server")
-	fs := http.FileServer(http.Dir(path))
-	http.Handle("/", fs)
-	err := http.ListenAndServe(address, nil)
+// startFileServer serves the storage at the given path with the given server, and listener or else the address of the
+// server, until the server is shut down. The given gate answers the requests while the replica can not serve the
+// artifacts.
+func startFileServer(server *http.Server, path string, ln net.Listener, maxDownloads int, maxBandwidth int64,
+	standby *controllers.StandbyGate, errorMonitor *controllers.ArtifactErrorMonitor, l logr.Logger) {
+	address, tlsConfig := server.Addr, server.TLSConfig
+	l.Info("starting file server", "address", address, "tls", tlsConfig != nil)
+	fs, err := controllers.NewArtifactServer(path)
 	if err != nil {
+		l.Error(err, "unable to create file server")
+		return
+	}
+	fs.SetLimits(maxDownloads, maxBandwidth)
+	// serve the artifacts on a mux of their own, as the default mux serves
+	// the pprof profiles
+	mux := http.NewServeMux()
+	mux.Handle("/", controllers.ArtifactAccessLog(errorMonitor.Handler(standby.Handler(fs)), ctrl.Log.WithName("file-server")))
+	server.Handler = mux
+	if ln == nil {
+		if ln, err = net.Listen("tcp", address); err != nil {
+			l.Error(err, "file server error")
+			return
+		}
+	}
+	if tlsConfig != nil {
+		err = server.ServeTLS(ln, "", "")
+	} else {
+		err = server.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		l.Error(err, "file server error")
 	}
 }
 
+// validateLeaderElection returns an error if the given leader election options are not accepted by the leader
+// elector, which requires a lease duration longer than the renew deadline, and a renew deadline longer than the
+// retry period with its jitter.
+func validateLeaderElection(opts leaderelection.Options) error {
+	if !opts.Enable {
+		return nil
+	}
+	if opts.LeaseDuration <= opts.RenewDeadline {
+		return fmt.Errorf("invalid --leader-election-lease-duration '%s', must be longer than the --leader-election-renew-deadline '%s'",
+			opts.LeaseDuration, opts.RenewDeadline)
+	}
+	if float64(opts.RenewDeadline) <= leaderElectionJitterFactor*float64(opts.RetryPeriod) {
+		return fmt.Errorf("invalid --leader-election-renew-deadline '%s', must be longer than %v times the --leader-election-retry-period '%s'",
+			opts.RenewDeadline, leaderElectionJitterFactor, opts.RetryPeriod)
+	}
+	return nil
+}
+
+// bindRetryFlags binds the --min-retry-delay and --max-retry-delay flags of the given flag set to the given delays
+// of the retry limiter of the reconcilers.
+func bindRetryFlags(fs *flag.FlagSet, minDelay, maxDelay *time.Duration) {
+	fs.DurationVar(minDelay, "min-retry-delay", controllers.DefaultMinRetryDelay,
+		"The delay of the first retry of a failed reconciliation, doubled with every failure of the source.")
+	fs.DurationVar(maxDelay, "max-retry-delay", controllers.DefaultMaxRetryDelay,
+		"The maximum delay between the retries of a failed reconciliation.")
+}
+
+// validateRetryDelays returns an error if the given delays of the retry limiter are not valid, the minimum must be
+// positive and not exceed the maximum.
+func validateRetryDelays(minDelay, maxDelay time.Duration) error {
+	if minDelay <= 0 || maxDelay < minDelay {
+		return fmt.Errorf("invalid --min-retry-delay '%s' and --max-retry-delay '%s', the minimum must be positive and not exceed the maximum",
+			minDelay, maxDelay)
+	}
+	return nil
+}
+
+// concurrentReconciles returns the number of concurrent reconciles configured with the given per-kind flag, or the
+// given number of the --concurrent flag if it is not set. The number must be at least one.
+func concurrentReconciles(name string, value, concurrent int) (int, error) {
+	if !flag.CommandLine.Changed(name) {
+		name, value = "concurrent", concurrent
+	}
+	if value < 1 {
+		return 0, fmt.Errorf("invalid --%s '%d', must be at least 1", name, value)
+	}
+	return value, nil
+}
+
 func mustInitStorage(path string, storageAdvAddr string, l logr.Logger) *controllers.Storage {
 	if path == "" {
 		p, _ := os.Getwd()
@@ -268,7 +1057,13 @@ func determineAdvStorageAddr(storageAddr string, l logr.Logger) string {
 	switch host {
 	case "":
 		host = "localhost"
-	case "0.0.0.0":
+	case "0.0.0.0", "::":
+		// Out of cluster, e.g. with 'make run', the artifacts are advertised
+		// on localhost, as the host name may not resolve to the local machine.
+		if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+			host = "localhost"
+			break
+		}
 		host = os.Getenv("HOSTNAME")
 		if host == "" {
 			hn, err := os.Hostname()
@@ -282,6 +1077,31 @@ func determineAdvStorageAddr(storageAddr string, l logr.Logger) string {
 	return net.JoinHostPort(host, port)
 }
 
+// withListenerPort returns the given address with the port of the given listener, if the address has the port 0.
+func withListenerPort(addr string, ln net.Listener) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != "0" {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+}
+
+// withLocalPort returns the given advertised address with the port of the given storage address, if the advertised
+// address is a loopback host without a port, e.g. 'localhost'.
+func withLocalPort(advAddr, storageAddr string) string {
+	if _, _, err := net.SplitHostPort(advAddr); err == nil {
+		return advAddr
+	}
+	if ip := net.ParseIP(strings.Trim(advAddr, "[]")); advAddr != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return advAddr
+	}
+	_, port, err := net.SplitHostPort(storageAddr)
+	if err != nil {
+		return advAddr
+	}
+	return net.JoinHostPort(strings.Trim(advAddr, "[]"), port)
+}
+
 func envOrDefault(envName, defaultValue string) string {
 	ret := os.Getenv(envName)
 	if ret != "" {
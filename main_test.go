@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/fluxcd/source-controller/controllers"
+)
+
+func TestRetryFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantDelay []time.Duration
+		wantErr   string
+	}{
+		{
+			name:      "defaults",
+			wantDelay: []time.Duration{controllers.DefaultMinRetryDelay, 2 * controllers.DefaultMinRetryDelay, 4 * controllers.DefaultMinRetryDelay},
+		},
+		{
+			name:      "configured delays",
+			args:      []string{"--min-retry-delay=1s", "--max-retry-delay=5s"},
+			wantDelay: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:      "equal delays",
+			args:      []string{"--min-retry-delay=30s", "--max-retry-delay=30s"},
+			wantDelay: []time.Duration{30 * time.Second, 30 * time.Second},
+		},
+		{
+			name:    "zero minimum",
+			args:    []string{"--min-retry-delay=0s"},
+			wantErr: "invalid --min-retry-delay '0s'",
+		},
+		{
+			name:    "maximum below minimum",
+			args:    []string{"--min-retry-delay=1m", "--max-retry-delay=30s"},
+			wantErr: "the minimum must be positive and not exceed the maximum",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var minDelay, maxDelay time.Duration
+			fs := flag.NewFlagSet("source-controller", flag.ContinueOnError)
+			bindRetryFlags(fs, &minDelay, &maxDelay)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := validateRetryDelays(minDelay, maxDelay)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("validateRetryDelays() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateRetryDelays() error = %v", err)
+			}
+
+			// the reconcilers build their limiter with the delays of the flags
+			limiter := controllers.NewRetryLimiter(minDelay, maxDelay)
+			for i, want := range tt.wantDelay {
+				if got := limiter.When("default/podinfo"); got != want {
+					t.Errorf("delay of retry %d = %s, want %s", i+1, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+const (
+	// apiVersion is the Blob service REST API version sent with every
+	// request.
+	apiVersion = "2020-10-02"
+
+	// maxResults is the maximum number of blobs requested per list page.
+	maxResults = "5000"
+
+	// accountNameField is the Secret field holding the storage account name,
+	// for endpoints that do not contain it (e.g. emulators).
+	accountNameField = "accountName"
+
+	// defaultHost is the host pattern of the Blob service endpoints, which
+	// may be sent the tokens of the identity of the controller.
+	defaultHost = "*.blob.core.windows.net"
+)
+
+// BlobClient is a minimal Azure Blob Storage client for fetching files from
+// a storage account container.
+type BlobClient struct {
+	httpClient *http.Client
+	endpoint   *url.URL
+	account    string
+	credential Credential
+}
+
+// NewClient creates a new BlobClient for the storage account endpoint of the
+// given v1beta1.Bucket, authorized with the Credential configured by the
+// given Secret. The tokens of the managed or workload identity of the
+// controller are only sent to an 'https://' endpoint of Azure Blob Storage,
+// or of a host allowed with transport.SetAmbientCredentialHosts. The
+// certificate of the endpoint is verified against the CA certificates in the
+// 'caFile' or 'ca.crt' field of the Secret in addition to the system roots,
+// or not at all when spec.insecure is set for an 'https://' endpoint. The Secret may be nil. The requests are sent through the proxy of
+// the given ProxyFunc instead of the proxy of the environment, if not nil.
+func NewClient(bucket sourcev1.Bucket, secret *corev1.Secret, proxy transport.ProxyFunc) (*BlobClient, error) {
+	endpoint := bucket.Spec.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https"
+		if bucket.Spec.Insecure {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint '%s': %w", bucket.Spec.Endpoint, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	account := strings.SplitN(u.Hostname(), ".", 2)[0]
+	if secret != nil {
+		if v, ok := secret.Data[accountNameField]; ok && len(v) > 0 {
+			account = string(v)
+		}
+	}
+	if account == "" {
+		return nil, fmt.Errorf("unable to determine storage account name from endpoint '%s'", bucket.Spec.Endpoint)
+	}
+
+	credential, err := CredentialFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := credential.(*tokenCredential); ok {
+		if err := transport.CheckAmbientCredentialEndpoint(u, bucket.Spec.Insecure, defaultHost); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConfig, err := transport.TLSConfigFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if bucket.Spec.Insecure && u.Scheme == "https" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return &BlobClient{
+		httpClient: &http.Client{Transport: transport.WithUserAgent(transport.NewProxyTransport(tlsConfig, proxy))},
+		endpoint:   u,
+		account:    account,
+		credential: credential,
+	}, nil
+}
+
+// CredentialSource returns the name of the type of credentials used by the
+// client.
+func (c *BlobClient) CredentialSource() string {
+	switch cred := c.credential.(type) {
+	case *SharedKeyCredential:
+		return "account key"
+	case *SASCredential:
+		return "SAS token"
+	case *tokenCredential:
+		return cred.name
+	default:
+		return ""
+	}
+}
+
+// Region returns an empty string, as storage accounts are addressed by their
+// endpoint.
+func (c *BlobClient) Region() string {
+	return ""
+}
+
+// Retries returns zero, as failed requests are not retried.
+func (c *BlobClient) Retries() int64 {
+	return 0
+}
+
+// BucketExists returns if the container with the given name exists.
+func (c *BlobClient) BucketExists(ctx context.Context, containerName string) (bool, error) {
+	resp, err := c.do(ctx, containerName, "", url.Values{"restype": {"container"}})
+	if err != nil {
+		var respErr *ResponseError
+		if errors.As(err, &respErr) && respErr.Code == "ContainerNotFound" {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// FGetObject downloads the blob with the given name from the container to
+// the given local path, and returns the content type of the blob.
+func (c *BlobClient) FGetObject(ctx context.Context, containerName, blobName, localPath string) (string, error) {
+	resp, err := c.do(ctx, containerName, blobName, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return "", err
+	}
+	return resp.Header.Get("Content-Type"), f.Close()
+}
+
+// VisitObjects lists all blobs in the container with a name starting with the
+// given prefix, following the continuation markers of large containers, and
+// calls visit with the name, ETag, size and last modification time of every
+// blob. Directory entries of accounts with a hierarchical namespace are
+// skipped. Listing stops at the first error returned by visit.
+func (c *BlobClient) VisitObjects(ctx context.Context, containerName, prefix string, visit func(key, etag string, size int64, lastModified time.Time) error) error {
+	marker := ""
+	for {
+		query := url.Values{
+			"restype":    {"container"},
+			"comp":       {"list"},
+			"include":    {"metadata"},
+			"maxresults": {maxResults},
+		}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := c.do(ctx, containerName, "", query)
+		if err != nil {
+			return err
+		}
+		var result listBlobsResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode blob listing: %w", err)
+		}
+
+		for _, blob := range result.Blobs {
+			if blob.isDirectory() {
+				continue
+			}
+			if err := visit(blob.Name, blob.Properties.ETag, blob.Properties.ContentLength, blob.lastModified()); err != nil {
+				return err
+			}
+		}
+
+		if result.NextMarker == "" {
+			return nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// ObjectIsNotFound checks if the error provided is a ResponseError with a
+// "BlobNotFound" code.
+func (c *BlobClient) ObjectIsNotFound(err error) bool {
+	var respErr *ResponseError
+	return errors.As(err, &respErr) && respErr.Code == "BlobNotFound"
+}
+
+// IsAuthError checks if the error provided is caused by missing, invalid or
+// insufficient credentials.
+func (c *BlobClient) IsAuthError(err error) bool {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return true
+	}
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	if respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden {
+		return true
+	}
+	return strings.HasPrefix(respErr.Code, "Authentication") || strings.HasPrefix(respErr.Code, "Authorization")
+}
+
+// do performs an authorized GET request for the given container and blob,
+// and returns the response if the request succeeded. The caller is
+// responsible for closing the response body.
+func (c *BlobClient) do(ctx context.Context, containerName, blobName string, query url.Values) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path += "/" + containerName
+	u.RawPath = ""
+	if blobName != "" {
+		u.Path += "/" + blobName
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	if err := c.credential.Authorize(ctx, req, c.account); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, newResponseError(resp)
+}
+
+// ResponseError is returned for requests that were not successful.
+type ResponseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s (%d): %s", e.Code, e.StatusCode, e.Message)
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("%s (%d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+func newResponseError(resp *http.Response) *ResponseError {
+	respErr := &ResponseError{
+		StatusCode: resp.StatusCode,
+		Code:       resp.Header.Get("x-ms-error-code"),
+	}
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body); err == nil {
+		if respErr.Code == "" {
+			respErr.Code = body.Code
+		}
+		// Only keep the first line, the remainder contains request IDs and
+		// timestamps which would cause the message to change on every
+		// reconciliation.
+		respErr.Message = strings.SplitN(strings.TrimSpace(body.Message), "\n", 2)[0]
+	}
+	return respErr
+}
+
+// AuthError is returned when a Credential failed to obtain an authorization
+// for a request.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authorization failed: %s", e.Err.Error())
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// listBlobsResult is the response of a List Blobs request, as described in
+// https://docs.microsoft.com/en-us/rest/api/storageservices/list-blobs.
+type listBlobsResult struct {
+	Blobs      []blobItem `xml:"Blobs>Blob"`
+	NextMarker string     `xml:"NextMarker"`
+}
+
+type blobItem struct {
+	Name     string `xml:"Name"`
+	Metadata struct {
+		IsFolder string `xml:"hdi_isfolder"`
+	} `xml:"Metadata"`
+	Properties struct {
+		ETag          string `xml:"Etag"`
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int64  `xml:"Content-Length"`
+		ResourceType  string `xml:"ResourceType"`
+	} `xml:"Properties"`
+}
+
+// lastModified returns the last modification time of the blob, or the zero
+// time if it can not be parsed.
+func (b blobItem) lastModified() time.Time {
+	t, err := http.ParseTime(b.Properties.LastModified)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// isDirectory returns if the blob is a directory entry of a hierarchical
+// namespace (ADLS Gen2) account.
+func (b blobItem) isDirectory() bool {
+	return strings.EqualFold(b.Metadata.IsFolder, "true") || b.Properties.ResourceType == "directory"
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+const testSAS = "sv=2020-10-02&sig=signature"
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *BlobClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.AzureBucketProvider,
+		Endpoint: server.URL,
+	}}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "azure"},
+		Data: map[string][]byte{
+			accountNameField: []byte("account"),
+			SASKeyField:      []byte("?" + testSAS),
+		},
+	}
+	client, err := NewClient(bucket, secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>The error message.\nRequestId:1</Message></Error>", code)
+}
+
+func TestBlobClient_BucketExists(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		code      string
+		want      bool
+		wantErr   bool
+		wantAuthz bool
+	}{
+		{name: "exists", status: http.StatusOK, want: true},
+		{name: "not found", status: http.StatusNotFound, code: "ContainerNotFound"},
+		{name: "forbidden", status: http.StatusForbidden, code: "AuthorizationPermissionMismatch", wantErr: true, wantAuthz: true},
+		{name: "server error", status: http.StatusInternalServerError, code: "InternalError", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/container" || r.URL.Query().Get("restype") != "container" {
+					t.Errorf("unexpected request %s", r.URL)
+				}
+				if r.URL.Query().Get("sig") != "signature" {
+					t.Errorf("missing SAS token in request %s", r.URL)
+				}
+				if tt.code != "" {
+					writeError(w, tt.status, tt.code)
+					return
+				}
+				w.WriteHeader(tt.status)
+			})
+			got, err := client.BucketExists(context.TODO(), "container")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BucketExists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("BucketExists() got = %v, want %v", got, tt.want)
+			}
+			if authz := client.IsAuthError(err); authz != tt.wantAuthz {
+				t.Errorf("IsAuthError() got = %v, want %v", authz, tt.wantAuthz)
+			}
+		})
+	}
+}
+
+func TestBlobClient_userAgent(t *testing.T) {
+	var got string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+		w.WriteHeader(http.StatusOK)
+	})
+	if _, err := client.BucketExists(context.TODO(), "container"); err != nil {
+		t.Fatal(err)
+	}
+	if got != transport.UserAgent() {
+		t.Errorf("User-Agent = %q, want %q", got, transport.UserAgent())
+	}
+}
+
+func TestWorkloadIdentityCredential_userAgent(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		fmt.Fprint(w, `{"access_token":"token","expires_in":3600}`)
+	}))
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("federated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	credential := NewWorkloadIdentityCredential("tenant", "client", tokenFile, server.URL)
+	req := httptest.NewRequest(http.MethodGet, "https://account.blob.core.windows.net/container", nil)
+	if err := credential.Authorize(context.TODO(), req, "account"); err != nil {
+		t.Fatal(err)
+	}
+	if authz := req.Header.Get("Authorization"); authz != "Bearer token" {
+		t.Errorf("Authorization = %q, want %q", authz, "Bearer token")
+	}
+	if got != transport.UserAgent() {
+		t.Errorf("User-Agent = %q, want %q", got, transport.UserAgent())
+	}
+}
+
+func TestBlobClient_VisitObjects(t *testing.T) {
+	pages := map[string]string{
+		"": `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ContainerName="container">
+  <Blobs>
+    <Blob><Name>deploy</Name><Properties><Content-Length>0</Content-Length></Properties><Metadata><hdi_isfolder>true</hdi_isfolder></Metadata></Blob>
+    <Blob><Name>deploy/a.yaml</Name><Properties><Etag>0x8D9A1</Etag><Last-Modified>Tue, 12 Oct 2021 08:30:00 GMT</Last-Modified><Content-Length>10</Content-Length></Properties><Metadata /></Blob>
+  </Blobs>
+  <NextMarker>2!page+/=&amp;</NextMarker>
+</EnumerationResults>`,
+		"2!page+/=&": `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ContainerName="container">
+  <Blobs>
+    <Blob><Name>deploy/b.yaml</Name><Properties><Etag>0x8D9B2</Etag><Content-Length>10</Content-Length></Properties><Metadata /></Blob>
+  </Blobs>
+  <NextMarker />
+</EnumerationResults>`,
+	}
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("comp") != "list" || q.Get("include") != "metadata" || q.Get("prefix") != "deploy/" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		page, ok := pages[q.Get("marker")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "InvalidQueryParameterValue")
+			return
+		}
+		fmt.Fprint(w, page)
+	})
+
+	var got []string
+	if err := client.VisitObjects(context.TODO(), "container", "deploy/", func(key, etag string, size int64, lastModified time.Time) error {
+		got = append(got, fmt.Sprintf("%s@%s:%d:%d", key, etag, size, lastModified.Unix()))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"deploy/a.yaml@0x8D9A1:10:1634027400", "deploy/b.yaml@0x8D9B2:10:-62135596800"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VisitObjects() got = %v, want %v", got, want)
+	}
+}
+
+func TestBlobClient_FGetObject(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/container/deploy/file with spaces.yaml":
+			w.Header().Set("Content-Type", "application/yaml")
+			fmt.Fprint(w, "content")
+		default:
+			writeError(w, http.StatusNotFound, "BlobNotFound")
+		}
+	})
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "deploy", "file with spaces.yaml")
+	contentType, err := client.FGetObject(context.TODO(), "container", "deploy/file with spaces.yaml", localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/yaml" {
+		t.Errorf("FGetObject() content type = %q, want %q", contentType, "application/yaml")
+	}
+	b, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "content" {
+		t.Errorf("FGetObject() wrote %q, want %q", string(b), "content")
+	}
+
+	_, err = client.FGetObject(context.TODO(), "container", "missing", filepath.Join(dir, "missing"))
+	if !client.ObjectIsNotFound(err) {
+		t.Errorf("ObjectIsNotFound() got = false for error %v", err)
+	}
+	if strings.Contains(err.Error(), "RequestId") {
+		t.Errorf("error contains request ID: %v", err)
+	}
+}
+
+func TestCredentialFromSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		env     map[string]string
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name: "account key",
+			data: map[string][]byte{AccountKeyField: []byte("a2V5"), SASKeyField: []byte(testSAS)},
+			want: &SharedKeyCredential{},
+		},
+		{
+			name:    "invalid account key",
+			data:    map[string][]byte{AccountKeyField: []byte("not base64")},
+			wantErr: true,
+		},
+		{
+			name: "SAS token",
+			data: map[string][]byte{SASKeyField: []byte(testSAS)},
+			want: &SASCredential{},
+		},
+		{
+			name:    "empty SAS token",
+			data:    map[string][]byte{SASKeyField: []byte("")},
+			wantErr: true,
+		},
+		{
+			name: "managed identity",
+			want: &tokenCredential{},
+		},
+		{
+			name: "workload identity",
+			data: map[string][]byte{ClientIDField: []byte("client"), TenantIDField: []byte("tenant")},
+			env:  map[string]string{"AZURE_FEDERATED_TOKEN_FILE": "/var/run/secrets/token"},
+			want: &tokenCredential{},
+		},
+		{
+			name:    "workload identity without tenant",
+			env:     map[string]string{"AZURE_FEDERATED_TOKEN_FILE": "/var/run/secrets/token"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"AZURE_FEDERATED_TOKEN_FILE", "AZURE_CLIENT_ID", "AZURE_TENANT_ID"} {
+				if v, ok := os.LookupEnv(k); ok {
+					defer os.Setenv(k, v)
+				} else {
+					defer os.Unsetenv(k)
+				}
+				os.Setenv(k, tt.env[k])
+			}
+			var secret *corev1.Secret
+			if tt.data != nil {
+				secret = &corev1.Secret{Data: tt.data}
+			}
+			got, err := CredentialFromSecret(secret)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CredentialFromSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("CredentialFromSecret() got = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClient_ambientCredentials(t *testing.T) {
+	for _, k := range []string{"AZURE_FEDERATED_TOKEN_FILE", "AZURE_CLIENT_ID", "AZURE_TENANT_ID"} {
+		if v, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, v)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		os.Unsetenv(k)
+	}
+
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	// The token of the controller is not sent to an endpoint of the tenant,
+	// nor over plain HTTP
+	for _, spec := range []sourcev1.BucketSpec{
+		{Endpoint: server.URL},
+		{Endpoint: strings.TrimPrefix(server.URL, "http://"), Insecure: true},
+		{Endpoint: "http://podinfo.blob.core.windows.net"},
+		{Endpoint: "https://podinfo.blob.core.windows.net", Insecure: true},
+		{Endpoint: "https://podinfo.blob.core.windows.net.attacker.example.com"},
+	} {
+		spec.Provider = sourcev1.AzureBucketProvider
+		client, err := NewClient(sourcev1.Bucket{Spec: spec}, nil, nil)
+		if err == nil {
+			client.BucketExists(context.TODO(), "podinfo")
+			t.Errorf("NewClient() with the identity of the controller for %s error = nil, want rejected", spec.Endpoint)
+		}
+	}
+	if len(authorizations) != 0 {
+		t.Errorf("endpoint received the authorizations %v, want none", authorizations)
+	}
+
+	// The credentials of a secret are sent to any endpoint
+	secret := &corev1.Secret{Data: map[string][]byte{SASKeyField: []byte(testSAS)}}
+	if _, err := NewClient(sourcev1.Bucket{Spec: sourcev1.BucketSpec{Endpoint: server.URL}}, secret, nil); err != nil {
+		t.Errorf("NewClient() with a SAS token error = %v", err)
+	}
+
+	for _, endpoint := range []string{"https://podinfo.blob.core.windows.net", "podinfo.blob.core.windows.net"} {
+		if _, err := NewClient(sourcev1.Bucket{Spec: sourcev1.BucketSpec{Endpoint: endpoint}}, nil, nil); err != nil {
+			t.Errorf("NewClient() with the identity of the controller for %s error = %v", endpoint, err)
+		}
+	}
+	if err := transport.SetAmbientCredentialHosts([]string{"*.blob.core.chinacloudapi.cn"}); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.SetAmbientCredentialHosts(nil)
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{Endpoint: "https://podinfo.blob.core.chinacloudapi.cn"}}
+	if _, err := NewClient(bucket, nil, nil); err != nil {
+		t.Errorf("NewClient() with the identity of the controller for an allowed host error = %v", err)
+	}
+}
+
+func TestStringToSign(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://account.blob.core.windows.net/container?restype=container&comp=list&include=metadata", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", "Fri, 26 Jun 2015 23:39:12 GMT")
+
+	want := "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+		"x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\n" +
+		"x-ms-version:2020-10-02\n" +
+		"/account/container\ncomp:list\ninclude:metadata\nrestype:container"
+	if got := stringToSign(req, "account"); got != want {
+		t.Errorf("stringToSign() got = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+const (
+	// AccountKeyField is the Secret field holding a storage account key.
+	AccountKeyField = "accountKey"
+	// SASKeyField is the Secret field holding a shared access signature token.
+	SASKeyField = "sasKey"
+	// ClientIDField is the Secret field holding the client ID of a managed
+	// or workload identity.
+	ClientIDField = "clientId"
+	// TenantIDField is the Secret field holding the tenant ID of a workload
+	// identity.
+	TenantIDField = "tenantId"
+
+	storageScope         = "https://storage.azure.com/.default"
+	storageResource      = "https://storage.azure.com/"
+	defaultIMDSEndpoint  = "http://169.254.169.254/metadata/identity/oauth2/token"
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+
+	// tokenExpiryDelta is the time before the actual expiry of a token at
+	// which it is considered expired, to account for clock skew and
+	// in-flight requests.
+	tokenExpiryDelta = 5 * time.Minute
+)
+
+// tokenClient is the http.Client of the token requests of the managed and
+// workload identities, which are requests of the controller itself, to which
+// the egress policy does not apply.
+var tokenClient = &http.Client{Transport: transport.WithUserAgent(transport.NewControllerTransport())}
+
+// Credential authorizes requests to the Azure Blob Storage API.
+type Credential interface {
+	// Authorize adds the authorization for the given account to the request.
+	Authorize(ctx context.Context, req *http.Request, account string) error
+}
+
+// CredentialFromSecret returns the Credential configured by the fields of the
+// given Secret. The first field found of 'accountKey' and 'sasKey' selects
+// shared key and SAS token authentication. Otherwise, a token is requested
+// for the workload identity configured in the environment, or the
+// managed identity of the host, optionally for the 'clientId' and 'tenantId'
+// in the Secret. A nil Secret is valid.
+func CredentialFromSecret(secret *corev1.Secret) (Credential, error) {
+	var clientID, tenantID string
+	if secret != nil {
+		if k, ok := secret.Data[AccountKeyField]; ok {
+			if len(k) == 0 {
+				return nil, fmt.Errorf("invalid '%s' secret data: empty '%s'", secret.Name, AccountKeyField)
+			}
+			return NewSharedKeyCredential(string(k))
+		}
+		if k, ok := secret.Data[SASKeyField]; ok {
+			if len(k) == 0 {
+				return nil, fmt.Errorf("invalid '%s' secret data: empty '%s'", secret.Name, SASKeyField)
+			}
+			return NewSASCredential(string(k)), nil
+		}
+		clientID = string(secret.Data[ClientIDField])
+		tenantID = string(secret.Data[TenantIDField])
+	}
+
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" {
+		if clientID == "" {
+			clientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+		if tenantID == "" {
+			tenantID = os.Getenv("AZURE_TENANT_ID")
+		}
+		if clientID == "" || tenantID == "" {
+			return nil, fmt.Errorf("workload identity requires a client ID and tenant ID")
+		}
+		return NewWorkloadIdentityCredential(tenantID, clientID, tokenFile, os.Getenv("AZURE_AUTHORITY_HOST")), nil
+	}
+	return NewManagedIdentityCredential(clientID), nil
+}
+
+// SharedKeyCredential authorizes requests by signing them with a storage
+// account key.
+type SharedKeyCredential struct {
+	key []byte
+}
+
+// NewSharedKeyCredential returns a SharedKeyCredential for the given base64
+// encoded account key.
+func NewSharedKeyCredential(accountKey string) (*SharedKeyCredential, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(accountKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid account key: %w", err)
+	}
+	return &SharedKeyCredential{key: key}, nil
+}
+
+// Authorize signs the request with the account key, as described in
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key.
+func (c *SharedKeyCredential) Authorize(_ context.Context, req *http.Request, account string) error {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(stringToSign(req, account)))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", account, signature))
+	return nil
+}
+
+// stringToSign returns the canonical representation of the request that is
+// signed for shared key authorization.
+func stringToSign(req *http.Request, account string) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	parts := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	var headers []string
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k)
+		}
+	}
+	sort.Strings(headers)
+	var b strings.Builder
+	for _, k := range headers {
+		b.WriteString(k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n")
+	}
+
+	b.WriteString("/" + account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	var params []string
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		values := query[k]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+
+	return strings.Join(parts, "\n") + "\n" + b.String()
+}
+
+// SASCredential authorizes requests by appending a shared access signature
+// token to the query.
+type SASCredential struct {
+	query url.Values
+}
+
+// NewSASCredential returns a SASCredential for the given token, with or
+// without a leading '?'.
+func NewSASCredential(token string) *SASCredential {
+	query, _ := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(token), "?"))
+	return &SASCredential{query: query}
+}
+
+// Authorize adds the SAS token to the query of the request.
+func (c *SASCredential) Authorize(_ context.Context, req *http.Request, _ string) error {
+	query := req.URL.Query()
+	for k, v := range c.query {
+		query[k] = v
+	}
+	req.URL.RawQuery = query.Encode()
+	return nil
+}
+
+// tokenCredential authorizes requests with an OAuth bearer token, which is
+// cached until shortly before it expires.
+type tokenCredential struct {
+	name  string
+	fetch func(ctx context.Context) (token string, expiresOn time.Time, err error)
+
+	mu        sync.Mutex
+	token     string
+	expiresOn time.Time
+}
+
+// Authorize adds a valid bearer token to the request.
+func (c *tokenCredential) Authorize(ctx context.Context, req *http.Request, _ string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" || time.Now().Add(tokenExpiryDelta).After(c.expiresOn) {
+		token, expiresOn, err := c.fetch(ctx)
+		if err != nil {
+			return &AuthError{Err: err}
+		}
+		c.token, c.expiresOn = token, expiresOn
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return nil
+}
+
+// NewManagedIdentityCredential returns a Credential that requests tokens for
+// the managed identity of the host from the Azure Instance Metadata Service.
+// The clientID selects a user-assigned identity, and may be empty.
+func NewManagedIdentityCredential(clientID string) Credential {
+	return &tokenCredential{
+		name: "managed identity",
+		fetch: func(ctx context.Context) (string, time.Time, error) {
+			query := url.Values{}
+			query.Set("api-version", "2018-02-01")
+			query.Set("resource", storageResource)
+			if clientID != "" {
+				query.Set("client_id", clientID)
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, defaultIMDSEndpoint+"?"+query.Encode(), nil)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			req.Header.Set("Metadata", "true")
+
+			var resp struct {
+				AccessToken string `json:"access_token"`
+				ExpiresOn   string `json:"expires_on"`
+			}
+			if err := doTokenRequest(req, &resp); err != nil {
+				return "", time.Time{}, fmt.Errorf("managed identity token request failed: %w", err)
+			}
+			expiresOn, err := strconv.ParseInt(resp.ExpiresOn, 10, 64)
+			if err != nil {
+				return "", time.Time{}, fmt.Errorf("invalid managed identity token expiry '%s'", resp.ExpiresOn)
+			}
+			return resp.AccessToken, time.Unix(expiresOn, 0), nil
+		},
+	}
+}
+
+// NewWorkloadIdentityCredential returns a Credential that exchanges the
+// federated service account token in tokenFile for an Azure AD token of the
+// given client. The authorityHost defaults to the Azure public cloud.
+func NewWorkloadIdentityCredential(tenantID, clientID, tokenFile, authorityHost string) Credential {
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+	endpoint := strings.TrimSuffix(authorityHost, "/") + "/" + tenantID + "/oauth2/v2.0/token"
+	return &tokenCredential{
+		name: "workload identity",
+		fetch: func(ctx context.Context) (string, time.Time, error) {
+			// The token file is rotated by the kubelet, read it on every request.
+			assertion, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return "", time.Time{}, fmt.Errorf("failed to read federated token: %w", err)
+			}
+			form := url.Values{}
+			form.Set("client_id", clientID)
+			form.Set("scope", storageScope)
+			form.Set("grant_type", "client_credentials")
+			form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+			form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			var resp struct {
+				AccessToken string `json:"access_token"`
+				ExpiresIn   int64  `json:"expires_in"`
+			}
+			if err := doTokenRequest(req, &resp); err != nil {
+				return "", time.Time{}, fmt.Errorf("workload identity token request failed: %w", err)
+			}
+			return resp.AccessToken, time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second), nil
+		},
+	}
+}
+
+func doTokenRequest(req *http.Request, v interface{}) error {
+	resp, err := tokenClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
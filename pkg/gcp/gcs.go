@@ -0,0 +1,354 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	corev1 "k8s.io/api/core/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+const (
+	// ServiceAccountField is the Secret field holding the JSON key of a
+	// Google service account.
+	ServiceAccountField = "serviceaccount"
+
+	// readOnlyScope is the OAuth scope of the tokens requested for the
+	// credentials, which only allows reading the buckets.
+	readOnlyScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+	// defaultHost is the host of the Cloud Storage endpoint, which may be sent
+	// the tokens of the identity of the controller.
+	defaultHost = "storage.googleapis.com"
+
+	// maxResults is the maximum number of objects requested per list page.
+	maxResults = "1000"
+)
+
+// GCSClient is a minimal Google Cloud Storage client for fetching objects
+// from a bucket with the JSON API.
+type GCSClient struct {
+	httpClient  *http.Client
+	endpoint    *url.URL
+	tokenSource oauth2.TokenSource
+	source      string
+}
+
+// NewClient creates a new GCSClient for the endpoint of the given
+// v1beta1.Bucket, e.g. 'storage.googleapis.com', authorized with the JSON
+// key of the service account in the 'serviceaccount' field of the given
+// Secret, or else with the Application Default Credentials of the
+// controller, e.g. the Workload Identity of its Kubernetes service account
+// on GKE. The credentials of the controller are only used for an 'https://'
+// endpoint of Cloud Storage, or of a host allowed with
+// transport.SetAmbientCredentialHosts. The certificate of the endpoint is verified against the CA
+// certificates in the 'caFile' or 'ca.crt' field of the Secret in addition to
+// the system roots, or not at all when spec.insecure is set for an 'https://'
+// endpoint. The Secret may be nil. The requests are sent through the proxy of
+// the given ProxyFunc instead of the proxy of the environment, if not nil.
+func NewClient(ctx context.Context, bucket sourcev1.Bucket, secret *corev1.Secret, proxy transport.ProxyFunc) (*GCSClient, error) {
+	endpoint := bucket.Spec.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https"
+		if bucket.Spec.Insecure {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint '%s': %w", bucket.Spec.Endpoint, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	tlsConfig, err := transport.TLSConfigFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if bucket.Spec.Insecure && u.Scheme == "https" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+	httpClient := &http.Client{Transport: transport.WithUserAgent(transport.NewProxyTransport(tlsConfig, proxy))}
+
+	// The tokens of a service account key are requested with the client of
+	// the endpoint, those of the Application Default Credentials from the
+	// metadata server are not
+	var creds *google.Credentials
+	source := "service account key"
+	if key, ok := secretField(secret, ServiceAccountField); ok {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("invalid '%s' secret data: empty '%s'", secret.Name, ServiceAccountField)
+		}
+		creds, err = google.CredentialsFromJSON(context.WithValue(ctx, oauth2.HTTPClient, httpClient), key, readOnlyScope)
+		if err != nil {
+			return nil, fmt.Errorf("invalid '%s' secret data: invalid '%s': %w", secret.Name, ServiceAccountField, err)
+		}
+	} else {
+		if err := transport.CheckAmbientCredentialEndpoint(u, bucket.Spec.Insecure, defaultHost); err != nil {
+			return nil, err
+		}
+		source = "workload identity"
+		creds, err = google.FindDefaultCredentials(ctx, readOnlyScope)
+		if err != nil {
+			return nil, &AuthError{Err: err}
+		}
+	}
+
+	return &GCSClient{
+		httpClient:  httpClient,
+		endpoint:    u,
+		tokenSource: creds.TokenSource,
+		source:      source,
+	}, nil
+}
+
+// secretField returns the given field of the given Secret, which may be nil,
+// and if it is set.
+func secretField(secret *corev1.Secret, field string) ([]byte, bool) {
+	if secret == nil {
+		return nil, false
+	}
+	v, ok := secret.Data[field]
+	return v, ok
+}
+
+// CredentialSource returns the name of the type of credentials used by the
+// client.
+func (c *GCSClient) CredentialSource() string {
+	return c.source
+}
+
+// Region returns an empty string, as the location of a bucket is not needed
+// to address it.
+func (c *GCSClient) Region() string {
+	return ""
+}
+
+// Retries returns zero, as failed requests are not retried.
+func (c *GCSClient) Retries() int64 {
+	return 0
+}
+
+// BucketExists returns if the bucket with the given name exists.
+func (c *GCSClient) BucketExists(ctx context.Context, bucketName string) (bool, error) {
+	resp, err := c.do(ctx, "/storage/v1/b/"+url.PathEscape(bucketName), url.Values{"fields": {"name"}})
+	if err != nil {
+		var respErr *ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// FGetObject downloads the object with the given name from the bucket to the
+// given local path, and returns the content type of the object.
+func (c *GCSClient) FGetObject(ctx context.Context, bucketName, objectName, localPath string) (string, error) {
+	resp, err := c.do(ctx, "/storage/v1/b/"+url.PathEscape(bucketName)+"/o/"+url.PathEscape(objectName),
+		url.Values{"alt": {"media"}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return "", err
+	}
+	return resp.Header.Get("Content-Type"), f.Close()
+}
+
+// VisitObjects lists all objects in the bucket with a name starting with the
+// given prefix, following the page tokens of large buckets, and calls visit
+// with the name, ETag, size and last modification time of every object.
+// Listing stops at the first error returned by visit.
+func (c *GCSClient) VisitObjects(ctx context.Context, bucketName, prefix string, visit func(key, etag string, size int64, lastModified time.Time) error) error {
+	pageToken := ""
+	for {
+		query := url.Values{
+			"maxResults": {maxResults},
+			"fields":     {"items(name,etag,size,updated),nextPageToken"},
+		}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		resp, err := c.do(ctx, "/storage/v1/b/"+url.PathEscape(bucketName)+"/o", query)
+		if err != nil {
+			return err
+		}
+		var result listObjectsResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode object listing: %w", err)
+		}
+
+		for _, object := range result.Items {
+			size, _ := strconv.ParseInt(object.Size, 10, 64)
+			if err := visit(object.Name, object.ETag, size, object.Updated); err != nil {
+				return err
+			}
+		}
+
+		if result.NextPageToken == "" {
+			return nil
+		}
+		pageToken = result.NextPageToken
+	}
+}
+
+// ObjectIsNotFound checks if the error provided is a ResponseError with a
+// 404 status code.
+func (c *GCSClient) ObjectIsNotFound(err error) bool {
+	var respErr *ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+// IsAuthError checks if the error provided is caused by missing, invalid or
+// insufficient credentials.
+func (c *GCSClient) IsAuthError(err error) bool {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return true
+	}
+	var respErr *ResponseError
+	return errors.As(err, &respErr) &&
+		(respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden)
+}
+
+// do performs an authorized GET request for the given escaped path of the
+// endpoint, and returns the response if the request succeeded. The caller is
+// responsible for closing the response body.
+func (c *GCSClient) do(ctx context.Context, escapedPath string, query url.Values) (*http.Response, error) {
+	// The escaped path keeps the slashes of the object names escaped
+	u := c.endpoint.String() + escapedPath + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.tokenSource.Token()
+	if err != nil {
+		return nil, &AuthError{Err: err}
+	}
+	token.SetAuthHeader(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, newResponseError(resp)
+}
+
+// ResponseError is returned for requests that were not successful.
+type ResponseError struct {
+	StatusCode int
+	Reason     string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s (%d): %s", e.Reason, e.StatusCode, e.Message)
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("%s (%d)", e.Reason, e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+func newResponseError(resp *http.Response) *ResponseError {
+	respErr := &ResponseError{StatusCode: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Errors  []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body); err == nil {
+		if len(body.Error.Errors) > 0 {
+			respErr.Reason = body.Error.Errors[0].Reason
+		}
+		respErr.Message = strings.SplitN(strings.TrimSpace(body.Error.Message), "\n", 2)[0]
+	}
+	return respErr
+}
+
+// AuthError is returned when the credentials failed to obtain a token for a
+// request.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authorization failed: %s", e.Err.Error())
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// listObjectsResult is the response of an Objects: list request, as described
+// in https://cloud.google.com/storage/docs/json_api/v1/objects/list.
+type listObjectsResult struct {
+	Items         []objectItem `json:"items"`
+	NextPageToken string       `json:"nextPageToken"`
+}
+
+type objectItem struct {
+	Name    string    `json:"name"`
+	ETag    string    `json:"etag"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
@@ -0,0 +1,309 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+// newTestClient returns a GCSClient for a test server which serves the
+// tokens of a service account key at '/token', and the other requests with
+// the given handler, if they are authorized with the token.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *GCSClient {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			writeError(w, http.StatusUnauthorized, "required")
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.GoogleBucketProvider,
+		Endpoint: server.URL,
+	}}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "gcp"},
+		Data:       map[string][]byte{ServiceAccountField: serviceAccountKey(t, server.URL+"/token")},
+	}
+	client, err := NewClient(context.TODO(), bucket, secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// serviceAccountKey returns the JSON key of a service account of which the
+// tokens are requested from the given URL.
+func serviceAccountKey(t *testing.T, tokenURL string) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "flux",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"client_email":   "source-controller@flux.iam.gserviceaccount.com",
+		"token_uri":      tokenURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":"The error message.","errors":[{"reason":%q}]}}`, status, reason)
+}
+
+func TestGCSClient_BucketExists(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		reason    string
+		want      bool
+		wantErr   bool
+		wantAuthz bool
+	}{
+		{name: "exists", status: http.StatusOK, want: true},
+		{name: "not found", status: http.StatusNotFound, reason: "notFound"},
+		{name: "forbidden", status: http.StatusForbidden, reason: "forbidden", wantErr: true, wantAuthz: true},
+		{name: "server error", status: http.StatusInternalServerError, reason: "backendError", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/storage/v1/b/bucket" {
+					t.Errorf("unexpected request %s", r.URL)
+				}
+				if tt.reason != "" {
+					writeError(w, tt.status, tt.reason)
+					return
+				}
+				fmt.Fprint(w, `{"name":"bucket"}`)
+			})
+			got, err := client.BucketExists(context.TODO(), "bucket")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BucketExists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("BucketExists() got = %v, want %v", got, tt.want)
+			}
+			if authz := client.IsAuthError(err); authz != tt.wantAuthz {
+				t.Errorf("IsAuthError() got = %v, want %v", authz, tt.wantAuthz)
+			}
+		})
+	}
+}
+
+func TestGCSClient_VisitObjects(t *testing.T) {
+	updated := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/bucket/o" || r.URL.Query().Get("prefix") != "charts/" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		switch r.URL.Query().Get("pageToken") {
+		case "":
+			fmt.Fprintf(w, `{"items":[{"name":"charts/a.yaml","etag":"CAE=","size":"12","updated":%q}],"nextPageToken":"next"}`,
+				updated.Format(time.RFC3339))
+		case "next":
+			fmt.Fprintf(w, `{"items":[{"name":"charts/b/c.yaml","etag":"CAI=","size":"3","updated":%q}]}`,
+				updated.Format(time.RFC3339))
+		default:
+			t.Errorf("unexpected page token in %s", r.URL)
+		}
+	})
+
+	var got []string
+	err := client.VisitObjects(context.TODO(), "bucket", "charts/", func(key, etag string, size int64, lastModified time.Time) error {
+		if !lastModified.Equal(updated) {
+			t.Errorf("VisitObjects() last modified = %v, want %v", lastModified, updated)
+		}
+		got = append(got, fmt.Sprintf("%s %s %d", key, etag, size))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VisitObjects() error = %v", err)
+	}
+	want := []string{"charts/a.yaml CAE= 12", "charts/b/c.yaml CAI= 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VisitObjects() = %v, want %v", got, want)
+	}
+}
+
+func TestGCSClient_FGetObject(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/storage/v1/b/bucket/o/charts%2Fa.yaml" || r.URL.Query().Get("alt") != "media" {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		fmt.Fprint(w, "key: value")
+	})
+
+	localPath := filepath.Join(t.TempDir(), "charts", "a.yaml")
+	contentType, err := client.FGetObject(context.TODO(), "bucket", "charts/a.yaml", localPath)
+	if err != nil {
+		t.Fatalf("FGetObject() error = %v", err)
+	}
+	if contentType != "application/yaml" {
+		t.Errorf("FGetObject() content type = %q, want application/yaml", contentType)
+	}
+	if b, err := os.ReadFile(localPath); err != nil || string(b) != "key: value" {
+		t.Errorf("FGetObject() wrote %q, %v, want the object", b, err)
+	}
+
+	_, err = client.FGetObject(context.TODO(), "bucket", "missing.yaml", filepath.Join(t.TempDir(), "missing.yaml"))
+	if !client.ObjectIsNotFound(err) {
+		t.Errorf("FGetObject() of a missing object error = %v, want not found", err)
+	}
+}
+
+func TestNewClient_invalidServiceAccount(t *testing.T) {
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.GoogleBucketProvider,
+		Endpoint: "storage.googleapis.com",
+	}}
+	for _, key := range []string{"", "{"} {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "gcp"},
+			Data:       map[string][]byte{ServiceAccountField: []byte(key)},
+		}
+		if _, err := NewClient(context.TODO(), bucket, secret, nil); err == nil {
+			t.Errorf("NewClient() with service account key %q error = nil, want invalid", key)
+		}
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "gcp"},
+		Data:       map[string][]byte{ServiceAccountField: serviceAccountKey(t, "https://oauth2.googleapis.com/token")},
+	}
+	client, err := NewClient(context.TODO(), bucket, secret, nil)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if client.CredentialSource() != "service account key" {
+		t.Errorf("CredentialSource() = %q, want service account key", client.CredentialSource())
+	}
+}
+
+func TestNewClient_ambientCredentials(t *testing.T) {
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"controller","token_type":"Bearer","expires_in":3600}`)
+	}))
+	defer tokens.Close()
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(keyFile, serviceAccountKey(t, tokens.URL), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); ok {
+		defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", v)
+	} else {
+		defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", keyFile)
+
+	var authorizations []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"name":"bucket"}`)
+	}))
+	defer server.Close()
+	ca := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ca"},
+		Data: map[string][]byte{"ca.crt": pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: server.Certificate().Raw,
+		})},
+	}
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token of the controller is not sent to an endpoint of the tenant
+	for _, spec := range []sourcev1.BucketSpec{
+		{Endpoint: "127.0.0.1:" + port},
+		{Endpoint: "http://127.0.0.1:" + port},
+		{Endpoint: "https://127.0.0.1:" + port, Insecure: true},
+	} {
+		spec.Provider = sourcev1.GoogleBucketProvider
+		client, err := NewClient(context.TODO(), sourcev1.Bucket{Spec: spec}, ca, nil)
+		if err == nil {
+			client.BucketExists(context.TODO(), "bucket")
+			t.Errorf("NewClient() with ambient credentials for %s error = nil, want rejected", spec.Endpoint)
+		}
+	}
+	if len(authorizations) != 0 {
+		t.Fatalf("endpoint received the authorizations %v, want none", authorizations)
+	}
+
+	// An allowed host is sent the token
+	if err := transport.SetAmbientCredentialHosts([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.SetAmbientCredentialHosts(nil)
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.GoogleBucketProvider,
+		Endpoint: "127.0.0.1:" + port,
+	}}
+	client, err := NewClient(context.TODO(), bucket, ca, nil)
+	if err != nil {
+		t.Fatalf("NewClient() for an allowed host error = %v", err)
+	}
+	if client.CredentialSource() != "workload identity" {
+		t.Errorf("CredentialSource() = %q, want workload identity", client.CredentialSource())
+	}
+	if exists, err := client.BucketExists(context.TODO(), "bucket"); err != nil || !exists {
+		t.Fatalf("BucketExists() = %v, %v", exists, err)
+	}
+	if len(authorizations) != 1 || authorizations[0] != "Bearer controller" {
+		t.Errorf("endpoint received the authorizations %v, want the token of the controller", authorizations)
+	}
+}
@@ -18,6 +18,8 @@ package git
 
 import (
 	"context"
+	"net/http"
+	"net/url"
 
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	git2go "github.com/libgit2/git2go/v31"
@@ -31,8 +33,16 @@ const (
 	CAFile                   = "caFile"
 )
 
+// ProtocolV0 is the original Git wire protocol, the only one spoken by the
+// Git implementations.
+const ProtocolV0 = "v0"
+
 type Commit interface {
 	Verify(secret corev1.Secret) error
+	// VerifyTag returns an error if the commit was not checked out from an
+	// annotated tag, or if the PGP signature of the tag can't be verified
+	// with any of the public keys of the given secret.
+	VerifyTag(secret corev1.Secret) error
 	Hash() string
 }
 
@@ -43,6 +53,19 @@ type CheckoutStrategy interface {
 type CheckoutOptions struct {
 	GitImplementation string
 	RecurseSubmodules bool
+	// SubmoduleDepth is the maximum depth of the recursion of the
+	// submodules, zero for the default of the implementation.
+	SubmoduleDepth int
+	// SparseCheckout are the paths relative to the root of the repository
+	// to check out, instead of the whole worktree, if any. The hash of the
+	// revision of a sparse checkout is the hash of the content of the paths.
+	SparseCheckout []string
+	// Depth is the number of commits of the history to fetch, zero for the
+	// default of the checkout strategy.
+	Depth int
+	// AllBranches fetches all the branches of the repository, instead of
+	// the referenced branch only.
+	AllBranches bool
 }
 
 // TODO(hidde): candidate for refactoring, so that we do not directly
@@ -52,6 +75,16 @@ type Auth struct {
 	CABundle     []byte
 	CredCallback git2go.CredentialsCallback
 	CertCallback git2go.CertificateCheckCallback
+	// ServerName is the name by which the server of an HTTPS repository is
+	// addressed instead of the host of the URL, if any.
+	ServerName string
+	// SubmoduleSecrets are the secrets of the credentials of the submodules
+	// by host of their URL. The submodules of the other hosts are cloned
+	// with the AuthMethod.
+	SubmoduleSecrets map[string]corev1.Secret
+	// Proxy returns the proxy of the HTTP(S) requests of the clone, instead
+	// of the proxy of the environment, if not nil.
+	Proxy func(*http.Request) (*url.URL, error)
 }
 
 type AuthSecretStrategy interface {
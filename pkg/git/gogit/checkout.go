@@ -25,6 +25,7 @@ import (
 	"github.com/Masterminds/semver/v3"
 	extgogit "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 
 	"github.com/fluxcd/pkg/gitutil"
 	"github.com/fluxcd/pkg/version"
@@ -33,49 +34,75 @@ import (
 	"github.com/fluxcd/source-controller/pkg/git"
 )
 
+// ProtocolVersion is the Git wire protocol version implemented by go-git, it
+// does not negotiate a later version with remotes.
+const ProtocolVersion = git.ProtocolV0
+
 func CheckoutStrategyForRef(ref *sourcev1.GitRepositoryRef, opt git.CheckoutOptions) git.CheckoutStrategy {
 	switch {
 	case ref == nil:
-		return &CheckoutBranch{branch: git.DefaultBranch}
+		return &CheckoutBranch{branch: git.DefaultBranch, sparseCheckout: opt.SparseCheckout,
+			depth: opt.Depth, allBranches: opt.AllBranches}
 	case ref.SemVer != "":
-		return &CheckoutSemVer{semVer: ref.SemVer, recurseSubmodules: opt.RecurseSubmodules}
+		return &CheckoutSemVer{semVer: ref.SemVer, recurseSubmodules: opt.RecurseSubmodules,
+			submoduleDepth: opt.SubmoduleDepth, sparseCheckout: opt.SparseCheckout, depth: opt.Depth}
 	case ref.Tag != "":
-		return &CheckoutTag{tag: ref.Tag, recurseSubmodules: opt.RecurseSubmodules}
+		return &CheckoutTag{tag: ref.Tag, recurseSubmodules: opt.RecurseSubmodules,
+			submoduleDepth: opt.SubmoduleDepth, sparseCheckout: opt.SparseCheckout, depth: opt.Depth,
+			allBranches: opt.AllBranches}
 	case ref.Commit != "":
-		strategy := &CheckoutCommit{branch: ref.Branch, commit: ref.Commit, recurseSubmodules: opt.RecurseSubmodules}
+		strategy := &CheckoutCommit{branch: ref.Branch, commit: ref.Commit, recurseSubmodules: opt.RecurseSubmodules,
+			submoduleDepth: opt.SubmoduleDepth, sparseCheckout: opt.SparseCheckout, depth: opt.Depth,
+			allBranches: opt.AllBranches}
 		if strategy.branch == "" {
 			strategy.branch = git.DefaultBranch
 		}
 		return strategy
 	case ref.Branch != "":
-		return &CheckoutBranch{branch: ref.Branch, recurseSubmodules: opt.RecurseSubmodules}
+		return &CheckoutBranch{branch: ref.Branch, recurseSubmodules: opt.RecurseSubmodules,
+			submoduleDepth: opt.SubmoduleDepth, sparseCheckout: opt.SparseCheckout, depth: opt.Depth,
+			allBranches: opt.AllBranches}
 	default:
-		return &CheckoutBranch{branch: git.DefaultBranch}
+		return &CheckoutBranch{branch: git.DefaultBranch, sparseCheckout: opt.SparseCheckout,
+			depth: opt.Depth, allBranches: opt.AllBranches}
 	}
 }
 
 type CheckoutBranch struct {
 	branch            string
 	recurseSubmodules bool
+	submoduleDepth    int
+	sparseCheckout    []string
+	depth             int
+	allBranches       bool
 }
 
 func (c *CheckoutBranch) Checkout(ctx context.Context, path, url string, auth *git.Auth) (git.Commit, string, error) {
+	authMethod, caBundle, err := cloneAuth(url, auth)
+	if err != nil {
+		return nil, "", err
+	}
 	repo, err := extgogit.PlainCloneContext(ctx, path, false, &extgogit.CloneOptions{
 		URL:               url,
-		Auth:              auth.AuthMethod,
+		Auth:              authMethod,
 		RemoteName:        git.DefaultOrigin,
 		ReferenceName:     plumbing.NewBranchReferenceName(c.branch),
-		SingleBranch:      true,
-		NoCheckout:        false,
-		Depth:             1,
-		RecurseSubmodules: recurseSubmodules(c.recurseSubmodules),
+		SingleBranch:      !c.allBranches,
+		NoCheckout:        len(c.sparseCheckout) > 0,
+		Depth:             cloneDepth(c.depth),
+		RecurseSubmodules: extgogit.NoRecurseSubmodules,
 		Progress:          nil,
 		Tags:              extgogit.NoTags,
-		CABundle:          auth.CABundle,
+		CABundle:          caBundle,
 	})
 	if err != nil {
 		return nil, "", fmt.Errorf("unable to clone '%s', error: %w", url, gitutil.GoGitError(err))
 	}
+	if c.recurseSubmodules {
+		if err := updateSubmodules(ctx, repo, url, authMethod, auth, submoduleDepth(c.submoduleDepth)); err != nil {
+			return nil, "", err
+		}
+	}
 	head, err := repo.Head()
 	if err != nil {
 		return nil, "", fmt.Errorf("git resolve HEAD error: %w", err)
@@ -84,31 +111,44 @@ func (c *CheckoutBranch) Checkout(ctx context.Context, path, url string, auth *g
 	if err != nil {
 		return nil, "", fmt.Errorf("git commit '%s' not found: %w", head.Hash(), err)
 	}
-	return &Commit{commit}, fmt.Sprintf("%s/%s", c.branch, head.Hash().String()), nil
+	return checkoutResult(commit, nil, path, c.branch, c.sparseCheckout)
 }
 
 type CheckoutTag struct {
 	tag               string
 	recurseSubmodules bool
+	submoduleDepth    int
+	sparseCheckout    []string
+	depth             int
+	allBranches       bool
 }
 
 func (c *CheckoutTag) Checkout(ctx context.Context, path, url string, auth *git.Auth) (git.Commit, string, error) {
+	authMethod, caBundle, err := cloneAuth(url, auth)
+	if err != nil {
+		return nil, "", err
+	}
 	repo, err := extgogit.PlainCloneContext(ctx, path, false, &extgogit.CloneOptions{
 		URL:               url,
-		Auth:              auth.AuthMethod,
+		Auth:              authMethod,
 		RemoteName:        git.DefaultOrigin,
 		ReferenceName:     plumbing.NewTagReferenceName(c.tag),
-		SingleBranch:      true,
-		NoCheckout:        false,
-		Depth:             1,
-		RecurseSubmodules: recurseSubmodules(c.recurseSubmodules),
+		SingleBranch:      !c.allBranches,
+		NoCheckout:        len(c.sparseCheckout) > 0,
+		Depth:             cloneDepth(c.depth),
+		RecurseSubmodules: extgogit.NoRecurseSubmodules,
 		Progress:          nil,
 		Tags:              extgogit.NoTags,
-		CABundle:          auth.CABundle,
+		CABundle:          caBundle,
 	})
 	if err != nil {
 		return nil, "", fmt.Errorf("unable to clone '%s', error: %w", url, err)
 	}
+	if c.recurseSubmodules {
+		if err := updateSubmodules(ctx, repo, url, authMethod, auth, submoduleDepth(c.submoduleDepth)); err != nil {
+			return nil, "", err
+		}
+	}
 	head, err := repo.Head()
 	if err != nil {
 		return nil, "", fmt.Errorf("git resolve HEAD error: %w", err)
@@ -117,27 +157,40 @@ func (c *CheckoutTag) Checkout(ctx context.Context, path, url string, auth *git.
 	if err != nil {
 		return nil, "", fmt.Errorf("git commit '%s' not found: %w", head.Hash(), err)
 	}
-	return &Commit{commit}, fmt.Sprintf("%s/%s", c.tag, head.Hash().String()), nil
+	tag, err := annotatedTag(repo, c.tag)
+	if err != nil {
+		return nil, "", err
+	}
+	return checkoutResult(commit, tag, path, c.tag, c.sparseCheckout)
 }
 
 type CheckoutCommit struct {
 	branch            string
 	commit            string
 	recurseSubmodules bool
+	submoduleDepth    int
+	sparseCheckout    []string
+	depth             int
+	allBranches       bool
 }
 
 func (c *CheckoutCommit) Checkout(ctx context.Context, path, url string, auth *git.Auth) (git.Commit, string, error) {
+	authMethod, caBundle, err := cloneAuth(url, auth)
+	if err != nil {
+		return nil, "", err
+	}
 	repo, err := extgogit.PlainCloneContext(ctx, path, false, &extgogit.CloneOptions{
 		URL:               url,
-		Auth:              auth.AuthMethod,
+		Auth:              authMethod,
 		RemoteName:        git.DefaultOrigin,
 		ReferenceName:     plumbing.NewBranchReferenceName(c.branch),
-		SingleBranch:      true,
-		NoCheckout:        false,
-		RecurseSubmodules: recurseSubmodules(c.recurseSubmodules),
+		SingleBranch:      !c.allBranches,
+		NoCheckout:        len(c.sparseCheckout) > 0,
+		Depth:             c.depth,
+		RecurseSubmodules: extgogit.NoRecurseSubmodules,
 		Progress:          nil,
 		Tags:              extgogit.NoTags,
-		CABundle:          auth.CABundle,
+		CABundle:          caBundle,
 	})
 	if err != nil {
 		return nil, "", fmt.Errorf("unable to clone '%s', error: %w", url, err)
@@ -147,22 +200,40 @@ func (c *CheckoutCommit) Checkout(ctx context.Context, path, url string, auth *g
 		return nil, "", fmt.Errorf("git worktree error: %w", err)
 	}
 	commit, err := repo.CommitObject(plumbing.NewHash(c.commit))
+	if err == plumbing.ErrObjectNotFound && c.depth > 0 {
+		commit, err = deepen(ctx, repo, &extgogit.FetchOptions{
+			RemoteName: git.DefaultOrigin,
+			Auth:       authMethod,
+			Tags:       extgogit.NoTags,
+			CABundle:   caBundle,
+		}, c.depth, plumbing.NewHash(c.commit))
+	}
 	if err != nil {
 		return nil, "", fmt.Errorf("git commit '%s' not found: %w", c.commit, err)
 	}
-	err = w.Checkout(&extgogit.CheckoutOptions{
-		Hash:  commit.Hash,
-		Force: true,
-	})
-	if err != nil {
-		return nil, "", fmt.Errorf("git checkout error: %w", err)
+	if len(c.sparseCheckout) == 0 {
+		err = w.Checkout(&extgogit.CheckoutOptions{
+			Hash:  commit.Hash,
+			Force: true,
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("git checkout error: %w", err)
+		}
+	}
+	if c.recurseSubmodules {
+		if err := updateSubmodules(ctx, repo, url, authMethod, auth, submoduleDepth(c.submoduleDepth)); err != nil {
+			return nil, "", err
+		}
 	}
-	return &Commit{commit}, fmt.Sprintf("%s/%s", c.branch, commit.Hash.String()), nil
+	return checkoutResult(commit, nil, path, c.branch, c.sparseCheckout)
 }
 
 type CheckoutSemVer struct {
 	semVer            string
 	recurseSubmodules bool
+	submoduleDepth    int
+	sparseCheckout    []string
+	depth             int
 }
 
 func (c *CheckoutSemVer) Checkout(ctx context.Context, path, url string, auth *git.Auth) (git.Commit, string, error) {
@@ -171,16 +242,20 @@ func (c *CheckoutSemVer) Checkout(ctx context.Context, path, url string, auth *g
 		return nil, "", fmt.Errorf("semver parse range error: %w", err)
 	}
 
+	authMethod, caBundle, err := cloneAuth(url, auth)
+	if err != nil {
+		return nil, "", err
+	}
 	repo, err := extgogit.PlainCloneContext(ctx, path, false, &extgogit.CloneOptions{
 		URL:               url,
-		Auth:              auth.AuthMethod,
+		Auth:              authMethod,
 		RemoteName:        git.DefaultOrigin,
-		NoCheckout:        false,
-		Depth:             1,
-		RecurseSubmodules: recurseSubmodules(c.recurseSubmodules),
+		NoCheckout:        len(c.sparseCheckout) > 0,
+		Depth:             cloneDepth(c.depth),
+		RecurseSubmodules: extgogit.NoRecurseSubmodules,
 		Progress:          nil,
 		Tags:              extgogit.AllTags,
-		CABundle:          auth.CABundle,
+		CABundle:          caBundle,
 	})
 	if err != nil {
 		return nil, "", fmt.Errorf("unable to clone '%s', error: %w", url, err)
@@ -243,6 +318,22 @@ func (c *CheckoutSemVer) Checkout(ctx context.Context, path, url string, auth *g
 	})
 	v := matchedVersions[len(matchedVersions)-1]
 	t := v.Original()
+	tag, err := annotatedTag(repo, t)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(c.sparseCheckout) > 0 {
+		hash, err := repo.ResolveRevision(plumbing.Revision(plumbing.NewTagReferenceName(t).String()))
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to resolve tag revision: %w", err)
+		}
+		commit, err := repo.CommitObject(*hash)
+		if err != nil {
+			return nil, "", fmt.Errorf("git commit '%s' not found: %w", hash, err)
+		}
+		return checkoutResult(commit, tag, path, t, c.sparseCheckout)
+	}
 
 	w, err := repo.Worktree()
 	if err != nil {
@@ -255,6 +346,11 @@ func (c *CheckoutSemVer) Checkout(ctx context.Context, path, url string, auth *g
 	if err != nil {
 		return nil, "", fmt.Errorf("git checkout error: %w", err)
 	}
+	if c.recurseSubmodules {
+		if err := updateSubmodules(ctx, repo, url, authMethod, auth, submoduleDepth(c.submoduleDepth)); err != nil {
+			return nil, "", err
+		}
+	}
 
 	head, err := repo.Head()
 	if err != nil {
@@ -266,12 +362,68 @@ func (c *CheckoutSemVer) Checkout(ctx context.Context, path, url string, auth *g
 		return nil, "", fmt.Errorf("git commit '%s' not found: %w", head.Hash(), err)
 	}
 
-	return &Commit{commit}, fmt.Sprintf("%s/%s", t, head.Hash().String()), nil
+	return &Commit{commit: commit, tag: tag}, fmt.Sprintf("%s/%s", t, head.Hash().String()), nil
 }
 
-func recurseSubmodules(recurse bool) extgogit.SubmoduleRescursivity {
-	if recurse {
-		return extgogit.DefaultSubmoduleRecursionDepth
+// checkoutResult returns the given commit, checked out from the given
+// annotated tag if any, and its revision for the given reference, in the
+// form '<ref>/<hash>'. The hash is the hash of the commit, or for the given
+// sparse checkout paths, if any, the hash of their content, after they are
+// written to the worktree at the given path.
+func checkoutResult(commit *object.Commit, tag *object.Tag, path, ref string, sparse []string) (git.Commit, string, error) {
+	hash := commit.Hash.String()
+	if len(sparse) > 0 {
+		h, err := sparseCheckout(commit, path, sparse)
+		if err != nil {
+			return nil, "", err
+		}
+		hash = h
+	}
+	return &Commit{commit: commit, tag: tag}, fmt.Sprintf("%s/%s", ref, hash), nil
+}
+
+// annotatedTag returns the annotated tag object of the tag with the given
+// name in the given repository, or nil for a lightweight tag.
+func annotatedTag(repo *extgogit.Repository, name string) (*object.Tag, error) {
+	ref, err := repo.Tag(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find tag '%s': %w", name, err)
+	}
+	tag, err := repo.TagObject(ref.Hash())
+	if err == plumbing.ErrObjectNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("git tag '%s' error: %w", name, err)
+	}
+	return tag, nil
+}
+
+// cloneDepth returns the given depth of the history to fetch, or a depth of
+// one commit when it is zero.
+func cloneDepth(depth int) int {
+	if depth > 0 {
+		return depth
+	}
+	return 1
+}
+
+// deepen fetches more of the history of the given shallow repository with
+// the given options, doubling the given depth at every fetch, until the
+// commit with the given hash is reachable or the history is complete.
+func deepen(ctx context.Context, repo *extgogit.Repository, opts *extgogit.FetchOptions, depth int, hash plumbing.Hash) (*object.Commit, error) {
+	for {
+		depth *= 2
+		opts.Depth = depth
+		fetchErr := repo.FetchContext(ctx, opts)
+		if fetchErr != nil && fetchErr != extgogit.NoErrAlreadyUpToDate {
+			return nil, fmt.Errorf("unable to deepen the history to %d commits: %w", depth, gitutil.GoGitError(fetchErr))
+		}
+		commit, err := repo.CommitObject(hash)
+		// the shallow boundary did not move when it is up to date, as the
+		// history is complete
+		if err != plumbing.ErrObjectNotFound || fetchErr == extgogit.NoErrAlreadyUpToDate {
+			return commit, err
+		}
 	}
-	return extgogit.NoRecurseSubmodules
 }
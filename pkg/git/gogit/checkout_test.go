@@ -17,10 +17,35 @@ limitations under the License.
 package gogit
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	extgogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	corev1 "k8s.io/api/core/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
 	"github.com/fluxcd/source-controller/pkg/git"
 )
 
@@ -52,3 +77,264 @@ func TestCheckoutTagSemVer_Checkout(t *testing.T) {
 		t.Errorf("expected semver hash %s, got %s", cTag.Hash(), cSemVer.Hash())
 	}
 }
+
+func TestCheckoutCommit_CheckoutDepth(t *testing.T) {
+	origin := t.TempDir()
+	repo, err := extgogit.PlainInit(origin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commits []plumbing.Hash
+	for i := 0; i < 6; i++ {
+		commitFiles(t, repo, map[string]string{"version": strconv.Itoa(i)})
+		head, err := repo.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, head.Hash())
+	}
+
+	tests := []struct {
+		name    string
+		commit  string
+		depth   int
+		wantErr bool
+	}{
+		{name: "commit within the depth", commit: commits[4].String(), depth: 2},
+		{name: "commit beyond the depth", commit: commits[0].String(), depth: 1},
+		{name: "full history", commit: commits[0].String()},
+		{name: "unknown commit", commit: "a7e2b3f1c9d8e6f5a4b3c2d1e0f9a8b7c6d5e4f3", depth: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := CheckoutStrategyForRef(&sourcev1.GitRepositoryRef{Branch: git.DefaultBranch, Commit: tt.commit},
+				git.CheckoutOptions{Depth: tt.depth})
+			tmpDir := t.TempDir()
+			c, _, err := strategy.Checkout(context.TODO(), tmpDir, origin, &git.Auth{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Checkout() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Checkout() error = %v", err)
+			}
+			if c.Hash() != tt.commit {
+				t.Errorf("Checkout() commit = %s, want %s", c.Hash(), tt.commit)
+			}
+		})
+	}
+
+	// the branch is cloned with the depth
+	strategy := CheckoutStrategyForRef(&sourcev1.GitRepositoryRef{Branch: git.DefaultBranch}, git.CheckoutOptions{Depth: 3})
+	tmpDir := t.TempDir()
+	if _, _, err := strategy.Checkout(context.TODO(), tmpDir, origin, &git.Auth{}); err != nil {
+		t.Fatalf("Checkout() error = %v", err)
+	}
+	clone, err := extgogit.PlainOpen(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clone.CommitObject(commits[3]); err != nil {
+		t.Errorf("commit within the depth not found: %v", err)
+	}
+	if _, err := clone.CommitObject(commits[2]); err != plumbing.ErrObjectNotFound {
+		t.Errorf("commit beyond the depth error = %v, want %v", err, plumbing.ErrObjectNotFound)
+	}
+}
+
+func TestCommit_VerifyTag(t *testing.T) {
+	origin := t.TempDir()
+	repo, err := extgogit.PlainInit(origin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, repo, map[string]string{"version": "1"})
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newEntity := func(name string) (*openpgp.Entity, string) {
+		entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := entity.Serialize(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		return entity, buf.String()
+	}
+	signer, signerKey := newEntity("flux")
+	_, otherKey := newEntity("other")
+	tagger := &object.Signature{Name: "flux", Email: "flux@example.com", When: time.Now()}
+	if _, err := repo.CreateTag("v1.0.0", head.Hash(), &extgogit.CreateTagOptions{
+		Tagger: tagger, Message: "v1.0.0", SignKey: signer}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v1.1.0", head.Hash(), &extgogit.CreateTagOptions{
+		Tagger: tagger, Message: "v1.1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v1.2.0", head.Hash(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ref     *sourcev1.GitRepositoryRef
+		key     string
+		wantErr string
+	}{
+		{name: "signed tag", ref: &sourcev1.GitRepositoryRef{Tag: "v1.0.0"}, key: signerKey},
+		{name: "signed semver tag", ref: &sourcev1.GitRepositoryRef{SemVer: "<1.1.0"}, key: signerKey},
+		{name: "untrusted key", ref: &sourcev1.GitRepositoryRef{Tag: "v1.0.0"}, key: otherKey, wantErr: "can't be verified"},
+		{name: "unsigned tag", ref: &sourcev1.GitRepositoryRef{Tag: "v1.1.0"}, key: signerKey, wantErr: "no PGP signature found"},
+		{name: "lightweight tag", ref: &sourcev1.GitRepositoryRef{SemVer: "1.2.x"}, key: signerKey, wantErr: "not checked out from an annotated tag"},
+		{name: "branch", ref: &sourcev1.GitRepositoryRef{Branch: git.DefaultBranch}, key: signerKey, wantErr: "not checked out from an annotated tag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := CheckoutStrategyForRef(tt.ref, git.CheckoutOptions{})
+			c, _, err := strategy.Checkout(context.TODO(), t.TempDir(), origin, &git.Auth{})
+			if err != nil {
+				t.Fatalf("Checkout() error = %v", err)
+			}
+			err = c.VerifyTag(corev1.Secret{Data: map[string][]byte{"author.asc": []byte(tt.key)}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyTag() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyTag() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckoutBranch_CheckoutUserAgent(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	tmpDir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(tmpDir)
+
+	branch := CheckoutBranch{branch: "main"}
+	if _, _, err := branch.Checkout(context.TODO(), tmpDir, server.URL+"/repo.git", &git.Auth{}); err == nil {
+		t.Fatal("Checkout() of a missing repository error = nil, want an error")
+	}
+	if got != transport.UserAgent() {
+		t.Errorf("User-Agent = %q, want %q", got, transport.UserAgent())
+	}
+}
+
+func TestCheckoutBranch_CheckoutServerName(t *testing.T) {
+	var host, sni, username string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, sni = r.Host, r.TLS.ServerName
+		username, _, _ = r.BasicAuth()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "git.internal.example.com"},
+		DNSNames:              []string{"git.internal.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	server.StartTLS()
+	defer server.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	tmpDir := t.TempDir()
+	branch := CheckoutBranch{branch: "main"}
+	basicAuth := &githttp.BasicAuth{Username: "user", Password: "password"}
+
+	// the certificate is not valid for the address of the server
+	_, _, err = branch.Checkout(context.TODO(), tmpDir, server.URL+"/repo.git", &git.Auth{AuthMethod: basicAuth, CABundle: caBundle})
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Checkout() without a server name error = %v, want a certificate error", err)
+	}
+
+	_, _, err = branch.Checkout(context.TODO(), tmpDir, server.URL+"/repo.git",
+		&git.Auth{AuthMethod: basicAuth, CABundle: caBundle, ServerName: "git.internal.example.com"})
+	if err == nil || strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Checkout() of a missing repository with a server name error = %v, want a not found error", err)
+	}
+	u, _ := url.Parse(server.URL)
+	if want := "git.internal.example.com:" + u.Port(); host != want || sni != "git.internal.example.com" {
+		t.Errorf("expected Host %q and SNI of the server name, got %q and %q", want, host, sni)
+	}
+	if username != "user" {
+		t.Errorf("expected the credentials of the auth method, got user %q", username)
+	}
+
+	// the certificate is verified against the server name
+	_, _, err = branch.Checkout(context.TODO(), tmpDir, server.URL+"/repo.git",
+		&git.Auth{CABundle: caBundle, ServerName: "charts.internal.example.com"})
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Checkout() with another server name error = %v, want a certificate error", err)
+	}
+
+	_, _, err = branch.Checkout(context.TODO(), tmpDir, "http://"+u.Host+"/repo.git",
+		&git.Auth{ServerName: "git.internal.example.com"})
+	if err == nil || !strings.Contains(err.Error(), "requires an HTTPS URL") {
+		t.Errorf("Checkout() of an HTTP URL with a server name error = %v, want an error", err)
+	}
+}
+
+func TestCheckoutBranch_CheckoutProxy(t *testing.T) {
+	var requestURL, proxyAuth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURL, proxyAuth = r.URL.String(), r.Header.Get("Proxy-Authorization")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("proxy", "secret")
+	auth := &git.Auth{
+		AuthMethod: &githttp.BasicAuth{Username: "user", Password: "password"},
+		Proxy:      http.ProxyURL(proxyURL),
+	}
+
+	branch := CheckoutBranch{branch: "main"}
+	_, _, err := branch.Checkout(context.TODO(), t.TempDir(), "http://git.example.com/repo.git", auth)
+	if err == nil {
+		t.Fatal("Checkout() of a missing repository error = nil, want an error")
+	}
+	if want := "http://git.example.com/repo.git/info/refs?service=git-upload-pack"; requestURL != want {
+		t.Errorf("proxy received %q, want %q", requestURL, want)
+	}
+	if proxyAuth == "" {
+		t.Error("proxy received no Proxy-Authorization")
+	}
+
+	_, _, err = branch.Checkout(context.TODO(), t.TempDir(), "ssh://git@git.example.com/repo.git", &git.Auth{Proxy: auth.Proxy})
+	if err == nil || !strings.Contains(err.Error(), "proxy requires an HTTP(S) URL") {
+		t.Errorf("Checkout() of an SSH URL with a proxy error = %v, want an error", err)
+	}
+}
@@ -25,6 +25,8 @@ import (
 
 type Commit struct {
 	commit *object.Commit
+	// tag is the annotated tag the commit was checked out from, if any.
+	tag *object.Tag
 }
 
 func (c *Commit) Hash() string {
@@ -49,3 +51,21 @@ func (c *Commit) Verify(secret corev1.Secret) error {
 	}
 	return nil
 }
+
+// VerifyTag returns an error if the commit was not checked out from an
+// annotated tag, or if the PGP signature of the tag can't be verified
+func (c *Commit) VerifyTag(secret corev1.Secret) error {
+	if c.tag == nil {
+		return fmt.Errorf("commit '%s' was not checked out from an annotated tag", c.commit.Hash)
+	}
+	if c.tag.PGPSignature == "" {
+		return fmt.Errorf("no PGP signature found for tag: %s", c.tag.Name)
+	}
+
+	for _, bytes := range secret.Data {
+		if _, err := c.tag.Verify(string(bytes)); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("PGP signature '%s' of tag '%s' by '%s' can't be verified", c.tag.PGPSignature, c.tag.Name, c.tag.Tagger)
+}
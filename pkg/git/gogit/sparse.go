@@ -0,0 +1,146 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gogit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// sparseCheckoutPaths returns the given sparse checkout paths cleaned and
+// sorted, without the paths under another path of the list. It returns an
+// error for a path outside of the repository, or for its root.
+func sparseCheckoutPaths(paths []string) ([]string, error) {
+	var cleaned []string
+	for _, p := range paths {
+		c := path.Clean(strings.Trim(p, "/"))
+		if c == "." || c == ".." || strings.HasPrefix(c, "../") {
+			return nil, fmt.Errorf("invalid sparse checkout path '%s': it must be a path under the root of the repository", p)
+		}
+		cleaned = append(cleaned, c)
+	}
+	sort.Strings(cleaned)
+
+	var result []string
+	for _, p := range cleaned {
+		if n := len(result); n > 0 && (p == result[n-1] || strings.HasPrefix(p, result[n-1]+"/")) {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// sparseCheckout writes the files under the given paths of the tree of the
+// given commit to the worktree at the given directory, of a repository
+// cloned without a checkout, and returns the hash of the content of the
+// paths: the SHA-256 of the modes, object hashes and names of their tree
+// entries, which only changes with the content of the paths.
+func sparseCheckout(commit *object.Commit, dir string, paths []string) (string, error) {
+	paths, err := sparseCheckoutPaths(paths)
+	if err != nil {
+		return "", err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", fmt.Errorf("git tree of commit '%s' error: %w", commit.Hash, err)
+	}
+
+	h := sha256.New()
+	for _, p := range paths {
+		entry, err := tree.FindEntry(p)
+		if err != nil {
+			return "", fmt.Errorf("sparse checkout path '%s' not found in commit '%s': %w", p, commit.Hash, err)
+		}
+		fmt.Fprintf(h, "%o %s %s\n", uint32(entry.Mode), entry.Hash, p)
+
+		switch entry.Mode {
+		case filemode.Dir:
+			subtree, err := tree.Tree(p)
+			if err != nil {
+				return "", fmt.Errorf("git tree '%s' error: %w", p, err)
+			}
+			err = subtree.Files().ForEach(func(f *object.File) error {
+				return writeFile(dir, path.Join(p, f.Name), f)
+			})
+			if err != nil {
+				return "", err
+			}
+		case filemode.Submodule:
+			// submodules are not checked out
+		default:
+			f, err := tree.TreeEntryFile(entry)
+			if err != nil {
+				return "", fmt.Errorf("git file '%s' error: %w", p, err)
+			}
+			if err := writeFile(dir, p, f); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFile writes the given file of a tree to the given name under the
+// given directory, as a symbolic link for a file with the symlink mode.
+func writeFile(dir, name string, f *object.File) error {
+	dst, err := securejoin.SecureJoin(dir, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return fmt.Errorf("git file '%s' error: %w", name, err)
+		}
+		return os.Symlink(target, dst)
+	}
+
+	perm := os.FileMode(0o644)
+	if f.Mode == filemode.Executable {
+		perm = 0o755
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return fmt.Errorf("git file '%s' error: %w", name, err)
+	}
+	defer r.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gogit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	extgogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/fluxcd/source-controller/pkg/git"
+)
+
+// commitFiles writes the given files to the worktree of the given repository
+// and commits them.
+func commitFiles(t *testing.T, repo *extgogit.Repository, files map[string]string) {
+	t.Helper()
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(w.Filesystem.Root(), name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = w.Commit("update", &extgogit.CommitOptions{
+		Author: &object.Signature{Name: "Flux", Email: "flux@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckoutBranch_SparseCheckout(t *testing.T) {
+	origin := t.TempDir()
+	repo, err := extgogit.PlainInit(origin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, repo, map[string]string{
+		"apps/podinfo/deployment.yaml": "kind: Deployment",
+		"apps/podinfo/service.yaml":    "kind: Service",
+		"apps/other/deployment.yaml":   "kind: Deployment",
+		"infra/namespace.yaml":         "kind: Namespace",
+		"README.md":                    "monorepo",
+	})
+
+	checkout := func(t *testing.T) (string, string) {
+		t.Helper()
+		dir := t.TempDir()
+		strategy := CheckoutStrategyForRef(nil, git.CheckoutOptions{SparseCheckout: []string{"./apps/podinfo/", "infra/namespace.yaml"}})
+		_, revision, err := strategy.Checkout(context.TODO(), dir, origin, &git.Auth{})
+		if err != nil {
+			t.Fatalf("Checkout() error = %v", err)
+		}
+		return dir, revision
+	}
+
+	dir, revision := checkout(t)
+	var files []string
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"apps/podinfo/deployment.yaml", "apps/podinfo/service.yaml", "infra/namespace.yaml"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("checked out files = %v, want %v", files, want)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(revision, git.DefaultBranch+"/") || strings.HasSuffix(revision, head.Hash().String()) {
+		t.Errorf("revision = %s, want the hash of the content of the paths", revision)
+	}
+	if hash := strings.TrimPrefix(revision, git.DefaultBranch+"/"); len(hash) != 64 {
+		t.Errorf("revision hash = %s, want a SHA-256", hash)
+	}
+
+	// the revision only changes with the content of the paths
+	commitFiles(t, repo, map[string]string{"apps/other/deployment.yaml": "kind: StatefulSet"})
+	if _, r := checkout(t); r != revision {
+		t.Errorf("revision after a change outside of the paths = %s, want %s", r, revision)
+	}
+	commitFiles(t, repo, map[string]string{"apps/podinfo/service.yaml": "kind: Service\nspec: {}"})
+	if _, r := checkout(t); r == revision {
+		t.Error("revision after a change of the paths is unchanged")
+	}
+}
+
+func TestSparseCheckoutPaths(t *testing.T) {
+	got, err := sparseCheckoutPaths([]string{"apps/podinfo/", "./infra", "apps", "/clusters/prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"apps", "clusters/prod", "infra"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sparseCheckoutPaths() = %v, want %v", got, want)
+	}
+	for _, p := range []string{"", ".", "../other", "apps/../../other"} {
+		if _, err := sparseCheckoutPaths([]string{p}); err == nil {
+			t.Errorf("sparseCheckoutPaths(%q) error = nil, want an error", p)
+		}
+	}
+}
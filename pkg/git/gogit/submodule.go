@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gogit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	extgogit "github.com/go-git/go-git/v5"
+	gittransport "github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+
+	"github.com/fluxcd/pkg/gitutil"
+
+	"github.com/fluxcd/source-controller/internal/transport"
+	"github.com/fluxcd/source-controller/pkg/git"
+)
+
+// submoduleDepth returns the given maximum depth of the recursion of the
+// submodules, or the default of go-git when it is zero.
+func submoduleDepth(depth int) int {
+	if depth > 0 {
+		return depth
+	}
+	return int(extgogit.DefaultSubmoduleRecursionDepth)
+}
+
+// updateSubmodules initializes and updates the submodules of the worktree
+// of the given repository, cloned from the given URL with the given auth
+// method, and recursively their submodules until the given depth. A
+// submodule is fetched with the credentials of the submodule secret of the
+// given Auth for the host of its URL, if any, or else with the auth method
+// of the repository for a submodule of the same host, and with the
+// AuthMethod of the Auth for the other hosts.
+func updateSubmodules(ctx context.Context, repo *extgogit.Repository, repoURL string, authMethod gittransport.AuthMethod,
+	auth *git.Auth, depth int) error {
+	if depth <= 0 {
+		return nil
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("git worktree error: %w", err)
+	}
+	submodules, err := w.Submodules()
+	if err != nil {
+		return fmt.Errorf("git submodules error: %w", err)
+	}
+	for _, sub := range submodules {
+		name := sub.Config().Name
+		subURL := submoduleURL(repoURL, sub.Config().URL)
+		subAuth, err := submoduleAuth(repoURL, subURL, authMethod, auth)
+		if err != nil {
+			return fmt.Errorf("git submodule '%s' auth error: %w", name, err)
+		}
+		err = sub.UpdateContext(ctx, &extgogit.SubmoduleUpdateOptions{
+			Init:              true,
+			Auth:              subAuth,
+			RecurseSubmodules: extgogit.NoRecurseSubmodules,
+		})
+		if err != nil {
+			return fmt.Errorf("git submodule '%s' update error: %w", name, gitutil.GoGitError(err))
+		}
+		subRepo, err := sub.Repository()
+		if err != nil {
+			return fmt.Errorf("git submodule '%s' error: %w", name, err)
+		}
+		if err := updateSubmodules(ctx, subRepo, subURL, subAuth, auth, depth-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submoduleURL returns the given URL of a submodule, resolved against the
+// given URL of its parent repository when it is relative to it.
+func submoduleURL(parentURL, subURL string) string {
+	if !strings.HasPrefix(subURL, "./") && !strings.HasPrefix(subURL, "../") {
+		return subURL
+	}
+	u, err := url.Parse(parentURL)
+	if err != nil || u.Scheme == "" {
+		return subURL
+	}
+	u.Path = path.Join(u.Path, subURL)
+	return u.String()
+}
+
+// submoduleAuth returns the auth method of the submodule with the given URL,
+// of the repository with the given URL and auth method.
+func submoduleAuth(repoURL, subURL string, authMethod gittransport.AuthMethod, auth *git.Auth) (gittransport.AuthMethod, error) {
+	ep, err := gittransport.NewEndpoint(subURL)
+	if err != nil {
+		return nil, err
+	}
+	if secret, ok := auth.SubmoduleSecrets[ep.Host]; ok {
+		strategy, err := AuthSecretStrategyForURL(ep.String())
+		if err != nil {
+			return nil, err
+		}
+		subAuth, err := strategy.Method(secret)
+		if err != nil {
+			return nil, err
+		}
+		return proxyAuth(ep, subAuth.AuthMethod, subAuth.CABundle, auth.Proxy), nil
+	}
+	// the auth method of the repository carries its server name, if any,
+	// which only applies to its host
+	if repoEp, err := gittransport.NewEndpoint(repoURL); err == nil && repoEp.Host == ep.Host {
+		return authMethod, nil
+	}
+	return proxyAuth(ep, auth.AuthMethod, nil, auth.Proxy), nil
+}
+
+// proxyAuth returns the given auth method of the submodule with the given
+// endpoint, as a clientAuth carrying the given CA bundle and proxy if the
+// proxy is not nil and the endpoint is an HTTP(S) endpoint.
+func proxyAuth(ep *gittransport.Endpoint, method gittransport.AuthMethod, caBundle []byte,
+	proxy transport.ProxyFunc) gittransport.AuthMethod {
+	if proxy == nil || (ep.Protocol != "http" && ep.Protocol != "https") {
+		return method
+	}
+	a := &clientAuth{caBundle: caBundle, proxy: proxy}
+	if httpAuth, ok := method.(http.AuthMethod); ok {
+		a.auth = httpAuth
+	}
+	return a
+}
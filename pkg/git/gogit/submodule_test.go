@@ -0,0 +1,178 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gogit
+
+import (
+	"context"
+	"fmt"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	extgogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	corev1 "k8s.io/api/core/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/pkg/git"
+)
+
+// newSubmoduleRepository initializes a repository with a file and the given
+// submodule, if any, at the path 'sub', and returns its path.
+func newSubmoduleRepository(t *testing.T, submoduleURL string) string {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := extgogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"file": dir}
+	if submoduleURL != "" {
+		files[".gitmodules"] = fmt.Sprintf("[submodule \"sub\"]\n\tpath = sub\n\turl = %s\n", submoduleURL)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	if submoduleURL != "" {
+		sub, err := extgogit.PlainOpen(submoduleURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := sub.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := repo.Storer.Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.Entries = append(idx.Entries, &index.Entry{Name: "sub", Hash: head.Hash(), Mode: filemode.Submodule})
+		if err := repo.Storer.SetIndex(idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = w.Commit("init", &extgogit.CommitOptions{
+		Author: &object.Signature{Name: "Flux", Email: "flux@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCheckoutBranch_CheckoutSubmoduleDepth(t *testing.T) {
+	nested := newSubmoduleRepository(t, "")
+	sub := newSubmoduleRepository(t, nested)
+	origin := newSubmoduleRepository(t, sub)
+
+	tests := []struct {
+		name       string
+		depth      int
+		wantNested bool
+	}{
+		{name: "default depth", wantNested: true},
+		{name: "depth of the submodules of the repository", depth: 1},
+		{name: "depth of the nested submodules", depth: 2, wantNested: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := CheckoutStrategyForRef(&sourcev1.GitRepositoryRef{Branch: git.DefaultBranch},
+				git.CheckoutOptions{RecurseSubmodules: true, SubmoduleDepth: tt.depth})
+			tmpDir := t.TempDir()
+			if _, _, err := strategy.Checkout(context.TODO(), tmpDir, origin, &git.Auth{}); err != nil {
+				t.Fatalf("Checkout() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(tmpDir, "sub", "file")); err != nil {
+				t.Errorf("submodule not checked out: %v", err)
+			}
+			_, err := os.Stat(filepath.Join(tmpDir, "sub", "sub", "file"))
+			if gotNested := err == nil; gotNested != tt.wantNested {
+				t.Errorf("nested submodule checked out = %v, want %v", gotNested, tt.wantNested)
+			}
+		})
+	}
+}
+
+func TestSubmoduleURL(t *testing.T) {
+	tests := []struct {
+		parentURL string
+		subURL    string
+		want      string
+	}{
+		{parentURL: "https://github.com/org/repo.git", subURL: "../other.git", want: "https://github.com/org/other.git"},
+		{parentURL: "ssh://git@github.com/org/repo", subURL: "./sub", want: "ssh://git@github.com/org/repo/sub"},
+		{parentURL: "https://github.com/org/repo.git", subURL: "https://gitlab.com/org/sub.git", want: "https://gitlab.com/org/sub.git"},
+		{parentURL: "git@github.com:org/repo.git", subURL: "../sub.git", want: "../sub.git"},
+	}
+	for _, tt := range tests {
+		if got := submoduleURL(tt.parentURL, tt.subURL); got != tt.want {
+			t.Errorf("submoduleURL(%q, %q) = %q, want %q", tt.parentURL, tt.subURL, got, tt.want)
+		}
+	}
+}
+
+func TestSubmoduleAuth(t *testing.T) {
+	repoAuth := &http.BasicAuth{Username: "github"}
+	auth := &git.Auth{
+		AuthMethod: repoAuth,
+		SubmoduleSecrets: map[string]corev1.Secret{
+			"gitlab.com": {Data: map[string][]byte{"username": []byte("gitlab"), "password": []byte("token")}},
+		},
+	}
+	// the auth method of the clone of the repository
+	cloneAuth := &clientAuth{auth: repoAuth, serverName: "git.internal.example.com"}
+	repoURL := "https://github.com/org/repo.git"
+
+	got, err := submoduleAuth(repoURL, "https://gitlab.com/org/sub.git", cloneAuth, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := got.(*http.BasicAuth); !ok || b.Username != "gitlab" {
+		t.Errorf("auth of a host with a secret = %v, want the credentials of the secret", got)
+	}
+	if got, _ := submoduleAuth(repoURL, "https://github.com/org/sub.git", cloneAuth, auth); got != cloneAuth {
+		t.Errorf("auth of the host of the repository = %v, want the auth of the clone", got)
+	}
+	if got, _ := submoduleAuth(repoURL, "https://bitbucket.org/org/sub.git", cloneAuth, auth); got != repoAuth {
+		t.Errorf("auth of another host = %v, want the auth of the repository without server name", got)
+	}
+
+	// the submodules of the other hosts are fetched through the proxy
+	auth.Proxy = func(*nethttp.Request) (*url.URL, error) { return url.Parse("http://proxy.example.com:3128") }
+	got, _ = submoduleAuth(repoURL, "https://bitbucket.org/org/sub.git", cloneAuth, auth)
+	if a, ok := got.(*clientAuth); !ok || a.auth != repoAuth || a.proxy == nil || a.serverName != "" {
+		t.Errorf("auth of another host with a proxy = %v, want the auth of the repository with the proxy", got)
+	}
+	if got, _ := submoduleAuth(repoURL, "ssh://git@bitbucket.org/org/sub.git", cloneAuth, auth); got != repoAuth {
+		t.Errorf("auth of an SSH URL with a proxy = %v, want the auth of the repository", got)
+	}
+}
@@ -17,18 +17,156 @@ limitations under the License.
 package gogit
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	nethttp "net/http"
 	"net/url"
 
+	gittransport "github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	corev1 "k8s.io/api/core/v1"
 
 	"github.com/fluxcd/pkg/ssh/knownhosts"
 
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
 	"github.com/fluxcd/source-controller/pkg/git"
 )
 
+func init() {
+	// Send the User-Agent of the controller instead of the User-Agent of
+	// go-git with the HTTP(S) requests of every clone, dialed dual-stack
+	httpClient := &clientTransport{
+		Transport: http.NewClient(&nethttp.Client{Transport: transport.WithUserAgent(transport.NewTransport(nil))}),
+	}
+	client.InstallProtocol("http", httpClient)
+	client.InstallProtocol("https", httpClient)
+}
+
+// cloneAuth returns the AuthMethod and the CA bundle with which the
+// repository with the given URL is cloned with the given Auth. If the Auth
+// has a server name or a proxy, the AuthMethod is a clientAuth carrying them
+// and the CA bundle to the clientTransport, and no CA bundle is returned, as
+// go-git does not clone with the transport of the protocol if it is given
+// one.
+func cloneAuth(rawURL string, auth *git.Auth) (gittransport.AuthMethod, []byte, error) {
+	if auth.ServerName == "" && auth.Proxy == nil {
+		return auth.AuthMethod, auth.CABundle, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse URL: %w", err)
+	}
+	switch {
+	case auth.ServerName != "" && u.Scheme != "https":
+		return nil, nil, fmt.Errorf("server name '%s' requires an HTTPS URL", auth.ServerName)
+	case u.Scheme != "http" && u.Scheme != "https":
+		return nil, nil, fmt.Errorf("proxy requires an HTTP(S) URL")
+	}
+	a := &clientAuth{serverName: auth.ServerName, caBundle: auth.CABundle, proxy: auth.Proxy}
+	if auth.AuthMethod != nil {
+		httpAuth, ok := auth.AuthMethod.(http.AuthMethod)
+		if !ok {
+			return nil, nil, fmt.Errorf("URL '%s' requires an HTTP auth method", u.Redacted())
+		}
+		a.auth = httpAuth
+	}
+	return a, nil, nil
+}
+
+// clientAuth is the http.AuthMethod of the clones of an HTTP(S) repository
+// with a client other than the client of the protocol: of which the server
+// is addressed by a name other than the host of the URL, or of which the
+// requests are sent through another proxy than the proxy of the environment,
+// with the AuthMethod of the clone, if any.
+type clientAuth struct {
+	auth       http.AuthMethod
+	serverName string
+	caBundle   []byte
+	proxy      transport.ProxyFunc
+}
+
+func (a *clientAuth) Name() string {
+	return "http-client"
+}
+
+func (a *clientAuth) String() string {
+	if a.auth != nil {
+		return fmt.Sprintf("%s - %s", a.Name(), a.auth.String())
+	}
+	return a.Name()
+}
+
+// SetAuth sets the credentials of the AuthMethod of the clone, if any.
+func (a *clientAuth) SetAuth(r *nethttp.Request) {
+	if a.auth != nil {
+		a.auth.SetAuth(r)
+	}
+}
+
+// clientTransport is the transport of the HTTP(S) protocols, which clones
+// with the client of the clientAuth for the endpoint, if the AuthMethod of
+// the clone is a clientAuth.
+type clientTransport struct {
+	gittransport.Transport
+}
+
+func (t *clientTransport) NewUploadPackSession(ep *gittransport.Endpoint,
+	auth gittransport.AuthMethod) (gittransport.UploadPackSession, error) {
+	if a, ok := auth.(*clientAuth); ok {
+		c, err := a.client(ep)
+		if err != nil {
+			return nil, err
+		}
+		return c.NewUploadPackSession(ep, a)
+	}
+	return t.Transport.NewUploadPackSession(ep, auth)
+}
+
+func (t *clientTransport) NewReceivePackSession(ep *gittransport.Endpoint,
+	auth gittransport.AuthMethod) (gittransport.ReceivePackSession, error) {
+	if a, ok := auth.(*clientAuth); ok {
+		c, err := a.client(ep)
+		if err != nil {
+			return nil, err
+		}
+		return c.NewReceivePackSession(ep, a)
+	}
+	return t.Transport.NewReceivePackSession(ep, auth)
+}
+
+// client returns the client of the given endpoint, which sends the requests
+// through the proxy, if any, of which the server is addressed by the server
+// name, if any, and verified against the CA bundle in addition to the system
+// roots.
+func (a *clientAuth) client(ep *gittransport.Endpoint) (gittransport.Transport, error) {
+	var config *tls.Config
+	if len(a.caBundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(a.caBundle) {
+			return nil, fmt.Errorf("%s does not contain any PEM encoded certificates", git.CAFile)
+		}
+		config = &tls.Config{RootCAs: pool}
+	}
+	t := transport.NewProxyTransport(config, a.proxy)
+	var rt nethttp.RoundTripper = t
+	if a.serverName != "" {
+		// the host of the requests, of which go-git omits the default port
+		u, err := url.Parse(ep.String())
+		if err != nil {
+			return nil, err
+		}
+		rt = transport.WithServerName(t, u.Host, a.serverName)
+	}
+	return http.NewClient(&nethttp.Client{Transport: transport.WithUserAgent(rt)}), nil
+}
+
 func AuthSecretStrategyForURL(URL string) (git.AuthSecretStrategy, error) {
 	u, err := url.Parse(URL)
 	if err != nil {
@@ -63,6 +201,11 @@ func (s *BasicAuth) Method(secret corev1.Secret) (*git.Auth, error) {
 	if (basicAuth.Username == "" && basicAuth.Password != "") || (basicAuth.Username != "" && basicAuth.Password == "") {
 		return nil, fmt.Errorf("invalid '%s' secret data: required fields 'username' and 'password'", secret.Name)
 	}
+	for _, field := range []string{"username", "password"} {
+		if err := secretdata.CheckCredential(secret.Name, field, secret.Data[field]); err != nil {
+			return nil, err
+		}
+	}
 	if basicAuth.Username != "" && basicAuth.Password != "" {
 		auth.AuthMethod = basicAuth
 	}
@@ -82,6 +225,9 @@ func (s *PublicKeyAuth) Method(secret corev1.Secret) (*git.Auth, error) {
 	if len(identity) == 0 || len(knownHosts) == 0 {
 		return nil, fmt.Errorf("invalid '%s' secret data: required fields 'identity' and 'known_hosts'", secret.Name)
 	}
+	if err := secretdata.CheckBOM(secret.Name, "known_hosts", knownHosts); err != nil {
+		return nil, err
+	}
 
 	user := s.user
 	if user == "" {
@@ -91,12 +237,12 @@ func (s *PublicKeyAuth) Method(secret corev1.Secret) (*git.Auth, error) {
 	password := secret.Data["password"]
 	pk, err := ssh.NewPublicKeys(user, identity, string(password))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w%s", err, secretdata.Hint("identity", identity))
 	}
 
 	callback, err := knownhosts.New(knownHosts)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w%s", err, secretdata.Hint("known_hosts", knownHosts))
 	}
 	pk.HostKeyCallback = callback
 
@@ -17,6 +17,8 @@ limitations under the License.
 package gogit
 
 import (
+	"bytes"
+	"encoding/base64"
 	"reflect"
 	"testing"
 
@@ -142,6 +144,8 @@ func TestBasicAuthStrategy_Method(t *testing.T) {
 		{"username and password", basicAuthSecretFixture, nil, &git.Auth{AuthMethod: &http.BasicAuth{Username: "git", Password: "password"}}, false},
 		{"without username", basicAuthSecretFixture, func(s *corev1.Secret) { delete(s.Data, "username") }, nil, true},
 		{"without password", basicAuthSecretFixture, func(s *corev1.Secret) { delete(s.Data, "password") }, nil, true},
+		{"username with a byte order mark", basicAuthSecretFixture, func(s *corev1.Secret) { s.Data["username"] = []byte("\xef\xbb\xbfgit") }, nil, true},
+		{"password with a CRLF line ending", basicAuthSecretFixture, func(s *corev1.Secret) { s.Data["password"] = []byte("password\r\n") }, nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -179,6 +183,24 @@ func TestPublicKeyStrategy_Method(t *testing.T) {
 		{"missing password", privateKeySecretWithPassphraseFixture, func(s *corev1.Secret) { delete(s.Data, "password") }, true},
 		{"wrong password", privateKeySecretWithPassphraseFixture, func(s *corev1.Secret) { s.Data["password"] = []byte("pass") }, true},
 		{"empty", corev1.Secret{}, nil, true},
+		{"private key with a byte order mark", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["identity"] = append([]byte("\xef\xbb\xbf"), s.Data["identity"]...)
+		}, true},
+		{"private key with CRLF line endings", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["identity"] = bytes.ReplaceAll(s.Data["identity"], []byte("\n"), []byte("\r\n"))
+		}, false},
+		{"private key base64 encoded twice", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["identity"] = []byte(base64.StdEncoding.EncodeToString(s.Data["identity"]))
+		}, true},
+		{"known_hosts with a byte order mark", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["known_hosts"] = append([]byte("\xef\xbb\xbf"), s.Data["known_hosts"]...)
+		}, true},
+		{"known_hosts with CRLF line endings", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["known_hosts"] = append(s.Data["known_hosts"], "\r\n"...)
+		}, false},
+		{"known_hosts base64 encoded twice", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["known_hosts"] = []byte(base64.StdEncoding.EncodeToString(s.Data["known_hosts"]))
+		}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -58,6 +58,9 @@ type CheckoutBranch struct {
 }
 
 func (c *CheckoutBranch) Checkout(ctx context.Context, path, url string, auth *git.Auth) (git.Commit, string, error) {
+	if err := checkServerName(auth); err != nil {
+		return nil, "", err
+	}
 	repo, err := git2go.Clone(url, path, &git2go.CloneOptions{
 		FetchOptions: &git2go.FetchOptions{
 			DownloadTags: git2go.DownloadTagsNone,
@@ -87,6 +90,9 @@ type CheckoutTag struct {
 }
 
 func (c *CheckoutTag) Checkout(ctx context.Context, path, url string, auth *git.Auth) (git.Commit, string, error) {
+	if err := checkServerName(auth); err != nil {
+		return nil, "", err
+	}
 	repo, err := git2go.Clone(url, path, &git2go.CloneOptions{
 		FetchOptions: &git2go.FetchOptions{
 			DownloadTags: git2go.DownloadTagsAll,
@@ -131,6 +137,9 @@ type CheckoutCommit struct {
 }
 
 func (c *CheckoutCommit) Checkout(ctx context.Context, path, url string, auth *git.Auth) (git.Commit, string, error) {
+	if err := checkServerName(auth); err != nil {
+		return nil, "", err
+	}
 	repo, err := git2go.Clone(url, path, &git2go.CloneOptions{
 		FetchOptions: &git2go.FetchOptions{
 			DownloadTags: git2go.DownloadTagsNone,
@@ -171,6 +180,9 @@ type CheckoutSemVer struct {
 }
 
 func (c *CheckoutSemVer) Checkout(ctx context.Context, path, url string, auth *git.Auth) (git.Commit, string, error) {
+	if err := checkServerName(auth); err != nil {
+		return nil, "", err
+	}
 	verConstraint, err := semver.NewConstraint(c.semVer)
 	if err != nil {
 		return nil, "", fmt.Errorf("semver parse range error: %w", err)
@@ -270,3 +282,12 @@ func (c *CheckoutSemVer) Checkout(ctx context.Context, path, url string, auth *g
 
 	return &Commit{commit}, fmt.Sprintf("%s/%s", t, commit.Id().String()), nil
 }
+
+// checkServerName returns an error if the given Auth has a server name, as
+// libgit2 sends the host of the URL as TLS server name and Host header.
+func checkServerName(auth *git.Auth) error {
+	if auth.ServerName != "" {
+		return fmt.Errorf("server name '%s' is not supported by the libgit2 Git implementation", auth.ServerName)
+	}
+	return nil
+}
@@ -63,3 +63,9 @@ func (c *Commit) Verify(secret corev1.Secret) error {
 
 	return nil
 }
+
+// VerifyTag returns an error, as the signatures of annotated tags can't be
+// extracted with libgit2
+func (c *Commit) VerifyTag(secret corev1.Secret) error {
+	return fmt.Errorf("PGP signature verification of tags is not supported by libgit2")
+}
@@ -19,8 +19,6 @@ package libgit2
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
-	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/x509"
 	"fmt"
@@ -34,6 +32,8 @@ import (
 	"golang.org/x/crypto/ssh/knownhosts"
 	corev1 "k8s.io/api/core/v1"
 
+	"github.com/fluxcd/source-controller/internal/fips"
+	"github.com/fluxcd/source-controller/internal/secretdata"
 	"github.com/fluxcd/source-controller/pkg/git"
 )
 
@@ -65,6 +65,11 @@ func (s *BasicAuth) Method(secret corev1.Secret) (*git.Auth, error) {
 	if d, ok := secret.Data["password"]; ok {
 		password = string(d)
 	}
+	for _, field := range []string{"username", "password"} {
+		if err := secretdata.CheckCredential(secret.Name, field, secret.Data[field]); err != nil {
+			return nil, err
+		}
+	}
 	if username != "" && password != "" {
 		credCallback = func(url string, usernameFromURL string, allowedTypes git2go.CredType) (*git2go.Cred, error) {
 			cred, err := git2go.NewCredUserpassPlaintext(username, password)
@@ -113,10 +118,13 @@ func (s *PublicKeyAuth) Method(secret corev1.Secret) (*git.Auth, error) {
 	if len(identity) == 0 || len(knownHosts) == 0 {
 		return nil, fmt.Errorf("invalid '%s' secret data: required fields 'identity' and 'known_hosts'", secret.Name)
 	}
+	if err := secretdata.CheckBOM(secret.Name, "known_hosts", knownHosts); err != nil {
+		return nil, err
+	}
 
 	kk, err := parseKnownHosts(string(knownHosts))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w%s", err, secretdata.Hint("known_hosts", knownHosts))
 	}
 
 	// Need to validate private key as it is not
@@ -129,7 +137,7 @@ func (s *PublicKeyAuth) Method(secret corev1.Secret) (*git.Auth, error) {
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w%s", err, secretdata.Hint("identity", identity))
 	}
 
 	user := s.user
@@ -211,19 +219,25 @@ func (k knownKey) matches(host string, hostkey git2go.HostkeyCertificate) bool {
 
 	var fingerprint []byte
 	var hasher hash.Hash
+	var err error
 	switch {
 	case hostkey.Kind&git2go.HostkeySHA256 > 0:
 		fingerprint = hostkey.HashSHA256[:]
 		hasher = sha256.New()
 	case hostkey.Kind&git2go.HostkeySHA1 > 0:
+		// the SHA1 and MD5 fingerprints are only given by the versions of
+		// libssh2 without SHA256, and are not trusted in FIPS mode
 		fingerprint = hostkey.HashSHA1[:]
-		hasher = sha1.New()
+		hasher, err = fips.Legacy(fips.SHA1, "SSH host key fingerprint")
 	case hostkey.Kind&git2go.HostkeyMD5 > 0:
 		fingerprint = hostkey.HashMD5[:]
-		hasher = md5.New()
+		hasher, err = fips.Legacy(fips.MD5, "SSH host key fingerprint")
 	default:
 		return false
 	}
+	if err != nil {
+		return false
+	}
 	hasher.Write(k.key.Marshal())
 	return bytes.Compare(hasher.Sum(nil), fingerprint) == 0
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package libgit2
 
 import (
+	"bytes"
 	"encoding/base64"
 	"reflect"
 	"testing"
@@ -24,6 +25,7 @@ import (
 	git2go "github.com/libgit2/git2go/v31"
 	corev1 "k8s.io/api/core/v1"
 
+	"github.com/fluxcd/source-controller/internal/fips"
 	"github.com/fluxcd/source-controller/pkg/git"
 )
 
@@ -123,6 +125,8 @@ func TestBasicAuthStrategy_Method(t *testing.T) {
 		wantErr bool
 	}{
 		{"with username and password", basicAuthSecretFixture, nil, false},
+		{"username with a byte order mark", basicAuthSecretFixture, func(s *corev1.Secret) { s.Data["username"] = []byte("\xef\xbb\xbfgit") }, true},
+		{"password with a CRLF line ending", basicAuthSecretFixture, func(s *corev1.Secret) { s.Data["password"] = []byte("password\r\n") }, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -156,6 +160,21 @@ func TestPublicKeyStrategy_Method(t *testing.T) {
 		{"missing password", privateKeySecretWithPassphraseFixture, func(s *corev1.Secret) { delete(s.Data, "password") }, true},
 		{"invalid password", privateKeySecretWithPassphraseFixture, func(s *corev1.Secret) { s.Data["password"] = []byte("foo") }, true},
 		{"empty", corev1.Secret{}, nil, true},
+		{"private key with a byte order mark", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["identity"] = append([]byte("\xef\xbb\xbf"), s.Data["identity"]...)
+		}, true},
+		{"private key with CRLF line endings", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["identity"] = bytes.ReplaceAll(s.Data["identity"], []byte("\n"), []byte("\r\n"))
+		}, false},
+		{"private key base64 encoded twice", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["identity"] = []byte(base64.StdEncoding.EncodeToString(s.Data["identity"]))
+		}, true},
+		{"known_hosts with a byte order mark", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["known_hosts"] = append([]byte("\xef\xbb\xbf"), s.Data["known_hosts"]...)
+		}, true},
+		{"known_hosts base64 encoded twice", privateKeySecretFixture, func(s *corev1.Secret) {
+			s.Data["known_hosts"] = []byte(base64.StdEncoding.EncodeToString(s.Data["known_hosts"]))
+		}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -195,9 +214,11 @@ func TestKnownKeyHash(t *testing.T) {
 				return
 			}
 
+			// the SHA1 and MD5 fingerprints are not trusted in FIPS mode
+			wantMatches := tt.wantMatches && (tt.hostkey.Kind&git2go.HostkeySHA256 > 0 || !fips.Enabled())
 			matches := knownKeys[0].matches("github.com", tt.hostkey)
-			if matches != tt.wantMatches {
-				t.Errorf("Method() matches = %v, wantMatches %v", matches, tt.wantMatches)
+			if matches != wantMatches {
+				t.Errorf("Method() matches = %v, wantMatches %v", matches, wantMatches)
 				return
 			}
 		})
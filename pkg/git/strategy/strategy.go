@@ -18,6 +18,7 @@ package strategy
 
 import (
 	"fmt"
+	"net/url"
 
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
 	"github.com/fluxcd/source-controller/pkg/git"
@@ -30,6 +31,9 @@ func CheckoutStrategyForRef(ref *sourcev1.GitRepositoryRef, opt git.CheckoutOpti
 	case sourcev1.GoGitImplementation:
 		return gogit.CheckoutStrategyForRef(ref, opt), nil
 	case sourcev1.LibGit2Implementation:
+		if len(opt.SparseCheckout) > 0 {
+			return nil, fmt.Errorf("sparse checkout is not supported by the %s Git implementation", opt.GitImplementation)
+		}
 		return libgit2.CheckoutStrategyForRef(ref, opt), nil
 	default:
 		return nil, fmt.Errorf("invalid Git implementation %s", opt.GitImplementation)
@@ -46,3 +50,26 @@ func AuthSecretStrategyForURL(url string, opt git.CheckoutOptions) (git.AuthSecr
 		return nil, fmt.Errorf("invalid Git implementation %s", opt.GitImplementation)
 	}
 }
+
+// TransportForURL returns the v1beta1.GitRepositoryTransport describing the
+// Git implementation and transport scheme used to communicate with the given
+// URL, and the wire protocol version implemented by the Git implementation.
+func TransportForURL(URL string, opt git.CheckoutOptions) (*sourcev1.GitRepositoryTransport, error) {
+	transport := &sourcev1.GitRepositoryTransport{
+		Implementation: opt.GitImplementation,
+	}
+	switch opt.GitImplementation {
+	case sourcev1.GoGitImplementation:
+		transport.ImplementationProtocolVersion = gogit.ProtocolVersion
+	case sourcev1.LibGit2Implementation:
+		transport.ImplementationProtocolVersion = git.ProtocolV0
+	default:
+		return nil, fmt.Errorf("invalid Git implementation %s", opt.GitImplementation)
+	}
+	u, err := url.Parse(URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL to determine transport: %w", err)
+	}
+	transport.Scheme = u.Scheme
+	return transport, nil
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minio
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+// credentialSource is a credentials.Provider with a descriptive name.
+type credentialSource struct {
+	name string
+	credentials.Provider
+}
+
+// credentialChain is a credentials.Provider which retrieves the credentials
+// from the first of its sources that returns a value, and records the name
+// of that source.
+type credentialChain struct {
+	sources []credentialSource
+
+	mu      sync.Mutex
+	current *credentialSource
+}
+
+// newAWSCredentialChain returns a credentialChain with the sources of the
+// standard AWS credential chain: the environment, the shared credentials
+// file, and the IAM role of the web identity (IRSA), ECS task or EC2
+// instance.
+func newAWSCredentialChain() *credentialChain {
+	roundTripper := transport.WithUserAgent(transport.NewControllerTransport())
+	role := credentialSource{name: iamSourceName(), Provider: &credentials.IAM{
+		Client: &http.Client{Transport: roundTripper},
+	}}
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		role = credentialSource{name: "web identity", Provider: newWebIdentityFileProvider(
+			awsSTSEndpoint(awsRegion()), os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_ROLE_SESSION_NAME"), tokenFile, roundTripper)}
+	}
+	return &credentialChain{
+		sources: []credentialSource{
+			{name: "environment", Provider: &credentials.EnvAWS{}},
+			{name: "shared credentials file", Provider: &credentials.FileAWSCredentials{}},
+			role,
+		},
+	}
+}
+
+// iamSourceName returns the name of the IAM role source credentials.IAM
+// retrieves the credentials from, based on the environment.
+func iamSourceName() string {
+	switch {
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "",
+		os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		return "ECS task role"
+	default:
+		return "EC2 instance profile"
+	}
+}
+
+// awsSTSEndpoint returns the regional endpoint of the AWS Security Token
+// Service for the given region, or the global endpoint if the region is
+// empty.
+func awsSTSEndpoint(region string) string {
+	switch {
+	case region == "":
+		return "https://sts.amazonaws.com"
+	case strings.HasPrefix(region, "cn-"):
+		return "https://sts." + region + ".amazonaws.com.cn"
+	default:
+		return "https://sts." + region + ".amazonaws.com"
+	}
+}
+
+// Retrieve returns the credentials of the first source that returns a
+// value. Sources are retrieved again on every call, so that a source which
+// failed before is reconsidered after a refresh.
+func (c *credentialChain) Retrieve() (credentials.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current = nil
+	var errs []string
+	for i := range c.sources {
+		source := &c.sources[i]
+		v, err := source.Retrieve()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", source.name, err.Error()))
+			continue
+		}
+		if v.AccessKeyID == "" || v.SecretAccessKey == "" {
+			continue
+		}
+		c.current = source
+		return v, nil
+	}
+	if len(errs) > 0 {
+		return credentials.Value{}, fmt.Errorf("no valid credentials found in the AWS credential chain: %s", strings.Join(errs, ", "))
+	}
+	return credentials.Value{}, fmt.Errorf("no valid credentials found in the AWS credential chain")
+}
+
+// IsExpired returns if the credentials of the current source are expired,
+// or no source returned a value.
+func (c *credentialChain) IsExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current == nil || c.current.IsExpired()
+}
+
+// Name returns the name of the source of the current credentials, or an
+// empty string if no credentials have been retrieved.
+func (c *credentialChain) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil {
+		return ""
+	}
+	return c.current.name
+}
+
+// webIdentityProvider is a credentials.Provider which exchanges a web
+// identity token for temporary credentials using the
+// AssumeRoleWithWebIdentity action of a Security Token Service.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client      *http.Client
+	endpoint    string
+	roleARN     string
+	sessionName string
+	// token returns the web identity token, which is read again on every
+	// retrieval for tokens that are rotated.
+	token func() (string, error)
+}
+
+func newWebIdentityProvider(endpoint, roleARN, token string, transport http.RoundTripper) *webIdentityProvider {
+	return &webIdentityProvider{
+		client:   &http.Client{Transport: transport},
+		endpoint: endpoint,
+		roleARN:  roleARN,
+		token: func() (string, error) {
+			return token, nil
+		},
+	}
+}
+
+// newWebIdentityFileProvider returns a webIdentityProvider for the web
+// identity token in the file at the given path, e.g. the projected service
+// account token of IRSA, which is rotated by the kubelet.
+func newWebIdentityFileProvider(endpoint, roleARN, sessionName, path string, transport http.RoundTripper) *webIdentityProvider {
+	return &webIdentityProvider{
+		client:      &http.Client{Transport: transport},
+		endpoint:    endpoint,
+		roleARN:     roleARN,
+		sessionName: sessionName,
+		token: func() (string, error) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("failed to read web identity token: %w", err)
+			}
+			return string(b), nil
+		},
+	}
+}
+
+// Retrieve requests temporary credentials from the Security Token Service.
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	if _, err := url.Parse(p.endpoint); err != nil {
+		return credentials.Value{}, fmt.Errorf("invalid STS endpoint '%s': %w", p.endpoint, err)
+	}
+	token, err := p.token()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	// The parameters are sent in the body, as the URL of a request is
+	// included in the errors of the transport, which end up in the
+	// conditions and events of the Bucket
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", credentials.STSVersion)
+	form.Set("WebIdentityToken", strings.TrimSpace(token))
+	if p.roleARN != "" {
+		sessionName := p.sessionName
+		if sessionName == "" {
+			sessionName = fmt.Sprintf("source-controller-%d", time.Now().Unix())
+		}
+		form.Set("RoleArn", p.roleARN)
+		form.Set("RoleSessionName", sessionName)
+	}
+
+	resp, err := p.client.PostForm(p.endpoint, form)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var stsErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&stsErr); err == nil && stsErr.Code != "" {
+			return credentials.Value{}, fmt.Errorf("STS AssumeRoleWithWebIdentity failed: %s: %s", stsErr.Code, stsErr.Message)
+		}
+		return credentials.Value{}, fmt.Errorf("STS AssumeRoleWithWebIdentity failed: %s", resp.Status)
+	}
+
+	var result credentials.AssumeRoleWithWebIdentityResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to decode STS response: %w", err)
+	}
+	creds := result.Result.Credentials
+	p.SetExpiration(creds.Expiration, credentials.DefaultExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKey,
+		SecretAccessKey: creds.SecretKey,
+		SessionToken:    creds.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
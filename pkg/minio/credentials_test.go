@@ -0,0 +1,202 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minio
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type fakeProvider struct {
+	value   credentials.Value
+	err     error
+	expired bool
+}
+
+func (p *fakeProvider) Retrieve() (credentials.Value, error) {
+	return p.value, p.err
+}
+
+func (p *fakeProvider) IsExpired() bool {
+	return p.expired
+}
+
+func TestCredentialChain(t *testing.T) {
+	env := &fakeProvider{}
+	file := &fakeProvider{err: errors.New("file not found")}
+	iam := &fakeProvider{value: credentials.Value{AccessKeyID: "id", SecretAccessKey: "secret", SessionToken: "token"}}
+	chain := &credentialChain{
+		sources: []credentialSource{
+			{name: "environment", Provider: env},
+			{name: "shared credentials file", Provider: file},
+			{name: "web identity", Provider: iam},
+		},
+	}
+	creds := credentials.New(chain)
+
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.SessionToken != "token" {
+		t.Errorf("Get() got = %v, want credentials of the IAM source", v)
+	}
+	if name := chain.Name(); name != "web identity" {
+		t.Errorf("Name() got = %q, want %q", name, "web identity")
+	}
+
+	// An expired token is retrieved again, and sources earlier in the
+	// chain are reconsidered.
+	iam.expired = true
+	env.value = credentials.Value{AccessKeyID: "env-id", SecretAccessKey: "env-secret"}
+	if v, err = creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "env-id" {
+		t.Errorf("Get() got = %v, want credentials of the environment source", v)
+	}
+	if name := chain.Name(); name != "environment" {
+		t.Errorf("Name() got = %q, want %q", name, "environment")
+	}
+
+	// A failed retrieval is not cached.
+	env.value = credentials.Value{}
+	iam.err = errors.New("token expired")
+	creds.Expire()
+	if _, err = creds.Get(); err == nil || !strings.Contains(err.Error(), "token expired") {
+		t.Errorf("Get() expected error, got %v", err)
+	}
+	if name := chain.Name(); name != "" {
+		t.Errorf("Name() got = %q, want empty", name)
+	}
+	iam.err = nil
+	if _, err = creds.Get(); err != nil {
+		t.Errorf("Get() after recovery returned error: %v", err)
+	}
+}
+
+func TestAWSSTSEndpoint(t *testing.T) {
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{region: "", want: "https://sts.amazonaws.com"},
+		{region: "eu-west-1", want: "https://sts.eu-west-1.amazonaws.com"},
+		{region: "cn-north-1", want: "https://sts.cn-north-1.amazonaws.com.cn"},
+	}
+	for _, tt := range tests {
+		if got := awsSTSEndpoint(tt.region); got != tt.want {
+			t.Errorf("awsSTSEndpoint(%q) = %q, want %q", tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestWebIdentityFileProvider(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("jwt-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		q := r.PostForm
+		if q.Get("RoleArn") != "arn:role" || q.Get("RoleSessionName") != "flux" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		// The projected token of the controller is not in the URL, which
+		// is included in the errors of the transport
+		if strings.Contains(r.URL.String(), "jwt") {
+			t.Errorf("request URL %s contains the web identity token", r.URL)
+		}
+		tokens = append(tokens, q.Get("WebIdentityToken"))
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>access</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, expiration)
+	}))
+	defer server.Close()
+
+	creds := credentials.New(newWebIdentityFileProvider(server.URL, "arn:role", "flux", tokenFile, http.DefaultTransport))
+	if _, err := creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated token is used for the next session
+	if err := os.WriteFile(tokenFile, []byte("jwt-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	creds.Expire()
+	if _, err := creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"jwt-1", "jwt-2"}; strings.Join(tokens, ",") != strings.Join(want, ",") {
+		t.Errorf("tokens got = %v, want %v", tokens, want)
+	}
+
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	creds.Expire()
+	if _, err := creds.Get(); err == nil || !strings.Contains(err.Error(), "failed to read web identity token") {
+		t.Errorf("Get() without token file error = %v", err)
+	}
+}
+
+func TestNewAWSCredentialChain_webIdentity(t *testing.T) {
+	for _, env := range []string{"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if v, ok := os.LookupEnv(env); ok {
+			defer os.Setenv(env, v)
+		} else {
+			defer os.Unsetenv(env)
+		}
+		os.Unsetenv(env)
+	}
+
+	chain := newAWSCredentialChain()
+	if _, ok := chain.sources[2].Provider.(*credentials.IAM); !ok {
+		t.Errorf("role source = %T, want the IAM provider", chain.sources[2].Provider)
+	}
+
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token")
+	os.Setenv("AWS_DEFAULT_REGION", "eu-central-1")
+	chain = newAWSCredentialChain()
+	p, ok := chain.sources[2].Provider.(*webIdentityProvider)
+	if !ok || chain.sources[2].name != "web identity" {
+		t.Fatalf("role source = %s (%T), want the web identity provider", chain.sources[2].name, chain.sources[2].Provider)
+	}
+	if p.endpoint != "https://sts.eu-central-1.amazonaws.com" {
+		t.Errorf("endpoint = %q, want the regional STS endpoint", p.endpoint)
+	}
+}
@@ -0,0 +1,514 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minio
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	corev1 "k8s.io/api/core/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+// MinioClient is a minimal Minio client for fetching files from S3 compatible
+// storage APIs.
+type MinioClient struct {
+	*minio.Client
+	creds  *credentials.Credentials
+	source func() string
+	listV1 bool
+	sse    *serverSideEncryption
+
+	// backoff is the policy for retrying transient errors, and retries the
+	// number of retries made.
+	backoff backoff
+	retries int64
+
+	// endpoint and opts are used to recreate the client for another region.
+	endpoint string
+	// specRegion is the region configured in the spec, which is never
+	// overridden by the region reported by the service.
+	specRegion string
+
+	// mu guards the client, which is recreated for another region while
+	// objects are downloaded concurrently, and the fields of the region.
+	mu   sync.RWMutex
+	opts minio.Options
+	// region is the effective region of the bucket.
+	region string
+	// regionWarning reports the region of the bucket when it mismatches
+	// the region configured in the spec.
+	regionWarning string
+}
+
+// NewClient creates a new Minio storage client for the given v1beta1.Bucket.
+// The credentials are loaded from the 'accesskey', 'secretkey' and optional
+// 'sessionToken' fields of the given Secret, or retrieved from the standard
+// AWS credential chain when the provider is 'aws' and no Secret with these
+// fields is given, e.g. for a Secret with only a CA certificate.
+// When the v1beta1.Bucket has an STS configuration, temporary credentials are
+// obtained from the STS endpoint by exchanging the web identity token in the
+// 'token' field of the given tokenSecret, or the credentials of the Secret.
+// The certificate of the endpoint, and of the STS endpoint, is verified
+// against the CA certificates in the 'caFile' or 'ca.crt' field of the
+// Secret in addition to the system roots. Objects are read with the SSE-C
+// key in the 'sseCustomerKey' field, and the SSE-KMS key ID and encryption
+// context in the 'sseKmsKeyId' and 'sseKmsContext' fields of the Secret.
+//
+// The requests, also to the STS endpoint, are sent through the proxy of the
+// given ProxyFunc instead of the proxy of the environment, if not nil.
+//
+// When the bucket is located in another region than the default region, the
+// client switches to the region reported by the service. A region configured
+// in the spec is never overridden.
+func NewClient(bucket sourcev1.Bucket, secret, tokenSecret *corev1.Secret, proxy transport.ProxyFunc) (*MinioClient, error) {
+	endpoint, secure := parseEndpoint(bucket)
+	httpTransport, err := newTransport(secret, secure, bucket.Spec.Insecure, proxy)
+	if err != nil {
+		return nil, err
+	}
+	roundTripper := transport.WithUserAgent(httpTransport)
+	opt := minio.Options{
+		Region:    bucket.Spec.Region,
+		Secure:    secure,
+		Transport: roundTripper,
+	}
+	sse, err := sseFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if sse != nil && sse.customerKey != nil && !secure {
+		return nil, fmt.Errorf("customer provided encryption keys (SSE-C) require an 'https://' endpoint")
+	}
+	source := func() string { return "" }
+
+	if sts := bucket.Spec.STS; sts != nil {
+		if sts.WebIdentityTokenSecretRef != nil {
+			if tokenSecret == nil {
+				return nil, fmt.Errorf("web identity token secret '%s' not found", sts.WebIdentityTokenSecretRef.Name)
+			}
+			token, ok := tokenSecret.Data["token"]
+			if !ok || len(token) == 0 {
+				return nil, fmt.Errorf("invalid '%s' secret data: required field 'token'", tokenSecret.Name)
+			}
+			opt.Creds = credentials.New(newWebIdentityProvider(sts.Endpoint, sts.RoleARN, string(token), roundTripper))
+			source = func() string { return "STS web identity" }
+		} else {
+			if secret == nil {
+				return nil, fmt.Errorf("STS AssumeRole requires a secret with 'accesskey' and 'secretkey' fields")
+			}
+			accesskey, secretkey, _, err := staticCredentials(secret)
+			if err != nil {
+				return nil, err
+			}
+			opt.Creds = credentials.New(&credentials.STSAssumeRole{
+				Client:      &http.Client{Transport: roundTripper},
+				STSEndpoint: sts.Endpoint,
+				Options: credentials.STSAssumeRoleOptions{
+					AccessKey: accesskey,
+					SecretKey: secretkey,
+					RoleARN:   sts.RoleARN,
+					Location:  opt.Region,
+				},
+			})
+			source = func() string { return "STS AssumeRole" }
+		}
+	} else if secret != nil && (bucket.Spec.Provider != sourcev1.AmazonBucketProvider || hasStaticCredentials(secret)) {
+		accesskey, secretkey, sessionToken, err := staticCredentials(secret)
+		if err != nil {
+			return nil, err
+		}
+		opt.Creds = credentials.NewStaticV4(accesskey, secretkey, sessionToken)
+		source = func() string { return "secret" }
+	} else if bucket.Spec.Provider == sourcev1.AmazonBucketProvider {
+		chain := newAWSCredentialChain()
+		opt.Creds = credentials.New(chain)
+		source = chain.Name
+		if opt.Region == "" {
+			opt.Region = awsRegion()
+		}
+	}
+
+	if opt.Creds == nil {
+		return nil, fmt.Errorf("no bucket credentials found")
+	}
+
+	client, err := minio.New(endpoint, &opt)
+	if err != nil {
+		return nil, err
+	}
+	return &MinioClient{
+		Client:     client,
+		creds:      opt.Creds,
+		source:     source,
+		listV1:     s3utils.IsGoogleEndpoint(*client.EndpointURL()),
+		sse:        sse,
+		backoff:    defaultBackoff,
+		endpoint:   endpoint,
+		opts:       opt,
+		specRegion: bucket.Spec.Region,
+		region:     opt.Region,
+	}, nil
+}
+
+// parseEndpoint returns the endpoint address of the given v1beta1.Bucket
+// without a scheme, and if the endpoint uses TLS. An 'http://' or 'https://'
+// scheme in the endpoint takes precedence over spec.insecure, which allows
+// the verification of the certificate of an 'https://' endpoint to be
+// skipped.
+func parseEndpoint(bucket sourcev1.Bucket) (string, bool) {
+	endpoint := bucket.Spec.Endpoint
+	switch {
+	case strings.HasPrefix(endpoint, "https://"):
+		return strings.TrimSuffix(strings.TrimPrefix(endpoint, "https://"), "/"), true
+	case strings.HasPrefix(endpoint, "http://"):
+		return strings.TrimSuffix(strings.TrimPrefix(endpoint, "http://"), "/"), false
+	default:
+		return endpoint, !bucket.Spec.Insecure
+	}
+}
+
+// newTransport returns the minio.DefaultTransport with the dialer and egress
+// policy of the controller, verifying the certificates of TLS endpoints
+// against the CA certificates of the given Secret, or not at all if insecure
+// is true, and sending the requests through the proxy of the given ProxyFunc,
+// if not nil.
+func newTransport(secret *corev1.Secret, secure, insecure bool, proxy transport.ProxyFunc) (*http.Transport, error) {
+	httpTransport, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		httpTransport.Proxy = proxy
+	}
+	httpTransport = transport.WithEgressPolicy(httpTransport)
+	if !secure {
+		return httpTransport, nil
+	}
+	tlsConfig, err := transport.TLSConfigFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		tlsConfig.MinVersion = tls.VersionTLS12
+		httpTransport.TLSClientConfig = tlsConfig
+	}
+	httpTransport.TLSClientConfig.InsecureSkipVerify = insecure
+	return httpTransport, nil
+}
+
+// hasStaticCredentials returns if the given Secret has an 'accesskey' or
+// 'secretkey' field.
+func hasStaticCredentials(secret *corev1.Secret) bool {
+	_, accesskey := secret.Data["accesskey"]
+	_, secretkey := secret.Data["secretkey"]
+	return accesskey || secretkey
+}
+
+// staticCredentials returns the 'accesskey', 'secretkey' and optional
+// 'sessionToken' fields of the given Secret.
+func staticCredentials(secret *corev1.Secret) (accesskey, secretkey, sessionToken string, err error) {
+	if k, ok := secret.Data["accesskey"]; ok {
+		accesskey = string(k)
+	}
+	if k, ok := secret.Data["secretkey"]; ok {
+		secretkey = string(k)
+	}
+	if k, ok := secret.Data["sessionToken"]; ok {
+		sessionToken = string(k)
+	}
+	if accesskey == "" || secretkey == "" {
+		return "", "", "", fmt.Errorf("invalid '%s' secret data: required fields 'accesskey' and 'secretkey'", secret.Name)
+	}
+	return accesskey, secretkey, sessionToken, nil
+}
+
+// awsRegion returns the region configured in the environment, or an empty
+// string to let the client look up the region of the bucket.
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// CredentialSource returns the name of the source of the credentials used by
+// the client.
+func (c *MinioClient) CredentialSource() string {
+	return c.source()
+}
+
+// Region returns the effective region of the bucket, or an empty string if
+// it is not known yet.
+func (c *MinioClient) Region() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.region
+}
+
+// RegionWarning returns a warning when the service reported that the bucket
+// is located in another region than the region configured in the spec, which
+// is used nonetheless, or an empty string.
+func (c *MinioClient) RegionWarning() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.regionWarning
+}
+
+// client returns the client of the current region of the bucket.
+func (c *MinioClient) client() *minio.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Client
+}
+
+// BucketExists returns if the bucket with the given name exists.
+func (c *MinioClient) BucketExists(ctx context.Context, bucketName string) (exists bool, err error) {
+	err = c.retry(ctx, "bucket lookup", func() error {
+		exists, err = c.client().BucketExists(ctx, bucketName)
+		return err
+	})
+	if err == nil && c.Region() == "" {
+		// Without a region, the client looked up (and cached) the location
+		// of the bucket before the request.
+		if location, err := c.client().GetBucketLocation(ctx, bucketName); err == nil {
+			c.mu.Lock()
+			if c.region == "" {
+				c.region = location
+			}
+			c.mu.Unlock()
+		}
+	}
+	return exists, err
+}
+
+// FGetObject downloads the object with the given name from the bucket to the
+// given local path, with the server-side encryption settings of the client,
+// and returns the content type of the object.
+func (c *MinioClient) FGetObject(ctx context.Context, bucketName, objectName, localPath string) (string, error) {
+	opts := c.sse.getObjectOptions()
+	var contentType string
+	err := c.retry(ctx, "download", func() (err error) {
+		contentType, err = c.getObject(ctx, bucketName, objectName, localPath, opts)
+		return err
+	})
+	return contentType, c.sse.objectError(err)
+}
+
+// getObject downloads the object with the given name from the bucket to the
+// given local path with a single GET request, and returns its content type.
+func (c *MinioClient) getObject(ctx context.Context, bucketName, objectName, localPath string, opts minio.GetObjectOptions) (string, error) {
+	object, err := c.client().GetObject(ctx, bucketName, objectName, opts)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return "", err
+	}
+	// The GET request is sent on the first Read, and its response has the
+	// info of the object: a first Stat would send a HEAD request, of which
+	// the errors have no body and thus no S3 error code.
+	if _, err := io.Copy(f, object); err != nil {
+		f.Close()
+		return "", err
+	}
+	info, err := object.Stat()
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	return info.ContentType, f.Close()
+}
+
+// VisitObjects recursively lists all objects in the bucket with a key starting
+// with the given prefix, following the continuation tokens (or markers for
+// the V1 API) of every page, and calls visit with the key, ETag, size and
+// last modification time of every object. Listing stops at the first error returned by visit, or by a
+// page request. When the listing is retried, e.g. after a transient error or
+// when the credentials expired, the objects that have already been visited
+// are skipped.
+func (c *MinioClient) VisitObjects(ctx context.Context, bucketName, prefix string, visit func(key, etag string, size int64, lastModified time.Time) error) error {
+	var lastVisited string
+	return c.retry(ctx, "listing", func() error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var lastKey string
+		for object := range c.client().ListObjects(ctx, bucketName, minio.ListObjectsOptions{
+			Prefix:    prefix,
+			Recursive: true,
+			UseV1:     c.listV1,
+		}) {
+			if object.Err != nil {
+				return object.Err
+			}
+			// Objects are listed in ascending key order, a key that does not
+			// sort after the previous one means a page did not continue
+			// where the previous page ended.
+			if lastKey != "" && object.Key <= lastKey {
+				return fmt.Errorf("%w: object '%s' listed after '%s'", errListingNotAdvancing, object.Key, lastKey)
+			}
+			lastKey = object.Key
+			if lastVisited != "" && object.Key <= lastVisited {
+				continue
+			}
+			lastVisited = object.Key
+			if err := visit(object.Key, object.ETag, object.Size, object.LastModified); err != nil {
+				return err
+			}
+		}
+		// The listing ends without an error when the context is done,
+		// which must not be mistaken for a complete listing.
+		return ctx.Err()
+	})
+}
+
+// errListingNotAdvancing is returned when the pages of a listing do not
+// follow each other, e.g. because a continuation token was not accepted.
+var errListingNotAdvancing = errors.New("listing did not advance")
+
+// retry calls fn, and retries it when it fails with a transient error, an
+// expired token or because the request was sent to the wrong region.
+func (c *MinioClient) retry(ctx context.Context, operation string, fn func() error) error {
+	return c.retryTransient(ctx, operation, func() error {
+		return c.retryOnTokenError(func() error {
+			return c.retryOnRegionError(fn)
+		})
+	})
+}
+
+// retryOnRegionError calls fn, and when it fails because the bucket is
+// located in another region than the region of the client, switches the
+// client to the region reported by the service and calls fn once more. When
+// the region is configured in the spec, the client is not switched, and the
+// mismatch is reported by RegionWarning instead.
+func (c *MinioClient) retryOnRegionError(fn func() error) error {
+	before := c.Region()
+	err := fn()
+	region := regionFromError(err)
+	if region == "" || region == before {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.specRegion != "" {
+		c.regionWarning = fmt.Sprintf("bucket is located in region '%s' instead of the configured region '%s'", region, c.specRegion)
+		c.mu.Unlock()
+		return err
+	}
+	// The client may have been switched by a concurrent request already
+	if region != c.region {
+		if switchErr := c.setRegion(region); switchErr != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	c.mu.Unlock()
+	return fn()
+}
+
+// setRegion recreates the client for the given region, it must be called
+// with the lock held.
+func (c *MinioClient) setRegion(region string) error {
+	opts := c.opts
+	opts.Region = region
+	client, err := minio.New(c.endpoint, &opts)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.opts = opts
+	c.region = region
+	return nil
+}
+
+// regionFromError returns the region reported by the service if the error is
+// a minio.ErrorResponse for a request sent to the wrong region, or an empty
+// string.
+func regionFromError(err error) string {
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) || resp.Region == "" {
+		return ""
+	}
+	switch {
+	case resp.StatusCode == http.StatusMovedPermanently,
+		resp.Code == "PermanentRedirect",
+		resp.Code == "AuthorizationHeaderMalformed",
+		resp.Code == "InvalidRegion":
+		return resp.Region
+	}
+	return ""
+}
+
+// retryOnTokenError calls fn, and when it fails with an error caused by an
+// expired or invalid session token, expires the credentials of the client
+// to force them to be retrieved again, and calls fn once more.
+func (c *MinioClient) retryOnTokenError(fn func() error) error {
+	err := fn()
+	if isTokenError(err) {
+		c.creds.Expire()
+		err = fn()
+	}
+	return err
+}
+
+// isTokenError returns if the error is a minio.ErrorResponse caused by an
+// expired or invalid session token.
+func isTokenError(err error) bool {
+	var resp minio.ErrorResponse
+	return errors.As(err, &resp) && (resp.Code == "ExpiredToken" || resp.Code == "InvalidToken")
+}
+
+// ObjectIsNotFound checks if the error provided is a minio.ErrorResponse with
+// a "NoSuchKey" code.
+func (c *MinioClient) ObjectIsNotFound(err error) bool {
+	var resp minio.ErrorResponse
+	return errors.As(err, &resp) && resp.Code == "NoSuchKey"
+}
+
+// IsAuthError checks if the error provided is a minio.ErrorResponse caused by
+// missing, invalid or insufficient credentials.
+func (c *MinioClient) IsAuthError(err error) bool {
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) {
+		return false
+	}
+	switch resp.Code {
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+		return true
+	}
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
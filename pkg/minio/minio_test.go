@@ -0,0 +1,784 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minio
+
+import (
+	"context"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+func TestNewClient(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+		Data: map[string][]byte{
+			"accesskey":    []byte("access"),
+			"secretkey":    []byte("secret"),
+			"sessionToken": []byte("session"),
+		},
+	}
+	sts := &sourcev1.BucketSTSSpec{
+		Endpoint:                  "https://sts.example.com",
+		WebIdentityTokenSecretRef: &meta.LocalObjectReference{Name: "token"},
+	}
+	tests := []struct {
+		name        string
+		sts         *sourcev1.BucketSTSSpec
+		secret      *corev1.Secret
+		tokenSecret *corev1.Secret
+		wantSource  string
+		wantErr     bool
+	}{
+		{
+			name:       "static credentials",
+			secret:     secret,
+			wantSource: "secret",
+		},
+		{
+			name:    "missing secret key",
+			secret:  &corev1.Secret{Data: map[string][]byte{"accesskey": []byte("access")}},
+			wantErr: true,
+		},
+		{
+			name:    "no credentials",
+			wantErr: true,
+		},
+		{
+			name:        "STS web identity",
+			sts:         sts,
+			tokenSecret: &corev1.Secret{Data: map[string][]byte{"token": []byte("jwt")}},
+			wantSource:  "STS web identity",
+		},
+		{
+			name:        "STS web identity without token",
+			sts:         sts,
+			tokenSecret: &corev1.Secret{Data: map[string][]byte{}},
+			wantErr:     true,
+		},
+		{
+			name:       "STS AssumeRole",
+			sts:        &sourcev1.BucketSTSSpec{Endpoint: "https://sts.example.com", RoleARN: "arn:aws:iam::123456789012:role/source"},
+			secret:     secret,
+			wantSource: "STS AssumeRole",
+		},
+		{
+			name:    "STS AssumeRole without secret",
+			sts:     &sourcev1.BucketSTSSpec{Endpoint: "https://sts.example.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+				Provider: sourcev1.GenericBucketProvider,
+				Endpoint: "minio.example.com",
+				STS:      tt.sts,
+			}}
+			client, err := NewClient(bucket, tt.secret, tt.tokenSecret, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if source := client.CredentialSource(); source != tt.wantSource {
+				t.Errorf("CredentialSource() got = %q, want %q", source, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestNewClient_awsCredentialChain(t *testing.T) {
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		if v, ok := os.LookupEnv(env); ok {
+			defer os.Setenv(env, v)
+		} else {
+			defer os.Unsetenv(env)
+		}
+	}
+	os.Setenv("AWS_ACCESS_KEY_ID", "access")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	// A secret without static credentials, e.g. for server-side encryption,
+	// does not replace the credential chain
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sse"},
+		Data:       map[string][]byte{"sseKmsKeyId": []byte("alias/flux")},
+	}
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.AmazonBucketProvider,
+		Endpoint: "s3.amazonaws.com",
+		Region:   "eu-west-1",
+	}}
+	client, err := NewClient(bucket, secret, nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if _, err := client.creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if source := client.CredentialSource(); source != "environment" {
+		t.Errorf("CredentialSource() got = %q, want %q", source, "environment")
+	}
+
+	bucket.Spec.Provider = sourcev1.GenericBucketProvider
+	if _, err := NewClient(bucket, secret, nil, nil); err == nil {
+		t.Error("NewClient() of the generic provider without static credentials error = nil")
+	}
+}
+
+func TestWebIdentityProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Method != http.MethodPost || r.URL.RawQuery != "" {
+			t.Errorf("unexpected request %s %s, want the parameters in the body", r.Method, r.URL)
+		}
+		q := r.PostForm
+		if q.Get("Action") != "AssumeRoleWithWebIdentity" || q.Get("RoleArn") != "arn:role" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if q.Get("WebIdentityToken") != "jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidIdentityToken</Code><Message>invalid token</Message></Error></ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>access</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, expiration)
+	}))
+	defer server.Close()
+
+	p := newWebIdentityProvider(server.URL, "arn:role", "jwt\n", http.DefaultTransport)
+	v, err := p.Retrieve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "access" || v.SecretAccessKey != "secret" || v.SessionToken != "session" {
+		t.Errorf("Retrieve() got = %v", v)
+	}
+	if p.IsExpired() {
+		t.Error("IsExpired() got = true, want false")
+	}
+
+	p = newWebIdentityProvider(server.URL, "arn:role", "invalid", http.DefaultTransport)
+	if _, err := p.Retrieve(); err == nil {
+		t.Error("Retrieve() expected error for invalid token")
+	}
+
+	// The token is not in the errors of the transport
+	server.Close()
+	p = newWebIdentityProvider(server.URL, "arn:role", "jwt", http.DefaultTransport)
+	if _, err := p.Retrieve(); err == nil || strings.Contains(err.Error(), "jwt") {
+		t.Errorf("Retrieve() of an unreachable endpoint error = %v, want an error without the token", err)
+	}
+}
+
+type countingProvider struct {
+	retrieved int
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	return credentials.Value{AccessKeyID: "access", SecretAccessKey: "secret"}, nil
+}
+
+func (p *countingProvider) IsExpired() bool {
+	return false
+}
+
+func TestMinioClient_retryOnTokenError(t *testing.T) {
+	provider := &countingProvider{}
+	client := &MinioClient{creds: credentials.New(provider)}
+	if _, err := client.creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	err := client.retryOnTokenError(func() error {
+		calls++
+		if _, err := client.creds.Get(); err != nil {
+			return err
+		}
+		if calls == 1 {
+			return minio.ErrorResponse{Code: "ExpiredToken", StatusCode: http.StatusBadRequest}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("retryOnTokenError() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("retryOnTokenError() called fn %d times, want 2", calls)
+	}
+	if provider.retrieved != 2 {
+		t.Errorf("credentials retrieved %d times, want 2", provider.retrieved)
+	}
+
+	calls = 0
+	err = client.retryOnTokenError(func() error {
+		calls++
+		return minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("retryOnTokenError() retried non-token error, calls = %d, err = %v", calls, err)
+	}
+}
+
+// listServer is a fake S3 server serving the listing of a single bucket in
+// pages of pageSize objects.
+type listServer struct {
+	keys     []string
+	pageSize int
+	// failPage is the page (starting at 1) which fails, if any.
+	failPage int
+	// repeatPage serves the first page for every continuation.
+	repeatPage bool
+}
+
+// token returns the continuation token for the page starting at the given
+// offset, containing characters which must be encoded in the query.
+func (s *listServer) token(offset int) string {
+	return fmt.Sprintf("1/%d+=&p %d?", offset, offset)
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	offset := 0
+	if q.Get("list-type") == "2" {
+		if token := q.Get("continuation-token"); token != "" {
+			for offset = 0; offset < len(s.keys) && s.token(offset) != token; offset += s.pageSize {
+			}
+			if offset >= len(s.keys) {
+				writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+				return
+			}
+		}
+	} else if marker := q.Get("marker"); marker != "" {
+		offset = sort.SearchStrings(s.keys, marker) + 1
+	}
+	if s.repeatPage {
+		offset = 0
+	}
+	if s.failPage > 0 && offset/s.pageSize+1 == s.failPage {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	end := offset + s.pageSize
+	if end > len(s.keys) {
+		end = len(s.keys)
+	}
+	type content struct {
+		Key  string
+		ETag string
+		Size int64
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		IsTruncated           bool
+		NextContinuationToken string    `xml:",omitempty"`
+		Contents              []content `xml:"Contents"`
+	}{Name: "bucket", IsTruncated: end < len(s.keys)}
+	if result.IsTruncated && q.Get("list-type") == "2" {
+		result.NextContinuationToken = s.token(end)
+	}
+	for _, key := range s.keys[offset:end] {
+		result.Contents = append(result.Contents, content{Key: key, ETag: `"etag"`, Size: int64(len(key))})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, message)
+}
+
+func newListClient(t *testing.T, handler http.Handler, listV1 bool) *MinioClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.GenericBucketProvider,
+		Endpoint: u.Host,
+		Insecure: true,
+		Region:   "us-east-1",
+	}}
+	client, err := NewClient(bucket, &corev1.Secret{Data: map[string][]byte{
+		"accesskey": []byte("access"),
+		"secretkey": []byte("secret"),
+	}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.listV1 = listV1
+	return client
+}
+
+func TestMinioClient_VisitObjects(t *testing.T) {
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("objects/%04d.yaml", i))
+	}
+
+	tests := []struct {
+		name    string
+		server  *listServer
+		listV1  bool
+		wantErr string
+	}{
+		{
+			name:   "V2 continuation tokens",
+			server: &listServer{keys: keys, pageSize: 1000},
+		},
+		{
+			name:   "V1 markers",
+			server: &listServer{keys: keys, pageSize: 1000},
+			listV1: true,
+		},
+		{
+			name:    "error mid-pagination",
+			server:  &listServer{keys: keys, pageSize: 1000, failPage: 2},
+			wantErr: "Access Denied",
+		},
+		{
+			name:    "page not advancing",
+			server:  &listServer{keys: keys, pageSize: 1000, repeatPage: true},
+			wantErr: "listing did not advance",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newListClient(t, tt.server, tt.listV1)
+			var got []string
+			err := client.VisitObjects(context.TODO(), "bucket", "objects/", func(key, etag string, size int64, lastModified time.Time) error {
+				got = append(got, key)
+				return nil
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("VisitObjects() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(keys) || got[0] != keys[0] || got[len(got)-1] != keys[len(keys)-1] {
+				t.Errorf("VisitObjects() visited %d objects, want %d", len(got), len(keys))
+			}
+		})
+	}
+}
+
+func TestMinioClient_VisitObjects_cancelled(t *testing.T) {
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("objects/%04d.yaml", i))
+	}
+	client := newListClient(t, &listServer{keys: keys, pageSize: 1000}, false)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	var visited int
+	err := client.VisitObjects(ctx, "bucket", "", func(key, etag string, size int64, lastModified time.Time) error {
+		if visited++; visited == 1500 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("VisitObjects() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestNewClient_userAgent(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.GenericBucketProvider,
+		Endpoint: u.Host,
+		Insecure: true,
+		Region:   "us-east-1",
+	}}
+	secret := &corev1.Secret{Data: map[string][]byte{
+		"accesskey": []byte("access"),
+		"secretkey": []byte("secret"),
+	}}
+	client, err := NewClient(bucket, secret, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BucketExists(context.TODO(), "bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if got != transport.UserAgent() {
+		t.Errorf("User-Agent = %q, want %q", got, transport.UserAgent())
+	}
+}
+
+func TestNewClient_proxy(t *testing.T) {
+	var got string
+	proxy := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.URL.String()
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.GenericBucketProvider,
+		Endpoint: "minio.example.com",
+		Insecure: true,
+		Region:   "us-east-1",
+	}}
+	secret := &corev1.Secret{Data: map[string][]byte{
+		"accesskey": []byte("access"),
+		"secretkey": []byte("secret"),
+	}}
+	client, err := NewClient(bucket, secret, nil, http.ProxyURL(proxyURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BucketExists(context.TODO(), "bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "http://minio.example.com/bucket") {
+		t.Errorf("proxy received %q, want the request to the endpoint", got)
+	}
+}
+
+func TestNewClient_TLS(t *testing.T) {
+	server := httptest.NewTLSServer(&listServer{keys: []string{"a.yaml"}, pageSize: 1000})
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	tests := []struct {
+		name     string
+		endpoint string
+		insecure bool
+		caField  string
+		wantErr  string
+	}{
+		{
+			name:     "caFile",
+			endpoint: u.Host,
+			caField:  "caFile",
+		},
+		{
+			name:     "ca.crt with https scheme",
+			endpoint: "https://" + u.Host,
+			caField:  "ca.crt",
+		},
+		{
+			name:     "untrusted certificate",
+			endpoint: u.Host,
+			wantErr:  "certificate",
+		},
+		{
+			name:     "insecure with https scheme",
+			endpoint: "https://" + u.Host,
+			insecure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &corev1.Secret{Data: map[string][]byte{
+				"accesskey": []byte("access"),
+				"secretkey": []byte("secret"),
+			}}
+			if tt.caField != "" {
+				secret.Data[tt.caField] = caPEM
+			}
+			bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+				Provider: sourcev1.GenericBucketProvider,
+				Endpoint: tt.endpoint,
+				Insecure: tt.insecure,
+				Region:   "us-east-1",
+			}}
+			client, err := NewClient(bucket, secret, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.VisitObjects(context.TODO(), "bucket", "", func(key, etag string, size int64, lastModified time.Time) error {
+				return nil
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("VisitObjects() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("VisitObjects() error = %v", err)
+			}
+		})
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+		Data: map[string][]byte{
+			"accesskey": []byte("access"),
+			"secretkey": []byte("secret"),
+			"caFile":    []byte("invalid"),
+		},
+	}
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{Endpoint: u.Host}}
+	if _, err := NewClient(bucket, secret, nil, nil); err == nil || !strings.Contains(err.Error(), "field 'caFile'") {
+		t.Errorf("NewClient() error = %v, want invalid caFile error", err)
+	}
+}
+
+// regionServer is a fake S3 server for a bucket located in region, which
+// rejects requests signed for another region like AWS S3 does.
+type regionServer struct {
+	t           *testing.T
+	region      string
+	virtualHost bool
+}
+
+func (s *regionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The location of the bucket is always requested path-style, and can be
+	// requested from any region.
+	if _, ok := r.URL.Query()["location"]; ok {
+		fmt.Fprintf(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">%s</LocationConstraint>`, s.region)
+		return
+	}
+
+	if virtualHost := strings.HasPrefix(r.Host, "bucket."); virtualHost != s.virtualHost {
+		s.t.Errorf("unexpected addressing style, host: %s, path: %s", r.Host, r.URL.Path)
+	}
+
+	// Authorization: AWS4-HMAC-SHA256 Credential=<key>/<date>/<region>/s3/aws4_request, ...
+	if scope := strings.Split(r.Header.Get("Authorization"), "/"); len(scope) < 3 || scope[2] != s.region {
+		w.Header().Set("x-amz-bucket-region", s.region)
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		writeS3Error(w, http.StatusMovedPermanently, "PermanentRedirect", "The bucket you are attempting to access must be addressed using the specified endpoint.")
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	(&listServer{keys: []string{"a.yaml"}, pageSize: 1000}).ServeHTTP(w, r)
+}
+
+func TestMinioClient_region(t *testing.T) {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		if v, ok := os.LookupEnv(env); ok {
+			defer os.Setenv(env, v)
+		} else {
+			defer os.Unsetenv(env)
+		}
+		os.Unsetenv(env)
+	}
+	os.Setenv("AWS_ACCESS_KEY_ID", "access")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	tests := []struct {
+		name        string
+		specRegion  string
+		envRegion   string
+		wantRegion  string
+		wantErr     bool
+		wantWarning string
+	}{
+		{
+			name:       "detected from bucket location",
+			wantRegion: "eu-west-1",
+		},
+		{
+			name:       "default region redirected",
+			envRegion:  "us-east-1",
+			wantRegion: "eu-west-1",
+		},
+		{
+			name:       "matching spec region",
+			specRegion: "eu-west-1",
+			wantRegion: "eu-west-1",
+		},
+		{
+			name:        "mismatching spec region",
+			specRegion:  "us-east-1",
+			wantRegion:  "us-east-1",
+			wantErr:     true,
+			wantWarning: "bucket is located in region 'eu-west-1' instead of the configured region 'us-east-1'",
+		},
+	}
+	for _, lookup := range []minio.BucketLookupType{minio.BucketLookupPath, minio.BucketLookupDNS} {
+		virtualHost := lookup == minio.BucketLookupDNS
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s (virtual host %v)", tt.name, virtualHost), func(t *testing.T) {
+				server := httptest.NewServer(&regionServer{t: t, region: "eu-west-1", virtualHost: virtualHost})
+				defer server.Close()
+				os.Setenv("AWS_REGION", tt.envRegion)
+
+				bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+					Provider: sourcev1.AmazonBucketProvider,
+					Endpoint: "s3.example.com",
+					Insecure: true,
+					Region:   tt.specRegion,
+				}}
+				client, err := NewClient(bucket, nil, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Resolve all hosts to the test server, and use the given
+				// addressing style
+				httpTransport, err := minio.DefaultTransport(false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				httpTransport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+				}
+				client.opts.Transport = transport.WithUserAgent(httpTransport)
+				client.opts.BucketLookup = lookup
+				if err := client.setRegion(client.region); err != nil {
+					t.Fatal(err)
+				}
+
+				exists, err := client.BucketExists(context.TODO(), "bucket")
+				if region := client.Region(); region != tt.wantRegion {
+					t.Errorf("Region() got = %q, want %q", region, tt.wantRegion)
+				}
+				if warning := client.RegionWarning(); warning != tt.wantWarning {
+					t.Errorf("RegionWarning() got = %q, want %q", warning, tt.wantWarning)
+				}
+				if tt.wantErr {
+					if err == nil {
+						t.Error("BucketExists() error = nil, want the error of the service")
+					}
+					return
+				}
+				if err != nil || !exists {
+					t.Fatalf("BucketExists() = %v, %v", exists, err)
+				}
+				var keys []string
+				if err := client.VisitObjects(context.TODO(), "bucket", "", func(key, etag string, size int64, lastModified time.Time) error {
+					keys = append(keys, key)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if len(keys) != 1 {
+					t.Errorf("VisitObjects() got = %v", keys)
+				}
+			})
+		}
+	}
+}
+
+func TestMinioClient_regionConcurrentDownloads(t *testing.T) {
+	regions := &regionServer{t: t, region: "eu-west-1"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		regions.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.GenericBucketProvider,
+		Endpoint: server.Listener.Addr().String(),
+		Insecure: true,
+		Region:   "us-east-1",
+	}}
+	secret := &corev1.Secret{Data: map[string][]byte{"accesskey": []byte("access"), "secretkey": []byte("secret")}}
+	client, err := NewClient(bucket, secret, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A region of the default client instead of the spec, which is switched
+	// by the first download that is redirected
+	client.specRegion = ""
+
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := client.FGetObject(context.TODO(), "bucket", "a.yaml", filepath.Join(dir, fmt.Sprintf("%d.yaml", i))); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("FGetObject() error = %v", err)
+	}
+	if region := client.Region(); region != "eu-west-1" {
+		t.Errorf("Region() got = %q, want %q", region, "eu-west-1")
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/minio/minio-go/v7"
+)
+
+// backoff is the policy for retrying operations which failed with a
+// transient error.
+type backoff struct {
+	// attempts is the maximum number of attempts of an operation.
+	attempts int
+	// base is the wait before the second attempt, which doubles for every
+	// following attempt.
+	base time.Duration
+	// max is the maximum wait between two attempts.
+	max time.Duration
+}
+
+// defaultBackoff retries an operation for about 15 seconds, on top of the
+// retries of the individual requests by the minio.Client.
+var defaultBackoff = backoff{attempts: 5, base: time.Second, max: 8 * time.Second}
+
+// wait returns the wait before the next attempt after the given attempt,
+// a random duration up to the exponential backoff (full jitter).
+func (b backoff) wait(attempt int) time.Duration {
+	d := b.base << uint(attempt-1)
+	if d > b.max || d <= 0 {
+		d = b.max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryTransient calls fn until it succeeds, fails with an error that is not
+// transient, or the maximum number of attempts has been made, waiting with an
+// exponential backoff between attempts. No attempt is made that would start
+// after the deadline of the context. The failed attempts are only logged at
+// debug level, the returned error states the number of attempts that were
+// made.
+func (c *MinioClient) retryTransient(ctx context.Context, operation string, fn func() error) error {
+	attempt := 1
+	err := fn()
+	for ; err != nil && isTransientError(err) && attempt < c.backoff.attempts; attempt++ {
+		wait := c.backoff.wait(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			break
+		}
+		logr.FromContextOrDiscard(ctx).V(1).Info("retrying after transient error",
+			"operation", operation, "attempt", attempt, "backoff", wait.String(), "error", err.Error())
+		atomic.AddInt64(&c.retries, 1)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s failed after %d attempts: %w", operation, attempt, err)
+		}
+		err = fn()
+	}
+	if err != nil && attempt > 1 {
+		return fmt.Errorf("%s failed after %d attempts: %w", operation, attempt, err)
+	}
+	return err
+}
+
+// Retries returns the number of retries of operations after a transient
+// error.
+func (c *MinioClient) Retries() int64 {
+	return atomic.LoadInt64(&c.retries)
+}
+
+// isTransientError returns if the error is caused by throttling, a server
+// error, or a connection that was reset or timed out. Errors for missing
+// objects and denied access are never transient.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var resp minio.ErrorResponse
+	if errors.As(err, &resp) {
+		switch resp.StatusCode {
+		case http.StatusForbidden, http.StatusNotFound:
+			return false
+		case http.StatusTooManyRequests:
+			return true
+		}
+		switch resp.Code {
+		case "SlowDown", "RequestTimeout", "Throttling", "ThrottlingException", "RequestLimitExceeded",
+			"RequestThrottled", "InternalError", "ServiceUnavailable":
+			return true
+		}
+		return resp.StatusCode >= http.StatusInternalServerError
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "SlowDown", err: minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "RequestTimeout", err: minio.ErrorResponse{Code: "RequestTimeout", StatusCode: http.StatusBadRequest}, want: true},
+		{name: "too many requests", err: minio.ErrorResponse{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "server error without body", err: minio.ErrorResponse{Code: "502 Bad Gateway", StatusCode: http.StatusBadGateway}, want: true},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET), want: true},
+		{name: "unexpected EOF", err: io.ErrUnexpectedEOF, want: true},
+		{name: "access denied", err: minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}, want: false},
+		{name: "not found", err: minio.ErrorResponse{Code: "NoSuchKey", StatusCode: http.StatusNotFound}, want: false},
+		{name: "forbidden internal error", err: minio.ErrorResponse{Code: "InternalError", StatusCode: http.StatusForbidden}, want: false},
+		{name: "context deadline", err: context.DeadlineExceeded, want: false},
+		{name: "other error", err: errors.New("invalid argument"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.want {
+				t.Errorf("isTransientError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinioClient_retryTransient(t *testing.T) {
+	slowDown := minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable, Message: "Please reduce your request rate."}
+
+	tests := []struct {
+		name         string
+		failures     int
+		err          error
+		expired      bool
+		wantCalls    int
+		wantErr      string
+		wantAttempts bool
+	}{
+		{
+			name:      "succeeds after transient errors",
+			failures:  2,
+			err:       slowDown,
+			wantCalls: 3,
+		},
+		{
+			name:         "attempts exhausted",
+			failures:     10,
+			err:          slowDown,
+			wantCalls:    4,
+			wantErr:      "listing failed after 4 attempts: Please reduce your request rate.",
+			wantAttempts: true,
+		},
+		{
+			name:      "access denied is not retried",
+			failures:  10,
+			err:       minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden, Message: "Access Denied."},
+			wantCalls: 1,
+			wantErr:   "Access Denied.",
+		},
+		{
+			name:      "no attempt after the deadline",
+			failures:  10,
+			err:       slowDown,
+			expired:   true,
+			wantCalls: 1,
+			wantErr:   "Please reduce your request rate.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &MinioClient{backoff: backoff{attempts: 4, base: 5 * time.Millisecond, max: 20 * time.Millisecond}}
+			ctx := context.TODO()
+			if tt.expired {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, time.Now())
+				defer cancel()
+			}
+
+			var calls int
+			err := client.retryTransient(ctx, "listing", func() error {
+				if calls++; calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("retryTransient() called fn %d times, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("retryTransient() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("retryTransient() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := strings.Contains(err.Error(), "attempts"); got != tt.wantAttempts {
+				t.Errorf("retryTransient() error = %v, want attempts in error = %v", err, tt.wantAttempts)
+			}
+			if got, want := client.Retries(), int64(tt.wantCalls-1); got != want {
+				t.Errorf("Retries() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// throttlingHandler fails the first failures continuation requests of a
+// listing with a SlowDown error.
+type throttlingHandler struct {
+	http.Handler
+	failures int32
+}
+
+func (h *throttlingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("continuation-token") != "" && atomic.AddInt32(&h.failures, -1) >= 0 {
+		writeS3Error(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestMinioClient_VisitObjects_throttled(t *testing.T) {
+	// Disable the retries of the individual requests by the minio.Client.
+	maxRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	defer func() { minio.MaxRetry = maxRetry }()
+
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("objects/%04d.yaml", i))
+	}
+	client := newListClient(t, &throttlingHandler{
+		Handler:  &listServer{keys: keys, pageSize: 1000},
+		failures: 2,
+	}, false)
+	client.backoff = backoff{attempts: 5, base: time.Millisecond, max: 10 * time.Millisecond}
+
+	visited := map[string]int{}
+	err := client.VisitObjects(context.TODO(), "bucket", "", func(key, etag string, size int64, lastModified time.Time) error {
+		visited[key]++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VisitObjects() error = %v", err)
+	}
+	if len(visited) != len(keys) {
+		t.Errorf("VisitObjects() visited %d objects, want %d", len(visited), len(keys))
+	}
+	for key, n := range visited {
+		if n != 1 {
+			t.Errorf("VisitObjects() visited '%s' %d times, want once", key, n)
+		}
+	}
+	if got := client.Retries(); got != 2 {
+		t.Errorf("Retries() = %d, want 2", got)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minio
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// sseCustomerKeyField is the Secret field holding the 256-bit SSE-C key,
+	// raw or base64 encoded.
+	sseCustomerKeyField = "sseCustomerKey"
+	// sseCustomerAlgorithmField is the Secret field holding the SSE-C
+	// algorithm, which must be 'AES256' if set.
+	sseCustomerAlgorithmField = "sseCustomerAlgorithm"
+	// sseKMSKeyIDField is the Secret field holding the SSE-KMS key ID.
+	sseKMSKeyIDField = "sseKmsKeyId"
+	// sseKMSContextField is the Secret field holding the SSE-KMS encryption
+	// context as a JSON object.
+	sseKMSContextField = "sseKmsContext"
+)
+
+// serverSideEncryption holds the server-side encryption settings of the
+// requests for objects. The customer key is only kept in memory, and is never
+// included in errors. The SSE-KMS settings are not sent, as S3 decrypts the
+// objects itself and rejects them on GET requests, they only explain the
+// errors of the objects which can not be decrypted.
+type serverSideEncryption struct {
+	secretName  string
+	customerKey encrypt.ServerSide
+	kms         bool
+}
+
+// sseFromSecret returns the serverSideEncryption configured by the SSE-C and
+// SSE-KMS fields of the given Secret, or nil if the Secret is nil or has none
+// of the fields.
+func sseFromSecret(secret *corev1.Secret) (*serverSideEncryption, error) {
+	if secret == nil {
+		return nil, nil
+	}
+	sse := &serverSideEncryption{secretName: secret.Name}
+
+	if key, ok := secret.Data[sseCustomerKeyField]; ok {
+		if algorithm, ok := secret.Data[sseCustomerAlgorithmField]; ok && string(algorithm) != "AES256" {
+			return nil, fmt.Errorf("invalid '%s' secret data: unsupported '%s' value '%s', must be 'AES256'",
+				secret.Name, sseCustomerAlgorithmField, string(algorithm))
+		}
+		if len(key) != 32 {
+			decoded, err := base64.StdEncoding.DecodeString(string(key))
+			if err != nil || len(decoded) != 32 {
+				return nil, fmt.Errorf("invalid '%s' secret data: field '%s' must be a 256-bit key, raw or base64 encoded",
+					secret.Name, sseCustomerKeyField)
+			}
+			key = decoded
+		}
+		customerKey, err := encrypt.NewSSEC(key)
+		if err != nil {
+			return nil, err
+		}
+		sse.customerKey = customerKey
+	}
+
+	if keyID, ok := secret.Data[sseKMSKeyIDField]; ok && len(keyID) > 0 {
+		sse.kms = true
+	}
+	if kmsContext, ok := secret.Data[sseKMSContextField]; ok && len(kmsContext) > 0 {
+		var v map[string]string
+		if err := json.Unmarshal(kmsContext, &v); err != nil {
+			return nil, fmt.Errorf("invalid '%s' secret data: field '%s' must be a JSON object with string values: %w",
+				secret.Name, sseKMSContextField, err)
+		}
+		sse.kms = true
+	}
+
+	if sse.customerKey == nil && !sse.kms {
+		return nil, nil
+	}
+	return sse, nil
+}
+
+// getObjectOptions returns the minio.GetObjectOptions with the customer
+// provided key, if any.
+func (s *serverSideEncryption) getObjectOptions() minio.GetObjectOptions {
+	opts := minio.GetObjectOptions{}
+	if s == nil {
+		return opts
+	}
+	opts.ServerSideEncryption = s.customerKey
+	return opts
+}
+
+// isSSEErrorCode returns if the given S3 error code is the code of a request
+// for an object encrypted with a customer provided key without the key,
+// 'InvalidRequest', or of another server-side encryption error.
+func isSSEErrorCode(code string) bool {
+	return code == "InvalidRequest" || strings.Contains(strings.ToLower(code), "encryption")
+}
+
+// objectError returns the error for a failed request for an object, with an
+// explanation if it was likely caused by missing or mismatching encryption
+// settings.
+func (s *serverSideEncryption) objectError(err error) error {
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) {
+		return err
+	}
+	switch {
+	case (s == nil || s.customerKey == nil) && resp.StatusCode == http.StatusBadRequest && isSSEErrorCode(resp.Code):
+		return fmt.Errorf("object can not be read without server-side encryption settings, "+
+			"if it is encrypted with a customer provided key the key must be set in the '%s' field of the secret: %w",
+			sseCustomerKeyField, err)
+	case s != nil && s.customerKey != nil && (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden):
+		return fmt.Errorf("object can not be read with the customer provided key of secret '%s', "+
+			"verify that the object is encrypted with this key: %w", s.secretName, err)
+	case s != nil && s.kms && resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("object can not be read with the KMS settings of secret '%s', "+
+			"verify the kms:Decrypt permission of the credentials on the key of the '%s' field: %w",
+			s.secretName, sseKMSKeyIDField, err)
+	}
+	return err
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minio
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+const testCustomerKey = "0123456789abcdef0123456789abcdef"
+
+func TestSSEFromSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		wantNil bool
+		wantKey bool
+		wantKMS bool
+		wantErr string
+	}{
+		{
+			name:    "no encryption fields",
+			data:    map[string][]byte{"accesskey": []byte("access")},
+			wantNil: true,
+		},
+		{
+			name:    "raw customer key",
+			data:    map[string][]byte{sseCustomerKeyField: []byte(testCustomerKey)},
+			wantKey: true,
+		},
+		{
+			name: "base64 customer key with algorithm",
+			data: map[string][]byte{
+				sseCustomerKeyField:       []byte(base64.StdEncoding.EncodeToString([]byte(testCustomerKey))),
+				sseCustomerAlgorithmField: []byte("AES256"),
+			},
+			wantKey: true,
+		},
+		{
+			name:    "short customer key",
+			data:    map[string][]byte{sseCustomerKeyField: []byte("secret-key")},
+			wantErr: "field 'sseCustomerKey' must be a 256-bit key",
+		},
+		{
+			name: "unsupported algorithm",
+			data: map[string][]byte{
+				sseCustomerKeyField:       []byte(testCustomerKey),
+				sseCustomerAlgorithmField: []byte("AES128"),
+			},
+			wantErr: "unsupported 'sseCustomerAlgorithm' value 'AES128'",
+		},
+		{
+			name: "KMS key and context",
+			data: map[string][]byte{
+				sseKMSKeyIDField:   []byte("arn:aws:kms:eu-west-1:123456789012:key/abcd"),
+				sseKMSContextField: []byte(`{"team":"apps"}`),
+			},
+			wantKMS: true,
+		},
+		{
+			name:    "invalid KMS context",
+			data:    map[string][]byte{sseKMSContextField: []byte(`["apps"]`)},
+			wantErr: "field 'sseKmsContext' must be a JSON object",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "creds"}, Data: tt.data}
+			sse, err := sseFromSecret(secret)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("sseFromSecret() error = %v, want %q", err, tt.wantErr)
+				}
+				if key, ok := tt.data[sseCustomerKeyField]; ok && strings.Contains(err.Error(), string(key)) {
+					t.Errorf("sseFromSecret() error contains the customer key: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sseFromSecret() error = %v", err)
+			}
+			if tt.wantNil {
+				if sse != nil {
+					t.Errorf("sseFromSecret() = %v, want nil", sse)
+				}
+				return
+			}
+			if got := sse.customerKey != nil; got != tt.wantKey {
+				t.Errorf("customer key set = %v, want %v", got, tt.wantKey)
+			}
+			if sse.kms != tt.wantKMS {
+				t.Errorf("KMS settings set = %v, want %v", sse.kms, tt.wantKMS)
+			}
+			// The SSE-KMS settings are rejected by S3 on GET requests
+			if header := sse.getObjectOptions().Header(); !tt.wantKey && len(header) > 0 {
+				t.Errorf("headers = %v, want none", header)
+			}
+		})
+	}
+}
+
+// sseServer is a fake S3 server with a single object encrypted with the
+// customer provided key, which rejects the requests without the key with the
+// 'InvalidRequest' error of AWS S3, and the requests for any other object
+// with an 'InvalidArgument' error.
+type sseServer struct {
+	key     string
+	content string
+	headers http.Header
+}
+
+func (s *sseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.headers = r.Header.Clone()
+	badRequest := func(code string) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<Error><Code>%s</Code><Message>bad request</Message></Error>`, code)
+	}
+	if !strings.HasSuffix(r.URL.Path, "/a.yaml") {
+		badRequest("InvalidArgument")
+		return
+	}
+	keyMD5 := md5.Sum([]byte(s.key))
+	switch r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-MD5") {
+	case "":
+		badRequest("InvalidRequest")
+		return
+	case base64.StdEncoding.EncodeToString(keyMD5[:]):
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("ETag", `"abc"`)
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", "7")
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write([]byte(s.content))
+	}
+}
+
+func TestMinioClient_FGetObject_sse(t *testing.T) {
+	handler := &sseServer{key: testCustomerKey, content: "content"}
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		object  string
+		data    map[string][]byte
+		wantErr string
+	}{
+		{
+			name: "matching key",
+			data: map[string][]byte{
+				sseCustomerKeyField: []byte(testCustomerKey),
+				sseKMSContextField:  []byte(`{"team":"apps"}`),
+			},
+		},
+		{
+			name:    "missing key",
+			wantErr: "the key must be set in the 'sseCustomerKey' field of the secret",
+		},
+		{
+			name:    "other bad request",
+			object:  "b.yaml",
+			wantErr: "bad request",
+		},
+		{
+			name:    "mismatching key",
+			data:    map[string][]byte{sseCustomerKeyField: []byte("fedcba9876543210fedcba9876543210")},
+			wantErr: "verify that the object is encrypted with this key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+				Data: map[string][]byte{
+					"accesskey": []byte("access"),
+					"secretkey": []byte("secret"),
+				},
+			}
+			for k, v := range tt.data {
+				secret.Data[k] = v
+			}
+			bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+				Provider: sourcev1.GenericBucketProvider,
+				Endpoint: "https://" + u.Host,
+				Insecure: true,
+				Region:   "us-east-1",
+			}}
+			client, err := NewClient(bucket, secret, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			object := tt.object
+			if object == "" {
+				object = "a.yaml"
+			}
+			localPath := filepath.Join(t.TempDir(), object)
+			contentType, err := client.FGetObject(context.TODO(), "bucket", object, localPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("FGetObject() error = %v, want %q", err, tt.wantErr)
+				}
+				if tt.object != "" && strings.Contains(err.Error(), sseCustomerKeyField) {
+					t.Errorf("FGetObject() error = %v, want no encryption hint", err)
+				}
+				if strings.Contains(err.Error(), testCustomerKey) {
+					t.Errorf("FGetObject() error contains the customer key: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FGetObject() error = %v", err)
+			}
+			if b, err := os.ReadFile(localPath); err != nil || string(b) != handler.content {
+				t.Errorf("FGetObject() content = %q, %v, want %q", b, err, handler.content)
+			}
+			if contentType != "application/yaml" {
+				t.Errorf("FGetObject() content type = %q, want %q", contentType, "application/yaml")
+			}
+			if got := handler.headers.Get("X-Amz-Server-Side-Encryption-Context"); got != "" {
+				t.Errorf("FGetObject() sent the SSE-KMS context %q", got)
+			}
+		})
+	}
+
+	bucket := sourcev1.Bucket{Spec: sourcev1.BucketSpec{
+		Provider: sourcev1.GenericBucketProvider,
+		Endpoint: u.Host,
+		Insecure: true,
+	}}
+	secret := &corev1.Secret{Data: map[string][]byte{
+		"accesskey":         []byte("access"),
+		"secretkey":         []byte("secret"),
+		sseCustomerKeyField: []byte(testCustomerKey),
+	}}
+	if _, err := NewClient(bucket, secret, nil, nil); err == nil || !strings.Contains(err.Error(), "require an 'https://' endpoint") {
+		t.Errorf("NewClient() error = %v, want https endpoint error", err)
+	}
+}
@@ -0,0 +1,549 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/fluxcd/pkg/version"
+	corev1 "k8s.io/api/core/v1"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+const (
+	// ManifestMediaType is the media type of an OCI image manifest.
+	ManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	// DockerManifestMediaType is the media type of a Docker image manifest,
+	// schema version 2.
+	DockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	// IndexMediaType is the media type of an OCI image index.
+	IndexMediaType = "application/vnd.oci.image.index.v1+json"
+	// DockerManifestListMediaType is the media type of a Docker manifest
+	// list.
+	DockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// FluxContentMediaType is the media type of the content layer of the
+	// artifacts pushed by Flux.
+	FluxContentMediaType = "application/vnd.cncf.flux.content.v1.tar+gzip"
+	// LayerMediaType is the media type of a gzip compressed OCI image layer.
+	LayerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// DockerLayerMediaType is the media type of a gzip compressed Docker
+	// image layer.
+	DockerLayerMediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	// TarGzipMediaType is the media type of a generic gzip compressed
+	// tarball, as pushed by e.g. ORAS.
+	TarGzipMediaType = "application/tar+gzip"
+
+	// DefaultTag is the tag pulled when an OCIRepository has no reference.
+	DefaultTag = "latest"
+
+	// maxManifestSize is the maximum size of a manifest, as the registries
+	// commonly limit them to 4MiB.
+	maxManifestSize = 4 << 20
+)
+
+// LayerMediaTypes are the media types of the layers which can be pulled,
+// all of them are gzip compressed tarballs.
+var LayerMediaTypes = []string{
+	FluxContentMediaType,
+	LayerMediaType,
+	DockerLayerMediaType,
+	TarGzipMediaType,
+}
+
+// digestRegexp matches a digest in the form '<algorithm>:<encoded>'.
+var digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+// Descriptor describes the content of a manifest or layer.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest is an OCI image manifest, or a Docker image manifest of schema
+// version 2, which have the same fields.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Client is a minimal client of the OCI distribution API for pulling the
+// artifacts of a repository in a registry.
+type Client struct {
+	httpClient *http.Client
+	// registry is the base URL of the API of the registry.
+	registry   *url.URL
+	repository string
+	credential *Credential
+	// authorization is the value of the Authorization header of the
+	// requests, once the registry has challenged the client.
+	authorization string
+}
+
+// NewClient creates a new Client for the repository at the URL of the given
+// v1beta1.OCIRepository, authorized with the credentials of the registry in
+// the given Secret, as returned by CredentialFromSecret. The certificate of
+// the registry is verified against the CA certificates in the 'caFile' or
+// 'ca.crt' field of the Secret in addition to the system roots, and the
+// client presents the certificate in the 'certFile' and 'keyFile', or
+// 'tls.crt' and 'tls.key', fields of the Secret, if any. The API is requested
+// over plain HTTP when spec.insecure is set. The Secret may be nil.
+func NewClient(repository sourcev1.OCIRepository, secret *corev1.Secret) (*Client, error) {
+	host, repo, err := ParseURL(repository.Spec.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := CredentialFromSecret(secret, host)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := transport.TLSConfigFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	cert, err := transport.ClientCertificateFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	scheme := "https"
+	if repository.Spec.Insecure {
+		scheme = "http"
+	}
+	return &Client{
+		httpClient: &http.Client{Transport: transport.WithUserAgent(transport.NewTransport(tlsConfig))},
+		registry:   &url.URL{Scheme: scheme, Host: apiHost(host)},
+		repository: repo,
+		credential: credential,
+	}, nil
+}
+
+// ParseURL returns the host of the registry and the name of the repository
+// of the given 'oci://' URL. The URL must not contain a tag or digest, as
+// they are set with the reference of the OCIRepository.
+func ParseURL(rawURL string) (host, repository string, err error) {
+	if !strings.HasPrefix(rawURL, "oci://") {
+		return "", "", fmt.Errorf("invalid URL '%s': the scheme must be 'oci'", rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid URL: %w", err)
+	}
+	repository = strings.Trim(u.Path, "/")
+	if u.Host == "" || repository == "" {
+		return "", "", fmt.Errorf("invalid URL '%s': it must be in the form 'oci://<host>/<repository>'", rawURL)
+	}
+	if strings.ContainsAny(repository, ":@") {
+		return "", "", fmt.Errorf("invalid URL '%s': the tag or digest must be set with the reference", rawURL)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", fmt.Errorf("invalid URL '%s': it must be in the form 'oci://<host>/<repository>'", rawURL)
+	}
+	if apiHost(u.Host) != u.Host && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return u.Host, repository, nil
+}
+
+// apiHost returns the host of the API of the given registry, which differs
+// from the registry for Docker Hub.
+func apiHost(host string) string {
+	if host == "docker.io" || host == "index.docker.io" {
+		return "registry-1.docker.io"
+	}
+	return host
+}
+
+// Resolve returns the reference of the manifest to pull for the given
+// v1beta1.OCIRepositoryRef: its digest, the highest version of the tags
+// matching its semver range, its tag, or DefaultTag.
+func (c *Client) Resolve(ctx context.Context, ref *sourcev1.OCIRepositoryRef) (string, error) {
+	switch {
+	case ref == nil:
+		return DefaultTag, nil
+	case ref.Digest != "":
+		if !digestRegexp.MatchString(ref.Digest) {
+			return "", fmt.Errorf("invalid digest '%s'", ref.Digest)
+		}
+		return ref.Digest, nil
+	case ref.SemVer != "":
+		return c.resolveSemVer(ctx, ref.SemVer)
+	case ref.Tag != "":
+		return ref.Tag, nil
+	default:
+		return DefaultTag, nil
+	}
+}
+
+// resolveSemVer returns the tag of the highest version matching the given
+// semver range.
+func (c *Client) resolveSemVer(ctx context.Context, semVer string) (string, error) {
+	constraint, err := semver.NewConstraint(semVer)
+	if err != nil {
+		return "", fmt.Errorf("semver parse range error: %w", err)
+	}
+	tags, err := c.Tags(ctx)
+	if err != nil {
+		return "", err
+	}
+	var matched semver.Collection
+	for _, tag := range tags {
+		v, err := version.ParseVersion(tag)
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		matched = append(matched, v)
+	}
+	if len(matched) == 0 {
+		return "", fmt.Errorf("no match found for semver: %s", semVer)
+	}
+	sort.Sort(matched)
+	return matched[len(matched)-1].Original(), nil
+}
+
+// Tags returns the tags of the repository, following the pagination of the
+// registry.
+func (c *Client) Tags(ctx context.Context) ([]string, error) {
+	var tags []string
+	next := "/v2/" + c.repository + "/tags/list"
+	for next != "" {
+		resp, err := c.do(ctx, next, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags: %w", err)
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tags: %w", err)
+		}
+		tags = append(tags, list.Tags...)
+		next = nextLink(resp.Header.Get("Link"))
+	}
+	return tags, nil
+}
+
+// nextLink returns the path and query of the next page of the given Link
+// header, or an empty string for the last page.
+func nextLink(link string) string {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		if len(parts) < 2 || !strings.Contains(parts[1], `rel="next"`) {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(parts[0]), "<>"))
+		if err != nil {
+			return ""
+		}
+		return u.RequestURI()
+	}
+	return ""
+}
+
+// Manifest returns the manifest of the given tag or digest, and its digest.
+// The manifest is verified against the digest if the reference is a digest.
+// An image index is rejected, as an artifact has a single manifest.
+func (c *Client) Manifest(ctx context.Context, reference string) (*Manifest, string, error) {
+	accept := strings.Join([]string{ManifestMediaType, DockerManifestMediaType, IndexMediaType, DockerManifestListMediaType}, ", ")
+	resp, err := c.do(ctx, "/v2/"+c.repository+"/manifests/"+reference, accept)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get manifest '%s': %w", reference, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest '%s': %w", reference, err)
+	}
+	if len(b) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest '%s' exceeds the maximum size of %d bytes", reference, maxManifestSize)
+	}
+
+	digest := "sha256:" + sha256Hex(b)
+	if digestRegexp.MatchString(reference) {
+		if err := verifyDigest(reference, b); err != nil {
+			return nil, "", fmt.Errorf("manifest '%s': %w", reference, err)
+		}
+		digest = reference
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest '%s': %w", reference, err)
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	}
+	switch mediaType {
+	case ManifestMediaType, DockerManifestMediaType:
+	case IndexMediaType, DockerManifestListMediaType:
+		return nil, "", fmt.Errorf("'%s' is an image index of media type '%s', expected the manifest of an artifact", reference, mediaType)
+	default:
+		if manifest.SchemaVersion != 2 {
+			return nil, "", fmt.Errorf("'%s' has an unsupported manifest media type '%s'", reference, mediaType)
+		}
+	}
+	return &manifest, digest, nil
+}
+
+// Blob returns the content of the blob of the given descriptor. The content
+// is verified against the digest and size of the descriptor while it is
+// read, reading it to the end returns an error if it does not match. The
+// caller is responsible for closing the returned io.ReadCloser.
+func (c *Client) Blob(ctx context.Context, desc Descriptor) (io.ReadCloser, error) {
+	if !strings.HasPrefix(desc.Digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported digest algorithm of blob '%s'", desc.Digest)
+	}
+	resp, err := c.do(ctx, "/v2/"+c.repository+"/blobs/"+desc.Digest, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob '%s': %w", desc.Digest, err)
+	}
+	return &verifyingReader{
+		ReadCloser: resp.Body,
+		reader:     io.LimitReader(resp.Body, desc.Size+1),
+		hash:       sha256.New(),
+		desc:       desc,
+	}, nil
+}
+
+// BlobFile streams the content of the blob of the given descriptor to a
+// temporary file in the given directory, the default directory for
+// temporary files if empty, and returns the file seeked to its start once the
+// content is verified against the digest and size of the descriptor. The
+// content is hashed while it is written, and is never held in memory as a
+// whole. The caller is responsible for closing and removing the returned
+// file, which is removed if the content does not match.
+func (c *Client) BlobFile(ctx context.Context, desc Descriptor, dir string) (*os.File, error) {
+	blob, err := c.Blob(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	f, err := os.CreateTemp(dir, "blob-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, blob); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// verifyingReader reads the content of a blob, verifying its digest and size
+// at the end of the content.
+type verifyingReader struct {
+	io.ReadCloser
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+	desc   Descriptor
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	if r.size > r.desc.Size {
+		return n, fmt.Errorf("blob '%s' exceeds its size of %d bytes", r.desc.Digest, r.desc.Size)
+	}
+	if err == io.EOF {
+		if r.size != r.desc.Size {
+			return n, fmt.Errorf("blob '%s' has a size of %d bytes, expected %d", r.desc.Digest, r.size, r.desc.Size)
+		}
+		if got := "sha256:" + hex.EncodeToString(r.hash.Sum(nil)); got != r.desc.Digest {
+			return n, fmt.Errorf("blob '%s' does not match its digest, got '%s'", r.desc.Digest, got)
+		}
+	}
+	return n, err
+}
+
+// verifyDigest returns an error if the given content does not match the
+// given sha256 digest.
+func verifyDigest(digest string, b []byte) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return fmt.Errorf("unsupported digest algorithm of '%s'", digest)
+	}
+	if got := "sha256:" + sha256Hex(b); got != digest {
+		return fmt.Errorf("content does not match the digest, got '%s'", got)
+	}
+	return nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// do performs an authorized GET request for the given path of the API of the
+// registry, and returns the response if the request succeeded. A request
+// challenged by the registry is authorized with a token, or with the
+// credential for a basic challenge, and retried once. The caller is
+// responsible for closing the response body.
+func (c *Client) do(ctx context.Context, path, accept string) (*http.Response, error) {
+	resp, err := c.get(ctx, path, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		authorization, err := c.authorize(ctx, challenge)
+		if err != nil {
+			return nil, &AuthError{Err: err}
+		}
+		c.authorization = authorization
+		if resp, err = c.get(ctx, path, accept); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, newResponseError(resp)
+}
+
+func (c *Client) get(ctx context.Context, path, accept string) (*http.Response, error) {
+	u, err := c.registry.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	return c.httpClient.Do(req)
+}
+
+// ResponseError is returned for requests that were not successful.
+type ResponseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s (%d): %s", e.Code, e.StatusCode, e.Message)
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("%s (%d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+// newResponseError returns the ResponseError of the given response, with the
+// first error of the body as described in
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes.
+func newResponseError(resp *http.Response) *ResponseError {
+	respErr := &ResponseError{StatusCode: resp.StatusCode}
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body); err == nil && len(body.Errors) > 0 {
+		respErr.Code = body.Errors[0].Code
+		respErr.Message = body.Errors[0].Message
+	}
+	return respErr
+}
+
+// AuthError is returned when the client failed to obtain an authorization
+// for a request challenged by the registry.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authorization failed: %s", e.Err.Error())
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// IsAuthError checks if the error provided is caused by missing, invalid or
+// insufficient credentials.
+func IsAuthError(err error) bool {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return true
+	}
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	return respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden ||
+		respErr.Code == "UNAUTHORIZED" || respErr.Code == "DENIED"
+}
+
+// IsLayerSupported returns if the layer with the given media type can be
+// pulled, see LayerMediaTypes.
+func IsLayerSupported(mediaType string) bool {
+	for _, t := range LayerMediaTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,491 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// SimpleSigningMediaType is the media type of the layers of a cosign
+	// signature manifest, of which the content is the signed payload.
+	SimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// DefaultRekorURL is the URL of the public Rekor transparency log.
+	DefaultRekorURL = "https://rekor.sigstore.dev"
+
+	// PublicKeyExtension is the extension of the fields of a Secret with the
+	// trusted cosign public keys.
+	PublicKeyExtension = ".pub"
+
+	signatureAnnotation   = "dev.cosignproject.cosign/signature"
+	certificateAnnotation = "dev.sigstore.cosign/certificate"
+	chainAnnotation       = "dev.sigstore.cosign/chain"
+	bundleAnnotation      = "dev.sigstore.cosign/bundle"
+
+	// signaturePayloadType is the type of the payload of the signature of a
+	// manifest.
+	signaturePayloadType = "cosign container image signature"
+
+	maxSignaturePayloadSize = 1 << 16
+)
+
+var (
+	// oidcIssuerOID is the extension of the certificates of Fulcio with the
+	// OIDC issuer of the identity, as a raw string.
+	oidcIssuerOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+	// oidcIssuerV2OID is the extension of the certificates of Fulcio with
+	// the OIDC issuer of the identity, as a DER encoded string.
+	oidcIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// Signature is a cosign signature of a manifest: the signed payload, and the
+// certificate and transparency log bundle of a keyless signature.
+type Signature struct {
+	Payload     []byte
+	Signature   []byte
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+	Bundle      *Bundle
+}
+
+// Bundle is the entry of a signature in the Rekor transparency log, with the
+// timestamp of the entry signed by the log.
+type Bundle struct {
+	SignedEntryTimestamp []byte        `json:"SignedEntryTimestamp"`
+	Payload              BundlePayload `json:"Payload"`
+}
+
+// BundlePayload is the signed entry of a Bundle. The fields are in the
+// order of the canonical JSON encoding of the entry, which is signed.
+type BundlePayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// Signatures returns the cosign signatures of the manifest of the given
+// digest, from the layers of the signature manifest tagged
+// 'sha256-<hex>.sig' in the repository.
+func (c *Client) Signatures(ctx context.Context, digest string) ([]Signature, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, fmt.Errorf("invalid digest '%s'", digest)
+	}
+	tag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	manifest, _, err := c.Manifest(ctx, tag)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, fmt.Errorf("no signatures found for '%s'", digest)
+		}
+		return nil, err
+	}
+
+	var signatures []Signature
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != SimpleSigningMediaType {
+			continue
+		}
+		if layer.Size > maxSignaturePayloadSize {
+			return nil, fmt.Errorf("signature payload '%s' exceeds the maximum size of %d bytes", layer.Digest, maxSignaturePayloadSize)
+		}
+		blob, err := c.Blob(ctx, layer)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := io.ReadAll(blob)
+		blob.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signature payload '%s': %w", layer.Digest, err)
+		}
+		signature, err := parseSignature(layer, payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature '%s': %w", layer.Digest, err)
+		}
+		signatures = append(signatures, signature)
+	}
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("no signatures found for '%s' in '%s'", digest, tag)
+	}
+	return signatures, nil
+}
+
+// parseSignature returns the Signature of the given layer of a signature
+// manifest with the given payload.
+func parseSignature(layer Descriptor, payload []byte) (Signature, error) {
+	signature := Signature{Payload: payload}
+	b, err := base64.StdEncoding.DecodeString(layer.Annotations[signatureAnnotation])
+	if err != nil || len(b) == 0 {
+		return signature, fmt.Errorf("annotation '%s' must be a base64 encoded signature", signatureAnnotation)
+	}
+	signature.Signature = b
+
+	if v, ok := layer.Annotations[certificateAnnotation]; ok {
+		certs, err := parseCertificates([]byte(v))
+		if err != nil || len(certs) != 1 {
+			return signature, fmt.Errorf("annotation '%s' must be a PEM encoded certificate", certificateAnnotation)
+		}
+		signature.Certificate = certs[0]
+	}
+	if v, ok := layer.Annotations[chainAnnotation]; ok {
+		if signature.Chain, err = parseCertificates([]byte(v)); err != nil {
+			return signature, fmt.Errorf("annotation '%s' must be PEM encoded certificates: %w", chainAnnotation, err)
+		}
+	}
+	if v, ok := layer.Annotations[bundleAnnotation]; ok {
+		signature.Bundle = &Bundle{}
+		if err := json.Unmarshal([]byte(v), signature.Bundle); err != nil {
+			return signature, fmt.Errorf("failed to decode annotation '%s': %w", bundleAnnotation, err)
+		}
+	}
+	return signature, nil
+}
+
+// parseCertificates returns the certificates of the given PEM blocks.
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// Identity is an OIDC identity of which the certificate of a keyless
+// signature is issued, matching the issuer and the subject of the
+// certificate.
+type Identity struct {
+	Issuer  *regexp.Regexp
+	Subject *regexp.Regexp
+}
+
+// Verifier verifies the cosign signatures of manifests, with one of the
+// trusted public keys if any, or else keyless: with a certificate of the
+// trusted roots issued to one of the trusted identities when it was
+// recorded in the Rekor transparency log.
+type Verifier struct {
+	// PublicKeys are the trusted public keys by name.
+	PublicKeys map[string]crypto.PublicKey
+
+	// Identities are the trusted identities of the keyless signatures.
+	Identities []Identity
+
+	// Roots are the trusted roots of the certificates of the keyless
+	// signatures.
+	Roots *x509.CertPool
+
+	// RekorPublicKey is the public key of the Rekor transparency log of the
+	// keyless signatures.
+	RekorPublicKey crypto.PublicKey
+}
+
+// VerifiedSignature describes the identity of a verified signature: the name
+// of the public key it was verified with, or the issuer and subject of the
+// certificate of a keyless signature.
+type VerifiedSignature struct {
+	Key     string
+	Issuer  string
+	Subject string
+}
+
+// Verify returns the identity of the first of the given signatures that is a
+// valid signature of the manifest of the given digest, or an error with the
+// reason each of them was rejected.
+func (v *Verifier) Verify(digest string, signatures []Signature) (*VerifiedSignature, error) {
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("no signatures found for '%s'", digest)
+	}
+	var errs []string
+	for _, signature := range signatures {
+		verified, err := v.verify(digest, signature)
+		if err == nil {
+			return verified, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("no valid signature of '%s': %s", digest, strings.Join(errs, "; "))
+}
+
+func (v *Verifier) verify(digest string, signature Signature) (*VerifiedSignature, error) {
+	if err := verifyPayload(digest, signature.Payload); err != nil {
+		return nil, err
+	}
+	if len(v.PublicKeys) > 0 {
+		return v.verifyKey(signature)
+	}
+	return v.verifyKeyless(signature)
+}
+
+// verifyPayload verifies that the given signed payload is the payload of a
+// signature of the manifest of the given digest.
+func verifyPayload(digest string, payload []byte) error {
+	var simpleSigning struct {
+		Critical struct {
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+			Type string `json:"type"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &simpleSigning); err != nil {
+		return fmt.Errorf("failed to decode signature payload: %w", err)
+	}
+	if simpleSigning.Critical.Type != signaturePayloadType {
+		return fmt.Errorf("unsupported signature payload type '%s'", simpleSigning.Critical.Type)
+	}
+	if simpleSigning.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for the manifest '%s'", simpleSigning.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
+
+// verifyKey verifies the given signature with the public keys of the
+// Verifier, in the order of their names.
+func (v *Verifier) verifyKey(signature Signature) (*VerifiedSignature, error) {
+	names := make([]string, 0, len(v.PublicKeys))
+	for name := range v.PublicKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if verifySignature(v.PublicKeys[name], signature.Payload, signature.Signature) == nil {
+			return &VerifiedSignature{Key: name}, nil
+		}
+	}
+	return nil, fmt.Errorf("signature does not match any of the public keys: %s", strings.Join(names, ", "))
+}
+
+// verifyKeyless verifies the given signature with its certificate, which must
+// be issued by the roots of the Verifier to one of its identities, and valid
+// at the time of the entry of the signature in the transparency log.
+func (v *Verifier) verifyKeyless(signature Signature) (*VerifiedSignature, error) {
+	cert := signature.Certificate
+	switch {
+	case cert == nil:
+		return nil, fmt.Errorf("signature has no certificate for keyless verification")
+	case signature.Bundle == nil:
+		return nil, fmt.Errorf("signature has no transparency log bundle")
+	case v.Roots == nil:
+		return nil, fmt.Errorf("no trusted roots for keyless verification")
+	case v.RekorPublicKey == nil:
+		return nil, fmt.Errorf("no transparency log public key for keyless verification")
+	}
+
+	if err := verifySignature(cert.PublicKey, signature.Payload, signature.Signature); err != nil {
+		return nil, fmt.Errorf("signature does not match its certificate: %w", err)
+	}
+	integratedTime, err := v.verifyBundle(signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transparency log bundle: %w", err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range signature.Chain {
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, fmt.Errorf("untrusted certificate: %w", err)
+	}
+
+	verified := &VerifiedSignature{Issuer: certificateIssuer(cert), Subject: certificateSubject(cert)}
+	for _, identity := range v.Identities {
+		if identity.Issuer.MatchString(verified.Issuer) && identity.Subject.MatchString(verified.Subject) {
+			return verified, nil
+		}
+	}
+	return nil, fmt.Errorf("certificate of subject '%s' issued by '%s' does not match any of the trusted identities",
+		verified.Subject, verified.Issuer)
+}
+
+// verifyBundle verifies that the bundle of the given signature is signed by
+// the transparency log, and that its entry is the given signature, and
+// returns the time of the entry.
+func (v *Verifier) verifyBundle(signature Signature) (time.Time, error) {
+	bundle := signature.Bundle
+	der, err := x509.MarshalPKIXPublicKey(v.RekorPublicKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if logID := sha256.Sum256(der); hex.EncodeToString(logID[:]) != bundle.Payload.LogID {
+		return time.Time{}, fmt.Errorf("entry of the log '%s', expected '%x'", bundle.Payload.LogID, logID)
+	}
+	payload, err := json.Marshal(bundle.Payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifySignature(v.RekorPublicKey, payload, bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("signed entry timestamp: %w", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode entry: %w", err)
+	}
+	var entry struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content   []byte `json:"content"`
+				PublicKey struct {
+					Content []byte `json:"content"`
+				} `json:"publicKey"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode entry: %w", err)
+	}
+	if entry.Kind != "hashedrekord" {
+		return time.Time{}, fmt.Errorf("unsupported entry kind '%s'", entry.Kind)
+	}
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != sha256Hex(signature.Payload) {
+		return time.Time{}, fmt.Errorf("entry is for another payload")
+	}
+	if !bytes.Equal(entry.Spec.Signature.Content, signature.Signature) {
+		return time.Time{}, fmt.Errorf("entry is for another signature")
+	}
+	certs, err := parseCertificates(entry.Spec.Signature.PublicKey.Content)
+	if err != nil || len(certs) != 1 || !bytes.Equal(certs[0].Raw, signature.Certificate.Raw) {
+		return time.Time{}, fmt.Errorf("entry is for another certificate")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// verifySignature verifies the given signature of the given payload with the
+// given public key.
+func verifySignature(publicKey crypto.PublicKey, payload, signature []byte) error {
+	sum := sha256.Sum256(payload)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, sum[:], signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+// certificateSubject returns the identity of the given certificate of
+// Fulcio: its email address, or else its URI.
+func certificateSubject(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// certificateIssuer returns the OIDC issuer of the identity of the given
+// certificate of Fulcio.
+func certificateIssuer(cert *x509.Certificate) string {
+	var issuer string
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidcIssuerV2OID):
+			var s string
+			if _, err := asn1.Unmarshal(ext.Value, &s); err == nil {
+				return s
+			}
+		case ext.Id.Equal(oidcIssuerOID):
+			issuer = string(ext.Value)
+		}
+	}
+	return issuer
+}
+
+// PublicKeysFromSecret returns the public keys of the fields of the given
+// Secret with the PublicKeyExtension, by field name.
+func PublicKeysFromSecret(secret *corev1.Secret) (map[string]crypto.PublicKey, error) {
+	keys := map[string]crypto.PublicKey{}
+	for name, data := range secret.Data {
+		if !strings.HasSuffix(name, PublicKeyExtension) {
+			continue
+		}
+		key, err := parsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid '%s' secret data: field '%s': %w", secret.Name, name, err)
+		}
+		keys[name] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("invalid '%s' secret data: no public keys in the fields with the '%s' extension",
+			secret.Name, PublicKeyExtension)
+	}
+	return keys, nil
+}
+
+// parsePublicKey returns the public key of the given PEM encoded PKIX public
+// key.
+func parsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("expected a PEM encoded public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pushSignatures adds the signature manifest of the given digest with a
+// layer for each of the given payloads and annotations.
+func (r *testRegistry) pushSignatures(t *testing.T, digest string, payloads [][]byte, annotations []map[string]string) {
+	t.Helper()
+	m := Manifest{SchemaVersion: 2, MediaType: ManifestMediaType}
+	for i, payload := range payloads {
+		layerDigest := "sha256:" + sha256Hex(payload)
+		r.blobs[layerDigest] = payload
+		m.Layers = append(m.Layers, Descriptor{MediaType: SimpleSigningMediaType, Digest: layerDigest,
+			Size: int64(len(payload)), Annotations: annotations[i]})
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	r.manifests[tag] = b
+	r.mediaType[tag] = ManifestMediaType
+}
+
+func signaturePayload(digest string) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"localhost/org/app"},`+
+		`"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, digest))
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) []byte {
+	t.Helper()
+	sum := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func publicKeyPEM(t *testing.T, key crypto.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestClient_Signatures_key(t *testing.T) {
+	registry := newTestRegistry(t)
+	_, digest := registry.push(t, "v1.0.0", FluxContentMediaType, []byte("content"))
+	_, otherDigest := registry.push(t, "v2.0.0", FluxContentMediaType, []byte("other content"))
+	c := registry.client(t)
+	key, otherKey := newKey(t), newKey(t)
+
+	// the payload of the first signature is the payload of another manifest
+	payload := signaturePayload(digest)
+	registry.pushSignatures(t, digest,
+		[][]byte{signaturePayload(otherDigest), payload},
+		[]map[string]string{
+			{signatureAnnotation: base64.StdEncoding.EncodeToString(sign(t, key, signaturePayload(otherDigest)))},
+			{signatureAnnotation: base64.StdEncoding.EncodeToString(sign(t, key, payload))},
+		})
+	registry.pushSignatures(t, otherDigest, [][]byte{signaturePayload(otherDigest)}, []map[string]string{
+		{signatureAnnotation: base64.StdEncoding.EncodeToString(sign(t, otherKey, signaturePayload(otherDigest)))},
+	})
+
+	keys, err := PublicKeysFromSecret(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cosign"},
+		Data: map[string][]byte{
+			"cosign.pub": publicKeyPEM(t, &key.PublicKey),
+			"README.md":  []byte("not a key"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &Verifier{PublicKeys: keys}
+
+	signatures, err := c.Signatures(context.TODO(), digest)
+	if err != nil {
+		t.Fatalf("Signatures() error = %v", err)
+	}
+	if len(signatures) != 2 {
+		t.Fatalf("Signatures() = %d signatures, want 2", len(signatures))
+	}
+	got, err := verifier.Verify(digest, signatures)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if got.Key != "cosign.pub" {
+		t.Errorf("Verify() = %+v, want verified with cosign.pub", got)
+	}
+
+	// the signatures of the manifest of another digest are rejected
+	if _, err := verifier.Verify(otherDigest, signatures[1:]); err == nil || !strings.Contains(err.Error(), "signature is for the manifest") {
+		t.Errorf("Verify() of another digest error = %v, want a digest mismatch", err)
+	}
+
+	// a signature with another key is rejected
+	signatures, err = c.Signatures(context.TODO(), otherDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(otherDigest, signatures); err == nil || !strings.Contains(err.Error(), "does not match any of the public keys: cosign.pub") {
+		t.Errorf("Verify() with another key error = %v, want a key mismatch", err)
+	}
+
+	// an unsigned manifest has no signatures
+	_, unsignedDigest := registry.push(t, "v3.0.0", FluxContentMediaType, []byte("unsigned"))
+	if _, err := c.Signatures(context.TODO(), unsignedDigest); err == nil || !strings.Contains(err.Error(), "no signatures found") {
+		t.Errorf("Signatures() of an unsigned manifest error = %v, want no signatures", err)
+	}
+}
+
+// testCA is a root certificate authority, which issues the certificates of
+// the keyless signatures.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key := newKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sigstore"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a short lived code signing certificate of the given key for
+// the given email and OIDC issuer, which expired an hour ago.
+func (ca *testCA) issue(t *testing.T, key *ecdsa.PrivateKey, email, issuer string) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       time.Now().Add(-70 * time.Minute),
+		NotAfter:        time.Now().Add(-60 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{email},
+		ExtraExtensions: []pkix.Extension{{Id: oidcIssuerOID, Value: []byte(issuer)}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// rekorBundle returns the transparency log bundle of the given signature,
+// signed by the given key of the log, with an entry at the given time.
+func rekorBundle(t *testing.T, rekorKey *ecdsa.PrivateKey, payload, signature []byte, cert *x509.Certificate, integratedTime time.Time) string {
+	t.Helper()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	body := fmt.Sprintf(`{"apiVersion":"0.0.1","kind":"hashedrekord","spec":{"data":{"hash":{"algorithm":"sha256","value":"%s"}},`+
+		`"signature":{"content":"%s","publicKey":{"content":"%s"}}}}`,
+		sha256Hex(payload), base64.StdEncoding.EncodeToString(signature), base64.StdEncoding.EncodeToString(certPEM))
+	der, err := x509.MarshalPKIXPublicKey(&rekorKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := BundlePayload{
+		Body:           base64.StdEncoding.EncodeToString([]byte(body)),
+		IntegratedTime: integratedTime.Unix(),
+		LogID:          sha256Hex(der),
+		LogIndex:       42,
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := json.Marshal(Bundle{SignedEntryTimestamp: sign(t, rekorKey, b), Payload: entry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bundle)
+}
+
+func TestVerifier_keyless(t *testing.T) {
+	registry := newTestRegistry(t)
+	_, digest := registry.push(t, "v1.0.0", FluxContentMediaType, []byte("content"))
+	c := registry.client(t)
+	ca, rekorKey, key := newTestCA(t), newKey(t), newKey(t)
+
+	// the certificate was valid when the signature was recorded in the log
+	payload := signaturePayload(digest)
+	signature := sign(t, key, payload)
+	cert := ca.issue(t, key, "flux@example.com", "https://accounts.example.com")
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	registry.pushSignatures(t, digest, [][]byte{payload}, []map[string]string{{
+		signatureAnnotation:   base64.StdEncoding.EncodeToString(signature),
+		certificateAnnotation: certPEM,
+		chainAnnotation:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})),
+		bundleAnnotation:      rekorBundle(t, rekorKey, payload, signature, cert, time.Now().Add(-65*time.Minute)),
+	}})
+	signatures, err := c.Signatures(context.TODO(), digest)
+	if err != nil {
+		t.Fatalf("Signatures() error = %v", err)
+	}
+
+	verifier := func(subject string) *Verifier {
+		return &Verifier{
+			Identities: []Identity{{
+				Issuer:  regexp.MustCompile(`^https://accounts\.example\.com$`),
+				Subject: regexp.MustCompile(subject),
+			}},
+			Roots:          ca.pool,
+			RekorPublicKey: &rekorKey.PublicKey,
+		}
+	}
+	got, err := verifier(`^.*@example\.com$`).Verify(digest, signatures)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if got.Subject != "flux@example.com" || got.Issuer != "https://accounts.example.com" || got.Key != "" {
+		t.Errorf("Verify() = %+v, want the identity of the certificate", got)
+	}
+
+	tests := []struct {
+		name     string
+		verifier func() *Verifier
+		modify   func(s *Signature)
+		wantErr  string
+	}{
+		{
+			name:     "untrusted identity",
+			verifier: func() *Verifier { return verifier(`^admin@example\.com$`) },
+			wantErr:  "certificate of subject 'flux@example.com' issued by 'https://accounts.example.com' does not match any of the trusted identities",
+		},
+		{
+			name: "untrusted root",
+			verifier: func() *Verifier {
+				v := verifier(`.*`)
+				v.Roots = newTestCA(t).pool
+				return v
+			},
+			wantErr: "untrusted certificate",
+		},
+		{
+			name: "another log",
+			verifier: func() *Verifier {
+				v := verifier(`.*`)
+				v.RekorPublicKey = &newKey(t).PublicKey
+				return v
+			},
+			wantErr: "invalid transparency log bundle: entry of the log",
+		},
+		{
+			name:     "tampered entry time",
+			verifier: func() *Verifier { return verifier(`.*`) },
+			modify:   func(s *Signature) { s.Bundle.Payload.IntegratedTime = time.Now().Unix() },
+			wantErr:  "signed entry timestamp",
+		},
+		{
+			name:     "no bundle",
+			verifier: func() *Verifier { return verifier(`.*`) },
+			modify:   func(s *Signature) { s.Bundle = nil },
+			wantErr:  "signature has no transparency log bundle",
+		},
+		{
+			name:     "signature of another key",
+			verifier: func() *Verifier { return verifier(`.*`) },
+			modify:   func(s *Signature) { s.Signature = sign(t, newKey(t), payload) },
+			wantErr:  "signature does not match its certificate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := signatures[0]
+			bundle := *s.Bundle
+			s.Bundle = &bundle
+			if tt.modify != nil {
+				tt.modify(&s)
+			}
+			if _, err := tt.verifier().Verify(digest, []Signature{s}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublicKeysFromSecret(t *testing.T) {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "cosign"}, Data: map[string][]byte{"key": []byte("value")}}
+	if _, err := PublicKeysFromSecret(secret); err == nil || !strings.Contains(err.Error(), "no public keys") {
+		t.Errorf("PublicKeysFromSecret() without keys error = %v, want no public keys", err)
+	}
+	secret.Data["cosign.pub"] = []byte("-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n")
+	if _, err := PublicKeysFromSecret(secret); err == nil || !strings.Contains(err.Error(), "field 'cosign.pub'") {
+		t.Errorf("PublicKeysFromSecret() with an invalid key error = %v, want an invalid field", err)
+	}
+}
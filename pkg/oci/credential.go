@@ -0,0 +1,266 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/fluxcd/source-controller/internal/secretdata"
+	"github.com/fluxcd/source-controller/internal/transport"
+)
+
+// Credential is the username and password, or the identity token, of a
+// registry.
+type Credential struct {
+	Username string
+	Password string
+	// IdentityToken is a refresh token exchanged for the access tokens of
+	// the registry, instead of the username and password.
+	IdentityToken string
+}
+
+// dockerConfig is the content of the corev1.DockerConfigJsonKey field of a
+// Secret of type corev1.SecretTypeDockerConfigJson.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+}
+
+// tlsFields are the fields of a Secret with the TLS configuration of the
+// registry, of which a Secret without credentials may consist.
+var tlsFields = []string{transport.CAFileField, transport.CACrtField, transport.CertFileField, transport.KeyFileField,
+	corev1.TLSCertKey, corev1.TLSPrivateKeyKey}
+
+// CredentialFromSecret returns the Credential of the given registry host in
+// the corev1.DockerConfigJsonKey field of the given Secret, or else in its
+// 'username' and 'password' fields, as the basic auth of a HelmRepository.
+// It returns nil if the Secret is nil, has no credentials for the host, as
+// the repository may be public, or has only the TLS configuration of the
+// registry. The keys of the auths may be a host, or a URL of the host.
+func CredentialFromSecret(secret *corev1.Secret, host string) (*Credential, error) {
+	if secret == nil {
+		return nil, nil
+	}
+	data, ok := secret.Data[corev1.DockerConfigJsonKey]
+	if !ok {
+		return basicCredentialFromSecret(secret)
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid '%s' secret data: failed to decode '%s': %w", secret.Name, corev1.DockerConfigJsonKey, err)
+	}
+	for key, auth := range config.Auths {
+		if !matchesHost(key, host) {
+			continue
+		}
+		credential := &Credential{Username: auth.Username, Password: auth.Password, IdentityToken: auth.IdentityToken}
+		if auth.Auth != "" {
+			b, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s' secret data: failed to decode the auth of '%s': %w", secret.Name, key, err)
+			}
+			parts := strings.SplitN(string(b), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid '%s' secret data: the auth of '%s' must be in the form 'username:password'", secret.Name, key)
+			}
+			credential.Username, credential.Password = parts[0], parts[1]
+		}
+		return credential, nil
+	}
+	return nil, nil
+}
+
+// basicCredentialFromSecret returns the Credential in the 'username' and
+// 'password' fields of the given Secret, or nil if it has neither and has
+// the TLS configuration of the registry.
+func basicCredentialFromSecret(secret *corev1.Secret) (*Credential, error) {
+	username, password := string(secret.Data["username"]), string(secret.Data["password"])
+	switch {
+	case username != "" && password != "":
+		for _, field := range []string{"username", "password"} {
+			if err := secretdata.CheckCredential(secret.Name, field, secret.Data[field]); err != nil {
+				return nil, err
+			}
+		}
+		return &Credential{Username: username, Password: password}, nil
+	case username != "" || password != "":
+		return nil, fmt.Errorf("invalid '%s' secret data: required fields 'username' and 'password'", secret.Name)
+	}
+	for _, field := range tlsFields {
+		if _, ok := secret.Data[field]; ok {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid '%s' secret data: required field '%s' of a secret of type '%s', or fields 'username' and 'password'",
+		secret.Name, corev1.DockerConfigJsonKey, corev1.SecretTypeDockerConfigJson)
+}
+
+// matchesHost returns if the given key of the auths of a Docker config is
+// the given registry host, or a URL of it. The keys of Docker Hub match any
+// of its hosts.
+func matchesHost(key, host string) bool {
+	if strings.Contains(key, "://") {
+		u, err := url.Parse(key)
+		if err != nil {
+			return false
+		}
+		key = u.Host
+	} else {
+		key = strings.SplitN(key, "/", 2)[0]
+	}
+	return key == host || apiHost(key) == apiHost(host)
+}
+
+// authorize returns the value of the Authorization header of the requests
+// answering the given WWW-Authenticate challenge of the registry: a token of
+// the token service of a Bearer challenge, or the basic credentials for a
+// Basic challenge.
+func (c *Client) authorize(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return c.token(ctx, params)
+	case "basic":
+		if c.credential == nil || c.credential.Username == "" {
+			return "", fmt.Errorf("the registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.credential.Username+":"+c.credential.Password)), nil
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge '%s'", challenge)
+	}
+}
+
+// token returns the Authorization of a token of the token service in the
+// realm of the given challenge, for the service and scope of the challenge,
+// or the pull scope of the repository. The credential authorizes the token
+// request, or the token is anonymous.
+func (c *Client) token(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid realm '%s' of the authentication challenge", params["realm"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + c.repository + ":pull"
+	}
+
+	var req *http.Request
+	if c.credential != nil && c.credential.IdentityToken != "" {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {c.credential.IdentityToken},
+			"service":       {params["service"]},
+			"scope":         {scope},
+			"client_id":     {"source-controller"},
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		query.Set("scope", scope)
+		realm.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if c.credential != nil && c.credential.Username != "" {
+			req.SetBasicAuth(c.credential.Username, c.credential.Password)
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %w", newResponseError(resp))
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode token: %w", err)
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("the token service returned no token")
+	}
+	return "Bearer " + token, nil
+}
+
+// parseChallenge returns the scheme and the parameters of the given
+// WWW-Authenticate challenge, e.g.
+// 'Bearer realm="https://auth.docker.io/token",service="registry.docker.io"'.
+func parseChallenge(challenge string) (string, map[string]string) {
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	params := map[string]string{}
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end+1:]
+			}
+		}
+		params[key] = value
+	}
+	return parts[0], params
+}
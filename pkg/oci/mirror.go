@@ -0,0 +1,138 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// Mirrors is the configuration of the mirrors of the registries, e.g. the
+// pull-through caches of an internal registry, through which the artifacts
+// are pulled instead of from the registries of their URLs.
+type Mirrors struct {
+	Mirrors []Mirror `json:"mirrors"`
+}
+
+// Mirror is the mirror of the repositories of a registry host.
+type Mirror struct {
+	// Host is the host of the mirrored registry, e.g. 'ghcr.io'.
+	Host string `json:"host"`
+
+	// Mirror is the host of the mirror, with an optional path prefix of the
+	// mirrored repositories, e.g. 'registry.example.com/ghcr'.
+	Mirror string `json:"mirror"`
+
+	// SecretRef is the secret with the credentials of the mirror, of type
+	// 'kubernetes.io/dockerconfigjson', optionally with the CA certificate
+	// of the mirror in a caFile or ca.crt field.
+	SecretRef *MirrorSecretRef `json:"secretRef,omitempty"`
+
+	// Insecure allows connecting to the mirror over plain HTTP.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// MirrorSecretRef is the reference of the secret of a Mirror.
+type MirrorSecretRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// LoadMirrors returns the Mirrors of the given YAML or JSON file, of which
+// every mirror is validated.
+func LoadMirrors(path string) (*Mirrors, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mirrors Mirrors
+	if err := yaml.UnmarshalStrict(b, &mirrors); err != nil {
+		return nil, fmt.Errorf("failed to decode the mirrors of '%s': %w", path, err)
+	}
+	hosts := map[string]bool{}
+	for i, m := range mirrors.Mirrors {
+		if m.Host == "" || strings.ContainsAny(m.Host, "/@") {
+			return nil, fmt.Errorf("mirror %d of '%s': the host must be a registry host, e.g. 'ghcr.io'", i, path)
+		}
+		if hosts[apiHost(m.Host)] {
+			return nil, fmt.Errorf("mirror %d of '%s': duplicate host '%s'", i, path, m.Host)
+		}
+		hosts[apiHost(m.Host)] = true
+		if _, _, err := ParseURL("oci://" + strings.Trim(m.Mirror, "/") + "/repository"); err != nil || m.Mirror == "" {
+			return nil, fmt.Errorf("mirror %d of '%s': the mirror must be a host with an optional path, e.g. 'registry.example.com/ghcr'", i, path)
+		}
+		if m.SecretRef != nil && (m.SecretRef.Namespace == "" || m.SecretRef.Name == "") {
+			return nil, fmt.Errorf("mirror %d of '%s': the secretRef must have a namespace and a name", i, path)
+		}
+	}
+	return &mirrors, nil
+}
+
+// Lookup returns the Mirror of the given registry host, or nil if it has no
+// mirror or m is nil. The hosts of Docker Hub match any of its hosts.
+func (m *Mirrors) Lookup(host string) *Mirror {
+	if m == nil {
+		return nil
+	}
+	for i := range m.Mirrors {
+		if m.Mirrors[i].Host == host || apiHost(m.Mirrors[i].Host) == apiHost(host) {
+			return &m.Mirrors[i]
+		}
+	}
+	return nil
+}
+
+// URL returns the 'oci://' URL of the given repository of the mirrored
+// registry in the mirror.
+func (m *Mirror) URL(repository string) string {
+	return "oci://" + strings.Trim(m.Mirror, "/") + "/" + repository
+}
+
+// MirrorHost returns the host of the mirror, without its path prefix.
+func (m *Mirror) MirrorHost() string {
+	u, err := url.Parse("oci://" + strings.Trim(m.Mirror, "/"))
+	if err != nil {
+		return m.Mirror
+	}
+	return u.Host
+}
+
+// NewClient creates a new Client for the given repository of the mirrored
+// registry in the mirror, authorized with the credentials of the mirror in
+// the given Secret, which may be nil.
+func (m *Mirror) NewClient(repository string, secret *corev1.Secret) (*Client, error) {
+	return NewClient(sourcev1.OCIRepository{Spec: sourcev1.OCIRepositorySpec{
+		URL:      m.URL(repository),
+		Insecure: m.Insecure,
+	}}, secret)
+}
+
+// IsNotFound returns if the given error is the error of a manifest, blob or
+// repository not found in the registry, e.g. a miss of a mirror.
+func IsNotFound(err error) bool {
+	var respErr *ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
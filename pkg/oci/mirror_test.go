@@ -0,0 +1,102 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadMirrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "valid", config: `
+mirrors:
+- host: docker.io
+  mirror: registry.example.com/dockerhub
+  secretRef:
+    namespace: flux-system
+    name: mirror
+- host: ghcr.io
+  mirror: registry.example.com:5000
+  insecure: true
+`},
+		{name: "unknown field", config: "mirrors:\n- host: ghcr.io\n  mirrors: registry.example.com\n", wantErr: "unknown field"},
+		{name: "URL host", config: "mirrors:\n- host: https://ghcr.io\n  mirror: registry.example.com\n", wantErr: "the host must be a registry host"},
+		{name: "no mirror", config: "mirrors:\n- host: ghcr.io\n", wantErr: "the mirror must be a host"},
+		{name: "duplicate Docker Hub host", config: "mirrors:\n- host: docker.io\n  mirror: a.example.com\n- host: index.docker.io\n  mirror: b.example.com\n",
+			wantErr: "duplicate host 'index.docker.io'"},
+		{name: "secret without namespace", config: "mirrors:\n- host: ghcr.io\n  mirror: registry.example.com\n  secretRef:\n    name: mirror\n",
+			wantErr: "the secretRef must have a namespace and a name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mirrors.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadMirrors(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadMirrors() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadMirrors() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMirrors_Lookup(t *testing.T) {
+	mirrors := &Mirrors{Mirrors: []Mirror{
+		{Host: "docker.io", Mirror: "registry.example.com/dockerhub/"},
+		{Host: "ghcr.io", Mirror: "registry.example.com:5000"},
+	}}
+
+	// the bare names of Docker Hub are mirrored in the library namespace
+	host, repository, err := ParseURL("oci://index.docker.io/podinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mirrors.Lookup(host)
+	if m == nil {
+		t.Fatalf("Lookup(%s) = nil, want the mirror of docker.io", host)
+	}
+	if got := m.URL(repository); got != "oci://registry.example.com/dockerhub/library/podinfo" {
+		t.Errorf("URL() = %s, want the repository in the mirror", got)
+	}
+	if got := m.MirrorHost(); got != "registry.example.com" {
+		t.Errorf("MirrorHost() = %s, want the host without the path", got)
+	}
+	if m := mirrors.Lookup("ghcr.io"); m == nil || m.MirrorHost() != "registry.example.com:5000" {
+		t.Errorf("Lookup(ghcr.io) = %+v, want the mirror of ghcr.io", m)
+	}
+	if m := mirrors.Lookup("quay.io"); m != nil {
+		t.Errorf("Lookup(quay.io) = %+v, want nil", m)
+	}
+	var nilMirrors *Mirrors
+	if m := nilMirrors.Lookup("ghcr.io"); m != nil {
+		t.Errorf("nil Lookup() = %+v, want nil", m)
+	}
+}
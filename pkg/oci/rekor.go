@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"crypto"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// defaultRekorPublicKey is the pinned public key of the public Rekor
+// transparency log at DefaultRekorURL, of which the log ID is
+// 'c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d'.
+const defaultRekorPublicKey = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE2G2Y+2tabdTV5BcGiBIx0a9fAFwr
+kBbmLSGtks4L3qX6yYY0zufBnhC8Ur/iy55GhWP/9A/bY2LhC30M9+RYtw==
+-----END PUBLIC KEY-----
+`
+
+// RekorKeys is the configuration of the public keys of the Rekor
+// transparency logs trusted for the keyless verification, e.g. of a private
+// log or of a mirror of the public log in an air-gapped environment. The
+// keys are never read from the logs themselves, as a log would then vouch
+// for its own entries.
+type RekorKeys struct {
+	Logs []RekorLog `json:"logs"`
+}
+
+// RekorLog is the public key of a Rekor transparency log.
+type RekorLog struct {
+	// URL is the URL of the log, as in the spec of the sources, e.g.
+	// 'https://rekor.example.com'.
+	URL string `json:"url"`
+
+	// PublicKey is the PEM encoded public key of the log.
+	PublicKey string `json:"publicKey"`
+}
+
+// LoadRekorKeys returns the RekorKeys of the given YAML or JSON file, of
+// which every log is validated.
+func LoadRekorKeys(path string) (*RekorKeys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys RekorKeys
+	if err := yaml.UnmarshalStrict(b, &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode the transparency logs of '%s': %w", path, err)
+	}
+	urls := map[string]bool{}
+	for i, log := range keys.Logs {
+		u, err := url.Parse(log.URL)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("log %d of '%s': the URL must be an HTTP/S URL, e.g. 'https://rekor.example.com'", i, path)
+		}
+		if urls[rekorKey(log.URL)] {
+			return nil, fmt.Errorf("log %d of '%s': duplicate URL '%s'", i, path, log.URL)
+		}
+		if _, err := parsePublicKey([]byte(log.PublicKey)); err != nil {
+			return nil, fmt.Errorf("log %d of '%s': invalid public key: %w", i, path, err)
+		}
+		urls[rekorKey(log.URL)] = true
+	}
+	return &keys, nil
+}
+
+// Lookup returns the public key of the transparency log at the given URL,
+// or nil if it has none. The key of the public log at DefaultRekorURL is
+// pinned, unless k overrides it. A nil RekorKeys only has the pinned key.
+func (k *RekorKeys) Lookup(rekorURL string) crypto.PublicKey {
+	encoded := ""
+	if rekorKey(rekorURL) == rekorKey(DefaultRekorURL) {
+		encoded = defaultRekorPublicKey
+	}
+	if k != nil {
+		for _, log := range k.Logs {
+			if rekorKey(log.URL) == rekorKey(rekorURL) {
+				encoded = log.PublicKey
+			}
+		}
+	}
+	if encoded == "" {
+		return nil
+	}
+	key, err := parsePublicKey([]byte(encoded))
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// rekorKey returns the given URL of a log without its trailing slash, by
+// which the logs are compared.
+func rekorKey(rekorURL string) string {
+	return strings.TrimSuffix(rekorURL, "/")
+}
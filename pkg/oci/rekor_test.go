@@ -0,0 +1,95 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRekorKeys(t *testing.T) {
+	key := strings.ReplaceAll(string(publicKeyPEM(t, &newKey(t).PublicKey)), "\n", "\n    ")
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "valid", config: "logs:\n- url: https://rekor.example.com\n  publicKey: |\n    " + key},
+		{name: "unknown field", config: "logs:\n- url: https://rekor.example.com\n  key: |\n    " + key, wantErr: "unknown field"},
+		{name: "host URL", config: "logs:\n- url: rekor.example.com\n  publicKey: |\n    " + key, wantErr: "the URL must be an HTTP/S URL"},
+		{name: "invalid key", config: "logs:\n- url: https://rekor.example.com\n  publicKey: key\n", wantErr: "invalid public key"},
+		{name: "duplicate URL", config: "logs:\n- url: https://rekor.example.com\n  publicKey: |\n    " + key +
+			"\n- url: https://rekor.example.com/\n  publicKey: |\n    " + key, wantErr: "duplicate URL 'https://rekor.example.com/'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rekor.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadRekorKeys(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadRekorKeys() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadRekorKeys() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRekorKeys_Lookup(t *testing.T) {
+	// the key of the public log is pinned, and not read from the log
+	var nilKeys *RekorKeys
+	pinned := nilKeys.Lookup(DefaultRekorURL + "/")
+	if pinned == nil {
+		t.Fatalf("nil Lookup(%s) = nil, want the pinned key", DefaultRekorURL)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(der); hex.EncodeToString(sum[:]) != "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d" {
+		t.Errorf("log ID of the pinned key = %x, want the log ID of the public log", sum)
+	}
+	if key := nilKeys.Lookup("https://rekor.example.com"); key != nil {
+		t.Errorf("nil Lookup(https://rekor.example.com) = %v, want nil", key)
+	}
+
+	key, mirrorKey := newKey(t), newKey(t)
+	keys := &RekorKeys{Logs: []RekorLog{
+		{URL: "https://rekor.example.com/", PublicKey: string(publicKeyPEM(t, &key.PublicKey))},
+		{URL: DefaultRekorURL, PublicKey: string(publicKeyPEM(t, &mirrorKey.PublicKey))},
+	}}
+	if got := keys.Lookup("https://rekor.example.com"); !key.PublicKey.Equal(got) {
+		t.Errorf("Lookup(https://rekor.example.com) = %v, want the key of the log", got)
+	}
+	if got := keys.Lookup(DefaultRekorURL); !mirrorKey.PublicKey.Equal(got) {
+		t.Errorf("Lookup(%s) = %v, want the key overriding the pinned key", DefaultRekorURL, got)
+	}
+	if got := keys.Lookup("https://rekor.other.com"); got != nil {
+		t.Errorf("Lookup(https://rekor.other.com) = %v, want nil", got)
+	}
+}